@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Every API error is {"error": {"code", "message", "details"}}. The code
+// follows from the status and is what integrators should branch on; the
+// message is for people and may change.
+const (
+	codeValidationFailed = "validation_failed"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeConflict         = "conflict"
+	codeUnavailable      = "unavailable"
+	codeInternal         = "internal"
+)
+
+// errorCodes documents the codes, for the OpenAPI document.
+var errorCodes = []struct{ Code, Meaning string }{
+	{codeValidationFailed, "the request was malformed or its values were refused (400, 422)"},
+	{codeUnauthorized, "no staff key, or one that is unknown or revoked (401)"},
+	{codeForbidden, "the staff key's role is below the route's (403)"},
+	{codeNotFound, "the route or what it names does not exist (404)"},
+	{codeMethodNotAllowed, "the route exists, but not for this method (405)"},
+	{codeConflict, "the request clashes with the current state (409)"},
+	{codeUnavailable, "the API or what it needs is switched off (503)"},
+	{codeInternal, "something failed on our side; the log has the cause (500)"},
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Details any    `json:"details,omitempty"`
+}
+
+type apiErrorResponse struct {
+	Error apiError `json:"error"`
+}
+
+func errorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity, http.StatusRequestEntityTooLarge:
+		return codeValidationFailed
+	case http.StatusUnauthorized:
+		return codeUnauthorized
+	case http.StatusForbidden:
+		return codeForbidden
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusMethodNotAllowed:
+		return codeMethodNotAllowed
+	case http.StatusConflict:
+		return codeConflict
+	case http.StatusServiceUnavailable:
+		return codeUnavailable
+	}
+	return codeInternal
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("error writing response: ", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeAPIError(w, status, msg, nil)
+}
+
+// writeAPIError is writeJSONError with details, e.g. which field was wrong.
+func writeAPIError(w http.ResponseWriter, status int, msg string, details any) {
+	writeJSON(w, status, apiErrorResponse{Error: apiError{Code: errorCode(status), Message: msg, Details: details}})
+}
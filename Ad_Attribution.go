@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// A customer's first message after tapping a click-to-WhatsApp ad or the
+// business catalog carries where they came from in its ContextInfo. The
+// first such referral is kept on their profile, and the first order they
+// start after it is attributed to it, so the funnel report can show which
+// ads produce paid orders.
+
+const defaultAdGreeting = "Thanks for clicking our special!"
+
+// adReferral is the source of a message, as WhatsApp reports it.
+type adReferral struct {
+	// Source is the entry point, e.g. "ctwa_ad" or "catalog".
+	Source string
+	// Type is what was tapped, e.g. "ad" or "post".
+	Type     string
+	SourceID string
+	Title    string
+	URL      string
+	ClickID  string
+}
+
+// label names the referral in reports: the ad's title where it has one.
+func (r adReferral) label() string {
+	if r.Title != "" {
+		return r.Title
+	}
+	return r.SourceID
+}
+
+// fromAd reports whether the customer arrived by tapping an ad, as
+// opposed to e.g. the catalog.
+func (r adReferral) fromAd() bool {
+	return r.ClickID != "" || r.Type == "ad"
+}
+
+// messageReferral returns where m came from, and false for messages the
+// customer simply typed.
+func messageReferral(m *waProto.Message) (adReferral, bool) {
+	var ctx *waProto.ContextInfo
+	switch {
+	case m.GetExtendedTextMessage() != nil:
+		ctx = m.GetExtendedTextMessage().GetContextInfo()
+	case m.GetImageMessage() != nil:
+		ctx = m.GetImageMessage().GetContextInfo()
+	default:
+		return adReferral{}, false
+	}
+	ad := ctx.GetExternalAdReply()
+	r := adReferral{
+		Source:   ctx.GetEntryPointConversionSource(),
+		Type:     ad.GetSourceType(),
+		SourceID: ad.GetSourceID(),
+		Title:    ad.GetTitle(),
+		URL:      ad.GetSourceURL(),
+		ClickID:  ad.GetCtwaClid(),
+	}
+	if r.Source == "" {
+		r.Source = ctx.GetConversionSource()
+	}
+	if r.Source == "" {
+		r.Source = r.Type
+	}
+	if r.Source == "" && r.SourceID == "" {
+		return adReferral{}, false
+	}
+	return r, true
+}
+
+// recordReferral keeps r on the customer's profile unless an earlier
+// referral is already there.
+func recordReferral(db *sql.DB, cell string, r adReferral) error {
+	_, err := db.Exec(`INSERT INTO customer_profiles (cell_number, ad_source, ad_source_id, ad_title, ad_url, ad_click_id, ad_seen_at)
+		VALUES ($1, $2, $3, $4, $5, $6, now())
+		ON CONFLICT (cell_number) DO UPDATE SET ad_source = EXCLUDED.ad_source, ad_source_id = EXCLUDED.ad_source_id,
+			ad_title = EXCLUDED.ad_title, ad_url = EXCLUDED.ad_url, ad_click_id = EXCLUDED.ad_click_id, ad_seen_at = now()
+		WHERE customer_profiles.ad_seen_at IS NULL`,
+		cell, r.Source, r.SourceID, r.Title, r.URL, r.ClickID)
+	if err != nil {
+		return fmt.Errorf("recording referral of %s: %w", cell, err)
+	}
+	return nil
+}
+
+// attributeOrder stamps a new order with the customer's referral if it is
+// their first order since it. Orders of customers who didn't come from an
+// ad, and later orders of those who did, are left alone.
+func attributeOrder(db *sql.DB, cell string, orderID int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var source, sourceID string
+	err = tx.QueryRow(`UPDATE customer_profiles SET ad_order_id = $2
+		WHERE cell_number = $1 AND ad_seen_at IS NOT NULL AND ad_order_id IS NULL
+		RETURNING ad_source, ad_source_id`, cell, orderID).Scan(&source, &sourceID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO order_meta (order_id, pricelist_version, ad_source, ad_source_id) VALUES ($1, 0, $2, $3)
+		ON CONFLICT (order_id) DO UPDATE SET ad_source = EXCLUDED.ad_source, ad_source_id = EXCLUDED.ad_source_id, updated_at = now()`,
+		orderID, source, sourceID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	metrics.Inc("menubot_ad_orders_total", "Orders attributed to the ad or catalog entry point the customer came from.", "source", source)
+	return nil
+}
+
+// noteReferral records where an inbound message came from, if anywhere,
+// and returns the greeting to put in front of the reply.
+func noteReferral(db *sql.DB, cell string, m *waProto.Message) (greeting string) {
+	r, ok := messageReferral(m)
+	if !ok {
+		return ""
+	}
+	log.Printf("Message from %s came from %s %s", cell, r.Source, r.label())
+	metrics.Inc("menubot_ad_referrals_total", "Inbound messages that came from an ad or catalog entry point.", "source", r.Source)
+	if err := recordReferral(db, cell, r); err != nil {
+		log.Printf("Ad attribution: %v", err)
+	}
+	if rc := cfg(); rc.AdGreeting != "" && r.fromAd() {
+		return rc.message("AD_GREETING", map[string]string{"ad": r.label()})
+	}
+	return ""
+}
+
+type adSourceReport struct {
+	Source   string `json:"source"`
+	SourceID string `json:"source_id,omitempty"`
+	Title    string `json:"title,omitempty"`
+	// Customers arrived from the source within the report's range, Orders
+	// is how many of them went on to start an order and Paid how many paid
+	// for it.
+	Customers int64   `json:"customers"`
+	Orders    int64   `json:"orders"`
+	Paid      int64   `json:"paid"`
+	PaidPct   float64 `json:"paid_pct"`
+}
+
+// buildAdSourceReport counts, per ad, the customers who arrived from it
+// between from and to and what became of their first order.
+func buildAdSourceReport(db *sql.DB, from, to time.Time) ([]adSourceReport, error) {
+	rows, err := db.Query(`SELECT p.ad_source, p.ad_source_id, max(p.ad_title), count(*), count(m.order_id), count(m.paid_at)
+		FROM customer_profiles p LEFT JOIN order_meta m ON m.order_id = p.ad_order_id
+		WHERE p.ad_seen_at >= $1 AND p.ad_seen_at < $2
+		GROUP BY p.ad_source, p.ad_source_id ORDER BY count(m.paid_at) DESC, count(*) DESC`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sources := []adSourceReport{}
+	for rows.Next() {
+		var s adSourceReport
+		if err := rows.Scan(&s.Source, &s.SourceID, &s.Title, &s.Customers, &s.Orders, &s.Paid); err != nil {
+			return nil, err
+		}
+		if s.Customers > 0 {
+			s.PaidPct = float64(s.Paid) * 100 / float64(s.Customers)
+		}
+		sources = append(sources, s)
+	}
+	return sources, rows.Err()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Staff authenticate to the admin API with "Authorization: Bearer <key>"
+// and to the dashboard with the same key. ADMIN_API_KEY is the admin's
+// key; everyone else gets a key of their own from /api/staff/keys, with a
+// role that decides what it may do. With ADMIN_API_KEY unset the admin
+// routes are refused outright rather than left open.
+
+// Staff roles, each allowed everything the roles after it are.
+const (
+	roleAdmin   = "admin"
+	roleManager = "manager"
+	roleKitchen = "kitchen"
+	roleDriver  = "driver"
+)
+
+var roleRank = map[string]int{roleAdmin: 4, roleManager: 3, roleKitchen: 2, roleDriver: 1}
+
+// adminKeyName is who requests made with ADMIN_API_KEY are from.
+const adminKeyName = "ADMIN_API_KEY"
+
+// staffIdentity is who a request is from. KeyID is 0 for ADMIN_API_KEY.
+type staffIdentity struct {
+	KeyID int64
+	Name  string
+	Role  string
+}
+
+func (s staffIdentity) can(role string) bool {
+	return roleRank[s.Role] >= roleRank[role]
+}
+
+type staffAuth struct {
+	db       *sql.DB
+	adminKey string
+}
+
+func hashStaffKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Resolve returns whose key this is. Revoked keys resolve to nobody.
+func (a staffAuth) Resolve(key string) (staffIdentity, bool) {
+	if key == "" {
+		return staffIdentity{}, false
+	}
+	if a.adminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(a.adminKey)) == 1 {
+		return staffIdentity{Name: adminKeyName, Role: roleAdmin}, true
+	}
+	// Only the hash is stored, so the lookup itself gives nothing away
+	// about how close a wrong key was.
+	var s staffIdentity
+	err := a.db.QueryRow(`UPDATE staff_keys SET last_used_at = now() WHERE key_hash = $1 AND revoked_at IS NULL
+		RETURNING id, name, role`, hashStaffKey(key)).Scan(&s.KeyID, &s.Name, &s.Role)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Looking up staff key failed: %v", err)
+		}
+		return staffIdentity{}, false
+	}
+	return s, true
+}
+
+type staffIdentityKey struct{}
+
+func staffFromContext(ctx context.Context) staffIdentity {
+	s, _ := ctx.Value(staffIdentityKey{}).(staffIdentity)
+	return s
+}
+
+func withStaff(r *http.Request, s staffIdentity) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), staffIdentityKey{}, s))
+}
+
+// requireStaffKey guards the admin API with a staff key.
+func requireStaffKey(auth staffAuth) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if auth.adminKey == "" {
+				writeJSONError(w, http.StatusServiceUnavailable, "admin API disabled, set ADMIN_API_KEY")
+				return
+			}
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			staff, ok := auth.Resolve(token)
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+				return
+			}
+			next.ServeHTTP(w, withStaff(r, staff))
+		})
+	}
+}
+
+// requireRole refuses requests from staff below role.
+func requireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !staffFromContext(r.Context()).can(role) {
+				writeJSONError(w, http.StatusForbidden, "forbidden, needs the "+role+" role or above")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
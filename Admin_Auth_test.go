@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeStaffDB answers the two queries the admin API's guards make: looking
+// up a staff key and writing the audit log. Anything else fails, which is
+// fine for handlers the guards let through.
+type fakeStaffDB struct {
+	mu    sync.Mutex
+	keys  map[string]staffIdentity // by key hash
+	audit [][]driver.NamedValue
+}
+
+func (db *fakeStaffDB) Open(string) (driver.Conn, error) { return fakeStaffConn{db}, nil }
+
+type fakeStaffConn struct{ db *fakeStaffDB }
+
+func (c fakeStaffConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fake staff db: prepare not supported")
+}
+func (c fakeStaffConn) Close() error { return nil }
+func (c fakeStaffConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fake staff db: no transactions")
+}
+
+func (c fakeStaffConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if !strings.Contains(query, "UPDATE staff_keys SET last_used_at") {
+		return nil, errors.New("fake staff db: unexpected query")
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	s, ok := c.db.keys[args[0].Value.(string)]
+	if !ok {
+		return &fakeRows{}, nil
+	}
+	return &fakeRows{rows: [][]driver.Value{{s.KeyID, s.Name, s.Role}}}, nil
+}
+
+func (c fakeStaffConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if !strings.Contains(query, "INSERT INTO staff_audit") {
+		return nil, errors.New("fake staff db: unexpected statement")
+	}
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	c.db.audit = append(c.db.audit, args)
+	return driver.RowsAffected(1), nil
+}
+
+type fakeRows struct{ rows [][]driver.Value }
+
+func (r *fakeRows) Columns() []string { return []string{"id", "name", "role"} }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func openFakeStaffDB(t *testing.T, keys map[string]staffIdentity) (*sql.DB, *fakeStaffDB) {
+	t.Helper()
+	fake := &fakeStaffDB{keys: map[string]staffIdentity{}}
+	for key, s := range keys {
+		fake.keys[hashStaffKey(key)] = s
+	}
+	name := "fakestaff-" + t.Name()
+	sql.Register(name, fake)
+	db, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, fake
+}
+
+func TestStaffRoles(t *testing.T) {
+	tests := []struct {
+		role, needs string
+		want        bool
+	}{
+		{roleAdmin, roleAdmin, true},
+		{roleAdmin, roleDriver, true},
+		{roleManager, roleAdmin, false},
+		{roleManager, roleManager, true},
+		{roleManager, roleKitchen, true},
+		{roleKitchen, roleManager, false},
+		{roleKitchen, roleKitchen, true},
+		{roleDriver, roleKitchen, false},
+		{roleDriver, roleDriver, true},
+		{"", roleDriver, false},
+		{"owner", roleDriver, false},
+	}
+	for _, tt := range tests {
+		if got := (staffIdentity{Role: tt.role}).can(tt.needs); got != tt.want {
+			t.Errorf("%q can %s = %v, want %v", tt.role, tt.needs, got, tt.want)
+		}
+	}
+}
+
+func TestAdminAPIRoles(t *testing.T) {
+	withRuntimeConfig(t, &RuntimeConfig{})
+	keys := map[string]staffIdentity{
+		"manager-key": {KeyID: 1, Name: "Thandi", Role: roleManager},
+		"kitchen-key": {KeyID: 2, Name: "Sipho", Role: roleKitchen},
+		"driver-key":  {KeyID: 3, Name: "Pieter", Role: roleDriver},
+	}
+	db, fake := openFakeStaffDB(t, keys)
+	d := testRouteDeps("127.0.0.1:9090")
+	d.db = db
+	d.envVars.AdminAPIKey = "admin-key"
+	d.prclist = &pricelistHolder{}
+	d.prclist.current.Store(&versionedPricelist{})
+	_, admin := newRouters(d)
+
+	tests := []struct {
+		name, key, method, path string
+		want                    int // 0 for anything the guards let through
+	}{
+		{"kitchen can't change a price", "kitchen-key", http.MethodPatch, "/api/catalogue/7", http.StatusForbidden},
+		{"kitchen can't schedule a price change", "kitchen-key", http.MethodPost, "/api/price-changes", http.StatusForbidden},
+		{"driver can't change a price", "driver-key", http.MethodPatch, "/api/catalogue/7", http.StatusForbidden},
+		{"manager can change a price", "manager-key", http.MethodPatch, "/api/catalogue/7", 0},
+		{"admin can change a price", "admin-key", http.MethodPatch, "/api/catalogue/7", 0},
+		{"driver can set an ETA", "driver-key", http.MethodPost, "/api/orders/1/eta", 0},
+		{"driver can list orders", "driver-key", http.MethodGet, "/api/orders", 0},
+		{"kitchen can't reprioritise", "kitchen-key", http.MethodPost, "/api/orders/1/priority", http.StatusForbidden},
+		{"manager can't manage keys", "manager-key", http.MethodPost, "/api/staff/keys", http.StatusForbidden},
+		{"manager can't revoke keys", "manager-key", http.MethodDelete, "/api/staff/keys/2", http.StatusForbidden},
+		{"manager can't reach debug", "manager-key", http.MethodGet, "/debug/status", http.StatusForbidden},
+		{"admin can list keys", "admin-key", http.MethodGet, "/api/staff/keys", 0},
+		{"no key", "", http.MethodGet, "/api/orders", http.StatusUnauthorized},
+		{"unknown key", "revoked-key", http.MethodGet, "/api/orders", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(`{}`))
+			if tt.key != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.key)
+			}
+			got, body := serveGuarded(admin, req)
+			switch {
+			case tt.want != 0 && got != tt.want:
+				t.Errorf("status = %d, want %d", got, tt.want)
+			case tt.want == 0 && (got == http.StatusUnauthorized || got == http.StatusForbidden || strings.Contains(body, "no such route")):
+				t.Errorf("status = %d (%s), want the request let through", got, body)
+			}
+		})
+	}
+
+	t.Run("refusals are audited", func(t *testing.T) {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		for _, args := range fake.audit {
+			if args[1].Value == "Sipho" && args[4].Value == "/api/catalogue/{itemID}" {
+				if args[6].Value != int64(http.StatusForbidden) {
+					t.Errorf("audited status %v, want %d", args[6].Value, http.StatusForbidden)
+				}
+				return
+			}
+		}
+		t.Errorf("the kitchen's price change isn't in the audit log: %v", fake.audit)
+	})
+}
+
+// serveGuarded returns the response, treating a handler that panics on the
+// test's missing dependencies as let through.
+func serveGuarded(h http.Handler, req *http.Request) (status int, body string) {
+	rec := httptest.NewRecorder()
+	defer func() {
+		if recover() != nil {
+			status, body = http.StatusOK, ""
+		}
+	}()
+	h.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
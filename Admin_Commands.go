@@ -0,0 +1,148 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/JeremyJalpha/MenuBot_WebAPI/buildinfo"
+)
+
+// commandContext carries what admin and customer commands need to act on
+// the running app.
+type commandContext struct {
+	db      *sql.DB
+	waDB    *sql.DB
+	prclist *pricelistHolder
+	client  waClient
+	sender  *messageSender
+	envVars EnvVars
+	events  eventSinks
+
+	maintenance     *maintenanceMode
+	connLog         *connectionLog
+	images          *itemImageCache
+	senders         *senderLocks
+	takeovers       *takeovers
+	escalations     *escalations
+	modifierPrompts *modifierPrompts
+	suggestions     *commandSuggestions
+	payments        *paymentPipeline
+	recipients      *recipientCache
+	shortcuts       *menuShortcuts
+	polls           *choicePolls
+	commandStats    *commandStats
+	homebase        *homebaseResolver
+	contactRules    *contactRules
+	incidents       *incidentLog
+	jobs            *scheduler
+	devices         *deviceSet
+}
+
+type adminCommand struct {
+	name string
+	run  func(cc *commandContext, args []string) string
+}
+
+// adminCommands are matched by prefix against messages from ADMIN_NUMBER.
+// Longer names must come before shorter names that share a prefix.
+var adminCommands = []adminCommand{
+	{name: "reload pricelist", run: adminReloadPricelist},
+	{name: "approve cancel", run: adminApproveCancel},
+	{name: "deny cancel", run: adminDenyCancel},
+	{name: "status", run: adminStatus},
+	{name: "debug", run: adminDebug},
+	{name: "pause", run: adminPause},
+	{name: "resume", run: adminResume},
+	{name: "reprint", run: adminReprint},
+	{name: "tier", run: adminTier},
+	{name: "points", run: adminPoints},
+	{name: "takeover", run: adminTakeover},
+	{name: "release", run: adminRelease},
+	{name: "export", run: adminExport},
+	{name: "history", run: adminHistory},
+	{name: "link", run: adminLink},
+	{name: "wastore", run: adminWAStore},
+	{name: "encrypt fields", run: adminEncryptFields},
+	{name: "stats", run: adminStats},
+	{name: "selftest", run: adminSelfTest},
+	{name: "jobs", run: adminJobs},
+	{name: "run job", run: adminRunJob},
+	{name: "block", run: adminBlock},
+	{name: "unblock", run: adminUnblock},
+	{name: "invite", run: adminInvite},
+	{name: "uninvite", run: adminUninvite},
+	{name: "allowlist-only", run: adminAllowlistOnly},
+}
+
+// matchCommand reports whether msg invokes name, and returns the words
+// following it with their original case.
+func matchCommand(msg, name string) ([]string, bool) {
+	normalized := normalizeCommand(msg)
+	if normalized != name && !strings.HasPrefix(normalized, name+" ") {
+		return nil, false
+	}
+	return strings.Fields(msg)[len(strings.Fields(name)):], true
+}
+
+// handleAdminCommand runs msg if it is a known admin command. ok is false
+// when msg isn't one, so it can fall through to normal handling.
+func handleAdminCommand(cc *commandContext, msg string) (reply string, ok bool) {
+	for _, cmd := range adminCommands {
+		if args, ok := matchCommand(msg, cmd.name); ok {
+			cc.commandStats.Count(outcomeAdmin, cmd.name, "", time.Now())
+			return cmd.run(cc, args), true
+		}
+	}
+	return "", false
+}
+
+func adminReloadPricelist(cc *commandContext, _ []string) string {
+	previous := cc.prclist.Version()
+	version, err := rebuildPricelist(cc.db, cc.prclist)
+	if err != nil {
+		return fmt.Sprintf("Pricelist reload failed, still serving version %d: %v", previous, err)
+	}
+	reply := fmt.Sprintf("Pricelist reloaded, now version %d (was %d).", version, previous)
+	if version == previous {
+		reply = fmt.Sprintf("Pricelist reloaded, unchanged at version %d.", version)
+	}
+	if warnings := payFastNameWarnings(cc.prclist.Snapshot().Items); len(warnings) > 0 {
+		reply += "\n\nPayFast will show some names differently:\n" + strings.Join(warnings, "\n")
+	}
+	return reply
+}
+
+func adminStatus(cc *commandContext, _ []string) string {
+	whatsApp := "connected"
+	if !cc.client.IsConnected() {
+		whatsApp = "disconnected"
+	}
+	open := "open"
+	if now := time.Now(); cc.maintenance.Get().ActiveAt(now) {
+		open = "paused"
+	} else if !cfg().BusinessHours.IsOpen(now) {
+		open = "closed"
+	}
+	pricelist := fmt.Sprintf("pricelist version %d", cc.prclist.Version())
+	if cc.prclist.Stale() {
+		pricelist = "pricelist unavailable"
+	}
+	status := fmt.Sprintf("WhatsApp %s, shop %s, %s, PayFast %s.\n%s\nVersion %s",
+		whatsApp, open, pricelist, cc.envVars.PayFastMode, cc.connLog.Status(), buildinfo.Get())
+	if devices := cc.devices.Summary(); devices != "" {
+		status += "\n" + devices
+	}
+	if takeovers := cc.takeovers.Status(time.Now()); takeovers != "" {
+		status += "\n" + takeovers
+	}
+	if st := cc.sender.block.Get(); st.Active {
+		status += fmt.Sprintf("\nSending disabled since %s (%s: %s), next probe %s.",
+			st.Since.Format("2006-01-02 15:04"), st.Cause, st.Detail, st.NextProbe.Format("15:04"))
+	}
+	if cc.contactRules.AllowlistOnly() {
+		status += "\nAllowlist-only: only invited numbers are answered."
+	}
+	return status
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+	"github.com/JeremyJalpha/MenuBot_WebAPI/httpapi"
+	"github.com/mdp/qrterminal"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"golang.org/x/sync/errgroup"
+)
+
+// App is the running bot. NewApp builds it from the configuration and
+// checks everything it can before anything starts; Run starts the HTTP
+// servers and, once this instance is the leader, the background jobs and
+// WhatsApp connection, and stops them in order when its context ends.
+type App struct {
+	env      EnvVars
+	pf       *preflight
+	db, waDB *sql.DB
+	client   waClient
+	devices  *deviceSet
+	prclist  *pricelistHolder
+	checkout mb.CheckoutInfo
+	limiter  *senderLimiter
+	connLog  *connectionLog
+	cmds     *commandContext
+	election *leaderElection
+	servers  []*http.Server
+}
+
+// waClient is what the bot uses of a *whatsmeow.Client, so a test can run
+// an App without connecting to WhatsApp.
+type waClient interface {
+	qrLoginClient
+	groupInfoSource
+	IsConnected() bool
+	IsLoggedIn() bool
+	// ID is the paired device, nil before pairing.
+	ID() *types.JID
+	// Contacts is the device's contact store, nil when it has none.
+	Contacts() store.ContactStore
+	AddEventHandler(handler whatsmeow.EventHandler) uint32
+	// SetAutoReconnectHook sets the client's AutoReconnectHook.
+	SetAutoReconnectHook(hook func(error) bool)
+	SendMessage(ctx context.Context, to types.JID, message *waProto.Message, extra ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error)
+	BuildPollCreation(name string, optionNames []string, selectableOptionCount int) *waProto.Message
+	DecryptPollVote(vote *events.Message) (*waProto.PollVoteMessage, error)
+	Upload(ctx context.Context, plaintext []byte, appInfo whatsmeow.MediaType) (whatsmeow.UploadResponse, error)
+	IsOnWhatsApp(phones []string) ([]types.IsOnWhatsAppResponse, error)
+}
+
+// whatsmeowClient is a *whatsmeow.Client as a waClient.
+type whatsmeowClient struct {
+	*whatsmeow.Client
+}
+
+func (c whatsmeowClient) ID() *types.JID {
+	if c.Store == nil {
+		return nil
+	}
+	return c.Store.ID
+}
+
+func (c whatsmeowClient) Contacts() store.ContactStore {
+	if c.Store == nil {
+		return nil
+	}
+	return c.Store.Contacts
+}
+
+func (c whatsmeowClient) SetAutoReconnectHook(hook func(error) bool) {
+	c.AutoReconnectHook = hook
+}
+
+// clientFactory builds the client for a device in the WhatsApp store.
+type clientFactory func(device *store.Device) waClient
+
+// newWhatsmeowClients is the clientFactory that connects to WhatsApp.
+func newWhatsmeowClients(debug bool) clientFactory {
+	return func(device *store.Device) waClient {
+		return whatsmeowClient{whatsmeow.NewClient(device, newWALogger("Client", debug))}
+	}
+}
+
+// dbOpener opens and checks a database, as openDB does.
+type dbOpener func(name, label, driver, dsn string) (*sql.DB, error)
+
+// NewApp opens the databases with open, builds a client for each paired
+// device with newClient, loads the pricelist and wires up the commands and
+// routes. Preflight failures exit the process, as they always have; other
+// errors are returned.
+func NewApp(envVars EnvVars, pf *preflight, open dbOpener, newClient clientFactory) (*App, error) {
+	app := &App{env: envVars, pf: pf}
+	var err error
+
+	// Open the database connections. Each check runs only when the settings
+	// it needs are present, so a bad app.env doesn't bury the real problem.
+	if envVars.DBConn != "" {
+		app.db, err = open(appDBName, "app", "postgres", envVars.DBConn)
+		pf.dependency(err, "check DATABASE_URL")
+		if app.db != nil {
+			pf.checkCatalogue(app.db)
+		}
+	}
+
+	var container *sqlstore.Container
+	if envVars.WADBConn != "" {
+		app.waDB, err = open(waDBName, "whatsapp", envVars.WADBDriver, envVars.WADBConn)
+		pf.dependency(err, "check WHATSAPP_DB_URL and WHATSAPP_DB_DRIVER")
+		if app.waDB != nil {
+			dbLog := newWALogger("Database", envVars.WADebug)
+			container = sqlstore.NewWithDB(app.waDB, envVars.WADBDriver, dbLog)
+			pf.checkWAStore(container, app.waDB)
+		}
+	}
+
+	if fieldEncryption, err = newFieldCipher(envVars.FieldKeyID, envVars.FieldKey); err != nil {
+		pf.config(err)
+	}
+
+	// Get the current working directory
+	envVars.Pwd, err = os.Getwd()
+	if err != nil {
+		pf.config(fmt.Errorf("getting current directory: %w", err))
+	}
+	app.env = envVars
+
+	// Construct the path to the template file
+	pymntRtrnTplPath := filepath.Join(envVars.Pwd, "templates", pymntRtrnBase+".html")
+	pymntCnclTplPath := filepath.Join(envVars.Pwd, "templates", pymntCnclBase+".html")
+
+	customerOrderTplPath := filepath.Join(envVars.Pwd, "templates", orderTplFile)
+
+	pymntRtrnTpl := pf.parseTemplate(pymntRtrnTplPath, customerOrderTplPath)
+	pymntCnclTpl := pf.parseTemplate(pymntCnclTplPath, customerOrderTplPath)
+	dashboardTpls := pf.parseDashboardTemplates(envVars.Pwd)
+
+	pf.exitOnFailure()
+
+	if err := ensureSchema(app.db); err != nil {
+		app.Close()
+		return nil, err
+	}
+	if err := backfillOrderRefs(app.db, envVars.OrderRefPrefix); err != nil {
+		log.Printf("Giving existing orders a reference failed, they get one when next mentioned: %v", err)
+	}
+
+	app.devices, err = loadDevices(app.db, container, envVars.HostNumber, newClient)
+	if err != nil {
+		app.Close()
+		return nil, fmt.Errorf("reading devices from %s: %w", waDBName, err)
+	}
+	primary := app.devices.primary()
+	app.client = primary
+	app.checkout = newCheckoutInfo(envVars)
+	log.Println("Loading pricelist from DB...")
+	app.prclist = &pricelistHolder{}
+	if version, err := loadStartupPricelist(app.db, app.prclist, envVars.PricelistStartupRetry); err != nil {
+		log.Printf("Error reading pricelist from database, starting with the menu unavailable: %v", err)
+	} else {
+		log.Printf("Loaded pricelist version %d", version)
+	}
+
+	maintenance, err := loadMaintenanceMode(app.db)
+	if err != nil {
+		app.Close()
+		return nil, err
+	}
+	takeovers, err := loadTakeovers(app.db)
+	if err != nil {
+		app.Close()
+		return nil, err
+	}
+	contactRules, err := loadContactRules(app.db)
+	if err != nil {
+		app.Close()
+		return nil, err
+	}
+	app.connLog = newConnectionLog(app.db)
+	app.connLog.Watch(primary)
+	app.limiter = newSenderLimiter()
+	events := newEventSinks(envVars)
+	block, err := loadSendingBlock(app.db, events, envVars.InstanceID)
+	if err != nil {
+		app.Close()
+		return nil, err
+	}
+	for _, c := range app.devices.all() {
+		block.Watch(c)
+	}
+	sender := newMessageSender(primary, app.db, newTokenBucket(), events, block,
+		envVars.HostNumber, envVars.AdminNumber, envVars.KitchenNumber, envVars.SupportNumber)
+	app.cmds = &commandContext{
+		db:      app.db,
+		waDB:    app.waDB,
+		prclist: app.prclist,
+		client:  primary,
+		sender:  sender,
+		envVars: envVars,
+		events:  events,
+
+		maintenance:     maintenance,
+		connLog:         app.connLog,
+		images:          newItemImageCache(),
+		senders:         newSenderLocks(),
+		takeovers:       takeovers,
+		escalations:     newEscalations(),
+		modifierPrompts: newModifierPrompts(app.db),
+		suggestions:     newCommandSuggestions(),
+		recipients:      newRecipientCache(),
+		shortcuts:       newMenuShortcuts(),
+		polls:           newChoicePolls(),
+		commandStats:    newCommandStats(),
+		homebase:        newHomebaseResolver(),
+		contactRules:    contactRules,
+		devices:         app.devices,
+	}
+	sender.failed = app.cmds.deliveryFailed
+	sender.devices = app.devices
+	app.devices.attach = func(c waClient) {
+		block.Watch(c)
+		app.listen(c)
+	}
+	app.cmds.payments = newPaymentPipeline(app.cmds)
+	app.cmds.incidents = newIncidentLog(app.cmds)
+	app.cmds.jobs = newScheduler(app.db, app.jobs())
+	app.election = newLeaderElection(app.db, envVars.InstanceID)
+
+	// Define routes
+	public, admin := newRouters(routeDeps{
+		db:      app.db,
+		waDB:    app.waDB,
+		client:  primary,
+		devices: app.devices,
+		prclist: app.prclist,
+		cmds:    app.cmds,
+		envVars: envVars,
+		payments: newPaymentHandlers(envVars,
+			dbOrderStore{db: app.db, prclist: app.prclist, instanceID: envVars.InstanceID, itemNamePrefix: envVars.ItemNamePrefix},
+			payfastVerifier{passphrase: envVars.Passphrase, host: envVars.PfHost, incidents: app.cmds.incidents},
+			pipelineQueue{db: app.db, payments: app.cmds.payments},
+			app.cmds.events,
+			templatePages{
+				templates: map[string]*template.Template{httpapi.PageReturn: pymntRtrnTpl, httpapi.PageCancel: pymntCnclTpl},
+				branding:  brandingFromEnv(envVars),
+			},
+			app.cmds.homebase,
+			app.cmds.incidents),
+		checkout:  app.checkout,
+		dashboard: dashboardTpls,
+		election:  app.election,
+	})
+	app.servers = []*http.Server{{Addr: envVars.PublicAddr, Handler: public}}
+	if admin != nil {
+		app.servers = append(app.servers, &http.Server{Addr: envVars.AdminAddr, Handler: admin})
+	}
+	return app, nil
+}
+
+// Run starts the app and blocks until ctx is done or an HTTP server fails,
+// then shuts it down. It returns the server's error.
+func (app *App) Run(ctx context.Context) error {
+	app.cmds.jobs.Start()
+
+	servers, ctx := errgroup.WithContext(ctx)
+	for _, srv := range app.servers {
+		srv := srv
+		servers.Go(func() error {
+			if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				return fmt.Errorf("HTTP server on %s failed: %w", srv.Addr, err)
+			}
+			return nil
+		})
+	}
+
+	if app.env.PreflightPublicURL {
+		app.pf.checkPublicHealth(app.cmds.homebase.URL())
+		app.pf.exitOnFailure()
+	}
+	log.Println("preflight OK")
+
+	if err := app.election.campaign(ctx, app.lostLeadership); err == nil {
+		log.Println("Elected leader")
+		app.lead()
+	}
+
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, srv := range app.servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Printf("HTTP server on %s shutdown: %v", srv.Addr, err)
+		}
+	}
+	err := servers.Wait()
+	if err := app.cmds.commandStats.flush(app.db); err != nil {
+		log.Printf("Saving command counters failed: %v", err)
+	}
+	if app.client.IsConnected() {
+		app.connLog.Record(connStopped, "")
+		app.client.Disconnect()
+		app.connLog.Flush(2 * time.Second)
+	}
+	app.devices.disconnectAll()
+	return err
+}
+
+// lead starts what only the leader may run: anything that sends WhatsApp
+// messages on its own or would run twice with two instances.
+func (app *App) lead() {
+	cmds := app.cmds
+	go cmds.payments.run()
+	if app.prclist.Stale() {
+		go recoverPricelist(cmds)
+	}
+	go processWebOrders(cmds)
+	cmds.jobs.Lead()
+	for _, c := range app.devices.all() {
+		app.listen(c)
+	}
+
+	// Reconnecting a blocked number on every restart is what a crash loop
+	// would do; the probe reconnects it when it's due instead.
+	if st := cmds.sender.block.Get(); st.Active && app.client.ID() != nil {
+		log.Printf("Sending is disabled (%s), staying disconnected from WhatsApp until the probe at %s", st.Cause, st.NextProbe.Format(time.RFC3339))
+		return
+	}
+	connectWhatsApp(app.client, app.env, app.connLog, func(code string) {
+		qrterminal.GenerateHalfBlock(code, qrterminal.L, os.Stdout)
+	})
+	app.devices.connectOthers()
+}
+
+// listen hands c's events to handleEvent.
+func (app *App) listen(c waClient) {
+	c.AddEventHandler(func(evt interface{}) { app.handleEvent(c, evt) })
+}
+
+// jobs are the background jobs, see scheduler.
+func (app *App) jobs() []job {
+	cc := app.cmds
+	return []job{
+		{Name: "pricelist-refresh", Schedule: pricelistRefreshSchedule(app.prclist), EveryInstance: true,
+			Run: func(context.Context) error { return refreshPricelist(app.db, app.prclist) }},
+		{Name: "outbox-flush", Schedule: every(outboxFlushInterval),
+			Run: func(context.Context) error { return flushOutbox(cc.sender) }},
+		{Name: "sending-probe", Schedule: probeJobSchedule(cc.sender.block),
+			Run: func(context.Context) error { probeSending(cc); return nil }},
+		{Name: "held-messages", Schedule: every(quietHoursCheck),
+			Run: func(context.Context) error { return releaseDeferredMessages(cc) }},
+		{Name: "specials", Schedule: every(specialAnnounceCheck),
+			Run: func(context.Context) error { return announceDueSpecials(cc, time.Now()) }},
+		{Name: "rating-prompts", Schedule: every(ratingPromptCheck),
+			Run: func(context.Context) error { return promptRatings(cc) }},
+		{Name: "command-stats", Schedule: every(commandStatsFlush),
+			Run: func(context.Context) error { return flushCommandStats(cc) }},
+		{Name: "order-expiry", Schedule: every(orderExpirySweep),
+			Run: func(context.Context) error { return expireOrders(cc, time.Now()) }},
+		{Name: "stale-prompts", Schedule: every(promptSweep),
+			Run: func(context.Context) error { return abandonStalePrompts(cc) }},
+		{Name: "inactive-items", Schedule: dailyAt(inactiveReminderHour, 0),
+			Run: func(context.Context) error { return remindInactiveItems(cc) }},
+		{Name: "dispute-summary", Schedule: dailyAt(disputeSummaryHour, 0),
+			Run: func(context.Context) error { return sendDisputeSummaries(cc) }},
+		{Name: "conversation-summary", Schedule: weeklyAt(conversationSummaryWeekday, conversationSummaryHour, 0),
+			Run: func(context.Context) error { return sendConversationSummaries(cc) }},
+		{Name: "reconciliation", Schedule: dailyAt(reconciliationHour, 0),
+			Run: func(context.Context) error { return reconcilePayments(cc) }},
+		{Name: "customer-names", Schedule: dailyAt(customerNameSyncHour, 0),
+			Run: func(context.Context) error { return reconcileCustomerNames(cc) }},
+		{Name: "retention", Schedule: dailyAt(retentionHour, 0), Timeout: time.Hour,
+			Run: func(context.Context) error { return purgeOldData(cc) }},
+		{Name: jobPayFastSelfTest, Schedule: selfTestJobSchedule(cc),
+			Run: func(context.Context) error { return payFastSelfTest(cc) }},
+	}
+}
+
+// lostLeadership exits rather than stopping the leader's jobs one by one:
+// the standby may already hold the lock, and none of the jobs can be
+// interrupted safely.
+func (app *App) lostLeadership(err error) {
+	log.Printf("Lost the leader lock (%v), disconnecting WhatsApp so the standby can take over", err)
+	app.devices.disconnectAll()
+	os.Exit(exitLostLeadership)
+}
+
+// Close closes the database connections.
+func (app *App) Close() {
+	if app.db != nil {
+		closeDB(appDBName, app.db)
+	}
+	if app.waDB != nil {
+		closeDB(waDBName, app.waDB)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/store"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// fakeWAClient is a paired device that connects without going anywhere.
+type fakeWAClient struct {
+	mu        sync.Mutex
+	connected bool
+	connects  chan struct{}
+}
+
+func (c *fakeWAClient) GetQRChannel(ctx context.Context) (<-chan whatsmeow.QRChannelItem, error) {
+	return nil, errors.New("already paired")
+}
+
+func (c *fakeWAClient) Connect() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = true
+	close(c.connects)
+	return nil
+}
+
+func (c *fakeWAClient) Disconnect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = false
+}
+
+func (c *fakeWAClient) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *fakeWAClient) IsLoggedIn() bool { return c.IsConnected() }
+
+func (c *fakeWAClient) ID() *types.JID {
+	return &types.JID{User: "27000000000", Device: 1, Server: types.DefaultUserServer}
+}
+
+func (c *fakeWAClient) Contacts() store.ContactStore                  { return nil }
+func (c *fakeWAClient) AddEventHandler(whatsmeow.EventHandler) uint32 { return 0 }
+func (c *fakeWAClient) SetAutoReconnectHook(func(error) bool)         {}
+func (c *fakeWAClient) GetGroupInfo(types.JID) (*types.GroupInfo, error) {
+	return nil, errors.New("no groups")
+}
+func (c *fakeWAClient) IsOnWhatsApp([]string) ([]types.IsOnWhatsAppResponse, error) { return nil, nil }
+
+func (c *fakeWAClient) SendMessage(context.Context, types.JID, *waProto.Message, ...whatsmeow.SendRequestExtra) (whatsmeow.SendResponse, error) {
+	return whatsmeow.SendResponse{}, nil
+}
+
+func (c *fakeWAClient) BuildPollCreation(string, []string, int) *waProto.Message {
+	return &waProto.Message{}
+}
+
+func (c *fakeWAClient) DecryptPollVote(*events.Message) (*waProto.PollVoteMessage, error) {
+	return nil, errors.New("no polls")
+}
+
+func (c *fakeWAClient) Upload(context.Context, []byte, whatsmeow.MediaType) (whatsmeow.UploadResponse, error) {
+	return whatsmeow.UploadResponse{}, errors.New("no uploads")
+}
+
+// fakeAppDB is an app database with everything empty: statements succeed
+// and queries find nothing. The leader lock is always free, and the
+// catalogue, read by MenuBotLib with queries of its own, has one item.
+type fakeAppDB struct{}
+
+func (fakeAppDB) Open(string) (driver.Conn, error) { return fakeAppConn{}, nil }
+
+type fakeAppConn struct{}
+
+func (fakeAppConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fake app db: prepare not supported")
+}
+func (fakeAppConn) Close() error              { return nil }
+func (fakeAppConn) Begin() (driver.Tx, error) { return fakeAppConn{}, nil }
+func (fakeAppConn) Commit() error             { return nil }
+func (fakeAppConn) Rollback() error           { return nil }
+
+func (fakeAppConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+
+func (fakeAppConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	switch {
+	case strings.Contains(query, "pg_try_advisory_lock"):
+		return &fakeAppRows{cols: 1, rows: [][]driver.Value{{true}}}, nil
+	case strings.Contains(query, "catalogue") && !strings.Contains(query, "catalogue_id"):
+		// Ours all filter on catalogue_id; this is MenuBotLib's. Its
+		// columns aren't ours to know, so every one of them is 1.
+		n := selectColumns(query)
+		row := make([]driver.Value, n)
+		for i := range row {
+			row[i] = int64(1)
+		}
+		return &fakeAppRows{cols: n, rows: [][]driver.Value{row}}, nil
+	}
+	return &fakeAppRows{}, nil
+}
+
+// selectColumns counts the columns query selects.
+func selectColumns(query string) int {
+	q := strings.ToUpper(query)
+	start := strings.Index(q, "SELECT") + len("SELECT")
+	n, depth := 1, 0
+	for i := start; i < len(q); i++ {
+		switch q[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				n++
+			}
+		}
+		if depth == 0 && strings.HasPrefix(q[i:], " FROM ") {
+			break
+		}
+	}
+	return n
+}
+
+type fakeAppRows struct {
+	cols int
+	rows [][]driver.Value
+}
+
+func (r *fakeAppRows) Columns() []string { return make([]string, r.cols) }
+func (r *fakeAppRows) Close() error      { return nil }
+func (r *fakeAppRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// TestAppRunStops builds an App with its WhatsApp store in sqlite, a fake
+// app database and a fake client, runs it until it leads and connects, and
+// checks that cancelling shuts it down cleanly.
+func TestAppRunStops(t *testing.T) {
+	sql.Register("fakeappdb", fakeAppDB{})
+	t.Setenv("HOMEBASEURL", "https://menubot.example.com")
+	rc, err := loadRuntimeConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	withRuntimeConfig(t, rc)
+
+	env := EnvVars{
+		DBConn:                "fake",
+		WADBDriver:            "sqlite3",
+		WADBConn:              "file:" + filepath.Join(t.TempDir(), "whatsapp.db") + "?_foreign_keys=on",
+		HostNumber:            "27000000000",
+		AdminNumber:           "27000000009",
+		SupportNumber:         "27000000000",
+		KitchenNumber:         "27000000000",
+		MerchantId:            "10000100",
+		MerchantKey:           "46f0cd694581a",
+		PfHost:                "https://sandbox.payfast.co.za/eng/process",
+		PayFastMode:           payfastSandbox,
+		InstanceID:            "smoke",
+		ItemNamePrefix:        legacyItemNamePrefix,
+		OrderRefPrefix:        "SMK",
+		PublicAddr:            "127.0.0.1:0",
+		EventsBackend:         eventsNone,
+		QRAttempts:            1,
+		Headless:              true,
+		PricelistStartupRetry: time.Second,
+		ShopName:              "MenuBot",
+	}
+	open := func(name, label, driver, dsn string) (*sql.DB, error) {
+		if label == "app" {
+			driver = "fakeappdb"
+		}
+		return openDB(name, label, driver, dsn)
+	}
+	client := &fakeWAClient{connects: make(chan struct{})}
+	app, err := NewApp(env, &preflight{}, open, func(*store.Device) waClient { return client })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	for name, c := range map[string]waClient{"commands": app.cmds.client, "sender": app.cmds.sender.client, "devices": app.devices.primary()} {
+		if c != client {
+			t.Fatalf("the %s don't use the client NewApp was given", name)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- app.Run(ctx) }()
+
+	select {
+	case <-client.connects:
+	case err := <-done:
+		t.Fatalf("Run returned before connecting: %v", err)
+	case <-time.After(30 * time.Second):
+		t.Fatal("the app didn't connect to WhatsApp")
+	}
+	if !app.election.Leader() {
+		t.Error("connected without leading")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatal("Run didn't return after cancelling")
+	}
+	if client.IsConnected() {
+		t.Error("still connected to WhatsApp after Run returned")
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// availabilitySpec is the stored and API form of an item's availability
+// rule. Every field is optional; an empty spec means always available.
+type availabilitySpec struct {
+	ItemID int    `json:"item_id"`
+	Days   string `json:"days,omitempty"`  // e.g. "Mon-Fri"
+	Start  string `json:"start,omitempty"` // HH:MM
+	End    string `json:"end,omitempty"`   // HH:MM
+	From   string `json:"from,omitempty"`  // YYYY-MM-DD, inclusive
+	To     string `json:"to,omitempty"`    // YYYY-MM-DD, inclusive
+}
+
+// availabilityRule is a parsed availabilitySpec.
+type availabilityRule struct {
+	Spec     availabilitySpec
+	Window   *TimeWindow
+	From, To string
+}
+
+func parseAvailabilityRule(spec availabilitySpec) (availabilityRule, error) {
+	rule := availabilityRule{Spec: spec}
+
+	if spec.Start != "" || spec.End != "" {
+		if spec.Start == "" || spec.End == "" {
+			return rule, fmt.Errorf("item %d: start and end must be set together", spec.ItemID)
+		}
+		window, err := parseTimeWindow(strings.TrimSpace(spec.Days + " " + spec.Start + "-" + spec.End))
+		if err != nil {
+			return rule, fmt.Errorf("item %d: %w", spec.ItemID, err)
+		}
+		rule.Window = &window
+	} else if spec.Days != "" {
+		days, err := parseWeekdays(spec.Days)
+		if err != nil {
+			return rule, fmt.Errorf("item %d: %w", spec.ItemID, err)
+		}
+		rule.Window = &TimeWindow{Days: days, Start: 0, End: 24 * 60}
+	}
+
+	for _, date := range []string{spec.From, spec.To} {
+		if date == "" {
+			continue
+		}
+		if _, err := time.Parse(dateLayout, date); err != nil {
+			return rule, fmt.Errorf("item %d: invalid date %q, expected YYYY-MM-DD", spec.ItemID, date)
+		}
+	}
+	if spec.From != "" && spec.To != "" && spec.To < spec.From {
+		return rule, fmt.Errorf("item %d: date range ends before it starts", spec.ItemID)
+	}
+	rule.From, rule.To = spec.From, spec.To
+
+	return rule, nil
+}
+
+// AvailableAt reports whether the item can be ordered at t, evaluated in
+// the business timezone.
+func (r availabilityRule) AvailableAt(t time.Time, loc *time.Location) bool {
+	t = t.In(loc)
+	today := t.Format(dateLayout)
+	if r.From != "" && today < r.From {
+		return false
+	}
+	if r.To != "" && today > r.To {
+		return false
+	}
+	return r.Window == nil || r.Window.Contains(t)
+}
+
+// Describe renders the rule for customers, e.g. "07:00–11:00".
+func (r availabilityRule) Describe() string {
+	var parts []string
+	if r.Spec.Days != "" {
+		parts = append(parts, r.Spec.Days)
+	}
+	if r.Spec.Start != "" {
+		parts = append(parts, r.Spec.Start+"–"+r.Spec.End)
+	}
+	switch {
+	case r.From != "" && r.To != "":
+		parts = append(parts, "from "+r.From+" until "+r.To)
+	case r.From != "":
+		parts = append(parts, "from "+r.From)
+	case r.To != "":
+		parts = append(parts, "until "+r.To)
+	}
+	return strings.Join(parts, " ")
+}
+
+func loadAvailabilityRules(db *sql.DB) (map[int]availabilityRule, error) {
+	rows, err := db.Query(`SELECT item_id, days, start_time, end_time, valid_from, valid_to
+		FROM item_availability WHERE catalogue_id = $1`, catalogueID)
+	if err != nil {
+		return nil, fmt.Errorf("loading item availability: %w", err)
+	}
+	defer rows.Close()
+
+	rules := make(map[int]availabilityRule)
+	for rows.Next() {
+		var spec availabilitySpec
+		if err := rows.Scan(&spec.ItemID, &spec.Days, &spec.Start, &spec.End, &spec.From, &spec.To); err != nil {
+			return nil, fmt.Errorf("loading item availability: %w", err)
+		}
+		rule, err := parseAvailabilityRule(spec)
+		if err != nil {
+			return nil, fmt.Errorf("loading item availability: %w", err)
+		}
+		rules[spec.ItemID] = rule
+	}
+	return rules, rows.Err()
+}
+
+func saveAvailabilityRule(db dbtx, spec availabilitySpec) error {
+	_, err := db.Exec(`INSERT INTO item_availability (catalogue_id, item_id, days, start_time, end_time, valid_from, valid_to)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (catalogue_id, item_id) DO UPDATE SET
+			days = EXCLUDED.days, start_time = EXCLUDED.start_time, end_time = EXCLUDED.end_time,
+			valid_from = EXCLUDED.valid_from, valid_to = EXCLUDED.valid_to`,
+		catalogueID, spec.ItemID, spec.Days, spec.Start, spec.End, spec.From, spec.To)
+	return err
+}
+
+func deleteAvailabilityRule(db *sql.DB, itemID int) error {
+	_, err := db.Exec(`DELETE FROM item_availability WHERE catalogue_id = $1 AND item_id = $2`, catalogueID, itemID)
+	return err
+}
+
+// unavailableItemsReply explains which of the referenced items can't be
+// ordered right now, or returns "" if they all can.
+func unavailableItemsReply(vp versionedPricelist, itemIDs []int, now time.Time) string {
+	loc := cfg().BusinessHours.Location
+	var lines []string
+	for _, id := range itemIDs {
+		name := itemRef(id)
+		if item, ok := vp.Item(id); ok {
+			name = ctlgItemName(item)
+		}
+		if !vp.Listed(id) {
+			lines = append(lines, fmt.Sprintf("Sorry, %s is not available at the moment.", name))
+			continue
+		}
+		if rule, ok := vp.Rules[id]; ok && !rule.AvailableAt(now, loc) {
+			lines = append(lines, fmt.Sprintf("Sorry, %s is only available %s.", name, rule.Describe()))
+			continue
+		}
+		if missing := vp.unavailableComponents(id, now); len(missing) > 0 {
+			lines = append(lines, fmt.Sprintf("Sorry, %s can't be ordered right now, we're out of %s.", name, strings.Join(missing, " and ")))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// availabilityGate stops messages that would add an unavailable item. A
+// cart filled while its items were still available is dealt with at
+// checkout, see unresolvedCartReply.
+func availabilityGate(vp versionedPricelist, msg string, now time.Time) (reply string, blocked bool) {
+	if reply := unavailableItemsReply(vp, referencedItemIDs(msg), now); reply != "" {
+		return reply, true
+	}
+	return "", false
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// availabilityCSVHeader is the column order accepted by the CSV import.
+var availabilityCSVHeader = []string{"item_id", "days", "start", "end", "from", "to"}
+
+func availabilitySpecs(rules map[int]availabilityRule) []availabilitySpec {
+	specs := make([]availabilitySpec, 0, len(rules))
+	for _, rule := range rules {
+		specs = append(specs, rule.Spec)
+	}
+	sort.Slice(specs, func(i, j int) bool { return specs[i].ItemID < specs[j].ItemID })
+	return specs
+}
+
+func itemIDParam(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(chi.URLParam(r, "itemID"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid item id %q", chi.URLParam(r, "itemID"))
+	}
+	return id, nil
+}
+
+type pricelistVersionResponse struct {
+	Version int64 `json:"version"`
+}
+
+// respondPricelistChanged rebuilds the pricelist after an edit and reports
+// the resulting version.
+func respondPricelistChanged(w http.ResponseWriter, db *sql.DB, prclist *pricelistHolder) {
+	version, err := rebuildPricelist(db, prclist)
+	if err != nil {
+		log.Printf("Rebuilding pricelist after edit failed: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "saved, but rebuilding the pricelist failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, pricelistVersionResponse{Version: version})
+}
+
+func ListAvailabilityHandler(prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, availabilitySpecs(prclist.Snapshot().Rules))
+	}
+}
+
+func PutAvailabilityHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := itemIDParam(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, ok := prclist.Snapshot().Item(itemID); !ok {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no catalogue item %d", itemID))
+			return
+		}
+
+		var spec availabilitySpec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		spec.ItemID = itemID
+		if _, err := parseAvailabilityRule(spec); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if err := saveAvailabilityRule(db, spec); err != nil {
+			log.Printf("Saving availability for item %d failed: %v", itemID, err)
+			writeJSONError(w, http.StatusInternalServerError, "saving availability failed")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
+
+func DeleteAvailabilityHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := itemIDParam(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := deleteAvailabilityRule(db, itemID); err != nil {
+			log.Printf("Deleting availability for item %d failed: %v", itemID, err)
+			writeJSONError(w, http.StatusInternalServerError, "deleting availability failed")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
+
+// ImportAvailabilityHandler replaces rules from a CSV upload. Every row is
+// validated before anything is written, and the rows are saved in one
+// transaction, so a bad file changes nothing.
+func ImportAvailabilityHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		specs, err := parseAvailabilityCSV(r.Body)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Availability import: begin failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "import failed")
+			return
+		}
+		defer tx.Rollback()
+		for _, spec := range specs {
+			if err := saveAvailabilityRule(tx, spec); err != nil {
+				log.Printf("Availability import: saving item %d failed: %v", spec.ItemID, err)
+				writeJSONError(w, http.StatusInternalServerError, "import failed")
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Availability import: commit failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "import failed")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
+
+func parseAvailabilityCSV(body io.Reader) ([]availabilitySpec, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = len(availabilityCSVHeader)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	if strings.Join(header, ",") != strings.Join(availabilityCSVHeader, ",") {
+		return nil, fmt.Errorf("CSV header must be %s", strings.Join(availabilityCSVHeader, ","))
+	}
+
+	var specs []availabilitySpec
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		itemID, err := strconv.Atoi(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid item_id %q", len(specs)+2, record[0])
+		}
+		spec := availabilitySpec{ItemID: itemID, Days: record[1], Start: record[2], End: record[3], From: record[4], To: record[5]}
+		if _, err := parseAvailabilityRule(spec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", len(specs)+2, err)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
@@ -0,0 +1,640 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+	"github.com/JeremyJalpha/MenuBot_WebAPI/buildinfo"
+)
+
+// backupFormat is the version of the shopBackup layout. Bump it whenever a
+// field is renamed, removed or changes meaning, and add a migration from
+// the previous version to backupMigrations.
+const backupFormat = 5
+
+// backupMigrations upgrade a decoded backup document from format n to n+1,
+// keyed by n.
+var backupMigrations = map[int]func(doc map[string]json.RawMessage) error{
+	// Format 2 added item modifiers; older backups had none.
+	1: func(doc map[string]json.RawMessage) error {
+		doc["modifiers"] = json.RawMessage("[]")
+		return nil
+	},
+	// Format 3 added combos.
+	2: func(doc map[string]json.RawMessage) error {
+		doc["combos"] = json.RawMessage("[]")
+		return nil
+	},
+	// Format 4 added categories and specials.
+	3: func(doc map[string]json.RawMessage) error {
+		doc["categories"] = json.RawMessage("[]")
+		doc["specials"] = json.RawMessage("[]")
+		return nil
+	},
+	// Format 5 added item codes. Older backups restore without touching
+	// them, as codes made afresh could differ from those customers know.
+	4: func(doc map[string]json.RawMessage) error {
+		doc["item_codes"] = json.RawMessage("null")
+		return nil
+	},
+}
+
+// shopBackup is everything the web API owns that describes the shop rather
+// than its trade: no orders, loyalty balances or WhatsApp session. The
+// catalogue rows belong to MenuBotLib and are included for reference only;
+// a restore checks them against the live catalogue but never writes them.
+// Templates, business hours and webhook settings live in templates/ and
+// app.env and are backed up with the deployment, not here.
+type shopBackup struct {
+	Format        int                `json:"format"`
+	CreatedAt     time.Time          `json:"created_at"`
+	Build         string             `json:"build"`
+	CatalogueID   string             `json:"catalogue_id"`
+	Catalogue     []backupItem       `json:"catalogue"`
+	Availability  []availabilitySpec `json:"availability"`
+	ItemStates    []itemState        `json:"item_states"`
+	ItemImages    []backupImage      `json:"item_images"`
+	Modifiers     []itemModifiers    `json:"modifiers"`
+	Combos        []comboSpec        `json:"combos"`
+	Categories    []itemCategory     `json:"categories"`
+	ItemCodes     []itemCode         `json:"item_codes"`
+	Specials      []special          `json:"specials"`
+	PriceChanges  []priceChange      `json:"price_changes"`
+	PriceTiers    []priceTier        `json:"price_tiers"`
+	CustomerTiers []backupCustomer   `json:"customer_tiers"`
+	Maintenance   maintenanceState   `json:"maintenance"`
+}
+
+type backupItem struct {
+	ItemID int     `json:"item_id"`
+	Name   string  `json:"name"`
+	Price  float64 `json:"price"`
+}
+
+type backupImage struct {
+	ItemID   int    `json:"item_id"`
+	ImageURL string `json:"image_url"`
+}
+
+type backupCustomer struct {
+	CellNumber string `json:"cell_number"`
+	Tier       string `json:"tier"`
+}
+
+// buildBackup reads the current configuration. The catalogue is read fresh
+// rather than from the pricelist, which has price changes applied.
+func buildBackup(db *sql.DB, mm *maintenanceMode) (shopBackup, error) {
+	b := shopBackup{
+		Format:      backupFormat,
+		CreatedAt:   time.Now().UTC(),
+		Build:       buildinfo.Get().Version,
+		CatalogueID: catalogueID,
+		Maintenance: mm.Get(),
+	}
+	vp, err := loadPricelist(db)
+	if err != nil {
+		return b, err
+	}
+	items, err := mb.GetCatalogueItemsFromDB(db, catalogueID)
+	if err != nil {
+		return b, err
+	}
+	for _, item := range items {
+		b.Catalogue = append(b.Catalogue, backupItem{ItemID: ctlgItemID(item), Name: ctlgItemName(item), Price: ctlgItemPrice(item)})
+	}
+	b.Availability = availabilitySpecs(vp.Rules)
+	b.ItemStates = itemStateList(vp.States)
+	for id, url := range vp.Images {
+		b.ItemImages = append(b.ItemImages, backupImage{ItemID: id, ImageURL: url})
+	}
+	sort.Slice(b.ItemImages, func(i, j int) bool { return b.ItemImages[i].ItemID < b.ItemImages[j].ItemID })
+	b.Modifiers = modifierList(vp.Modifiers)
+	b.Combos = comboList(vp.Combos)
+	b.Categories = itemCategoryList(vp.Categories)
+	manual, err := manualItemCodes(db)
+	if err != nil {
+		return b, err
+	}
+	b.ItemCodes = itemCodeList(vp, manual)
+	if b.Specials, err = listSpecials(db, true); err != nil {
+		return b, err
+	}
+	for i := range b.Specials {
+		b.Specials[i].ID = 0
+	}
+	if b.PriceChanges, err = listPriceChanges(db, true); err != nil {
+		return b, err
+	}
+	for i := range b.PriceChanges {
+		b.PriceChanges[i].ID = 0
+	}
+	for _, t := range vp.Tiers {
+		b.PriceTiers = append(b.PriceTiers, t)
+	}
+	sort.Slice(b.PriceTiers, func(i, j int) bool { return b.PriceTiers[i].Name < b.PriceTiers[j].Name })
+
+	rows, err := db.Query(`SELECT cell_number, tier FROM customer_profiles WHERE tier <> $1 ORDER BY cell_number`, retailTier)
+	if err != nil {
+		return b, fmt.Errorf("reading customer tiers: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c backupCustomer
+		if err := rows.Scan(&c.CellNumber, &c.Tier); err != nil {
+			return b, fmt.Errorf("reading customer tiers: %w", err)
+		}
+		b.CustomerTiers = append(b.CustomerTiers, c)
+	}
+	b.normalize()
+	return b, rows.Err()
+}
+
+// normalize puts every time in UTC, so the same moment compares equal
+// however it was written.
+func (b *shopBackup) normalize() {
+	utc := func(t *time.Time) *time.Time {
+		if t == nil {
+			return nil
+		}
+		u := t.UTC()
+		return &u
+	}
+	for i := range b.ItemStates {
+		b.ItemStates[i].InactiveSince = utc(b.ItemStates[i].InactiveSince)
+		b.ItemStates[i].DeletedAt = utc(b.ItemStates[i].DeletedAt)
+	}
+	for i := range b.PriceChanges {
+		b.PriceChanges[i].EffectiveFrom = b.PriceChanges[i].EffectiveFrom.UTC()
+	}
+	for i := range b.Specials {
+		s := &b.Specials[i]
+		s.StartsAt, s.EndsAt, s.AnnouncedAt = s.StartsAt.UTC(), s.EndsAt.UTC(), utc(s.AnnouncedAt)
+	}
+	b.Maintenance.Until = utc(b.Maintenance.Until)
+}
+
+// decodeBackup checks the format version, migrates older backups forward
+// and decodes the result strictly, so a field this build doesn't know is
+// an error rather than silently dropped.
+func decodeBackup(body []byte) (shopBackup, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return shopBackup{}, fmt.Errorf("invalid JSON body: %w", err)
+	}
+	raw, ok := doc["format"]
+	if !ok {
+		return shopBackup{}, errors.New("not a shop backup: no format field")
+	}
+	var format int
+	if err := json.Unmarshal(raw, &format); err != nil || format < 1 {
+		return shopBackup{}, fmt.Errorf("invalid backup format %s", raw)
+	}
+	if format > backupFormat {
+		return shopBackup{}, fmt.Errorf("backup format %d was written by a newer build; this build reads formats up to %d", format, backupFormat)
+	}
+	for ; format < backupFormat; format++ {
+		migrate, ok := backupMigrations[format]
+		if !ok {
+			return shopBackup{}, fmt.Errorf("no migration from backup format %d to %d", format, format+1)
+		}
+		if err := migrate(doc); err != nil {
+			return shopBackup{}, fmt.Errorf("migrating backup format %d to %d: %w", format, format+1, err)
+		}
+	}
+	doc["format"] = json.RawMessage(strconv.Itoa(backupFormat))
+
+	migrated, err := json.Marshal(doc)
+	if err != nil {
+		return shopBackup{}, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(migrated))
+	dec.DisallowUnknownFields()
+	var b shopBackup
+	if err := dec.Decode(&b); err != nil {
+		return shopBackup{}, fmt.Errorf("backup does not match format %d: %w", backupFormat, err)
+	}
+	b.normalize()
+	return b, nil
+}
+
+// validateBackup checks b against the live catalogue. Problems are errors;
+// catalogue drift, which a restore can't fix, only produces warnings.
+func validateBackup(b shopBackup, current []backupItem) (warnings []string, err error) {
+	if b.CatalogueID != catalogueID {
+		return nil, fmt.Errorf("backup is of catalogue %q, this deployment serves %q", b.CatalogueID, catalogueID)
+	}
+	live := make(map[int]backupItem, len(current))
+	for _, item := range current {
+		live[item.ItemID] = item
+	}
+	var problems []string
+	checkItem := func(what string, id int) {
+		if _, ok := live[id]; !ok {
+			problems = append(problems, fmt.Sprintf("%s refers to item %d, which is not in the catalogue", what, id))
+		}
+	}
+
+	for _, item := range b.Catalogue {
+		now, ok := live[item.ItemID]
+		switch {
+		case !ok:
+			warnings = append(warnings, fmt.Sprintf("catalogue item %d (%s) is missing here", item.ItemID, item.Name))
+		case now.Name != item.Name || now.Price != item.Price:
+			warnings = append(warnings, fmt.Sprintf("catalogue item %d is %s at %.2f here, %s at %.2f in the backup",
+				item.ItemID, now.Name, now.Price, item.Name, item.Price))
+		}
+	}
+	for _, spec := range b.Availability {
+		checkItem("availability", spec.ItemID)
+		if _, err := parseAvailabilityRule(spec); err != nil {
+			problems = append(problems, "availability: "+err.Error())
+		}
+	}
+	for _, s := range b.ItemStates {
+		checkItem("item state", s.ItemID)
+	}
+	for _, img := range b.ItemImages {
+		checkItem("item image", img.ItemID)
+		if !strings.HasPrefix(img.ImageURL, "https://") && !strings.HasPrefix(img.ImageURL, "http://") {
+			problems = append(problems, fmt.Sprintf("item image %d: %q is not a URL", img.ItemID, img.ImageURL))
+		}
+	}
+	for _, m := range b.Modifiers {
+		checkItem("modifiers", m.ItemID)
+		if err := validateModifierGroups(m.Groups); err != nil {
+			problems = append(problems, fmt.Sprintf("modifiers of item %d: %v", m.ItemID, err))
+		}
+	}
+	combos := make(map[int]bool, len(b.Combos))
+	for _, c := range b.Combos {
+		combos[c.ItemID] = true
+	}
+	exists := func(id int) bool {
+		_, ok := live[id]
+		return ok
+	}
+	isCombo := func(id int) bool { return combos[id] }
+	for _, c := range b.Combos {
+		checkItem("combo", c.ItemID)
+		if err := validateCombo(c.ItemID, c.Components, exists, isCombo); err != nil {
+			problems = append(problems, fmt.Sprintf("combo %d: %v", c.ItemID, err))
+		}
+	}
+	for _, c := range b.Categories {
+		checkItem("category", c.ItemID)
+		if c.Category == "" || c.Category != normalizeCategory(c.Category) {
+			problems = append(problems, fmt.Sprintf("item %d: invalid category %q", c.ItemID, c.Category))
+		}
+	}
+	codes := make(map[string]int, len(b.ItemCodes))
+	for _, c := range b.ItemCodes {
+		checkItem("item code", c.ItemID)
+		if err := validateItemCode(c.Code); err != nil {
+			problems = append(problems, fmt.Sprintf("item %d: %v", c.ItemID, err))
+		}
+		if other, dup := codes[c.Code]; dup {
+			problems = append(problems, fmt.Sprintf("items %d and %d both have code %q", other, c.ItemID, c.Code))
+		}
+		codes[c.Code] = c.ItemID
+	}
+	for _, s := range b.Specials {
+		if s.ItemID != 0 {
+			checkItem("special", s.ItemID)
+		}
+		if (s.ItemID == 0) == (s.Category == "") || s.DiscountPct <= 0 || s.DiscountPct > maxSpecialDiscount || !s.EndsAt.After(s.StartsAt) {
+			problems = append(problems, fmt.Sprintf("invalid special from %s", s.StartsAt.Format(time.RFC3339)))
+		}
+	}
+	for _, c := range b.PriceChanges {
+		checkItem("price change", c.ItemID)
+		if c.Price <= 0 || c.EffectiveFrom.IsZero() {
+			problems = append(problems, fmt.Sprintf("price change for item %d needs a positive price and effective_from", c.ItemID))
+		}
+	}
+	tiers := map[string]bool{retailTier: true}
+	for _, t := range b.PriceTiers {
+		if t.Name == "" || t.Name == retailTier || t.Name != strings.ToLower(t.Name) {
+			problems = append(problems, fmt.Sprintf("invalid price tier name %q", t.Name))
+		}
+		if t.Multiplier <= 0 {
+			problems = append(problems, fmt.Sprintf("price tier %s: multiplier must be positive", t.Name))
+		}
+		for id, price := range t.Prices {
+			checkItem("price tier "+t.Name, id)
+			if price < 0 {
+				problems = append(problems, fmt.Sprintf("price tier %s: negative price for item %d", t.Name, id))
+			}
+		}
+		tiers[t.Name] = true
+	}
+	for _, c := range b.CustomerTiers {
+		if number, err := canonicalNumber(c.CellNumber); err != nil || number != c.CellNumber {
+			problems = append(problems, fmt.Sprintf("customer tier: invalid number %q", c.CellNumber))
+		}
+		if !tiers[c.Tier] {
+			problems = append(problems, fmt.Sprintf("customer %s: unknown tier %q", c.CellNumber, c.Tier))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return warnings, errors.New(strings.Join(problems, "; "))
+	}
+	return warnings, nil
+}
+
+type restoreChange struct {
+	Section string `json:"section"`
+	Key     string `json:"key"`
+	Action  string `json:"action"` // add, update or remove
+}
+
+// backupSections keys each restorable section's rows for diffing.
+func backupSections(b shopBackup) map[string]map[string]any {
+	sections := map[string]map[string]any{
+		"availability":   {},
+		"item_states":    {},
+		"item_images":    {},
+		"modifiers":      {},
+		"combos":         {},
+		"categories":     {},
+		"specials":       {},
+		"price_changes":  {},
+		"price_tiers":    {},
+		"customer_tiers": {},
+		"maintenance":    {"maintenance": b.Maintenance},
+	}
+	for _, s := range b.Availability {
+		sections["availability"][itemRef(s.ItemID)] = s
+	}
+	for _, s := range b.ItemStates {
+		sections["item_states"][itemRef(s.ItemID)] = s
+	}
+	for _, img := range b.ItemImages {
+		sections["item_images"][itemRef(img.ItemID)] = img
+	}
+	for _, m := range b.Modifiers {
+		sections["modifiers"][itemRef(m.ItemID)] = m.Groups
+	}
+	for _, c := range b.Combos {
+		sections["combos"][itemRef(c.ItemID)] = c.Components
+	}
+	for _, c := range b.Categories {
+		sections["categories"][itemRef(c.ItemID)] = c.Category
+	}
+	if b.ItemCodes != nil {
+		sections["item_codes"] = map[string]any{}
+		for _, c := range b.ItemCodes {
+			sections["item_codes"][itemRef(c.ItemID)] = c
+		}
+	}
+	for _, s := range b.Specials {
+		target := s.Category
+		if s.ItemID != 0 {
+			target = itemRef(s.ItemID)
+		}
+		sections["specials"][target+" from "+s.StartsAt.Format(time.RFC3339)] = s
+	}
+	for _, c := range b.PriceChanges {
+		sections["price_changes"][itemRef(c.ItemID)+" from "+c.EffectiveFrom.Format(time.RFC3339)] = c.Price
+	}
+	for _, t := range b.PriceTiers {
+		sections["price_tiers"][t.Name] = t
+	}
+	for _, c := range b.CustomerTiers {
+		sections["customer_tiers"][c.CellNumber] = c.Tier
+	}
+	return sections
+}
+
+// diffBackups lists what restoring next over cur would change.
+func diffBackups(cur, next shopBackup) []restoreChange {
+	changes := []restoreChange{}
+	curSections, nextSections := backupSections(cur), backupSections(next)
+	for section, want := range nextSections {
+		have := curSections[section]
+		for key, row := range want {
+			old, ok := have[key]
+			if !ok {
+				changes = append(changes, restoreChange{section, key, "add"})
+			} else if !sameJSON(old, row) {
+				changes = append(changes, restoreChange{section, key, "update"})
+			}
+		}
+		for key := range have {
+			if _, ok := want[key]; !ok {
+				changes = append(changes, restoreChange{section, key, "remove"})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Section != changes[j].Section {
+			return changes[i].Section < changes[j].Section
+		}
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
+
+func sameJSON(a, b any) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+// applyBackup replaces every restorable section with the backup's rows.
+func applyBackup(tx *sql.Tx, b shopBackup) error {
+	for _, stmt := range []string{
+		`DELETE FROM item_availability WHERE catalogue_id = $1`,
+		`DELETE FROM item_state WHERE catalogue_id = $1`,
+		`DELETE FROM item_images WHERE catalogue_id = $1`,
+		`DELETE FROM item_modifiers WHERE catalogue_id = $1`,
+		`DELETE FROM item_combos WHERE catalogue_id = $1`,
+		`DELETE FROM item_categories WHERE catalogue_id = $1`,
+		`DELETE FROM specials WHERE catalogue_id = $1`,
+		`DELETE FROM price_changes WHERE catalogue_id = $1`,
+	} {
+		if _, err := tx.Exec(stmt, catalogueID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM price_tiers`); err != nil {
+		return err
+	}
+	if b.ItemCodes != nil {
+		if _, err := tx.Exec(`DELETE FROM item_codes WHERE catalogue_id = $1`, catalogueID); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE customer_profiles SET tier = $1, updated_at = now() WHERE tier <> $1`, retailTier); err != nil {
+		return err
+	}
+
+	for _, spec := range b.Availability {
+		if err := saveAvailabilityRule(tx, spec); err != nil {
+			return fmt.Errorf("availability for item %d: %w", spec.ItemID, err)
+		}
+	}
+	for _, s := range b.ItemStates {
+		_, err := tx.Exec(`INSERT INTO item_state (catalogue_id, item_id, is_active, inactive_since, deleted_at) VALUES ($1, $2, $3, $4, $5)`,
+			catalogueID, s.ItemID, s.Active, s.InactiveSince, s.DeletedAt)
+		if err != nil {
+			return fmt.Errorf("state of item %d: %w", s.ItemID, err)
+		}
+	}
+	for _, img := range b.ItemImages {
+		_, err := tx.Exec(`INSERT INTO item_images (catalogue_id, item_id, image_url) VALUES ($1, $2, $3)`, catalogueID, img.ItemID, img.ImageURL)
+		if err != nil {
+			return fmt.Errorf("image of item %d: %w", img.ItemID, err)
+		}
+	}
+	for _, m := range b.Modifiers {
+		if err := saveItemModifiers(tx, m.ItemID, m.Groups); err != nil {
+			return fmt.Errorf("modifiers of item %d: %w", m.ItemID, err)
+		}
+	}
+	for _, c := range b.Combos {
+		if err := saveCombo(tx, c.ItemID, c.Components); err != nil {
+			return fmt.Errorf("combo %d: %w", c.ItemID, err)
+		}
+	}
+	for _, c := range b.Categories {
+		if err := saveItemCategory(tx, c.ItemID, c.Category); err != nil {
+			return fmt.Errorf("category of item %d: %w", c.ItemID, err)
+		}
+	}
+	for _, c := range b.ItemCodes {
+		_, err := tx.Exec(`INSERT INTO item_codes (catalogue_id, item_id, code, manual) VALUES ($1, $2, $3, $4)`,
+			catalogueID, c.ItemID, c.Code, c.Manual)
+		if err != nil {
+			return fmt.Errorf("code of item %d: %w", c.ItemID, err)
+		}
+	}
+	for _, s := range b.Specials {
+		var itemID sql.NullInt64
+		if s.ItemID != 0 {
+			itemID = sql.NullInt64{Int64: int64(s.ItemID), Valid: true}
+		}
+		_, err := tx.Exec(`INSERT INTO specials (catalogue_id, item_id, category, discount_pct, starts_at, ends_at, broadcast, message, announced_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+			catalogueID, itemID, s.Category, s.DiscountPct, s.StartsAt, s.EndsAt, s.Broadcast, s.Message, s.AnnouncedAt)
+		if err != nil {
+			return fmt.Errorf("special from %s: %w", s.StartsAt.Format(time.RFC3339), err)
+		}
+	}
+	for _, c := range b.PriceChanges {
+		_, err := tx.Exec(`INSERT INTO price_changes (catalogue_id, item_id, price, effective_from) VALUES ($1, $2, $3, $4)`,
+			catalogueID, c.ItemID, c.Price, c.EffectiveFrom)
+		if err != nil {
+			return fmt.Errorf("price change for item %d: %w", c.ItemID, err)
+		}
+	}
+	for _, t := range b.PriceTiers {
+		if _, err := tx.Exec(`INSERT INTO price_tiers (name, multiplier) VALUES ($1, $2)`, t.Name, t.Multiplier); err != nil {
+			return fmt.Errorf("price tier %s: %w", t.Name, err)
+		}
+		for id, price := range t.Prices {
+			if _, err := tx.Exec(`INSERT INTO price_tier_items (tier, item_id, price) VALUES ($1, $2, $3)`, t.Name, id, price); err != nil {
+				return fmt.Errorf("price tier %s: %w", t.Name, err)
+			}
+		}
+	}
+	for _, c := range b.CustomerTiers {
+		_, err := tx.Exec(`INSERT INTO customer_profiles (cell_number, tier) VALUES ($1, $2)
+			ON CONFLICT (cell_number) DO UPDATE SET tier = EXCLUDED.tier, updated_at = now()`, c.CellNumber, c.Tier)
+		if err != nil {
+			return fmt.Errorf("tier of customer %s: %w", c.CellNumber, err)
+		}
+	}
+	return saveMaintenanceState(tx, b.Maintenance)
+}
+
+// BackupHandler serves GET /api/backup as a download.
+func BackupHandler(db *sql.DB, mm *maintenanceMode) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b, err := buildBackup(db, mm)
+		if err != nil {
+			log.Printf("Building backup failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "building backup failed")
+			return
+		}
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="menubot-backup-%s.json"`, b.CreatedAt.Format("20060102-150405")))
+		writeJSON(w, http.StatusOK, b)
+	}
+}
+
+type restoreResponse struct {
+	DryRun   bool            `json:"dry_run"`
+	Changes  []restoreChange `json:"changes"`
+	Warnings []string        `json:"warnings,omitempty"`
+	Version  int64           `json:"version,omitempty"`
+}
+
+// RestoreHandler serves POST /api/restore[?dry_run=true]. The backup
+// replaces the current configuration wholesale, in one transaction; a dry
+// run reports the changes without making them.
+func RestoreHandler(db *sql.DB, prclist *pricelistHolder, mm *maintenanceMode) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body bytes.Buffer
+		if _, err := body.ReadFrom(http.MaxBytesReader(w, r.Body, 16<<20)); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "reading body: "+err.Error())
+			return
+		}
+		next, err := decodeBackup(body.Bytes())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		cur, err := buildBackup(db, mm)
+		if err != nil {
+			log.Printf("Restore: reading current configuration failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "reading current configuration failed")
+			return
+		}
+		warnings, err := validateBackup(next, cur.Catalogue)
+		if err != nil {
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		resp := restoreResponse{DryRun: r.URL.Query().Get("dry_run") == "true", Changes: diffBackups(cur, next), Warnings: warnings}
+		if resp.DryRun {
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Restore: begin failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "restore failed")
+			return
+		}
+		defer tx.Rollback()
+		if err := applyBackup(tx, next); err != nil {
+			log.Printf("Restore failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "restore failed, nothing was changed")
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Restore: commit failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "restore failed, nothing was changed")
+			return
+		}
+		log.Printf("Restored configuration from a backup made %s (%d changes)", next.CreatedAt.Format(time.RFC3339), len(resp.Changes))
+		mm.adopt(next.Maintenance)
+		if resp.Version, err = rebuildPricelist(db, prclist); err != nil {
+			log.Printf("Rebuilding pricelist after restore failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "restored, but rebuilding the pricelist failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import "github.com/JeremyJalpha/MenuBot_WebAPI/httpapi"
+
+// branding is shown on the customer-facing HTML pages.
+type branding struct {
+	ShopName      string
+	LogoURL       string
+	SupportNumber string
+}
+
+// customerOrderData fills the CustomerOrder template.
+type customerOrderData = httpapi.Receipt
+
+// paymentPageData is passed to the payment return and cancel templates.
+// Order is nil until the page knows which order it is about.
+type paymentPageData struct {
+	Branding branding
+	Order    *customerOrderData
+}
+
+func brandingFromEnv(envVars EnvVars) branding {
+	return branding{
+		ShopName:      envVars.ShopName,
+		LogoURL:       envVars.ShopLogoURL,
+		SupportNumber: envVars.SupportNumber,
+	}
+}
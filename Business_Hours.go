@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata"
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// TimeWindow is a daily opening window on a set of weekdays. Times are
+// minutes after midnight; an End before Start wraps past midnight.
+type TimeWindow struct {
+	Days  [7]bool
+	Start int
+	End   int
+}
+
+// BusinessHours is the set of windows in which the shop takes orders. No
+// windows means always open.
+type BusinessHours struct {
+	Windows  []TimeWindow
+	Location *time.Location
+}
+
+// ParseBusinessHours parses a spec such as "Mon-Fri 08:00-17:00; Sat 09:00-13:00".
+// The day part is optional and defaults to every day.
+func ParseBusinessHours(spec, tz string) (BusinessHours, error) {
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return BusinessHours{}, fmt.Errorf("unknown timezone %q: %w", tz, err)
+	}
+	bh := BusinessHours{Location: loc}
+
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		window, err := parseTimeWindow(entry)
+		if err != nil {
+			return BusinessHours{}, err
+		}
+		bh.Windows = append(bh.Windows, window)
+	}
+
+	return bh, nil
+}
+
+func parseTimeWindow(entry string) (TimeWindow, error) {
+	var window TimeWindow
+	fields := strings.Fields(entry)
+
+	switch len(fields) {
+	case 1:
+		for d := range window.Days {
+			window.Days[d] = true
+		}
+	case 2:
+		days, err := parseWeekdays(fields[0])
+		if err != nil {
+			return TimeWindow{}, err
+		}
+		window.Days = days
+	default:
+		return TimeWindow{}, fmt.Errorf("invalid window %q, expected e.g. \"Mon-Fri 08:00-17:00\"", entry)
+	}
+
+	start, end, found := strings.Cut(fields[len(fields)-1], "-")
+	if !found {
+		return TimeWindow{}, fmt.Errorf("invalid time range %q, expected HH:MM-HH:MM", fields[len(fields)-1])
+	}
+	var err error
+	if window.Start, err = parseClock(start); err != nil {
+		return TimeWindow{}, err
+	}
+	if window.End, err = parseClock(end); err != nil {
+		return TimeWindow{}, err
+	}
+
+	return window, nil
+}
+
+// parseWeekdays accepts comma separated days or ranges, e.g. "Mon-Fri,Sun".
+func parseWeekdays(spec string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(spec, ",") {
+		from, to, isRange := strings.Cut(strings.ToLower(part), "-")
+		first, ok := weekdayNames[from]
+		if !ok {
+			return days, fmt.Errorf("unknown weekday %q", from)
+		}
+		last := first
+		if isRange {
+			if last, ok = weekdayNames[to]; !ok {
+				return days, fmt.Errorf("unknown weekday %q", to)
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func formatClock(minutes int) string {
+	return fmt.Sprintf("%02d:%02d", minutes/60, minutes%60)
+}
+
+// Contains reports whether t falls inside the window. t must already be in
+// the window's timezone.
+func (w TimeWindow) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.Start <= w.End {
+		return w.Days[t.Weekday()] && minute >= w.Start && minute < w.End
+	}
+	// Overnight window: the part after midnight belongs to the previous day.
+	if minute >= w.Start {
+		return w.Days[t.Weekday()]
+	}
+	return minute < w.End && w.Days[(t.Weekday()+6)%7]
+}
+
+func (w TimeWindow) String() string {
+	var days []string
+	all := true
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if w.Days[d] {
+			days = append(days, d.String()[:3])
+		} else {
+			all = false
+		}
+	}
+	hours := formatClock(w.Start) + "-" + formatClock(w.End)
+	if all {
+		return hours
+	}
+	return strings.Join(days, ",") + " " + hours
+}
+
+// IsOpen reports whether the shop is open at t.
+func (bh BusinessHours) IsOpen(t time.Time) bool {
+	if len(bh.Windows) == 0 {
+		return true
+	}
+	t = t.In(bh.Location)
+	for _, w := range bh.Windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+func (bh BusinessHours) String() string {
+	if len(bh.Windows) == 0 {
+		return "always open"
+	}
+	windows := make([]string, len(bh.Windows))
+	for i, w := range bh.Windows {
+		windows[i] = w.String()
+	}
+	return strings.Join(windows, "; ")
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	cancelRequestPending  = "pending"
+	cancelRequestApproved = "approved"
+	cancelRequestDenied   = "denied"
+)
+
+type refundRequestedEvent struct {
+	OrderID    int64  `json:"order_id"`
+	CellNumber string `json:"cell_number"`
+	Total      string `json:"total"`
+}
+
+// customerCancelOrder handles "cancel order". Unpaid orders are cancelled
+// on the spot; paid orders inside the cancellation window need the admin
+// to approve, since a refund has to be issued by hand.
+func customerCancelOrder(cc *commandContext, sender string, _ []string) string {
+	order, found, err := latestOrder(cc.db, sender)
+	if err != nil {
+		return cc.apology(incidentOrderLookup, sender, 0, err, "Cancel order: looking up the order",
+			"Sorry, something went wrong looking up your order. Please try again.")
+	}
+	if !found {
+		return "You don't have an order to cancel."
+	}
+
+	switch {
+	case order.Status == statusCancelled:
+		return fmt.Sprintf("Order %s is already cancelled.", order.reference())
+	case order.Status == statusExpired:
+		return fmt.Sprintf("Order %s has already expired unpaid, there is nothing to cancel.", order.reference())
+	case order.Status == statusDisputed:
+		return fmt.Sprintf("Order %s is on hold because of a problem with its payment. Please contact us on %s.",
+			order.reference(), cc.envVars.HostNumber)
+	case order.atOrPast(statusPreparing):
+		return fmt.Sprintf("Order %s is already %s, so it can no longer be cancelled here. Please contact us on %s.",
+			order.reference(), order.Status, cc.envVars.HostNumber)
+	case order.Status == statusUnpaid:
+		return cancelUnpaidOrder(cc, order)
+	}
+
+	window := cfg().CancelWindow
+	if order.PaidAt == nil || time.Since(*order.PaidAt) > window {
+		return fmt.Sprintf("Order %s was paid more than %s ago and can no longer be cancelled here. Please contact us on %s.",
+			order.reference(), window, cc.envVars.HostNumber)
+	}
+
+	_, err = cc.db.Exec(`INSERT INTO cancellation_requests (order_id, cell_number) VALUES ($1, $2)
+		ON CONFLICT (order_id) WHERE state = 'pending' DO NOTHING`, order.ID, sender)
+	if err != nil {
+		return cc.apology(incidentCancelRequest, sender, order.ID, err, "Cancel order: recording the request",
+			"Sorry, something went wrong recording your cancellation request. Please try again.")
+	}
+	cc.sender.SendOrder(cc.envVars.AdminNumber, fmt.Sprintf(
+		"Cancellation requested for paid order %d, %s (total %s) by %s.\nReply \"approve cancel %d\" or \"deny cancel %d\".",
+		order.ID, order.reference(), order.Total, sender, order.ID, order.ID), priorityNotify, order.ID)
+
+	return fmt.Sprintf("Order %s is already paid, so we've asked the shop to approve the cancellation. We'll let you know shortly.", order.reference())
+}
+
+func cancelUnpaidOrder(cc *commandContext, order orderSummary) string {
+	tx, err := cc.db.Begin()
+	if err != nil {
+		return cc.apology(incidentCancelOrder, order.CellNumber, order.ID, err, "Cancel order: starting the transaction",
+			"Sorry, something went wrong cancelling your order. Please try again.")
+	}
+	defer tx.Rollback()
+
+	cancelled, err := transitionOrder(tx, order.ID, statusCancelled, statusUnpaid)
+	if err == nil && cancelled {
+		err = closeOrder(tx, order.ID)
+	}
+	if err == nil && cancelled {
+		err = releaseLoyalty(tx, order.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return cc.apology(incidentCancelOrder, order.CellNumber, order.ID, err, "Cancel order: cancelling the order",
+			"Sorry, something went wrong cancelling your order. Please try again.")
+	}
+	if !cancelled {
+		// Paid between our lookup and the update; let the customer retry
+		// so they go through the paid-order path.
+		return fmt.Sprintf("Order %s changed while we were cancelling it. Please send \"cancel order\" again.", order.reference())
+	}
+	cc.events.Emit(eventOrderStatusChanged, orderStatusEvent{OrderID: order.ID, OrderRef: order.reference(), CellNumber: order.CellNumber, From: statusUnpaid, To: statusCancelled})
+	return fmt.Sprintf("Order %s has been cancelled and your cart has been cleared.", order.reference())
+}
+
+// parseOrderIDArg reads an admin command's order argument, a number or a
+// reference, which may have been typed with spaces.
+func parseOrderIDArg(db *sql.DB, args []string) (int64, error) {
+	if len(args) == 0 {
+		return 0, errNotOrderRef
+	}
+	return resolveOrderArg(db, strings.Join(args, " "))
+}
+
+// decideCancelRequest moves a pending request to approved or denied and
+// returns the customer it belongs to.
+func decideCancelRequest(db dbtx, orderID int64, decision string) (cellNumber string, found bool, err error) {
+	row := db.QueryRow(`UPDATE cancellation_requests SET state = $2, decided_at = now()
+		WHERE order_id = $1 AND state = 'pending' RETURNING cell_number`, orderID, decision)
+	err = row.Scan(&cellNumber)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	return cellNumber, err == nil, err
+}
+
+func adminApproveCancel(cc *commandContext, args []string) string {
+	orderID, err := parseOrderIDArg(cc.db, args)
+	if err != nil {
+		return orderArgError(err, "Usage: approve cancel <order number or reference>")
+	}
+	order, found, err := getOrder(cc.db, orderID)
+	if err != nil || !found {
+		return fmt.Sprintf("Order %d not found.", orderID)
+	}
+
+	tx, err := cc.db.Begin()
+	if err != nil {
+		return fmt.Sprintf("Approving cancellation of order %d failed: %v", orderID, err)
+	}
+	defer tx.Rollback()
+
+	cellNumber, found, err := decideCancelRequest(tx, orderID, cancelRequestApproved)
+	if err == nil && found {
+		_, err = transitionOrder(tx, orderID, statusCancelled, statusPaid, statusPreparing, statusReady)
+	}
+	if err == nil && found {
+		err = releaseLoyalty(tx, orderID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return fmt.Sprintf("Approving cancellation of order %d failed: %v", orderID, err)
+	}
+	if !found {
+		return fmt.Sprintf("There is no pending cancellation request for order %d.", orderID)
+	}
+
+	cc.events.Emit(eventOrderStatusChanged, orderStatusEvent{OrderID: orderID, OrderRef: order.reference(), CellNumber: cellNumber, From: order.Status, To: statusCancelled})
+	cc.events.Emit(eventRefundRequested, refundRequestedEvent{OrderID: orderID, CellNumber: cellNumber, Total: order.Total})
+	cc.advanceQueue()
+	cc.sender.SendOrder(cellNumber, fmt.Sprintf("Your cancellation of order %s has been approved. Your refund of %s will be processed shortly.", order.reference(), order.Total), priorityNotify, orderID)
+	return fmt.Sprintf("Order %d cancelled. Refund of %s to %s still needs to be paid out manually.", orderID, order.Total, cellNumber)
+}
+
+func adminDenyCancel(cc *commandContext, args []string) string {
+	orderID, err := parseOrderIDArg(cc.db, args)
+	if err != nil {
+		return orderArgError(err, "Usage: deny cancel <order number or reference>")
+	}
+	cellNumber, found, err := decideCancelRequest(cc.db, orderID, cancelRequestDenied)
+	if err != nil {
+		return fmt.Sprintf("Denying cancellation of order %d failed: %v", orderID, err)
+	}
+	if !found {
+		return fmt.Sprintf("There is no pending cancellation request for order %d.", orderID)
+	}
+	cc.sender.SendOrder(cellNumber, fmt.Sprintf("Sorry, your cancellation of order %s could not be approved. Please contact us on %s if you have questions.", cc.orderRef(orderID), cc.envVars.HostNumber), priorityNotify, orderID)
+	return fmt.Sprintf("Cancellation of order %d denied; the customer has been told.", orderID)
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// The website works on the same cart as the bot: the customer's open order
+// in MenuBotLib's table, read and written here the way "edit", "change"
+// and "remove" do, under the same per-sender lock as their messages. The
+// cart's version is a hash of its items as stored, so it changes whatever
+// changed them, MenuBotLib included; a write naming any other version
+// than the current one is refused with 409 rather than overwriting a
+// change the writer hasn't seen. Nothing is cached, so the bot's next
+// summary shows what the website did. Lines that can no longer be ordered
+// are listed as unavailable and left out of the totals, as checkout will
+// take them out.
+
+var errCartConflict = errors.New("the cart has changed since it was read")
+
+// cartVersion is the version of a cart whose items column holds items;
+// "" is the version of no cart at all.
+func cartVersion(items string) string {
+	if items == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(items))
+	return hex.EncodeToString(sum[:8])
+}
+
+type cartSpecial struct {
+	ItemID int    `json:"item_id"`
+	Hint   string `json:"hint"`
+}
+
+type cartResponse struct {
+	CellNumber string `json:"cell_number"`
+	// OrderID is 0, and Version "", while the customer has no cart.
+	OrderID  int64             `json:"order_id"`
+	OrderRef string            `json:"order_ref"`
+	Version  string            `json:"version"`
+	Tier     string            `json:"tier"`
+	Lines    []orderLineDetail `json:"lines"`
+	Specials []cartSpecial     `json:"specials,omitempty"`
+	// Unavailable are the lines checkout will take out, see
+	// resolveCartLines.
+	Unavailable []cartIssue `json:"unavailable,omitempty"`
+	Subtotal    float64     `json:"subtotal"`
+	// Surcharge is the items' options, Discount the loyalty points being
+	// redeemed; Total is what the payment link will ask for.
+	Surcharge float64 `json:"surcharge"`
+	Discount  float64 `json:"discount"`
+	Total     float64 `json:"total"`
+}
+
+// cartLineRequest is the body of the add and remove endpoints. Item is
+// anything "show" takes: a reference, code or name. Quantity defaults to
+// 1 for add and to all of it for remove.
+type cartLineRequest struct {
+	Item     string `json:"item"`
+	Quantity int    `json:"quantity"`
+	Version  string `json:"version"`
+}
+
+// buildCart describes the customer's cart as the bot would price it.
+func buildCart(db *sql.DB, vp versionedPricelist, cell string) (cartResponse, error) {
+	tier := customerTier(db, cell)
+	vp = vp.ForTier(tier)
+	cart := cartResponse{CellNumber: cell, Tier: tier, Lines: []orderLineDetail{}}
+	orderID, items, found, err := openOrder(db, cell)
+	if err != nil || !found {
+		return cart, err
+	}
+	cart.OrderID, cart.Version = orderID, cartVersion(items)
+	if cart.OrderRef, err = storedOrderRef(db, orderID); err != nil {
+		return cart, err
+	}
+	lines, err := decodeOrderLines(items)
+	if err != nil {
+		return cart, fmt.Errorf("decoding items: %w", err)
+	}
+	quoted, err := orderQuotedPrices(db, orderID)
+	if err != nil {
+		return cart, err
+	}
+	prices := make(quotedPrices, len(lines))
+	now := time.Now()
+	cart.Unavailable = resolveCartLines(vp, lines, quoted, now).Removed
+	unavailable := map[int]bool{}
+	for _, issue := range cart.Unavailable {
+		unavailable[issue.ItemID] = true
+	}
+	for _, line := range lines {
+		price := linePrice(vp, quoted, line.ItemID)
+		prices[strconv.Itoa(line.ItemID)] = price
+		if unavailable[line.ItemID] {
+			continue
+		}
+		cart.Subtotal += price * float64(line.Quantity)
+		if s, ok := vp.Specials[line.ItemID]; ok {
+			cart.Specials = append(cart.Specials, cartSpecial{ItemID: line.ItemID, Hint: s.hint(now)})
+		}
+	}
+	cart.Lines = orderLineDetails(vp, lines, prices)
+	if cart.Surcharge, err = orderSurcharge(db, orderID); err != nil {
+		return cart, err
+	}
+	if cart.Discount, err = orderDiscount(db, orderID); err != nil {
+		return cart, err
+	}
+	cart.Total = payableAmount(cart.Subtotal, cart.Surcharge, cart.Discount)
+	return cart, nil
+}
+
+// lockCart locks the customer's cart row and checks it is still at
+// version. A missing cart is only created for add.
+func lockCart(tx *sql.Tx, cell, version string, create bool) (orderID int64, entries []map[string]json.RawMessage, created bool, err error) {
+	var items string
+	err = tx.QueryRow(`SELECT `+orderIDColumn+`, COALESCE(`+orderItemsColumn+`::text, '') FROM `+orderTable+
+		` WHERE `+orderCellColumn+` = $1 AND `+orderOpenFilter+` ORDER BY `+orderIDColumn+` DESC LIMIT 1 FOR UPDATE`, cell).
+		Scan(&orderID, &items)
+	if errors.Is(err, sql.ErrNoRows) {
+		if version != "" {
+			return 0, nil, false, errCartConflict
+		}
+		if !create {
+			return 0, nil, false, sql.ErrNoRows
+		}
+		err = tx.QueryRow(`INSERT INTO `+orderTable+` (`+orderCellColumn+`, `+orderItemsColumn+`, `+orderTotalColumn+`)
+			VALUES ($1, '[]', 0) RETURNING `+orderIDColumn, cell).Scan(&orderID)
+		return orderID, nil, true, err
+	}
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if cartVersion(items) != version {
+		return 0, nil, false, errCartConflict
+	}
+	if items != "" {
+		if err := json.Unmarshal([]byte(items), &entries); err != nil {
+			return 0, nil, false, fmt.Errorf("decoding items: %w", err)
+		}
+	}
+	return orderID, entries, false, nil
+}
+
+// addCartLine adds qty of itemID to the cart, as a line of its own unless
+// the item is already in it.
+func addCartLine(tx *sql.Tx, orderID int64, entries []map[string]json.RawMessage, itemID, qty int, vp versionedPricelist) ([]orderLine, error) {
+	quoted, err := orderQuotedPrices(tx, orderID)
+	if err != nil {
+		return nil, err
+	}
+	var lines []orderLine
+	var total float64
+	added := false
+	for _, entry := range entries {
+		var line orderLine
+		if err := remarshal(entry, &line); err != nil {
+			return nil, fmt.Errorf("decoding items: %w", err)
+		}
+		if line.ItemID == itemID && !added {
+			line.Quantity += qty
+			entry["Quantity"] = json.RawMessage(strconv.Itoa(line.Quantity))
+			added = true
+		}
+		lines = append(lines, line)
+		total += linePrice(vp, quoted, line.ItemID) * float64(line.Quantity)
+	}
+	if !added {
+		line := orderLine{ItemID: itemID, Quantity: qty}
+		entry := map[string]json.RawMessage{}
+		if err := remarshal(line, &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+		lines = append(lines, line)
+		total += linePrice(vp, quoted, itemID) * float64(qty)
+	}
+	return lines, saveOrderLines(tx, orderID, entries, total)
+}
+
+func remarshal(from, to any) error {
+	encoded, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, to)
+}
+
+func GetCartHandler(cc *commandContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cell, err := canonicalNumber(chi.URLParam(r, "cell"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		cart, err := buildCart(cc.db, cc.prclist.Snapshot(), cell)
+		if err != nil {
+			log.Printf("Reading cart of %s failed: %v", cell, err)
+			writeJSONError(w, http.StatusInternalServerError, "reading cart failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, cart)
+	}
+}
+
+// AddCartLineHandler adds an item to the customer's cart, starting one if
+// they have none.
+func AddCartLineHandler(cc *commandContext) http.HandlerFunc {
+	return cartLineHandler(cc, true)
+}
+
+// RemoveCartLineHandler takes some or all of an item out of the cart.
+func RemoveCartLineHandler(cc *commandContext) http.HandlerFunc {
+	return cartLineHandler(cc, false)
+}
+
+func cartLineHandler(cc *commandContext, add bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cell, err := canonicalNumber(chi.URLParam(r, "cell"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var req cartLineRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		if req.Quantity < 0 || req.Quantity > maxEditQuantity {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("quantity must be 0 to %d", maxEditQuantity))
+			return
+		}
+		snap := cc.prclist.Snapshot()
+		vp := snap.ForTier(customerTier(cc.db, cell))
+		item, ok := findItem(vp, strings.TrimSpace(req.Item))
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no item called %q", req.Item))
+			return
+		}
+		itemID := ctlgItemID(item)
+		if add {
+			if reply := unavailableItemsReply(vp, []int{itemID}, time.Now()); reply != "" {
+				writeJSONError(w, http.StatusConflict, reply)
+				return
+			}
+		}
+
+		unlock := cc.senders.Lock(cell)
+		defer unlock()
+		orderID, before, lines, created, err := writeCartLine(cc.db, vp, cell, req, itemID, add)
+		switch {
+		case errors.Is(err, errCartConflict):
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		case errors.Is(err, sql.ErrNoRows):
+			writeJSONError(w, http.StatusNotFound, "no such item in the cart")
+			return
+		case err != nil:
+			log.Printf("Changing cart of %s failed: %v", cell, err)
+			writeJSONError(w, http.StatusInternalServerError, "changing cart failed")
+			return
+		}
+		if created {
+			ref, err := assignOrderRef(cc.db, cc.envVars.OrderRefPrefix, orderID)
+			if err != nil {
+				log.Printf("Giving order %d its reference failed: %v", orderID, err)
+			}
+			cc.events.Emit(eventOrderCreated, orderEvent{OrderID: orderID, OrderRef: ref, CellNumber: cell})
+		}
+		// What the conversation records when a message changes the cart.
+		recordItemAdditions(cc.db, cell, orderID, before, lines)
+		if err := trimLineOptions(cc.db, orderID, lines); err != nil {
+			log.Printf("Trimming options of order %d failed: %v", orderID, err)
+		}
+		if err := stampPricelistVersion(cc.db, orderID, snap.Version, cc.envVars.PayFastMode); err != nil {
+			log.Printf("Stamping pricelist version on order %d failed: %v", orderID, err)
+		}
+		if err := stampQuotedPrices(cc.db, orderID, quotePrices(vp, lines), false); err != nil {
+			log.Printf("Stamping quoted prices on order %d failed: %v", orderID, err)
+		}
+		if err := stampItemCodes(cc.db, orderID, vp, lines); err != nil {
+			log.Printf("Stamping item codes on order %d failed: %v", orderID, err)
+		}
+		log.Printf("%s changed %s in the cart of %s (order %d) from the API", staffFromContext(r.Context()).Name, itemRef(itemID), cell, orderID)
+
+		cart, err := buildCart(cc.db, snap, cell)
+		if err != nil {
+			log.Printf("Reading cart of %s failed: %v", cell, err)
+			writeJSONError(w, http.StatusInternalServerError, "reading cart failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, cart)
+	}
+}
+
+// writeCartLine makes one change to the cart in a transaction. created is
+// set when the cart was started for it.
+func writeCartLine(db *sql.DB, vp versionedPricelist, cell string, req cartLineRequest, itemID int, add bool) (orderID int64, before, lines []orderLine, created bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, nil, nil, false, err
+	}
+	defer tx.Rollback()
+	orderID, entries, created, err := lockCart(tx, cell, req.Version, add)
+	if err != nil {
+		return 0, nil, nil, false, err
+	}
+	if err := remarshal(entries, &before); err != nil {
+		return 0, nil, nil, false, fmt.Errorf("decoding items: %w", err)
+	}
+	if add {
+		qty := max(req.Quantity, 1)
+		lines, err = addCartLine(tx, orderID, entries, itemID, qty, vp)
+	} else {
+		qty := 0
+		for _, line := range before {
+			if line.ItemID == itemID && req.Quantity > 0 {
+				qty = max(line.Quantity-req.Quantity, 0)
+			}
+		}
+		var changed bool
+		lines, changed, err = setLineQuantity(tx, orderID, itemID, qty, vp)
+		if err == nil && !changed {
+			err = sql.ErrNoRows
+		}
+	}
+	if err != nil {
+		return 0, nil, nil, false, err
+	}
+	return orderID, before, lines, created, tx.Commit()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A cart can outlive what's in it: an item taken out of the catalogue,
+// deleted or switched off here, or outside its availability window since
+// it was added. MenuBotLib fails on such a line at checkout, and a link
+// rebuilt for a checked-out order would charge for it, so every checkout
+// and every rebuilt payment link first resolves the order against the
+// current pricelist. Lines that can't be ordered are taken out and the
+// total is recomputed without them, and the customer is told which lines
+// went and why and shown what is left. No link goes out that time: the
+// next checkout, once they've seen the adjusted cart, is their go-ahead.
+//
+// An open cart is re-quoted when lines are taken out, since MenuBotLib's
+// link uses today's prices and the total shown should be the one charged;
+// the price changes are listed with the removals. A checked-out order
+// keeps the prices it was quoted.
+
+const (
+	cartLineDeleted     = "deleted"     // no longer in the catalogue, or deleted here
+	cartLineInactive    = "inactive"    // switched off
+	cartLineUnavailable = "unavailable" // outside its window, or a combo missing a component
+)
+
+// cartIssue is a line resolution takes out of an order.
+type cartIssue struct {
+	ItemID   int    `json:"item_id"`
+	Name     string `json:"name"`
+	Quantity int    `json:"quantity"`
+	Reason   string `json:"reason"`
+	// Detail is why, as the customer is told, e.g. "it's only available
+	// Sat-Sun".
+	Detail string `json:"detail"`
+}
+
+// cartRepricing is a line whose price changed since it was quoted.
+type cartRepricing struct {
+	ItemID int
+	Name   string
+	Was    float64
+	Now    float64
+}
+
+type cartResolution struct {
+	Removed  []cartIssue
+	Repriced []cartRepricing
+}
+
+// lineIssue says why itemID can't be ordered at now, or returns false
+// when it can.
+func lineIssue(vp versionedPricelist, itemID int, now time.Time) (reason, detail string, ok bool) {
+	if !itemExists(vp, itemID) || vp.Deleted(itemID) {
+		return cartLineDeleted, "it's no longer on our menu", true
+	}
+	if !vp.Listed(itemID) {
+		return cartLineInactive, "it's not available at the moment", true
+	}
+	if rule, ok := vp.Rules[itemID]; ok && !rule.AvailableAt(now, cfg().BusinessHours.Location) {
+		return cartLineUnavailable, "it's only available " + rule.Describe(), true
+	}
+	if missing := vp.unavailableComponents(itemID, now); len(missing) > 0 {
+		return cartLineUnavailable, "we're out of " + strings.Join(missing, " and "), true
+	}
+	return "", "", false
+}
+
+// resolveCartLines checks each item in lines against vp. An item split
+// over several lines is reported once, with their quantities added up.
+func resolveCartLines(vp versionedPricelist, lines []orderLine, quoted quotedPrices, now time.Time) cartResolution {
+	var res cartResolution
+	seen := map[int]int{}
+	for _, line := range lines {
+		if i, ok := seen[line.ItemID]; ok {
+			if i >= 0 {
+				res.Removed[i].Quantity += line.Quantity
+			}
+			continue
+		}
+		seen[line.ItemID] = -1
+		if reason, detail, ok := lineIssue(vp, line.ItemID, now); ok {
+			seen[line.ItemID] = len(res.Removed)
+			res.Removed = append(res.Removed, cartIssue{ItemID: line.ItemID, Name: vp.itemName(line.ItemID),
+				Quantity: line.Quantity, Reason: reason, Detail: detail})
+			continue
+		}
+		item, _ := vp.Item(line.ItemID)
+		was, ok := quoted[strconv.Itoa(line.ItemID)]
+		if ok && math.Round(was*100) != math.Round(ctlgItemPrice(item)*100) {
+			res.Repriced = append(res.Repriced, cartRepricing{ItemID: line.ItemID, Name: ctlgItemName(item), Was: was, Now: ctlgItemPrice(item)})
+		}
+	}
+	return res
+}
+
+// resolveOrder takes the lines that can't be ordered out of the order, as
+// part of tx, and returns the lines left. requote re-quotes what is left
+// at today's prices when anything was taken out; Repriced is only set
+// then.
+func resolveOrder(tx *sql.Tx, vp versionedPricelist, orderID int64, requote bool, now time.Time) (cartResolution, []orderLine, error) {
+	var items string
+	err := tx.QueryRow(`SELECT COALESCE(`+orderItemsColumn+`::text, '') FROM `+orderTable+
+		` WHERE `+orderIDColumn+` = $1 FOR UPDATE`, orderID).Scan(&items)
+	if err != nil {
+		return cartResolution{}, nil, err
+	}
+	lines, err := decodeOrderLines(items)
+	if err != nil {
+		return cartResolution{}, nil, fmt.Errorf("decoding items: %w", err)
+	}
+	quoted, err := orderQuotedPrices(tx, orderID)
+	if err != nil {
+		return cartResolution{}, nil, err
+	}
+	res := resolveCartLines(vp, lines, quoted, now)
+	if len(res.Removed) == 0 || !requote {
+		res.Repriced = nil
+	}
+	if len(res.Removed) == 0 {
+		return res, lines, nil
+	}
+	if requote {
+		if err := stampQuotedPrices(tx, orderID, quotePrices(vp, lines), true); err != nil {
+			return res, nil, fmt.Errorf("re-quoting: %w", err)
+		}
+	}
+	for _, issue := range res.Removed {
+		if lines, _, err = setLineQuantity(tx, orderID, issue.ItemID, 0, vp); err != nil {
+			return res, nil, fmt.Errorf("removing %s: %w", itemRef(issue.ItemID), err)
+		}
+	}
+	return res, lines, nil
+}
+
+// notice tells the customer what was taken out of their order and why.
+func (res cartResolution) notice() string {
+	var b strings.Builder
+	b.WriteString("Sorry, we've had to take some items out of your order:")
+	for _, issue := range res.Removed {
+		fmt.Fprintf(&b, "\n%d x %s: %s", issue.Quantity, issue.Name, issue.Detail)
+	}
+	if len(res.Repriced) > 0 {
+		b.WriteString("\nPrices also changed since these were added:")
+		for _, p := range res.Repriced {
+			fmt.Fprintf(&b, "\n%s: was R%.2f, now R%.2f", p.Name, p.Was, p.Now)
+		}
+	}
+	return b.String()
+}
+
+// cartAdjusted finishes up after resolution took lines out of the order,
+// once committed, and describes the adjusted order to the customer; next
+// tells them how to go ahead with it.
+func (cc *commandContext) cartAdjusted(cell string, vp versionedPricelist, orderID int64, res cartResolution, lines []orderLine, next string) string {
+	if err := trimLineOptions(cc.db, orderID, lines); err != nil {
+		log.Printf("Trimming options of order %d failed: %v", orderID, err)
+	}
+	cc.modifierPrompts.clear(cell, 0)
+	var removed []string
+	for _, issue := range res.Removed {
+		removed = append(removed, fmt.Sprintf("%s (%s)", itemRef(issue.ItemID), issue.Reason))
+		metrics.Inc("menubot_cart_lines_removed_total", "Order lines taken out at checkout because their item can no longer be ordered.", "reason", issue.Reason)
+	}
+	log.Printf("Took %s out of order %d of %s", strings.Join(removed, ", "), orderID, cell)
+
+	reply := res.notice()
+	if len(lines) == 0 {
+		return reply + "\n\nThere's nothing left in your order; send \"menu\" to start a new one."
+	}
+	return reply + "\n\n" + cartSummary(cc.db, vp, orderID, lines) + "\n\n" + next
+}
+
+// unresolvedCartReply holds up a checkout of a cart with lines that can't
+// be ordered any more, taking them out and showing what is left.
+func unresolvedCartReply(cc *commandContext, vp versionedPricelist, cell, msg string, now time.Time) (string, int64, bool) {
+	if !isCheckoutCommand(msg) && !isNewOrderAnyway(msg) {
+		return "", 0, false
+	}
+	orderID, _, found, err := openOrder(cc.db, cell)
+	if err != nil || !found {
+		return "", 0, false
+	}
+	const failed = "Sorry, something went wrong checking your cart. Please try again."
+	tx, err := cc.db.Begin()
+	if err != nil {
+		return cc.apology(incidentCartChange, cell, orderID, err, "Checkout: starting the cart check", failed), orderID, true
+	}
+	defer tx.Rollback()
+	res, lines, err := resolveOrder(tx, vp, orderID, true, now)
+	if err != nil {
+		return cc.apology(incidentCartChange, cell, orderID, err, "Checkout: taking unavailable items out of the cart", failed), orderID, true
+	}
+	if len(res.Removed) == 0 {
+		return "", 0, false
+	}
+	if err := tx.Commit(); err != nil {
+		return cc.apology(incidentCartChange, cell, orderID, err, "Checkout: committing the adjusted cart", failed), orderID, true
+	}
+	return cc.cartAdjusted(cell, vp, orderID, res, lines,
+		fmt.Sprintf("Send \"%s\" again to pay for it.", checkoutCommands[0])), orderID, true
+}
+
+// resolveCheckedOutOrder resolves an unpaid checked-out order before its
+// payment link is rebuilt. It returns the customer's reply, and true, when
+// lines were taken out or the order couldn't be checked; the link is only
+// rebuilt on their next checkout then.
+func resolveCheckedOutOrder(cc *commandContext, vp versionedPricelist, cell string, orderID int64) (string, bool) {
+	const failed = "Sorry, something went wrong checking your order. Please try again."
+	tx, err := cc.db.Begin()
+	if err != nil {
+		return cc.apology(incidentCartChange, cell, orderID, err, "Resuming checkout: starting the order check", failed), true
+	}
+	defer tx.Rollback()
+	res, lines, err := resolveOrder(tx, vp, orderID, false, time.Now())
+	if err != nil {
+		return cc.apology(incidentCartChange, cell, orderID, err, "Resuming checkout: taking unavailable items out of the order", failed), true
+	}
+	if len(res.Removed) == 0 {
+		return "", false
+	}
+	if err := tx.Commit(); err != nil {
+		return cc.apology(incidentCartChange, cell, orderID, err, "Resuming checkout: committing the adjusted order", failed), true
+	}
+	return cc.cartAdjusted(cell, vp, orderID, res, lines,
+		fmt.Sprintf("Send \"%s\" again for the payment link.", checkoutCommands[0])), true
+}
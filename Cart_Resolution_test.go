@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+)
+
+// cartNow is a Wednesday.
+var cartNow = time.Date(2026, 3, 4, 12, 0, 0, 0, time.UTC)
+
+// cartPricelist is the catalogue as it is at checkout, after the carts in
+// these tests were filled.
+func cartPricelist(t *testing.T) versionedPricelist {
+	t.Helper()
+	weekends, err := parseAvailabilityRule(availabilitySpec{ItemID: 9, Days: "Sat-Sun"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ended, err := parseAvailabilityRule(availabilitySpec{ItemID: 15, To: "2026-02-28"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := cartNow.Add(-time.Hour)
+	return versionedPricelist{
+		Items: []mb.CatalogueItem{
+			ctlgItemWithPrice(mb.CatalogueItem{CatalogueItemID: 7, Item: "Brownie"}, 25),
+			ctlgItemWithPrice(mb.CatalogueItem{CatalogueItemID: 8, Item: "Muffin"}, 32),
+			ctlgItemWithPrice(mb.CatalogueItem{CatalogueItemID: 9, Item: "Brunch platter"}, 120),
+			ctlgItemWithPrice(mb.CatalogueItem{CatalogueItemID: 10, Item: "Coffee combo"}, 55),
+			ctlgItemWithPrice(mb.CatalogueItem{CatalogueItemID: 11, Item: "Croissant"}, 20),
+			ctlgItemWithPrice(mb.CatalogueItem{CatalogueItemID: 13, Item: "Lemon tart"}, 30),
+			ctlgItemWithPrice(mb.CatalogueItem{CatalogueItemID: 14, Item: "Carrot cake"}, 35),
+			ctlgItemWithPrice(mb.CatalogueItem{CatalogueItemID: 15, Item: "Hot cross bun"}, 15),
+		},
+		// Item 12 has been taken out of the catalogue altogether.
+		Rules:  map[int]availabilityRule{9: weekends, 15: ended},
+		Combos: map[int][]comboComponent{10: {{ItemID: 7, Quantity: 1}, {ItemID: 11, Quantity: 1}}},
+		States: map[int]itemState{
+			11: {ItemID: 11, Active: false},
+			13: {ItemID: 13, Active: true, DeletedAt: &deleted},
+			14: {ItemID: 14, Active: false},
+		},
+	}
+}
+
+func TestResolveCartLines(t *testing.T) {
+	withRuntimeConfig(t, &RuntimeConfig{BusinessHours: BusinessHours{Location: time.UTC}})
+	vp := cartPricelist(t)
+	tests := []struct {
+		name     string
+		lines    []orderLine
+		quoted   quotedPrices
+		removed  []cartIssue
+		repriced []cartRepricing
+	}{
+		{name: "nothing wrong", lines: []orderLine{{7, 2}, {8, 1}}, quoted: quotedPrices{"7": 25, "8": 32}},
+		{name: "never quoted", lines: []orderLine{{7, 2}}},
+		{name: "no longer in the catalogue", lines: []orderLine{{7, 1}, {12, 2}},
+			removed: []cartIssue{{ItemID: 12, Name: "item12", Quantity: 2, Reason: cartLineDeleted, Detail: "it's no longer on our menu"}}},
+		{name: "deleted here", lines: []orderLine{{13, 1}},
+			removed: []cartIssue{{ItemID: 13, Name: "Lemon tart", Quantity: 1, Reason: cartLineDeleted, Detail: "it's no longer on our menu"}}},
+		{name: "switched off", lines: []orderLine{{14, 3}},
+			removed: []cartIssue{{ItemID: 14, Name: "Carrot cake", Quantity: 3, Reason: cartLineInactive, Detail: "it's not available at the moment"}}},
+		{name: "outside its days", lines: []orderLine{{9, 1}},
+			removed: []cartIssue{{ItemID: 9, Name: "Brunch platter", Quantity: 1, Reason: cartLineUnavailable, Detail: "it's only available Sat-Sun"}}},
+		{name: "past its end date", lines: []orderLine{{15, 6}},
+			removed: []cartIssue{{ItemID: 15, Name: "Hot cross bun", Quantity: 6, Reason: cartLineUnavailable, Detail: "it's only available until 2026-02-28"}}},
+		{name: "combo missing a component", lines: []orderLine{{10, 1}},
+			removed: []cartIssue{{ItemID: 10, Name: "Coffee combo", Quantity: 1, Reason: cartLineUnavailable, Detail: "we're out of Croissant"}}},
+		{name: "split over lines", lines: []orderLine{{12, 1}, {7, 1}, {12, 2}, {7, 1}},
+			removed: []cartIssue{{ItemID: 12, Name: "item12", Quantity: 3, Reason: cartLineDeleted, Detail: "it's no longer on our menu"}}},
+		{name: "price went up", lines: []orderLine{{7, 1}, {8, 1}}, quoted: quotedPrices{"7": 25, "8": 30},
+			repriced: []cartRepricing{{ItemID: 8, Name: "Muffin", Was: 30, Now: 32}}},
+		{name: "price went down", lines: []orderLine{{8, 1}}, quoted: quotedPrices{"8": 35},
+			repriced: []cartRepricing{{ItemID: 8, Name: "Muffin", Was: 35, Now: 32}}},
+		{name: "price changed on a split line", lines: []orderLine{{8, 1}, {8, 2}}, quoted: quotedPrices{"8": 30},
+			repriced: []cartRepricing{{ItemID: 8, Name: "Muffin", Was: 30, Now: 32}}},
+		{name: "removed line isn't repriced", lines: []orderLine{{14, 1}}, quoted: quotedPrices{"14": 30},
+			removed: []cartIssue{{ItemID: 14, Name: "Carrot cake", Quantity: 1, Reason: cartLineInactive, Detail: "it's not available at the moment"}}},
+		{name: "everything at once", lines: []orderLine{{12, 1}, {14, 1}, {8, 1}, {9, 2}}, quoted: quotedPrices{"8": 30},
+			removed: []cartIssue{
+				{ItemID: 12, Name: "item12", Quantity: 1, Reason: cartLineDeleted, Detail: "it's no longer on our menu"},
+				{ItemID: 14, Name: "Carrot cake", Quantity: 1, Reason: cartLineInactive, Detail: "it's not available at the moment"},
+				{ItemID: 9, Name: "Brunch platter", Quantity: 2, Reason: cartLineUnavailable, Detail: "it's only available Sat-Sun"},
+			},
+			repriced: []cartRepricing{{ItemID: 8, Name: "Muffin", Was: 30, Now: 32}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := resolveCartLines(vp, tt.lines, tt.quoted, cartNow)
+			if !sameJSON(res.Removed, tt.removed) {
+				t.Errorf("removed %+v, want %+v", res.Removed, tt.removed)
+			}
+			if !sameJSON(res.Repriced, tt.repriced) {
+				t.Errorf("repriced %+v, want %+v", res.Repriced, tt.repriced)
+			}
+		})
+	}
+
+	t.Run("available again at the weekend", func(t *testing.T) {
+		if res := resolveCartLines(vp, []orderLine{{9, 1}}, nil, cartNow.AddDate(0, 0, 3)); len(res.Removed) != 0 {
+			t.Errorf("removed %+v on a Saturday", res.Removed)
+		}
+	})
+}
+
+func TestCartResolutionNotice(t *testing.T) {
+	res := cartResolution{
+		Removed: []cartIssue{
+			{ItemID: 12, Name: "item12", Quantity: 2, Reason: cartLineDeleted, Detail: "it's no longer on our menu"},
+			{ItemID: 9, Name: "Brunch platter", Quantity: 1, Reason: cartLineUnavailable, Detail: "it's only available Sat-Sun"},
+		},
+	}
+	want := "Sorry, we've had to take some items out of your order:\n2 x item12: it's no longer on our menu\n1 x Brunch platter: it's only available Sat-Sun"
+	if got := res.notice(); got != want {
+		t.Errorf("notice = %q, want %q", got, want)
+	}
+	res.Repriced = []cartRepricing{{ItemID: 8, Name: "Muffin", Was: 30, Now: 32.5}}
+	if got := res.notice(); got != want+"\nPrices also changed since these were added:\nMuffin: was R30.00, now R32.50" {
+		t.Errorf("notice = %q", got)
+	}
+}
+
+// fakeCartDB holds one order's items and quoted prices, answering the
+// statements resolveOrder makes.
+type fakeCartDB struct {
+	items  string
+	quoted string // "" for never quoted
+	total  string
+	fail   string // a statement containing it fails
+}
+
+func (db *fakeCartDB) Open(string) (driver.Conn, error) { return fakeCartConn{db}, nil }
+
+type fakeCartConn struct{ db *fakeCartDB }
+
+func (c fakeCartConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fake cart db: prepare not supported")
+}
+func (c fakeCartConn) Close() error              { return nil }
+func (c fakeCartConn) Begin() (driver.Tx, error) { return c, nil }
+func (c fakeCartConn) Commit() error             { return nil }
+func (c fakeCartConn) Rollback() error           { return nil }
+
+func (c fakeCartConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if c.db.fail != "" && strings.Contains(query, c.db.fail) {
+		return nil, errors.New("injected failure")
+	}
+	switch {
+	case strings.Contains(query, "FOR UPDATE"):
+		return &fakeCartRows{rows: []string{c.db.items}}, nil
+	case strings.Contains(query, "SELECT quoted_prices"):
+		rows := &fakeCartRows{}
+		if c.db.quoted != "" {
+			rows.rows = append(rows.rows, c.db.quoted)
+		}
+		return rows, nil
+	}
+	return nil, errors.New("fake cart db: unexpected query")
+}
+
+func (c fakeCartConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if c.db.fail != "" && strings.Contains(query, c.db.fail) {
+		return nil, errors.New("injected failure")
+	}
+	switch {
+	case strings.Contains(query, "INSERT INTO order_meta"):
+		c.db.quoted = args[1].Value.(string)
+	case strings.Contains(query, "UPDATE "+orderTable):
+		c.db.items, c.db.total = args[1].Value.(string), args[2].Value.(string)
+	default:
+		return nil, errors.New("fake cart db: unexpected statement")
+	}
+	return driver.RowsAffected(1), nil
+}
+
+type fakeCartRows struct{ rows []string }
+
+func (r *fakeCartRows) Columns() []string { return []string{"value"} }
+func (r *fakeCartRows) Close() error      { return nil }
+func (r *fakeCartRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	dest[0], r.rows = r.rows[0], r.rows[1:]
+	return nil
+}
+
+// TestResolveOrder resolves stored orders the way checkout (requote) and
+// a rebuilt payment link (no requote) do, checking what is left, the total
+// charged for it and what the customer is told.
+func TestResolveOrder(t *testing.T) {
+	withRuntimeConfig(t, &RuntimeConfig{BusinessHours: BusinessHours{Location: time.UTC}})
+	vp := cartPricelist(t)
+	fake := &fakeCartDB{}
+	sql.Register("fakecart", fake)
+	db, err := sql.Open("fakecart", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		name     string
+		items    string
+		quoted   string
+		requote  bool
+		removed  string // item IDs taken out
+		repriced string // item IDs listed as repriced
+		left     []orderLine
+		total    string // "" when the order isn't rewritten
+	}{
+		{name: "nothing to take out", items: `[{"CatalogueItemID":7,"Quantity":2}]`, quoted: `{"7":25}`, requote: true,
+			left: []orderLine{{7, 2}}},
+		{name: "price changed, nothing taken out", items: `[{"CatalogueItemID":8,"Quantity":1}]`, quoted: `{"8":30}`, requote: true,
+			left: []orderLine{{8, 1}}},
+		{name: "deleted item at checkout", items: `[{"CatalogueItemID":7,"Quantity":2},{"CatalogueItemID":12,"Quantity":1}]`, quoted: `{"7":25,"12":40}`, requote: true,
+			removed: "12", left: []orderLine{{7, 2}}, total: "50.00"},
+		{name: "switched-off item at checkout", items: `[{"CatalogueItemID":14,"Quantity":1},{"CatalogueItemID":7,"Quantity":1}]`, requote: true,
+			removed: "14", left: []orderLine{{7, 1}}, total: "25.00"},
+		{name: "repriced and deleted at checkout", items: `[{"CatalogueItemID":8,"Quantity":2},{"CatalogueItemID":13,"Quantity":1}]`, quoted: `{"8":30,"13":30}`, requote: true,
+			removed: "13", repriced: "8", left: []orderLine{{8, 2}}, total: "64.00"},
+		{name: "split lines of a deleted item", items: `[{"CatalogueItemID":12,"Quantity":1},{"CatalogueItemID":7,"Quantity":1},{"CatalogueItemID":12,"Quantity":2}]`, requote: true,
+			removed: "12", left: []orderLine{{7, 1}}, total: "25.00"},
+		{name: "everything gone", items: `[{"CatalogueItemID":12,"Quantity":1},{"CatalogueItemID":14,"Quantity":1}]`, requote: true,
+			removed: "12,14", left: []orderLine{}, total: "0.00"},
+		{name: "rebuilt link keeps quoted prices", items: `[{"CatalogueItemID":8,"Quantity":2},{"CatalogueItemID":14,"Quantity":1}]`, quoted: `{"8":30,"14":35}`,
+			removed: "14", left: []orderLine{{8, 2}}, total: "60.00"},
+		{name: "rebuilt link after a deletion", items: `[{"CatalogueItemID":12,"Quantity":1},{"CatalogueItemID":7,"Quantity":1}]`, quoted: `{"7":25,"12":40}`,
+			removed: "12", left: []orderLine{{7, 1}}, total: "25.00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*fake = fakeCartDB{items: tt.items, quoted: tt.quoted}
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			res, lines, err := resolveOrder(tx, vp, 42, tt.requote, cartNow)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var removed, repriced []string
+			for _, issue := range res.Removed {
+				removed = append(removed, strconv.Itoa(issue.ItemID))
+			}
+			for _, p := range res.Repriced {
+				repriced = append(repriced, strconv.Itoa(p.ItemID))
+			}
+			if got := strings.Join(removed, ","); got != tt.removed {
+				t.Errorf("removed %s, want %s", got, tt.removed)
+			}
+			if got := strings.Join(repriced, ","); got != tt.repriced {
+				t.Errorf("repriced %s, want %s", got, tt.repriced)
+			}
+			if !sameJSON(lines, tt.left) && !(len(lines) == 0 && len(tt.left) == 0) {
+				t.Errorf("left %+v, want %+v", lines, tt.left)
+			}
+			if fake.total != tt.total {
+				t.Errorf("total %q, want %q", fake.total, tt.total)
+			}
+			if tt.total == "" && fake.items != tt.items {
+				t.Errorf("items rewritten to %s with nothing taken out", fake.items)
+			}
+			stored, err := decodeOrderLines(fake.items)
+			if err != nil || !sameJSON(stored, lines) && len(stored)+len(lines) > 0 {
+				t.Errorf("stored %s, returned %+v", fake.items, lines)
+			}
+			// What the customer is shown adds up to what is charged.
+			if tt.total != "" {
+				quoted, _ := orderQuotedPrices(tx, 42)
+				var sum float64
+				for _, line := range lines {
+					sum += linePrice(vp, quoted, line.ItemID) * float64(line.Quantity)
+				}
+				if got := fmt.Sprintf("%.2f", sum); got != tt.total {
+					t.Errorf("lines left add up to %s, total is %s", got, tt.total)
+				}
+			}
+		})
+	}
+
+	for _, stmt := range []string{"FOR UPDATE", "SELECT quoted_prices", "INSERT INTO order_meta", "UPDATE " + orderTable} {
+		t.Run("failing at "+stmt, func(t *testing.T) {
+			*fake = fakeCartDB{items: `[{"CatalogueItemID":12,"Quantity":1},{"CatalogueItemID":7,"Quantity":1}]`, fail: stmt}
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			if _, lines, err := resolveOrder(tx, vp, 42, true, cartNow); err == nil {
+				t.Errorf("resolved to %+v", lines)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+)
+
+type catalogueResponse struct {
+	Version      int64                   `json:"version"`
+	Preamble     string                  `json:"preamble"`
+	Catalogue    []mb.CatalogueSelection `json:"catalogue"`
+	Availability []availabilitySpec      `json:"availability"`
+	Images       map[int]string          `json:"images,omitempty"`
+	States       []itemState             `json:"states"`
+}
+
+func pricelistETag(version int64) string {
+	return fmt.Sprintf(`"pricelist-%d"`, version)
+}
+
+// CatalogueHandler serves the current pricelist. The ETag is derived from
+// the pricelist version so pollers can use If-None-Match to skip the body.
+func CatalogueHandler(prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snap := prclist.Snapshot()
+		etag := pricelistETag(snap.Version)
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		full := snap.Full()
+		resp := catalogueResponse{
+			Version:      snap.Version,
+			Preamble:     full.PrlstPreamble,
+			Catalogue:    full.Catalogue,
+			Availability: availabilitySpecs(snap.Rules),
+			Images:       snap.Images,
+			States:       itemStateList(snap.States),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(resp)
+		if err != nil {
+			log.Println("error writing response: ", err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+)
+
+// The accessors below are the only places that reach into MenuBotLib's
+// catalogue item fields.
+
+func ctlgItemID(it mb.CatalogueItem) int {
+	return it.CatalogueItemID
+}
+
+func ctlgItemName(it mb.CatalogueItem) string {
+	return it.Item
+}
+
+func ctlgItemPrice(it mb.CatalogueItem) float64 {
+	return it.Price
+}
+
+func ctlgItemWithPrice(it mb.CatalogueItem, price float64) mb.CatalogueItem {
+	it.Price = price
+	return it
+}
+
+func ctlgItemWithName(it mb.CatalogueItem, name string) mb.CatalogueItem {
+	it.Item = name
+	return it
+}
+
+// itemRef is how customers refer to an item in messages, e.g. "item7".
+func itemRef(id int) string {
+	return fmt.Sprintf("item%d", id)
+}
+
+var itemRefPattern = regexp.MustCompile(`(?i)\bitem\s?(\d+)\b`)
+
+// referencedItemIDs returns the item IDs mentioned in msg, in order.
+func referencedItemIDs(msg string) []int {
+	var ids []int
+	for _, match := range itemRefPattern.FindAllStringSubmatch(msg, -1) {
+		if id, err := strconv.Atoi(match[1]); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A combo is a catalogue item whose price is a bundle price and which
+// stands for a set of component items. MenuBotLib sees an ordinary item, so
+// the cart carries one line at the bundle price; only the kitchen and the
+// customer-facing descriptions expand it into its components.
+
+type comboComponent struct {
+	ItemID   int `json:"item_id"`
+	Quantity int `json:"quantity"`
+}
+
+type comboSpec struct {
+	ItemID     int              `json:"item_id"`
+	Components []comboComponent `json:"components"`
+}
+
+func loadCombos(db *sql.DB) (map[int][]comboComponent, error) {
+	rows, err := db.Query(`SELECT combo_id, item_id, quantity FROM item_combos
+		WHERE catalogue_id = $1 ORDER BY combo_id, position`, catalogueID)
+	if err != nil {
+		return nil, fmt.Errorf("loading combos: %w", err)
+	}
+	defer rows.Close()
+	combos := make(map[int][]comboComponent)
+	for rows.Next() {
+		var comboID int
+		var c comboComponent
+		if err := rows.Scan(&comboID, &c.ItemID, &c.Quantity); err != nil {
+			return nil, fmt.Errorf("loading combos: %w", err)
+		}
+		combos[comboID] = append(combos[comboID], c)
+	}
+	return combos, rows.Err()
+}
+
+// saveCombo replaces a combo's components; none makes it a plain item
+// again.
+func saveCombo(db dbtx, comboID int, components []comboComponent) error {
+	if _, err := db.Exec(`DELETE FROM item_combos WHERE catalogue_id = $1 AND combo_id = $2`, catalogueID, comboID); err != nil {
+		return err
+	}
+	for i, c := range components {
+		_, err := db.Exec(`INSERT INTO item_combos (catalogue_id, combo_id, position, item_id, quantity) VALUES ($1, $2, $3, $4, $5)`,
+			catalogueID, comboID, i, c.ItemID, c.Quantity)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateCombo checks a combo's components against the catalogue. isCombo
+// reports whether an item is itself a combo; combos don't nest.
+func validateCombo(comboID int, components []comboComponent, exists, isCombo func(id int) bool) error {
+	if len(components) == 0 {
+		return errors.New("combo needs at least one component")
+	}
+	seen := map[int]bool{}
+	for _, c := range components {
+		switch {
+		case c.ItemID == comboID:
+			return fmt.Errorf("combo %d can't contain itself", comboID)
+		case !exists(c.ItemID):
+			return fmt.Errorf("component item %d is not in the catalogue", c.ItemID)
+		case isCombo(c.ItemID):
+			return fmt.Errorf("component item %d is a combo; combos can't contain combos", c.ItemID)
+		case c.Quantity <= 0:
+			return fmt.Errorf("component item %d needs a positive quantity", c.ItemID)
+		case seen[c.ItemID]:
+			return fmt.Errorf("component item %d is listed twice", c.ItemID)
+		}
+		seen[c.ItemID] = true
+	}
+	return nil
+}
+
+func comboList(combos map[int][]comboComponent) []comboSpec {
+	list := make([]comboSpec, 0, len(combos))
+	for id, components := range combos {
+		list = append(list, comboSpec{ItemID: id, Components: components})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ItemID < list[j].ItemID })
+	return list
+}
+
+func (vp versionedPricelist) itemName(id int) string {
+	if item, ok := vp.Item(id); ok {
+		return ctlgItemName(item)
+	}
+	return itemRef(id)
+}
+
+// comboSaving is what the combo saves over buying its components at the
+// pricelist's prices.
+func (vp versionedPricelist) comboSaving(comboID int) float64 {
+	combo, ok := vp.Item(comboID)
+	if !ok {
+		return 0
+	}
+	var parts float64
+	for _, c := range vp.Combos[comboID] {
+		item, ok := vp.Item(c.ItemID)
+		if !ok {
+			return 0
+		}
+		parts += ctlgItemPrice(item) * float64(c.Quantity)
+	}
+	return parts - ctlgItemPrice(combo)
+}
+
+// comboHint is how the menu shows a combo, e.g.
+// "Brownie, 2 x Cookie - save R15.00".
+func (vp versionedPricelist) comboHint(comboID int) string {
+	parts := make([]string, len(vp.Combos[comboID]))
+	for i, c := range vp.Combos[comboID] {
+		parts[i] = vp.itemName(c.ItemID)
+		if c.Quantity > 1 {
+			parts[i] = fmt.Sprintf("%d x %s", c.Quantity, parts[i])
+		}
+	}
+	hint := strings.Join(parts, ", ")
+	if saving := vp.comboSaving(comboID); saving > 0 {
+		hint += fmt.Sprintf(" - save R%.2f", saving)
+	}
+	return hint
+}
+
+// unavailableComponents names the components of a combo that can't be
+// ordered at now.
+func (vp versionedPricelist) unavailableComponents(comboID int, now time.Time) []string {
+	loc := cfg().BusinessHours.Location
+	var missing []string
+	for _, c := range vp.Combos[comboID] {
+		rule, hasRule := vp.Rules[c.ItemID]
+		if !itemExists(vp, c.ItemID) || !vp.Listed(c.ItemID) || (hasRule && !rule.AvailableAt(now, loc)) {
+			missing = append(missing, vp.itemName(c.ItemID))
+		}
+	}
+	return missing
+}
+
+// orderLineDetail is an order line as the orders API and receipts show it:
+// one priced line, with a combo's contents listed under it.
+type orderLineDetail struct {
+	ItemID     int                    `json:"item_id"`
+	Code       string                 `json:"code,omitempty"`
+	Name       string                 `json:"name"`
+	Quantity   int                    `json:"quantity"`
+	UnitPrice  *float64               `json:"unit_price,omitempty"`
+	Components []orderComponentDetail `json:"components,omitempty"`
+}
+
+type orderComponentDetail struct {
+	ItemID   int    `json:"item_id"`
+	Name     string `json:"name"`
+	Quantity int    `json:"quantity"`
+}
+
+// orderLineDetails describes the lines of an order. Unit prices are the
+// ones the cart was quoted at, where known.
+func orderLineDetails(vp versionedPricelist, lines []orderLine, quoted quotedPrices) []orderLineDetail {
+	details := make([]orderLineDetail, 0, len(lines))
+	for _, line := range lines {
+		d := orderLineDetail{ItemID: line.ItemID, Code: vp.Codes[line.ItemID], Name: vp.itemName(line.ItemID), Quantity: line.Quantity}
+		if price, ok := quoted[strconv.Itoa(line.ItemID)]; ok {
+			d.UnitPrice = &price
+		}
+		for _, c := range vp.Combos[line.ItemID] {
+			d.Components = append(d.Components, orderComponentDetail{
+				ItemID:   c.ItemID,
+				Name:     vp.itemName(c.ItemID),
+				Quantity: c.Quantity * line.Quantity,
+			})
+		}
+		details = append(details, d)
+	}
+	return details
+}
+
+// receiptLines renders order lines for the receipt, e.g.
+// "1 x Weekend bundle (Brownie, 2 x Cookie) R99.00".
+func receiptLines(details []orderLineDetail) []string {
+	lines := make([]string, len(details))
+	for i, d := range details {
+		lines[i] = fmt.Sprintf("%d x %s", d.Quantity, d.Name)
+		if len(d.Components) > 0 {
+			parts := make([]string, len(d.Components))
+			for j, c := range d.Components {
+				parts[j] = c.Name
+				if c.Quantity > 1 {
+					parts[j] = fmt.Sprintf("%d x %s", c.Quantity, c.Name)
+				}
+			}
+			lines[i] += " (" + strings.Join(parts, ", ") + ")"
+		}
+		if d.UnitPrice != nil {
+			lines[i] += fmt.Sprintf(" R%.2f", *d.UnitPrice*float64(d.Quantity))
+		}
+	}
+	return lines
+}
+
+func ListCombosHandler(prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, comboList(prclist.Snapshot().Combos))
+	}
+}
+
+// PutComboHandler makes the item a combo of the posted components. The
+// item's own catalogue price is the bundle price.
+func PutComboHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := itemIDParam(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		vp := prclist.Snapshot()
+		if _, ok := vp.Item(itemID); !ok {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no catalogue item %d", itemID))
+			return
+		}
+		var spec comboSpec
+		if err := json.NewDecoder(r.Body).Decode(&spec); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		exists := func(id int) bool {
+			_, ok := vp.Item(id)
+			return ok
+		}
+		isCombo := func(id int) bool {
+			_, ok := vp.Combos[id]
+			return ok
+		}
+		if err := validateCombo(itemID, spec.Components, exists, isCombo); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		for id, components := range vp.Combos {
+			for _, c := range components {
+				if c.ItemID == itemID {
+					writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("item %d is a component of combo %d", itemID, id))
+					return
+				}
+			}
+		}
+		if err := saveCombo(db, itemID, spec.Components); err != nil {
+			log.Printf("Saving combo %d failed: %v", itemID, err)
+			writeJSONError(w, http.StatusInternalServerError, "saving combo failed")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
+
+func DeleteComboHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := itemIDParam(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := saveCombo(db, itemID, nil); err != nil {
+			log.Printf("Deleting combo %d failed: %v", itemID, err)
+			writeJSONError(w, http.StatusInternalServerError, "deleting combo failed")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Command counters are cheap, always-on numbers, kept apart from the
+// conversation report: how each message was dispatched and what fell
+// through to the pricelist, per business day. They are counted in memory
+// and added to the daily rollups every commandStatsFlush, and on shutdown,
+// so a crash loses at most that much.
+
+const (
+	commandStatsFlush = 2 * time.Minute
+	// maxFallbackTexts caps the distinct fallback texts held between
+	// flushes; the rest still count towards the fallback total.
+	maxFallbackTexts = 500
+	topFallbackTexts = 10
+	// outcomeAdmin is what admin commands are counted under, alongside the
+	// conversation kinds customer messages are.
+	outcomeAdmin = "admin"
+)
+
+type commandKey struct {
+	Day, Outcome, Command string
+}
+
+type fallbackKey struct {
+	Day, Text string
+}
+
+type commandStats struct {
+	mu        sync.Mutex
+	pending   map[commandKey]int64
+	fallbacks map[fallbackKey]int64
+}
+
+func newCommandStats() *commandStats {
+	return &commandStats{pending: map[commandKey]int64{}, fallbacks: map[fallbackKey]int64{}}
+}
+
+func businessDay(t time.Time) string {
+	start, _ := dayBounds(t)
+	return start.Format("2006-01-02")
+}
+
+// Count records how a message was dispatched: its conversation kind, or
+// outcomeAdmin, and the command, if any. text is the message, kept by its
+// normalized form when it hit the fallback.
+func (s *commandStats) Count(outcome, command, text string, now time.Time) {
+	day := businessDay(now)
+	metrics.Inc("menubot_dispatch_total", "Messages by how they were dispatched.", "outcome", outcome, "command", command)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending[commandKey{day, outcome, command}]++
+	if outcome != convFallback {
+		return
+	}
+	if text = normalizeForMatch(text); text == "" {
+		return
+	}
+	key := fallbackKey{day, text}
+	if _, held := s.fallbacks[key]; held || len(s.fallbacks) < maxFallbackTexts {
+		s.fallbacks[key]++
+	}
+}
+
+// flush adds the pending counts to the daily rollups. On failure they are
+// put back to be tried again with the next flush.
+func (s *commandStats) flush(db *sql.DB) error {
+	s.mu.Lock()
+	pending, fallbacks := s.pending, s.fallbacks
+	s.pending, s.fallbacks = map[commandKey]int64{}, map[fallbackKey]int64{}
+	s.mu.Unlock()
+	if len(pending) == 0 && len(fallbacks) == 0 {
+		return nil
+	}
+	err := saveCommandStats(db, pending, fallbacks)
+	if err != nil {
+		s.mu.Lock()
+		for k, n := range pending {
+			s.pending[k] += n
+		}
+		for k, n := range fallbacks {
+			s.fallbacks[k] += n
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+func saveCommandStats(db *sql.DB, pending map[commandKey]int64, fallbacks map[fallbackKey]int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for k, n := range pending {
+		_, err := tx.Exec(`INSERT INTO command_stats_daily (day, outcome, command, count) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (day, outcome, command) DO UPDATE SET count = command_stats_daily.count + EXCLUDED.count`,
+			k.Day, k.Outcome, k.Command, n)
+		if err != nil {
+			return err
+		}
+	}
+	for k, n := range fallbacks {
+		sealed, err := sealField(fieldMessageBody, k.Text)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`INSERT INTO command_fallbacks_daily (day, text_hash, text, count) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (day, text_hash) DO UPDATE SET count = command_fallbacks_daily.count + EXCLUDED.count`,
+			k.Day, fieldHash(k.Text), sealed, n)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func flushCommandStats(cc *commandContext) error {
+	if err := cc.commandStats.flush(cc.db); err != nil {
+		return fmt.Errorf("saving command counters: %w", err)
+	}
+	return nil
+}
+
+type dispatchCount struct {
+	Outcome string `json:"outcome"`
+	Command string `json:"command,omitempty"`
+	Count   int64  `json:"count"`
+}
+
+type fallbackText struct {
+	Text  string `json:"text"`
+	Count int64  `json:"count"`
+}
+
+type commandReport struct {
+	Day          string          `json:"day"`
+	Messages     int64           `json:"messages"`
+	Fallbacks    int64           `json:"fallbacks"`
+	Commands     []dispatchCount `json:"commands"`
+	TopFallbacks []fallbackText  `json:"top_fallbacks"`
+}
+
+// buildCommandReport reads the day's rollups and adds what hasn't been
+// flushed yet.
+func buildCommandReport(db *sql.DB, s *commandStats, day string) (commandReport, error) {
+	report := commandReport{Day: day, Commands: []dispatchCount{}, TopFallbacks: []fallbackText{}}
+	counts := map[commandKey]int64{}
+	texts := map[string]fallbackText{}
+
+	rows, err := db.Query(`SELECT outcome, command, count FROM command_stats_daily WHERE day = $1`, day)
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var k commandKey
+		var n int64
+		if err := rows.Scan(&k.Outcome, &k.Command, &n); err != nil {
+			rows.Close()
+			return report, err
+		}
+		k.Day = day
+		counts[k] += n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+	rows, err = db.Query(`SELECT text_hash, text, count FROM command_fallbacks_daily WHERE day = $1`, day)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hash, sealed string
+		var f fallbackText
+		if err := rows.Scan(&hash, &sealed, &f.Count); err != nil {
+			return report, err
+		}
+		if f.Text, err = openField(fieldMessageBody, sealed); err != nil {
+			return report, err
+		}
+		texts[hash] = f
+	}
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	s.mu.Lock()
+	for k, n := range s.pending {
+		if k.Day == day {
+			counts[k] += n
+		}
+	}
+	for k, n := range s.fallbacks {
+		if k.Day == day {
+			f := texts[fieldHash(k.Text)]
+			f.Text, f.Count = k.Text, f.Count+n
+			texts[fieldHash(k.Text)] = f
+		}
+	}
+	s.mu.Unlock()
+
+	for k, n := range counts {
+		if k.Outcome != outcomeAdmin {
+			report.Messages += n
+		}
+		if k.Outcome == convFallback {
+			report.Fallbacks += n
+		}
+		report.Commands = append(report.Commands, dispatchCount{Outcome: k.Outcome, Command: k.Command, Count: n})
+	}
+	sort.Slice(report.Commands, func(i, j int) bool {
+		a, b := report.Commands[i], report.Commands[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Outcome+a.Command < b.Outcome+b.Command
+	})
+	for _, f := range texts {
+		report.TopFallbacks = append(report.TopFallbacks, f)
+	}
+	sort.Slice(report.TopFallbacks, func(i, j int) bool {
+		a, b := report.TopFallbacks[i], report.TopFallbacks[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Text < b.Text
+	})
+	if len(report.TopFallbacks) > topFallbackTexts {
+		report.TopFallbacks = report.TopFallbacks[:topFallbackTexts]
+	}
+	return report, nil
+}
+
+// CommandReportHandler serves GET /api/reports/commands?date=, defaulting
+// to today.
+func CommandReportHandler(db *sql.DB, s *commandStats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		date, err := parseReportTime(r.URL.Query().Get("date"), time.Now())
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "date: "+err.Error())
+			return
+		}
+		report, err := buildCommandReport(db, s, businessDay(date))
+		if err != nil {
+			log.Printf("Building command report failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "building report failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// adminStats handles "stats [date]".
+func adminStats(cc *commandContext, args []string) string {
+	date, err := parseReportTime(strings.Join(args, " "), time.Now())
+	if err != nil {
+		return "Usage: stats [YYYY-MM-DD]"
+	}
+	day := businessDay(date)
+	report, err := buildCommandReport(cc.db, cc.commandStats, day)
+	if err != nil {
+		log.Printf("Building command report failed: %v", err)
+		return "Reading the counters failed: " + err.Error()
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Stats for %s: %d messages, %d fell back to the pricelist.", day, report.Messages, report.Fallbacks)
+	if len(report.Commands) > 0 {
+		b.WriteString("\n\nBy outcome:")
+		for _, c := range report.Commands {
+			name := c.Outcome
+			if c.Command != "" {
+				name += " " + c.Command
+			}
+			fmt.Fprintf(&b, "\n%s: %d", name, c.Count)
+		}
+	}
+	if len(report.TopFallbacks) > 0 {
+		b.WriteString("\n\nTop unknown inputs:")
+		for i, f := range report.TopFallbacks {
+			fmt.Fprintf(&b, "\n%d. %q x%d", i+1, f.Text, f.Count)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// COMMAND_SUGGESTIONS modes.
+const (
+	suggestionsOff         = "off"
+	suggestionsSuggest     = "suggest"
+	suggestionsAutocorrect = "autocorrect"
+)
+
+const (
+	// menuCommand isn't parsed by the web API; MenuBotLib answers it, like
+	// anything else it doesn't recognise, with the pricelist.
+	menuCommand = "menu"
+	// suggestionTTL is how long a "did you mean" waits for its yes.
+	suggestionTTL = 2 * time.Minute
+)
+
+// commandFix is a message with its misspelt first word replaced by the
+// nearest command or item.
+type commandFix struct {
+	Message  string
+	Distance int
+}
+
+// suggestionVocabulary lists what a first word may be corrected to: each
+// command as its words, and each orderable item's reference and code. Consent
+// commands are left out on purpose; consent has to be given in the
+// customer's own words.
+func suggestionVocabulary(vp versionedPricelist) [][]string {
+	var vocab [][]string
+	for _, cmd := range customerCommands {
+		vocab = append(vocab, strings.Fields(cmd.name))
+	}
+	for _, cmd := range append([]string{menuCommand, newOrderAnywayCommand}, checkoutCommands...) {
+		vocab = append(vocab, strings.Fields(cmd))
+	}
+	for _, item := range vp.Items {
+		if id := ctlgItemID(item); vp.Listed(id) {
+			vocab = append(vocab, []string{itemRef(id)})
+			if code, ok := vp.Codes[id]; ok {
+				vocab = append(vocab, []string{code})
+			}
+		}
+	}
+	return vocab
+}
+
+// maxSuggestionDistance is how far off a word of n letters may be. Words
+// of three letters or fewer ("ok", "hi") are never corrected.
+func maxSuggestionDistance(n int) int {
+	switch {
+	case n <= 3:
+		return 0
+	case n <= 5:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// suggestCommand finds the command or item msg's first word most likely
+// meant. There is no fix when the word is already one, when nothing is
+// close enough, when two different words are equally close, or when it
+// isn't plain ASCII: edit distances mean little across scripts.
+func suggestCommand(vp versionedPricelist, msg string) (commandFix, bool) {
+	words := strings.Fields(strings.ToLower(msg))
+	if len(words) == 0 {
+		return commandFix{}, false
+	}
+	first := words[0]
+	for _, r := range first {
+		if r >= utf8.RuneSelf {
+			return commandFix{}, false
+		}
+	}
+	limit := maxSuggestionDistance(len(first))
+	if limit == 0 {
+		return commandFix{}, false
+	}
+
+	best, bestWord, ambiguous := limit+1, "", false
+	for _, cmd := range suggestionVocabulary(vp) {
+		if first == cmd[0] {
+			return commandFix{}, false
+		}
+		// The rest of a multi-word command has to be there as typed.
+		if len(words) < len(cmd) || strings.Join(words[1:len(cmd)], " ") != strings.Join(cmd[1:], " ") {
+			continue
+		}
+		d := editDistance(first, cmd[0])
+		switch {
+		case d < best:
+			best, bestWord, ambiguous = d, cmd[0], false
+		case d == best && cmd[0] != bestWord:
+			ambiguous = true
+		}
+	}
+	if bestWord == "" || ambiguous {
+		return commandFix{}, false
+	}
+	fixed := strings.Join(append([]string{bestWord}, words[1:]...), " ")
+	return commandFix{Message: RemoveNonASCIICharacters(fixed), Distance: best}, true
+}
+
+// editDistance is the optimal string alignment distance between a and b:
+// insertions, deletions, substitutions and swaps of adjacent letters each
+// count one, so "chekout" and "itme7" are both one away.
+func editDistance(a, b string) int {
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+type pendingSuggestion struct {
+	Message string
+	Expires time.Time
+}
+
+// commandSuggestions holds the "did you mean" each customer was last asked,
+// until they answer it or it expires.
+type commandSuggestions struct {
+	mu      sync.Mutex
+	pending map[string]pendingSuggestion
+}
+
+func newCommandSuggestions() *commandSuggestions {
+	return &commandSuggestions{pending: map[string]pendingSuggestion{}}
+}
+
+// offer remembers fix for cell and returns the question to ask.
+func (s *commandSuggestions) offer(cell string, fix commandFix, now time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c, p := range s.pending {
+		if now.After(p.Expires) {
+			delete(s.pending, c)
+		}
+	}
+	s.pending[cell] = pendingSuggestion{Message: fix.Message, Expires: now.Add(suggestionTTL)}
+	return fmt.Sprintf("Did you mean *%s*? Reply yes to continue.", fix.Message)
+}
+
+// confirm answers a pending suggestion: a yes in time returns the
+// suggested message. Any other reply drops it.
+func (s *commandSuggestions) confirm(cell, msg string, now time.Time) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.pending[cell]
+	if !ok {
+		return "", false
+	}
+	delete(s.pending, cell)
+	if normalizeCommand(msg) != confirmCommand || now.After(p.Expires) {
+		return "", false
+	}
+	return p.Message, true
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+)
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"checkout", "checkout", 0},
+		{"chekout", "checkout", 1},
+		{"menue", "menu", 1},
+		{"stauts", "status", 1},
+		{"itme7", "item7", 1},
+		{"kitten", "sitting", 3},
+		{"", "menu", 4},
+		{"menu", "", 4},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestSuggestCommand(t *testing.T) {
+	vp := versionedPricelist{
+		Items: []mb.CatalogueItem{{CatalogueItemID: 7}, {CatalogueItemID: 8}, {CatalogueItemID: 9}},
+		Codes: map[int]string{7: "toast", 8: "roast"},
+		States: map[int]itemState{
+			9: {ItemID: 9, Active: false},
+		},
+	}
+	tests := []struct {
+		name     string
+		msg      string
+		want     string
+		distance int
+		ok       bool
+	}{
+		{"misspelt command", "chekout", "checkout", 1, true},
+		{"misspelt menu", "Menue", "menu", 1, true},
+		{"swapped letters", "stauts", "status", 1, true},
+		{"rest of the message kept", "chekout now please", "checkout now please", 1, true},
+		{"multi-word command", "chek out", "check out", 1, true},
+		{"item reference", "itme7", "item7", 1, true},
+		{"two away", "chckot", "checkout", 2, true},
+		{"already a command", "checkout", "", 0, false},
+		{"already an item code", "toast", "", 0, false},
+		{"two codes equally close", "hoast", "", 0, false},
+		{"unlisted item", "itme9", "", 0, false},
+		{"too short", "pya", "", 0, false},
+		{"nothing close", "xyzzyq", "", 0, false},
+		{"cyrillic", "меню", "", 0, false},
+		{"accented", "chéckout", "", 0, false},
+		{"emoji", "checkout🛒", "", 0, false},
+		{"empty", "   ", "", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fix, ok := suggestCommand(vp, tt.msg)
+			if ok != tt.ok {
+				t.Fatalf("suggestCommand(%q) = %+v, %v; want ok %v", tt.msg, fix, ok, tt.ok)
+			}
+			if ok && (fix.Message != tt.want || fix.Distance != tt.distance) {
+				t.Errorf("suggestCommand(%q) = %q at %d, want %q at %d", tt.msg, fix.Message, fix.Distance, tt.want, tt.distance)
+			}
+		})
+	}
+}
+
+func TestCommandSuggestionConfirm(t *testing.T) {
+	fix := commandFix{Message: "checkout", Distance: 1}
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		cell   string
+		answer string
+		after  time.Duration
+		want   string
+		ok     bool
+	}{
+		{"yes", "27821234567", "yes", time.Minute, "checkout", true},
+		{"shouted yes", "27821234567", "  YES ", time.Minute, "checkout", true},
+		{"no", "27821234567", "no", time.Minute, "", false},
+		{"too late", "27821234567", "yes", suggestionTTL + time.Second, "", false},
+		{"someone else", "27829876543", "yes", time.Minute, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newCommandSuggestions()
+			if q := s.offer("27821234567", fix, now); q != "Did you mean *checkout*? Reply yes to continue." {
+				t.Errorf("offer asked %q", q)
+			}
+			got, ok := s.confirm(tt.cell, tt.answer, now.Add(tt.after))
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("confirm(%q) = %q, %v; want %q, %v", tt.answer, got, ok, tt.want, tt.ok)
+			}
+			if _, ok := s.confirm("27821234567", "yes", now.Add(tt.after)); ok && tt.cell == "27821234567" {
+				t.Error("the suggestion could be confirmed twice")
+			}
+		})
+	}
+}
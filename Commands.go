@@ -0,0 +1,21 @@
+package main
+
+import "strings"
+
+// Customer commands that MenuBotLib acts on and the web API needs to
+// recognise before handing the message over.
+var checkoutCommands = []string{"checkout", "check out", "pay"}
+
+func normalizeCommand(msg string) string {
+	return strings.ToLower(strings.Join(strings.Fields(msg), " "))
+}
+
+func isCheckoutCommand(msg string) bool {
+	normalized := normalizeCommand(msg)
+	for _, cmd := range checkoutCommands {
+		if normalized == cmd {
+			return true
+		}
+	}
+	return false
+}
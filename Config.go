@@ -0,0 +1,800 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+const envFile = "app.env"
+
+type EnvVars struct {
+	Pwd         string
+	DBConn      string
+	WADBDriver  string
+	WADBConn    string
+	HostNumber  string
+	AdminNumber string
+	MerchantId  string
+	MerchantKey string
+	Passphrase  string
+	// InstanceID and ItemNamePrefix name this deployment's payments, see
+	// paymentID.
+	InstanceID     string
+	ItemNamePrefix string
+	// OrderRefPrefix starts the references customers know orders by.
+	OrderRefPrefix string
+	PfHost         string
+	PayFastMode    string // sandbox or live, checked against PfHost
+	PublicAddr     string
+	AdminAddr      string
+	AdminAPIKey    string
+	WebhookURL     string
+	// WebhookSecret signs webhook bodies with HMAC-SHA256 when set.
+	WebhookSecret string
+	// EventsBackend publishes the webhook events to NATS or a Redis stream
+	// as well, see queuePublisher; "none" disables it.
+	EventsBackend string
+	EventsURL     string
+	EventsSubject string
+	EventsBuffer  int
+	// FieldKey encrypts order notes and message bodies at rest, see
+	// sealField. FieldKeyID is stored with every value it seals.
+	FieldKey   string
+	FieldKeyID string
+	// LogRedaction masks phone numbers and message bodies in all log output.
+	LogRedaction bool
+	// WADebug enables whatsmeow's DEBUG logging, which is very verbose.
+	WADebug bool
+	// NotifyPathSecrets and ReturnPathSecrets, when set, move the PayFast
+	// routes under a secret path segment. See splitSecrets.
+	NotifyPathSecrets []string
+	ReturnPathSecrets []string
+	// Branding for the customer-facing payment pages.
+	ShopName      string
+	ShopLogoURL   string
+	SupportNumber string
+	// KitchenNumber receives the pick list of every paid order.
+	KitchenNumber string
+	// QRAttempts is how many rounds of QR codes to show before giving up
+	// on pairing; QRFailureHTTPOnly keeps the process up regardless.
+	QRAttempts        int
+	QRFailureHTTPOnly bool
+	// PricelistStartupRetry is how long startup keeps retrying the
+	// pricelist load before starting without a menu.
+	PricelistStartupRetry time.Duration
+	// Headless refuses interactive QR login, e.g. under systemd.
+	Headless bool
+	// PreflightPublicURL makes startup fetch our own /healthz through
+	// HOMEBASEURL, proving the tunnel reaches us.
+	PreflightPublicURL bool
+	// The sandbox merchant the PayFast self-test pays with in live mode.
+	SelfTestMerchantId  string
+	SelfTestMerchantKey string
+	SelfTestPassphrase  string
+}
+
+// isStaffNumber reports whether number is one of the shop's own.
+func (env EnvVars) isStaffNumber(number string) bool {
+	for _, own := range []string{env.HostNumber, env.AdminNumber, env.KitchenNumber, env.SupportNumber} {
+		if number == own {
+			return true
+		}
+	}
+	return false
+}
+
+// RuntimeConfig holds the settings that are safe to change while the bot is
+// connected. A fresh value is built on every reload and swapped in whole,
+// so readers always see a consistent set.
+type RuntimeConfig struct {
+	BusinessHours    BusinessHours
+	ClosedMessage    string
+	RateLimit        int // inbound messages per sender per minute, 0 disables
+	LogLevel         slog.Level
+	PricelistRefresh time.Duration // 0 disables the periodic refresh
+	IsTest           bool
+	TesterNumbers    []string
+	TestSinkNumber   string        // see TestSink
+	CancelWindow     time.Duration // how long after payment customers may request cancellation
+	// RatingPromptDelay is how long after collection or delivery the
+	// customer is asked to rate the order, 0 disables it. See ratingReply.
+	RatingPromptDelay time.Duration
+	// MenuShortcutWindow is how long after a menu a bare number orders
+	// from it, 0 disables the shortcut. See menuShortcuts.
+	MenuShortcutWindow time.Duration
+	SendRetries        int     // extra attempts for a transient send failure before it goes to the outbox
+	OutboundRate       float64 // messages per second across all send paths, 0 disables
+	OutboundBurst      int
+	// HTTPRate and NotifyRate are requests per second per remote IP on the
+	// public routes and on the ITN route, 0 disables. IPs in
+	// RateLimitAllowlist are never limited. See ipLimiter.
+	HTTPRate           float64
+	HTTPBurst          int
+	NotifyRate         float64
+	NotifyBurst        int
+	RateLimitAllowlist []*net.IPNet
+	// TrustedProxies are the peers whose X-Forwarded-For is believed. See
+	// remoteIP.
+	TrustedProxies []*net.IPNet
+	ReferralPoints int // credited to both sides when a referred customer first pays, 0 disables
+	// DuplicateCheckout is how long an unpaid checkout blocks an identical
+	// one from the same customer, 0 disables the guard.
+	DuplicateCheckout time.Duration
+	// EscalationKeywords are matched as whole words, ignoring case and
+	// punctuation; a match hands the customer to a human.
+	EscalationKeywords []string
+	EscalationTakeover time.Duration // how long an escalation silences the bot
+	// QuietHours holds back bulk messages while it contains the time in
+	// BusinessHours' timezone, nil disables it. See sendBulk.
+	QuietHours *TimeWindow
+	// CommandSuggestions is what to do with a mistyped command: "suggest"
+	// the nearest one, "autocorrect" it when it's one letter off, or "off".
+	CommandSuggestions string
+	// ReactionActions maps a reaction emoji to the command it stands for.
+	// See reactionCommand.
+	ReactionActions map[string]string
+	// AdGreeting goes in front of the reply to a customer who arrived by
+	// tapping an ad, with {ad} standing for its title; empty disables it.
+	AdGreeting string
+	// Retention is how long each purgeable table keeps its rows; tables
+	// left out are kept forever. See purgeExpired.
+	Retention           map[string]retentionPeriod
+	RetentionArchiveDir string // purged rows are archived here first, empty skips archiving
+	RetentionDryRun     bool   // only log what would be purged
+	// Phrases customers ask about prices, stock and opening hours with,
+	// answered by intentReply.
+	PricePhrases []intentPhrase
+	StockPhrases []intentPhrase
+	HoursPhrases []intentPhrase
+	// PollSteps are the choice steps asked with a WhatsApp poll as well as
+	// in text, PollTimeout how long a poll waits for a vote before the
+	// options are sent numbered. See choicePolls.
+	PollSteps   []string
+	PollTimeout time.Duration
+	// GiftSlots are the delivery slots a gift's recipient picks from; with
+	// none they may name any.
+	GiftSlots []string
+	// SelfTest is when the weekly PayFast self-test runs, nil when it
+	// doesn't.
+	SelfTest *selfTestSchedule
+	// OrderExpiry is how long a checked-out order may stay unpaid before
+	// it expires; 0 keeps unpaid orders forever.
+	OrderExpiry time.Duration
+	// HomebaseURL is where PayFast calls us back, NgrokAPIURL the local
+	// ngrok agent that knows better when set. See homebaseResolver.
+	HomebaseURL string
+	NgrokAPIURL string
+	// SlowQuery is how long a SQL statement may take before it is logged;
+	// 0 logs none.
+	SlowQuery time.Duration
+	// InviteOnlyMessage is sent, once, to numbers not on the allowlist
+	// while only allowed numbers are served.
+	InviteOnlyMessage string
+	// AlertWebhookURL is posted the alerts WhatsApp can't carry, see
+	// sendingBlock; "" posts none.
+	AlertWebhookURL string
+	// PrepTimePerOrder is how long the kitchen takes per order on average,
+	// for the rough ready time "status" gives; 0 gives none.
+	PrepTimePerOrder time.Duration
+	// MaxMessageLength is the most characters an inbound text may have
+	// before it is refused unread; 0 allows any length.
+	MaxMessageLength int
+}
+
+// staticEnvKeys are only read at startup; a reload reports changes to them
+// instead of applying them.
+var staticEnvKeys = []string{
+	"DATABASE_URL",
+	"WHATSAPP_DB_URL",
+	"WHATSAPP_DB_DRIVER",
+	"HOST_NUMBER",
+	"ADMIN_NUMBER",
+	"MERCHANTID",
+	"MERCHANTKEY",
+	"PASSPHRASE",
+	"INSTANCE_ID",
+	"ITEM_NAME_PREFIX",
+	"PFHOST",
+	"PAYFAST_MODE",
+	"LISTEN_ADDR",
+	"PUBLIC_ADDR",
+	"ADMIN_ADDR",
+	"ADMIN_API_KEY",
+	"WEBHOOK_URL",
+	"WEBHOOK_SECRET",
+	"EVENTS_BACKEND",
+	"EVENTS_URL",
+	"EVENTS_SUBJECT",
+	"EVENTS_BUFFER",
+	"FIELD_ENCRYPTION_KEY",
+	"FIELD_ENCRYPTION_KEY_ID",
+	"LOG_REDACTION",
+	"WHATSAPP_DEBUG",
+	"PREFLIGHT_CHECK_PUBLIC_URL",
+	"QR_ATTEMPTS",
+	"QR_FAILURE_HTTP_ONLY",
+	"HEADLESS",
+	"PRICELIST_STARTUP_RETRY",
+	"SHOP_NAME",
+	"SHOP_LOGO_URL",
+	"SUPPORT_NUMBER",
+	"KITCHEN_NUMBER",
+	"NOTIFY_PATH_SECRET",
+	"RETURN_PATH_SECRET",
+	"PAYFAST_SELFTEST_MERCHANTID",
+	"PAYFAST_SELFTEST_MERCHANTKEY",
+	"PAYFAST_SELFTEST_PASSPHRASE",
+}
+
+// secretEnvKeys may alternatively be supplied as a path in NAME_FILE, e.g.
+// a Docker secret mounted under /run/secrets.
+var secretEnvKeys = []string{
+	"DATABASE_URL",
+	"WHATSAPP_DB_URL",
+	"MERCHANTKEY",
+	"PASSPHRASE",
+	"ADMIN_API_KEY",
+	"WEBHOOK_SECRET",
+	"EVENTS_URL",
+	"NOTIFY_PATH_SECRET",
+	"RETURN_PATH_SECRET",
+	"FIELD_ENCRYPTION_KEY",
+	"PAYFAST_SELFTEST_MERCHANTKEY",
+	"PAYFAST_SELFTEST_PASSPHRASE",
+}
+
+var (
+	runtimeConfig atomic.Pointer[RuntimeConfig]
+	logLevel      = new(slog.LevelVar)
+)
+
+// cfg returns the runtime configuration currently in effect.
+func cfg() *RuntimeConfig {
+	return runtimeConfig.Load()
+}
+
+func applyRuntimeConfig(rc *RuntimeConfig) {
+	logLevel.Set(rc.LogLevel)
+	runtimeConfig.Store(rc)
+}
+
+// envLoader reads startup settings, collecting every problem instead of
+// stopping at the first so preflight can report them all at once.
+type envLoader struct {
+	errs []error
+}
+
+func (l *envLoader) required(name string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		l.errs = append(l.errs, fmt.Errorf("%s environment variable does not exist", name))
+	}
+	return value
+}
+
+// lookupSecret returns the value of name, or the trimmed contents of the
+// file named by name_FILE. Setting both is an error so it is never
+// ambiguous which one is in effect. Errors name the variable but never
+// include the secret itself.
+func lookupSecret(name string) (string, error) {
+	value := os.Getenv(name)
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return value, nil
+	}
+	if value != "" {
+		return "", fmt.Errorf("both %s and %s_FILE are set, use only one", name, name)
+	}
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading %s_FILE: %w", name, err)
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
+
+// secret is required for settings that may come from a _FILE.
+func (l *envLoader) secret(name string, required bool) string {
+	value, err := lookupSecret(name)
+	if err != nil {
+		l.errs = append(l.errs, err)
+		return ""
+	}
+	if value == "" && required {
+		l.errs = append(l.errs, fmt.Errorf("%s environment variable does not exist (set %s or %s_FILE)", name, name, name))
+	}
+	return value
+}
+
+func (l *envLoader) boolean(name string, def bool) bool {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	value, err := strconv.ParseBool(raw)
+	if err != nil {
+		l.errs = append(l.errs, fmt.Errorf("%s: %w", name, err))
+		return def
+	}
+	return value
+}
+
+func (l *envLoader) positive(name string, def int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < 1 {
+		l.errs = append(l.errs, fmt.Errorf("%s: must be a positive integer", name))
+		return def
+	}
+	return value
+}
+
+func (l *envLoader) duration(name string, def time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return def
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil || value < 0 {
+		l.errs = append(l.errs, fmt.Errorf("%s: must be a non-negative duration such as 2m", name))
+		return def
+	}
+	return value
+}
+
+func (l *envLoader) err() error {
+	return errors.Join(l.errs...)
+}
+
+func getEnvVarDefault(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+func loadEnvVars() (EnvVars, error) {
+	var l envLoader
+	envVars := EnvVars{
+		DBConn:         l.secret("DATABASE_URL", true),
+		WADBDriver:     getEnvVarDefault("WHATSAPP_DB_DRIVER", "postgres"),
+		WADBConn:       l.secret("WHATSAPP_DB_URL", false),
+		HostNumber:     l.required("HOST_NUMBER"),
+		AdminNumber:    os.Getenv("ADMIN_NUMBER"),
+		MerchantId:     l.required("MERCHANTID"),
+		MerchantKey:    l.secret("MERCHANTKEY", true),
+		Passphrase:     l.secret("PASSPHRASE", true),
+		InstanceID:     os.Getenv("INSTANCE_ID"),
+		ItemNamePrefix: getEnvVarDefault("ITEM_NAME_PREFIX", legacyItemNamePrefix),
+		OrderRefPrefix: getEnvVarDefault("ORDER_REF_PREFIX", strings.ToUpper(catalogueID)),
+		PfHost:         l.required("PFHOST"),
+		PayFastMode:    os.Getenv("PAYFAST_MODE"),
+		PublicAddr:     getEnvVarDefault("PUBLIC_ADDR", getEnvVarDefault("LISTEN_ADDR", ":8080")),
+		AdminAddr:      os.Getenv("ADMIN_ADDR"),
+		AdminAPIKey:    l.secret("ADMIN_API_KEY", false),
+		WebhookURL:     os.Getenv("WEBHOOK_URL"),
+		WebhookSecret:  l.secret("WEBHOOK_SECRET", false),
+		EventsBackend:  getEnvVarDefault("EVENTS_BACKEND", eventsNone),
+		EventsURL:      l.secret("EVENTS_URL", false),
+		EventsSubject:  getEnvVarDefault("EVENTS_SUBJECT", "menubot.events"),
+		EventsBuffer:   l.positive("EVENTS_BUFFER", 1024),
+		FieldKey:       l.secret("FIELD_ENCRYPTION_KEY", false),
+		FieldKeyID:     getEnvVarDefault("FIELD_ENCRYPTION_KEY_ID", "1"),
+		LogRedaction:   l.boolean("LOG_REDACTION", true),
+		WADebug:        l.boolean("WHATSAPP_DEBUG", false),
+
+		NotifyPathSecrets:     splitSecrets(l.secret("NOTIFY_PATH_SECRET", false)),
+		ReturnPathSecrets:     splitSecrets(l.secret("RETURN_PATH_SECRET", false)),
+		QRAttempts:            l.positive("QR_ATTEMPTS", 3),
+		QRFailureHTTPOnly:     l.boolean("QR_FAILURE_HTTP_ONLY", false),
+		Headless:              l.boolean("HEADLESS", false),
+		PricelistStartupRetry: l.duration("PRICELIST_STARTUP_RETRY", 2*time.Minute),
+		ShopName:              getEnvVarDefault("SHOP_NAME", "MenuBot"),
+		ShopLogoURL:           getEnvVarDefault("SHOP_LOGO_URL", staticBaseURL+"/logo.svg"),
+		SupportNumber:         os.Getenv("SUPPORT_NUMBER"),
+		KitchenNumber:         os.Getenv("KITCHEN_NUMBER"),
+		PreflightPublicURL:    l.boolean("PREFLIGHT_CHECK_PUBLIC_URL", false),
+		SelfTestMerchantId:    os.Getenv("PAYFAST_SELFTEST_MERCHANTID"),
+		SelfTestMerchantKey:   l.secret("PAYFAST_SELFTEST_MERCHANTKEY", false),
+		SelfTestPassphrase:    l.secret("PAYFAST_SELFTEST_PASSPHRASE", false),
+	}
+	if envVars.AdminNumber == "" {
+		envVars.AdminNumber = envVars.HostNumber
+	}
+	if envVars.SupportNumber == "" {
+		envVars.SupportNumber = envVars.HostNumber
+	}
+	if envVars.KitchenNumber == "" {
+		envVars.KitchenNumber = envVars.HostNumber
+	}
+	if envVars.WADBConn == "" {
+		envVars.WADBConn = envVars.DBConn
+	}
+	if envVars.PfHost != "" {
+		if err := validatePayFastMode(envVars.PayFastMode, envVars.PfHost); err != nil {
+			l.errs = append(l.errs, err)
+		}
+	}
+	for name, secrets := range map[string][]string{"NOTIFY_PATH_SECRET": envVars.NotifyPathSecrets, "RETURN_PATH_SECRET": envVars.ReturnPathSecrets} {
+		for _, secret := range secrets {
+			if url.PathEscape(secret) != secret {
+				l.errs = append(l.errs, fmt.Errorf("%s: secrets may only contain characters that are safe in a URL path", name))
+			}
+		}
+	}
+	if err := validatePaymentNaming(envVars.InstanceID, envVars.ItemNamePrefix); err != nil {
+		l.errs = append(l.errs, err)
+	}
+	if err := validateOrderRefPrefix(envVars.OrderRefPrefix); err != nil {
+		l.errs = append(l.errs, err)
+	}
+	if err := validateEventsBackend(envVars.EventsBackend, envVars.EventsURL); err != nil {
+		l.errs = append(l.errs, err)
+	}
+	return envVars, l.err()
+}
+
+// loadRuntimeConfig reads the hot-reloadable settings from the environment.
+// Unlike loadEnvVars it never exits, so a bad value on reload leaves the
+// running configuration untouched.
+func loadRuntimeConfig() (*RuntimeConfig, error) {
+	rc := &RuntimeConfig{
+		ClosedMessage: getEnvVarDefault("CLOSED_MESSAGE", "Sorry, we are closed right now. Our hours are {hours}."),
+	}
+
+	var err error
+	if rc.BusinessHours, err = ParseBusinessHours(os.Getenv("BUSINESS_HOURS"), getEnvVarDefault("BUSINESS_TZ", "Africa/Johannesburg")); err != nil {
+		return nil, fmt.Errorf("BUSINESS_HOURS: %w", err)
+	}
+	if spec := getEnvVarDefault("QUIET_HOURS", "21:00-08:00"); spec != "off" {
+		window, err := parseTimeWindow(spec)
+		if err != nil {
+			return nil, fmt.Errorf("QUIET_HOURS: %w", err)
+		}
+		rc.QuietHours = &window
+	}
+	if rc.RateLimit, err = strconv.Atoi(getEnvVarDefault("RATE_LIMIT_PER_MINUTE", "0")); err != nil || rc.RateLimit < 0 {
+		return nil, fmt.Errorf("RATE_LIMIT_PER_MINUTE: must be a non-negative integer")
+	}
+	if err = rc.LogLevel.UnmarshalText([]byte(getEnvVarDefault("LOG_LEVEL", "INFO"))); err != nil {
+		return nil, fmt.Errorf("LOG_LEVEL: %w", err)
+	}
+	if rc.PricelistRefresh, err = time.ParseDuration(getEnvVarDefault("PRICELIST_REFRESH_INTERVAL", "0s")); err != nil || rc.PricelistRefresh < 0 {
+		return nil, fmt.Errorf("PRICELIST_REFRESH_INTERVAL: must be a non-negative duration such as 15m")
+	}
+	if rc.IsTest, err = strconv.ParseBool(getEnvVarDefault("IS_TEST", "true")); err != nil {
+		return nil, fmt.Errorf("IS_TEST: %w", err)
+	}
+	if rc.CancelWindow, err = time.ParseDuration(getEnvVarDefault("CANCEL_WINDOW", "30m")); err != nil || rc.CancelWindow < 0 {
+		return nil, fmt.Errorf("CANCEL_WINDOW: must be a non-negative duration such as 30m")
+	}
+	if rc.RatingPromptDelay, err = time.ParseDuration(getEnvVarDefault("RATING_PROMPT_DELAY", "1h")); err != nil || rc.RatingPromptDelay < 0 {
+		return nil, fmt.Errorf("RATING_PROMPT_DELAY: must be a non-negative duration such as 1h")
+	}
+	if rc.MenuShortcutWindow, err = time.ParseDuration(getEnvVarDefault("MENU_SHORTCUT_WINDOW", "30m")); err != nil || rc.MenuShortcutWindow < 0 {
+		return nil, fmt.Errorf("MENU_SHORTCUT_WINDOW: must be a non-negative duration such as 30m")
+	}
+	if rc.SendRetries, err = strconv.Atoi(getEnvVarDefault("SEND_RETRIES", "3")); err != nil || rc.SendRetries < 0 {
+		return nil, fmt.Errorf("SEND_RETRIES: must be a non-negative integer")
+	}
+	if rc.OutboundRate, err = strconv.ParseFloat(getEnvVarDefault("OUTBOUND_RATE", "1"), 64); err != nil || rc.OutboundRate < 0 {
+		return nil, fmt.Errorf("OUTBOUND_RATE: must be a non-negative number of messages per second")
+	}
+	if rc.OutboundBurst, err = strconv.Atoi(getEnvVarDefault("OUTBOUND_BURST", "5")); err != nil || rc.OutboundBurst < 1 {
+		return nil, fmt.Errorf("OUTBOUND_BURST: must be a positive integer")
+	}
+	if rc.HTTPRate, err = strconv.ParseFloat(getEnvVarDefault("HTTP_RATE_LIMIT", "10"), 64); err != nil || rc.HTTPRate < 0 {
+		return nil, fmt.Errorf("HTTP_RATE_LIMIT: must be a non-negative number of requests per second")
+	}
+	if rc.HTTPBurst, err = strconv.Atoi(getEnvVarDefault("HTTP_RATE_BURST", "20")); err != nil || rc.HTTPBurst < 1 {
+		return nil, fmt.Errorf("HTTP_RATE_BURST: must be a positive integer")
+	}
+	if rc.NotifyRate, err = strconv.ParseFloat(getEnvVarDefault("NOTIFY_RATE_LIMIT", "0.5"), 64); err != nil || rc.NotifyRate < 0 {
+		return nil, fmt.Errorf("NOTIFY_RATE_LIMIT: must be a non-negative number of requests per second")
+	}
+	if rc.NotifyBurst, err = strconv.Atoi(getEnvVarDefault("NOTIFY_RATE_BURST", "5")); err != nil || rc.NotifyBurst < 1 {
+		return nil, fmt.Errorf("NOTIFY_RATE_BURST: must be a positive integer")
+	}
+	if rc.RateLimitAllowlist, err = parseCIDRList(getEnvVarDefault("HTTP_RATE_ALLOWLIST", defaultPayFastRanges)); err != nil {
+		return nil, fmt.Errorf("HTTP_RATE_ALLOWLIST: %w", err)
+	}
+	if rc.TrustedProxies, err = parseCIDRList(getEnvVarDefault("TRUSTED_PROXIES", defaultTrustedProxies)); err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES: %w", err)
+	}
+	if rc.ReferralPoints, err = strconv.Atoi(getEnvVarDefault("REFERRAL_POINTS", "50")); err != nil || rc.ReferralPoints < 0 {
+		return nil, fmt.Errorf("REFERRAL_POINTS: must be a non-negative integer")
+	}
+	if rc.DuplicateCheckout, err = time.ParseDuration(getEnvVarDefault("DUPLICATE_CHECKOUT_WINDOW", "10m")); err != nil || rc.DuplicateCheckout < 0 {
+		return nil, fmt.Errorf("DUPLICATE_CHECKOUT_WINDOW: must be a non-negative duration such as 10m")
+	}
+	if rc.EscalationTakeover, err = time.ParseDuration(getEnvVarDefault("ESCALATION_TAKEOVER", "30m")); err != nil || rc.EscalationTakeover <= 0 {
+		return nil, fmt.Errorf("ESCALATION_TAKEOVER: must be a positive duration such as 30m")
+	}
+	switch rc.CommandSuggestions = getEnvVarDefault("COMMAND_SUGGESTIONS", suggestionsSuggest); rc.CommandSuggestions {
+	case suggestionsOff, suggestionsSuggest, suggestionsAutocorrect:
+	default:
+		return nil, fmt.Errorf("COMMAND_SUGGESTIONS: must be off, suggest or autocorrect")
+	}
+	if rc.ReactionActions, err = parseReactionActions(getEnvVarDefault("REACTION_ACTIONS", defaultReactionActions)); err != nil {
+		return nil, fmt.Errorf("REACTION_ACTIONS: %w", err)
+	}
+	if rc.PricePhrases, err = parseIntentPhrases(getEnvVarDefault("PRICE_PHRASES", defaultPricePhrases), true); err != nil {
+		return nil, fmt.Errorf("PRICE_PHRASES: %w", err)
+	}
+	if rc.StockPhrases, err = parseIntentPhrases(getEnvVarDefault("STOCK_PHRASES", defaultStockPhrases), true); err != nil {
+		return nil, fmt.Errorf("STOCK_PHRASES: %w", err)
+	}
+	if rc.HoursPhrases, err = parseIntentPhrases(getEnvVarDefault("HOURS_PHRASES", defaultHoursPhrases), false); err != nil {
+		return nil, fmt.Errorf("HOURS_PHRASES: %w", err)
+	}
+	if rc.PollSteps, err = parsePollSteps(getEnvVarDefault("POLL_STEPS", defaultPollSteps)); err != nil {
+		return nil, fmt.Errorf("POLL_STEPS: %w", err)
+	}
+	if rc.PollTimeout, err = time.ParseDuration(getEnvVarDefault("POLL_TIMEOUT", "2m")); err != nil || rc.PollTimeout <= 0 {
+		return nil, fmt.Errorf("POLL_TIMEOUT: must be a positive duration such as 2m")
+	}
+	for _, slot := range strings.Split(os.Getenv("GIFT_SLOTS"), "|") {
+		if slot = strings.TrimSpace(slot); slot == "" {
+			continue
+		}
+		if len([]rune(slot)) > maxGiftSlot {
+			return nil, fmt.Errorf("GIFT_SLOTS: %q is longer than %d characters", slot, maxGiftSlot)
+		}
+		rc.GiftSlots = append(rc.GiftSlots, slot)
+	}
+	if rc.SelfTest, err = parseSelfTestSchedule(getEnvVarDefault("PAYFAST_SELFTEST", "off")); err != nil {
+		return nil, fmt.Errorf("PAYFAST_SELFTEST: %w", err)
+	}
+	if rc.OrderExpiry, err = time.ParseDuration(getEnvVarDefault("ORDER_EXPIRY", "48h")); err != nil || rc.OrderExpiry < 0 {
+		return nil, fmt.Errorf("ORDER_EXPIRY: must be a non-negative duration such as 48h")
+	}
+	if rc.NgrokAPIURL = strings.TrimSpace(os.Getenv("NGROK_API_URL")); rc.NgrokAPIURL != "" {
+		if err := validateBaseURL(rc.NgrokAPIURL); err != nil {
+			return nil, fmt.Errorf("NGROK_API_URL: %w", err)
+		}
+	}
+	switch rc.HomebaseURL = strings.TrimSpace(os.Getenv("HOMEBASEURL")); {
+	case rc.HomebaseURL == "" && rc.NgrokAPIURL == "":
+		return nil, fmt.Errorf("HOMEBASEURL: required unless NGROK_API_URL is set")
+	case rc.HomebaseURL != "":
+		if err := validateBaseURL(rc.HomebaseURL); err != nil {
+			return nil, fmt.Errorf("HOMEBASEURL: %w", err)
+		}
+	}
+	if rc.SlowQuery, err = time.ParseDuration(getEnvVarDefault("SLOW_QUERY_THRESHOLD", "200ms")); err != nil || rc.SlowQuery < 0 {
+		return nil, fmt.Errorf("SLOW_QUERY_THRESHOLD: must be a non-negative duration such as 200ms")
+	}
+	rc.InviteOnlyMessage = getEnvVarDefault("INVITE_ONLY_MESSAGE", defaultInviteOnlyMessage)
+	if rc.AlertWebhookURL = strings.TrimSpace(os.Getenv("ALERT_WEBHOOK_URL")); rc.AlertWebhookURL != "" {
+		if err := validateBaseURL(rc.AlertWebhookURL); err != nil {
+			return nil, fmt.Errorf("ALERT_WEBHOOK_URL: %w", err)
+		}
+	}
+	if rc.PrepTimePerOrder, err = time.ParseDuration(getEnvVarDefault("PREP_TIME_PER_ORDER", "8m")); err != nil || rc.PrepTimePerOrder < 0 {
+		return nil, fmt.Errorf("PREP_TIME_PER_ORDER: must be a non-negative duration such as 8m")
+	}
+	if rc.MaxMessageLength, err = strconv.Atoi(getEnvVarDefault("MAX_MESSAGE_LENGTH", "4096")); err != nil || rc.MaxMessageLength < 0 {
+		return nil, fmt.Errorf("MAX_MESSAGE_LENGTH: must be a non-negative number of characters")
+	}
+	if rc.Retention, err = parseRetention(getEnvVarDefault("RETENTION", defaultRetention)); err != nil {
+		return nil, fmt.Errorf("RETENTION: %w", err)
+	}
+	rc.RetentionArchiveDir = strings.TrimSpace(os.Getenv("RETENTION_ARCHIVE_DIR"))
+	if rc.RetentionDryRun, err = strconv.ParseBool(getEnvVarDefault("RETENTION_DRY_RUN", "false")); err != nil {
+		return nil, fmt.Errorf("RETENTION_DRY_RUN: %w", err)
+	}
+	if rc.AdGreeting = getEnvVarDefault("AD_GREETING", defaultAdGreeting); rc.AdGreeting == "none" {
+		rc.AdGreeting = ""
+	}
+	if err := checkMessageTemplates(rc); err != nil {
+		return nil, err
+	}
+	if keywords := getEnvVarDefault("ESCALATION_KEYWORDS", defaultEscalationKeywords); keywords != "none" {
+		for _, keyword := range strings.Split(keywords, ",") {
+			if keyword = normalizeForMatch(keyword); keyword != "" {
+				rc.EscalationKeywords = append(rc.EscalationKeywords, keyword)
+			}
+		}
+	}
+	if rc.TestSinkNumber = strings.TrimSpace(os.Getenv("TEST_SINK_NUMBER")); rc.TestSinkNumber != "" {
+		if _, err := resolveJID(rc.TestSinkNumber); err != nil {
+			return nil, fmt.Errorf("TEST_SINK_NUMBER: %w", err)
+		}
+	}
+	for _, number := range strings.Split(os.Getenv("TESTER_NUMBERS"), ",") {
+		if number = strings.TrimSpace(number); number != "" {
+			rc.TesterNumbers = append(rc.TesterNumbers, number)
+		}
+	}
+
+	return rc, nil
+}
+
+// IsTester reports whether number may talk to the bot while in test mode.
+func (rc *RuntimeConfig) IsTester(number string) bool {
+	for _, tester := range rc.TesterNumbers {
+		if tester == number {
+			return true
+		}
+	}
+	return false
+}
+
+// diffRuntimeConfig lists the settings that differ between cur and next in
+// "NAME: old -> new" form. URLs are only reported as changed, since a
+// webhook's secret is usually in its path or query.
+func diffRuntimeConfig(cur, next *RuntimeConfig) []string {
+	var changes []string
+	add := func(name string, o, n any) {
+		if was, now := fmt.Sprint(o), fmt.Sprint(n); was != now {
+			changes = append(changes, fmt.Sprintf("%s: %q -> %q", name, was, now))
+		}
+	}
+	addRedacted := func(name, was, now string) {
+		if was != now {
+			changes = append(changes, name+": changed")
+		}
+	}
+	add("BUSINESS_HOURS", cur.BusinessHours, next.BusinessHours)
+	add("BUSINESS_TZ", cur.BusinessHours.Location, next.BusinessHours.Location)
+	add("CLOSED_MESSAGE", cur.ClosedMessage, next.ClosedMessage)
+	add("QUIET_HOURS", quietHoursString(cur.QuietHours), quietHoursString(next.QuietHours))
+	add("RATE_LIMIT_PER_MINUTE", cur.RateLimit, next.RateLimit)
+	add("LOG_LEVEL", cur.LogLevel, next.LogLevel)
+	add("PRICELIST_REFRESH_INTERVAL", cur.PricelistRefresh, next.PricelistRefresh)
+	add("IS_TEST", cur.IsTest, next.IsTest)
+	add("CANCEL_WINDOW", cur.CancelWindow, next.CancelWindow)
+	add("RATING_PROMPT_DELAY", cur.RatingPromptDelay, next.RatingPromptDelay)
+	add("MENU_SHORTCUT_WINDOW", cur.MenuShortcutWindow, next.MenuShortcutWindow)
+	add("SEND_RETRIES", cur.SendRetries, next.SendRetries)
+	add("OUTBOUND_RATE", cur.OutboundRate, next.OutboundRate)
+	add("OUTBOUND_BURST", cur.OutboundBurst, next.OutboundBurst)
+	add("HTTP_RATE_LIMIT", cur.HTTPRate, next.HTTPRate)
+	add("HTTP_RATE_BURST", cur.HTTPBurst, next.HTTPBurst)
+	add("NOTIFY_RATE_LIMIT", cur.NotifyRate, next.NotifyRate)
+	add("NOTIFY_RATE_BURST", cur.NotifyBurst, next.NotifyBurst)
+	add("HTTP_RATE_ALLOWLIST", cidrListString(cur.RateLimitAllowlist), cidrListString(next.RateLimitAllowlist))
+	add("TRUSTED_PROXIES", cidrListString(cur.TrustedProxies), cidrListString(next.TrustedProxies))
+	add("REFERRAL_POINTS", cur.ReferralPoints, next.ReferralPoints)
+	add("DUPLICATE_CHECKOUT_WINDOW", cur.DuplicateCheckout, next.DuplicateCheckout)
+	add("ESCALATION_KEYWORDS", strings.Join(cur.EscalationKeywords, ","), strings.Join(next.EscalationKeywords, ","))
+	add("ESCALATION_TAKEOVER", cur.EscalationTakeover, next.EscalationTakeover)
+	add("COMMAND_SUGGESTIONS", cur.CommandSuggestions, next.CommandSuggestions)
+	add("REACTION_ACTIONS", reactionActionsString(cur.ReactionActions), reactionActionsString(next.ReactionActions))
+	add("AD_GREETING", cur.AdGreeting, next.AdGreeting)
+	add("PRICE_PHRASES", intentPhrasesString(cur.PricePhrases), intentPhrasesString(next.PricePhrases))
+	add("STOCK_PHRASES", intentPhrasesString(cur.StockPhrases), intentPhrasesString(next.StockPhrases))
+	add("HOURS_PHRASES", intentPhrasesString(cur.HoursPhrases), intentPhrasesString(next.HoursPhrases))
+	add("POLL_STEPS", strings.Join(cur.PollSteps, ","), strings.Join(next.PollSteps, ","))
+	add("POLL_TIMEOUT", cur.PollTimeout, next.PollTimeout)
+	add("GIFT_SLOTS", strings.Join(cur.GiftSlots, "|"), strings.Join(next.GiftSlots, "|"))
+	add("PAYFAST_SELFTEST", cur.SelfTest.String(), next.SelfTest.String())
+	add("ORDER_EXPIRY", cur.OrderExpiry, next.OrderExpiry)
+	addRedacted("HOMEBASEURL", cur.HomebaseURL, next.HomebaseURL)
+	addRedacted("NGROK_API_URL", cur.NgrokAPIURL, next.NgrokAPIURL)
+	add("SLOW_QUERY_THRESHOLD", cur.SlowQuery, next.SlowQuery)
+	add("INVITE_ONLY_MESSAGE", cur.InviteOnlyMessage, next.InviteOnlyMessage)
+	addRedacted("ALERT_WEBHOOK_URL", cur.AlertWebhookURL, next.AlertWebhookURL)
+	add("PREP_TIME_PER_ORDER", cur.PrepTimePerOrder, next.PrepTimePerOrder)
+	add("MAX_MESSAGE_LENGTH", cur.MaxMessageLength, next.MaxMessageLength)
+	add("RETENTION", retentionString(cur.Retention), retentionString(next.Retention))
+	add("RETENTION_ARCHIVE_DIR", cur.RetentionArchiveDir, next.RetentionArchiveDir)
+	add("RETENTION_DRY_RUN", cur.RetentionDryRun, next.RetentionDryRun)
+	add("TESTER_NUMBERS", strings.Join(cur.TesterNumbers, ","), strings.Join(next.TesterNumbers, ","))
+	add("TEST_SINK_NUMBER", cur.TestSinkNumber, next.TestSinkNumber)
+	return changes
+}
+
+func snapshotStaticEnv() map[string]string {
+	snapshot := make(map[string]string, len(staticEnvKeys)+len(secretEnvKeys))
+	for _, key := range staticEnvKeys {
+		snapshot[key] = os.Getenv(key)
+	}
+	for _, key := range secretEnvKeys {
+		snapshot[key+"_FILE"] = os.Getenv(key + "_FILE")
+	}
+	return snapshot
+}
+
+// envFromFile are the keys app.env set, at startup or on the last reload.
+// A key taken out of the file is unset again on reload, rather than
+// keeping the value it had; keys the process environment set are left
+// alone, as godotenv.Load leaves them.
+var envFromFile = map[string]bool{}
+
+// loadEnvFile sets the environment from app.env, leaving keys the
+// process environment already has.
+func loadEnvFile() error {
+	values, err := godotenv.Read(envFile)
+	if err != nil {
+		return err
+	}
+	applyEnvFile(values)
+	return nil
+}
+
+func applyEnvFile(values map[string]string) {
+	for key := range envFromFile {
+		if _, ok := values[key]; !ok {
+			os.Unsetenv(key)
+		}
+	}
+	fromFile := make(map[string]bool, len(values))
+	for key, value := range values {
+		if _, set := os.LookupEnv(key); set && !envFromFile[key] {
+			continue
+		}
+		os.Setenv(key, value)
+		fromFile[key] = true
+	}
+	envFromFile = fromFile
+}
+
+// reloadConfig re-reads app.env and applies the runtime subset. Static
+// settings that changed are reported by name only, since several of them
+// are credentials.
+func reloadConfig(startupEnv map[string]string) {
+	values, err := godotenv.Read(envFile)
+	if err != nil {
+		log.Printf("Config reload: reading %s failed, keeping current config: %v", envFile, err)
+		return
+	}
+	applyEnvFile(values)
+
+	keys := make([]string, 0, len(startupEnv))
+	for key := range startupEnv {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if os.Getenv(key) != startupEnv[key] {
+			log.Printf("Config reload: %s changed: ignored, restart required", key)
+		}
+	}
+
+	next, err := loadRuntimeConfig()
+	if err != nil {
+		log.Printf("Config reload: invalid config, keeping current config: %v", err)
+		return
+	}
+
+	changes := diffRuntimeConfig(cfg(), next)
+	if sink := next.TestSink(); sink != "" && sink != cfg().TestSink() {
+		logTestSinkBanner(sink)
+	}
+	applyRuntimeConfig(next)
+	if len(changes) == 0 {
+		log.Println("Config reload: no runtime settings changed")
+		return
+	}
+	for _, change := range changes {
+		log.Printf("Config reload: %s", change)
+	}
+}
+
+// watchConfigReload reloads the runtime configuration on every SIGHUP.
+func watchConfigReload(startupEnv map[string]string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig(startupEnv)
+		}
+	}()
+}
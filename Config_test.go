@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecretFromFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, contents string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	tests := []struct {
+		name     string
+		value    string
+		file     string // contents of PASSPHRASE_FILE, "" for unset
+		missing  bool   // PASSPHRASE_FILE names a file that doesn't exist
+		required bool
+		want     string
+		wantErr  string
+	}{
+		{name: "plain value", value: "s3cret", want: "s3cret"},
+		{name: "from file", file: "s3cret", want: "s3cret"},
+		{name: "trailing newline trimmed", file: "s3cret\n", want: "s3cret"},
+		{name: "CRLF and spaces trimmed", file: "  s3cret \r\n", want: "s3cret"},
+		{name: "inner spaces kept", file: "two words\n", want: "two words"},
+		{name: "both set", value: "s3cret", file: "other", wantErr: "both PASSPHRASE and PASSPHRASE_FILE are set"},
+		{name: "unreadable file", missing: true, wantErr: "reading PASSPHRASE_FILE"},
+		{name: "required and unset", required: true, wantErr: "set PASSPHRASE or PASSPHRASE_FILE"},
+		{name: "optional and unset", want: ""},
+		{name: "required from file", file: "s3cret", required: true, want: "s3cret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PASSPHRASE", tt.value)
+			t.Setenv("PASSPHRASE_FILE", "")
+			switch {
+			case tt.missing:
+				t.Setenv("PASSPHRASE_FILE", filepath.Join(dir, "nope"))
+			case tt.file != "":
+				t.Setenv("PASSPHRASE_FILE", write(strings.ReplaceAll(tt.name, " ", "-"), tt.file))
+			}
+			var l envLoader
+			got := l.secret("PASSPHRASE", tt.required)
+			err := l.err()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				if strings.Contains(err.Error(), "s3cret") || strings.Contains(err.Error(), "other") {
+					t.Errorf("the error gives the secret away: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// withRuntimeConfig makes rc the runtime config for the rest of the test.
+func withRuntimeConfig(t *testing.T, rc *RuntimeConfig) {
+	t.Helper()
+	prev := runtimeConfig.Load()
+	runtimeConfig.Store(rc)
+	t.Cleanup(func() { runtimeConfig.Store(prev) })
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// connectionEventQueueSize bounds the writes waiting for the database. A
+// flapping connection fills it and further events are dropped, rather than
+// piling up goroutines or database load.
+const connectionEventQueueSize = 128
+
+// Connection event kinds. connUp and the down kinds drive the uptime
+// report; the rest are recorded for context only.
+const (
+	connStarted         = "started"
+	connUp              = "connected"
+	connDisconnected    = "disconnected"
+	connLoggedOut       = "logged_out"
+	connStreamReplaced  = "stream_replaced"
+	connConnectFailure  = "connect_failure"
+	connReconnectFailed = "reconnect_failed"
+	connKeepAlive       = "keepalive_timeout"
+	connTemporaryBan    = "temporary_ban"
+	connPaired          = "paired"
+	connStopped         = "stopped"
+)
+
+// connDownKinds end a connected period. connStarted is among them so a
+// crash while connected doesn't count the downtime until the restart as
+// uptime forever after.
+var connDownKinds = map[string]bool{
+	connStarted:        true,
+	connDisconnected:   true,
+	connLoggedOut:      true,
+	connStreamReplaced: true,
+	connConnectFailure: true,
+	connTemporaryBan:   true,
+	connStopped:        true,
+}
+
+type connectionEvent struct {
+	Kind       string    `json:"kind"`
+	Detail     string    `json:"detail,omitempty"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// connectionLog appends WhatsApp connection lifecycle events to the
+// connection_events table in the background, and remembers the latest
+// transitions for the status command.
+type connectionLog struct {
+	db    *sql.DB
+	queue chan connectionEvent
+
+	mu             sync.Mutex
+	connectedSince time.Time
+	lastDown       connectionEvent
+}
+
+func newConnectionLog(db *sql.DB) *connectionLog {
+	l := &connectionLog{db: db, queue: make(chan connectionEvent, connectionEventQueueSize)}
+	err := db.QueryRow(`SELECT kind, detail, occurred_at FROM connection_events
+		WHERE `+kindsIn(downKinds(connStarted)...)+` ORDER BY id DESC LIMIT 1`).
+		Scan(&l.lastDown.Kind, &l.lastDown.Detail, &l.lastDown.OccurredAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Reading last disconnect failed: %v", err)
+	}
+	go l.run()
+	l.Record(connStarted, "")
+	return l
+}
+
+// kindsIn is a SQL condition matching the given kinds, which are all
+// constants above.
+func kindsIn(kinds ...string) string {
+	return "kind IN ('" + strings.Join(kinds, "', '") + "')"
+}
+
+// downKinds lists connDownKinds, optionally without some of them.
+func downKinds(except ...string) []string {
+	var kinds []string
+	for kind := range connDownKinds {
+		if !slices.Contains(except, kind) {
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// Record queues an event without blocking.
+func (l *connectionLog) Record(kind, detail string) {
+	e := connectionEvent{Kind: kind, Detail: detail, OccurredAt: time.Now()}
+	l.mu.Lock()
+	if kind == connUp {
+		l.connectedSince = e.OccurredAt
+	} else if connDownKinds[kind] {
+		if !l.connectedSince.IsZero() {
+			l.lastDown = e
+		}
+		l.connectedSince = time.Time{}
+	}
+	l.mu.Unlock()
+
+	select {
+	case l.queue <- e:
+	default:
+		metrics.Inc("menubot_connection_events_dropped_total", "Connection events not recorded because the write queue was full.")
+	}
+}
+
+func (l *connectionLog) run() {
+	for e := range l.queue {
+		_, err := l.db.Exec(`INSERT INTO connection_events (kind, detail, occurred_at) VALUES ($1, $2, $3)`,
+			e.Kind, e.Detail, e.OccurredAt)
+		if err != nil {
+			log.Printf("Recording %s connection event failed: %v", e.Kind, err)
+		}
+	}
+}
+
+// Flush waits briefly for queued events to be written, for shutdown.
+func (l *connectionLog) Flush(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for len(l.queue) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Watch records the client's lifecycle events, including failed
+// automatic reconnects.
+func (l *connectionLog) Watch(c waClient) {
+	c.AddEventHandler(l.handleEvent)
+	c.SetAutoReconnectHook(func(err error) bool {
+		l.Record(connReconnectFailed, err.Error())
+		return true
+	})
+}
+
+func (l *connectionLog) handleEvent(evt interface{}) {
+	switch v := evt.(type) {
+	case *events.Connected:
+		l.Record(connUp, "")
+	case *events.Disconnected:
+		l.Record(connDisconnected, "")
+	case *events.LoggedOut:
+		l.Record(connLoggedOut, v.Reason.String())
+	case *events.StreamReplaced:
+		l.Record(connStreamReplaced, "")
+	case *events.ConnectFailure:
+		l.Record(connConnectFailure, fmt.Sprintf("%s: %s", v.Reason, v.Message))
+	case *events.TemporaryBan:
+		l.Record(connTemporaryBan, v.String())
+	case *events.KeepAliveTimeout:
+		l.Record(connKeepAlive, fmt.Sprintf("%d errors, last success %s", v.ErrorCount, v.LastSuccess.Format(time.RFC3339)))
+	case *events.PairSuccess:
+		l.Record(connPaired, v.ID.String())
+	}
+}
+
+// Status is the connection summary shown by the admin status command.
+func (l *connectionLog) Status() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var s string
+	if !l.connectedSince.IsZero() {
+		s = fmt.Sprintf("Connected since %s (%s).", l.connectedSince.Format("2006-01-02 15:04"), time.Since(l.connectedSince).Round(time.Minute))
+	} else {
+		s = "Not connected."
+	}
+	if !l.lastDown.OccurredAt.IsZero() {
+		s += fmt.Sprintf(" Last disconnect %s (%s).", l.lastDown.OccurredAt.Format("2006-01-02 15:04"), l.lastDown.Kind)
+	}
+	return s
+}
+
+type outage struct {
+	Start  time.Time  `json:"start"`
+	End    *time.Time `json:"end,omitempty"`
+	Reason string     `json:"reason"`
+	// Seconds is the part of the outage inside the report window.
+	Seconds float64 `json:"seconds"`
+}
+
+type uptimeReport struct {
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+	ConnectedPct float64   `json:"connected_pct"`
+	Outages      []outage  `json:"outages"`
+}
+
+func buildUptimeReport(db *sql.DB, from, to time.Time) (uptimeReport, error) {
+	report := uptimeReport{From: from, To: to, Outages: []outage{}}
+
+	// The state at the start of the window is whatever the last event
+	// before it left behind; with no history at all we were down.
+	stateKinds := kindsIn(append(downKinds(), connUp)...)
+	var before connectionEvent
+	err := db.QueryRow(`SELECT kind, detail, occurred_at FROM connection_events
+		WHERE occurred_at < $1 AND `+stateKinds+` ORDER BY occurred_at DESC, id DESC LIMIT 1`,
+		from).Scan(&before.Kind, &before.Detail, &before.OccurredAt)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return report, err
+	}
+	up := before.Kind == connUp
+	var current *outage
+	if !up {
+		start := from
+		if !before.OccurredAt.IsZero() {
+			start = before.OccurredAt
+		}
+		current = &outage{Start: start, Reason: before.Kind}
+		if current.Reason == "" {
+			current.Reason = "no data"
+		}
+	}
+
+	rows, err := db.Query(`SELECT kind, detail, occurred_at FROM connection_events
+		WHERE occurred_at >= $1 AND occurred_at < $2 AND `+stateKinds+` ORDER BY occurred_at, id`,
+		from, to)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+
+	var connected time.Duration
+	mark := from
+	for rows.Next() {
+		var e connectionEvent
+		if err := rows.Scan(&e.Kind, &e.Detail, &e.OccurredAt); err != nil {
+			return report, err
+		}
+		switch {
+		case e.Kind == connUp && !up:
+			end := e.OccurredAt
+			current.End = &end
+			current.Seconds = end.Sub(maxTime(current.Start, from)).Seconds()
+			report.Outages = append(report.Outages, *current)
+			current = nil
+			up, mark = true, e.OccurredAt
+		case connDownKinds[e.Kind] && up:
+			connected += e.OccurredAt.Sub(mark)
+			current = &outage{Start: e.OccurredAt, Reason: e.Kind}
+			up = false
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	end := minTime(to, time.Now())
+	if up {
+		connected += end.Sub(mark)
+	} else if current != nil {
+		current.Seconds = end.Sub(maxTime(current.Start, from)).Seconds()
+		report.Outages = append(report.Outages, *current)
+	}
+	if window := end.Sub(from); window > 0 {
+		report.ConnectedPct = connected.Seconds() * 100 / window.Seconds()
+	}
+	return report, nil
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// UptimeReportHandler serves GET /api/reports/uptime?from=&to=, defaulting
+// to the last 7 days.
+func UptimeReportHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		from, err := parseReportTime(r.URL.Query().Get("from"), now.AddDate(0, 0, -7))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "from: "+err.Error())
+			return
+		}
+		to, err := parseReportTime(r.URL.Query().Get("to"), now)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "to: "+err.Error())
+			return
+		}
+		report, err := buildUptimeReport(db, from, to)
+		if err != nil {
+			log.Printf("Building uptime report failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "building report failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	subscribeCommand   = "subscribe"
+	unsubscribeCommand = "unsubscribe"
+	confirmCommand     = "yes"
+	consentPrompt      = "Reply YES to receive weekly specials."
+	// consentConfirmWindow is how long a subscribe request waits for YES.
+	consentConfirmWindow = 24 * time.Hour
+)
+
+// Consent log events. The log is append-only; the customer's current
+// consent is the opted_in flag on their profile.
+const (
+	consentRequested = "requested"
+	consentGranted   = "opted_in"
+	consentWithdrawn = "opted_out"
+)
+
+type consentEvent struct {
+	Event   string    `json:"event"`
+	Message string    `json:"message"`
+	Prompt  string    `json:"prompt,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+type customerConsent struct {
+	CellNumber   string         `json:"cell_number"`
+	OptedIn      bool           `json:"opted_in"`
+	PendingUntil *time.Time     `json:"pending_until,omitempty"`
+	History      []consentEvent `json:"history"`
+}
+
+func logConsent(tx dbtx, cell, event, message, prompt string) error {
+	_, err := tx.Exec(`INSERT INTO consent_log (cell_number, event, message, prompt) VALUES ($1, $2, $3, $4)`,
+		cell, event, message, prompt)
+	return err
+}
+
+// isOptedIn is the broadcast check, made per recipient at send time.
+func isOptedIn(db dbtx, cell string) (bool, error) {
+	var optedIn bool
+	err := db.QueryRow(`SELECT opted_in FROM customer_profiles WHERE cell_number = $1`, cell).Scan(&optedIn)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return optedIn, err
+}
+
+// setConsent changes the customer's consent and logs the message that
+// changed it, in one transaction so the flag never disagrees with the log.
+func setConsent(db *sql.DB, cell string, optedIn bool, message, prompt string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO customer_profiles (cell_number, opted_in) VALUES ($1, $2)
+		ON CONFLICT (cell_number) DO UPDATE SET opted_in = EXCLUDED.opted_in, consent_requested_at = NULL, updated_at = now()`,
+		cell, optedIn)
+	if err != nil {
+		return err
+	}
+	event := consentWithdrawn
+	if optedIn {
+		event = consentGranted
+	}
+	if err := logConsent(tx, cell, event, message, prompt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func requestConsent(db *sql.DB, cell, message string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(`INSERT INTO customer_profiles (cell_number, consent_requested_at) VALUES ($1, now())
+		ON CONFLICT (cell_number) DO UPDATE SET consent_requested_at = now(), updated_at = now()`, cell)
+	if err != nil {
+		return err
+	}
+	if err := logConsent(tx, cell, consentRequested, message, consentPrompt); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// consentReply handles subscribe, the YES that confirms it, and
+// unsubscribe. msg is the message as received, which is what the consent
+// log records. A YES with no subscribe request in the last 24 hours isn't
+// handled here, so it reaches MenuBotLib like any other message.
+func consentReply(cc *commandContext, cell, msg string, now time.Time) (string, bool) {
+	db := cc.db
+	failed := func(err error, context string) string {
+		return cc.apology(incidentConsentSave, cell, 0, err, "Consent: "+context,
+			"Sorry, something went wrong saving your preference. Please try again.")
+	}
+	switch normalizeCommand(RemoveNonASCIICharacters(msg)) {
+	case subscribeCommand:
+		optedIn, err := isOptedIn(db, cell)
+		if err != nil {
+			return failed(err, "reading consent"), true
+		}
+		if optedIn {
+			return fmt.Sprintf("You're already subscribed to our weekly specials. Reply \"%s\" to stop them.", unsubscribeCommand), true
+		}
+		if err := requestConsent(db, cell, msg); err != nil {
+			return failed(err, "saving the subscribe request"), true
+		}
+		return consentPrompt, true
+
+	case confirmCommand:
+		var requested sql.NullTime
+		err := db.QueryRow(`SELECT consent_requested_at FROM customer_profiles WHERE cell_number = $1`, cell).Scan(&requested)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Reading consent of %s failed: %v", cell, err)
+			return "", false
+		}
+		if !requested.Valid || now.Sub(requested.Time) > consentConfirmWindow {
+			return "", false
+		}
+		if err := setConsent(db, cell, true, msg, consentPrompt); err != nil {
+			return failed(err, "saving consent"), true
+		}
+		return fmt.Sprintf("You're subscribed to our weekly specials. Reply \"%s\" at any time to stop them.", unsubscribeCommand), true
+
+	case unsubscribeCommand:
+		if err := setConsent(db, cell, false, msg, ""); err != nil {
+			return failed(err, "saving the unsubscribe"), true
+		}
+		return fmt.Sprintf("You won't receive our specials any more. Reply \"%s\" to subscribe again.", subscribeCommand), true
+	}
+	return "", false
+}
+
+func getConsent(db *sql.DB, cell string) (customerConsent, error) {
+	c := customerConsent{CellNumber: cell, History: []consentEvent{}}
+	var requested sql.NullTime
+	var lid string
+	err := db.QueryRow(`SELECT opted_in, consent_requested_at, COALESCE(lid, '') FROM customer_profiles WHERE cell_number = $1`, cell).
+		Scan(&c.OptedIn, &requested, &lid)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return c, err
+	}
+	if requested.Valid && !c.OptedIn {
+		until := requested.Time.Add(consentConfirmWindow)
+		if time.Now().Before(until) {
+			c.PendingUntil = &until
+		}
+	}
+	// Consent given before the customer's LID was linked to their number,
+	// or under a number since merged into this one, stays logged there.
+	rows, err := db.Query(`SELECT event, message, prompt, created_at FROM consent_log
+		WHERE cell_number IN ($1, $2) OR cell_number IN (WITH RECURSIVE merged (cell) AS (
+				SELECT duplicate_cell FROM customer_merges WHERE primary_cell = $1
+				UNION SELECT c.duplicate_cell FROM customer_merges c JOIN merged ON c.primary_cell = merged.cell
+			) SELECT cell FROM merged)
+		ORDER BY id`, cell, lid)
+	if err != nil {
+		return c, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e consentEvent
+		if err := rows.Scan(&e.Event, &e.Message, &e.Prompt, &e.At); err != nil {
+			return c, err
+		}
+		c.History = append(c.History, e)
+	}
+	return c, rows.Err()
+}
+
+func GetConsentHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cell, err := canonicalNumber(chi.URLParam(r, "cell"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		c, err := getConsent(db, cell)
+		if err != nil {
+			log.Printf("Reading consent of %s failed: %v", cell, err)
+			writeJSONError(w, http.StatusInternalServerError, "reading consent failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, c)
+	}
+}
+
+type broadcastRequest struct {
+	Text string `json:"text"`
+}
+
+type broadcastResponse struct {
+	Recipients int `json:"recipients"`
+	// HeldUntil is when quiet hours end, if the broadcast was held.
+	HeldUntil *time.Time `json:"held_until,omitempty"`
+}
+
+// subscribers lists the customers opted in to marketing messages.
+func subscribers(db *sql.DB) ([]string, error) {
+	rows, err := db.Query(`SELECT cell_number FROM customer_profiles WHERE opted_in ORDER BY cell_number`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var recipients []string
+	for rows.Next() {
+		var cell string
+		if err := rows.Scan(&cell); err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, cell)
+	}
+	return recipients, rows.Err()
+}
+
+// broadcast sends text to each recipient that is still opted in when
+// their turn comes; the send queue can take a while to work through. In
+// quiet hours it is held instead, and dropped if expires has passed by
+// the time it could go out.
+func broadcast(cc *commandContext, recipients []string, text string, expires *time.Time) {
+	var sent, held int
+	for _, cell := range recipients {
+		optedIn, err := isOptedIn(cc.db, cell)
+		if err != nil {
+			log.Printf("Broadcast: reading consent of %s failed, skipping: %v", cell, err)
+			continue
+		}
+		if !optedIn {
+			continue
+		}
+		if cc.sendBulk(bulkMessage{Recipient: cell, Text: text, Kind: bulkBroadcast, ExpiresAt: expires}) {
+			held++
+		} else {
+			sent++
+		}
+	}
+	log.Printf("Broadcast sent to %d and held for quiet hours for %d of %d subscribers", sent, held, len(recipients))
+}
+
+// PostBroadcastHandler queues a marketing message to every subscriber and
+// returns how many there are. Delivery happens in the background.
+func PostBroadcastHandler(cc *commandContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req broadcastRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		req.Text = strings.TrimSpace(req.Text)
+		if req.Text == "" {
+			writeJSONError(w, http.StatusBadRequest, "text is required")
+			return
+		}
+		recipients, err := subscribers(cc.db)
+		if err != nil {
+			log.Printf("Reading subscribers failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "reading subscribers failed")
+			return
+		}
+		resp := broadcastResponse{Recipients: len(recipients)}
+		if until, quiet := quietUntil(cfg(), time.Now()); quiet {
+			resp.HeldUntil = &until
+		}
+		go broadcast(cc, recipients, req.Text, nil)
+		writeJSON(w, http.StatusAccepted, resp)
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// contact_rules decide who the bot talks to, before anything else looks at
+// a message. A rule's pattern is a number, or a prefix ending in "*" such
+// as "2783*". A deny rule that matches drops the message unanswered, even
+// if an allow rule matches too. In allowlist-only mode, for pilots, only
+// numbers an allow rule matches get through; the rest are sent
+// INVITE_ONLY_MESSAGE once, ever, and nothing after. Expired rules are
+// ignored. The shop's own numbers are never gated.
+
+const defaultInviteOnlyMessage = "Sorry, we're only serving invited customers at the moment."
+
+const (
+	contactAllow = "allow"
+	contactDeny  = "deny"
+)
+
+var contactPatternRE = regexp.MustCompile(`^\d{2,15}\*?$`)
+
+type contactRule struct {
+	ID        int64      `json:"id"`
+	Pattern   string     `json:"pattern"`
+	Action    string     `json:"action"`
+	Reason    string     `json:"reason,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (r contactRule) Matches(number string, now time.Time) bool {
+	if r.ExpiresAt != nil && !now.Before(*r.ExpiresAt) {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(r.Pattern, "*"); ok {
+		return strings.HasPrefix(number, prefix)
+	}
+	return number == r.Pattern
+}
+
+// The verdicts of contactRules.Check.
+const (
+	contactPass       = ""
+	contactDenied     = "denied"
+	contactNotInvited = "not_invited"
+)
+
+// contactRules caches the rules and allowlist-only mode, which live in
+// contact_rules and the single-row contact_gate table.
+type contactRules struct {
+	db            *sql.DB
+	mu            sync.RWMutex
+	rules         []contactRule
+	allowlistOnly atomic.Bool
+}
+
+func loadContactRules(db *sql.DB) (*contactRules, error) {
+	c := &contactRules{db: db}
+	var only bool
+	err := db.QueryRow(`SELECT allowlist_only FROM contact_gate WHERE id = 1`).Scan(&only)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("reading allowlist-only mode: %w", err)
+	}
+	c.allowlistOnly.Store(only)
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	if only {
+		log.Printf("Allowlist-only mode is on")
+	}
+	return c, nil
+}
+
+func (c *contactRules) reload() error {
+	rows, err := c.db.Query(`SELECT id, pattern, action, reason, expires_at, created_at FROM contact_rules
+		WHERE expires_at IS NULL OR expires_at > now() ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("reading contact rules: %w", err)
+	}
+	defer rows.Close()
+	var rules []contactRule
+	for rows.Next() {
+		var r contactRule
+		var expires sql.NullTime
+		if err := rows.Scan(&r.ID, &r.Pattern, &r.Action, &r.Reason, &expires, &r.CreatedAt); err != nil {
+			return fmt.Errorf("reading contact rules: %w", err)
+		}
+		if expires.Valid {
+			r.ExpiresAt = &expires.Time
+		}
+		rules = append(rules, r)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("reading contact rules: %w", err)
+	}
+	c.mu.Lock()
+	c.rules = rules
+	c.mu.Unlock()
+	return nil
+}
+
+// Rules are the rules in force at now.
+func (c *contactRules) Rules(now time.Time) []contactRule {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	rules := []contactRule{}
+	for _, r := range c.rules {
+		if r.ExpiresAt == nil || now.Before(*r.ExpiresAt) {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+func (c *contactRules) AllowlistOnly() bool {
+	return c.allowlistOnly.Load()
+}
+
+// Check gives the verdict on a message from number.
+func (c *contactRules) Check(number string, now time.Time) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	allowed := false
+	for _, r := range c.rules {
+		if !r.Matches(number, now) {
+			continue
+		}
+		if r.Action == contactDeny {
+			return contactDenied
+		}
+		allowed = true
+	}
+	if !allowed && c.AllowlistOnly() {
+		return contactNotInvited
+	}
+	return contactPass
+}
+
+// Add saves a rule and makes it current.
+func (c *contactRules) Add(r contactRule) (contactRule, error) {
+	var expires sql.NullTime
+	if r.ExpiresAt != nil {
+		expires = sql.NullTime{Time: *r.ExpiresAt, Valid: true}
+	}
+	err := c.db.QueryRow(`INSERT INTO contact_rules (pattern, action, reason, expires_at) VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at`, r.Pattern, r.Action, r.Reason, expires).Scan(&r.ID, &r.CreatedAt)
+	if err != nil {
+		return r, fmt.Errorf("saving contact rule: %w", err)
+	}
+	return r, c.reload()
+}
+
+// Remove deletes the rules of action on pattern, returning how many went.
+func (c *contactRules) Remove(pattern, action string) (int64, error) {
+	res, err := c.db.Exec(`DELETE FROM contact_rules WHERE pattern = $1 AND action = $2`, pattern, action)
+	if err != nil {
+		return 0, fmt.Errorf("deleting contact rules: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n, c.reload()
+}
+
+func (c *contactRules) RemoveID(id int64) (bool, error) {
+	res, err := c.db.Exec(`DELETE FROM contact_rules WHERE id = $1`, id)
+	if err != nil {
+		return false, fmt.Errorf("deleting contact rule: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, c.reload()
+}
+
+func (c *contactRules) SetAllowlistOnly(on bool) error {
+	_, err := c.db.Exec(`INSERT INTO contact_gate (id, allowlist_only) VALUES (1, $1)
+		ON CONFLICT (id) DO UPDATE SET allowlist_only = EXCLUDED.allowlist_only, updated_at = now()`, on)
+	if err != nil {
+		return fmt.Errorf("saving allowlist-only mode: %w", err)
+	}
+	c.allowlistOnly.Store(on)
+	return nil
+}
+
+// gateContact reports whether a message from sender may go on to be
+// answered. Blocked messages are counted, and an uninvited number is told
+// once that it isn't invited.
+func (cc *commandContext) gateContact(sender string, now time.Time) bool {
+	verdict := cc.contactRules.Check(sender, now)
+	if verdict == contactPass {
+		return true
+	}
+	metrics.Inc("menubot_blocked_messages_total", "Inbound messages dropped by contact rules.", "reason", verdict)
+	if verdict == contactNotInvited {
+		res, err := cc.db.Exec(`INSERT INTO contact_invite_notices (cell_number) VALUES ($1) ON CONFLICT DO NOTHING`, sender)
+		if err != nil {
+			log.Printf("Recording invite-only notice to %s failed: %v", sender, err)
+		} else if n, _ := res.RowsAffected(); n == 1 {
+			cc.sender.Send(sender, cfg().message("INVITE_ONLY_MESSAGE", nil), priorityReply)
+		}
+	}
+	return false
+}
+
+// parseContactPattern normalizes a number, or a prefix ending in "*".
+func parseContactPattern(s string) (string, error) {
+	if prefix, ok := strings.CutSuffix(s, "*"); ok {
+		prefix = strings.TrimPrefix(strings.NewReplacer(" ", "", "-", "").Replace(prefix), "+")
+		if !contactPatternRE.MatchString(prefix + "*") {
+			return "", fmt.Errorf("invalid number prefix %q", s)
+		}
+		return prefix + "*", nil
+	}
+	number, err := canonicalNumber(s)
+	if err != nil {
+		return "", err
+	}
+	if !contactPatternRE.MatchString(number) {
+		return "", fmt.Errorf("invalid number %q", s)
+	}
+	return number, nil
+}
+
+// parseContactRuleArgs reads "<pattern> [for 7d] [reason...]".
+func parseContactRuleArgs(args []string, action string, now time.Time) (contactRule, error) {
+	if len(args) == 0 {
+		return contactRule{}, errors.New("a number is required")
+	}
+	pattern, err := parseContactPattern(args[0])
+	if err != nil {
+		return contactRule{}, err
+	}
+	r := contactRule{Pattern: pattern, Action: action}
+	args = args[1:]
+	if len(args) >= 2 && strings.EqualFold(args[0], "for") {
+		period, err := parsePeriod(args[1])
+		if err != nil {
+			return contactRule{}, err
+		}
+		expires := now.Add(period)
+		r.ExpiresAt = &expires
+		args = args[2:]
+	}
+	r.Reason = strings.Join(args, " ")
+	return r, nil
+}
+
+func (r contactRule) String() string {
+	s := r.Action + " " + r.Pattern
+	if r.ExpiresAt != nil {
+		s += " until " + r.ExpiresAt.In(cfg().BusinessHours.Location).Format("2 Jan 15:04")
+	}
+	if r.Reason != "" {
+		s += ": " + r.Reason
+	}
+	return s
+}
+
+func addContactRuleCommand(cc *commandContext, args []string, action, usage string) string {
+	r, err := parseContactRuleArgs(args, action, time.Now())
+	if err != nil {
+		return fmt.Sprintf("%v. Usage: %s", err, usage)
+	}
+	if r, err = cc.contactRules.Add(r); err != nil {
+		log.Println(err)
+		return "Saving the rule failed."
+	}
+	log.Printf("Contact rule %d added: %s", r.ID, r)
+	return "Done: " + r.String()
+}
+
+func removeContactRuleCommand(cc *commandContext, args []string, action, usage string) string {
+	if len(args) != 1 {
+		return "Usage: " + usage
+	}
+	pattern, err := parseContactPattern(args[0])
+	if err != nil {
+		return fmt.Sprintf("%v. Usage: %s", err, usage)
+	}
+	n, err := cc.contactRules.Remove(pattern, action)
+	if err != nil {
+		log.Println(err)
+		return "Removing the rule failed."
+	}
+	if n == 0 {
+		return fmt.Sprintf("There is no %s rule for %s.", action, pattern)
+	}
+	log.Printf("Contact rules: %s %s removed", action, pattern)
+	return fmt.Sprintf("Removed the %s rule for %s.", action, pattern)
+}
+
+// adminBlock handles "block <number|prefix*> [for 7d] [reason]".
+func adminBlock(cc *commandContext, args []string) string {
+	return addContactRuleCommand(cc, args, contactDeny, "block <number|prefix*> [for 7d] [reason]")
+}
+
+func adminUnblock(cc *commandContext, args []string) string {
+	return removeContactRuleCommand(cc, args, contactDeny, "unblock <number|prefix*>")
+}
+
+// adminInvite handles "invite <number|prefix*> [for 7d] [reason]", adding
+// to the allowlist.
+func adminInvite(cc *commandContext, args []string) string {
+	return addContactRuleCommand(cc, args, contactAllow, "invite <number|prefix*> [for 7d] [reason]")
+}
+
+func adminUninvite(cc *commandContext, args []string) string {
+	return removeContactRuleCommand(cc, args, contactAllow, "uninvite <number|prefix*>")
+}
+
+// adminAllowlistOnly handles "allowlist-only on|off", and on its own
+// reports the mode and the rules.
+func adminAllowlistOnly(cc *commandContext, args []string) string {
+	if len(args) == 0 {
+		mode := "off"
+		if cc.contactRules.AllowlistOnly() {
+			mode = "on"
+		}
+		lines := []string{"Allowlist-only is " + mode + "."}
+		for _, r := range cc.contactRules.Rules(time.Now()) {
+			lines = append(lines, r.String())
+		}
+		return strings.Join(lines, "\n")
+	}
+	var on bool
+	switch strings.ToLower(args[0]) {
+	case "on":
+		on = true
+	case "off":
+	default:
+		return "Usage: allowlist-only on|off"
+	}
+	if err := cc.contactRules.SetAllowlistOnly(on); err != nil {
+		log.Println(err)
+		return "Saving allowlist-only mode failed."
+	}
+	if on {
+		return "Allowlist-only is on: only invited numbers will be answered."
+	}
+	return "Allowlist-only is off: everyone not blocked will be answered."
+}
+
+type contactRulesResponse struct {
+	AllowlistOnly bool          `json:"allowlist_only"`
+	Rules         []contactRule `json:"rules"`
+}
+
+// contactRuleRequest is the body of POST /contact-rules. ExpiresAt is
+// RFC 3339.
+type contactRuleRequest struct {
+	Pattern   string     `json:"pattern"`
+	Action    string     `json:"action"`
+	Reason    string     `json:"reason"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type allowlistOnlyRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+func ListContactRulesHandler(rules *contactRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, contactRulesResponse{AllowlistOnly: rules.AllowlistOnly(), Rules: rules.Rules(time.Now())})
+	}
+}
+
+func PostContactRuleHandler(rules *contactRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req contactRuleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		if req.Action != contactAllow && req.Action != contactDeny {
+			writeJSONError(w, http.StatusBadRequest, "action must be allow or deny")
+			return
+		}
+		pattern, err := parseContactPattern(strings.TrimSpace(req.Pattern))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+			writeJSONError(w, http.StatusBadRequest, "expires_at must be in the future")
+			return
+		}
+		rule, err := rules.Add(contactRule{Pattern: pattern, Action: req.Action, Reason: strings.TrimSpace(req.Reason), ExpiresAt: req.ExpiresAt})
+		if err != nil {
+			log.Println(err)
+			writeJSONError(w, http.StatusInternalServerError, "saving rule failed")
+			return
+		}
+		log.Printf("%s added contact rule %d: %s", staffFromContext(r.Context()).Name, rule.ID, rule)
+		writeJSON(w, http.StatusCreated, rule)
+	}
+}
+
+func DeleteContactRuleHandler(rules *contactRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "ruleID"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid rule id")
+			return
+		}
+		found, err := rules.RemoveID(id)
+		if err != nil {
+			log.Println(err)
+			writeJSONError(w, http.StatusInternalServerError, "deleting rule failed")
+			return
+		}
+		if !found {
+			writeJSONError(w, http.StatusNotFound, "no rule with that id")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func PutAllowlistOnlyHandler(rules *contactRules) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req allowlistOnlyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		if err := rules.SetAllowlistOnly(req.Enabled); err != nil {
+			log.Println(err)
+			writeJSONError(w, http.StatusInternalServerError, "saving allowlist-only mode failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, contactRulesResponse{AllowlistOnly: req.Enabled, Rules: rules.Rules(time.Now())})
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	historyDefaultPeriod = 3 * 24 * time.Hour
+	historyMaxPeriod     = 90 * 24 * time.Hour
+	// historyMessageRunes is where a long message is cut off.
+	historyMessageRunes = 300
+	// A transcript is sent as up to historyMaxChunks messages of about
+	// historyChunkRunes each, and as a .txt document beyond that.
+	historyChunkRunes = 1500
+	historyMaxChunks  = 3
+)
+
+// parsePeriod accepts a number of days or hours, e.g. "3d" or "12h".
+func parsePeriod(s string) (time.Duration, error) {
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "h"):
+		unit = time.Hour
+	}
+	n, err := strconv.Atoi(s[:max(len(s)-1, 0)])
+	if unit == 0 || err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid period %q, expected e.g. 3d or 12h", s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+func parseHistoryPeriod(s string) (time.Duration, error) {
+	period, err := parsePeriod(s)
+	if err != nil || period <= historyMaxPeriod {
+		return period, err
+	}
+	return 0, fmt.Errorf("the period can be at most %d days", int(historyMaxPeriod.Hours()/24))
+}
+
+// formatHistoryLine renders one message, e.g.
+// "Mon 14 Oct 09:12 → two brownies please". Arrows point away from
+// whoever sent it: → from the customer, ← from us. Messages of ours that
+// didn't get through are marked, so they aren't read as sent.
+func formatHistoryLine(m exportMessage, loc *time.Location) string {
+	arrow := "←"
+	if m.Direction == transcriptInbound {
+		arrow = "→"
+	}
+	body := truncateRunes(strings.Join(strings.Fields(m.Body), " "), historyMessageRunes)
+	if m.Direction == transcriptOperator {
+		body = "(staff) " + body
+	}
+	switch m.Delivery {
+	case deliveryFailed:
+		body += " ✗ failed"
+	case deliveryQueued:
+		body += " ⏳ not sent yet"
+	}
+	return fmt.Sprintf("%s %s %s", m.At.In(loc).Format("Mon 02 Jan 15:04"), arrow, body)
+}
+
+// chunkLines joins lines into chunks of at most limit runes, breaking only
+// between lines; a single longer line gets a chunk of its own.
+func chunkLines(lines []string, limit int) []string {
+	var chunks, chunk []string
+	n := 0
+	for _, line := range lines {
+		size := len([]rune(line))
+		if len(chunk) > 0 && n+1+size > limit {
+			chunks = append(chunks, strings.Join(chunk, "\n"))
+			chunk, n = nil, 0
+		}
+		if len(chunk) > 0 {
+			n++
+		}
+		chunk = append(chunk, line)
+		n += size
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, strings.Join(chunk, "\n"))
+	}
+	return chunks
+}
+
+// adminHistory handles "history <number> [period]": a forwardable transcript
+// of the customer's recent messages, unredacted. Like every admin command
+// it is only recognised from ADMIN_NUMBER; anyone else gets the usual bot
+// reply.
+func adminHistory(cc *commandContext, args []string) string {
+	if len(args) < 1 || len(args) > 2 {
+		return "Usage: history <number> [days, e.g. 3d]"
+	}
+	cell, err := canonicalNumber(args[0])
+	if err != nil {
+		return err.Error()
+	}
+	period := historyDefaultPeriod
+	if len(args) == 2 {
+		if period, err = parseHistoryPeriod(strings.ToLower(args[1])); err != nil {
+			return err.Error()
+		}
+	}
+	jid, err := resolveJID(cell)
+	if err != nil {
+		return err.Error()
+	}
+	profile, err := getCustomerProfile(cc.db, cell)
+	if err != nil {
+		log.Printf("History of %s: reading profile failed: %v", cell, err)
+		return fmt.Sprintf("Reading the history of %s failed.", cell)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	now := time.Now()
+	rows, err := queryCustomerMessages(ctx, cc.db, cell, jid.String(), profile.LID, now.Add(-period))
+	if err != nil {
+		log.Printf("History of %s: reading messages failed: %v", cell, err)
+		return fmt.Sprintf("Reading the history of %s failed.", cell)
+	}
+	defer rows.Close()
+	loc := cfg().BusinessHours.Location
+	var lines []string
+	for rows.Next() {
+		var m exportMessage
+		if err := rows.Scan(&m.Direction, &m.Body, &m.At, &m.Delivery); err != nil {
+			log.Printf("History of %s: reading messages failed: %v", cell, err)
+			return fmt.Sprintf("Reading the history of %s failed.", cell)
+		}
+		if m.Body, err = openField(fieldMessageBody, m.Body); err != nil {
+			log.Printf("History of %s: reading messages failed: %v", cell, err)
+			return fmt.Sprintf("Reading the history of %s failed.", cell)
+		}
+		lines = append(lines, formatHistoryLine(m, loc))
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("History of %s: reading messages failed: %v", cell, err)
+		return fmt.Sprintf("Reading the history of %s failed.", cell)
+	}
+
+	days := formatPeriod(period)
+	if len(lines) == 0 {
+		return fmt.Sprintf("No messages with %s in the last %s.", cell, days)
+	}
+	header := fmt.Sprintf("Conversation with %s, last %s (%d messages; → from the customer, ← from us)", cell, days, len(lines))
+	chunks := chunkLines(append([]string{header, ""}, lines...), historyChunkRunes)
+	if len(chunks) > historyMaxChunks {
+		filename := fmt.Sprintf("history-%s-%s.txt", cell, now.In(loc).Format("20060102"))
+		body := header + "\n\n" + strings.Join(lines, "\n") + "\n"
+		err := sendAdminDocument(ctx, cc, []byte(body), filename, "text/plain", header)
+		if err == nil {
+			return ""
+		}
+		log.Printf("History of %s: sending document failed, sending it as messages: %v", cell, err)
+	}
+	for _, chunk := range chunks {
+		cc.sender.Send(cc.envVars.AdminNumber, chunk, priorityReply)
+	}
+	return ""
+}
+
+func formatPeriod(d time.Duration) string {
+	if d%(24*time.Hour) == 0 {
+		if days := int(d.Hours() / 24); days != 1 {
+			return fmt.Sprintf("%d days", days)
+		}
+		return "day"
+	}
+	if hours := int(d.Hours()); hours != 1 {
+		return fmt.Sprintf("%d hours", hours)
+	}
+	return "hour"
+}
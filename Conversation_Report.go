@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How each inbound customer message was handled, as recorded in the
+// conversation log.
+const (
+	convCommand       = "command"     // a web API customer command
+	convCheckout      = "checkout"    // checkout, including duplicates
+	convCart          = "cart"        // changed the cart
+	convUnavailable   = "unavailable" // asked for items that can't be ordered now
+	convFallback      = "fallback"    // MenuBotLib answered with the pricelist
+	convOther         = "other"       // anything else MenuBotLib answered
+	convEscalation    = "escalation"
+	convClosed        = "closed"
+	convSuggestion    = "suggestion"     // asked "did you mean" about a mistyped command
+	convExpiredChoice = "expired_choice" // tapped an option from an outdated menu
+	convRating        = "rating"         // rated a finished order
+	convQuestion      = "question"       // asked about a price, stock or opening hours in words
+	convGift          = "gift"           // answered the notice of a gift order
+	convReask         = "reask"          // answered a question so late it was asked again
+	convContact       = "contact"        // sent or confirmed a delivery contact card
+	convTooLong       = "too_long"       // sent a text over MAX_MESSAGE_LENGTH
+)
+
+const (
+	conversationReportLimit    = 20
+	conversationReportMaxLimit = 100
+	conversationSummaryItems   = 10
+	conversationSummaryWeekday = time.Monday
+	conversationSummaryHour    = 9
+)
+
+// customerCommandName returns the customer command msg invokes, or "".
+func customerCommandName(msg string) string {
+	for _, cmd := range customerCommands {
+		if _, ok := matchCommand(msg, cmd.name); ok {
+			return cmd.name
+		}
+	}
+	return ""
+}
+
+// recordConversation appends an inbound message to the conversation log.
+// The normalized text groups messages that differ only in case and
+// punctuation; with field encryption it is a hash, see fieldHash.
+func recordConversation(db *sql.DB, cell, body, kind, command string) {
+	sealed, err := sealField(fieldMessageBody, body)
+	if err == nil {
+		_, err = db.Exec(`INSERT INTO conversation_log (cell_number, body, normalized, kind, command) VALUES ($1, $2, $3, $4, $5)`,
+			cell, sealed, fieldHash(normalizeForMatch(body)), kind, command)
+	}
+	if err != nil {
+		log.Printf("Recording conversation message from %s failed: %v", cell, err)
+	}
+}
+
+// recordItemAdditions logs the quantity of each item the cart gained.
+func recordItemAdditions(db *sql.DB, cell string, orderID int64, before, after []orderLine) {
+	added := map[int]int{}
+	for _, line := range after {
+		added[line.ItemID] += line.Quantity
+	}
+	for _, line := range before {
+		added[line.ItemID] -= line.Quantity
+	}
+	for itemID, qty := range added {
+		if qty <= 0 {
+			continue
+		}
+		_, err := db.Exec(`INSERT INTO item_additions (item_id, quantity, cell_number, order_id) VALUES ($1, $2, $3, $4)`,
+			itemID, qty, cell, orderID)
+		if err != nil {
+			log.Printf("Recording addition of item %d to order %d failed: %v", itemID, orderID, err)
+		}
+	}
+}
+
+type commandCount struct {
+	Command   string `json:"command"`
+	Count     int64  `json:"count"`
+	Customers int64  `json:"customers"`
+}
+
+type itemCount struct {
+	ItemID    int    `json:"item_id"`
+	Name      string `json:"name,omitempty"`
+	Quantity  int64  `json:"quantity"`
+	Customers int64  `json:"customers"`
+	// Components lists what a combo contains, per unit.
+	Components []orderComponentDetail `json:"components,omitempty"`
+}
+
+type unansweredMessage struct {
+	Text      string `json:"text"`
+	Example   string `json:"example"`
+	Count     int64  `json:"count"`
+	Customers int64  `json:"customers"`
+}
+
+type conversationReport struct {
+	From       time.Time           `json:"from"`
+	To         time.Time           `json:"to"`
+	Messages   int64               `json:"messages"`
+	Commands   []commandCount      `json:"top_commands"`
+	Items      []itemCount         `json:"top_items"`
+	Unanswered []unansweredMessage `json:"top_unanswered"`
+}
+
+func buildConversationReport(db *sql.DB, vp versionedPricelist, from, to time.Time, limit int) (conversationReport, error) {
+	report := conversationReport{From: from, To: to, Commands: []commandCount{}, Items: []itemCount{}, Unanswered: []unansweredMessage{}}
+	err := db.QueryRow(`SELECT COUNT(*) FROM conversation_log WHERE received_at >= $1 AND received_at < $2`, from, to).Scan(&report.Messages)
+	if err != nil {
+		return report, err
+	}
+
+	rows, err := db.Query(`SELECT CASE WHEN kind = $3 THEN command ELSE kind END AS cmd, COUNT(*), COUNT(DISTINCT cell_number)
+		FROM conversation_log WHERE received_at >= $1 AND received_at < $2 AND kind IN ($3, $4)
+		GROUP BY cmd ORDER BY COUNT(*) DESC, cmd LIMIT $5`, from, to, convCommand, convCheckout, limit)
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var c commandCount
+		if err := rows.Scan(&c.Command, &c.Count, &c.Customers); err != nil {
+			rows.Close()
+			return report, err
+		}
+		report.Commands = append(report.Commands, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	rows, err = db.Query(`SELECT item_id, SUM(quantity), COUNT(DISTINCT cell_number) FROM item_additions
+		WHERE added_at >= $1 AND added_at < $2
+		GROUP BY item_id ORDER BY SUM(quantity) DESC, item_id LIMIT $3`, from, to, limit)
+	if err != nil {
+		return report, err
+	}
+	for rows.Next() {
+		var c itemCount
+		if err := rows.Scan(&c.ItemID, &c.Quantity, &c.Customers); err != nil {
+			rows.Close()
+			return report, err
+		}
+		if item, ok := vp.Item(c.ItemID); ok {
+			c.Name = ctlgItemName(item)
+		}
+		for _, part := range vp.Combos[c.ItemID] {
+			c.Components = append(c.Components, orderComponentDetail{ItemID: part.ItemID, Name: vp.itemName(part.ItemID), Quantity: part.Quantity})
+		}
+		report.Items = append(report.Items, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+
+	rows, err = db.Query(`SELECT normalized, MIN(body), COUNT(*), COUNT(DISTINCT cell_number) FROM conversation_log
+		WHERE received_at >= $1 AND received_at < $2 AND kind = $3 AND normalized <> ''
+		GROUP BY normalized ORDER BY COUNT(*) DESC, normalized LIMIT $4`, from, to, convFallback, limit)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m unansweredMessage
+		if err := rows.Scan(&m.Text, &m.Example, &m.Count, &m.Customers); err != nil {
+			return report, err
+		}
+		if m.Example, err = openField(fieldMessageBody, m.Example); err != nil {
+			return report, err
+		}
+		m.Text = normalizeForMatch(m.Example)
+		report.Unanswered = append(report.Unanswered, m)
+	}
+	return report, rows.Err()
+}
+
+// ConversationReportHandler serves GET /api/reports/conversations?from=&to=&limit=,
+// defaulting to the last 7 days and 20 rows per list.
+func ConversationReportHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		from, err := parseReportTime(r.URL.Query().Get("from"), now.AddDate(0, 0, -7))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "from: "+err.Error())
+			return
+		}
+		to, err := parseReportTime(r.URL.Query().Get("to"), now)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "to: "+err.Error())
+			return
+		}
+		limit := conversationReportLimit
+		if raw := r.URL.Query().Get("limit"); raw != "" {
+			if limit, err = strconv.Atoi(raw); err != nil || limit < 1 || limit > conversationReportMaxLimit {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", conversationReportMaxLimit))
+				return
+			}
+		}
+		report, err := buildConversationReport(db, prclist.Snapshot(), from, to, limit)
+		if err != nil {
+			log.Printf("Building conversation report failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "building report failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// conversationSummary is the weekly WhatsApp version of the report.
+// Customers' links are stripped from the examples.
+func conversationSummary(report conversationReport) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Conversations this week: %d messages.", report.Messages)
+	if len(report.Items) > 0 {
+		b.WriteString("\n\nMost added items:")
+		for i, item := range report.Items[:min(len(report.Items), conversationSummaryItems)] {
+			name := item.Name
+			if name == "" {
+				name = itemRef(item.ItemID)
+			}
+			fmt.Fprintf(&b, "\n%d. %s x%d", i+1, name, item.Quantity)
+			if len(item.Components) > 0 {
+				b.WriteString(" (combo)")
+			}
+		}
+	}
+	if len(report.Unanswered) > 0 {
+		b.WriteString("\n\nMessages the bot didn't understand:")
+		for i, m := range report.Unanswered[:min(len(report.Unanswered), conversationSummaryItems)] {
+			text := strings.TrimSpace(linkPattern.ReplaceAllString(m.Example, "[link]"))
+			fmt.Fprintf(&b, "\n%d. \"%s\" x%d", i+1, truncateRunes(text, 80), m.Count)
+		}
+	}
+	return b.String()
+}
+
+// sendConversationSummaries sends the admin last week's summary, as a
+// Monday morning job.
+func sendConversationSummaries(cc *commandContext) error {
+	now := time.Now()
+	report, err := buildConversationReport(cc.db, cc.prclist.Snapshot(), now.AddDate(0, 0, -7), now, conversationSummaryItems)
+	if err != nil {
+		return fmt.Errorf("building weekly conversation summary: %w", err)
+	}
+	if report.Messages > 0 {
+		cc.sendBulk(bulkMessage{Recipient: cc.envVars.AdminNumber, Text: conversationSummary(report), Kind: bulkAdmin})
+	}
+	return nil
+}
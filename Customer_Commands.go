@@ -0,0 +1,35 @@
+package main
+
+type customerCommand struct {
+	name string
+	run  func(cc *commandContext, sender string, args []string) string
+}
+
+// customerCommands are handled by the web API itself rather than passed to
+// MenuBotLib.
+var customerCommands = []customerCommand{
+	{name: "cancel order", run: customerCancelOrder},
+	{name: "status", run: customerStatus},
+	{name: "notify me", run: customerNotifyMe},
+	{name: "remove", run: customerRemoveItem},
+	{name: "change", run: customerChangeItem},
+	{name: "edit", run: customerEditOrder},
+	{name: "repeat", run: customerRepeat},
+	{name: "show", run: customerShowItem},
+	{name: "points", run: customerPoints},
+	{name: "redeem", run: customerRedeem},
+	{name: "refer", run: customerRefer},
+	{name: "ref", run: customerRef},
+	{name: "gift", run: customerGift},
+	{name: "my name", run: customerMyName},
+	{name: "email", run: customerEmail},
+}
+
+func handleCustomerCommand(cc *commandContext, sender, msg string) (reply string, ok bool) {
+	for _, cmd := range customerCommands {
+		if args, ok := matchCommand(msg, cmd.name); ok {
+			return cmd.run(cc, sender, args), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// A customer's display name is the one WhatsApp has for them, the same
+// contactName the merge suggestions use, until they set one themselves
+// with "my name". It is copied in when whatsmeow sees their push name or
+// a contact change, and each night from its whole contact store to catch
+// what was missed while disconnected. A name the customer set is never
+// replaced by one from WhatsApp. Names are only kept for customers we
+// already know, keyed the way their messages are, so a LID sender's name
+// lives on the LID's profile and moves with it when it is linked or
+// merged.
+
+const (
+	nameSourceWhatsApp = "whatsapp"
+	nameSourceCustomer = "customer"
+
+	maxDisplayName       = 60
+	customerNameSyncHour = 4
+
+	customerDirectoryLimit    = 50
+	customerDirectoryMaxLimit = 200
+)
+
+// takeIncomingName is the SQL condition under which a profile being
+// folded into another (incoming) brings its name along: the current one
+// has none, or the incoming one was set by the customer and the current
+// one wasn't.
+func takeIncomingName(current, incoming string) string {
+	return fmt.Sprintf(`(%[2]s.display_name <> '' AND (%[1]s.display_name = ''
+		OR (%[2]s.name_source = '%[3]s' AND %[1]s.name_source <> '%[3]s')))`, current, incoming, nameSourceCustomer)
+}
+
+// cleanDisplayName trims a name and cuts it to maxDisplayName characters.
+func cleanDisplayName(name string) string {
+	name = strings.Join(strings.Fields(name), " ")
+	if utf8.RuneCountInString(name) > maxDisplayName {
+		name = strings.TrimSpace(string([]rune(name)[:maxDisplayName]))
+	}
+	return name
+}
+
+// syncCustomerName records name as the WhatsApp name of the customer
+// chatting as jid. It reports whether the profile changed.
+func syncCustomerName(db *sql.DB, jid types.JID, name string) (bool, error) {
+	jid = jid.ToNonAD()
+	name = cleanDisplayName(name)
+	if name == "" || (jid.Server != types.DefaultUserServer && !isLID(jid)) {
+		return false, nil
+	}
+	key := chatCustomerKey(db, jid)
+	if known, err := knownCustomer(db, key); err != nil || !known {
+		return false, err
+	}
+	var lid sql.NullString
+	if strings.HasSuffix(key, "@"+types.HiddenUserServer) {
+		lid = sql.NullString{String: key, Valid: true}
+	}
+	res, err := db.Exec(`INSERT INTO customer_profiles (cell_number, lid, display_name, name_source) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (cell_number) DO UPDATE SET display_name = EXCLUDED.display_name, name_source = EXCLUDED.name_source, updated_at = now()
+		WHERE customer_profiles.name_source <> $5 AND customer_profiles.merged_into IS NULL
+			AND customer_profiles.display_name <> EXCLUDED.display_name`,
+		key, lid, name, nameSourceWhatsApp, nameSourceCustomer)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// syncContactName copies the name whatsmeow now has for jid, or fallback
+// while its contact store can't be read. It is called on push name and
+// contact events, after whatsmeow has stored the change.
+func (cc *commandContext) syncContactName(jid types.JID, fallback string) {
+	name := fallback
+	if cc.client != nil && cc.client.Contacts() != nil {
+		if contact, err := cc.client.Contacts().GetContact(jid); err != nil {
+			log.Printf("Reading WhatsApp contact %s failed: %v", jid, err)
+		} else if n := contactName(contact); n != "" {
+			name = n
+		}
+	}
+	if changed, err := syncCustomerName(cc.db, jid, name); err != nil {
+		log.Printf("Saving the WhatsApp name of %s failed: %v", jid, err)
+	} else if changed {
+		metrics.Inc("menubot_customer_names_synced_total", "Customer display names copied from WhatsApp.")
+	}
+}
+
+// reconcileCustomerNames is the nightly pass over whatsmeow's contacts.
+func reconcileCustomerNames(cc *commandContext) error {
+	if cc.client == nil || cc.client.Contacts() == nil {
+		return nil
+	}
+	contacts, err := cc.client.Contacts().GetAllContacts()
+	if err != nil {
+		return fmt.Errorf("reading WhatsApp contacts: %w", err)
+	}
+	var updated int
+	for jid, contact := range contacts {
+		changed, err := syncCustomerName(cc.db, jid, contactName(contact))
+		if err != nil {
+			return fmt.Errorf("saving the name of %s: %w", jid, err)
+		}
+		if changed {
+			updated++
+		}
+	}
+	if updated > 0 {
+		metrics.Add("menubot_customer_names_synced_total", "Customer display names copied from WhatsApp.", float64(updated))
+		log.Printf("Updated %d customer names from %d WhatsApp contacts", updated, len(contacts))
+	}
+	return nil
+}
+
+// customerMyName handles "my name" and "my name is <name>".
+func customerMyName(cc *commandContext, sender string, args []string) string {
+	if len(args) > 0 && strings.EqualFold(args[0], "is") {
+		args = args[1:]
+	}
+	name := cleanDisplayName(strings.Join(args, " "))
+	if name == "" {
+		var current string
+		err := cc.db.QueryRow(`SELECT display_name FROM customer_profiles WHERE cell_number = $1`, sender).Scan(&current)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("My name: reading the name of %s failed: %v", sender, err)
+		}
+		if current == "" {
+			return `We don't have a name for you. Send "my name is" and your name to set one.`
+		}
+		return fmt.Sprintf(`We have you as %s. Send "my name is" and a new name to change it.`, current)
+	}
+	_, err := cc.db.Exec(`INSERT INTO customer_profiles (cell_number, display_name, name_source) VALUES ($1, $2, $3)
+		ON CONFLICT (cell_number) DO UPDATE SET display_name = EXCLUDED.display_name, name_source = EXCLUDED.name_source, updated_at = now()`,
+		sender, name, nameSourceCustomer)
+	if err != nil {
+		return cc.apology(incidentNameSave, sender, 0, err, "My name: saving the name",
+			"Sorry, something went wrong saving your name. Please try again.")
+	}
+	return fmt.Sprintf("Thanks, %s! We'll use that name from now on.", name)
+}
+
+type directoryCustomer struct {
+	Cell       string `json:"cell"`
+	LID        string `json:"lid,omitempty"`
+	Name       string `json:"name"`
+	NameSource string `json:"name_source,omitempty"`
+	Tier       string `json:"tier"`
+	Orders     int    `json:"orders"`
+}
+
+type customerDirectory struct {
+	Customers []directoryCustomer `json:"customers"`
+	Total     int                 `json:"total"`
+	Limit     int                 `json:"limit"`
+	Offset    int                 `json:"offset"`
+}
+
+// directorySearch is the WHERE condition and argument for q: digits match
+// the end of the number, anything else part of the name.
+func directorySearch(q string) (string, any) {
+	digits := strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9':
+			return r
+		case r == '+' || r == ' ' || r == '-':
+			return -1
+		}
+		return 'x'
+	}, q)
+	if digits != "" && !strings.Contains(digits, "x") {
+		return `c.cell LIKE '%' || $1`, digits
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(q)
+	return `COALESCE(p.display_name, '') ILIKE '%' || $1 || '%'`, escaped
+}
+
+// listCustomers returns a page of the customers we know, named ones first
+// by name. Merged profiles are left out; their customer is listed under
+// the primary.
+func listCustomers(db *sql.DB, q string, limit, offset int) (customerDirectory, error) {
+	dir := customerDirectory{Customers: []directoryCustomer{}, Limit: limit, Offset: offset}
+	where, arg := "true", any("")
+	if q = strings.TrimSpace(q); q != "" {
+		where, arg = directorySearch(q)
+	}
+	rows, err := db.Query(`WITH customers AS (
+			SELECT cell_number AS cell FROM customer_profiles WHERE merged_into IS NULL
+			UNION SELECT `+orderCellColumn+` FROM `+orderTable+`
+		)
+		SELECT c.cell, COALESCE(p.lid, ''), COALESCE(p.display_name, ''), COALESCE(p.name_source, ''), COALESCE(p.tier, $2),
+			(SELECT count(*) FROM `+orderTable+` o WHERE o.`+orderCellColumn+` = c.cell), count(*) OVER ()
+		FROM customers c LEFT JOIN customer_profiles p ON p.cell_number = c.cell
+		WHERE p.merged_into IS NULL AND ($1 = '' OR `+where+`)
+		ORDER BY COALESCE(p.display_name, '') = '', lower(COALESCE(p.display_name, '')), c.cell
+		LIMIT $3 OFFSET $4`, arg, retailTier, limit, offset)
+	if err != nil {
+		return dir, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c directoryCustomer
+		if err := rows.Scan(&c.Cell, &c.LID, &c.Name, &c.NameSource, &c.Tier, &c.Orders, &dir.Total); err != nil {
+			return dir, err
+		}
+		if c.LID == c.Cell {
+			c.LID = ""
+		}
+		dir.Customers = append(dir.Customers, c)
+	}
+	return dir, rows.Err()
+}
+
+// pageParam reads an optional non-negative integer query parameter.
+func pageParam(r *http.Request, name string, def, max int) (int, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 || (max > 0 && n > max) {
+		if max > 0 {
+			return 0, fmt.Errorf("%s must be between 0 and %d", name, max)
+		}
+		return 0, fmt.Errorf("%s must be a whole number", name)
+	}
+	return n, nil
+}
+
+// ListCustomersHandler serves GET /api/users?q=&limit=&offset=, the
+// dashboard's customer lookup. q is a number suffix or part of a name.
+func ListCustomersHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, err := pageParam(r, "limit", customerDirectoryLimit, customerDirectoryMaxLimit)
+		if err == nil && limit == 0 {
+			err = fmt.Errorf("limit must be between 1 and %d", customerDirectoryMaxLimit)
+		}
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		offset, err := pageParam(r, "offset", 0, 0)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		dir, err := listCustomers(db, r.URL.Query().Get("q"), limit, offset)
+		if err != nil {
+			log.Printf("Listing customers failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "listing customers failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, dir)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// customerExportFormat versions the export document. Field names are part
+// of the format; renaming one means bumping it.
+const customerExportFormat = 1
+
+// exportOutbound is the direction of the bot's own messages in the export;
+// the others are the takeover transcript's.
+const exportOutbound = "out"
+
+type customerProfile struct {
+	Tier         string     `json:"tier"`
+	Name         string     `json:"name,omitempty"`
+	Email        string     `json:"email,omitempty"`
+	LID          string     `json:"lid,omitempty"`
+	ReferralCode string     `json:"referral_code,omitempty"`
+	ReferredBy   string     `json:"referred_by,omitempty"`
+	AdSource     string     `json:"ad_source,omitempty"`
+	AdTitle      string     `json:"ad_title,omitempty"`
+	UpdatedAt    *time.Time `json:"updated_at,omitempty"`
+}
+
+type exportPayment struct {
+	PfPaymentID string     `json:"pf_payment_id,omitempty"`
+	Mode        string     `json:"mode,omitempty"`
+	PaidAt      *time.Time `json:"paid_at,omitempty"`
+	Discount    float64    `json:"loyalty_discount,omitempty"`
+}
+
+type exportOrder struct {
+	ID         int64           `json:"id"`
+	Total      string          `json:"total"`
+	Status     string          `json:"status"`
+	Fulfilment string          `json:"fulfilment,omitempty"`
+	Slot       string          `json:"slot,omitempty"`
+	Notes      string          `json:"notes,omitempty"`
+	Lines      []orderLine     `json:"lines"`
+	Options    json.RawMessage `json:"options"`
+	Payment    exportPayment   `json:"payment"`
+}
+
+type exportMessage struct {
+	Direction string    `json:"direction"`
+	Body      string    `json:"body"`
+	At        time.Time `json:"at"`
+	// Delivery is how far a message we sent got, see deliveryQueued.
+	Delivery string `json:"delivery,omitempty"`
+}
+
+func getCustomerProfile(db *sql.DB, cell string) (customerProfile, error) {
+	p := customerProfile{Tier: retailTier}
+	var updated sql.NullTime
+	err := db.QueryRow(`SELECT tier, display_name, email, COALESCE(lid, ''), ad_source, ad_title, updated_at FROM customer_profiles WHERE cell_number = $1`,
+		cell).Scan(&p.Tier, &p.Name, &p.Email, &p.LID, &p.AdSource, &p.AdTitle, &updated)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return p, err
+	}
+	if p.Email, err = openField(fieldEmail, p.Email); err != nil {
+		return p, err
+	}
+	if updated.Valid {
+		p.UpdatedAt = &updated.Time
+	}
+	err = db.QueryRow(`SELECT COALESCE((SELECT code FROM referral_codes WHERE cell_number = $1), ''),
+		COALESCE((SELECT referrer_cell FROM referrals WHERE referred_cell = $1), '')`, cell).Scan(&p.ReferralCode, &p.ReferredBy)
+	return p, err
+}
+
+// exportWriter writes the export as one JSON object, field by field, so
+// the orders and messages can be streamed from the database instead of
+// being held in memory.
+type exportWriter struct {
+	w      *bufio.Writer
+	fields int
+	err    error
+}
+
+func (e *exportWriter) raw(s string) {
+	if e.err == nil {
+		_, e.err = e.w.WriteString(s)
+	}
+}
+
+func (e *exportWriter) value(v any) {
+	if e.err != nil {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		e.err = err
+		return
+	}
+	_, e.err = e.w.Write(b)
+}
+
+func (e *exportWriter) key(name string) {
+	if e.fields > 0 {
+		e.raw(",")
+	}
+	e.fields++
+	e.value(name)
+	e.raw(":")
+}
+
+func (e *exportWriter) field(name string, v any) {
+	e.key(name)
+	e.value(v)
+}
+
+// array streams rows as a JSON array, calling scan for each element.
+func (e *exportWriter) array(name string, rows *sql.Rows, scan func(*sql.Rows) (any, error)) {
+	defer rows.Close()
+	e.key(name)
+	e.raw("[")
+	for n := 0; e.err == nil && rows.Next(); n++ {
+		v, err := scan(rows)
+		if err != nil {
+			e.err = err
+			return
+		}
+		if n > 0 {
+			e.raw(",")
+		}
+		e.value(v)
+	}
+	if e.err == nil {
+		e.err = rows.Err()
+	}
+	e.raw("]")
+}
+
+func scanExportOrder(rows *sql.Rows) (any, error) {
+	var o exportOrder
+	var items string
+	var paidAt sql.NullTime
+	var options string
+	err := rows.Scan(&o.ID, &o.Total, &o.Status, &o.Fulfilment, &o.Slot, &o.Notes, &items, &options,
+		&o.Payment.PfPaymentID, &o.Payment.Mode, &paidAt, &o.Payment.Discount)
+	if err != nil {
+		return nil, err
+	}
+	if paidAt.Valid {
+		o.Payment.PaidAt = &paidAt.Time
+	}
+	if o.Notes, err = openField(fieldOrderNotes, o.Notes); err != nil {
+		return nil, err
+	}
+	if o.Lines, err = decodeOrderLines(items); err != nil {
+		return nil, fmt.Errorf("order %d: %w", o.ID, err)
+	}
+	if o.Lines == nil {
+		o.Lines = []orderLine{}
+	}
+	o.Options = json.RawMessage(options)
+	return o, nil
+}
+
+func scanExportMessage(rows *sql.Rows) (any, error) {
+	var m exportMessage
+	err := rows.Scan(&m.Direction, &m.Body, &m.At, &m.Delivery)
+	if err == nil {
+		m.Body, err = openField(fieldMessageBody, m.Body)
+	}
+	return m, err
+}
+
+// queryCustomerMessages selects direction, body, time and delivery state
+// of the messages exchanged with cell since the given time, oldest first. Messages outside
+// a takeover are in the conversation log, those during one in the takeover
+// transcript, so together they cover every inbound message once.
+func queryCustomerMessages(ctx context.Context, db *sql.DB, cell, jid, lid string, since time.Time) (*sql.Rows, error) {
+	return db.QueryContext(ctx, `SELECT direction, body, at, delivery FROM (
+			SELECT $3 AS direction, body, received_at AS at, '' AS delivery, 0 AS src FROM conversation_log WHERE cell_number = $1
+			UNION ALL
+			SELECT direction, body, received_at, '', 1 FROM takeover_transcript WHERE cell_number = $1
+			UNION ALL
+			SELECT $4, body, server_time, delivery_state, 2 FROM outbound_messages WHERE recipient IN ($2, $5)
+		) t WHERE at >= $6 ORDER BY at, src`, cell, jid, transcriptInbound, exportOutbound, lid, since)
+}
+
+// writeCustomerExport writes everything held about cell to w: profile,
+// marketing consent, loyalty, orders with their lines and payments, gifts
+// sent and received, and the messages exchanged. There are no favorites to export; the bot
+// doesn't keep any.
+func writeCustomerExport(ctx context.Context, w io.Writer, db *sql.DB, cell string) error {
+	jid, err := resolveJID(cell)
+	if err != nil {
+		return err
+	}
+	profile, err := getCustomerProfile(db, cell)
+	if err != nil {
+		return fmt.Errorf("reading profile: %w", err)
+	}
+	consent, err := getConsent(db, cell)
+	if err != nil {
+		return fmt.Errorf("reading consent: %w", err)
+	}
+	loyalty, err := getLoyaltyAccount(db, cell, math.MaxInt32)
+	if err != nil {
+		return fmt.Errorf("reading loyalty: %w", err)
+	}
+
+	e := &exportWriter{w: bufio.NewWriter(w)}
+	e.raw("{")
+	e.field("format", customerExportFormat)
+	e.field("exported_at", time.Now().UTC())
+	e.field("cell_number", cell)
+	e.field("profile", profile)
+	e.field("consent", consent)
+	e.field("loyalty", loyalty)
+
+	rows, err := db.QueryContext(ctx, `SELECT o.`+orderIDColumn+`, COALESCE(o.`+orderTotalColumn+`::text, ''),
+			COALESCE(m.status, '`+statusUnpaid+`'), COALESCE(m.fulfilment, ''), COALESCE(m.slot, ''),
+			CASE WHEN EXISTS (SELECT 1 FROM gift_orders g WHERE g.order_id = o.`+orderIDColumn+`) THEN '' ELSE COALESCE(m.notes, '') END,
+			COALESCE(o.`+orderItemsColumn+`::text, ''),
+			(SELECT COALESCE(json_agg(json_build_object('item_id', l.item_id, 'options', l.options) ORDER BY l.id), '[]')::text
+				FROM order_line_options l WHERE l.order_id = o.`+orderIDColumn+`),
+			COALESCE(m.pf_payment_id, ''), COALESCE(m.payment_mode, ''), m.paid_at,
+			COALESCE(r.discount, 0)
+		FROM `+orderTable+` o LEFT JOIN order_meta m ON m.order_id = o.`+orderIDColumn+`
+			LEFT JOIN loyalty_redemptions r ON r.order_id = o.`+orderIDColumn+` AND r.state = $2
+		WHERE o.`+orderCellColumn+` = $1 ORDER BY o.`+orderIDColumn, cell, redemptionConsumed)
+	if err != nil {
+		return fmt.Errorf("reading orders: %w", err)
+	}
+	e.array("orders", rows, scanExportOrder)
+
+	rows, err = queryCustomerGifts(ctx, db, cell)
+	if err != nil {
+		return fmt.Errorf("reading gifts: %w", err)
+	}
+	e.array("gifts", rows, scanExportGift)
+
+	rows, err = queryCustomerMessages(ctx, db, cell, jid.String(), profile.LID, time.Time{})
+	if err != nil {
+		return fmt.Errorf("reading messages: %w", err)
+	}
+	e.array("messages", rows, scanExportMessage)
+	e.raw("}\n")
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// CustomerExportHandler serves GET /api/users/{cell}/export. The body is
+// streamed, so a failure part way through can only be seen as a truncated
+// document and in the log.
+func CustomerExportHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cell, err := canonicalNumber(chi.URLParam(r, "cell"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, customerExportFilename(cell)))
+		cw := &countingWriter{w: w}
+		if err := writeCustomerExport(r.Context(), cw, db, cell); err != nil {
+			log.Printf("Exporting customer %s failed: %v", cell, err)
+			if cw.n == 0 {
+				w.Header().Del("Content-Disposition")
+				writeJSONError(w, http.StatusInternalServerError, "exporting customer failed")
+			}
+		}
+	}
+}
+
+// countingWriter tells whether anything has been written yet, i.e.
+// whether an error can still be reported with a status code.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func customerExportFilename(cell string) string {
+	return fmt.Sprintf("customer-%s-%s.json", cell, time.Now().Format("20060102"))
+}
+
+// adminExport handles "export <number>", replying with the customer's
+// export as a JSON document.
+func adminExport(cc *commandContext, args []string) string {
+	if len(args) != 1 {
+		return "Usage: export <number>"
+	}
+	cell, err := canonicalNumber(args[0])
+	if err != nil {
+		return err.Error()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var buf bytes.Buffer
+	if err := writeCustomerExport(ctx, &buf, cc.db, cell); err != nil {
+		log.Printf("Exporting customer %s failed: %v", cell, err)
+		return fmt.Sprintf("Exporting %s failed: %v", cell, err)
+	}
+
+	if err := sendAdminDocument(ctx, cc, buf.Bytes(), customerExportFilename(cell), "application/json", "Export of "+cell); err != nil {
+		log.Printf("Sending export of %s failed: %v", cell, err)
+		return "Couldn't send the export. It is also available from the web API."
+	}
+	return ""
+}
+
+// sendAdminDocument uploads data and sends it to ADMIN_NUMBER as a
+// document.
+func sendAdminDocument(ctx context.Context, cc *commandContext, data []byte, filename, mimetype, caption string) error {
+	up, err := cc.client.Upload(ctx, data, whatsmeow.MediaDocument)
+	if err != nil {
+		return fmt.Errorf("uploading: %w", err)
+	}
+	doc := &waProto.DocumentMessage{
+		URL:           proto.String(up.URL),
+		DirectPath:    proto.String(up.DirectPath),
+		MediaKey:      up.MediaKey,
+		Mimetype:      proto.String(mimetype),
+		Title:         proto.String(filename),
+		FileName:      proto.String(filename),
+		FileEncSHA256: up.FileEncSHA256,
+		FileSHA256:    up.FileSHA256,
+		FileLength:    proto.Uint64(up.FileLength),
+		Caption:       proto.String(caption),
+	}
+	to, err := resolveJID(cc.envVars.AdminNumber)
+	if err != nil {
+		return err
+	}
+	return cc.sender.SendDocument(to, doc, priorityReply)
+}
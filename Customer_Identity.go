@@ -0,0 +1,251 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// WhatsApp shows some senders by LID (the hidden-number "@lid" JID)
+// instead of their phone number. Such a customer is keyed on the full LID
+// string, e.g. "123456789012345@lid", until the LID is linked to a number;
+// linking moves everything recorded under the LID to the number. The LID
+// is kept on the customer's profile either way.
+//
+// The whatsmeow version in use has no LID to number map of its own. The
+// only place it reveals both is a group's participant list, so LIDs are
+// resolved from there when a message arrives in a group, and otherwise by
+// the admin "link" command.
+
+// customerKeyColumns are the app columns holding a customer's number that
+// a link or merge rewrites. MenuBotLib's order table is included; any other state
+// the library keeps per number stays with the LID.
+var customerKeyColumns = []struct{ table, column string }{
+	{orderTable, orderCellColumn},
+	{"cancellation_requests", "cell_number"},
+	{"loyalty_ledger", "cell_number"},
+	{"loyalty_redemptions", "cell_number"},
+	{"referrals", "referrer_cell"},
+	{"funnel_events", "cell_number"},
+	{"takeover_transcript", "cell_number"},
+	{"conversation_log", "cell_number"},
+	{"item_additions", "cell_number"},
+	{"order_ratings", "cell_number"},
+	{"gift_orders", "payer_cell"},
+	{"gift_orders", "recipient_cell"},
+	{"pending_prompts", "cell"},
+}
+
+// customerUniqueColumns also hold a number but allow one row per customer.
+// A row the number already has wins over the LID's.
+var customerUniqueColumns = []struct{ table, column string }{
+	{"referral_codes", "cell_number"},
+	{"referrals", "referred_cell"},
+	{"takeovers", "cell_number"},
+}
+
+func isLID(jid types.JID) bool {
+	return jid.Server == types.HiddenUserServer
+}
+
+// parseLID accepts a LID as "123456789012345@lid" or just its digits.
+func parseLID(s string) (types.JID, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "@") {
+		s += "@" + types.HiddenUserServer
+	}
+	jid, err := types.ParseJID(s)
+	if err != nil || !isLID(jid) || jid.User == "" {
+		return types.JID{}, fmt.Errorf("invalid LID %q", s)
+	}
+	return jid.ToNonAD(), nil
+}
+
+// linkedNumber returns the number a LID has been linked to, if any.
+func linkedNumber(db *sql.DB, lid string) (string, bool, error) {
+	var cell string
+	err := db.QueryRow(`SELECT cell_number FROM customer_profiles WHERE lid = $1 AND cell_number <> lid`, lid).Scan(&cell)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	return cell, err == nil, err
+}
+
+// groupInfoSource is the part of the WhatsApp client LIDs are resolved
+// with.
+type groupInfoSource interface {
+	GetGroupInfo(jid types.JID) (*types.GroupInfo, error)
+}
+
+// groupPhoneNumber looks the LID sender up in the group's participant list.
+func groupPhoneNumber(client groupInfoSource, group, lid types.JID) (string, error) {
+	info, err := client.GetGroupInfo(group)
+	if err != nil {
+		return "", err
+	}
+	for _, p := range info.Participants {
+		if p.LID == lid && p.JID.Server == types.DefaultUserServer {
+			return p.JID.User, nil
+		}
+	}
+	return "", nil
+}
+
+// customerKey is the customer identifier for a message's sender: their
+// phone number, or their LID while it can't be resolved to one, or the
+// customer either was merged into.
+func customerKey(db *sql.DB, client groupInfoSource, info types.MessageInfo) string {
+	return mergedInto(db, senderKey(db, client, info))
+}
+
+func senderKey(db *sql.DB, client groupInfoSource, info types.MessageInfo) string {
+	sender := info.Sender.ToNonAD()
+	if !isLID(sender) {
+		return sender.User
+	}
+	lid := sender.String()
+	cell, found, err := linkedNumber(db, lid)
+	if err != nil {
+		log.Printf("Looking up LID %s failed: %v", lid, err)
+		return lid
+	}
+	if found {
+		return cell
+	}
+	if info.IsGroup && client != nil {
+		if cell, err := groupPhoneNumber(client, info.Chat, sender); err != nil {
+			log.Printf("Resolving LID %s from group %s failed: %v", lid, info.Chat, err)
+		} else if cell != "" {
+			if err := linkCustomer(db, lid, cell); err != nil {
+				log.Printf("Linking LID %s to %s failed: %v", lid, cell, err)
+				return lid
+			}
+			log.Printf("Linked LID %s to %s from group %s", lid, cell, info.Chat)
+			return cell
+		}
+	}
+	_, err = db.Exec(`INSERT INTO customer_profiles (cell_number, lid) VALUES ($1, $1) ON CONFLICT DO NOTHING`, lid)
+	if err != nil {
+		log.Printf("Saving profile of LID %s failed: %v", lid, err)
+	}
+	return lid
+}
+
+// chatCustomerKey is customerKey for a one-to-one chat, without trying to
+// resolve or record a LID. It's for messages the shop sends itself.
+func chatCustomerKey(db *sql.DB, chat types.JID) string {
+	if !isLID(chat) {
+		return mergedInto(db, chat.User)
+	}
+	lid := chat.String()
+	if cell, found, err := linkedNumber(db, lid); err == nil && found {
+		return cell
+	}
+	return mergedInto(db, lid)
+}
+
+// mergedInto returns the customer key was merged into, or key itself.
+func mergedInto(db *sql.DB, key string) string {
+	var primary string
+	err := db.QueryRow(`SELECT merged_into FROM customer_profiles WHERE cell_number = $1 AND merged_into IS NOT NULL`, key).Scan(&primary)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Looking up merge of %s failed: %v", key, err)
+		}
+		return key
+	}
+	return primary
+}
+
+// linkCustomer records that lid is cell and moves what was recorded under
+// the LID to the number. A profile the number already has keeps its tier
+// and consent, its email if it has one, and its name unless the LID's was
+// set by the customer; the consent log stays under the LID.
+func linkCustomer(db *sql.DB, lid, cell string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	tier := retailTier
+	var optedIn bool
+	var name, nameSource, email string
+	err = tx.QueryRow(`SELECT tier, opted_in, display_name, name_source, email FROM customer_profiles WHERE cell_number = $1`,
+		lid).Scan(&tier, &optedIn, &name, &nameSource, &email)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("reading LID profile: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM customer_profiles WHERE cell_number = $1`, lid); err != nil {
+		return fmt.Errorf("removing LID profile: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE customer_profiles SET lid = NULL WHERE lid = $1`, lid); err != nil {
+		return fmt.Errorf("unlinking LID: %w", err)
+	}
+	_, err = tx.Exec(`INSERT INTO customer_profiles (cell_number, tier, lid, opted_in, display_name, name_source, email) VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (cell_number) DO UPDATE SET lid = EXCLUDED.lid,
+			display_name = CASE WHEN `+takeIncomingName("customer_profiles", "EXCLUDED")+` THEN EXCLUDED.display_name ELSE customer_profiles.display_name END,
+			name_source = CASE WHEN `+takeIncomingName("customer_profiles", "EXCLUDED")+` THEN EXCLUDED.name_source ELSE customer_profiles.name_source END,
+			email = CASE WHEN customer_profiles.email = '' THEN EXCLUDED.email ELSE customer_profiles.email END,
+			updated_at = now()`, cell, tier, lid, optedIn, name, nameSource, email)
+	if err != nil {
+		return fmt.Errorf("saving profile: %w", err)
+	}
+
+	if _, err := moveCustomerRows(tx, lid, cell); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// moveCustomerRows moves what is recorded under from to to, and returns
+// how many rows of each table moved.
+func moveCustomerRows(tx *sql.Tx, from, to string) (map[string]int64, error) {
+	moved := map[string]int64{}
+	for _, c := range customerUniqueColumns {
+		_, err := tx.Exec(`DELETE FROM `+c.table+` WHERE `+c.column+` = $1
+			AND EXISTS (SELECT 1 FROM `+c.table+` WHERE `+c.column+` = $2)`, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("merging %s: %w", c.table, err)
+		}
+	}
+	for _, c := range append(customerKeyColumns, customerUniqueColumns...) {
+		res, err := tx.Exec(`UPDATE `+c.table+` SET `+c.column+` = $2 WHERE `+c.column+` = $1`, from, to)
+		if err != nil {
+			return nil, fmt.Errorf("merging %s: %w", c.table, err)
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			moved[c.table] += n
+		}
+	}
+	// Someone who referred their own other number has now referred
+	// themselves.
+	if _, err := tx.Exec(`DELETE FROM referrals WHERE referred_cell = $1 AND referrer_cell = $1`, to); err != nil {
+		return nil, fmt.Errorf("merging referrals: %w", err)
+	}
+	return moved, nil
+}
+
+// adminLink handles "link <lid> <number>".
+func adminLink(cc *commandContext, args []string) string {
+	if len(args) != 2 {
+		return "Usage: link <lid> <number>"
+	}
+	lid, err := parseLID(args[0])
+	if err != nil {
+		return err.Error()
+	}
+	cell, err := canonicalNumber(args[1])
+	if err != nil {
+		return err.Error()
+	}
+	if err := linkCustomer(cc.db, lid.String(), cell); err != nil {
+		log.Printf("Linking LID %s to %s failed: %v", lid, cell, err)
+		return fmt.Sprintf("Linking %s to %s failed.", lid, cell)
+	}
+	return fmt.Sprintf("Linked %s to %s; their orders, points and history are now under %s.", lid, cell, cell)
+}
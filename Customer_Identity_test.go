@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// fakeIdentityDB keeps customer_profiles' LID links and merges, answering
+// the statements senderKey, linkCustomer and mergedInto make.
+type fakeIdentityDB struct {
+	links  map[string]string // LID to number
+	merges map[string]string // key to the customer it was merged into
+	saved  []string          // LIDs given a profile of their own
+	fail   string            // a statement containing it fails
+}
+
+func (db *fakeIdentityDB) Open(string) (driver.Conn, error) { return fakeIdentityConn{db}, nil }
+
+type fakeIdentityConn struct{ db *fakeIdentityDB }
+
+func (c fakeIdentityConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fake identity db: prepare not supported")
+}
+func (c fakeIdentityConn) Close() error              { return nil }
+func (c fakeIdentityConn) Begin() (driver.Tx, error) { return c, nil }
+func (c fakeIdentityConn) Commit() error             { return nil }
+func (c fakeIdentityConn) Rollback() error           { return nil }
+
+func (c fakeIdentityConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if c.db.fail != "" && strings.Contains(query, c.db.fail) {
+		return nil, errors.New("injected failure")
+	}
+	key := args[0].Value.(string)
+	rows := &fakeIdentityRows{}
+	switch {
+	case strings.Contains(query, "WHERE lid = $1 AND cell_number <> lid"):
+		if cell, ok := c.db.links[key]; ok {
+			rows.rows = append(rows.rows, cell)
+		}
+	case strings.Contains(query, "SELECT merged_into"):
+		if primary, ok := c.db.merges[key]; ok {
+			rows.rows = append(rows.rows, primary)
+		}
+	case strings.Contains(query, "SELECT tier, opted_in"):
+		// The LID has no profile worth keeping.
+	default:
+		return nil, errors.New("fake identity db: unexpected query")
+	}
+	return rows, nil
+}
+
+func (c fakeIdentityConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if c.db.fail != "" && strings.Contains(query, c.db.fail) {
+		return nil, errors.New("injected failure")
+	}
+	switch {
+	case strings.Contains(query, "INSERT INTO customer_profiles (cell_number, lid) VALUES ($1, $1)"):
+		c.db.saved = append(c.db.saved, args[0].Value.(string))
+	case strings.Contains(query, "INSERT INTO customer_profiles (cell_number, tier, lid"):
+		c.db.links[args[2].Value.(string)] = args[0].Value.(string)
+	case strings.HasPrefix(query, "DELETE FROM"), strings.HasPrefix(query, "UPDATE"):
+		// Moving the LID's rows to the number; there are none.
+		return driver.RowsAffected(0), nil
+	default:
+		return nil, errors.New("fake identity db: unexpected statement")
+	}
+	return driver.RowsAffected(1), nil
+}
+
+type fakeIdentityRows struct{ rows []string }
+
+func (r *fakeIdentityRows) Columns() []string { return []string{"value"} }
+func (r *fakeIdentityRows) Close() error      { return nil }
+func (r *fakeIdentityRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	dest[0], r.rows = r.rows[0], r.rows[1:]
+	return nil
+}
+
+type fakeGroups struct {
+	participants []types.GroupParticipant
+	err          error
+}
+
+func (g fakeGroups) GetGroupInfo(types.JID) (*types.GroupInfo, error) {
+	if g.err != nil {
+		return nil, g.err
+	}
+	return &types.GroupInfo{Participants: g.participants}, nil
+}
+
+func TestSenderKey(t *testing.T) {
+	fake := &fakeIdentityDB{}
+	sql.Register("fakeidentity", fake)
+	db, err := sql.Open("fakeidentity", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const cell, other = "27821234567", "27829999999"
+	phone := types.NewJID(cell, types.DefaultUserServer)
+	lid := types.NewJID("123456789012345", types.HiddenUserServer)
+	group := types.NewJID("120363000000000000", types.GroupServer)
+	direct := func(sender types.JID) types.MessageInfo {
+		return types.MessageInfo{MessageSource: types.MessageSource{Sender: sender, Chat: sender}}
+	}
+	inGroup := func(sender types.JID) types.MessageInfo {
+		return types.MessageInfo{MessageSource: types.MessageSource{Sender: sender, Chat: group, IsGroup: true}}
+	}
+	members := fakeGroups{participants: []types.GroupParticipant{
+		{JID: types.NewJID(other, types.DefaultUserServer), LID: types.NewJID("555", types.HiddenUserServer)},
+		{JID: phone, LID: lid},
+	}}
+
+	tests := []struct {
+		name     string
+		info     types.MessageInfo
+		groups   groupInfoSource
+		links    map[string]string
+		merges   map[string]string
+		fail     string
+		sender   string // senderKey
+		customer string // customerKey
+		linked   bool   // the LID ends up linked to sender
+		saved    bool   // the LID is given a profile of its own
+	}{
+		{name: "phone number", info: direct(phone), sender: cell, customer: cell},
+		{name: "phone number on a linked device", info: direct(types.JID{User: cell, Device: 3, Server: types.DefaultUserServer}),
+			sender: cell, customer: cell},
+		{name: "phone number merged into another", info: direct(phone), merges: map[string]string{cell: other},
+			sender: cell, customer: other},
+		{name: "LID already linked", info: direct(lid), links: map[string]string{lid.String(): cell},
+			sender: cell, customer: cell, linked: true},
+		{name: "LID linked to a merged number", info: direct(lid), links: map[string]string{lid.String(): cell}, merges: map[string]string{cell: other},
+			sender: cell, customer: other, linked: true},
+		{name: "unknown LID in a chat", info: direct(lid), groups: members,
+			sender: lid.String(), customer: lid.String(), saved: true},
+		{name: "LID resolved from the group", info: inGroup(lid), groups: members,
+			sender: cell, customer: cell, linked: true},
+		{name: "LID resolved from the group, number merged", info: inGroup(lid), groups: members, merges: map[string]string{cell: other},
+			sender: cell, customer: other, linked: true},
+		{name: "LID merged before it was resolved", info: direct(lid), merges: map[string]string{lid.String(): other},
+			sender: lid.String(), customer: other, saved: true},
+		{name: "LID not among the participants", info: inGroup(lid), groups: fakeGroups{participants: members.participants[:1]},
+			sender: lid.String(), customer: lid.String(), saved: true},
+		{name: "group lookup fails", info: inGroup(lid), groups: fakeGroups{err: errors.New("offline")},
+			sender: lid.String(), customer: lid.String(), saved: true},
+		{name: "LID lookup fails", info: inGroup(lid), groups: members, fail: "cell_number <> lid",
+			sender: lid.String(), customer: lid.String()},
+		{name: "linking fails", info: inGroup(lid), groups: members, fail: "INSERT INTO customer_profiles (cell_number, tier",
+			sender: lid.String(), customer: lid.String()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []struct {
+				fn   func(*sql.DB, groupInfoSource, types.MessageInfo) string
+				name string
+				want string
+			}{{senderKey, "senderKey", tt.sender}, {customerKey, "customerKey", tt.customer}} {
+				*fake = fakeIdentityDB{links: map[string]string{}, merges: tt.merges, fail: tt.fail}
+				for k, v := range tt.links {
+					fake.links[k] = v
+				}
+				if got := key.fn(db, tt.groups, tt.info); got != key.want {
+					t.Errorf("%s = %q, want %q", key.name, got, key.want)
+				}
+				if linked := fake.links[lid.String()] == tt.sender; linked != tt.linked {
+					t.Errorf("%s: LID linked to %q, want linked %v", key.name, fake.links[lid.String()], tt.linked)
+				}
+				if saved := len(fake.saved) == 1 && fake.saved[0] == lid.String(); saved != tt.saved {
+					t.Errorf("%s: saved profiles %q, want the LID's saved %v", key.name, fake.saved, tt.saved)
+				}
+			}
+		})
+	}
+}
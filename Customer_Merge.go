@@ -0,0 +1,313 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// A customer can end up under two keys: a LID and a number, a new SIM, or
+// a number recorded before numbers were normalized. Merging moves
+// everything under the duplicate to the primary, as linking a LID does,
+// and leaves a tombstone profile on the duplicate so messages from it are
+// taken as the primary's. The consent log is append-only, so the
+// duplicate's entries stay where they are and are read through the merge
+// record. There are no favorites to move; the bot doesn't keep any.
+
+var errMergeConflict = errors.New("merge conflict")
+
+// sameNumberDigits is how many trailing digits two numbers must share to
+// be the same number written differently, e.g. 0821234567 and 27821234567.
+const sameNumberDigits = 9
+
+type customerMerge struct {
+	Primary   string           `json:"primary"`
+	Duplicate string           `json:"duplicate"`
+	Moved     map[string]int64 `json:"moved"`
+}
+
+// mergeCustomers merges duplicate into primary, recording by as who did
+// it.
+func mergeCustomers(db *sql.DB, primary, duplicate, by string) (customerMerge, error) {
+	m := customerMerge{Primary: primary, Duplicate: duplicate}
+	tx, err := db.Begin()
+	if err != nil {
+		return m, err
+	}
+	defer tx.Rollback()
+
+	// Locking both profiles keeps two merges of the same customer from
+	// interleaving.
+	if _, err := tx.Exec(`INSERT INTO customer_profiles (cell_number) VALUES ($1), ($2) ON CONFLICT DO NOTHING`, primary, duplicate); err != nil {
+		return m, fmt.Errorf("saving profiles: %w", err)
+	}
+	var merged sql.NullString
+	var dupLID string
+	err = tx.QueryRow(`SELECT p.merged_into, COALESCE(d.lid, '') FROM customer_profiles p, customer_profiles d
+		WHERE p.cell_number = $1 AND d.cell_number = $2 FOR UPDATE`, primary, duplicate).Scan(&merged, &dupLID)
+	if err != nil {
+		return m, fmt.Errorf("reading profiles: %w", err)
+	}
+	if merged.Valid {
+		return m, fmt.Errorf("%w: %s was itself merged into %s", errMergeConflict, primary, merged.String)
+	}
+	var openCarts int
+	if err := tx.QueryRow(`SELECT count(DISTINCT `+orderCellColumn+`) FROM `+orderTable+`
+		WHERE `+orderCellColumn+` IN ($1, $2) AND `+orderOpenFilter, primary, duplicate).Scan(&openCarts); err != nil {
+		return m, fmt.Errorf("reading carts: %w", err)
+	}
+	if openCarts > 1 {
+		return m, fmt.Errorf("%w: both have an open cart, one of them has to check out or empty it first", errMergeConflict)
+	}
+
+	// The duplicate's consent wins only if it changed more recently.
+	var dupConsentNewer bool
+	err = tx.QueryRow(`SELECT COALESCE((SELECT max(created_at) FROM consent_log WHERE cell_number = $2), '-infinity')
+		> COALESCE((SELECT max(created_at) FROM consent_log WHERE cell_number = $1), '-infinity')`, primary, duplicate).Scan(&dupConsentNewer)
+	if err != nil {
+		return m, fmt.Errorf("reading consent: %w", err)
+	}
+	if _, err := tx.Exec(`UPDATE customer_profiles SET lid = NULL WHERE cell_number = $1`, duplicate); err != nil {
+		return m, fmt.Errorf("unlinking LID: %w", err)
+	}
+	_, err = tx.Exec(`UPDATE customer_profiles p SET
+			tier = CASE WHEN p.tier = $3 THEN d.tier ELSE p.tier END,
+			lid = COALESCE(p.lid, NULLIF($4, '')),
+			opted_in = CASE WHEN $5 THEN d.opted_in ELSE p.opted_in END,
+			ad_source = CASE WHEN p.ad_seen_at IS NULL THEN d.ad_source ELSE p.ad_source END,
+			ad_source_id = CASE WHEN p.ad_seen_at IS NULL THEN d.ad_source_id ELSE p.ad_source_id END,
+			ad_title = CASE WHEN p.ad_seen_at IS NULL THEN d.ad_title ELSE p.ad_title END,
+			ad_url = CASE WHEN p.ad_seen_at IS NULL THEN d.ad_url ELSE p.ad_url END,
+			ad_click_id = CASE WHEN p.ad_seen_at IS NULL THEN d.ad_click_id ELSE p.ad_click_id END,
+			ad_order_id = CASE WHEN p.ad_seen_at IS NULL THEN d.ad_order_id ELSE p.ad_order_id END,
+			ad_seen_at = COALESCE(p.ad_seen_at, d.ad_seen_at),
+			display_name = CASE WHEN `+takeIncomingName("p", "d")+` THEN d.display_name ELSE p.display_name END,
+			name_source = CASE WHEN `+takeIncomingName("p", "d")+` THEN d.name_source ELSE p.name_source END,
+			email = CASE WHEN p.email = '' THEN d.email ELSE p.email END,
+			updated_at = now()
+		FROM customer_profiles d WHERE p.cell_number = $1 AND d.cell_number = $2`,
+		primary, duplicate, retailTier, dupLID, dupConsentNewer)
+	if err != nil {
+		return m, fmt.Errorf("merging profile: %w", err)
+	}
+	if m.Moved, err = moveCustomerRows(tx, duplicate, primary); err != nil {
+		return m, err
+	}
+	_, err = tx.Exec(`UPDATE customer_profiles SET merged_into = $1, tier = $3, opted_in = false, consent_requested_at = NULL,
+			ad_seen_at = NULL, ad_order_id = NULL, updated_at = now()
+		WHERE cell_number = $2 OR merged_into = $2`, primary, duplicate, retailTier)
+	if err != nil {
+		return m, fmt.Errorf("leaving tombstone: %w", err)
+	}
+	moved, err := json.Marshal(m.Moved)
+	if err != nil {
+		return m, err
+	}
+	if _, err := tx.Exec(`INSERT INTO customer_merges (primary_cell, duplicate_cell, merged_by, moved) VALUES ($1, $2, $3, $4)`,
+		primary, duplicate, by, string(moved)); err != nil {
+		return m, fmt.Errorf("recording merge: %w", err)
+	}
+	return m, tx.Commit()
+}
+
+// knownCustomer reports whether anything is recorded under key.
+func knownCustomer(db *sql.DB, key string) (bool, error) {
+	var known bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM customer_profiles WHERE cell_number = $1)
+		OR EXISTS (SELECT 1 FROM `+orderTable+` WHERE `+orderCellColumn+` = $1)`, key).Scan(&known)
+	return known, err
+}
+
+type mergeRequest struct {
+	Primary   string `json:"primary"`
+	Duplicate string `json:"duplicate"`
+}
+
+// MergeCustomersHandler serves POST /api/users/merge with {"primary":
+// ..., "duplicate": ...}. The primary must be a phone number; the
+// duplicate is taken as stored, so LIDs and numbers recorded before
+// normalization can be merged too.
+func MergeCustomersHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req mergeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		primary, err := canonicalNumber(req.Primary)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "primary: "+err.Error())
+			return
+		}
+		duplicate := strings.TrimSpace(req.Duplicate)
+		if lid, err := parseLID(duplicate); err == nil && strings.Contains(duplicate, "@") {
+			duplicate = lid.String()
+		}
+		if duplicate == "" || duplicate == primary {
+			writeJSONError(w, http.StatusBadRequest, "duplicate must be another customer")
+			return
+		}
+		if known, err := knownCustomer(db, duplicate); err != nil {
+			log.Printf("Looking up customer %s failed: %v", duplicate, err)
+			writeJSONError(w, http.StatusInternalServerError, "looking up duplicate failed")
+			return
+		} else if !known {
+			writeJSONError(w, http.StatusNotFound, "nothing is recorded under "+duplicate)
+			return
+		}
+		by := staffFromContext(r.Context()).Name
+		m, err := mergeCustomers(db, primary, duplicate, by)
+		if errors.Is(err, errMergeConflict) {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("Merging %s into %s failed: %v", duplicate, primary, err)
+			writeJSONError(w, http.StatusInternalServerError, "merge failed")
+			return
+		}
+		log.Printf("%s merged customer %s into %s: %v", by, duplicate, primary, m.Moved)
+		writeJSON(w, http.StatusOK, m)
+	}
+}
+
+// duplicateCandidate is a pair of customer keys that are likely the same
+// customer. Primary is the one suggested to keep.
+type duplicateCandidate struct {
+	Primary   string `json:"primary"`
+	Duplicate string `json:"duplicate"`
+	Reason    string `json:"reason"`
+	Name      string `json:"name,omitempty"`
+}
+
+type customerKeyInfo struct {
+	key    string
+	orders int
+	name   string
+}
+
+// findDuplicateCustomers suggests merges: the same number written
+// differently, a LID still holding data after being linked to a number,
+// and the same WhatsApp name on numbers a digit or two apart.
+func findDuplicateCustomers(db *sql.DB, contacts map[types.JID]types.ContactInfo) ([]duplicateCandidate, error) {
+	rows, err := db.Query(`SELECT k.cell, count(o.` + orderIDColumn + `), COALESCE(max(p.cell_number), '')
+		FROM (SELECT cell_number AS cell FROM customer_profiles WHERE merged_into IS NULL
+			UNION SELECT ` + orderCellColumn + ` FROM ` + orderTable + `) k
+		LEFT JOIN ` + orderTable + ` o ON o.` + orderCellColumn + ` = k.cell
+		LEFT JOIN customer_profiles p ON p.lid = k.cell AND p.cell_number <> k.cell AND p.merged_into IS NULL
+		WHERE NOT EXISTS (SELECT 1 FROM customer_profiles t WHERE t.cell_number = k.cell AND t.merged_into IS NOT NULL)
+		GROUP BY k.cell`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []customerKeyInfo
+	candidates := []duplicateCandidate{}
+	seen := map[[2]string]bool{}
+	add := func(a, b customerKeyInfo, reason string) {
+		// Keep the key with more orders, and a number over a LID.
+		if strings.Contains(a.key, "@") || (!strings.Contains(b.key, "@") && b.orders > a.orders) {
+			a, b = b, a
+		}
+		pair := [2]string{a.key, b.key}
+		if seen[pair] {
+			return
+		}
+		seen[pair] = true
+		candidates = append(candidates, duplicateCandidate{Primary: a.key, Duplicate: b.key, Reason: reason, Name: a.name})
+	}
+	for rows.Next() {
+		var k customerKeyInfo
+		var linked string
+		if err := rows.Scan(&k.key, &k.orders, &linked); err != nil {
+			return nil, err
+		}
+		if linked != "" {
+			add(customerKeyInfo{key: linked, orders: k.orders + 1}, k, "LID linked to this number")
+			continue
+		}
+		if !strings.Contains(k.key, "@") {
+			k.name = contactName(contacts[types.NewJID(k.key, types.DefaultUserServer)])
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	bySuffix := map[string][]customerKeyInfo{}
+	byName := map[string][]customerKeyInfo{}
+	for _, k := range keys {
+		if strings.Contains(k.key, "@") {
+			continue
+		}
+		if len(k.key) >= sameNumberDigits {
+			suffix := k.key[len(k.key)-sameNumberDigits:]
+			bySuffix[suffix] = append(bySuffix[suffix], k)
+		}
+		if name := normalizeForMatch(k.name); name != "" {
+			byName[name] = append(byName[name], k)
+		}
+	}
+	for _, group := range bySuffix {
+		for i := range group {
+			for j := i + 1; j < len(group); j++ {
+				add(group[i], group[j], "same number written differently")
+			}
+		}
+	}
+	for _, group := range byName {
+		for i := range group {
+			for j := i + 1; j < len(group); j++ {
+				if editDistance(group[i].key, group[j].key) <= 2 {
+					add(group[i], group[j], "same name, similar number")
+				}
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Primary != candidates[j].Primary {
+			return candidates[i].Primary < candidates[j].Primary
+		}
+		return candidates[i].Duplicate < candidates[j].Duplicate
+	})
+	return candidates, nil
+}
+
+// contactName is the name WhatsApp has for a contact, if any.
+func contactName(c types.ContactInfo) string {
+	for _, name := range []string{c.FullName, c.PushName, c.FirstName, c.BusinessName} {
+		if name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// DuplicateCustomersHandler serves GET /api/users/duplicates, the merges
+// worth looking at. Nothing is merged until POST /api/users/merge.
+func DuplicateCustomersHandler(cc *commandContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var contacts map[types.JID]types.ContactInfo
+		if cc.client != nil && cc.client.Contacts() != nil {
+			var err error
+			if contacts, err = cc.client.Contacts().GetAllContacts(); err != nil {
+				log.Printf("Reading WhatsApp contacts failed, suggesting duplicates without names: %v", err)
+			}
+		}
+		candidates, err := findDuplicateCustomers(cc.db, contacts)
+		if err != nil {
+			log.Printf("Finding duplicate customers failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "finding duplicates failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, candidates)
+	}
+}
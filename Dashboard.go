@@ -0,0 +1,484 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	dashboardBaseURL    = "/admin"
+	dashboardCookie     = "menubot_admin"
+	dashboardSessionTTL = 12 * time.Hour
+)
+
+// dashboardNext is the button each order status offers on the orders page.
+var dashboardNext = map[string]string{
+	statusPaid:      statusPreparing,
+	statusPreparing: statusReady,
+	statusReady:     statusCollected,
+}
+
+// dashboardTemplates are the pages in templates/admin, each parsed with the
+// shared layout.
+type dashboardTemplates struct {
+	login, status, orders, catalogue *template.Template
+}
+
+func (p *preflight) parseDashboardTemplates(pwd string) dashboardTemplates {
+	dir := filepath.Join(pwd, "templates", "admin")
+	layout := filepath.Join(dir, "layout.html")
+	page := func(name string) *template.Template {
+		return p.parseTemplate(filepath.Join(dir, name+".html"), layout)
+	}
+	return dashboardTemplates{login: page("login"), status: page("status"), orders: page("orders"), catalogue: page("catalogue")}
+}
+
+// dashboardPage is passed to every dashboard template. CSRF is empty on the
+// login page, which also hides the navigation.
+type dashboardPage struct {
+	Title    string
+	ShopName string
+	CSRF     string
+	Flash    string
+	Data     any
+}
+
+type dashboardSession struct {
+	csrf    string
+	staff   staffIdentity
+	expires time.Time
+}
+
+// dashboardSessions are kept in memory: a restart logs everyone out, which
+// is fine for a handful of staff.
+type dashboardSessions struct {
+	mu       sync.Mutex
+	sessions map[string]dashboardSession
+}
+
+func newDashboardSessions() *dashboardSessions {
+	return &dashboardSessions{sessions: map[string]dashboardSession{}}
+}
+
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (s *dashboardSessions) Create(staff staffIdentity) (token string, sess dashboardSession, err error) {
+	sess.staff = staff
+	if token, err = newSessionToken(); err != nil {
+		return "", sess, err
+	}
+	if sess.csrf, err = newSessionToken(); err != nil {
+		return "", sess, err
+	}
+	sess.expires = time.Now().Add(dashboardSessionTTL)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for t, old := range s.sessions {
+		if now.After(old.expires) {
+			delete(s.sessions, t)
+		}
+	}
+	s.sessions[token] = sess
+	return token, sess, nil
+}
+
+func (s *dashboardSessions) Lookup(token string) (dashboardSession, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sess, ok := s.sessions[token]
+	if ok && time.Now().After(sess.expires) {
+		delete(s.sessions, token)
+		return dashboardSession{}, false
+	}
+	return sess, ok
+}
+
+func (s *dashboardSessions) Delete(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, token)
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, token string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     dashboardCookie,
+		Value:    token,
+		Path:     dashboardBaseURL,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+type dashboardSessionKey struct{}
+
+// requireDashboardSession sends visitors without a session to the login
+// page, and rejects form posts whose csrf field doesn't match the session.
+func requireDashboardSession(sessions *dashboardSessions) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var sess dashboardSession
+			cookie, err := r.Cookie(dashboardCookie)
+			ok := err == nil
+			if ok {
+				sess, ok = sessions.Lookup(cookie.Value)
+			}
+			if !ok {
+				http.Redirect(w, r, dashboardBaseURL+"/login", http.StatusSeeOther)
+				return
+			}
+			if r.Method == http.MethodPost && subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(sess.csrf)) != 1 {
+				http.Error(w, "invalid or missing CSRF token, reload the page and try again", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, withStaff(r.WithContext(context.WithValue(r.Context(), dashboardSessionKey{}, sess)), sess.staff))
+		})
+	}
+}
+
+// dashboardRequireRole sends staff below role back with a message rather
+// than an error page.
+func dashboardRequireRole(role, page string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !staffFromContext(r.Context()).can(role) {
+				dashboardRedirect(w, r, page, "That needs the "+role+" role or above.")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// dashboardRedirect sends the browser back to a page after a form post,
+// with a message to show there.
+func dashboardRedirect(w http.ResponseWriter, r *http.Request, page, flash string) {
+	http.Redirect(w, r, dashboardBaseURL+page+"?msg="+url.QueryEscape(flash), http.StatusSeeOther)
+}
+
+// DashboardRoutes serves the staff dashboard under /admin. Staff log in
+// with their admin API key, which gives them the same role here, and it
+// works through the same functions as the API endpoints.
+func DashboardRoutes(d routeDeps, tpls dashboardTemplates) func(chi.Router) {
+	sessions := newDashboardSessions()
+	auth := staffAuth{db: d.db, adminKey: d.envVars.AdminAPIKey}
+	b := brandingFromEnv(d.envVars)
+	render := func(w http.ResponseWriter, r *http.Request, tpl *template.Template, title string, data any) {
+		sess, _ := r.Context().Value(dashboardSessionKey{}).(dashboardSession)
+		renderPage(w, r, tpl, dashboardPage{
+			Title:    title,
+			ShopName: b.ShopName,
+			CSRF:     sess.csrf,
+			Flash:    r.URL.Query().Get("msg"),
+			Data:     data,
+		}, b)
+	}
+
+	return func(r chi.Router) {
+		r.Get("/login", func(w http.ResponseWriter, r *http.Request) {
+			render(w, r, tpls.login, "Log in", nil)
+		})
+		r.Post("/login", func(w http.ResponseWriter, r *http.Request) {
+			staff, ok := auth.Resolve(r.PostFormValue("key"))
+			if !ok {
+				log.Printf("Failed dashboard login from %s", remoteIP(r))
+				dashboardRedirect(w, r, "/login", "Wrong key.")
+				return
+			}
+			log.Printf("%s (%s) logged in to the dashboard from %s", staff.Name, staff.Role, remoteIP(r))
+			token, _, err := sessions.Create(staff)
+			if err != nil {
+				log.Printf("Creating dashboard session failed: %v", err)
+				http.Error(w, "creating session failed", http.StatusInternalServerError)
+				return
+			}
+			setSessionCookie(w, r, token, int(dashboardSessionTTL.Seconds()))
+			http.Redirect(w, r, dashboardBaseURL+"/", http.StatusSeeOther)
+		})
+
+		r.Group(func(r chi.Router) {
+			r.Use(requireDashboardSession(sessions), auditMutations(d.db))
+			r.Post("/logout", func(w http.ResponseWriter, r *http.Request) {
+				if cookie, err := r.Cookie(dashboardCookie); err == nil {
+					sessions.Delete(cookie.Value)
+				}
+				setSessionCookie(w, r, "", -1)
+				dashboardRedirect(w, r, "/login", "Logged out.")
+			})
+			r.Get("/", dashboardStatusHandler(d, render, tpls.status))
+			r.With(dashboardRequireRole(roleAdmin, "/")).Post("/maintenance", dashboardMaintenanceHandler(d.cmds.maintenance))
+			r.Get("/orders", dashboardOrdersHandler(d.db, render, tpls.orders))
+			r.With(dashboardRequireRole(roleManager, "/orders")).Post("/orders/{orderID}/paid", dashboardMarkPaidHandler(d.db, d.cmds))
+			r.With(dashboardRequireRole(roleKitchen, "/orders")).Post("/orders/{orderID}/advance", dashboardAdvanceHandler(d.db, d.cmds))
+			r.Get("/catalogue", dashboardCatalogueHandler(d.prclist, render, tpls.catalogue))
+			r.With(dashboardRequireRole(roleManager, "/catalogue")).Post("/catalogue/{itemID}", dashboardUpdateItemHandler(d.db, d.prclist))
+		})
+	}
+}
+
+type dashboardRender func(w http.ResponseWriter, r *http.Request, tpl *template.Template, title string, data any)
+
+type dashboardStatus struct {
+	Connected        bool
+	Connection       string
+	PricelistVersion int64
+	PayFastMode      string
+	Paused           bool
+	Maintenance      maintenanceState
+}
+
+func dashboardStatusHandler(d routeDeps, render dashboardRender, tpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m := d.cmds.maintenance.Get()
+		render(w, r, tpl, "Status", dashboardStatus{
+			Connected:        d.client.IsConnected(),
+			Connection:       d.cmds.connLog.Status(),
+			PricelistVersion: d.prclist.Version(),
+			PayFastMode:      d.envVars.PayFastMode,
+			Paused:           m.ActiveAt(time.Now()),
+			Maintenance:      m,
+		})
+	}
+}
+
+func dashboardMaintenanceHandler(mm *maintenanceMode) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		st := maintenanceState{Active: r.PostFormValue("active") == "true", Message: strings.TrimSpace(r.PostFormValue("message"))}
+		if raw := r.PostFormValue("until"); st.Active && raw != "" {
+			until, err := parseMaintenanceUntil(raw, time.Now())
+			if err != nil {
+				dashboardRedirect(w, r, "/", err.Error())
+				return
+			}
+			st.Until = &until
+		}
+		if err := mm.Set(st); err != nil {
+			log.Println(err)
+			dashboardRedirect(w, r, "/", "Saving maintenance state failed.")
+			return
+		}
+		if st.Active {
+			dashboardRedirect(w, r, "/", "Shop paused.")
+		} else {
+			dashboardRedirect(w, r, "/", "Shop resumed.")
+		}
+	}
+}
+
+type dashboardOrder struct {
+	orderSummary
+	Next string
+}
+
+// todaysOrders lists the orders touched since midnight in the business
+// timezone, newest first.
+func todaysOrders(db *sql.DB, now time.Time) ([]dashboardOrder, error) {
+	loc := cfg().BusinessHours.Location
+	local := now.In(loc)
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	rows, err := db.Query(orderSummaryQuery+` WHERE m.updated_at >= $1 AND NOT m.self_test ORDER BY o.`+orderIDColumn+` DESC`, midnight)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var orders []dashboardOrder
+	for rows.Next() {
+		var o dashboardOrder
+		var paidAt sql.NullTime
+		if err := rows.Scan(&o.ID, &o.Ref, &o.CellNumber, &o.Total, &o.Status, &paidAt); err != nil {
+			return nil, err
+		}
+		if paidAt.Valid {
+			o.PaidAt = &paidAt.Time
+		}
+		o.Next = dashboardNext[o.Status]
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+func dashboardOrdersHandler(db *sql.DB, render dashboardRender, tpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orders, err := todaysOrders(db, time.Now())
+		if err != nil {
+			log.Printf("Listing today's orders failed: %v", err)
+			http.Error(w, "listing orders failed", http.StatusInternalServerError)
+			return
+		}
+		render(w, r, tpl, "Today's orders", orders)
+	}
+}
+
+func dashboardOrderParam(r *http.Request) (int64, error) {
+	return strconv.ParseInt(chi.URLParam(r, "orderID"), 10, 64)
+}
+
+// dashboardMarkPaidHandler records a payment taken outside PayFast, e.g.
+// cash at the counter, and settles it like an ITN would.
+func dashboardMarkPaidHandler(db *sql.DB, cc *commandContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderID, err := dashboardOrderParam(r)
+		if err != nil {
+			http.Error(w, "order ID must be a number", http.StatusBadRequest)
+			return
+		}
+		order, found, err := getOrder(db, orderID)
+		if err != nil || !found {
+			log.Printf("Reading order %d failed: %v", orderID, err)
+			dashboardRedirect(w, r, "/orders", fmt.Sprintf("Order %d not found.", orderID))
+			return
+		}
+		discount, err := orderDiscount(db, orderID)
+		if err != nil {
+			log.Printf("Reading discount for order %d failed: %v", orderID, err)
+			dashboardRedirect(w, r, "/orders", "Marking the order paid failed.")
+			return
+		}
+		total, _ := strconv.ParseFloat(order.Total, 64)
+		orderData := OrderData{
+			OrderID:     strconv.FormatInt(orderID, 10),
+			PfPaymentID: "manual",
+			AmountGross: fmt.Sprintf("%.2f", max(total-discount, 0)),
+		}
+		paid, err := markPaidAndSettle(db, orderID, order.CellNumber, orderData, "manual")
+		if err != nil {
+			log.Printf("Marking order %d paid failed: %v", orderID, err)
+			dashboardRedirect(w, r, "/orders", "Marking the order paid failed.")
+			return
+		}
+		if !paid {
+			dashboardRedirect(w, r, "/orders", fmt.Sprintf("Order %d is no longer unpaid.", orderID))
+			return
+		}
+		log.Printf("Order %d marked paid from the dashboard", orderID)
+		cc.orderPaid(orderID, order.CellNumber, orderData.AmountGross)
+		dashboardRedirect(w, r, "/orders", fmt.Sprintf("Order %d marked paid.", orderID))
+	}
+}
+
+func dashboardAdvanceHandler(db *sql.DB, cc *commandContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderID, err := dashboardOrderParam(r)
+		if err != nil {
+			http.Error(w, "order ID must be a number", http.StatusBadRequest)
+			return
+		}
+		order, found, err := getOrder(db, orderID)
+		if err != nil || !found {
+			log.Printf("Reading order %d failed: %v", orderID, err)
+			dashboardRedirect(w, r, "/orders", fmt.Sprintf("Order %d not found.", orderID))
+			return
+		}
+		next, ok := dashboardNext[order.Status]
+		if !ok {
+			dashboardRedirect(w, r, "/orders", fmt.Sprintf("Order %d is %s and can't be advanced.", orderID, order.Status))
+			return
+		}
+		moved, err := transitionOrder(db, orderID, next, order.Status)
+		if err != nil {
+			log.Printf("Advancing order %d failed: %v", orderID, err)
+			dashboardRedirect(w, r, "/orders", "Updating the order failed.")
+			return
+		}
+		if !moved {
+			dashboardRedirect(w, r, "/orders", fmt.Sprintf("Order %d changed meanwhile, check it again.", orderID))
+			return
+		}
+		cc.events.Emit(eventOrderStatusChanged, orderStatusEvent{OrderID: orderID, OrderRef: order.reference(), CellNumber: order.CellNumber, From: order.Status, To: next})
+		if next == statusReady {
+			cc.notifyReady(order)
+		}
+		cc.advanceQueue()
+		dashboardRedirect(w, r, "/orders", fmt.Sprintf("Order %d is now %s.", orderID, next))
+	}
+}
+
+type dashboardItem struct {
+	ID     int
+	Name   string
+	Price  float64
+	Active bool
+}
+
+func dashboardCatalogueHandler(prclist *pricelistHolder, render dashboardRender, tpl *template.Template) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vp := prclist.Snapshot()
+		var items []dashboardItem
+		for _, item := range vp.Items {
+			id := ctlgItemID(item)
+			if vp.Deleted(id) {
+				continue
+			}
+			items = append(items, dashboardItem{ID: id, Name: ctlgItemName(item), Price: ctlgItemPrice(item), Active: vp.Listed(id)})
+		}
+		render(w, r, tpl, "Catalogue", items)
+	}
+}
+
+// dashboardUpdateItemHandler saves one catalogue row. A new price is
+// recorded as a price change taking effect now, as the API would.
+func dashboardUpdateItemHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := itemIDParam(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		vp := prclist.Snapshot()
+		item, ok := vp.Item(itemID)
+		if !ok {
+			dashboardRedirect(w, r, "/catalogue", fmt.Sprintf("No catalogue item %d.", itemID))
+			return
+		}
+		price, err := strconv.ParseFloat(r.PostFormValue("price"), 64)
+		if err != nil || price <= 0 {
+			dashboardRedirect(w, r, "/catalogue", "Price must be a positive number.")
+			return
+		}
+		if fmt.Sprintf("%.2f", price) != fmt.Sprintf("%.2f", ctlgItemPrice(item)) {
+			_, err := db.Exec(`INSERT INTO price_changes (catalogue_id, item_id, price, effective_from) VALUES ($1, $2, $3, now())`,
+				catalogueID, itemID, price)
+			if err != nil {
+				log.Printf("Saving price change for item %d failed: %v", itemID, err)
+				dashboardRedirect(w, r, "/catalogue", "Saving the price failed.")
+				return
+			}
+		}
+		if active := r.PostFormValue("active") == "true"; active != vp.Listed(itemID) {
+			if err := setItemActive(db, itemID, active); err != nil {
+				log.Printf("Updating item %d failed: %v", itemID, err)
+				dashboardRedirect(w, r, "/catalogue", "Updating the item failed.")
+				return
+			}
+		}
+		if _, err := rebuildPricelist(db, prclist); err != nil {
+			log.Printf("Rebuilding pricelist after edit failed: %v", err)
+			dashboardRedirect(w, r, "/catalogue", "Saved, but rebuilding the pricelist failed.")
+			return
+		}
+		dashboardRedirect(w, r, "/catalogue", fmt.Sprintf("Saved %s.", ctlgItemName(item)))
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+const (
+	appDBName = "app database"
+	waDBName  = "whatsapp store database"
+
+	dbPingTimeout = 5 * time.Second
+)
+
+// dbtx is satisfied by both *sql.DB and *sql.Tx, so store functions can
+// run standalone or as part of a caller's transaction.
+type dbtx interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// openDB opens and pings a connection pool. name identifies the database in
+// errors so it's clear which of the two connections is failing, label in
+// query metrics.
+func openDB(name, label, driver, dsn string) (*sql.DB, error) {
+	if !slices.Contains(sql.Drivers(), driver) {
+		return nil, fmt.Errorf("%s: SQL driver %q is not compiled into this binary", name, driver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("%s: error opening database: %w", name, err)
+	}
+	if db, err = instrumentDB(db, dsn, label); err != nil {
+		return nil, fmt.Errorf("%s: error opening database: %w", name, err)
+	}
+	if err := pingDB(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: database unreachable: %w", name, err)
+	}
+	return db, nil
+}
+
+func pingDB(db *sql.DB) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbPingTimeout)
+	defer cancel()
+	return db.PingContext(ctx)
+}
+
+func closeDB(name string, db *sql.DB) {
+	if err := db.Close(); err != nil {
+		log.Printf("Error closing %s: %v", name, err)
+	}
+}
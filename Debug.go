@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const debugBaseURL = "/debug"
+
+type debugStatus struct {
+	Goroutines    int    `json:"goroutines"`
+	HeapAlloc     uint64 `json:"heap_alloc_bytes"`
+	HeapObjects   uint64 `json:"heap_objects"`
+	NumGC         uint32 `json:"num_gc"`
+	WebhookQueue  int    `json:"webhook_queue"` // events waiting in every sink, not just the webhook
+	OutboxBacklog int64  `json:"outbox_backlog"`
+	WhatsApp      string `json:"whatsapp"`
+	// Devices is set with more than one device paired.
+	Devices []deviceStatus `json:"devices,omitempty"`
+	// SlowestQueries are the SQL statements with the slowest single run
+	// since startup.
+	SlowestQueries []queryStat `json:"slowest_queries"`
+}
+
+func collectDebugStatus(cc *commandContext) debugStatus {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	var devices []deviceStatus
+	if cc.devices.multiple() {
+		devices = cc.devices.Status()
+	}
+
+	return debugStatus{
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAlloc:     mem.HeapAlloc,
+		HeapObjects:   mem.HeapObjects,
+		NumGC:         mem.NumGC,
+		WebhookQueue:  cc.events.QueueDepth(),
+		OutboxBacklog: outboxBacklog.Load(),
+		WhatsApp:      clientState(cc.client),
+		Devices:       devices,
+
+		SlowestQueries: queryStats.slowest(queryStatsShown),
+	}
+}
+
+func (s debugStatus) String() string {
+	status := fmt.Sprintf("Goroutines: %d\nHeap: %.1f MB in %d objects, %d GCs\nEvent queues: %d\nOutbox backlog: %d\nWhatsApp: %s",
+		s.Goroutines, float64(s.HeapAlloc)/(1<<20), s.HeapObjects, s.NumGC, s.WebhookQueue, s.OutboxBacklog, s.WhatsApp)
+	for _, d := range s.Devices {
+		status += fmt.Sprintf("\nDevice %s: %s", d.Number, d.State)
+	}
+	if len(s.SlowestQueries) == 0 {
+		return status
+	}
+	status += "\n\nSlowest queries:"
+	for i, q := range s.SlowestQueries {
+		status += fmt.Sprintf("\n%d. %s", i+1, q)
+	}
+	return status
+}
+
+// DebugRoutes mounts pprof and the status summary. The caller is expected
+// to put them behind requireAdminKey.
+func DebugRoutes(cc *commandContext) func(r chi.Router) {
+	return func(r chi.Router) {
+		r.Get("/status", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, collectDebugStatus(cc))
+		})
+		// pprof.Index expects the standard /debug/pprof/ prefix, which is
+		// why the group is mounted at /debug.
+		r.Get("/pprof/*", pprof.Index)
+		r.Get("/pprof/cmdline", pprof.Cmdline)
+		r.Get("/pprof/profile", pprof.Profile)
+		r.Get("/pprof/symbol", pprof.Symbol)
+		r.Post("/pprof/symbol", pprof.Symbol)
+		r.Get("/pprof/trace", pprof.Trace)
+	}
+}
+
+func adminDebug(cc *commandContext, _ []string) string {
+	return collectDebugStatus(cc).String()
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// Customers often forward the contact card of whoever will receive the
+// order. The card's name and number are offered as the order's delivery
+// contact, and once the customer says yes the pick list, the drivers' view
+// of the order and the ready notification use them instead of the
+// customer's own number. The offer waits in pending_prompts as the contact
+// flow, with the contact as its data.
+
+const contactDeclineCommand = "no"
+
+var (
+	errVCardMalformed = errors.New("not a vCard")
+	errVCardNoNumber  = errors.New("vCard has no phone number")
+)
+
+type deliveryContact struct {
+	Name       string `json:"name,omitempty"`
+	CellNumber string `json:"cell_number"`
+}
+
+// String is how the contact is shown, e.g. "Jane (27831234567)".
+func (c deliveryContact) String() string {
+	if c.Name == "" {
+		return c.CellNumber
+	}
+	return fmt.Sprintf("%s (%s)", c.Name, c.CellNumber)
+}
+
+// parseVCard reads the name and first phone number of a vCard. WhatsApp
+// adds a waid parameter with the number the contact is on WhatsApp with,
+// which is taken over the number as written, as it needs no guessing at
+// the format.
+func parseVCard(card string) (deliveryContact, error) {
+	card = strings.ReplaceAll(card, "\r\n", "\n")
+	// Long lines are folded onto the next one, which starts with a space.
+	card = strings.NewReplacer("\n ", "", "\n\t", "").Replace(card)
+	var c deliveryContact
+	var structured string
+	begun := false
+	for _, line := range strings.Split(card, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		params := strings.Split(key, ";")
+		// Properties may be grouped, e.g. "item1.TEL".
+		name := strings.ToUpper(params[0])
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			name = name[i+1:]
+		}
+		switch name {
+		case "BEGIN":
+			begun = strings.EqualFold(value, "VCARD")
+		case "FN":
+			c.Name = vCardUnescape(value)
+		case "N":
+			structured = value
+		case "TEL":
+			if c.CellNumber != "" {
+				continue
+			}
+			for _, p := range params[1:] {
+				if k, v, _ := strings.Cut(p, "="); strings.EqualFold(k, "waid") && msisdnPattern.MatchString(v) {
+					c.CellNumber = v
+				}
+			}
+			if c.CellNumber == "" {
+				c.CellNumber, _ = normalizeGiftNumber(value)
+			}
+		}
+	}
+	if !begun {
+		return deliveryContact{}, errVCardMalformed
+	}
+	if c.Name == "" && structured != "" {
+		// N is family;given;additional;prefix;suffix.
+		parts := strings.Split(structured, ";")
+		if len(parts) > 1 {
+			parts[0], parts[1] = parts[1], parts[0]
+		}
+		c.Name = vCardUnescape(strings.Join(strings.Fields(strings.Join(parts, " ")), " "))
+	}
+	if c.CellNumber == "" {
+		return c, errVCardNoNumber
+	}
+	return c, nil
+}
+
+func vCardUnescape(s string) string {
+	return strings.TrimSpace(strings.NewReplacer(`\n`, " ", `\N`, " ", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s))
+}
+
+// contactCard is the contact a message carries: the card itself, or the
+// first of several, in which case more is set.
+func contactCard(m *waProto.Message) (card *waProto.ContactMessage, more bool) {
+	if c := m.GetContactMessage(); c != nil {
+		return c, false
+	}
+	if cards := m.GetContactsArrayMessage().GetContacts(); len(cards) > 0 {
+		return cards[0], len(cards) > 1
+	}
+	return nil, false
+}
+
+// contactOrder is the order a delivery contact goes on: the cart, or else
+// the latest order that hasn't reached the customer yet.
+func contactOrder(db *sql.DB, cell string) (int64, bool, error) {
+	if orderID, _, open, err := openOrder(db, cell); err != nil || open {
+		return orderID, open, err
+	}
+	order, found, err := latestOrder(db, cell)
+	if err != nil || !found || order.finished() {
+		return 0, false, err
+	}
+	return order.ID, true, nil
+}
+
+func contactPrompt(c deliveryContact, ref string) string {
+	return fmt.Sprintf("Use %s as the delivery contact for order %s? Reply YES or NO.", c, ref)
+}
+
+// contactCardReply answers a message carrying a contact card by offering
+// it as the delivery contact.
+func contactCardReply(cc *commandContext, cell string, m *waProto.Message) (reply string, orderID int64, ok bool) {
+	card, more := contactCard(m)
+	if card == nil {
+		return "", 0, false
+	}
+	c, err := parseVCard(card.GetVcard())
+	if c.Name == "" {
+		c.Name = strings.TrimSpace(card.GetDisplayName())
+	}
+	switch {
+	case errors.Is(err, errVCardNoNumber):
+		return "Sorry, that contact doesn't have a phone number we can use. Please send one that does, or type the number instead.", 0, true
+	case err != nil:
+		log.Printf("Reading contact card from %s failed: %v", cell, err)
+		return "Sorry, we couldn't read that contact. Please try sending it again, or type the number instead.", 0, true
+	}
+	orderID, found, err := contactOrder(cc.db, cell)
+	if err != nil {
+		return cc.apology(incidentOrderLookup, cell, 0, err, "Delivery contact: finding the order",
+			"Sorry, something went wrong looking up your order. Please try again."), 0, true
+	}
+	if !found {
+		return "Thanks! You don't have an order on the go to add a delivery contact to, so please send the contact again once you've ordered.", 0, true
+	}
+	if err := clearOrderPrompt(cc.db, cell, flowContact, orderID); err == nil {
+		err = addPrompt(cc.db, cell, flowContact, orderID, "", c)
+	}
+	if err != nil {
+		return cc.apology(incidentDeliveryContact, cell, orderID, err, "Delivery contact: saving the prompt",
+			"Sorry, something went wrong. Please send the contact again."), orderID, true
+	}
+	reply = contactPrompt(c, cc.orderRef(orderID))
+	if more {
+		reply = "You sent several contacts, so we've taken the first.\n\n" + reply
+	}
+	return reply, orderID, true
+}
+
+// contactReply takes YES or NO to the delivery contact on offer. Anything
+// else is left to the rest of the pipeline, the offer standing until it
+// times out.
+func contactReply(cc *commandContext, cell, msg string) (reply string, orderID int64, ok bool) {
+	answer := normalizeCommand(msg)
+	if answer != confirmCommand && answer != contactDeclineCommand {
+		return "", 0, false
+	}
+	prompts, err := loadPrompts(cc.db, cell, flowContact)
+	if err != nil {
+		log.Printf("Reading contact prompt of %s failed: %v", cell, err)
+		return "", 0, false
+	}
+	if len(prompts) == 0 {
+		return "", 0, false
+	}
+	p := prompts[0]
+	var c deliveryContact
+	if err := json.Unmarshal(p.Data, &c); err != nil {
+		log.Printf("Reading contact prompt %d failed: %v", p.ID, err)
+		return "", 0, false
+	}
+	if err := deletePrompt(cc.db, p); err != nil {
+		log.Printf("Dropping contact prompt %d failed: %v", p.ID, err)
+	}
+	if answer == contactDeclineCommand {
+		return fmt.Sprintf("OK, order %s keeps your own number as the contact.", cc.orderRef(p.OrderID)), p.OrderID, true
+	}
+	if err := setDeliveryContact(cc.db, p.OrderID, c); err != nil {
+		return cc.apology(incidentDeliveryContact, cell, p.OrderID, err, "Delivery contact: saving the contact",
+			"Sorry, something went wrong saving the contact. Please send it again."), p.OrderID, true
+	}
+	log.Printf("Order %d delivery contact set by %s", p.OrderID, cell)
+	return fmt.Sprintf("Done, %s is the delivery contact for order %s. We'll let them know when it's ready.", c, cc.orderRef(p.OrderID)), p.OrderID, true
+}
+
+func setDeliveryContact(db *sql.DB, orderID int64, c deliveryContact) error {
+	name, err := sealField(fieldContact, c.Name)
+	if err != nil {
+		return err
+	}
+	cell, err := sealField(fieldContact, c.CellNumber)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO order_meta (order_id, pricelist_version, delivery_contact_name, delivery_contact_cell) VALUES ($1, 0, $2, $3)
+		ON CONFLICT (order_id) DO UPDATE SET delivery_contact_name = EXCLUDED.delivery_contact_name,
+			delivery_contact_cell = EXCLUDED.delivery_contact_cell, updated_at = now()`, orderID, name, cell)
+	return err
+}
+
+func getDeliveryContact(db *sql.DB, orderID int64) (deliveryContact, bool, error) {
+	var c deliveryContact
+	err := db.QueryRow(`SELECT delivery_contact_name, delivery_contact_cell FROM order_meta WHERE order_id = $1`, orderID).
+		Scan(&c.Name, &c.CellNumber)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && c.CellNumber == "") {
+		return deliveryContact{}, false, nil
+	}
+	if err != nil {
+		return deliveryContact{}, false, err
+	}
+	if c.Name, err = openField(fieldContact, c.Name); err != nil {
+		return deliveryContact{}, false, err
+	}
+	if c.CellNumber, err = openField(fieldContact, c.CellNumber); err != nil {
+		return deliveryContact{}, false, err
+	}
+	return c, true, nil
+}
+
+func askContact(cc *commandContext, _ versionedPricelist, p savedPrompt) string {
+	var c deliveryContact
+	if err := json.Unmarshal(p.Data, &c); err != nil {
+		return ""
+	}
+	return contactPrompt(c, cc.orderRef(p.OrderID))
+}
+
+func abandonContact(cc *commandContext, p savedPrompt) string {
+	if err := clearOrderPrompt(cc.db, p.Cell, flowContact, p.OrderID); err != nil {
+		log.Printf("Dropping contact prompt of order %d failed: %v", p.OrderID, err)
+	}
+	return fmt.Sprintf("We didn't hear back about the delivery contact, so order %s keeps your own number. Send the contact again if you'd still like to change it.", cc.orderRef(p.OrderID))
+}
+
+// notifyReady tells whoever is receiving the order that it's ready: the
+// delivery contact when there is one, the customer otherwise.
+func (cc *commandContext) notifyReady(order orderSummary) {
+	c, found, err := getDeliveryContact(cc.db, order.ID)
+	if err != nil {
+		log.Printf("Reading delivery contact of order %d failed: %v", order.ID, err)
+	}
+	to, text := order.CellNumber, fmt.Sprintf("Your order %s is ready.", order.reference())
+	if found {
+		greeting := "Hi"
+		if c.Name != "" {
+			greeting += " " + c.Name
+		}
+		to, text = c.CellNumber, fmt.Sprintf("%s, order %s is ready for you.", greeting, order.reference())
+	}
+	jid, err := resolveJID(to)
+	if err != nil {
+		log.Printf("Telling order %d is ready failed: %v", order.ID, err)
+		return
+	}
+	cc.sender.Deliver(outboundMessage{To: jid, Text: text, Priority: priorityNotify, OrderID: order.ID, Kind: outboundOrderReady})
+}
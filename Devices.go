@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow/store/sqlstore"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// More than one WhatsApp number can be paired into a deployment, say one
+// for orders and one for support. Each paired device gets its own client,
+// and a customer is answered from the number they last wrote to: every
+// inbound message records its chat's device in conversation_devices, and
+// sends to that chat, replies and later follow-ups alike, go out through
+// it while it is connected. Everything else, and any chat no device has
+// been recorded for, goes through the primary device: the one paired as
+// HOST_NUMBER, or the first in the store. With a single device nothing is
+// recorded and it is used for everything, as before.
+//
+// POST /api/devices/pair pairs another device while running; GET on the
+// same path shows the QR code to scan and how far pairing got.
+
+const devicePairTimeout = 10 * time.Minute
+
+// deviceSet is the paired clients, the primary first.
+type deviceSet struct {
+	db        *sql.DB
+	container *sqlstore.Container
+	newClient clientFactory
+	// attach sets up a client paired while running as the ones paired at
+	// startup were.
+	attach func(waClient)
+
+	mu      sync.RWMutex
+	clients []waClient
+	routes  map[string]string // chat JID → device JID, "" for the primary
+	pairing *devicePairing
+}
+
+// loadDevices builds a client for every device in the store, or for a new
+// one to pair when there is none.
+func loadDevices(db *sql.DB, container *sqlstore.Container, hostNumber string, newClient clientFactory) (*deviceSet, error) {
+	stores, err := container.GetAllDevices()
+	if err != nil {
+		return nil, err
+	}
+	if len(stores) == 0 {
+		stores = append(stores, container.NewDevice())
+	}
+	sort.SliceStable(stores, func(i, j int) bool {
+		hi := stores[i].ID != nil && stores[i].ID.User == hostNumber
+		hj := stores[j].ID != nil && stores[j].ID.User == hostNumber
+		return hi && !hj
+	})
+	d := &deviceSet{db: db, container: container, newClient: newClient, routes: map[string]string{}}
+	for _, s := range stores {
+		d.add(newClient(s))
+	}
+	return d, nil
+}
+
+func (d *deviceSet) add(c waClient) {
+	d.mu.Lock()
+	d.clients = append(d.clients, c)
+	d.mu.Unlock()
+	metrics.GaugeFunc("menubot_whatsapp_device_connected", "1 while the paired WhatsApp device is connected.", func() float64 {
+		if c.IsConnected() {
+			return 1
+		}
+		return 0
+	}, "device", deviceName(c))
+}
+
+// deviceJID is the device's own JID, "" until it is paired.
+func deviceJID(c waClient) string {
+	if c.ID() == nil {
+		return ""
+	}
+	return c.ID().String()
+}
+
+// deviceName is how the device is shown: its number, or "unpaired".
+func deviceName(c waClient) string {
+	if c.ID() == nil {
+		return "unpaired"
+	}
+	return c.ID().User
+}
+
+func (d *deviceSet) primary() waClient {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.clients[0]
+}
+
+func (d *deviceSet) all() []waClient {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return append([]waClient(nil), d.clients...)
+}
+
+func (d *deviceSet) multiple() bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.clients) > 1
+}
+
+// tag records that chat, and the customer cell behind it, last wrote to
+// c, and returns c's JID for the message.
+func (d *deviceSet) tag(c waClient, chat types.JID, cell string) string {
+	device := deviceJID(c)
+	if !d.multiple() || device == "" {
+		return device
+	}
+	route := device
+	if c == d.primary() {
+		route = ""
+	}
+	chats := []string{chat.String()}
+	if jid, err := resolveJID(cell); err == nil && jid.String() != chats[0] {
+		chats = append(chats, jid.String())
+	}
+	for _, to := range chats {
+		d.mu.RLock()
+		known, ok := d.routes[to]
+		d.mu.RUnlock()
+		if ok && known == route {
+			continue
+		}
+		_, err := d.db.Exec(`INSERT INTO conversation_devices (chat, device) VALUES ($1, $2)
+			ON CONFLICT (chat) DO UPDATE SET device = EXCLUDED.device, updated_at = now()`, to, route)
+		if err != nil {
+			log.Printf("Recording the device %s wrote to failed: %v", to, err)
+			continue
+		}
+		d.mu.Lock()
+		d.routes[to] = route
+		d.mu.Unlock()
+	}
+	return device
+}
+
+// clientFor is the client to send to a chat through.
+func (d *deviceSet) clientFor(to types.JID) waClient {
+	primary := d.primary()
+	if !d.multiple() {
+		return primary
+	}
+	chat := to.String()
+	d.mu.RLock()
+	route, ok := d.routes[chat]
+	d.mu.RUnlock()
+	if !ok {
+		err := d.db.QueryRow(`SELECT device FROM conversation_devices WHERE chat = $1`, chat).Scan(&route)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Reading the device of %s failed, sending from the primary: %v", chat, err)
+			return primary
+		}
+		d.mu.Lock()
+		d.routes[chat] = route
+		d.mu.Unlock()
+	}
+	if route == "" {
+		return primary
+	}
+	for _, c := range d.all() {
+		if deviceJID(c) == route {
+			if c.IsConnected() && c.IsLoggedIn() {
+				return c
+			}
+			break
+		}
+	}
+	return primary
+}
+
+// connectOthers connects the paired devices besides the primary, which
+// connectWhatsApp has taken care of.
+func (d *deviceSet) connectOthers() {
+	for _, c := range d.all()[1:] {
+		if c.ID() == nil {
+			continue
+		}
+		if err := c.Connect(); err != nil {
+			log.Printf("Connecting WhatsApp device %s failed: %v", c.ID(), err)
+		}
+	}
+}
+
+func (d *deviceSet) disconnectAll() {
+	for _, c := range d.all() {
+		c.Disconnect()
+	}
+}
+
+type deviceStatus struct {
+	JID     string `json:"jid"`
+	Number  string `json:"number"`
+	Primary bool   `json:"primary"`
+	State   string `json:"state"`
+}
+
+func clientState(c waClient) string {
+	switch {
+	case c.IsConnected() && c.IsLoggedIn():
+		return "logged in"
+	case c.IsConnected():
+		return "connected"
+	}
+	return "disconnected"
+}
+
+// Status is the state of each device, the primary first.
+func (d *deviceSet) Status() []deviceStatus {
+	var status []deviceStatus
+	for i, c := range d.all() {
+		status = append(status, deviceStatus{JID: deviceJID(c), Number: deviceName(c), Primary: i == 0, State: clientState(c)})
+	}
+	return status
+}
+
+// Summary is Status for the admin status command, "" with one device.
+func (d *deviceSet) Summary() string {
+	if !d.multiple() {
+		return ""
+	}
+	var parts []string
+	for _, s := range d.Status() {
+		part := s.Number + " " + s.State
+		if s.Primary {
+			part = s.Number + " (primary) " + s.State
+		}
+		parts = append(parts, part)
+	}
+	return "Devices: " + strings.Join(parts, ", ")
+}
+
+// devicePairing is a pairing started with POST /api/devices/pair.
+type devicePairing struct {
+	State     string    `json:"state"` // waiting, paired or failed
+	Code      string    `json:"code,omitempty"`
+	JID       string    `json:"jid,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+var errPairingInProgress = errors.New("a device is already being paired")
+
+// pair starts pairing a new device. The QR codes to scan show up in
+// Pairing as they are generated.
+func (d *deviceSet) pair(rounds int) (devicePairing, error) {
+	d.mu.Lock()
+	if d.pairing != nil && d.pairing.State == "waiting" {
+		p := *d.pairing
+		d.mu.Unlock()
+		return p, errPairingInProgress
+	}
+	d.pairing = &devicePairing{State: "waiting", StartedAt: time.Now()}
+	p := *d.pairing
+	d.mu.Unlock()
+
+	c := d.newClient(d.container.NewDevice())
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), devicePairTimeout)
+		defer cancel()
+		err := loginWithQR(ctx, c, rounds, func(code string) {
+			d.mu.Lock()
+			d.pairing.Code = code
+			d.mu.Unlock()
+		})
+		d.mu.Lock()
+		d.pairing.Code = ""
+		if err != nil {
+			d.pairing.State, d.pairing.Error = "failed", err.Error()
+			d.mu.Unlock()
+			log.Printf("Pairing another WhatsApp device failed: %v", err)
+			return
+		}
+		d.pairing.State, d.pairing.JID = "paired", deviceJID(c)
+		d.mu.Unlock()
+		log.Printf("Paired another WhatsApp device as %s", c.ID())
+		if d.attach != nil {
+			d.attach(c)
+		}
+		d.add(c)
+	}()
+	return p, nil
+}
+
+// Pairing is the pairing in progress or last finished, false when none
+// was started.
+func (d *deviceSet) Pairing() (devicePairing, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	if d.pairing == nil {
+		return devicePairing{}, false
+	}
+	return *d.pairing, true
+}
+
+// ListDevicesHandler serves GET /api/devices.
+func ListDevicesHandler(d *deviceSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, d.Status())
+	}
+}
+
+// PairDeviceHandler serves POST /api/devices/pair. Only the leader is
+// connected to WhatsApp, so only it can pair.
+func PairDeviceHandler(d *deviceSet, election *leaderElection, rounds int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !election.Leader() {
+			writeJSONError(w, http.StatusConflict, "only the leader instance can pair a device")
+			return
+		}
+		p, err := d.pair(rounds)
+		if errors.Is(err, errPairingInProgress) {
+			writeJSON(w, http.StatusConflict, p)
+			return
+		}
+		log.Printf("%s started pairing another WhatsApp device", staffFromContext(r.Context()).Name)
+		writeJSON(w, http.StatusAccepted, p)
+	}
+}
+
+// GetPairingHandler serves GET /api/devices/pair, polled for the QR code
+// to scan until the state is no longer waiting.
+func GetPairingHandler(d *deviceSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := d.Pairing()
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no pairing started, POST %s/devices/pair to start one", apiBaseURL))
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+	}
+}
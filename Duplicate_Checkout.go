@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// newOrderAnywayCommand overrides the duplicate checkout guard; it checks
+// out the current cart even though an identical one awaits payment.
+const newOrderAnywayCommand = "new order anyway"
+
+func isNewOrderAnyway(msg string) bool {
+	return normalizeCommand(msg) == newOrderAnywayCommand
+}
+
+// senderLocks serializes the handling of each sender's messages, so a
+// double-tapped checkout can't slip past the duplicate check while the
+// first is still being answered.
+type senderLocks struct {
+	mu    sync.Mutex
+	locks map[string]*senderLock
+}
+
+type senderLock struct {
+	sync.Mutex
+	users int
+}
+
+func newSenderLocks() *senderLocks {
+	return &senderLocks{locks: map[string]*senderLock{}}
+}
+
+// Lock blocks until sender's lock is free and returns its unlock function.
+func (s *senderLocks) Lock(sender string) (unlock func()) {
+	s.mu.Lock()
+	l, ok := s.locks[sender]
+	if !ok {
+		l = &senderLock{}
+		s.locks[sender] = l
+	}
+	l.users++
+	s.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		s.mu.Lock()
+		if l.users--; l.users == 0 {
+			delete(s.locks, sender)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// cartKey identifies a cart's contents regardless of line order or how
+// the quantities of an item were split across lines.
+func cartKey(lines []orderLine) string {
+	quantities := map[int]int{}
+	for _, line := range lines {
+		quantities[line.ItemID] += line.Quantity
+	}
+	parts := make([]string, 0, len(quantities))
+	for id, qty := range quantities {
+		if qty > 0 {
+			parts = append(parts, fmt.Sprintf("%d:%d", id, qty))
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+// paymentLinkIn returns the first PayFast link in reply, or "".
+func paymentLinkIn(reply, pfHost string) string {
+	host := pfHostname(pfHost)
+	for _, link := range linkPattern.FindAllString(reply, -1) {
+		if u, err := url.Parse(link); err == nil && u.Host == host {
+			return link
+		}
+	}
+	return ""
+}
+
+// recordCheckout remembers the payment link sent for an order, so a
+// duplicate checkout can be pointed back at it, and the base URL the link
+// calls back on.
+func recordCheckout(db dbtx, orderID int64, link, base string) error {
+	_, err := db.Exec(`INSERT INTO order_meta (order_id, pricelist_version, payment_link, callback_base, checked_out_at) VALUES ($1, 0, $2, $3, now())
+		ON CONFLICT (order_id) DO UPDATE SET payment_link = EXCLUDED.payment_link, callback_base = EXCLUDED.callback_base,
+			checked_out_at = EXCLUDED.checked_out_at, updated_at = now()`,
+		orderID, link, base)
+	return err
+}
+
+// pendingDuplicate finds another unpaid order of the customer's, checked
+// out within the window, with the same cart as orderID. It returns the
+// order and the payment link it was sent.
+func pendingDuplicate(db *sql.DB, cellNumber string, orderID int64, items string, window time.Duration) (int64, string, bool, error) {
+	lines, err := decodeOrderLines(items)
+	if err != nil || len(lines) == 0 {
+		return 0, "", false, err
+	}
+	want := cartKey(lines)
+
+	rows, err := db.Query(`SELECT o.`+orderIDColumn+`, COALESCE(o.`+orderItemsColumn+`::text, ''), m.payment_link
+		FROM `+orderTable+` o JOIN order_meta m ON m.order_id = o.`+orderIDColumn+`
+		WHERE o.`+orderCellColumn+` = $1 AND o.`+orderIDColumn+` <> $2 AND m.status = $3
+			AND m.payment_link <> '' AND m.checked_out_at >= $4
+		ORDER BY m.checked_out_at DESC`,
+		cellNumber, orderID, statusUnpaid, time.Now().Add(-window))
+	if err != nil {
+		return 0, "", false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var otherItems, link string
+		if err := rows.Scan(&id, &otherItems, &link); err != nil {
+			return 0, "", false, err
+		}
+		other, err := decodeOrderLines(otherItems)
+		if err != nil {
+			continue
+		}
+		if cartKey(other) == want {
+			return id, link, true, nil
+		}
+	}
+	return 0, "", false, rows.Err()
+}
+
+// resumeCheckoutReply answers a checkout with no cart when the customer's
+// latest order is checked out and still unpaid. MenuBotLib closes the order
+// and builds its link in writes of its own, so a checkout that failed or
+// crashed after that leaves a committed order whose link may never have
+// been recorded or reached the customer; checking out again hands them
+// that order's link, rebuilt if need be, rather than starting another. A
+// rebuilt link is only for what can still be ordered, see
+// resolveCheckedOutOrder.
+func resumeCheckoutReply(cc *commandContext, cellNumber, msg string) (string, int64, bool) {
+	if !isCheckoutCommand(msg) {
+		return "", 0, false
+	}
+	if _, _, open, err := openOrder(cc.db, cellNumber); err != nil || open {
+		return "", 0, false
+	}
+	order, found, err := latestOrder(cc.db, cellNumber)
+	if err != nil || !found || order.Status != statusUnpaid {
+		return "", 0, false
+	}
+	if lines, err := orderItems(cc.db, order.ID); err != nil || len(lines) == 0 {
+		return "", 0, false
+	}
+	var link string
+	err = cc.db.QueryRow(`SELECT payment_link FROM order_meta WHERE order_id = $1`, order.ID).Scan(&link)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Printf("Reading payment link of order %d failed: %v", order.ID, err)
+		return "", 0, false
+	}
+	if link == "" {
+		vp := cc.prclist.Snapshot().ForTier(customerTier(cc.db, cellNumber))
+		if reply, adjusted := resolveCheckedOutOrder(cc, vp, cellNumber, order.ID); adjusted {
+			return reply, order.ID, true
+		}
+		total, err := strconv.ParseFloat(order.Total, 64)
+		if err != nil {
+			log.Printf("Order %d has no usable total %q, not resuming its checkout", order.ID, order.Total)
+			return "", 0, false
+		}
+		base := cc.homebase.URL()
+		o := webOrder{ID: order.ID, Ref: order.reference(), CellNumber: cellNumber, Total: total}
+		if link, err = webPaymentLink(cc.db, withHomebase(newCheckoutInfo(cc.envVars), cc.envVars, base), cc.envVars.InstanceID, o); err != nil {
+			log.Printf("Rebuilding the payment link of order %d failed: %v", order.ID, err)
+			return "", 0, false
+		}
+		noteCallbackBase(cc, order.ID, base)
+		if err := recordCheckout(cc.db, order.ID, link, base); err != nil {
+			log.Printf("Recording checkout of order %d failed: %v", order.ID, err)
+			return "", 0, false
+		}
+		log.Printf("Order %d was closed without a recorded payment link, rebuilt it", order.ID)
+		metrics.Inc("menubot_checkouts_resumed_total", "Checkouts answered with the link of an order an earlier checkout closed.", "link", "rebuilt")
+	} else {
+		metrics.Inc("menubot_checkouts_resumed_total", "Checkouts answered with the link of an order an earlier checkout closed.", "link", "recorded")
+	}
+	reply := fmt.Sprintf("Your order %s is checked out and waiting for payment. Please pay here:\n%s", order.reference(), link)
+	return withSandboxWarning(reply, cc.envVars.PayFastMode, cc.envVars.PfHost), order.ID, true
+}
+
+// duplicateCheckoutReply answers a checkout of a cart identical to one
+// that was just checked out and is still unpaid, with the earlier payment
+// link instead of a new order. It returns false when the checkout should
+// go ahead.
+func duplicateCheckoutReply(db *sql.DB, cellNumber, msg string, envVars EnvVars) (string, bool) {
+	window := cfg().DuplicateCheckout
+	if window <= 0 || !isCheckoutCommand(msg) {
+		return "", false
+	}
+	orderID, items, found, err := openOrder(db, cellNumber)
+	if err != nil || !found {
+		return "", false
+	}
+	dupID, link, found, err := pendingDuplicate(db, cellNumber, orderID, items, window)
+	if err != nil {
+		log.Printf("Checking order %d for a duplicate checkout failed: %v", orderID, err)
+		return "", false
+	}
+	if !found {
+		return "", false
+	}
+	metrics.Inc("menubot_duplicate_checkouts_total", "Checkouts answered with an earlier identical order's payment link.")
+	ref, err := storedOrderRef(db, dupID)
+	if err != nil || ref == "" {
+		ref = strconv.FormatInt(dupID, 10)
+	}
+	reply := fmt.Sprintf("You already have a pending payment for this order (order %s). Please pay here:\n%s\n\n"+
+		"If you really want to place the same order again, reply \"%s\".", ref, link, newOrderAnywayCommand)
+	return withSandboxWarning(reply, envVars.PayFastMode, envVars.PfHost), true
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	defaultEscalationKeywords = "help,agent,human,complaint,wtf"
+	escalationHoldingMessage  = "Thanks, we've passed your message on. Someone from the shop will be with you shortly."
+	// escalationSnippetMessages is how many of the bot's recent messages to
+	// the customer are forwarded along with theirs.
+	escalationSnippetMessages = 3
+)
+
+// normalizeForMatch lowercases s and turns everything but letters and
+// digits, emoji included, into single spaces.
+func normalizeForMatch(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
+
+// matchEscalation returns the first keyword appearing in msg as whole
+// words, or "". Keywords must already be normalized.
+func matchEscalation(msg string, keywords []string) string {
+	padded := " " + normalizeForMatch(msg) + " "
+	for _, keyword := range keywords {
+		if strings.Contains(padded, " "+keyword+" ") {
+			return keyword
+		}
+	}
+	return ""
+}
+
+// escalations remembers when each customer was last forwarded to the
+// host, so repeated triggers within the takeover window aren't forwarded
+// again even if the takeover was released early.
+type escalations struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+func newEscalations() *escalations {
+	return &escalations{last: map[string]time.Time{}}
+}
+
+// claim reports whether cell may be forwarded at now, and if so starts a
+// new window.
+func (e *escalations) claim(cell string, now time.Time, window time.Duration) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for c, t := range e.last {
+		if now.Sub(t) >= window {
+			delete(e.last, c)
+		}
+	}
+	if _, ok := e.last[cell]; ok {
+		return false
+	}
+	e.last[cell] = now
+	return true
+}
+
+// recentBotMessages returns the last few messages we sent cell, oldest
+// first.
+func recentBotMessages(db *sql.DB, cell string, n int) ([]string, error) {
+	jid, err := resolveJID(cell)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(`SELECT body FROM outbound_messages WHERE recipient = $1 ORDER BY server_time DESC LIMIT $2`, jid.String(), n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var bodies []string
+	for rows.Next() {
+		var body string
+		if err := rows.Scan(&body); err != nil {
+			return nil, err
+		}
+		if body, err = openField(fieldMessageBody, body); err != nil {
+			return nil, err
+		}
+		bodies = append([]string{body}, bodies...)
+	}
+	return bodies, rows.Err()
+}
+
+func truncateRunes(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "…"
+	}
+	return s
+}
+
+// escalate hands the customer to a human when their message matches an
+// escalation keyword: it forwards the message to HOST_NUMBER and starts a
+// takeover. ok is false when the message doesn't escalate.
+func escalate(cc *commandContext, cell, msg string, now time.Time) (reply string, ok bool) {
+	rc := cfg()
+	keyword := matchEscalation(msg, rc.EscalationKeywords)
+	if keyword == "" {
+		return "", false
+	}
+	metrics.Inc("menubot_escalations_total", "Customer messages that matched an escalation keyword.")
+	if !cc.escalations.claim(cell, now, rc.EscalationTakeover) {
+		return escalationHoldingMessage, true
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Customer %s needs a human (matched %q):\n%s", cell, keyword, msg)
+	snippet, err := recentBotMessages(cc.db, cell, escalationSnippetMessages)
+	if err != nil {
+		log.Printf("Escalation: reading recent messages to %s failed: %v", cell, err)
+	}
+	if len(snippet) > 0 {
+		b.WriteString("\n\nLast bot replies:")
+		for _, body := range snippet {
+			b.WriteString("\n> " + truncateRunes(strings.ReplaceAll(body, "\n", " "), 200))
+		}
+	}
+	until := now.Add(rc.EscalationTakeover)
+	fmt.Fprintf(&b, "\n\nThe bot is silent towards them until %s; send \"release %s\" from the admin number to hand back sooner.",
+		until.In(rc.BusinessHours.Location).Format("15:04"), cell)
+	cc.sender.Send(cc.envVars.HostNumber, b.String(), priorityNotify)
+
+	if err := cc.takeovers.Start(cell, until); err != nil {
+		log.Printf("Escalation: %v", err)
+	}
+	return escalationHoldingMessage, true
+}
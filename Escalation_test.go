@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMatchEscalation(t *testing.T) {
+	var keywords []string
+	for _, k := range strings.Split(defaultEscalationKeywords+",speak to someone,Manager!", ",") {
+		keywords = append(keywords, normalizeForMatch(k))
+	}
+	tests := []struct {
+		msg  string
+		want string
+	}{
+		{"help", "help"},
+		{"HELP", "help"},
+		{"Help!!!", "help"},
+		{"🆘help🆘", "help"},
+		{"I need help with my order", "help"},
+		{"can I talk to an agent please", "agent"},
+		{"WTF 😡😡", "wtf"},
+		{"I want to make a complaint.", "complaint"},
+		{"let me speak   to\nsomeone", "speak to someone"},
+		{"where's the manager?", "manager"},
+		{"helpful bot", ""},
+		{"whelp", ""},
+		{"agents", ""},
+		{"1 x toast", ""},
+		{"😡", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			if got := matchEscalation(tt.msg, keywords); got != tt.want {
+				t.Errorf("matchEscalation(%q) = %q, want %q", tt.msg, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEscalationClaim(t *testing.T) {
+	const window = 30 * time.Minute
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	e := newEscalations()
+	tests := []struct {
+		name  string
+		cell  string
+		after time.Duration
+		want  bool
+	}{
+		{"first trigger", "27821234567", 0, true},
+		{"again at once", "27821234567", time.Minute, false},
+		{"another customer", "27829876543", time.Minute, true},
+		{"just inside the window", "27821234567", window - time.Second, false},
+		{"after the window", "27821234567", window, true},
+		{"again in the new window", "27821234567", window + time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := e.claim(tt.cell, start.Add(tt.after), window); got != tt.want {
+				t.Errorf("claim(%s, +%s) = %v, want %v", tt.cell, tt.after, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncateRunes(t *testing.T) {
+	tests := []struct {
+		in   string
+		n    int
+		want string
+	}{
+		{"short", 10, "short"},
+		{"exactly", 7, "exactly"},
+		{"too long", 3, "too…"},
+		{"héllo wörld", 5, "héllo…"},
+	}
+	for _, tt := range tests {
+		if got := truncateRunes(tt.in, tt.n); got != tt.want {
+			t.Errorf("truncateRunes(%q, %d) = %q, want %q", tt.in, tt.n, got, tt.want)
+		}
+	}
+}
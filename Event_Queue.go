@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/redis/go-redis/v9"
+)
+
+// EVENTS_BACKEND values.
+const (
+	eventsNone  = "none"
+	eventsNATS  = "nats"
+	eventsRedis = "redis"
+)
+
+const (
+	queueIOTimeout      = 5 * time.Second
+	queueReconnectFirst = time.Second
+	queueReconnectMax   = 30 * time.Second
+	// queueAttempts is how often an event the broker refused is sent
+	// before it is given up on as a dead letter.
+	queueAttempts = 3
+	// redisStreamMaxLen caps the stream so an idle consumer can't fill the
+	// server; Redis trims approximately, so it may run a little over.
+	redisStreamMaxLen = 100000
+)
+
+func validateEventsBackend(backend, rawURL string) error {
+	switch backend {
+	case eventsNone:
+		return nil
+	case eventsNATS, eventsRedis:
+	default:
+		return fmt.Errorf("EVENTS_BACKEND: must be nats, redis or none")
+	}
+	if rawURL == "" {
+		return fmt.Errorf("EVENTS_URL: required when EVENTS_BACKEND is %s", backend)
+	}
+	if u, err := url.Parse(rawURL); err != nil || u.Host == "" {
+		return fmt.Errorf("EVENTS_URL: must be a URL such as %s://localhost", backend)
+	}
+	if backend == eventsRedis {
+		if _, err := redis.ParseURL(rawURL); err != nil {
+			return fmt.Errorf("EVENTS_URL: %w", err)
+		}
+	}
+	return nil
+}
+
+// errEventRejected marks a publish the broker answered with an error,
+// rather than one lost with the connection.
+var errEventRejected = errors.New("broker refused the event")
+
+// queueConn is one connection to the broker.
+type queueConn interface {
+	publish(subject string, body []byte) error
+	Close() error
+}
+
+// queuePublisher publishes events to NATS or a Redis stream. Events wait in
+// a bounded buffer while the broker is unreachable; once that is full new
+// events are dropped and counted, so the message pipeline never blocks on
+// the broker.
+type queuePublisher struct {
+	backend string
+	subject string
+	buffer  chan eventEnvelope
+	dial    func() (queueConn, error)
+}
+
+func newQueuePublisher(backend, rawURL, subject string, size int) *queuePublisher {
+	p := &queuePublisher{
+		backend: backend,
+		subject: subject,
+		buffer:  make(chan eventEnvelope, size),
+		dial:    func() (queueConn, error) { return dialRedis(rawURL) },
+	}
+	if backend == eventsNATS {
+		p.dial = func() (queueConn, error) { return dialNATS(rawURL) }
+	}
+	go p.run()
+	return p
+}
+
+func (p *queuePublisher) Publish(env eventEnvelope) {
+	select {
+	case p.buffer <- env:
+	default:
+		metrics.Inc("menubot_events_dropped_total", "Events dropped because a sink's buffer was full.", "sink", p.backend)
+	}
+}
+
+func (p *queuePublisher) QueueDepth() int {
+	return len(p.buffer)
+}
+
+// connect dials until it succeeds, backing off between attempts. Only the
+// first failure of an outage is logged.
+func (p *queuePublisher) connect() queueConn {
+	wait := queueReconnectFirst
+	for attempt := 1; ; attempt++ {
+		conn, err := p.dial()
+		if err == nil {
+			if attempt > 1 {
+				log.Printf("Events: reconnected to %s after %d attempts", p.backend, attempt)
+			}
+			return conn
+		}
+		if attempt == 1 {
+			log.Printf("Events: connecting to %s failed, retrying: %v", p.backend, err)
+		}
+		time.Sleep(wait)
+		wait = min(wait*2, queueReconnectMax)
+	}
+}
+
+func (p *queuePublisher) run() {
+	conn := p.connect()
+	for env := range p.buffer {
+		body, err := json.Marshal(env)
+		if err != nil {
+			log.Printf("Events: encoding %s event failed: %v", env.Type, err)
+			continue
+		}
+		conn = p.publish(conn, env, body)
+	}
+}
+
+// publish sends one event and returns the connection to send the next on.
+// The event that hit a broken connection is published again once we've
+// reconnected, so an outage loses only what overflowed. One the broker
+// refuses, say for lack of permission, would be refused forever, so after
+// queueAttempts it is logged and counted as a dead letter instead.
+func (p *queuePublisher) publish(conn queueConn, env eventEnvelope, body []byte) queueConn {
+	for refused := 0; ; {
+		err := conn.publish(p.subject, body)
+		if err == nil {
+			metrics.Inc("menubot_events_published_total", "Events published to the message queue.", "backend", p.backend)
+			return conn
+		}
+		log.Printf("Events: publishing %s event %s to %s failed: %v", env.Type, env.ID, p.backend, err)
+		if errors.Is(err, errEventRejected) {
+			if refused++; refused >= queueAttempts {
+				log.Printf("Events: gave up on %s event %s after %s refused it %d times", env.Type, env.ID, p.backend, refused)
+				metrics.Inc("menubot_events_dead_total", "Events the message queue refused every time they were sent.", "backend", p.backend)
+				return conn
+			}
+			continue
+		}
+		conn.Close()
+		conn = p.connect()
+	}
+}
+
+// natsConn publishes with nats.go. Reconnecting is left to connect, so an
+// event is never buffered where a failure can't be seen.
+type natsConn struct {
+	nc *nats.Conn
+}
+
+func dialNATS(rawURL string) (queueConn, error) {
+	nc, err := nats.Connect(rawURL, nats.Name("menubot"), nats.Timeout(queueIOTimeout),
+		nats.FlusherTimeout(queueIOTimeout), nats.NoReconnect(),
+		// publish reports a refusal with the event it was for.
+		nats.ErrorHandler(func(*nats.Conn, *nats.Subscription, error) {}))
+	if err != nil {
+		return nil, err
+	}
+	return natsConn{nc: nc}, nil
+}
+
+func (c natsConn) publish(subject string, body []byte) error {
+	before := c.nc.LastError()
+	if err := c.nc.Publish(subject, body); err != nil {
+		return err
+	}
+	// The server doesn't answer a PUB, but it answers the flush's PING
+	// after any -ERR it had for it. Errors other than a refused publish
+	// close the connection, so the flush reports those.
+	if err := c.nc.FlushTimeout(queueIOTimeout); err != nil {
+		return err
+	}
+	if err := c.nc.LastError(); err != nil && err != before {
+		return fmt.Errorf("%w: %v", errEventRejected, err)
+	}
+	return nil
+}
+
+func (c natsConn) Close() error {
+	c.nc.Close()
+	return nil
+}
+
+// redisConn appends events to a Redis stream with XADD, waiting for each
+// reply, so a failed write is known before the next event is sent.
+type redisConn struct {
+	client *redis.Client
+}
+
+func dialRedis(rawURL string) (queueConn, error) {
+	opts, err := redis.ParseURL(rawURL) // checked by validateEventsBackend
+	if err != nil {
+		return nil, err
+	}
+	opts.DialTimeout, opts.ReadTimeout, opts.WriteTimeout = queueIOTimeout, queueIOTimeout, queueIOTimeout
+	// publish does the retrying, knowing which failures are worth it.
+	opts.MaxRetries = -1
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), queueIOTimeout)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return redisConn{client: client}, nil
+}
+
+func (c redisConn) publish(stream string, body []byte) error {
+	var env struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(body, &env)
+	ctx, cancel := context.WithTimeout(context.Background(), queueIOTimeout)
+	defer cancel()
+	err := c.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: redisStreamMaxLen,
+		Approx: true,
+		Values: []string{"type", env.Type, "event", string(body)},
+	}).Err()
+	var refused redis.Error
+	if errors.As(err, &refused) {
+		return fmt.Errorf("%w: %v", errEventRejected, err)
+	}
+	return err
+}
+
+func (c redisConn) Close() error {
+	return c.client.Close()
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeQueueConn answers each publish with the next of its results, then
+// with success.
+type fakeQueueConn struct {
+	results []error
+	sent    int
+	closed  bool
+}
+
+func (c *fakeQueueConn) publish(string, []byte) error {
+	if len(c.results) == 0 {
+		c.sent++
+		return nil
+	}
+	err := c.results[0]
+	c.results = c.results[1:]
+	return err
+}
+
+func (c *fakeQueueConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestQueuePublish(t *testing.T) {
+	broken := errors.New("connection reset")
+	refused := fmt.Errorf("%w: permissions violation", errEventRejected)
+	tests := []struct {
+		name       string
+		results    []error
+		reconnects int
+		sent       bool
+	}{
+		{name: "published", sent: true},
+		{name: "connection broke", results: []error{broken}, reconnects: 1, sent: true},
+		{name: "broke twice", results: []error{broken, broken}, reconnects: 2, sent: true},
+		{name: "refused once", results: []error{refused}, sent: true},
+		{name: "refused every time", results: []error{refused, refused, refused}},
+		{name: "refused after reconnecting", results: []error{broken, refused, refused, refused}, reconnects: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every connection shares the script, as if the broker were
+			// the same on every reconnect.
+			conn := &fakeQueueConn{results: tt.results}
+			dials := 0
+			p := &queuePublisher{backend: eventsNATS, subject: "menubot.events", dial: func() (queueConn, error) {
+				dials++
+				conn.closed = false
+				return conn, nil
+			}}
+			got := p.publish(conn, eventEnvelope{ID: "e1", Type: eventOrderPaid}, []byte(`{}`))
+			if dials != tt.reconnects {
+				t.Errorf("reconnected %d times, want %d", dials, tt.reconnects)
+			}
+			if got != conn || conn.closed {
+				t.Errorf("publish left the connection closed")
+			}
+			if sent := conn.sent == 1; sent != tt.sent {
+				t.Errorf("sent = %v, want %v", sent, tt.sent)
+			}
+		})
+	}
+}
+
+// fakeNATS is a NATS server that refuses publishing to one subject, the
+// way a server with permissions configured does: an -ERR and the
+// connection stays open.
+func fakeNATS(t *testing.T, denied string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveFakeNATS(conn, denied)
+		}
+	}()
+	return "nats://" + l.Addr().String()
+}
+
+func serveFakeNATS(conn net.Conn, denied string) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO {\"server_id\":\"fake\",\"version\":\"2.10.0\",\"proto\":1,\"max_payload\":1048576}\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+		case "PUB":
+			n, _ := strconv.Atoi(fields[len(fields)-1])
+			if _, err := io.CopyN(io.Discard, r, int64(n)+2); err != nil {
+				return
+			}
+			if fields[1] == denied {
+				fmt.Fprintf(conn, "-ERR 'Permissions Violation for Publish to \"%s\"'\r\n", denied)
+			}
+		}
+	}
+}
+
+func TestNATSRefusedPublish(t *testing.T) {
+	conn, err := dialNATS(fakeNATS(t, "menubot.denied"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tests := []struct {
+		subject string
+		refused bool
+	}{
+		{"menubot.events", false},
+		{"menubot.denied", true},
+		{"menubot.events", false},
+		{"menubot.denied", true},
+	}
+	for _, tt := range tests {
+		done := make(chan error, 1)
+		go func() { done <- conn.publish(tt.subject, []byte(`{"type":"order.paid"}`)) }()
+		select {
+		case err := <-done:
+			if refused := errors.Is(err, errEventRejected); refused != tt.refused || (err != nil && !refused) {
+				t.Errorf("publish to %s = %v, want refused %v", tt.subject, err, tt.refused)
+			}
+		case <-time.After(2 * queueIOTimeout):
+			t.Fatalf("publish to %s didn't return", tt.subject)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// With FIELD_ENCRYPTION_KEY set, customers' free text and contact details
+// are encrypted before they are written: order notes, which hold delivery
+// addresses, message bodies in the conversation log, takeover transcript,
+// outbound log and outbox, delivery contacts, customers' email addresses,
+// and stored ITNs, which carry the buyer's name and email.
+// Values are sealed with AES-256-GCM as "enc:<key id>:<base64>", so a key
+// can later be rotated without guessing which one a row was sealed with.
+// Plaintext still reads back as is, which keeps rows from before the key
+// was set working until migrateFieldEncryption has sealed them.
+//
+// The conversation log's normalized text would give the messages away, so
+// it is stored as a keyed hash instead: the conversation report can still
+// group identical messages, and takes the text it shows from a decrypted
+// example.
+
+const (
+	fieldCipherPrefix = "enc:"
+	fieldHashPrefix   = "hmac:"
+	fieldMigrateBatch = 500
+)
+
+// What a sealed value is, bound in as additional data so a value can't be
+// copied into a field of another kind.
+const (
+	fieldOrderNotes  = "order_notes"
+	fieldMessageBody = "message_body"
+	fieldGiftMessage = "gift_message"
+	fieldContact     = "delivery_contact"
+	fieldEmail       = "customer_email"
+	fieldITNPayload  = "itn_payload"
+)
+
+var fieldKeyIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,16}$`)
+
+type fieldCipher struct {
+	keyID   string
+	keys    map[string]cipher.AEAD
+	hashKey []byte
+}
+
+// fieldEncryption is set at startup, nil when FIELD_ENCRYPTION_KEY isn't.
+var fieldEncryption *fieldCipher
+
+// newFieldCipher takes a base64 32-byte key. It returns nil without a key.
+func newFieldCipher(keyID, key string) (*fieldCipher, error) {
+	if key == "" {
+		return nil, nil
+	}
+	if !fieldKeyIDPattern.MatchString(keyID) {
+		return nil, fmt.Errorf("FIELD_ENCRYPTION_KEY_ID: must be 1 to 16 letters, digits, - or _")
+	}
+	raw, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(raw) != 32 {
+		return nil, fmt.Errorf("FIELD_ENCRYPTION_KEY: must be 32 random bytes in base64, e.g. from openssl rand -base64 32")
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, raw)
+	mac.Write([]byte("menubot field hash"))
+	return &fieldCipher{keyID: keyID, keys: map[string]cipher.AEAD{keyID: aead}, hashKey: mac.Sum(nil)}, nil
+}
+
+// sealField encrypts value for storage. Without a key, and for empty
+// values, it returns value unchanged.
+func sealField(kind, value string) (string, error) {
+	c := fieldEncryption
+	if c == nil || value == "" {
+		return value, nil
+	}
+	aead := c.keys[c.keyID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generating nonce: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(value), []byte(kind))
+	return fieldCipherPrefix + c.keyID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openField decrypts a value written by sealField, and returns plaintext
+// as it is.
+func openField(kind, stored string) (string, error) {
+	rest, ok := strings.CutPrefix(stored, fieldCipherPrefix)
+	if !ok {
+		return stored, nil
+	}
+	keyID, data, _ := strings.Cut(rest, ":")
+	if fieldEncryption == nil {
+		return "", fmt.Errorf("value is encrypted with key %q but FIELD_ENCRYPTION_KEY is not set", keyID)
+	}
+	aead, ok := fieldEncryption.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("value is encrypted with unknown key %q", keyID)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(data)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("value is not valid ciphertext")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(kind))
+	if err != nil {
+		return "", fmt.Errorf("decrypting value: %w", err)
+	}
+	return string(plain), nil
+}
+
+// fieldHash stands in for a value that is only ever compared for
+// equality. Without a key it is the value itself.
+func fieldHash(value string) string {
+	c := fieldEncryption
+	if c == nil || value == "" || strings.HasPrefix(value, fieldHashPrefix) {
+		return value
+	}
+	mac := hmac.New(sha256.New, c.hashKey)
+	mac.Write([]byte(value))
+	return fieldHashPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// encryptedColumn is a column migrateFieldEncryption seals, with the
+// column hashed alongside it, if any.
+type encryptedColumn struct {
+	table, key, column, kind, hashed string
+}
+
+var encryptedColumns = []encryptedColumn{
+	{table: "order_meta", key: "order_id", column: "notes", kind: fieldOrderNotes},
+	{table: "conversation_log", key: "id", column: "body", kind: fieldMessageBody, hashed: "normalized"},
+	{table: "takeover_transcript", key: "id", column: "body", kind: fieldMessageBody},
+	{table: "outbound_messages", key: "message_id", column: "body", kind: fieldMessageBody},
+	{table: "outbox", key: "id", column: "body", kind: fieldMessageBody},
+	{table: "gift_orders", key: "order_id", column: "message", kind: fieldGiftMessage},
+	{table: "command_fallbacks_daily", key: "id", column: "text", kind: fieldMessageBody, hashed: "text_hash"},
+	{table: "order_meta", key: "order_id", column: "delivery_contact_name", kind: fieldContact},
+	{table: "order_meta", key: "order_id", column: "delivery_contact_cell", kind: fieldContact},
+	{table: "customer_profiles", key: "cell_number", column: "email", kind: fieldEmail},
+	{table: "payment_notifications", key: "id", column: "payload", kind: fieldITNPayload},
+}
+
+func (col encryptedColumn) String() string {
+	return col.table + "." + col.column
+}
+
+// migrateFieldEncryption seals the rows written before FIELD_ENCRYPTION_KEY
+// was set, batch rows per transaction, and reports how many it sealed in
+// each column. It can be stopped and run again at any point.
+func migrateFieldEncryption(db *sql.DB, batch int) (map[string]int, error) {
+	if fieldEncryption == nil {
+		return nil, fmt.Errorf("FIELD_ENCRYPTION_KEY is not set")
+	}
+	sealed := map[string]int{}
+	for _, col := range encryptedColumns {
+		for {
+			n, err := migrateFieldBatch(db, col, batch)
+			if err != nil {
+				return sealed, fmt.Errorf("%s: %w", col, err)
+			}
+			sealed[col.String()] += n
+			if n < batch {
+				break
+			}
+		}
+		log.Printf("Field encryption: sealed %d rows of %s", sealed[col.String()], col)
+	}
+	return sealed, nil
+}
+
+func migrateFieldBatch(db *sql.DB, col encryptedColumn, batch int) (int, error) {
+	hashed := "''"
+	if col.hashed != "" {
+		hashed = col.hashed
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`SELECT `+col.key+`::text, `+col.column+`, `+hashed+` FROM `+col.table+`
+		WHERE `+col.column+` <> '' AND `+col.column+` NOT LIKE '`+fieldCipherPrefix+`%'
+		LIMIT $1 FOR UPDATE`, batch)
+	if err != nil {
+		return 0, err
+	}
+	type plainRow struct{ key, value, hashed string }
+	var due []plainRow
+	for rows.Next() {
+		var r plainRow
+		if err := rows.Scan(&r.key, &r.value, &r.hashed); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, r := range due {
+		value, err := sealField(col.kind, r.value)
+		if err != nil {
+			return 0, err
+		}
+		if col.hashed == "" {
+			_, err = tx.Exec(`UPDATE `+col.table+` SET `+col.column+` = $2 WHERE `+col.key+` = $1`, r.key, value)
+		} else {
+			_, err = tx.Exec(`UPDATE `+col.table+` SET `+col.column+` = $2, `+col.hashed+` = $3 WHERE `+col.key+` = $1`,
+				r.key, value, fieldHash(r.hashed))
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(due), tx.Commit()
+}
+
+type encryptFieldsResponse struct {
+	Sealed map[string]int `json:"sealed"`
+}
+
+// EncryptFieldsHandler serves POST /api/encryption/migrate?batch=N.
+func EncryptFieldsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		batch := fieldMigrateBatch
+		if raw := r.URL.Query().Get("batch"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 {
+				writeJSONError(w, http.StatusBadRequest, "batch must be a positive number")
+				return
+			}
+			batch = n
+		}
+		sealed, err := migrateFieldEncryption(db, batch)
+		if err != nil {
+			log.Printf("Field encryption migration failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "migration failed: "+err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, encryptFieldsResponse{Sealed: sealed})
+	}
+}
+
+// adminEncryptFields handles "encrypt fields".
+func adminEncryptFields(cc *commandContext, _ []string) string {
+	sealed, err := migrateFieldEncryption(cc.db, fieldMigrateBatch)
+	if err != nil {
+		log.Printf("Field encryption migration failed: %v", err)
+		return "Encrypting stored customer details failed: " + err.Error()
+	}
+	var b strings.Builder
+	b.WriteString("Encrypted existing rows:")
+	for _, col := range encryptedColumns {
+		fmt.Fprintf(&b, "\n%s: %d", col, sealed[col.String()])
+	}
+	return b.String()
+}
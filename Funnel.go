@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JeremyJalpha/MenuBot_WebAPI/httpapi"
+)
+
+// Funnel stages, in the order customers pass through them.
+const (
+	funnelMenuShown    = "menu_shown"
+	funnelCartStarted  = "cart_started"
+	funnelCheckout     = "checkout_issued"
+	funnelReturnHit    = "return_url_hit"
+	funnelITNConfirmed = "itn_confirmed"
+)
+
+var funnelStages = []string{funnelMenuShown, funnelCartStarted, funnelCheckout, funnelReturnHit, funnelITNConfirmed}
+
+// returnOrderParam carries the order ID on the PayFast return URL, so the
+// return hit can be attributed to its order whether or not the ITN has
+// already arrived.
+const returnOrderParam = httpapi.ReturnOrderParam
+
+// recordFunnel stores a funnel event. Order-keyed stages are recorded once
+// per order, so repeated messages or page reloads don't inflate the counts;
+// menu views are keyed by customer and counted per customer in reports.
+func recordFunnel(db *sql.DB, stage, cellNumber string, orderID int64) {
+	res, err := db.Exec(`INSERT INTO funnel_events (stage, cell_number, order_id) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING`, stage, cellNumber, nullOrderID(orderID))
+	if err != nil {
+		log.Printf("Recording %s funnel event failed: %v", stage, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		metrics.Inc("menubot_funnel_events_total", "Customers reaching each stage of the ordering funnel.", "stage", stage)
+	}
+}
+
+// recordReplyFunnel works out which stages a bot reply represents. The
+// menu and the payment link are recognised by their content, since
+// MenuBotLib doesn't report what it answered.
+func recordReplyFunnel(db *sql.DB, cellNumber, reply string, orderID int64, hasItems bool, pfHost string) {
+	if strings.Contains(reply, prclstPreamble) {
+		recordFunnel(db, funnelMenuShown, cellNumber, 0)
+	}
+	if orderID == 0 {
+		return
+	}
+	if hasItems {
+		recordFunnel(db, funnelCartStarted, cellNumber, orderID)
+	}
+	if strings.Contains(reply, pfHostname(pfHost)) {
+		recordFunnel(db, funnelCheckout, cellNumber, orderID)
+	}
+}
+
+// withReturnOrder adds the order ID to the return URL handed to PayFast.
+func withReturnOrder(returnURL string, orderID int64) string {
+	sep := "?"
+	if strings.Contains(returnURL, "?") {
+		sep = "&"
+	}
+	return returnURL + sep + returnOrderParam + "=" + strconv.FormatInt(orderID, 10)
+}
+
+type funnelStageReport struct {
+	Stage string `json:"stage"`
+	Count int64  `json:"count"`
+	// OfPrevious and OfFirst are conversion percentages relative to the
+	// previous stage and to the top of the funnel.
+	OfPrevious float64 `json:"of_previous_pct"`
+	OfFirst    float64 `json:"of_first_pct"`
+}
+
+type funnelReport struct {
+	From   time.Time           `json:"from"`
+	To     time.Time           `json:"to"`
+	Stages []funnelStageReport `json:"stages"`
+	// Sources breaks down customers who arrived from an ad or the catalog.
+	Sources []adSourceReport `json:"sources"`
+}
+
+func buildFunnelReport(db *sql.DB, from, to time.Time) (funnelReport, error) {
+	rows, err := db.Query(`SELECT stage, count(DISTINCT COALESCE(order_id::text, cell_number)) FROM funnel_events
+		WHERE occurred_at >= $1 AND occurred_at < $2 GROUP BY stage`, from, to)
+	if err != nil {
+		return funnelReport{}, err
+	}
+	defer rows.Close()
+	counts := map[string]int64{}
+	for rows.Next() {
+		var stage string
+		var n int64
+		if err := rows.Scan(&stage, &n); err != nil {
+			return funnelReport{}, err
+		}
+		counts[stage] = n
+	}
+	if err := rows.Err(); err != nil {
+		return funnelReport{}, err
+	}
+
+	report := funnelReport{From: from, To: to}
+	pct := func(n, of int64) float64 {
+		if of == 0 {
+			return 0
+		}
+		return float64(n) * 100 / float64(of)
+	}
+	first := counts[funnelStages[0]]
+	for i, stage := range funnelStages {
+		previous := first
+		if i > 0 {
+			previous = counts[funnelStages[i-1]]
+		}
+		report.Stages = append(report.Stages, funnelStageReport{
+			Stage:      stage,
+			Count:      counts[stage],
+			OfPrevious: pct(counts[stage], previous),
+			OfFirst:    pct(counts[stage], first),
+		})
+	}
+	if report.Sources, err = buildAdSourceReport(db, from, to); err != nil {
+		return funnelReport{}, err
+	}
+	return report, nil
+}
+
+// parseReportTime accepts RFC 3339 or a plain date in the business timezone.
+func parseReportTime(raw string, def time.Time) (time.Time, error) {
+	if raw == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", raw, cfg().BusinessHours.Location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is not a date (2006-01-02) or RFC 3339 time", raw)
+	}
+	return t, nil
+}
+
+// FunnelReportHandler serves GET /api/reports/funnel?from=&to=, defaulting
+// to the last 30 days.
+func FunnelReportHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		from, err := parseReportTime(r.URL.Query().Get("from"), now.AddDate(0, 0, -30))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "from: "+err.Error())
+			return
+		}
+		to, err := parseReportTime(r.URL.Query().Get("to"), now)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "to: "+err.Error())
+			return
+		}
+		report, err := buildFunnelReport(db, from, to)
+		if err != nil {
+			log.Printf("Building funnel report failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "building report failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// "gift to <number> [message]" makes the customer's order a gift: they pay
+// as usual, and once it is paid the recipient is asked for a delivery
+// address and slot, or can decline. The pick list waits for the address.
+//
+// The recipient may never have messaged us. What we send them is about the
+// order they were given, not marketing, so it doesn't touch their consent:
+// they are never opted in or added to the subscribers. Each party's
+// messages stay under their own number; the order links the two through
+// gift_orders, and each party's export holds only their side of it.
+
+// Gift states, in the order they happen.
+const (
+	giftPending  = "pending"  // attached, order not paid yet
+	giftNotified = "notified" // recipient asked for their address
+	giftAddress  = "address"  // recipient asked for a slot
+	giftAccepted = "accepted"
+	giftDeclined = "declined"
+	giftLapsed   = "lapsed" // recipient never answered
+)
+
+const (
+	// giftCountryCode stands in for the leading 0 of a local number.
+	giftCountryCode = "27"
+	maxGiftMessage  = 300
+	maxGiftSlot     = 100
+	// giftReplyWindow is how long after the notice the recipient's replies
+	// are taken as their answer.
+	giftReplyWindow = 7 * 24 * time.Hour
+)
+
+var giftDeclineWords = map[string]bool{"decline": true, "no": true, "no thanks": true, "nee": true, "nee dankie": true}
+
+type giftOrder struct {
+	OrderID   int64
+	Payer     string
+	Recipient string
+	Message   string
+	State     string
+}
+
+// normalizeGiftNumber turns a number as a customer types it, e.g.
+// "082 123 4567" or "+27 (82) 123-4567", into the form the bot sees on
+// inbound messages.
+func normalizeGiftNumber(raw string) (string, error) {
+	number := strings.NewReplacer("+", "", " ", "", "-", "", "(", "", ")", "", ".", "").Replace(raw)
+	switch {
+	case strings.HasPrefix(number, "00"):
+		number = number[2:]
+	case strings.HasPrefix(number, "0"):
+		number = giftCountryCode + number[1:]
+	}
+	if !msisdnPattern.MatchString(number) {
+		return "", fmt.Errorf("%q is not a phone number", raw)
+	}
+	return number, nil
+}
+
+func getGift(db dbtx, orderID int64) (giftOrder, bool, error) {
+	g := giftOrder{OrderID: orderID}
+	err := db.QueryRow(`SELECT payer_cell, recipient_cell, message, state FROM gift_orders WHERE order_id = $1`, orderID).
+		Scan(&g.Payer, &g.Recipient, &g.Message, &g.State)
+	if errors.Is(err, sql.ErrNoRows) {
+		return giftOrder{}, false, nil
+	}
+	if err != nil {
+		return giftOrder{}, false, err
+	}
+	g.Message, err = openField(fieldGiftMessage, g.Message)
+	return g, err == nil, err
+}
+
+// customerGift handles "gift to <number> [message]" and "gift off".
+func customerGift(cc *commandContext, sender string, args []string) string {
+	usage := "Send \"gift to\" followed by their number and a message if you like, e.g. \"gift to 0821234567 Happy birthday!\". Send \"gift off\" to undo it."
+	orderID, _, found, err := editableOrder(cc.db, sender)
+	if err != nil {
+		return cc.apology(incidentOrderLookup, sender, 0, err, "Gift: finding the order",
+			"Sorry, something went wrong looking up your order. Please try again.")
+	}
+	if len(args) == 1 && strings.EqualFold(args[0], "off") {
+		if !found {
+			return "You don't have an unpaid order to change."
+		}
+		res, err := cc.db.Exec(`DELETE FROM gift_orders WHERE order_id = $1 AND state = $2`, orderID, giftPending)
+		if err != nil {
+			return cc.apology(incidentGiftSave, sender, orderID, err, "Gift: removing the gift",
+				"Sorry, something went wrong. Please try again.")
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Sprintf("Order %s isn't a gift.", cc.orderRef(orderID))
+		}
+		return fmt.Sprintf("Order %s is no longer a gift.", cc.orderRef(orderID))
+	}
+	if len(args) < 2 || !strings.EqualFold(args[0], "to") {
+		return usage
+	}
+	if !found {
+		return "Add something to your cart first, then send \"gift to\" and their number."
+	}
+	recipient, err := normalizeGiftNumber(args[1])
+	if err != nil {
+		return usage
+	}
+	for _, own := range []string{sender, cc.envVars.HostNumber, cc.envVars.AdminNumber} {
+		if n, err := canonicalNumber(own); err == nil && n == recipient {
+			return "Please send the gift to someone else's number."
+		}
+	}
+	message := strings.Join(args[2:], " ")
+	if len([]rune(message)) > maxGiftMessage {
+		return fmt.Sprintf("Please keep the gift message under %d characters.", maxGiftMessage)
+	}
+	if _, err := cc.checkRecipient(types.NewJID(recipient, types.DefaultUserServer)); errors.Is(err, errNotOnWhatsApp) {
+		return fmt.Sprintf("%s isn't on WhatsApp, so we can't ask them for their address.", args[1])
+	}
+	sealed, err := sealField(fieldGiftMessage, message)
+	if err == nil {
+		_, err = cc.db.Exec(`INSERT INTO gift_orders (order_id, payer_cell, recipient_cell, message) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (order_id) DO UPDATE SET recipient_cell = EXCLUDED.recipient_cell, message = EXCLUDED.message
+			WHERE gift_orders.state = '`+giftPending+`'`,
+			orderID, sender, recipient, sealed)
+	}
+	if err != nil {
+		return cc.apology(incidentGiftSave, sender, orderID, err, "Gift: attaching the gift",
+			"Sorry, something went wrong. Please try again.")
+	}
+	log.Printf("%s made order %d a gift for %s", sender, orderID, maskPhoneNumber(recipient))
+	return fmt.Sprintf("Order %s is now a gift for %s. Once it's paid we'll ask them for their delivery address and keep you posted.\nSend \"%s\" for a payment link if you haven't yet.",
+		cc.orderRef(orderID), recipient, checkoutCommands[0])
+}
+
+// giftCheckoutNote reminds the payer at checkout who the order is for.
+func giftCheckoutNote(db *sql.DB, orderID int64) string {
+	g, found, err := getGift(db, orderID)
+	if err != nil {
+		log.Printf("Reading gift of order %d failed: %v", orderID, err)
+	}
+	if !found || g.State != giftPending {
+		return ""
+	}
+	return fmt.Sprintf("This order is a gift for %s; we'll message them once it's paid.", g.Recipient)
+}
+
+// payerName is what the recipient knows the payer as: their WhatsApp name,
+// or failing that the end of their number.
+func (cc *commandContext) payerName(cell string) string {
+	if cc.client != nil && cc.client.Contacts() != nil {
+		if contact, err := cc.client.Contacts().GetContact(types.NewJID(cell, types.DefaultUserServer)); err == nil {
+			if name := contactName(contact); name != "" {
+				return name
+			}
+		}
+	}
+	return "The customer on " + maskPhoneNumber(cell)
+}
+
+// notifyGift tells the recipient of a paid gift order about it. It reports
+// false for orders that aren't gifts.
+func (cc *commandContext) notifyGift(orderID int64) bool {
+	g, found, err := getGift(cc.db, orderID)
+	if err != nil {
+		log.Printf("Reading gift of order %d failed: %v", orderID, err)
+		return false
+	}
+	if !found {
+		return false
+	}
+	res, err := cc.db.Exec(`UPDATE gift_orders SET state = $2, notified_at = now() WHERE order_id = $1 AND state = $3`,
+		orderID, giftNotified, giftPending)
+	if err != nil {
+		log.Printf("Marking gift of order %d notified failed: %v", orderID, err)
+		return true
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// A repeat of the payment, already handled.
+		return true
+	}
+	notice := fmt.Sprintf("%s sent you Order %s from us as a gift!", cc.payerName(g.Payer), cc.orderRef(orderID))
+	if g.Message != "" {
+		notice += "\n\n\"" + g.Message + "\""
+	}
+	notice += "\n\nReply with your delivery address, or DECLINE if you'd rather not receive it."
+	if err := setOrderPrompt(cc.db, g.Recipient, flowGift, orderID, giftNotified); err != nil {
+		log.Printf("Saving gift prompt of order %d failed: %v", orderID, err)
+	}
+	cc.sender.SendOrder(g.Recipient, notice, priorityNotify, orderID)
+	cc.sender.SendOrder(g.Payer, fmt.Sprintf("Thanks! We've let %s know about their gift and asked for their delivery address.", g.Recipient),
+		priorityNotify, orderID)
+	metrics.Inc("menubot_gifts_total", "Gift orders by what became of them.", "state", giftNotified)
+	return true
+}
+
+// looksLikeAddress is deliberately loose; it only has to tell an address
+// from the recipient simply ordering for themselves, e.g. "menu".
+func looksLikeAddress(msg string) bool {
+	return len(strings.Fields(msg)) >= 2 && strings.ContainsAny(msg, "0123456789")
+}
+
+// giftReply handles a recipient's replies to the gift notice: their
+// address, then their slot, or a decline. It reports false for messages
+// that are none of these, which are answered as usual.
+// answeringGift returns the gift whose questions cell's replies answer,
+// if any.
+func answeringGift(db *sql.DB, cell string, now time.Time) (orderID int64, state string, found bool) {
+	err := db.QueryRow(`SELECT order_id, state FROM gift_orders WHERE recipient_cell = $1 AND state IN ($2, $3) AND notified_at > $4
+		ORDER BY notified_at LIMIT 1`, cell, giftNotified, giftAddress, now.Add(-giftReplyWindow)).Scan(&orderID, &state)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Reading gift for %s failed: %v", cell, err)
+		}
+		return 0, "", false
+	}
+	return orderID, state, true
+}
+
+// giftSlotPrompt asks for a delivery slot: one of GIFT_SLOTS, by name or
+// number, or whatever suits the recipient when there are none.
+func giftSlotPrompt() string {
+	slots := cfg().GiftSlots
+	if len(slots) == 0 {
+		return "When would suit you for the delivery? E.g. \"Saturday morning\"."
+	}
+	return "When would suit you for the delivery? Reply with a number:\n" + numberedOptions(slots)
+}
+
+// matchGiftSlot returns the slot msg picks. Without GIFT_SLOTS any short
+// answer is the slot.
+func matchGiftSlot(msg string) (string, bool) {
+	slots := cfg().GiftSlots
+	if len(slots) == 0 {
+		return msg, msg != "" && len([]rune(msg)) <= maxGiftSlot
+	}
+	if n, err := strconv.Atoi(msg); err == nil && n >= 1 && n <= len(slots) {
+		return slots[n-1], true
+	}
+	for _, s := range slots {
+		if strings.EqualFold(s, msg) {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+func giftReply(cc *commandContext, cell, msg string, now time.Time) (reply string, orderID int64, ok bool) {
+	orderID, state, found := answeringGift(cc.db, cell, now)
+	if !found {
+		return "", 0, false
+	}
+	msg = strings.TrimSpace(msg)
+	if giftDeclineWords[normalizeCommand(msg)] {
+		return cc.declineGift(orderID, cell), orderID, true
+	}
+	switch {
+	case state == giftNotified && looksLikeAddress(msg):
+		sealed, err := sealField(fieldOrderNotes, msg)
+		if err == nil {
+			_, err = cc.db.Exec(`INSERT INTO order_meta (order_id, pricelist_version, fulfilment, notes) VALUES ($1, 0, 'delivery', $2)
+				ON CONFLICT (order_id) DO UPDATE SET fulfilment = 'delivery', notes = EXCLUDED.notes, updated_at = now()`, orderID, sealed)
+		}
+		if err == nil {
+			_, err = cc.db.Exec(`UPDATE gift_orders SET state = $2 WHERE order_id = $1`, orderID, giftAddress)
+		}
+		if err == nil {
+			err = setOrderPrompt(cc.db, cell, flowGift, orderID, giftAddress)
+		}
+		if err != nil {
+			return cc.apology(incidentGiftSave, cell, orderID, err, "Gift: saving the recipient's address",
+				"Sorry, something went wrong saving your address. Please send it again."), orderID, true
+		}
+		return "Thanks! " + giftSlotPrompt(), orderID, true
+	case state == giftAddress && msg != "":
+		slot, ok := matchGiftSlot(msg)
+		if !ok && len(cfg().GiftSlots) > 0 {
+			return "Please pick one of these:\n" + numberedOptions(cfg().GiftSlots), orderID, true
+		}
+		if !ok {
+			return "Please keep it short, e.g. \"Saturday morning\".", orderID, true
+		}
+		msg = slot
+		_, err := cc.db.Exec(`UPDATE order_meta SET slot = $2, updated_at = now() WHERE order_id = $1`, orderID, msg)
+		if err == nil {
+			_, err = cc.db.Exec(`UPDATE gift_orders SET state = $2, responded_at = $3 WHERE order_id = $1`, orderID, giftAccepted, now)
+		}
+		if err == nil {
+			err = clearOrderPrompt(cc.db, cell, flowGift, orderID)
+		}
+		if err != nil {
+			return cc.apology(incidentGiftSave, cell, orderID, err, "Gift: saving the recipient's delivery slot",
+				"Sorry, something went wrong. Please send it again."), orderID, true
+		}
+		metrics.Inc("menubot_gifts_total", "Gift orders by what became of them.", "state", giftAccepted)
+		if g, found, err := getGift(cc.db, orderID); err != nil || !found {
+			log.Printf("Reading gift of order %d failed: %v", orderID, err)
+		} else {
+			cc.sender.SendOrder(g.Payer, fmt.Sprintf("%s has accepted your gift, Order %s. It'll be delivered %s.", g.Recipient, cc.orderRef(orderID), msg),
+				priorityNotify, orderID)
+		}
+		cc.sendPickList(orderID)
+		return fmt.Sprintf("Thanks! Order %s will be delivered %s.", cc.orderRef(orderID), msg), orderID, true
+	}
+	return "", 0, false
+}
+
+// declineGift closes the gift and tells the payer and the admin, who
+// settles the paid order with the payer.
+func (cc *commandContext) declineGift(orderID int64, recipient string) string {
+	if _, err := cc.db.Exec(`UPDATE gift_orders SET state = $2, responded_at = now() WHERE order_id = $1`, orderID, giftDeclined); err != nil {
+		return cc.apology(incidentGiftSave, recipient, orderID, err, "Gift: declining the gift",
+			"Sorry, something went wrong. Please try again.")
+	}
+	if err := clearOrderPrompt(cc.db, recipient, flowGift, orderID); err != nil {
+		log.Printf("Dropping gift prompt of order %d failed: %v", orderID, err)
+	}
+	metrics.Inc("menubot_gifts_total", "Gift orders by what became of them.", "state", giftDeclined)
+	g, found, err := getGift(cc.db, orderID)
+	if err != nil || !found {
+		log.Printf("Reading gift of order %d failed: %v", orderID, err)
+	} else {
+		cc.sender.SendOrder(g.Payer, fmt.Sprintf("%s declined your gift, Order %s. We'll be in touch about your order.", g.Recipient, cc.orderRef(orderID)),
+			priorityNotify, orderID)
+		recipient = fmt.Sprintf("%s (from %s)", g.Recipient, g.Payer)
+	}
+	cc.sender.SendOrder(cc.envVars.AdminNumber, fmt.Sprintf("The gift of paid order %d was declined by %s. Please sort it out with the payer.", orderID, recipient),
+		priorityNotify, orderID)
+	return "No problem, we've let them know."
+}
+
+// lapseGift closes a gift whose recipient never answered and tells the
+// payer and the admin, as for a decline.
+func (cc *commandContext) lapseGift(orderID int64, recipient string) string {
+	res, err := cc.db.Exec(`UPDATE gift_orders SET state = $2, responded_at = now() WHERE order_id = $1 AND state IN ($3, $4)`,
+		orderID, giftLapsed, giftNotified, giftAddress)
+	if err != nil {
+		log.Printf("Lapsing gift of order %d failed: %v", orderID, err)
+		return ""
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ""
+	}
+	metrics.Inc("menubot_gifts_total", "Gift orders by what became of them.", "state", giftLapsed)
+	if g, found, err := getGift(cc.db, orderID); err != nil || !found {
+		log.Printf("Reading gift of order %d failed: %v", orderID, err)
+	} else {
+		cc.sender.SendOrder(g.Payer, fmt.Sprintf("We didn't hear back from %s about your gift, Order %s. We'll be in touch about your order.", g.Recipient, cc.orderRef(orderID)),
+			priorityNotify, orderID)
+	}
+	cc.sender.SendOrder(cc.envVars.AdminNumber, fmt.Sprintf("The gift of paid order %d lapsed, %s never answered. Please sort it out with the payer.", orderID, recipient),
+		priorityNotify, orderID)
+	return fmt.Sprintf("We didn't hear back about your gift, Order %s, so we've let the sender know. Message us if you'd still like it.", cc.orderRef(orderID))
+}
+
+type exportGift struct {
+	OrderID int64  `json:"order_id"`
+	Role    string `json:"role"`
+	// With is the other party's number, masked on the recipient's side.
+	With    string `json:"with"`
+	Message string `json:"message,omitempty"`
+	State   string `json:"state"`
+	// The delivery details are the recipient's, so only their export has
+	// them.
+	Address string `json:"address,omitempty"`
+	Slot    string `json:"slot,omitempty"`
+}
+
+// queryCustomerGifts selects the gifts cell sent or received.
+func queryCustomerGifts(ctx context.Context, db *sql.DB, cell string) (*sql.Rows, error) {
+	return db.QueryContext(ctx, `SELECT g.order_id, CASE WHEN g.payer_cell = $1 THEN 'payer' ELSE 'recipient' END,
+			CASE WHEN g.payer_cell = $1 THEN g.recipient_cell ELSE g.payer_cell END, g.message, g.state,
+			CASE WHEN g.payer_cell = $1 THEN '' ELSE COALESCE(m.notes, '') END,
+			CASE WHEN g.payer_cell = $1 THEN '' ELSE COALESCE(m.slot, '') END
+		FROM gift_orders g LEFT JOIN order_meta m ON m.order_id = g.order_id
+		WHERE g.payer_cell = $1 OR g.recipient_cell = $1 ORDER BY g.order_id`, cell)
+}
+
+func scanExportGift(rows *sql.Rows) (any, error) {
+	var g exportGift
+	err := rows.Scan(&g.OrderID, &g.Role, &g.With, &g.Message, &g.State, &g.Address, &g.Slot)
+	if err != nil {
+		return nil, err
+	}
+	if g.Role == "recipient" {
+		g.With = maskPhoneNumber(g.With)
+	}
+	if g.Address, err = openField(fieldOrderNotes, g.Address); err != nil {
+		return nil, err
+	}
+	g.Message, err = openField(fieldGiftMessage, g.Message)
+	return g, err
+}
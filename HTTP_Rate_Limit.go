@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The public routes are rate limited per remote IP with token buckets: one
+// limit for all of them and a stricter one for the ITN route, where every
+// request that gets through may be written to the database. PayFast's
+// published ranges are exempt so its retries are never throttled. Limits
+// come from the runtime config on every request.
+
+// defaultPayFastRanges are the ranges PayFast sends ITNs from.
+const defaultPayFastRanges = "197.97.145.144/28,41.74.179.192/27,102.216.36.0/28,102.216.36.128/28,144.126.193.139/32"
+
+// ipBucketTTL is how long an idle IP's bucket is kept.
+const ipBucketTTL = 10 * time.Minute
+
+// maxIPBuckets bounds the buckets a limiter holds, whatever the spread of
+// addresses it sees. Past it, the longest-idle bucket makes way.
+const maxIPBuckets = 10000
+
+type ipBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// ipLimiter holds one token bucket per remote IP.
+type ipLimiter struct {
+	name       string
+	limits     func(rc *RuntimeConfig) (rate float64, burst int)
+	mu         sync.Mutex
+	buckets    map[string]*ipBucket
+	lastPruned time.Time
+}
+
+func newIPLimiter(name string, limits func(rc *RuntimeConfig) (float64, int)) *ipLimiter {
+	l := &ipLimiter{name: name, limits: limits, buckets: map[string]*ipBucket{}}
+	metrics.GaugeFunc("menubot_http_rate_limit_tracked_ips", "Remote IPs with a rate limit bucket.", func() float64 {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return float64(len(l.buckets))
+	}, "limit", name)
+	return l
+}
+
+// allow takes a token for ip. When there is none it reports how long until
+// there will be.
+func (l *ipLimiter) allow(ip string, rate float64, burst int, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[ip]
+	if (!ok && len(l.buckets) >= maxIPBuckets) || now.Sub(l.lastPruned) > time.Minute {
+		l.prune(now)
+	}
+	if !ok {
+		if len(l.buckets) >= maxIPBuckets {
+			l.evictIdlest()
+		}
+		b = &ipBucket{tokens: float64(burst), last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(b.tokens+now.Sub(b.last).Seconds()*rate, float64(burst))
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// prune drops the buckets idle for longer than ipBucketTTL. l.mu is held.
+func (l *ipLimiter) prune(now time.Time) {
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > ipBucketTTL {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastPruned = now
+}
+
+// evictIdlest drops the bucket used longest ago. l.mu is held.
+func (l *ipLimiter) evictIdlest() {
+	var idlest string
+	var last time.Time
+	for key, b := range l.buckets {
+		if idlest == "" || b.last.Before(last) {
+			idlest, last = key, b.last
+		}
+	}
+	delete(l.buckets, idlest)
+	metrics.Inc("menubot_http_rate_limit_evictions_total", "Rate limit buckets dropped to stay under the cap.", "limit", l.name)
+}
+
+// Middleware answers 429 with Retry-After to an IP over the limit.
+func (l *ipLimiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := cfg()
+		rate, burst := l.limits(rc)
+		ip := remoteIP(r)
+		if rate <= 0 || rc.allowlisted(ip) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ok, wait := l.allow(ip, rate, burst, time.Now())
+		if !ok {
+			metrics.Inc("menubot_http_rate_limited_total", "Requests refused by the HTTP rate limit.", "limit", l.name)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (rc *RuntimeConfig) allowlisted(ip string) bool {
+	return inNets(ip, rc.RateLimitAllowlist)
+}
+
+func parseCIDRList(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a CIDR range such as 197.97.145.144/28", part)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func cidrListString(nets []*net.IPNet) string {
+	parts := make([]string, len(nets))
+	for i, n := range nets {
+		parts[i] = n.String()
+	}
+	return strings.Join(parts, ",")
+}
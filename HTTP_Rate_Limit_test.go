@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func rateLimitConfig(t *testing.T) *RuntimeConfig {
+	t.Helper()
+	allowlist, err := parseCIDRList(defaultPayFastRanges)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := parseCIDRList(defaultTrustedProxies)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &RuntimeConfig{HTTPRate: 0.001, HTTPBurst: 1, RateLimitAllowlist: allowlist, TrustedProxies: trusted}
+}
+
+func TestIPLimiterMiddleware(t *testing.T) {
+	withRuntimeConfig(t, rateLimitConfig(t))
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded func(i int) string
+		want      []int
+	}{
+		{"untrusted peer is limited", "203.0.113.7:4000", nil,
+			[]int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}},
+		{"spoofed PayFast hop from untrusted peer is limited", "203.0.113.7:4000",
+			func(int) string { return "197.97.145.145" },
+			[]int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}},
+		{"rotating hops from untrusted peer share a bucket", "203.0.113.7:4000",
+			func(i int) string { return fmt.Sprintf("198.51.100.%d", i) },
+			[]int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}},
+		{"PayFast through a trusted proxy is exempt", "127.0.0.1:4000",
+			func(int) string { return "197.97.145.145" },
+			[]int{http.StatusOK, http.StatusOK, http.StatusOK}},
+		{"spoofed PayFast hop through a trusted proxy is limited", "127.0.0.1:4000",
+			func(int) string { return "197.97.145.145, 203.0.113.7" },
+			[]int{http.StatusOK, http.StatusTooManyRequests, http.StatusTooManyRequests}},
+		{"PayFast peer is exempt", "197.97.145.145:4000", nil,
+			[]int{http.StatusOK, http.StatusOK, http.StatusOK}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &ipLimiter{name: "test", limits: func(rc *RuntimeConfig) (float64, int) { return rc.HTTPRate, rc.HTTPBurst },
+				buckets: map[string]*ipBucket{}}
+			h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			for i, want := range tt.want {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.RemoteAddr = tt.peer
+				if tt.forwarded != nil {
+					r.Header.Set("X-Forwarded-For", tt.forwarded(i))
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				if w.Code != want {
+					t.Fatalf("request %d: status %d, want %d", i, w.Code, want)
+				}
+			}
+			if len(l.buckets) > 1 {
+				t.Errorf("%d buckets, want at most 1", len(l.buckets))
+			}
+		})
+	}
+}
+
+func TestIPLimiterCap(t *testing.T) {
+	l := &ipLimiter{name: "test", buckets: map[string]*ipBucket{}}
+	start := time.Now()
+	for i := 0; i < maxIPBuckets+50; i++ {
+		l.allow(fmt.Sprintf("ip-%d", i), 1, 1, start.Add(time.Duration(i)*time.Millisecond))
+	}
+	if len(l.buckets) != maxIPBuckets {
+		t.Fatalf("%d buckets, want %d", len(l.buckets), maxIPBuckets)
+	}
+	if _, ok := l.buckets["ip-0"]; ok {
+		t.Error("the idlest bucket was kept")
+	}
+	if _, ok := l.buckets[fmt.Sprintf("ip-%d", maxIPBuckets+49)]; !ok {
+		t.Error("the newest bucket was dropped")
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+type healthStatus struct {
+	Status     string `json:"status"`
+	AppDB      string `json:"app_db"`
+	WhatsAppDB string `json:"whatsapp_db"`
+	WhatsApp   string `json:"whatsapp"`
+	PayFast    string `json:"payfast_mode"`
+	Role       string `json:"role"`
+	Pricelist  string `json:"pricelist"`
+	Sending    string `json:"sending"`
+	// Devices is set with more than one device paired; WhatsApp is the
+	// primary's state.
+	Devices []deviceStatus `json:"devices,omitempty"`
+}
+
+// HealthHandler reports the state of both databases and the WhatsApp
+// connection, answering 503 when any of them is down. A stale pricelist is
+// reported as degraded but still answers 200: the bot recovers it on its
+// own, and a restart wouldn't help. A follower doesn't connect WhatsApp, so
+// it reports it as standby without degrading. Sending disabled by a ban is
+// degraded at 200 for the same reason as a stale pricelist, and WhatsApp
+// being disconnected meanwhile is expected. Another device being down is
+// degraded at 200 too, as its chats fall back to the primary.
+func HealthHandler(db, waDB *sql.DB, c waClient, devices *deviceSet, prclist *pricelistHolder, election *leaderElection, block *sendingBlock, payfastMode string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := healthStatus{Status: "ok", AppDB: "ok", WhatsAppDB: "ok", WhatsApp: "connected", PayFast: payfastMode, Pricelist: "ok", Role: election.Role(), Sending: "ok"}
+		code := http.StatusOK
+
+		if err := pingDB(db); err != nil {
+			log.Printf("Health check: %s: %v", appDBName, err)
+			status.AppDB, status.Status, code = "down", "degraded", http.StatusServiceUnavailable
+		}
+		if err := pingDB(waDB); err != nil {
+			log.Printf("Health check: %s: %v", waDBName, err)
+			status.WhatsAppDB, status.Status, code = "down", "degraded", http.StatusServiceUnavailable
+		}
+		if prclist.Stale() {
+			status.Pricelist, status.Status = "stale", "degraded"
+		}
+		if block.Blocked() {
+			status.Sending, status.Status = "disabled", "degraded"
+		}
+		if !election.Leader() {
+			status.WhatsApp = "standby"
+		} else if block.Blocked() && !c.IsConnected() {
+			status.WhatsApp = "blocked"
+		} else if !c.IsConnected() {
+			status.WhatsApp, status.Status, code = "down", "degraded", http.StatusServiceUnavailable
+		}
+		if devices.multiple() {
+			status.Devices = devices.Status()
+			for _, d := range status.Devices[1:] {
+				if d.State == "disconnected" && election.Leader() {
+					status.Status = "degraded"
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(status); err != nil {
+			log.Println("error writing response: ", err)
+		}
+	}
+}
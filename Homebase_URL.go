@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+)
+
+// PayFast calls back on the base URL a payment link was built with. A free
+// ngrok URL changes whenever the tunnel restarts, so the base is resolved
+// each time a link is built rather than once at startup: HOMEBASEURL as of
+// the last reload, or with NGROK_API_URL set, the public URL the local
+// ngrok agent reports, falling back to HOMEBASEURL while the agent can't
+// be asked. Each order records the base its link was issued with, and the
+// admin is told when it changes between two links, as every link sent
+// before then now calls back on a tunnel that may be gone.
+
+const (
+	ngrokCacheTTL = 30 * time.Second
+	ngrokTimeout  = 2 * time.Second
+)
+
+// homebaseResolver resolves the base URL, caching what ngrok says.
+type homebaseResolver struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	apiURL  string // NGROK_API_URL the cached URL came from
+	cached  string
+	fetched time.Time
+}
+
+func newHomebaseResolver() *homebaseResolver {
+	return &homebaseResolver{client: &http.Client{Timeout: ngrokTimeout}}
+}
+
+// URL is the base URL to build payment links and callbacks on now.
+func (h *homebaseResolver) URL() string {
+	rc := cfg()
+	if rc.NgrokAPIURL == "" {
+		return rc.HomebaseURL
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.apiURL == rc.NgrokAPIURL && time.Since(h.fetched) < ngrokCacheTTL {
+		return h.cached
+	}
+	public, err := ngrokPublicURL(h.client, rc.NgrokAPIURL)
+	if err != nil {
+		log.Printf("Asking ngrok at %s for the public URL failed, using HOMEBASEURL %s: %v", rc.NgrokAPIURL, rc.HomebaseURL, err)
+		return rc.HomebaseURL
+	}
+	h.apiURL, h.cached, h.fetched = rc.NgrokAPIURL, public, time.Now()
+	return public
+}
+
+// ngrokTunnels is the part of the agent's /api/tunnels response we read.
+type ngrokTunnels struct {
+	Tunnels []struct {
+		PublicURL string `json:"public_url"`
+		Proto     string `json:"proto"`
+	} `json:"tunnels"`
+}
+
+// ngrokPublicURL returns the public URL of the agent's first https tunnel.
+// apiURL is the agent's web address, e.g. http://127.0.0.1:4040.
+func ngrokPublicURL(client *http.Client, apiURL string) (string, error) {
+	resp, err := client.Get(strings.TrimSuffix(apiURL, "/") + "/api/tunnels")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("got %s", resp.Status)
+	}
+	var tunnels ngrokTunnels
+	if err := json.NewDecoder(resp.Body).Decode(&tunnels); err != nil {
+		return "", fmt.Errorf("reading tunnels: %w", err)
+	}
+	for _, t := range tunnels.Tunnels {
+		if t.Proto == "https" && strings.HasPrefix(t.PublicURL, "https://") {
+			return t.PublicURL, nil
+		}
+	}
+	return "", errors.New("no https tunnel is running")
+}
+
+// validateBaseURL checks a URL from the config is absolute http or https.
+func validateBaseURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an http(s) URL", raw)
+	}
+	return nil
+}
+
+// baseHost is the host of a base URL, "" when it has none.
+func baseHost(base string) string {
+	if u, err := url.Parse(base); err == nil {
+		return u.Host
+	}
+	return ""
+}
+
+// withHomebase is checkout with its callback URLs on base.
+func withHomebase(checkout mb.CheckoutInfo, env EnvVars, base string) mb.CheckoutInfo {
+	checkout.ReturnURL = securedURL(base, returnBaseURL, env.ReturnPathSecrets)
+	checkout.CancelURL = securedURL(base, cancelBaseURL, env.ReturnPathSecrets)
+	checkout.NotifyURL = securedURL(base, notifyBaseURL, env.NotifyPathSecrets)
+	return checkout
+}
+
+// callbackBase is the base URL an order's payment link was issued with,
+// "" for orders from before it was recorded.
+func callbackBase(db *sql.DB, orderID int64) (string, error) {
+	var base string
+	err := db.QueryRow(`SELECT callback_base FROM order_meta WHERE order_id = $1`, orderID).Scan(&base)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return base, err
+}
+
+// noteCallbackBase tells the admin when base isn't the one the previous
+// payment link was issued with. It is called before the new link is
+// recorded.
+func noteCallbackBase(cc *commandContext, orderID int64, base string) {
+	var last string
+	err := cc.db.QueryRow(`SELECT callback_base FROM order_meta WHERE callback_base <> '' AND order_id <> $1
+		ORDER BY checked_out_at DESC NULLS LAST LIMIT 1`, orderID).Scan(&last)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Reading the last callback base URL failed: %v", err)
+		}
+		return
+	}
+	if last == base {
+		return
+	}
+	log.Printf("WARNING: the base URL changed from %s to %s since the last payment link; unpaid links issued before call back on the old one", last, base)
+	metrics.Inc("menubot_homebase_changes_total", "Times the callback base URL differed from the previous payment link's.")
+	cc.sendBulk(bulkMessage{
+		Recipient: cc.envVars.AdminNumber,
+		Text: fmt.Sprintf("The payment callback URL changed from %s to %s. Links sent before order %d still call back on the old one, so keep that tunnel up if you can; their payments otherwise have to be checked by hand.",
+			last, base, orderID),
+		Kind: bulkAdmin,
+	})
+}
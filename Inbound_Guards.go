@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// The guards look at a message's text before anything else does, and
+// before anything touches the database. A text made only of whitespace and
+// invisible characters is dropped unanswered: it can't be an order, and
+// answering it invites more. A text longer than MAX_MESSAGE_LENGTH
+// characters isn't processed at all; the customer is asked to send their
+// order as short lines, and only the first MAX_MESSAGE_LENGTH characters
+// are recorded. NUL bytes, which Postgres won't store, are removed from
+// every text.
+
+const tooLongMessage = "That message is too long. Please send your order as short lines."
+
+type inboundGuard int
+
+const (
+	inboundOK inboundGuard = iota
+	inboundBlank
+	inboundTooLong
+)
+
+// guardInbound returns text without NUL bytes and what the guards make of
+// it. Only typed text is checked: reactions, poll votes, contact cards and
+// the like carry none. The bot's own messages always pass.
+func guardInbound(m *waProto.Message, text string, fromMe bool) (string, inboundGuard) {
+	typed := !fromMe && (m.Conversation != nil || m.GetExtendedTextMessage() != nil)
+	limit, n := cfg().MaxMessageLength, 0
+	if typed && limit > 0 && len(text) > (limit+1)*utf8.UTFMax {
+		// This many bytes hold more than limit characters, and only the
+		// first limit are ever recorded, so the rest isn't even scanned.
+		text = text[:(limit+1)*utf8.UTFMax]
+	}
+	if strings.IndexByte(text, 0) >= 0 {
+		text = strings.ReplaceAll(text, "\x00", "")
+	}
+	if !typed {
+		return text, inboundOK
+	}
+	// Counting stops at the limit, so a huge text costs no more than that.
+	visible := false
+	for _, r := range text {
+		if n++; limit > 0 && n > limit {
+			metrics.Inc("menubot_inbound_rejected_total", "Inbound messages stopped by the size and blank-text guards.", "reason", "too_long")
+			return text, inboundTooLong
+		}
+		visible = visible || !invisibleRune(r)
+	}
+	if !visible {
+		metrics.Inc("menubot_inbound_rejected_total", "Inbound messages stopped by the size and blank-text guards.", "reason", "blank")
+		return text, inboundBlank
+	}
+	return text, inboundOK
+}
+
+// invisibleRune reports whether r shows nothing: whitespace, control and
+// format characters such as zero-width joiners, invalid UTF-8, and the
+// fillers that render as blanks.
+func invisibleRune(r rune) bool {
+	switch r {
+	case utf8.RuneError, 'ᅟ', 'ᅠ', '⠀', 'ㅤ', 'ﾠ':
+		return true
+	}
+	return unicode.IsSpace(r) || unicode.IsControl(r) || unicode.Is(unicode.Cf, r)
+}
+
+// answerTooLong replies to a message the length guard stopped.
+func answerTooLong(cc *commandContext, limiter *senderLimiter, chat types.JID, sender, text string) {
+	if !limiter.Allow(sender, time.Now()) {
+		log.Printf("Rate limit exceeded for %s, message dropped", sender)
+		return
+	}
+	log.Printf("Message from %s is over %d characters, not processed", sender, cfg().MaxMessageLength)
+	recordConversation(cc.db, sender, truncateRunes(text, cfg().MaxMessageLength), convTooLong, "")
+	cc.sender.SendTo(chat, tooLongMessage, priorityReply)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestGuardInbound(t *testing.T) {
+	withRuntimeConfig(t, &RuntimeConfig{MaxMessageLength: 4096})
+	typed := func(text string) *waProto.Message {
+		return &waProto.Message{Conversation: proto.String(text)}
+	}
+	extended := func(text string) *waProto.Message {
+		return &waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{Text: proto.String(text)}}
+	}
+	reaction := &waProto.Message{ReactionMessage: &waProto.ReactionMessage{Text: proto.String("👍")}}
+	tests := []struct {
+		name   string
+		m      *waProto.Message
+		text   string
+		fromMe bool
+		want   inboundGuard
+		clean  string // the text returned, when it isn't text unchanged
+	}{
+		{name: "order", m: typed("2 x item4"), text: "2 x item4", want: inboundOK},
+		{name: "emoji only", m: typed("🍔"), text: "🍔", want: inboundOK},
+		{name: "at the limit", m: typed(""), text: strings.Repeat("a", 4096), want: inboundOK},
+		{name: "multibyte at the limit", m: typed(""), text: strings.Repeat("é", 4096), want: inboundOK},
+		{name: "one over the limit", m: typed(""), text: strings.Repeat("a", 4097), want: inboundTooLong},
+		{name: "60KB wall of text", m: typed(""), text: strings.Repeat("lorem ipsum ", 5000), want: inboundTooLong,
+			clean: strings.Repeat("lorem ipsum ", 5000)[:4097*4]},
+		{name: "huge blank text", m: typed(""), text: strings.Repeat(" ", 60000), want: inboundTooLong,
+			clean: strings.Repeat(" ", 4097*4)},
+		{name: "huge text in an extended message", m: extended(""), text: strings.Repeat("a", 60000), want: inboundTooLong,
+			clean: strings.Repeat("a", 4097*4)},
+		{name: "huge text of 4-byte characters", m: typed(""), text: strings.Repeat("🍔", 20000), want: inboundTooLong,
+			clean: strings.Repeat("🍔", 4097)},
+		{name: "empty", m: typed(""), text: "", want: inboundBlank},
+		{name: "whitespace", m: typed(""), text: " \t\r\n  \u3000", want: inboundBlank},
+		{name: "zero-width joiners", m: typed(""), text: "\u200d\u200d\u200d", want: inboundBlank},
+		{name: "zero-width spaces and marks", m: typed(""), text: "\u200b\u200c\u200e\u2060\ufeff", want: inboundBlank},
+		{name: "blank fillers", m: typed(""), text: "\u3164\u2800\u115f\u1160\uffa0", want: inboundBlank},
+		{name: "null bytes", m: typed(""), text: "\x00\x00\x00", want: inboundBlank, clean: ""},
+		{name: "null bytes in an order", m: typed(""), text: "2 x\x00 item4\x00", want: inboundOK, clean: "2 x item4"},
+		{name: "invalid UTF-8", m: typed(""), text: "\xff\xfe\xfd", want: inboundBlank},
+		{name: "control characters", m: typed(""), text: "\x01\x02\x1b\x7f", want: inboundBlank},
+		{name: "joiner inside an emoji", m: typed(""), text: "\u200d👨\u200d🍳", want: inboundOK},
+		{name: "blank from the bot", m: typed(""), text: "\u200d", fromMe: true, want: inboundOK},
+		{name: "long from the bot", m: typed(""), text: strings.Repeat("a", 5000), fromMe: true, want: inboundOK},
+		{name: "reaction isn't typed text", m: reaction, text: "", want: inboundOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clean, got := guardInbound(tt.m, tt.text, tt.fromMe)
+			if got != tt.want {
+				t.Errorf("guard = %d, want %d", got, tt.want)
+			}
+			want := tt.clean
+			if want == "" && !strings.Contains(tt.text, "\x00") {
+				want = tt.text
+			}
+			if clean != want {
+				t.Errorf("text = %q, want %q", truncateRunes(clean, 40), truncateRunes(want, 40))
+			}
+		})
+	}
+}
+
+func TestGuardInboundLimit(t *testing.T) {
+	text := strings.Repeat("a", 5000)
+	tests := []struct {
+		limit int
+		want  inboundGuard
+	}{
+		{0, inboundOK}, // no limit
+		{4999, inboundTooLong},
+		{5000, inboundOK},
+	}
+	for _, tt := range tests {
+		withRuntimeConfig(t, &RuntimeConfig{MaxMessageLength: tt.limit})
+		if _, got := guardInbound(&waProto.Message{Conversation: proto.String(text)}, text, false); got != tt.want {
+			t.Errorf("limit %d: guard = %d, want %d", tt.limit, got, tt.want)
+		}
+	}
+}
+
+// TestGuardInboundCost checks a huge text is turned away after reading no
+// more of it than the limit.
+func TestGuardInboundCost(t *testing.T) {
+	withRuntimeConfig(t, &RuntimeConfig{MaxMessageLength: 4096})
+	huge := strings.Repeat("a", 64<<20)
+	m := &waProto.Message{Conversation: proto.String("")}
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		if _, got := guardInbound(m, huge, false); got != inboundTooLong {
+			t.Fatalf("guard = %d, want too long", got)
+		}
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("100 checks of a 64MB text took %s", took)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JeremyJalpha/MenuBot_WebAPI/buildinfo"
+	"github.com/go-chi/chi/v5"
+)
+
+// When something fails while handling a message or a payment, the failure
+// is recorded as an incident under a short random ID, and the customer's
+// apology and the admin's alert carry its error code and ID. A customer
+// reporting "the bot said something went wrong" can then quote the
+// reference, and support finds the context with GET /api/incidents/{id}.
+//
+// Error codes are registered below, each with its description, and
+// registering one twice stops the app at startup, so codes can't collide
+// and none go undescribed.
+
+// incidentCode is a stable code for one kind of failure, such as BOT-DB-001.
+type incidentCode string
+
+var incidentCodeDescriptions = map[incidentCode]string{}
+
+func registerIncidentCode(code, description string) incidentCode {
+	c := incidentCode(code)
+	if _, dup := incidentCodeDescriptions[c]; dup {
+		panic("error code " + code + " registered twice")
+	}
+	if strings.TrimSpace(description) == "" {
+		panic("error code " + code + " has no description")
+	}
+	incidentCodeDescriptions[c] = description
+	return c
+}
+
+func (c incidentCode) Description() string {
+	return incidentCodeDescriptions[c]
+}
+
+// The message pipeline.
+var (
+	incidentOrderLookup       = registerIncidentCode("BOT-DB-001", "Reading the customer's order failed.")
+	incidentCartLookup        = registerIncidentCode("BOT-DB-002", "Reading the customer's cart failed.")
+	incidentCartChange        = registerIncidentCode("BOT-DB-003", "Saving a change to the customer's cart failed.")
+	incidentCancelRequest     = registerIncidentCode("BOT-DB-004", "Recording a request to cancel a paid order failed.")
+	incidentCancelOrder       = registerIncidentCode("BOT-DB-005", "Cancelling an unpaid order failed.")
+	incidentRepeatOrder       = registerIncidentCode("BOT-DB-006", "Repeating an expired order failed.")
+	incidentConsentSave       = registerIncidentCode("BOT-DB-007", "Saving the customer's marketing preference failed.")
+	incidentLoyaltyLookup     = registerIncidentCode("BOT-DB-008", "Reading the customer's loyalty points failed.")
+	incidentLoyaltyRedeem     = registerIncidentCode("BOT-DB-009", "Redeeming loyalty points against an order failed.")
+	incidentOptionSave        = registerIncidentCode("BOT-DB-010", "Saving the customer's choice of item options failed.")
+	incidentRatingSave        = registerIncidentCode("BOT-DB-011", "Saving the customer's rating failed.")
+	incidentReferralCreate    = registerIncidentCode("BOT-DB-012", "Creating the customer's referral code failed.")
+	incidentReferralRecord    = registerIncidentCode("BOT-DB-013", "Recording a referral failed.")
+	incidentDeliveryContact   = registerIncidentCode("BOT-DB-014", "Saving a forwarded contact as the delivery contact failed.")
+	incidentGiftSave          = registerIncidentCode("BOT-DB-015", "Saving the details of a gift order failed.")
+	incidentPipelineOpenOrder = registerIncidentCode("BOT-DB-016", "Reading the open order around MenuBotLib's reply failed; the reply went out without the order's adjustments.")
+	incidentQueueLookup       = registerIncidentCode("BOT-DB-017", "Reading today's preparation queue failed.")
+	incidentQueueNotify       = registerIncidentCode("BOT-DB-018", "Saving the customer's request to hear when their order is next failed.")
+	incidentNameSave          = registerIncidentCode("BOT-DB-019", "Saving the name the customer gave failed.")
+	incidentEmailSave         = registerIncidentCode("BOT-DB-020", "Saving the customer's email address failed.")
+)
+
+// The payment handlers and pipeline.
+var (
+	incidentITNUnreadable   = registerIncidentCode("PAY-ITN-001", "A PayFast notification's body couldn't be read.")
+	incidentITNFields       = registerIncidentCode("PAY-ITN-002", "A PayFast notification was missing fields or had malformed ones.")
+	incidentITNSignature    = registerIncidentCode("PAY-SIG-001", "A PayFast notification's signature didn't match; it was ignored.")
+	incidentITNConfirmation = registerIncidentCode("PAY-SIG-002", "PayFast didn't confirm a notification as its own; it was ignored.")
+	incidentITNStore        = registerIncidentCode("PAY-DB-001", "Storing a verified PayFast notification failed; only PayFast's retries can recover it.")
+	incidentReturnPage      = registerIncidentCode("PAY-DB-002", "Reading the order or receipt for the payment return page failed.")
+	incidentITNDeadLetter   = registerIncidentCode("PAY-PROC-001", "Processing a PayFast notification failed and it was parked as a dead letter.")
+)
+
+const (
+	incidentIDLength = 6
+	// incidentIDAlphabet leaves out 0, 1, I and O, which customers misread.
+	incidentIDAlphabet = "23456789ABCDEFGHJKLMNPQRSTUVWXYZ"
+	// incidentAlertInterval limits the admin to one alert per code per
+	// interval, so a database outage doesn't page for every message.
+	incidentAlertInterval = 15 * time.Minute
+)
+
+type incident struct {
+	ID          string       `json:"id"`
+	Code        incidentCode `json:"code"`
+	Description string       `json:"description"`
+	Context     string       `json:"context"`
+	Error       string       `json:"error"`
+	CellNumber  string       `json:"cell_number,omitempty"`
+	OrderID     int64        `json:"order_id,omitempty"`
+	Build       string       `json:"build"`
+	OccurredAt  time.Time    `json:"occurred_at"`
+}
+
+// Ref is how customers and the admin are shown the incident.
+func (i incident) Ref() string {
+	return fmt.Sprintf("error %s, ref %s", i.Code, i.ID)
+}
+
+// Apology is text with the incident's reference appended.
+func (i incident) Apology(text string) string {
+	return fmt.Sprintf("%s (%s)", text, i.Ref())
+}
+
+func newIncidentID() string {
+	b := make([]byte, incidentIDLength)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	for i := range b {
+		b[i] = incidentIDAlphabet[int(b[i])%len(incidentIDAlphabet)]
+	}
+	return string(b)
+}
+
+// incidentReporter is how the payment handlers report incidents.
+type incidentReporter interface {
+	Report(code incidentCode, cell string, orderID int64, err error, context string) incident
+}
+
+// incidentLog records incidents and alerts the admin.
+type incidentLog struct {
+	cc *commandContext
+
+	mu      sync.Mutex
+	alerted map[incidentCode]time.Time
+}
+
+func newIncidentLog(cc *commandContext) *incidentLog {
+	return &incidentLog{cc: cc, alerted: map[incidentCode]time.Time{}}
+}
+
+// Report records err as a new incident and alerts the admin.
+func (l *incidentLog) Report(code incidentCode, cell string, orderID int64, err error, context string) incident {
+	i := l.Record(code, cell, orderID, err, context)
+	if l.shouldAlert(code, i.OccurredAt) {
+		text := fmt.Sprintf("Something went wrong (%s): %s\n%s", i.Ref(), code.Description(), i.Context)
+		if cell != "" {
+			text += "\nCustomer: " + cell
+		}
+		if orderID != 0 {
+			text += fmt.Sprintf("\nOrder: %d", orderID)
+		}
+		text += fmt.Sprintf("\nDetails: GET %s/incidents/%s", apiBaseURL, i.ID)
+		l.cc.sendBulk(bulkMessage{Recipient: l.cc.envVars.AdminNumber, Text: text, Kind: bulkAdmin})
+	}
+	return i
+}
+
+// Record logs err under a new incident and stores it, for callers that
+// alert the admin themselves. context says what was being done; cell and
+// orderID are "" and 0 when there is no customer or order.
+func (l *incidentLog) Record(code incidentCode, cell string, orderID int64, err error, context string) incident {
+	i := incident{ID: newIncidentID(), Code: code, Description: code.Description(), Context: context,
+		CellNumber: cell, OrderID: orderID, Build: buildinfo.Get().String(), OccurredAt: time.Now().UTC()}
+	if err != nil {
+		i.Error = err.Error()
+	}
+	log.Printf("Incident %s [%s] %s (customer %q, order %d, build %s): %s", i.ID, i.Code, i.Context, i.CellNumber, i.OrderID, i.Build, i.Error)
+	metrics.Inc("menubot_incidents_total", "Incidents recorded, by error code.", "code", string(code))
+	_, dbErr := l.cc.db.Exec(`INSERT INTO incidents (id, code, context, error, cell_number, order_id, build, occurred_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, 0), $7, $8)`,
+		i.ID, string(i.Code), i.Context, i.Error, i.CellNumber, i.OrderID, i.Build, i.OccurredAt)
+	if dbErr != nil {
+		log.Printf("Storing incident %s failed, it is only in the log: %v", i.ID, dbErr)
+	}
+	return i
+}
+
+func (l *incidentLog) shouldAlert(code incidentCode, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if last, ok := l.alerted[code]; ok && now.Sub(last) < incidentAlertInterval {
+		return false
+	}
+	l.alerted[code] = now
+	return true
+}
+
+// apology reports an incident for sender and returns text with its
+// reference, for a reply.
+func (cc *commandContext) apology(code incidentCode, sender string, orderID int64, err error, context, text string) string {
+	return cc.incidents.Report(code, sender, orderID, err, context).Apology(text)
+}
+
+func GetIncidentHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := strings.ToUpper(strings.TrimSpace(chi.URLParam(r, "incidentID")))
+		var i incident
+		var code string
+		err := db.QueryRow(`SELECT id, code, context, error, cell_number, COALESCE(order_id, 0), build, occurred_at
+			FROM incidents WHERE id = $1`, id).
+			Scan(&i.ID, &code, &i.Context, &i.Error, &i.CellNumber, &i.OrderID, &i.Build, &i.OccurredAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "no such incident")
+			return
+		}
+		if err != nil {
+			log.Printf("Reading incident %s failed: %v", id, err)
+			writeJSONError(w, http.StatusInternalServerError, "reading incident failed")
+			return
+		}
+		i.Code = incidentCode(code)
+		i.Description = i.Code.Description()
+		writeJSON(w, http.StatusOK, i)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestIncidentCodes(t *testing.T) {
+	format := regexp.MustCompile(`^(BOT|PAY)-[A-Z]+-\d{3}$`)
+	if len(incidentCodeDescriptions) == 0 {
+		t.Fatal("no error codes registered")
+	}
+	for code, description := range incidentCodeDescriptions {
+		if !format.MatchString(string(code)) {
+			t.Errorf("%s doesn't look like BOT-DB-001", code)
+		}
+		if strings.TrimSpace(description) == "" || code.Description() != description {
+			t.Errorf("%s has no description", code)
+		}
+	}
+
+	tests := []struct {
+		name, code, description string
+	}{
+		{"taken", string(incidentOrderLookup), "Something else."},
+		{"no description", "BOT-TEST-001", " "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registering %s with %q didn't panic", tt.code, tt.description)
+				}
+			}()
+			registerIncidentCode(tt.code, tt.description)
+		})
+	}
+	if _, ok := incidentCodeDescriptions["BOT-TEST-001"]; ok {
+		t.Error("an undescribed code was registered")
+	}
+}
+
+func TestNewIncidentID(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id := newIncidentID()
+		if len(id) != incidentIDLength || strings.Trim(id, incidentIDAlphabet) != "" {
+			t.Fatalf("incident ID %q isn't %d characters of %s", id, incidentIDLength, incidentIDAlphabet)
+		}
+		if strings.ContainsAny(id, "01IO") {
+			t.Fatalf("incident ID %q has a character customers misread", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) < 990 {
+		t.Errorf("only %d distinct IDs in 1000", len(seen))
+	}
+}
+
+func TestIncidentApology(t *testing.T) {
+	i := incident{ID: "K7QX2M", Code: incidentCartLookup}
+	if got, want := i.Ref(), "error BOT-DB-002, ref K7QX2M"; got != want {
+		t.Errorf("Ref() = %q, want %q", got, want)
+	}
+	if got, want := i.Apology("Sorry, something went wrong."), "Sorry, something went wrong. (error BOT-DB-002, ref K7QX2M)"; got != want {
+		t.Errorf("Apology() = %q, want %q", got, want)
+	}
+}
+
+func TestIncidentAlertInterval(t *testing.T) {
+	l := newIncidentLog(&commandContext{})
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		code incidentCode
+		at   time.Duration
+		want bool
+	}{
+		{incidentOrderLookup, 0, true},
+		{incidentOrderLookup, time.Minute, false},
+		{incidentCartLookup, time.Minute, true},
+		{incidentOrderLookup, incidentAlertInterval - time.Second, false},
+		{incidentOrderLookup, incidentAlertInterval, true},
+		{incidentOrderLookup, incidentAlertInterval + time.Minute, false},
+	}
+	for _, tt := range tests {
+		if got := l.shouldAlert(tt.code, start.Add(tt.at)); got != tt.want {
+			t.Errorf("alert for %s after %s = %v, want %v", tt.code, tt.at, got, tt.want)
+		}
+	}
+}
+
+// fakeIncidentDB stores incidents in memory, answering Record's insert and
+// GetIncidentHandler's select.
+type fakeIncidentDB struct {
+	incidents map[string][]driver.Value
+	fail      bool
+}
+
+func (db *fakeIncidentDB) Open(string) (driver.Conn, error) { return fakeIncidentConn{db}, nil }
+
+type fakeIncidentConn struct{ db *fakeIncidentDB }
+
+func (c fakeIncidentConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fake incident db: prepare not supported")
+}
+func (c fakeIncidentConn) Close() error { return nil }
+func (c fakeIncidentConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("fake incident db: no transactions")
+}
+
+func (c fakeIncidentConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if c.db.fail || !strings.Contains(query, "INSERT INTO incidents") {
+		return nil, errors.New("fake incident db: unexpected statement")
+	}
+	row := make([]driver.Value, len(args))
+	for i, a := range args {
+		row[i] = a.Value
+	}
+	c.db.incidents[row[0].(string)] = row
+	return driver.RowsAffected(1), nil
+}
+
+func (c fakeIncidentConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if c.db.fail || !strings.Contains(query, "FROM incidents") {
+		return nil, errors.New("fake incident db: unexpected query")
+	}
+	rows := &fakeIncidentRows{}
+	if row, ok := c.db.incidents[args[0].Value.(string)]; ok {
+		rows.rows = append(rows.rows, row)
+	}
+	return rows, nil
+}
+
+type fakeIncidentRows struct{ rows [][]driver.Value }
+
+func (r *fakeIncidentRows) Columns() []string {
+	return []string{"id", "code", "context", "error", "cell_number", "order_id", "build", "occurred_at"}
+}
+func (r *fakeIncidentRows) Close() error { return nil }
+func (r *fakeIncidentRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// TestIncidentLookup records an incident and reads it back the way support
+// would, by the reference the customer quotes.
+func TestIncidentLookup(t *testing.T) {
+	fake := &fakeIncidentDB{incidents: map[string][]driver.Value{}}
+	sql.Register("fakeincidents", fake)
+	db, err := sql.Open("fakeincidents", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	l := newIncidentLog(&commandContext{db: db})
+	recorded := l.Record(incidentCartChange, "27821234567", 42, errors.New("connection reset"), "Editing the cart")
+	if recorded.Description != incidentCartChange.Description() || recorded.Error != "connection reset" {
+		t.Errorf("recorded %+v", recorded)
+	}
+	r := chi.NewRouter()
+	r.Get("/incidents/{incidentID}", GetIncidentHandler(db))
+
+	tests := []struct {
+		name string
+		id   string
+		fail bool
+		want int
+	}{
+		{"by its ID", recorded.ID, false, http.StatusOK},
+		{"as typed by a customer", " " + strings.ToLower(recorded.ID), false, http.StatusOK},
+		{"unknown", "ZZZZZZ", false, http.StatusNotFound},
+		{"database down", recorded.ID, true, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake.fail = tt.fail
+			defer func() { fake.fail = false }()
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/incidents/"+strings.ReplaceAll(tt.id, " ", "%20"), nil))
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			var got incident
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != recorded.ID || got.Code != incidentCartChange || got.Description != incidentCartChange.Description() ||
+				got.CellNumber != "27821234567" || got.OrderID != 42 || got.Context != "Editing the cart" || got.Error != "connection reset" {
+				t.Errorf("incident = %+v, want %+v", got, recorded)
+			}
+		})
+	}
+
+	fake.fail = true
+	// Storing failing still leaves the incident, with its reference, in the log.
+	if i := l.Record(incidentCartChange, "", 0, nil, "Editing the cart"); i.ID == "" {
+		t.Error("no incident when storing it failed")
+	}
+}
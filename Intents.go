@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+)
+
+// Questions asked in words, such as "how much is item4" or "hoeveel kos
+// die brownies", are answered from the pricelist and business hours
+// instead of falling through to MenuBotLib, which would answer them with
+// the whole pricelist. What counts as a question is configured as phrases
+// rather than patterns, so new wordings and languages need no code.
+
+// Intents a question can have.
+const (
+	intentPrice = "price"
+	intentStock = "stock"
+	intentHours = "hours"
+)
+
+const itemPlaceholder = "{item}"
+
+const (
+	defaultPricePhrases = "how much is {item}|how much are {item}|how much for {item}|price of {item}|price for {item}|" +
+		"what does {item} cost|what do {item} cost|hoeveel kos {item}|wat kos {item}|prys van {item}|wat is die prys van {item}"
+	defaultStockPhrases = "do you still have {item}|do you have {item}|is {item} available|are {item} available|" +
+		"have you got {item}|het julle nog {item}|het julle {item}|is {item} beskikbaar|is daar nog {item}"
+	defaultHoursPhrases = "are you open|when are you open|what time do you open|what time do you close|opening hours|" +
+		"trading hours|is julle oop|hoe laat maak julle oop|hoe laat maak julle toe|wanneer is julle oop"
+)
+
+// intentFillers are words a customer puts around an item's name that are
+// not part of it.
+var intentFillers = map[string]bool{
+	"the": true, "a": true, "an": true, "one": true, "ones": true, "some": true, "your": true,
+	"die": true, "n": true, "een": true, "jou": true, "julle": true, "nog": true,
+}
+
+// intentPhrase is a configured phrase, split around where the item goes.
+// Phrases without an item match anywhere in a message.
+type intentPhrase struct {
+	before, after string
+	hasItem       bool
+}
+
+// parseIntentPhrases reads phrases separated by "|". Phrases for questions
+// about an item must say where it goes with {item}.
+func parseIntentPhrases(s string, withItem bool) ([]intentPhrase, error) {
+	var phrases []intentPhrase
+	if s == "none" {
+		return phrases, nil
+	}
+	for _, raw := range strings.Split(s, "|") {
+		if raw = strings.TrimSpace(raw); raw == "" {
+			continue
+		}
+		before, after, found := strings.Cut(raw, itemPlaceholder)
+		switch {
+		case withItem && (!found || strings.Contains(after, itemPlaceholder)):
+			return nil, fmt.Errorf("%q must contain %s once", raw, itemPlaceholder)
+		case !withItem && found:
+			return nil, fmt.Errorf("%q can't contain %s", raw, itemPlaceholder)
+		}
+		p := intentPhrase{before: normalizeForMatch(before), after: normalizeForMatch(after), hasItem: found}
+		if p.before == "" && p.after == "" {
+			return nil, fmt.Errorf("%q has no words besides %s", raw, itemPlaceholder)
+		}
+		phrases = append(phrases, p)
+	}
+	return phrases, nil
+}
+
+func intentPhrasesString(phrases []intentPhrase) string {
+	parts := make([]string, len(phrases))
+	for i, p := range phrases {
+		if p.hasItem {
+			parts[i] = strings.TrimSpace(p.before + " " + itemPlaceholder + " " + p.after)
+		} else {
+			parts[i] = p.before
+		}
+	}
+	return strings.Join(parts, "|")
+}
+
+// match reports whether msg, already normalized, asks p, and returns the
+// words standing for the item.
+func (p intentPhrase) match(msg string) (item string, ok bool) {
+	padded := " " + msg + " "
+	if !p.hasItem {
+		return "", strings.Contains(padded, " "+p.before+" ")
+	}
+	rest := padded
+	if p.before != "" {
+		i := strings.Index(padded, " "+p.before+" ")
+		if i < 0 {
+			return "", false
+		}
+		rest = padded[i+len(p.before)+1:]
+	}
+	if p.after != "" {
+		i := strings.LastIndex(rest, " "+p.after+" ")
+		if i < 0 {
+			return "", false
+		}
+		rest = rest[:i+1]
+	}
+	item = strings.TrimSpace(rest)
+	return item, item != ""
+}
+
+// matchIntent finds the first configured phrase msg asks.
+func matchIntent(rc *RuntimeConfig, msg string) (intent, item string, ok bool) {
+	normalized := normalizeForMatch(msg)
+	for _, set := range []struct {
+		intent  string
+		phrases []intentPhrase
+	}{
+		{intentPrice, rc.PricePhrases},
+		{intentStock, rc.StockPhrases},
+		{intentHours, rc.HoursPhrases},
+	} {
+		for _, p := range set.phrases {
+			if item, ok := p.match(normalized); ok {
+				return set.intent, item, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+// fuzzyFindItem resolves a description such as "the choc brownies" to the
+// one listed item whose name has every word of it, give or take the
+// typos command suggestions allow. ok is false when no item fits, or more
+// than one fits equally well.
+func fuzzyFindItem(vp versionedPricelist, query string) (mb.CatalogueItem, bool) {
+	var words []string
+	for _, w := range strings.Fields(normalizeForMatch(query)) {
+		if !intentFillers[w] {
+			words = append(words, w)
+		}
+	}
+	if len(words) == 0 {
+		return mb.CatalogueItem{}, false
+	}
+	var best mb.CatalogueItem
+	bestScore, ambiguous := -1, false
+	for _, item := range vp.Items {
+		if !vp.Listed(ctlgItemID(item)) {
+			continue
+		}
+		score, ok := nameDistance(words, strings.Fields(normalizeForMatch(ctlgItemName(item))))
+		switch {
+		case !ok:
+		case bestScore < 0 || score < bestScore:
+			best, bestScore, ambiguous = item, score, false
+		case score == bestScore:
+			ambiguous = true
+		}
+	}
+	if bestScore < 0 || ambiguous {
+		return mb.CatalogueItem{}, false
+	}
+	return best, true
+}
+
+// nameDistance adds up how far each word is from the nearest word of
+// name. ok is false when a word is nowhere near any of them.
+func nameDistance(words, name []string) (int, bool) {
+	total := 0
+	for _, w := range words {
+		nearest := -1
+		for _, n := range name {
+			if d := editDistance(w, n); d <= maxSuggestionDistance(len(w)) && (nearest < 0 || d < nearest) {
+				nearest = d
+			}
+		}
+		if nearest < 0 {
+			return 0, false
+		}
+		total += nearest
+	}
+	return total, true
+}
+
+// intentReply answers a question asked in words. ok is false when msg
+// isn't one, or names no item confidently, so it falls through to
+// MenuBotLib as before.
+func intentReply(vp versionedPricelist, msg string, now time.Time) (reply, intent string, ok bool) {
+	rc := cfg()
+	intent, query, ok := matchIntent(rc, msg)
+	if !ok {
+		return "", "", false
+	}
+	if intent == intentHours {
+		if rc.BusinessHours.IsOpen(now) {
+			return "We're open now. Our hours are " + rc.BusinessHours.String() + ".", intent, true
+		}
+		return rc.message("CLOSED_MESSAGE", map[string]string{"hours": rc.BusinessHours.String()}), intent, true
+	}
+	item, found := findItem(vp, query)
+	if !found || !vp.Listed(ctlgItemID(item)) {
+		return "", "", false
+	}
+	id := ctlgItemID(item)
+	if unavailable := unavailableItemsReply(vp, []int{id}, now); unavailable != "" {
+		return unavailable, intent, true
+	}
+	if intent == intentPrice {
+		return itemCaption(item), intent, true
+	}
+	return fmt.Sprintf("Yes, we have %s.", itemCaption(item)), intent, true
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+)
+
+func defaultIntentConfig(t *testing.T) *RuntimeConfig {
+	t.Helper()
+	parse := func(s string, withItem bool) []intentPhrase {
+		phrases, err := parseIntentPhrases(s, withItem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return phrases
+	}
+	return &RuntimeConfig{
+		PricePhrases: parse(defaultPricePhrases, true),
+		StockPhrases: parse(defaultStockPhrases, true),
+		HoursPhrases: parse(defaultHoursPhrases, false),
+	}
+}
+
+func TestMatchIntent(t *testing.T) {
+	rc := defaultIntentConfig(t)
+	tests := []struct {
+		msg    string
+		intent string
+		item   string
+	}{
+		// English
+		{"how much is item4", intentPrice, "item4"},
+		{"How much are the choc brownies?", intentPrice, "the choc brownies"},
+		{"hi, what's the price of a large latte?", intentPrice, "a large latte"},
+		{"what does the blue one cost?", intentPrice, "the blue one"},
+		{"do you still have carrot cake", intentStock, "carrot cake"},
+		{"Is the lemon tart available today?", intentStock, "the lemon tart"},
+		{"are you open?", intentHours, ""},
+		{"What time do you close on Saturday", intentHours, ""},
+		// Afrikaans
+		{"hoeveel kos die brownies", intentPrice, "die brownies"},
+		{"Wat kos 'n groot latte?", intentPrice, "n groot latte"},
+		{"wat is die prys van item4", intentPrice, "item4"},
+		{"het julle nog wortelkoek", intentStock, "wortelkoek"},
+		{"Is die suurlemoentert beskikbaar?", intentStock, "die suurlemoentert"},
+		{"is julle oop?", intentHours, ""},
+		{"Hoe laat maak julle toe vandag", intentHours, ""},
+		// Not questions
+		{"2 x item4", "", ""},
+		{"how much", "", ""},
+		{"price of", "", ""},
+		{"I'm open to suggestions", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			intent, item, ok := matchIntent(rc, tt.msg)
+			if ok != (tt.intent != "") || intent != tt.intent || item != tt.item {
+				t.Errorf("matchIntent(%q) = %q, %q, %v; want %q, %q", tt.msg, intent, item, ok, tt.intent, tt.item)
+			}
+		})
+	}
+}
+
+func TestParseIntentPhrases(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		withItem bool
+		want     string
+		wantErr  string
+	}{
+		{"item phrases", " how much is {item}| prys van  {item} ", true, "how much is {item}|prys van {item}", ""},
+		{"item in the middle", "is {item} available", true, "is {item} available", ""},
+		{"hours phrases", "Are you OPEN?|opening hours", false, "are you open|opening hours", ""},
+		{"none", "none", true, "", ""},
+		{"no item", "how much", true, "", "must contain {item} once"},
+		{"two items", "{item} or {item}", true, "", "must contain {item} once"},
+		{"item in hours", "open {item}", false, "", "can't contain {item}"},
+		{"only an item", " {item} ", true, "", "no words besides"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			phrases, err := parseIntentPhrases(tt.in, tt.withItem)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := intentPhrasesString(phrases); got != tt.want {
+				t.Errorf("phrases = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFuzzyFindItem(t *testing.T) {
+	vp := versionedPricelist{
+		Items: []mb.CatalogueItem{
+			{CatalogueItemID: 1, Item: "Chocolate Brownies"},
+			{CatalogueItemID: 2, Item: "Blueberry Muffin"},
+			{CatalogueItemID: 3, Item: "Carrot Cake"},
+			{CatalogueItemID: 4, Item: "Lemon Tart"},
+			{CatalogueItemID: 5, Item: "Lemon Cake"},
+			{CatalogueItemID: 6, Item: "Banana Bread"},
+		},
+		States: map[int]itemState{6: {ItemID: 6, Active: false}},
+	}
+	tests := []struct {
+		query string
+		want  int // 0 for no item
+	}{
+		{"the chocolate brownies", 1},
+		{"die brownies", 1},
+		{"blueberry muffin", 2},
+		{"a blubery muffin", 2},
+		{"carrot cake", 3},
+		{"lemon tart", 4},
+		{"the lemon", 0},
+		{"cake", 0},
+		{"banana bread", 0},
+		{"pizza", 0},
+		{"the one", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			item, ok := fuzzyFindItem(vp, tt.query)
+			if got := ctlgItemID(item); ok != (tt.want != 0) || got != tt.want {
+				t.Errorf("fuzzyFindItem(%q) = item %d, %v; want item %d", tt.query, got, ok, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// Rows of list messages and quick-reply buttons we send carry choiceID as
+// their ID: the command a tap stands for, stamped with the pricelist
+// version it was built from. A tap then goes through the pipeline exactly
+// as if the customer had typed the command.
+
+const choicePrefix = "cmd:"
+
+const choiceExpiredMessage = "That menu has expired, send 'menu' for the latest."
+
+// choiceID is the row or button ID of an option that stands for typing
+// command, e.g. choiceID(vp, "add item7").
+func choiceID(vp versionedPricelist, command string) string {
+	return fmt.Sprintf("%s%d:%s", choicePrefix, vp.Version, command)
+}
+
+// inboundText returns what the customer sent: the text they typed, or for
+// a tap on a list row or button the command it stands for. expired reports
+// a tap on something we don't recognise or that was built from an older
+// pricelist than version.
+func inboundText(m *waProto.Message, version int64) (text string, expired bool) {
+	var id string
+	switch {
+	case m.GetButtonsResponseMessage() != nil:
+		id = m.GetButtonsResponseMessage().GetSelectedButtonID()
+	case m.GetListResponseMessage() != nil:
+		id = m.GetListResponseMessage().GetSingleSelectReply().GetSelectedRowID()
+	case m.GetTemplateButtonReplyMessage() != nil:
+		id = m.GetTemplateButtonReplyMessage().GetSelectedID()
+	case m.GetExtendedTextMessage() != nil:
+		// Replies, links and messages sent from an ad arrive this way.
+		return m.GetExtendedTextMessage().GetText(), false
+	default:
+		return m.GetConversation(), false
+	}
+	rest, ok := strings.CutPrefix(id, choicePrefix)
+	if !ok {
+		return "", true
+	}
+	built, command, _ := strings.Cut(rest, ":")
+	if v, err := strconv.ParseInt(built, 10, 64); err != nil || v != version || command == "" {
+		return "", true
+	}
+	return command, false
+}
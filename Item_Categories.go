@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Categories group catalogue items, e.g. "edibles", so a special can cover
+// several at once. An item is in at most one category.
+
+type itemCategory struct {
+	ItemID   int    `json:"item_id"`
+	Category string `json:"category"`
+}
+
+func loadItemCategories(db *sql.DB) (map[int]string, error) {
+	rows, err := db.Query(`SELECT item_id, category FROM item_categories WHERE catalogue_id = $1`, catalogueID)
+	if err != nil {
+		return nil, fmt.Errorf("loading item categories: %w", err)
+	}
+	defer rows.Close()
+	categories := make(map[int]string)
+	for rows.Next() {
+		var c itemCategory
+		if err := rows.Scan(&c.ItemID, &c.Category); err != nil {
+			return nil, fmt.Errorf("loading item categories: %w", err)
+		}
+		categories[c.ItemID] = c.Category
+	}
+	return categories, rows.Err()
+}
+
+// normalizeCategory is how categories are stored and compared.
+func normalizeCategory(category string) string {
+	return strings.ToLower(strings.TrimSpace(category))
+}
+
+func saveItemCategory(db dbtx, itemID int, category string) error {
+	_, err := db.Exec(`INSERT INTO item_categories (catalogue_id, item_id, category) VALUES ($1, $2, $3)
+		ON CONFLICT (catalogue_id, item_id) DO UPDATE SET category = EXCLUDED.category`, catalogueID, itemID, category)
+	return err
+}
+
+// InCategory returns the IDs of the items in category, in ID order.
+func (vp versionedPricelist) InCategory(category string) []int {
+	var ids []int
+	for id, c := range vp.Categories {
+		if c == category {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func itemCategoryList(categories map[int]string) []itemCategory {
+	list := make([]itemCategory, 0, len(categories))
+	for id, c := range categories {
+		list = append(list, itemCategory{ItemID: id, Category: c})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ItemID < list[j].ItemID })
+	return list
+}
+
+func ListItemCategoriesHandler(prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, itemCategoryList(prclist.Snapshot().Categories))
+	}
+}
+
+type itemCategoryRequest struct {
+	Category string `json:"category"`
+}
+
+func PutItemCategoryHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := itemIDParam(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, ok := prclist.Snapshot().Item(itemID); !ok {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no catalogue item %d", itemID))
+			return
+		}
+		var body itemCategoryRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		category := normalizeCategory(body.Category)
+		if category == "" {
+			writeJSONError(w, http.StatusBadRequest, "category is required")
+			return
+		}
+		if err := saveItemCategory(db, itemID, category); err != nil {
+			log.Printf("Saving category of item %d failed: %v", itemID, err)
+			writeJSONError(w, http.StatusInternalServerError, "saving category failed")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
+
+func DeleteItemCategoryHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := itemIDParam(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, err := db.Exec(`DELETE FROM item_categories WHERE catalogue_id = $1 AND item_id = $2`, catalogueID, itemID); err != nil {
+			log.Printf("Deleting category of item %d failed: %v", itemID, err)
+			writeJSONError(w, http.StatusInternalServerError, "deleting category failed")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
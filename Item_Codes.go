@@ -0,0 +1,429 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+)
+
+// An item's code is a short name for it that stays put, e.g. "blue-dream",
+// unique in the catalogue. Items get one made from their name when first
+// loaded, and a manager can set their own. The pricelist shows codes and
+// customers may type one wherever an item reference goes: ahead of
+// everything else each code in a message is read as the item's reference,
+// so "order blue-dream 2" reaches MenuBotLib as "order item7 2". Orders
+// record the codes of their items as they were, so history still says
+// which item was meant after a code moves on.
+
+const (
+	maxItemCodeLen = 20
+	itemCodeCSV    = "item_id,code"
+)
+
+var (
+	itemCodePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]*[a-z0-9]$`)
+	itemCodeLetter  = regexp.MustCompile(`[a-z]`)
+	// itemRefLike would be read as an item reference instead.
+	itemRefLike = regexp.MustCompile(`^item-?\d+$`)
+
+	errItemCodeTaken = errors.New("code is taken")
+)
+
+type itemCode struct {
+	ItemID int    `json:"item_id"`
+	Code   string `json:"code"`
+	// Manual is set for codes a manager chose, which are never regenerated.
+	Manual bool `json:"manual"`
+}
+
+// reservedItemCode reports whether code is a word of a command, which
+// would stop the command working if it stood for an item.
+func reservedItemCode(code string) bool {
+	words := []string{menuCommand, newOrderAnywayCommand, confirmCommand, contactDeclineCommand,
+		subscribeCommand, unsubscribeCommand, "order", "add"}
+	words = append(words, checkoutCommands...)
+	for _, cmd := range customerCommands {
+		words = append(words, cmd.name)
+	}
+	for _, w := range words {
+		for _, f := range strings.Fields(w) {
+			if f == code {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// normalizeItemCode is how codes are stored and compared.
+func normalizeItemCode(code string) string {
+	return strings.ToLower(strings.TrimSpace(code))
+}
+
+func validateItemCode(code string) error {
+	switch {
+	case len(code) < 2 || len(code) > maxItemCodeLen:
+		return fmt.Errorf("code must be 2 to %d characters", maxItemCodeLen)
+	case !itemCodePattern.MatchString(code) || !itemCodeLetter.MatchString(code):
+		return fmt.Errorf("code %q must be lower-case letters, digits and hyphens, with at least one letter", code)
+	case itemRefLike.MatchString(code):
+		return fmt.Errorf("code %q looks like an item reference", code)
+	case reservedItemCode(code):
+		return fmt.Errorf("code %q is a command word", code)
+	}
+	return nil
+}
+
+// itemCodeSlug makes a code from an item's name, e.g. "Blue Dream (5g)"
+// becomes "blue-dream-5g", cut at a word to fit.
+func itemCodeSlug(name string) string {
+	var words []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return (r < 'a' || r > 'z') && (r < '0' || r > '9')
+	}) {
+		if len(strings.Join(append(words, w), "-")) > maxItemCodeLen {
+			break
+		}
+		words = append(words, w)
+	}
+	return strings.Join(words, "-")
+}
+
+// newItemCode is a free code for an item: its name's slug, numbered when
+// taken, or "item-code" style fallbacks for names that make no slug.
+func newItemCode(name string, taken map[string]bool) string {
+	base := itemCodeSlug(name)
+	if validateItemCode(base) != nil {
+		base = "code"
+	}
+	if len(base) > maxItemCodeLen-4 {
+		base = strings.TrimRight(base[:maxItemCodeLen-4], "-")
+	}
+	code := base
+	for n := 2; taken[code] || validateItemCode(code) != nil; n++ {
+		code = fmt.Sprintf("%s-%d", base, n)
+	}
+	return code
+}
+
+func loadItemCodes(db *sql.DB) (map[int]itemCode, error) {
+	rows, err := db.Query(`SELECT item_id, code, manual FROM item_codes WHERE catalogue_id = $1`, catalogueID)
+	if err != nil {
+		return nil, fmt.Errorf("loading item codes: %w", err)
+	}
+	defer rows.Close()
+	codes := make(map[int]itemCode)
+	for rows.Next() {
+		var c itemCode
+		if err := rows.Scan(&c.ItemID, &c.Code, &c.Manual); err != nil {
+			return nil, fmt.Errorf("loading item codes: %w", err)
+		}
+		codes[c.ItemID] = c
+	}
+	return codes, rows.Err()
+}
+
+// assignItemCodes gives every item without a code one made from its name,
+// which is how existing catalogues got theirs. A code another instance
+// took meanwhile is left for the next load.
+func assignItemCodes(db *sql.DB, items []mb.CatalogueItem) (map[int]string, error) {
+	stored, err := loadItemCodes(db)
+	if err != nil {
+		return nil, err
+	}
+	codes := make(map[int]string, len(items))
+	taken := make(map[string]bool, len(stored))
+	for id, c := range stored {
+		codes[id] = c.Code
+		taken[c.Code] = true
+	}
+	for _, item := range items {
+		id := ctlgItemID(item)
+		if _, ok := codes[id]; ok {
+			continue
+		}
+		code := newItemCode(ctlgItemName(item), taken)
+		res, err := db.Exec(`INSERT INTO item_codes (catalogue_id, item_id, code) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+			catalogueID, id, code)
+		if err != nil {
+			return nil, fmt.Errorf("assigning code to item %d: %w", id, err)
+		}
+		if n, _ := res.RowsAffected(); n == 1 {
+			log.Printf("Catalogue: %s is %s", itemRef(id), code)
+			codes[id], taken[code] = code, true
+		}
+	}
+	return codes, nil
+}
+
+func saveItemCode(db dbtx, itemID int, code string) error {
+	_, err := db.Exec(`INSERT INTO item_codes (catalogue_id, item_id, code, manual) VALUES ($1, $2, $3, true)
+		ON CONFLICT (catalogue_id, item_id) DO UPDATE SET code = EXCLUDED.code, manual = true`, catalogueID, itemID, code)
+	return err
+}
+
+// ItemByCode returns the ID of the item with code.
+func (vp versionedPricelist) ItemByCode(code string) (int, bool) {
+	code = normalizeItemCode(code)
+	for id, c := range vp.Codes {
+		if c == code {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// expandItemCodes replaces each code in msg with the item's reference.
+func expandItemCodes(vp versionedPricelist, msg string) string {
+	if len(vp.Codes) == 0 {
+		return msg
+	}
+	fields := strings.Fields(msg)
+	changed := false
+	for i, f := range fields {
+		word := strings.TrimRight(f, ".,!?")
+		if id, ok := vp.ItemByCode(word); ok {
+			fields[i] = itemRef(id) + f[len(word):]
+			changed = true
+		}
+	}
+	if !changed {
+		return msg
+	}
+	return strings.Join(fields, " ")
+}
+
+// stampItemCodes records the codes the order's items have now. Items
+// already stamped keep theirs.
+func stampItemCodes(db *sql.DB, orderID int64, vp versionedPricelist, lines []orderLine) error {
+	codes := make(map[string]string, len(lines))
+	for _, line := range lines {
+		if code, ok := vp.Codes[line.ItemID]; ok {
+			codes[strconv.Itoa(line.ItemID)] = code
+		}
+	}
+	encoded, err := json.Marshal(codes)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO order_meta (order_id, pricelist_version, item_codes) VALUES ($1, 0, $2)
+		ON CONFLICT (order_id) DO UPDATE SET item_codes = EXCLUDED.item_codes || order_meta.item_codes, updated_at = now()`,
+		orderID, string(encoded))
+	return err
+}
+
+// orderItemCodes returns the codes stamped on an order, by item ID.
+func orderItemCodes(db dbtx, orderID int64) (map[string]string, error) {
+	var raw string
+	err := db.QueryRow(`SELECT item_codes::text FROM order_meta WHERE order_id = $1`, orderID).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	codes := map[string]string{}
+	return codes, json.Unmarshal([]byte(raw), &codes)
+}
+
+func itemCodeList(vp versionedPricelist, manual map[int]bool) []itemCode {
+	list := make([]itemCode, 0, len(vp.Codes))
+	for id, code := range vp.Codes {
+		list = append(list, itemCode{ItemID: id, Code: code, Manual: manual[id]})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ItemID < list[j].ItemID })
+	return list
+}
+
+func manualItemCodes(db *sql.DB) (map[int]bool, error) {
+	stored, err := loadItemCodes(db)
+	if err != nil {
+		return nil, err
+	}
+	manual := make(map[int]bool, len(stored))
+	for id, c := range stored {
+		manual[id] = c.Manual
+	}
+	return manual, nil
+}
+
+// ListItemCodesHandler serves the codes as JSON, or with ?format=csv as
+// the CSV ImportItemCodesHandler takes.
+func ListItemCodesHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		manual, err := manualItemCodes(db)
+		if err != nil {
+			log.Printf("Listing item codes failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "listing item codes failed")
+			return
+		}
+		codes := itemCodeList(prclist.Snapshot(), manual)
+		if r.URL.Query().Get("format") != "csv" {
+			writeJSON(w, http.StatusOK, codes)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="item-codes.csv"`)
+		out := csv.NewWriter(w)
+		out.Write(strings.Split(itemCodeCSV, ","))
+		for _, c := range codes {
+			out.Write([]string{strconv.Itoa(c.ItemID), c.Code})
+		}
+		out.Flush()
+		if err := out.Error(); err != nil {
+			log.Printf("Writing item codes CSV failed: %v", err)
+		}
+	}
+}
+
+type itemCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// checkItemCodes validates codes to be set, by item ID, against each other
+// and the codes of the items not being changed.
+func checkItemCodes(vp versionedPricelist, codes map[int]string) error {
+	owner := make(map[string]int, len(vp.Codes))
+	for id, code := range vp.Codes {
+		if _, changing := codes[id]; !changing {
+			owner[code] = id
+		}
+	}
+	ids := make([]int, 0, len(codes))
+	for id := range codes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		code := codes[id]
+		if _, ok := vp.Item(id); !ok {
+			return fmt.Errorf("no catalogue item %d", id)
+		}
+		if err := validateItemCode(code); err != nil {
+			return fmt.Errorf("item %d: %w", id, err)
+		}
+		if other, ok := owner[code]; ok && other != id {
+			return fmt.Errorf("item %d: %w by %s", id, errItemCodeTaken, itemRef(other))
+		}
+		owner[code] = id
+	}
+	return nil
+}
+
+func PutItemCodeHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := itemIDParam(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var body itemCodeRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		code := normalizeItemCode(body.Code)
+		if err := checkItemCodes(prclist.Snapshot(), map[int]string{itemID: code}); errors.Is(err, errItemCodeTaken) {
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := saveItemCode(db, itemID, code); err != nil {
+			log.Printf("Saving code of item %d failed: %v", itemID, err)
+			writeJSONError(w, http.StatusInternalServerError, "saving code failed")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
+
+// ImportItemCodesHandler sets the codes of the items in an item_id,code
+// CSV as ListItemCodesHandler writes it. Items not in it keep theirs.
+func ImportItemCodesHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		codes, err := parseItemCodesCSV(r.Body)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		vp := prclist.Snapshot()
+		if err := checkItemCodes(vp, codes); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Item code import: begin failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "import failed")
+			return
+		}
+		defer tx.Rollback()
+		// Codes may be swapped between items, so the old ones go first.
+		for id := range codes {
+			if _, err := tx.Exec(`DELETE FROM item_codes WHERE catalogue_id = $1 AND item_id = $2`, catalogueID, id); err != nil {
+				log.Printf("Item code import: clearing item %d failed: %v", id, err)
+				writeJSONError(w, http.StatusInternalServerError, "import failed")
+				return
+			}
+		}
+		for id, code := range codes {
+			if err := saveItemCode(tx, id, code); err != nil {
+				log.Printf("Item code import: saving item %d failed: %v", id, err)
+				writeJSONError(w, http.StatusInternalServerError, "import failed")
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Item code import: commit failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "import failed")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
+
+func parseItemCodesCSV(body io.Reader) (map[int]string, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	if strings.Join(header, ",") != itemCodeCSV {
+		return nil, fmt.Errorf("CSV header must be %s", itemCodeCSV)
+	}
+	codes := map[int]string{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		itemID, err := strconv.Atoi(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid item_id %q", line, record[0])
+		}
+		if _, dup := codes[itemID]; dup {
+			return nil, fmt.Errorf("line %d: item %d is listed twice", line, itemID)
+		}
+		codes[itemID] = normalizeItemCode(record[1])
+	}
+	return codes, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// maxItemImageBytes keeps item photos well under WhatsApp's image limit
+	// and stops a misconfigured URL from pulling in something huge.
+	maxItemImageBytes = 5 << 20
+	itemImageTimeout  = 20 * time.Second
+)
+
+var errImageTooLarge = fmt.Errorf("image larger than %d bytes", maxItemImageBytes)
+
+func loadItemImages(db *sql.DB) (map[int]string, error) {
+	rows, err := db.Query(`SELECT item_id, image_url FROM item_images WHERE catalogue_id = $1`, catalogueID)
+	if err != nil {
+		return nil, fmt.Errorf("loading item images: %w", err)
+	}
+	defer rows.Close()
+
+	images := make(map[int]string)
+	for rows.Next() {
+		var id int
+		var imageURL string
+		if err := rows.Scan(&id, &imageURL); err != nil {
+			return nil, fmt.Errorf("loading item images: %w", err)
+		}
+		images[id] = imageURL
+	}
+	return images, rows.Err()
+}
+
+// itemImageCache remembers uploaded item images for one pricelist version,
+// so repeated "show" requests reuse the upload. A new version (which any
+// image change produces) starts an empty cache.
+type itemImageCache struct {
+	mu      sync.Mutex
+	version int64
+	uploads map[int]*waProto.ImageMessage
+}
+
+func newItemImageCache() *itemImageCache {
+	return &itemImageCache{uploads: map[int]*waProto.ImageMessage{}}
+}
+
+// Get returns the uploaded image for itemID, uploading it on first use.
+// The returned message has no caption; set one on a copy.
+func (c *itemImageCache) Get(client waClient, version int64, itemID int, imageURL string) (*waProto.ImageMessage, error) {
+	c.mu.Lock()
+	if c.version != version {
+		c.version, c.uploads = version, map[int]*waProto.ImageMessage{}
+	}
+	img, ok := c.uploads[itemID]
+	c.mu.Unlock()
+	if ok {
+		return img, nil
+	}
+
+	img, err := uploadItemImage(client, imageURL)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if c.version == version {
+		c.uploads[itemID] = img
+	}
+	c.mu.Unlock()
+	return img, nil
+}
+
+func uploadItemImage(client waClient, imageURL string) (*waProto.ImageMessage, error) {
+	if client == nil {
+		// The replay has no client; the caption goes as text instead.
+		return nil, fmt.Errorf("no WhatsApp client to upload with")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), itemImageTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching image: %s", resp.Status)
+	}
+	if resp.ContentLength > maxItemImageBytes {
+		return nil, errImageTooLarge
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxItemImageBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("fetching image: %w", err)
+	}
+	if len(data) > maxItemImageBytes {
+		return nil, errImageTooLarge
+	}
+	mimetype := http.DetectContentType(data)
+	if mimetype != "image/jpeg" && mimetype != "image/png" {
+		return nil, fmt.Errorf("unsupported image type %s", mimetype)
+	}
+
+	up, err := client.Upload(ctx, data, whatsmeow.MediaImage)
+	if err != nil {
+		return nil, fmt.Errorf("uploading image: %w", err)
+	}
+	return &waProto.ImageMessage{
+		URL:           proto.String(up.URL),
+		DirectPath:    proto.String(up.DirectPath),
+		MediaKey:      up.MediaKey,
+		Mimetype:      proto.String(mimetype),
+		FileEncSHA256: up.FileEncSHA256,
+		FileSHA256:    up.FileSHA256,
+		FileLength:    proto.Uint64(up.FileLength),
+	}, nil
+}
+
+// findItem resolves "item7", "7", an item code or an item name to a
+// catalogue item, and failing those a description close enough to one
+// item's name.
+func findItem(vp versionedPricelist, query string) (mb.CatalogueItem, bool) {
+	if ids := referencedItemIDs(query); len(ids) > 0 {
+		return vp.Item(ids[0])
+	}
+	if id, ok := vp.ItemByCode(query); ok {
+		return vp.Item(id)
+	}
+	if id, err := strconv.Atoi(query); err == nil {
+		return vp.Item(id)
+	}
+	for _, item := range vp.Items {
+		if strings.EqualFold(ctlgItemName(item), query) {
+			return item, true
+		}
+	}
+	return fuzzyFindItem(vp, query)
+}
+
+func itemCaption(item mb.CatalogueItem) string {
+	return fmt.Sprintf("%s (%s) - R%.2f", ctlgItemName(item), itemRef(ctlgItemID(item)), ctlgItemPrice(item))
+}
+
+// customerShowItem handles "show <item>", sending the item's photo with
+// its name and price. Items without a photo, or whose photo can't be sent,
+// get the same details as text.
+func customerShowItem(cc *commandContext, sender string, args []string) string {
+	query := strings.Join(args, " ")
+	if query == "" {
+		return "Send \"show\" followed by an item, e.g. \"show item7\"."
+	}
+	vp := cc.prclist.Snapshot().ForTier(customerTier(cc.db, sender))
+	item, ok := findItem(vp, query)
+	if !ok || !vp.Listed(ctlgItemID(item)) {
+		return fmt.Sprintf("Sorry, we don't have an item called %q.", query)
+	}
+	caption := itemCaption(item)
+	id := ctlgItemID(item)
+	imageURL, ok := vp.Images[id]
+	if !ok {
+		return caption
+	}
+
+	img, err := cc.images.Get(cc.client, vp.Version, id, imageURL)
+	if err != nil {
+		log.Printf("Show item %d: image %s unavailable: %v", id, imageURL, err)
+		return caption
+	}
+	to, err := resolveJID(sender)
+	if err == nil {
+		msg := proto.Clone(img).(*waProto.ImageMessage)
+		msg.Caption = proto.String(caption)
+		err = cc.sender.SendImage(to, msg, priorityReply)
+	}
+	if err != nil {
+		log.Printf("Show item %d: sending image failed: %v", id, err)
+		return caption
+	}
+	return ""
+}
+
+type itemImageRequest struct {
+	ImageURL string `json:"image_url"`
+}
+
+func PutItemImageHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := itemIDParam(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, ok := prclist.Snapshot().Item(itemID); !ok {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no catalogue item %d", itemID))
+			return
+		}
+
+		var req itemImageRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		if !strings.HasPrefix(req.ImageURL, "https://") && !strings.HasPrefix(req.ImageURL, "http://") {
+			writeJSONError(w, http.StatusBadRequest, "image_url must be an http(s) URL")
+			return
+		}
+
+		_, err = db.Exec(`INSERT INTO item_images (catalogue_id, item_id, image_url) VALUES ($1, $2, $3)
+			ON CONFLICT (catalogue_id, item_id) DO UPDATE SET image_url = EXCLUDED.image_url`,
+			catalogueID, itemID, req.ImageURL)
+		if err != nil {
+			log.Printf("Saving image for item %d failed: %v", itemID, err)
+			writeJSONError(w, http.StatusInternalServerError, "saving image failed")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
+
+func DeleteItemImageHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := itemIDParam(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, err := db.Exec(`DELETE FROM item_images WHERE catalogue_id = $1 AND item_id = $2`, catalogueID, itemID); err != nil {
+			log.Printf("Deleting image for item %d failed: %v", itemID, err)
+			writeJSONError(w, http.StatusInternalServerError, "deleting image failed")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// inactiveReminderAge is how long an item may sit switched off before
+	// the admin is reminded to delete or restore it.
+	inactiveReminderAge  = 30 * 24 * time.Hour
+	inactiveReminderHour = 9
+)
+
+// itemState is the web API's own record of whether a catalogue item is on
+// the menu. MenuBotLib owns the catalogue rows, and they are never deleted:
+// old orders keep referring to them. Items without a state are active.
+type itemState struct {
+	ItemID        int        `json:"item_id"`
+	Active        bool       `json:"active"`
+	InactiveSince *time.Time `json:"inactive_since,omitempty"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+}
+
+// Listed reports whether customers can order the item at all.
+func (s itemState) Listed() bool {
+	return s.Active && s.DeletedAt == nil
+}
+
+func loadItemStates(db *sql.DB) (map[int]itemState, error) {
+	rows, err := db.Query(`SELECT item_id, is_active, inactive_since, deleted_at FROM item_state WHERE catalogue_id = $1`, catalogueID)
+	if err != nil {
+		return nil, fmt.Errorf("loading item states: %w", err)
+	}
+	defer rows.Close()
+
+	states := make(map[int]itemState)
+	for rows.Next() {
+		var s itemState
+		var inactiveSince, deletedAt sql.NullTime
+		if err := rows.Scan(&s.ItemID, &s.Active, &inactiveSince, &deletedAt); err != nil {
+			return nil, fmt.Errorf("loading item states: %w", err)
+		}
+		if inactiveSince.Valid {
+			s.InactiveSince = &inactiveSince.Time
+		}
+		if deletedAt.Valid {
+			s.DeletedAt = &deletedAt.Time
+		}
+		states[s.ItemID] = s
+	}
+	return states, rows.Err()
+}
+
+// Listed reports whether the item is active and not deleted.
+func (vp versionedPricelist) Listed(id int) bool {
+	s, ok := vp.States[id]
+	return !ok || s.Listed()
+}
+
+func (vp versionedPricelist) Deleted(id int) bool {
+	s, ok := vp.States[id]
+	return ok && s.DeletedAt != nil
+}
+
+func itemStateList(states map[int]itemState) []itemState {
+	list := make([]itemState, 0, len(states))
+	for _, s := range states {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ItemID < list[j].ItemID })
+	return list
+}
+
+// setItemActive switches an item on or off. Switching it on also restores
+// a deleted item.
+func setItemActive(db *sql.DB, itemID int, active bool) error {
+	_, err := db.Exec(`INSERT INTO item_state (catalogue_id, item_id, is_active, inactive_since)
+		VALUES ($1, $2, $3, CASE WHEN $3 THEN NULL ELSE now() END)
+		ON CONFLICT (catalogue_id, item_id) DO UPDATE SET is_active = EXCLUDED.is_active,
+			inactive_since = CASE WHEN EXCLUDED.is_active THEN NULL ELSE COALESCE(item_state.inactive_since, now()) END,
+			deleted_at = CASE WHEN EXCLUDED.is_active THEN NULL ELSE item_state.deleted_at END`,
+		catalogueID, itemID, active)
+	return err
+}
+
+func softDeleteItem(db *sql.DB, itemID int) error {
+	_, err := db.Exec(`INSERT INTO item_state (catalogue_id, item_id, is_active, inactive_since, deleted_at)
+		VALUES ($1, $2, false, now(), now())
+		ON CONFLICT (catalogue_id, item_id) DO UPDATE SET is_active = false,
+			inactive_since = COALESCE(item_state.inactive_since, now()), deleted_at = COALESCE(item_state.deleted_at, now())`,
+		catalogueID, itemID)
+	return err
+}
+
+type itemStatePatch struct {
+	Active *bool `json:"active"`
+}
+
+// PatchItemHandler toggles an item's availability, e.g. {"active": false}
+// when it has sold out for the week.
+func PatchItemHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := itemIDParam(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, ok := prclist.Snapshot().Item(itemID); !ok {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no catalogue item %d", itemID))
+			return
+		}
+		var patch itemStatePatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		if patch.Active == nil {
+			writeJSONError(w, http.StatusBadRequest, "active is required")
+			return
+		}
+		if err := setItemActive(db, itemID, *patch.Active); err != nil {
+			log.Printf("Updating item %d failed: %v", itemID, err)
+			writeJSONError(w, http.StatusInternalServerError, "updating item failed")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
+
+// DeleteItemHandler takes an item off the menu for good. The catalogue row
+// stays so order history still resolves its name and price.
+func DeleteItemHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := itemIDParam(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, ok := prclist.Snapshot().Item(itemID); !ok {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no catalogue item %d", itemID))
+			return
+		}
+		if err := softDeleteItem(db, itemID); err != nil {
+			log.Printf("Deleting item %d failed: %v", itemID, err)
+			writeJSONError(w, http.StatusInternalServerError, "deleting item failed")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
+
+// staleInactiveItems lists items switched off (but not deleted) for longer
+// than inactiveReminderAge.
+func staleInactiveItems(vp versionedPricelist, now time.Time) []string {
+	var names []string
+	for _, s := range itemStateList(vp.States) {
+		if s.Active || s.DeletedAt != nil || s.InactiveSince == nil || now.Sub(*s.InactiveSince) < inactiveReminderAge {
+			continue
+		}
+		name := itemRef(s.ItemID)
+		if item, ok := vp.Item(s.ItemID); ok {
+			name = fmt.Sprintf("%s (%s)", ctlgItemName(item), itemRef(s.ItemID))
+		}
+		days := int(now.Sub(*s.InactiveSince).Hours() / 24)
+		names = append(names, fmt.Sprintf("%s, off for %d days", name, days))
+	}
+	return names
+}
+
+// remindInactiveItems tells the admin, as a morning job, about items that
+// have been switched off for a long time.
+func remindInactiveItems(cc *commandContext) error {
+	if names := staleInactiveItems(cc.prclist.Snapshot(), time.Now()); len(names) > 0 {
+		cc.sendBulk(bulkMessage{
+			Recipient: cc.envVars.AdminNumber,
+			Text:      "These items have been off the menu for over 30 days. Delete them or switch them back on:\n" + strings.Join(names, "\n"),
+			Kind:      bulkAdmin,
+		})
+	}
+	return nil
+}
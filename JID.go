@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+var (
+	msisdnPattern  = regexp.MustCompile(`^\d{6,15}$`)
+	groupIDPattern = regexp.MustCompile(`^\d+(-\d+)?$`)
+)
+
+// resolveJID is the single place outbound recipients are turned into JIDs.
+// It accepts a bare phone number ("27821234567", "+27 82 123 4567") or a
+// full JID string for a user, group or LID recipient.
+func resolveJID(to string) (types.JID, error) {
+	to = strings.TrimSpace(to)
+	if to == "" {
+		return types.JID{}, fmt.Errorf("empty recipient")
+	}
+
+	if !strings.Contains(to, "@") {
+		number := strings.NewReplacer("+", "", " ", "", "-", "").Replace(to)
+		if !msisdnPattern.MatchString(number) {
+			return types.JID{}, fmt.Errorf("invalid phone number %q", to)
+		}
+		return types.NewJID(number, types.DefaultUserServer), nil
+	}
+
+	jid, err := types.ParseJID(to)
+	if err != nil {
+		return types.JID{}, fmt.Errorf("invalid JID %q: %w", to, err)
+	}
+	return validateJID(jid)
+}
+
+// validateJID checks that jid is a recipient we can message and strips any
+// device part, since replies go to the account rather than one device.
+func validateJID(jid types.JID) (types.JID, error) {
+	if jid.User == "" {
+		return types.JID{}, fmt.Errorf("JID %q has no user part", jid)
+	}
+	switch jid.Server {
+	case types.DefaultUserServer, types.LegacyUserServer:
+		if !msisdnPattern.MatchString(jid.User) {
+			return types.JID{}, fmt.Errorf("invalid phone number in JID %q", jid)
+		}
+		return types.NewJID(jid.User, types.DefaultUserServer), nil
+	case types.GroupServer:
+		if !groupIDPattern.MatchString(jid.User) {
+			return types.JID{}, fmt.Errorf("invalid group JID %q", jid)
+		}
+		return jid.ToNonAD(), nil
+	case types.HiddenUserServer:
+		return jid.ToNonAD(), nil
+	default:
+		return types.JID{}, fmt.Errorf("unsupported JID server %q", jid.Server)
+	}
+}
+
+// replyJID is where a reply to an inbound message should go: the chat it
+// arrived in, so group and LID conversations are answered in place.
+func replyJID(info types.MessageInfo) (types.JID, error) {
+	return validateJID(info.Chat)
+}
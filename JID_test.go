@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+func TestResolveJID(t *testing.T) {
+	tests := []struct {
+		name    string
+		to      string
+		want    string
+		wantErr bool
+	}{
+		{"bare number", "27821234567", "27821234567@s.whatsapp.net", false},
+		{"formatted number", "+27 82 123-4567", "27821234567@s.whatsapp.net", false},
+		{"padded number", "  27821234567\n", "27821234567@s.whatsapp.net", false},
+		{"user JID", "27821234567@s.whatsapp.net", "27821234567@s.whatsapp.net", false},
+		{"legacy user JID", "27821234567@c.us", "27821234567@s.whatsapp.net", false},
+		{"user JID with a device", "27821234567:12@s.whatsapp.net", "27821234567@s.whatsapp.net", false},
+		{"group JID", "120363025246125486@g.us", "120363025246125486@g.us", false},
+		{"old style group JID", "27821234567-1613041234@g.us", "27821234567-1613041234@g.us", false},
+		{"LID JID", "123456789012345@lid", "123456789012345@lid", false},
+		{"LID JID with a device", "123456789012345:3@lid", "123456789012345@lid", false},
+		{"empty", "", "", true},
+		{"blank", "   ", "", true},
+		{"too short", "12345", "", true},
+		{"too long", "1234567890123456", "", true},
+		{"letters", "2782abc4567", "", true},
+		{"letters in a user JID", "abc@s.whatsapp.net", "", true},
+		{"no user part", "@s.whatsapp.net", "", true},
+		{"bad group ID", "abc@g.us", "", true},
+		{"unsupported server", "27821234567@broadcast", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveJID(tt.to)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("resolveJID(%q) = %s, want an error", tt.to, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveJID(%q): %v", tt.to, err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("resolveJID(%q) = %s, want %s", tt.to, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplyJID(t *testing.T) {
+	user := types.NewJID("27821234567", types.DefaultUserServer)
+	group := types.NewJID("120363025246125486", types.GroupServer)
+	lid := types.NewJID("123456789012345", types.HiddenUserServer)
+	tests := []struct {
+		name    string
+		info    types.MessageInfo
+		want    string
+		wantErr bool
+	}{
+		{"direct chat", types.MessageInfo{MessageSource: types.MessageSource{Chat: user, Sender: user}}, "27821234567@s.whatsapp.net", false},
+		{"group chat answers the group", types.MessageInfo{MessageSource: types.MessageSource{Chat: group, Sender: user, IsGroup: true}}, "120363025246125486@g.us", false},
+		{"LID chat answers the LID", types.MessageInfo{MessageSource: types.MessageSource{Chat: lid, Sender: lid}}, "123456789012345@lid", false},
+		{"status broadcast", types.MessageInfo{MessageSource: types.MessageSource{Chat: types.StatusBroadcastJID, Sender: user}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := replyJID(tt.info)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("replyJID = %s, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("replyJID = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Two instances can run against the same databases as a warm standby.
+// Whichever holds a session-level Postgres advisory lock is the leader: it
+// connects WhatsApp and runs the background jobs, the payment pipeline and
+// the outbox. The follower serves HTTP and keeps trying the lock; ITNs it
+// receives are stored for the leader's pipeline, and messages it can't send
+// wait in the outbox. Postgres drops the lock with the leader's connection,
+// so the follower takes over within leaderPoll. Both instances need the
+// same WHATSAPP_DB_URL for the standby to have the session.
+
+const leaderPoll = 2 * time.Second
+
+// exitLostLeadership is EX_TEMPFAIL: the leader's lock went with its
+// database connection and the standby may already be connected. The
+// restarted process comes back as the follower.
+const exitLostLeadership = 75
+
+const (
+	roleLeader   = "leader"
+	roleFollower = "follower"
+)
+
+type leaderElection struct {
+	db     *sql.DB
+	key    string
+	leader atomic.Bool
+}
+
+// newLeaderElection keys the lock by INSTANCE_ID, so deployments sharing a
+// database don't stand in for each other.
+func newLeaderElection(db *sql.DB, instanceID string) *leaderElection {
+	e := &leaderElection{db: db, key: "menubot:" + instanceID}
+	metrics.GaugeFunc("menubot_leader", "1 while this instance holds the leader lock.", func() float64 {
+		if e.leader.Load() {
+			return 1
+		}
+		return 0
+	})
+	return e
+}
+
+func (e *leaderElection) Leader() bool {
+	return e.leader.Load()
+}
+
+func (e *leaderElection) Role() string {
+	if e.Leader() {
+		return roleLeader
+	}
+	return roleFollower
+}
+
+// campaign blocks until this instance holds the lock or ctx ends. Once it
+// does, the connection holding the lock is watched and lost is called if it
+// drops; ending ctx releases the lock instead.
+func (e *leaderElection) campaign(ctx context.Context, lost func(error)) error {
+	waiting := false
+	for {
+		conn, won, err := e.tryLock(ctx)
+		switch {
+		case won:
+			e.leader.Store(true)
+			go e.hold(ctx, conn, lost)
+			return nil
+		case err != nil && ctx.Err() == nil:
+			log.Printf("Leader election: trying the lock failed: %v", err)
+		case !waiting:
+			log.Printf("Another instance is the leader, running as follower")
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(leaderPoll):
+		}
+	}
+}
+
+func (e *leaderElection) tryLock(ctx context.Context) (*sql.Conn, bool, error) {
+	conn, err := e.db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	var won bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock(hashtext($1))`, e.key).Scan(&won); err != nil || !won {
+		conn.Close()
+		return nil, false, err
+	}
+	return conn, true, nil
+}
+
+func (e *leaderElection) hold(ctx context.Context, conn *sql.Conn, lost func(error)) {
+	defer conn.Close()
+	for {
+		select {
+		case <-ctx.Done():
+			// The connection goes back to the pool, which would keep the
+			// lock, so release it for the standby.
+			unlockCtx, cancel := context.WithTimeout(context.Background(), leaderPoll)
+			defer cancel()
+			if _, err := conn.ExecContext(unlockCtx, `SELECT pg_advisory_unlock(hashtext($1))`, e.key); err != nil {
+				log.Printf("Leader election: releasing the lock failed: %v", err)
+			}
+			e.leader.Store(false)
+			return
+		case <-time.After(leaderPoll):
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, leaderPoll)
+		err := conn.PingContext(pingCtx)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			e.leader.Store(false)
+			lost(err)
+			return
+		}
+	}
+}
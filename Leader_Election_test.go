@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLeaderRole(t *testing.T) {
+	e := newLeaderElection(nil, "test")
+	tests := []struct {
+		leader bool
+		want   string
+	}{
+		{false, roleFollower},
+		{true, roleLeader},
+		{false, roleFollower},
+	}
+	for _, tt := range tests {
+		e.leader.Store(tt.leader)
+		if got := e.Role(); got != tt.want {
+			t.Errorf("Role() with leader %v = %s, want %s", tt.leader, got, tt.want)
+		}
+	}
+}
+
+// TestLeaderFailover runs two elections for the same instance against
+// Postgres, kills the leader's connection and checks that the standby takes
+// over, then that a leader stepping down hands over too. It only runs when
+// MENUBOT_TEST_DATABASE_URL names a database.
+func TestLeaderFailover(t *testing.T) {
+	dsn := os.Getenv("MENUBOT_TEST_DATABASE_URL")
+	if dsn == "" {
+		t.Skip("MENUBOT_TEST_DATABASE_URL is not set")
+	}
+	open := func() *sql.DB {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		return db
+	}
+	instance := fmt.Sprintf("failover%d", time.Now().UnixNano())
+	primary, standby := newLeaderElection(open(), instance), newLeaderElection(open(), instance)
+	admin := open()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lost := make(chan error, 1)
+	if err := primary.campaign(ctx, func(err error) { lost <- err }); err != nil {
+		t.Fatal(err)
+	}
+	if !primary.Leader() {
+		t.Fatal("the first instance isn't leading")
+	}
+
+	standbyCtx, stopStandby := context.WithCancel(ctx)
+	defer stopStandby()
+	standbyWon := make(chan error, 1)
+	go func() { standbyWon <- standby.campaign(standbyCtx, func(error) {}) }()
+	time.Sleep(2 * leaderPoll)
+	if standby.Leader() {
+		t.Fatal("both instances are leading")
+	}
+
+	// Kill the connection holding the lock, as a crashed leader would.
+	res, err := admin.Exec(`SELECT pg_terminate_backend(pid) FROM pg_locks
+		WHERE locktype = 'advisory' AND granted AND objsubid = 1
+			AND objid = (hashtext($1)::bigint & 4294967295)::oid`, primary.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := res.RowsAffected(); n != 1 {
+		t.Fatalf("%d lock holders terminated, want 1", n)
+	}
+	select {
+	case <-lost:
+	case <-time.After(5 * leaderPoll):
+		t.Fatal("the leader didn't notice losing its lock")
+	}
+	if primary.Leader() {
+		t.Error("still leading after losing the lock")
+	}
+	select {
+	case err := <-standbyWon:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * leaderPoll):
+		t.Fatal("the standby didn't take over")
+	}
+	if !standby.Leader() {
+		t.Fatal("the standby won but isn't leading")
+	}
+
+	// Stepping down releases the lock for the other instance.
+	primaryWon := make(chan error, 1)
+	go func() { primaryWon <- primary.campaign(ctx, func(error) {}) }()
+	stopStandby()
+	select {
+	case err := <-primaryWon:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * leaderPoll):
+		t.Fatal("the lock wasn't released when the leader stepped down")
+	}
+	deadline := time.Now().Add(leaderPoll)
+	for standby.Leader() {
+		if time.Now().After(deadline) {
+			t.Fatal("the standby still leads after stepping down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
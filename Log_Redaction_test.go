@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedactPhoneNumbers(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Rate limit exceeded for 27821234567, message dropped", "Rate limit exceeded for ********567, message dropped"},
+		{"sending to +27821234567", "sending to ********567"},
+		{"27821234567@s.whatsapp.net", "********567@s.whatsapp.net"},
+		{"from 27821234567 to 27829876543", "from ********567 to ********543"},
+		{"order 12345 for R120.00", "order 12345 for R120.00"},
+		{"a 16 digit reference 1234567890123456", "a 16 digit reference 1234567890123456"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := redactPhoneNumbers(tt.in); got != tt.want {
+			t.Errorf("redactPhoneNumbers(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRedactingHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		log     func(l *slog.Logger)
+		want    []string
+		notWant []string
+	}{
+		{"number in the message",
+			func(l *slog.Logger) { l.Info("Rate limit exceeded for 27821234567") },
+			[]string{"********567"}, []string{"27821234567"}},
+		{"number in an attribute",
+			func(l *slog.Logger) { l.Info("sent", "to", "27821234567", "count", 27821234567) },
+			[]string{"to=********567", "count=********567"}, []string{"27821234567"}},
+		{"number in a group",
+			func(l *slog.Logger) { l.Info("sent", slog.Group("msg", "to", "27821234567")) },
+			[]string{"msg.to=********567"}, []string{"27821234567"}},
+		{"number in a logger attribute",
+			func(l *slog.Logger) { l.With("cell", "27821234567").Info("hello") },
+			[]string{"cell=********567"}, []string{"27821234567"}},
+		{"message body",
+			func(l *slog.Logger) { l.Info("You sent a message", bodyAttrKey, "my address is 1 Long St") },
+			[]string{"[redacted len=23 sha256="}, []string{"Long St"}},
+		{"other values untouched",
+			func(l *slog.Logger) { l.Info("loaded", "version", 42, "ok", true) },
+			[]string{"version=42", "ok=true"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tt.log(slog.New(NewRedactingHandler(slog.NewTextHandler(&buf, nil))))
+			line := buf.String()
+			for _, s := range tt.want {
+				if !strings.Contains(line, s) {
+					t.Errorf("%q doesn't contain %q", line, s)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(line, s) {
+					t.Errorf("%q contains %q", line, s)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+const (
+	// exitLoginFailed is EX_TEMPFAIL: nobody scanned the QR in time, and a
+	// restart (with someone watching) should fix it.
+	exitLoginFailed = 75
+	// exitNeedsPairing is EX_NOPERM: running headless without a session,
+	// so a restart alone will never succeed.
+	exitNeedsPairing = 77
+)
+
+var errQRTimedOut = errors.New("QR code was not scanned in time")
+
+// qrLoginClient is the part of *whatsmeow.Client the QR login flow uses.
+type qrLoginClient interface {
+	GetQRChannel(ctx context.Context) (<-chan whatsmeow.QRChannelItem, error)
+	Connect() error
+	Disconnect()
+}
+
+// loginWithQR pairs a new device, showing each QR code with show. Each
+// round of codes expires after a couple of minutes; it is regenerated up
+// to rounds times before giving up with errQRTimedOut. Other failures are
+// returned as they happen since retrying won't help.
+func loginWithQR(ctx context.Context, c qrLoginClient, rounds int, show func(code string)) error {
+	for round := 1; round <= rounds; round++ {
+		qrChan, err := c.GetQRChannel(ctx)
+		if err != nil {
+			return fmt.Errorf("getting QR channel: %w", err)
+		}
+		if err := c.Connect(); err != nil {
+			return fmt.Errorf("connecting to WhatsApp: %w", err)
+		}
+
+		timedOut := false
+		for evt := range qrChan {
+			switch evt.Event {
+			case whatsmeow.QRChannelEventCode:
+				show(evt.Code)
+			case whatsmeow.QRChannelSuccess.Event:
+				return nil
+			case whatsmeow.QRChannelTimeout.Event:
+				timedOut = true
+			case whatsmeow.QRChannelEventError:
+				c.Disconnect()
+				return fmt.Errorf("pairing failed: %w", evt.Error)
+			default:
+				c.Disconnect()
+				return fmt.Errorf("pairing failed: %s", evt.Event)
+			}
+		}
+		if !timedOut {
+			c.Disconnect()
+			return errors.New("QR channel closed without a result")
+		}
+		if round < rounds {
+			log.Printf("QR code not scanned, generating a new one (%d of %d)", round+1, rounds)
+		}
+	}
+	return errQRTimedOut
+}
+
+// connectWhatsApp logs in with the stored session, or pairs a new device by
+// QR unless running headless. When pairing fails and QR_FAILURE_HTTP_ONLY is set it returns so the
+// HTTP side keeps running with /healthz reporting WhatsApp down; otherwise
+// it exits.
+func connectWhatsApp(c waClient, envVars EnvVars, connLog *connectionLog, show func(code string)) {
+	if c.ID() != nil {
+		// Already logged in, just connect
+		if err := c.Connect(); err != nil {
+			connLog.Record(connConnectFailure, err.Error())
+			connLog.Flush(2 * time.Second)
+			log.Fatalf("Connecting to WhatsApp failed: %v", err)
+		}
+		return
+	}
+
+	if envVars.Headless {
+		log.Printf("No WhatsApp session in the %s and HEADLESS is set, so no QR code can be shown. "+
+			"Pair the device by running once without HEADLESS in a terminal, then restart the service.", waDBName)
+		os.Exit(exitNeedsPairing)
+	}
+
+	err := loginWithQR(context.Background(), c, envVars.QRAttempts, show)
+	if err == nil {
+		log.Printf("Paired with WhatsApp as %s", c.ID())
+		return
+	}
+	connLog.Record(connConnectFailure, "pairing: "+err.Error())
+	connLog.Flush(2 * time.Second)
+	if envVars.QRFailureHTTPOnly {
+		log.Printf("WhatsApp login failed, serving HTTP only: %v", err)
+		return
+	}
+	log.Printf("WhatsApp login failed: %v", err)
+	os.Exit(exitLoginFailed)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mau.fi/whatsmeow"
+)
+
+// fakeQRClient plays one scripted batch of QR events per GetQRChannel call.
+type fakeQRClient struct {
+	rounds      [][]whatsmeow.QRChannelItem
+	calls       int
+	connectErr  error
+	disconnects int
+}
+
+func (c *fakeQRClient) GetQRChannel(ctx context.Context) (<-chan whatsmeow.QRChannelItem, error) {
+	if c.calls >= len(c.rounds) {
+		return nil, errors.New("no more rounds scripted")
+	}
+	items := c.rounds[c.calls]
+	c.calls++
+	ch := make(chan whatsmeow.QRChannelItem, len(items))
+	for _, item := range items {
+		ch <- item
+	}
+	close(ch)
+	return ch, nil
+}
+
+func (c *fakeQRClient) Connect() error { return c.connectErr }
+func (c *fakeQRClient) Disconnect()    { c.disconnects++ }
+
+func TestLoginWithQR(t *testing.T) {
+	code := func(s string) whatsmeow.QRChannelItem {
+		return whatsmeow.QRChannelItem{Event: whatsmeow.QRChannelEventCode, Code: s}
+	}
+	timeout := []whatsmeow.QRChannelItem{code("a"), code("b"), whatsmeow.QRChannelTimeout}
+	pairErr := errors.New("bad pairing")
+	tests := []struct {
+		name        string
+		rounds      [][]whatsmeow.QRChannelItem
+		attempts    int
+		connectErr  error
+		wantShown   []string
+		wantCalls   int
+		wantErr     error  // matched with errors.Is
+		wantErrText string // matched with strings.Contains
+		wantDisconn int
+	}{
+		{name: "scanned first time",
+			rounds:    [][]whatsmeow.QRChannelItem{{code("a"), whatsmeow.QRChannelSuccess}},
+			attempts:  3,
+			wantShown: []string{"a"}, wantCalls: 1},
+		{name: "scanned after a timeout",
+			rounds:    [][]whatsmeow.QRChannelItem{timeout, {code("c"), whatsmeow.QRChannelSuccess}},
+			attempts:  3,
+			wantShown: []string{"a", "b", "c"}, wantCalls: 2},
+		{name: "never scanned",
+			rounds:    [][]whatsmeow.QRChannelItem{timeout, timeout},
+			attempts:  2,
+			wantShown: []string{"a", "b", "a", "b"}, wantCalls: 2, wantErr: errQRTimedOut},
+		{name: "pairing error",
+			rounds:    [][]whatsmeow.QRChannelItem{{code("a"), {Event: whatsmeow.QRChannelEventError, Error: pairErr}}},
+			attempts:  3,
+			wantShown: []string{"a"}, wantCalls: 1, wantErr: pairErr, wantDisconn: 1},
+		{name: "client outdated",
+			rounds:    [][]whatsmeow.QRChannelItem{{whatsmeow.QRChannelClientOutdated}},
+			attempts:  3,
+			wantCalls: 1, wantErrText: "err-client-outdated", wantDisconn: 1},
+		{name: "channel closed without a result",
+			rounds:    [][]whatsmeow.QRChannelItem{{code("a")}},
+			attempts:  3,
+			wantShown: []string{"a"}, wantCalls: 1, wantErrText: "closed without a result", wantDisconn: 1},
+		{name: "connect fails",
+			rounds:     [][]whatsmeow.QRChannelItem{timeout},
+			attempts:   3,
+			connectErr: errors.New("no network"),
+			wantCalls:  1, wantErrText: "connecting to WhatsApp: no network"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &fakeQRClient{rounds: tt.rounds, connectErr: tt.connectErr}
+			var shown []string
+			err := loginWithQR(context.Background(), c, tt.attempts, func(code string) { shown = append(shown, code) })
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("err = %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantErrText != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErrText) {
+					t.Errorf("err = %v, want one containing %q", err, tt.wantErrText)
+				}
+			case err != nil:
+				t.Errorf("err = %v, want nil", err)
+			}
+			if !reflect.DeepEqual(shown, tt.wantShown) {
+				t.Errorf("shown %q, want %q", shown, tt.wantShown)
+			}
+			if c.calls != tt.wantCalls {
+				t.Errorf("%d QR channels opened, want %d", c.calls, tt.wantCalls)
+			}
+			if c.disconnects != tt.wantDisconn {
+				t.Errorf("%d disconnects, want %d", c.disconnects, tt.wantDisconn)
+			}
+		})
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	loyaltyRandsPerPoint = 10
+	loyaltyRedeemPoints  = 100
+	loyaltyRedeemValue   = 50.0
+	// pfMinimumAmount is the smallest amount PayFast will charge, which a
+	// discounted order must still reach.
+	pfMinimumAmount = 5.0
+)
+
+// Ledger reasons. Adjustments made by the admin carry their own reason.
+const (
+	loyaltyEarned   = "earned"
+	loyaltyRedeemed = "redeemed"
+	loyaltyReturned = "returned"
+	loyaltyReversed = "reversed"
+)
+
+// Redemption states. Points are only taken from the ledger once the
+// discounted order is paid; until then they are reserved against it.
+const (
+	redemptionReserved = "reserved"
+	redemptionConsumed = "consumed"
+	redemptionReleased = "released"
+)
+
+type loyaltyEntry struct {
+	Points    int       `json:"points"`
+	Reason    string    `json:"reason"`
+	OrderID   int64     `json:"order_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type loyaltyAccount struct {
+	CellNumber string         `json:"cell_number"`
+	Balance    int            `json:"balance"`
+	Reserved   int            `json:"reserved"`
+	History    []loyaltyEntry `json:"history"`
+}
+
+// Available is what can still be redeemed.
+func (a loyaltyAccount) Available() int {
+	return a.Balance - a.Reserved
+}
+
+func getLoyaltyAccount(db dbtx, cellNumber string, historyLimit int) (loyaltyAccount, error) {
+	a := loyaltyAccount{CellNumber: cellNumber, History: []loyaltyEntry{}}
+	err := db.QueryRow(`SELECT COALESCE((SELECT sum(points) FROM loyalty_ledger WHERE cell_number = $1), 0),
+		COALESCE((SELECT sum(points) FROM loyalty_redemptions WHERE cell_number = $1 AND state = $2), 0)`,
+		cellNumber, redemptionReserved).Scan(&a.Balance, &a.Reserved)
+	if err != nil {
+		return a, err
+	}
+	rows, err := db.Query(`SELECT points, reason, COALESCE(order_id, 0), created_at FROM loyalty_ledger
+		WHERE cell_number = $1 ORDER BY id DESC LIMIT $2`, cellNumber, historyLimit)
+	if err != nil {
+		return a, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e loyaltyEntry
+		if err := rows.Scan(&e.Points, &e.Reason, &e.OrderID, &e.CreatedAt); err != nil {
+			return a, err
+		}
+		a.History = append(a.History, e)
+	}
+	return a, rows.Err()
+}
+
+func addLoyaltyPoints(db dbtx, cellNumber string, points int, reason string, orderID int64) error {
+	_, err := db.Exec(`INSERT INTO loyalty_ledger (cell_number, points, reason, order_id) VALUES ($1, $2, $3, $4)`,
+		cellNumber, points, reason, nullOrderID(orderID))
+	return err
+}
+
+// orderDiscount is the loyalty discount applied to an order, if any.
+func orderDiscount(db dbtx, orderID int64) (float64, error) {
+	var discount float64
+	err := db.QueryRow(`SELECT discount FROM loyalty_redemptions WHERE order_id = $1 AND state IN ($2, $3)`,
+		orderID, redemptionReserved, redemptionConsumed).Scan(&discount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return discount, err
+}
+
+// settleLoyalty runs in the transaction that marks an order paid, so a
+// repeated ITN can neither credit nor charge points twice. It consumes the
+// order's reservation and credits a point per R10 actually paid.
+func settleLoyalty(tx dbtx, orderID int64, cellNumber, amountPaid string) error {
+	var points int
+	err := tx.QueryRow(`UPDATE loyalty_redemptions SET state = $2 WHERE order_id = $1 AND state = $3 RETURNING points`,
+		orderID, redemptionConsumed, redemptionReserved).Scan(&points)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("consuming redemption: %w", err)
+	}
+	if points > 0 {
+		if err := addLoyaltyPoints(tx, cellNumber, -points, loyaltyRedeemed, orderID); err != nil {
+			return fmt.Errorf("consuming redemption: %w", err)
+		}
+	}
+
+	paid, err := strconv.ParseFloat(amountPaid, 64)
+	if err != nil {
+		return fmt.Errorf("parsing amount %q: %w", amountPaid, err)
+	}
+	if earned := int(paid / loyaltyRandsPerPoint); earned > 0 {
+		if err := addLoyaltyPoints(tx, cellNumber, earned, loyaltyEarned, orderID); err != nil {
+			return fmt.Errorf("crediting points: %w", err)
+		}
+	}
+	return nil
+}
+
+// releaseLoyalty undoes an order's loyalty effects when it is cancelled:
+// redeemed points go back to the customer and points earned on it are
+// taken away again.
+func releaseLoyalty(tx dbtx, orderID int64) error {
+	var cellNumber, state string
+	var points int
+	err := tx.QueryRow(`SELECT cell_number, points, state FROM loyalty_redemptions WHERE order_id = $1 FOR UPDATE`,
+		orderID).Scan(&cellNumber, &points, &state)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("releasing redemption: %w", err)
+	}
+	if state == redemptionReserved || state == redemptionConsumed {
+		if _, err := tx.Exec(`UPDATE loyalty_redemptions SET state = $2 WHERE order_id = $1`, orderID, redemptionReleased); err != nil {
+			return fmt.Errorf("releasing redemption: %w", err)
+		}
+	}
+	if state == redemptionConsumed {
+		if err := addLoyaltyPoints(tx, cellNumber, points, loyaltyReturned, orderID); err != nil {
+			return fmt.Errorf("returning points: %w", err)
+		}
+	}
+
+	_, err = tx.Exec(`INSERT INTO loyalty_ledger (cell_number, points, reason, order_id)
+		SELECT cell_number, -sum(points), $3, order_id FROM loyalty_ledger
+		WHERE order_id = $1 AND reason = $2
+			AND NOT EXISTS (SELECT 1 FROM loyalty_ledger WHERE order_id = $1 AND reason = $3)
+		GROUP BY cell_number, order_id`, orderID, loyaltyEarned, loyaltyReversed)
+	if err != nil {
+		return fmt.Errorf("reversing earned points: %w", err)
+	}
+	return nil
+}
+
+// cartTotal prices the cart's lines with the customer's pricelist.
+func cartTotal(vp versionedPricelist, lines []orderLine) float64 {
+	var total float64
+	for _, line := range lines {
+		if item, ok := vp.Item(line.ItemID); ok {
+			total += ctlgItemPrice(item) * float64(line.Quantity)
+		}
+	}
+	return math.Round(total*100) / 100
+}
+
+func customerPoints(cc *commandContext, sender string, _ []string) string {
+	a, err := getLoyaltyAccount(cc.db, sender, 5)
+	if err != nil {
+		return cc.apology(incidentLoyaltyLookup, sender, 0, err, "Points: reading the account",
+			"Sorry, something went wrong looking up your points. Please try again.")
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "You have %d points", a.Balance)
+	if a.Reserved > 0 {
+		fmt.Fprintf(&b, " (%d reserved for an unpaid order)", a.Reserved)
+	}
+	fmt.Fprintf(&b, ". Every R%d spent earns a point, and %d points take R%.0f off an order: send \"redeem\" before checking out.",
+		loyaltyRandsPerPoint, loyaltyRedeemPoints, loyaltyRedeemValue)
+	if len(a.History) > 0 {
+		b.WriteString("\n\nRecent:")
+		for _, e := range a.History {
+			fmt.Fprintf(&b, "\n%s %+d %s", e.CreatedAt.In(cfg().BusinessHours.Location).Format("2 Jan"), e.Points, e.Reason)
+			if e.OrderID != 0 {
+				fmt.Fprintf(&b, " (order %d)", e.OrderID)
+			}
+		}
+	}
+	return b.String()
+}
+
+// customerRedeem reserves points against the open cart. The discount is
+// applied to the payment link when the customer checks out.
+func customerRedeem(cc *commandContext, sender string, _ []string) string {
+	failed := func(orderID int64, err error, context string) string {
+		return cc.apology(incidentLoyaltyRedeem, sender, orderID, err, "Redeem: "+context,
+			"Sorry, something went wrong redeeming your points. Please try again.")
+	}
+	orderID, items, found, err := openOrder(cc.db, sender)
+	if err != nil {
+		return failed(0, err, "reading the cart")
+	}
+	lines, _ := decodeOrderLines(items)
+	if !found || len(lines) == 0 {
+		return "Add something to your order first, then send \"redeem\" before checking out."
+	}
+	if discount, err := orderDiscount(cc.db, orderID); err != nil {
+		return failed(orderID, err, "reading the discount")
+	} else if discount > 0 {
+		return fmt.Sprintf("Your points already take R%.2f off order %s.", discount, cc.orderRef(orderID))
+	}
+
+	a, err := getLoyaltyAccount(cc.db, sender, 0)
+	if err != nil {
+		return failed(orderID, err, "reading the account")
+	}
+	if a.Available() < loyaltyRedeemPoints {
+		return fmt.Sprintf("You need %d points to redeem and have %d available.", loyaltyRedeemPoints, a.Available())
+	}
+	total := cartTotal(cc.prclist.Snapshot().ForTier(customerTier(cc.db, sender)), lines)
+	if total-loyaltyRedeemValue < pfMinimumAmount {
+		return fmt.Sprintf("Your order must come to at least R%.2f to redeem points.", loyaltyRedeemValue+pfMinimumAmount)
+	}
+
+	_, err = cc.db.Exec(`INSERT INTO loyalty_redemptions (order_id, cell_number, points, discount, state)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (order_id) DO UPDATE SET points = EXCLUDED.points, discount = EXCLUDED.discount, state = EXCLUDED.state
+		WHERE loyalty_redemptions.state = $6`,
+		orderID, sender, loyaltyRedeemPoints, loyaltyRedeemValue, redemptionReserved, redemptionReleased)
+	if err != nil {
+		return failed(orderID, err, "reserving the points")
+	}
+	return fmt.Sprintf("%d points will take R%.2f off order %s when you check out. They're only used once the order is paid.",
+		loyaltyRedeemPoints, loyaltyRedeemValue, cc.orderRef(orderID))
+}
+
+var linkPattern = regexp.MustCompile(`https?://\S+`)
+
+// payableAmount is what PayFast should charge for an order: the library's
+// total plus any modifier surcharge, less any loyalty discount.
+func payableAmount(total, surcharge, discount float64) float64 {
+	total += surcharge
+	if discount > 0 {
+		// Discounted links never go below PayFast's minimum.
+		total = math.Max(total-discount, pfMinimumAmount)
+	}
+	return total
+}
+
+// adjustCheckoutLinks changes the amount, m_payment_id and item_name on
+// PayFast payment links in a MenuBotLib reply, adds what we know of the
+// buyer, and re-signs them. The library builds the link from the cart and
+// knows nothing about modifier surcharges, loyalty discounts, INSTANCE_ID,
+// order references or customer profiles, so this
+// is the one place they reach PayFast. It is also where catalogue names are made safe for PayFast:
+// every link goes through here, and its text fields are cleaned and all of
+// it encoded the way PayFast signs it.
+func adjustCheckoutLinks(reply, pfHost, passphrase, paymentID, itemName string, buyer payFastBuyer, surcharge, discount float64) string {
+	host := pfHostname(pfHost)
+	return linkPattern.ReplaceAllStringFunc(reply, func(link string) string {
+		u, err := url.Parse(link)
+		if err != nil || u.Host != host {
+			return link
+		}
+		// Keep the parameter order: PayFast signs the fields as sent.
+		var params []itnParam
+		keys, values := parsePayFastQuery(u.RawQuery)
+		for i, key := range keys {
+			value := values[i]
+			if key == "signature" {
+				continue
+			}
+			if key == "item_name" {
+				value = itemName
+			}
+			if limit, ok := pfTextFields[key]; ok {
+				value = pfText(value, limit)
+			}
+			if key == "amount" {
+				amount, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return link
+				}
+				value = strconv.FormatFloat(payableAmount(amount, surcharge, discount), 'f', 2, 64)
+			}
+			if key == "m_payment_id" {
+				value = paymentID
+			}
+			params = append(params, itnParam{Key: key, Value: value})
+		}
+		query := checkPaymentResult(buyer.addTo(params))
+		u.RawQuery = query + "&signature=" + pfSignature(query, passphrase)
+		return u.String()
+	})
+}
+
+// adminPoints handles "points <number> <+/-points> <reason>".
+func adminPoints(cc *commandContext, args []string) string {
+	if len(args) < 3 {
+		return "Usage: points <number> <+/-points> <reason>"
+	}
+	number, err := canonicalNumber(args[0])
+	if err != nil {
+		return err.Error()
+	}
+	points, err := strconv.Atoi(args[1])
+	if err != nil || points == 0 {
+		return "Points must be a non-zero number, e.g. +50 or -20."
+	}
+	reason := strings.Join(args[2:], " ")
+	if err := addLoyaltyPoints(cc.db, number, points, reason, 0); err != nil {
+		return fmt.Sprintf("Adjusting points of %s failed: %v", number, err)
+	}
+	a, err := getLoyaltyAccount(cc.db, number, 0)
+	if err != nil {
+		return fmt.Sprintf("Adjusted points of %s by %+d.", number, points)
+	}
+	return fmt.Sprintf("Adjusted points of %s by %+d, balance now %d.", number, points, a.Balance)
+}
+
+func GetLoyaltyHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		number, err := canonicalNumber(chi.URLParam(r, "number"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		a, err := getLoyaltyAccount(db, number, 100)
+		if err != nil {
+			log.Printf("Reading points of %s failed: %v", number, err)
+			writeJSONError(w, http.StatusInternalServerError, "reading points failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, a)
+	}
+}
+
+type loyaltyAdjustment struct {
+	Points int    `json:"points"`
+	Reason string `json:"reason"`
+}
+
+func AdjustLoyaltyHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		number, err := canonicalNumber(chi.URLParam(r, "number"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var adj loyaltyAdjustment
+		if err := json.NewDecoder(r.Body).Decode(&adj); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		if adj.Points == 0 || strings.TrimSpace(adj.Reason) == "" {
+			writeJSONError(w, http.StatusBadRequest, "points must be non-zero and a reason is required")
+			return
+		}
+		if err := addLoyaltyPoints(db, number, adj.Points, adj.Reason, 0); err != nil {
+			log.Printf("Adjusting points of %s failed: %v", number, err)
+			writeJSONError(w, http.StatusInternalServerError, "adjusting points failed")
+			return
+		}
+		a, err := getLoyaltyAccount(db, number, 100)
+		if err != nil {
+			log.Printf("Reading points of %s failed: %v", number, err)
+			writeJSONError(w, http.StatusInternalServerError, "reading points failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, a)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maintenanceReplyInterval limits the maintenance reply to one per customer
+// per interval, so a customer retrying doesn't get spammed.
+const maintenanceReplyInterval = time.Hour
+
+// maintenanceState is persisted in the single-row maintenance table so a
+// restart mid-maintenance doesn't reopen the shop.
+type maintenanceState struct {
+	Active  bool       `json:"active"`
+	Until   *time.Time `json:"until,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+// ActiveAt reports whether maintenance is on at t. A state with an end time
+// switches itself off once that time has passed.
+func (m maintenanceState) ActiveAt(t time.Time) bool {
+	return m.Active && (m.Until == nil || t.Before(*m.Until))
+}
+
+// Reply is what customers are told while maintenance is on.
+func (m maintenanceState) Reply() string {
+	if m.Message != "" {
+		return m.Message
+	}
+	if m.Until != nil {
+		return fmt.Sprintf("Sorry, we're temporarily closed. We'll be back at %s.",
+			m.Until.In(cfg().BusinessHours.Location).Format("15:04"))
+	}
+	return "Sorry, we're temporarily closed. Please message us again later."
+}
+
+// maintenanceMode caches the persisted state and tracks who has already
+// been told about it.
+type maintenanceMode struct {
+	db      *sql.DB
+	state   atomic.Pointer[maintenanceState]
+	mu      sync.Mutex
+	replied map[string]time.Time
+}
+
+func loadMaintenanceMode(db *sql.DB) (*maintenanceMode, error) {
+	m := &maintenanceMode{db: db, replied: map[string]time.Time{}}
+	var st maintenanceState
+	var until sql.NullTime
+	err := db.QueryRow(`SELECT active, until, message FROM maintenance WHERE id = 1`).Scan(&st.Active, &until, &st.Message)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("reading maintenance state: %w", err)
+	}
+	if until.Valid {
+		st.Until = &until.Time
+	}
+	m.state.Store(&st)
+	if st.ActiveAt(time.Now()) {
+		log.Printf("Maintenance mode is on: %s", st.Reply())
+	}
+	return m, nil
+}
+
+func (m *maintenanceMode) Get() maintenanceState {
+	return *m.state.Load()
+}
+
+// Set persists st and makes it current.
+func (m *maintenanceMode) Set(st maintenanceState) error {
+	if err := saveMaintenanceState(m.db, st); err != nil {
+		return err
+	}
+	m.adopt(st)
+	return nil
+}
+
+// adopt makes an already persisted st current.
+func (m *maintenanceMode) adopt(st maintenanceState) {
+	m.state.Store(&st)
+	m.mu.Lock()
+	m.replied = map[string]time.Time{}
+	m.mu.Unlock()
+}
+
+func saveMaintenanceState(db dbtx, st maintenanceState) error {
+	var until sql.NullTime
+	if st.Until != nil {
+		until = sql.NullTime{Time: *st.Until, Valid: true}
+	}
+	_, err := db.Exec(`INSERT INTO maintenance (id, active, until, message) VALUES (1, $1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET active = EXCLUDED.active, until = EXCLUDED.until,
+			message = EXCLUDED.message, updated_at = now()`, st.Active, until, st.Message)
+	if err != nil {
+		return fmt.Errorf("saving maintenance state: %w", err)
+	}
+	return nil
+}
+
+// Intercept reports whether maintenance is on at now. reply is the message
+// to send sender, or "" if they were already told within the last hour.
+func (m *maintenanceMode) Intercept(sender string, now time.Time) (reply string, active bool) {
+	st := m.Get()
+	if !st.ActiveAt(now) {
+		return "", false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if last, ok := m.replied[sender]; ok && now.Sub(last) < maintenanceReplyInterval {
+		return "", true
+	}
+	m.replied[sender] = now
+	return st.Reply(), true
+}
+
+// nextClockTime returns the next time the clock in loc shows minutes after
+// midnight, today if that is still ahead and tomorrow otherwise.
+func nextClockTime(now time.Time, minutes int, loc *time.Location) time.Time {
+	local := now.In(loc)
+	t := time.Date(local.Year(), local.Month(), local.Day(), minutes/60, minutes%60, 0, 0, loc)
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t
+}
+
+// adminPause handles "pause", "pause until 14:00" and either followed by a
+// custom message for customers.
+func adminPause(cc *commandContext, args []string) string {
+	st := maintenanceState{Active: true}
+	if len(args) >= 2 && strings.EqualFold(args[0], "until") {
+		minutes, err := parseClock(args[1])
+		if err != nil {
+			return fmt.Sprintf("Couldn't pause: %v. Usage: pause [until HH:MM] [message]", err)
+		}
+		until := nextClockTime(time.Now(), minutes, cfg().BusinessHours.Location)
+		st.Until = &until
+		args = args[2:]
+	}
+	st.Message = strings.Join(args, " ")
+	if err := cc.maintenance.Set(st); err != nil {
+		log.Println(err)
+		return "Couldn't pause, saving the maintenance state failed."
+	}
+	return "Paused. Customers will be told: " + st.Reply()
+}
+
+func adminResume(cc *commandContext, _ []string) string {
+	if err := cc.maintenance.Set(maintenanceState{}); err != nil {
+		log.Println(err)
+		return "Couldn't resume, saving the maintenance state failed."
+	}
+	return "Resumed, taking orders again."
+}
+
+// maintenanceRequest is the body of PUT /api/maintenance. Until is RFC 3339
+// or HH:MM in the business timezone.
+type maintenanceRequest struct {
+	Active  bool   `json:"active"`
+	Until   string `json:"until"`
+	Message string `json:"message"`
+}
+
+// parseMaintenanceUntil accepts RFC 3339, or HH:MM meaning the next time
+// the business clock shows it.
+func parseMaintenanceUntil(raw string, now time.Time) (time.Time, error) {
+	if until, err := time.Parse(time.RFC3339, raw); err == nil {
+		return until, nil
+	}
+	minutes, err := parseClock(raw)
+	if err != nil {
+		return time.Time{}, errors.New("until must be RFC 3339 or HH:MM")
+	}
+	return nextClockTime(now, minutes, cfg().BusinessHours.Location), nil
+}
+
+func GetMaintenanceHandler(mm *maintenanceMode) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, mm.Get())
+	}
+}
+
+func PutMaintenanceHandler(mm *maintenanceMode) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req maintenanceRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		st := maintenanceState{Active: req.Active, Message: strings.TrimSpace(req.Message)}
+		if req.Until != "" {
+			until, err := parseMaintenanceUntil(req.Until, time.Now())
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			st.Until = &until
+		}
+		if err := mm.Set(st); err != nil {
+			log.Println(err)
+			writeJSONError(w, http.StatusInternalServerError, "saving maintenance state failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, st)
+	}
+}
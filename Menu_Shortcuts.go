@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+)
+
+// After we send a customer the menu, a bare number such as "3", or "3 x2"
+// for a quantity, orders the third item listed. The listing is remembered
+// per customer for MENU_SHORTCUT_WINDOW and only for the pricelist version
+// it was rendered from, so an index can't order a different item once the
+// menu has changed.
+
+const menuFirstMessage = "Send 'menu' first, then reply with the number of the item you'd like."
+
+var menuShortcutPattern = regexp.MustCompile(`(?i)^\s*(\d{1,3})(?:\s*x\s*(\d{1,3}))?\s*$`)
+
+type menuListing struct {
+	Version int64
+	ItemIDs []int
+	SentAt  time.Time
+}
+
+// menuShortcuts holds the last menu listing sent to each customer. Like
+// option prompts they're a convenience and die with the process.
+type menuShortcuts struct {
+	mu       sync.Mutex
+	listings map[string]menuListing
+}
+
+func newMenuShortcuts() *menuShortcuts {
+	return &menuShortcuts{listings: map[string]menuListing{}}
+}
+
+// menuItemIDs returns the IDs of the items in p, in the order MenuBotLib
+// lists them.
+func menuItemIDs(p mb.Pricelist) []int {
+	ids := make([]int, len(p.Catalogue))
+	for i, sel := range p.Catalogue {
+		ids[i] = ctlgItemID(sel.Item)
+	}
+	return ids
+}
+
+func (m *menuShortcuts) remember(cell string, version int64, ids []int, now time.Time) {
+	window := cfg().MenuShortcutWindow
+	if window == 0 {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for c, l := range m.listings {
+		if now.Sub(l.SentAt) > window {
+			delete(m.listings, c)
+		}
+	}
+	m.listings[cell] = menuListing{Version: version, ItemIDs: ids, SentAt: now}
+}
+
+// resolve turns a bare-number reply into the order command it stands for.
+// handled is false for any other message. A number with no current menu
+// to refer to gets a reply instead of a command.
+func (m *menuShortcuts) resolve(cell, msg string, version int64, now time.Time) (command, reply string, handled bool) {
+	window := cfg().MenuShortcutWindow
+	match := menuShortcutPattern.FindStringSubmatch(msg)
+	if window == 0 || match == nil {
+		return "", "", false
+	}
+	index, _ := strconv.Atoi(match[1])
+	quantity := 1
+	if match[2] != "" {
+		quantity, _ = strconv.Atoi(match[2])
+	}
+
+	m.mu.Lock()
+	l, ok := m.listings[cell]
+	if ok && (now.Sub(l.SentAt) > window || l.Version != version) {
+		delete(m.listings, cell)
+		ok = false
+	}
+	m.mu.Unlock()
+	switch {
+	case !ok:
+		return "", menuFirstMessage, true
+	case index < 1 || index > len(l.ItemIDs):
+		return "", fmt.Sprintf("The menu I sent lists items 1 to %d. Reply with one of those numbers, or send 'menu' to see it again.", len(l.ItemIDs)), true
+	case quantity < 1:
+		return "", "The quantity must be at least 1, e.g. \"3 x2\".", true
+	}
+	return fmt.Sprintf("order %s %d", itemRef(l.ItemIDs[index-1]), quantity), "", true
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// The texts staff reword without a release are message templates: Go
+// text/template bodies, so {{.hours}} is the shop's hours. The older
+// {hours} placeholders still work. A body that doesn't render is refused
+// when the configuration loads, and the preview endpoint shows why before
+// anyone saves it.
+
+type messageTemplate struct {
+	current func(rc *RuntimeConfig) string
+	// sample holds every variable the template is given, with values the
+	// preview uses unless the request supplies its own.
+	sample map[string]string
+}
+
+var messageTemplates = map[string]messageTemplate{
+	"CLOSED_MESSAGE": {
+		current: func(rc *RuntimeConfig) string { return rc.ClosedMessage },
+		sample:  map[string]string{"hours": "Mon-Fri 08:00-17:00; Sat 09:00-13:00"},
+	},
+	"AD_GREETING": {
+		current: func(rc *RuntimeConfig) string { return rc.AdGreeting },
+		sample:  map[string]string{"ad": "Burger Tuesday"},
+	},
+	"INVITE_ONLY_MESSAGE": {
+		current: func(rc *RuntimeConfig) string { return rc.InviteOnlyMessage },
+		sample:  map[string]string{},
+	},
+}
+
+// renderTemplate executes body with vars. A variable the body names but
+// vars lacks is an error rather than "<no value>" in front of a customer.
+func renderTemplate(name, body string, vars map[string]string) (string, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(body)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, vars); err != nil {
+		return "", err
+	}
+	text := b.String()
+	for k, v := range vars {
+		text = strings.ReplaceAll(text, "{"+k+"}", v)
+	}
+	return text, nil
+}
+
+// message renders the configured template name. Loading refuses bodies
+// that don't render, so the fallback to the raw body is only a backstop.
+func (rc *RuntimeConfig) message(name string, vars map[string]string) string {
+	body := messageTemplates[name].current(rc)
+	text, err := renderTemplate(name, body, vars)
+	if err != nil {
+		log.Printf("Rendering %s failed, sending it as written: %v", name, err)
+		return body
+	}
+	return text
+}
+
+// checkMessageTemplates renders every configured template with its sample
+// variables, for loadRuntimeConfig.
+func checkMessageTemplates(rc *RuntimeConfig) error {
+	for name, t := range messageTemplates {
+		if _, err := renderTemplate(name, t.current(rc), t.sample); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateLine finds the line in text/template's "template: NAME:LINE:..."
+// errors.
+var templateLine = regexp.MustCompile(`^template: [^:]+:(\d+):`)
+
+type templateError struct {
+	Line  int    `json:"line,omitempty"`
+	Error string `json:"error"`
+}
+
+type templatePreviewRequest struct {
+	// Body is the draft to render; without one the configured text is.
+	Body *string `json:"body,omitempty"`
+	// Vars replace the sample values of the variables they name.
+	Vars map[string]string `json:"vars,omitempty"`
+}
+
+type templatePreview struct {
+	Text string `json:"text"`
+	// HTML is Text with WhatsApp's *bold*, _italic_, ~strike~ and ```code```
+	// markers turned into tags, roughly as the customer will see it.
+	HTML string `json:"html"`
+}
+
+type templateTestSend struct {
+	To   string `json:"to"`
+	Text string `json:"text"`
+}
+
+// renderTemplateRequest renders the request's draft, or the configured
+// body, and writes the error response itself when it can't.
+func renderTemplateRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	name := strings.ToUpper(chi.URLParam(r, "name"))
+	t, ok := messageTemplates[name]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "no template named "+name)
+		return "", false
+	}
+	var req templatePreviewRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return "", false
+	}
+	body := t.current(cfg())
+	if req.Body != nil {
+		body = *req.Body
+	}
+	vars := make(map[string]string, len(t.sample)+len(req.Vars))
+	for k, v := range t.sample {
+		vars[k] = v
+	}
+	for k, v := range req.Vars {
+		vars[k] = v
+	}
+	text, err := renderTemplate(name, body, vars)
+	if err != nil {
+		details := templateError{Error: err.Error()}
+		if m := templateLine.FindStringSubmatch(err.Error()); m != nil {
+			details.Line, _ = strconv.Atoi(m[1])
+		}
+		writeAPIError(w, http.StatusUnprocessableEntity, name+" does not render", details)
+		return "", false
+	}
+	return text, true
+}
+
+var whatsappMarkers = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile("```([\\s\\S]+?)```"), "<code>$1</code>"},
+	// As in WhatsApp, a marker only counts against text: "a * b * c" stays.
+	{regexp.MustCompile(`\*(\S(?:[^*\n]*\S)?)\*`), "<b>$1</b>"},
+	{regexp.MustCompile(`_(\S(?:[^_\n]*\S)?)_`), "<i>$1</i>"},
+	{regexp.MustCompile(`~(\S(?:[^~\n]*\S)?)~`), "<s>$1</s>"},
+}
+
+func whatsappHTML(text string) string {
+	s := html.EscapeString(text)
+	for _, m := range whatsappMarkers {
+		s = m.re.ReplaceAllString(s, m.repl)
+	}
+	return strings.ReplaceAll(s, "\n", "<br>\n")
+}
+
+// PreviewTemplateHandler renders a template, usually an unsaved draft, with
+// sample variables.
+func PreviewTemplateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		text, ok := renderTemplateRequest(w, r)
+		if !ok {
+			return
+		}
+		writeJSON(w, http.StatusOK, templatePreview{Text: text, HTML: whatsappHTML(text)})
+	}
+}
+
+// TestSendTemplateHandler renders a template like the preview does and
+// sends the result to the shop's own number, never to a customer.
+func TestSendTemplateHandler(cc *commandContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		text, ok := renderTemplateRequest(w, r)
+		if !ok {
+			return
+		}
+		if strings.TrimSpace(text) == "" {
+			writeJSONError(w, http.StatusUnprocessableEntity, "the template renders to nothing")
+			return
+		}
+		cc.sender.Send(cc.envVars.HostNumber, text, priorityNotify)
+		writeJSON(w, http.StatusAccepted, templateTestSend{To: cc.envVars.HostNumber, Text: text})
+	}
+}
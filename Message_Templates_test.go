@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	hours := map[string]string{"hours": "Mon-Fri 08:00-17:00"}
+	tests := []struct {
+		name, body string
+		vars       map[string]string
+		want       string
+		err        string
+	}{
+		{name: "old placeholder", body: "Closed. Our hours are {hours}.", vars: hours, want: "Closed. Our hours are Mon-Fri 08:00-17:00."},
+		{name: "template variable", body: "Closed. Our hours are {{.hours}}.", vars: hours, want: "Closed. Our hours are Mon-Fri 08:00-17:00."},
+		{name: "plain text", body: "Invited customers only.", want: "Invited customers only."},
+		{name: "unknown variable", body: "Hi\n{{.name}}", vars: hours, err: "template: CLOSED_MESSAGE:2:"},
+		{name: "unclosed action", body: "Hi\n\n{{.hours", vars: hours, err: "template: CLOSED_MESSAGE:3:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderTemplate("CLOSED_MESSAGE", tt.body, tt.vars)
+			if tt.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+					t.Fatalf("error = %v, want one starting %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("renderTemplate = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWhatsAppHTML(t *testing.T) {
+	tests := []struct{ text, want string }{
+		{"*Closed* until _Monday_", "<b>Closed</b> until <i>Monday</i>"},
+		{"~R50~ now R40", "<s>R50</s> now R40"},
+		{"```code```", "<code>code</code>"},
+		{"<script> & co", "&lt;script&gt; &amp; co"},
+		{"two\nlines", "two<br>\nlines"},
+		{"a * b * c", "a * b * c"},
+		{"no markers", "no markers"},
+	}
+	for _, tt := range tests {
+		if got := whatsappHTML(tt.text); got != tt.want {
+			t.Errorf("whatsappHTML(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestPreviewTemplateHandler(t *testing.T) {
+	withRuntimeConfig(t, &RuntimeConfig{ClosedMessage: "Saved: {hours}"})
+	r := chi.NewRouter()
+	r.Post("/templates/{name}/preview", PreviewTemplateHandler())
+	tests := []struct {
+		name, path, body string
+		status           int
+		text             string
+		line             int
+	}{
+		{name: "saved body", path: "CLOSED_MESSAGE", body: `{}`, status: http.StatusOK, text: "Saved: Mon-Fri 08:00-17:00; Sat 09:00-13:00"},
+		{name: "draft", path: "closed_message", body: `{"body": "*Draft* {{.hours}}"}`, status: http.StatusOK, text: "*Draft* Mon-Fri 08:00-17:00; Sat 09:00-13:00"},
+		{name: "own variables", path: "AD_GREETING", body: `{"body": "Thanks for {{.ad}}!", "vars": {"ad": "Pizza Friday"}}`, status: http.StatusOK, text: "Thanks for Pizza Friday!"},
+		{name: "draft that doesn't parse", path: "CLOSED_MESSAGE", body: `{"body": "Hi\n{{if}}"}`, status: http.StatusUnprocessableEntity, line: 2},
+		{name: "draft that doesn't execute", path: "INVITE_ONLY_MESSAGE", body: `{"body": "Hi {{.hours}}"}`, status: http.StatusUnprocessableEntity, line: 1},
+		{name: "unknown template", path: "GOODBYE", body: `{}`, status: http.StatusNotFound},
+		{name: "not JSON", path: "CLOSED_MESSAGE", body: `body`, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/templates/"+tt.path+"/preview", strings.NewReader(tt.body)))
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			switch tt.status {
+			case http.StatusOK:
+				var got templatePreview
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+					t.Fatal(err)
+				}
+				if got.Text != tt.text || got.HTML != whatsappHTML(tt.text) {
+					t.Errorf("preview = %+v, want text %q", got, tt.text)
+				}
+			case http.StatusUnprocessableEntity:
+				var got struct {
+					Error struct{ Details templateError } `json:"error"`
+				}
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+					t.Fatal(err)
+				}
+				if got.Error.Details.Line != tt.line || got.Error.Details.Error == "" {
+					t.Errorf("details = %+v, want line %d", got.Error.Details, tt.line)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+const (
+	recipientCacheTTL  = 24 * time.Hour
+	recipientCacheSize = 10000
+)
+
+var errNotOnWhatsApp = errors.New("not_on_whatsapp")
+
+type recipientEntry struct {
+	JID     types.JID
+	IsIn    bool
+	Expires time.Time
+}
+
+// recipientCache remembers IsOnWhatsApp answers per number for a day, so
+// the back office can't turn every send into a lookup.
+type recipientCache struct {
+	mu      sync.Mutex
+	entries map[string]recipientEntry
+}
+
+func newRecipientCache() *recipientCache {
+	return &recipientCache{entries: map[string]recipientEntry{}}
+}
+
+func (c *recipientCache) get(number string, now time.Time) (recipientEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[number]
+	if ok && now.After(e.Expires) {
+		delete(c.entries, number)
+		return recipientEntry{}, false
+	}
+	return e, ok
+}
+
+// put stores an answer. When full it drops expired entries, and failing
+// that the one closest to expiring.
+func (c *recipientCache) put(number string, e recipientEntry, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[number]; !ok && len(c.entries) >= recipientCacheSize {
+		oldest := ""
+		for n, entry := range c.entries {
+			if now.After(entry.Expires) {
+				delete(c.entries, n)
+			} else if oldest == "" || entry.Expires.Before(c.entries[oldest].Expires) {
+				oldest = n
+			}
+		}
+		if len(c.entries) >= recipientCacheSize {
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[number] = e
+}
+
+// checkRecipient returns the canonical JID for a phone-number recipient, or
+// errNotOnWhatsApp. When it can't ask, because the client is offline or
+// the lookup fails, it lets the message through unchecked so it can wait
+// in the outbox.
+func (cc *commandContext) checkRecipient(jid types.JID) (types.JID, error) {
+	if jid.Server != types.DefaultUserServer {
+		return jid, nil
+	}
+	now := time.Now()
+	if e, ok := cc.recipients.get(jid.User, now); ok {
+		if !e.IsIn {
+			return jid, errNotOnWhatsApp
+		}
+		return e.JID, nil
+	}
+	if !cc.client.IsConnected() || !cc.client.IsLoggedIn() {
+		log.Printf("WhatsApp is offline, sending to %s without checking it is on WhatsApp", jid.User)
+		return jid, nil
+	}
+	resp, err := cc.client.IsOnWhatsApp([]string{"+" + jid.User})
+	if err != nil || len(resp) == 0 {
+		log.Printf("Checking whether %s is on WhatsApp failed, sending unchecked: %v", jid.User, err)
+		return jid, nil
+	}
+	e := recipientEntry{JID: resp[0].JID, IsIn: resp[0].IsIn, Expires: now.Add(recipientCacheTTL)}
+	if e.JID.IsEmpty() {
+		e.JID = jid
+	}
+	cc.recipients.put(jid.User, e, now)
+	if !e.IsIn {
+		return jid, errNotOnWhatsApp
+	}
+	return e.JID, nil
+}
+
+type sendMessageRequest struct {
+	To      string `json:"to"`
+	Text    string `json:"text"`
+	OrderID int64  `json:"order_id,omitempty"`
+}
+
+type sendMessageResponse struct {
+	JID string `json:"jid"`
+}
+
+// PostMessageHandler sends a message from the back office. Delivery happens
+// in the background, with the usual retries and outbox; the response only
+// says the recipient is one we can message.
+func PostMessageHandler(cc *commandContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req sendMessageRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		req.Text = strings.TrimSpace(req.Text)
+		if req.Text == "" {
+			writeJSONError(w, http.StatusBadRequest, "text is required")
+			return
+		}
+		if utf8.RuneCountInString(req.Text) > maxTextLength {
+			writeJSONError(w, http.StatusBadRequest, errMessageTooLong.Error())
+			return
+		}
+		jid, err := resolveJID(req.To)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if jid, err = cc.checkRecipient(jid); errors.Is(err, errNotOnWhatsApp) {
+			writeAPIError(w, http.StatusUnprocessableEntity, jid.User+" is not on WhatsApp",
+				map[string]string{"reason": errNotOnWhatsApp.Error()})
+			return
+		}
+		go cc.sender.Deliver(outboundMessage{To: jid, Text: req.Text, Priority: priorityNotify, OrderID: req.OrderID})
+		writeJSON(w, http.StatusAccepted, sendMessageResponse{JID: jid.String()})
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/JeremyJalpha/MenuBot_WebAPI/buildinfo"
+)
+
+const metricsBaseURL = "/metrics"
+
+// metricsRegistry is a minimal Prometheus text-format exporter. We only
+// need counters, gauges and the odd histogram, which doesn't justify the
+// client library.
+type metricsRegistry struct {
+	mu       sync.Mutex
+	families map[string]*metricFamily
+}
+
+type metricFamily struct {
+	help   string
+	kind   string
+	series map[string]float64
+	funcs  map[string]func() float64
+	hists  map[string]*histogram
+}
+
+// histogram is one series of a histogram family. counts[i] is the number
+// of observations up to buckets[i], not cumulative; the rest are above the
+// last bound.
+type histogram struct {
+	labels  []string
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+var metrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	m := &metricsRegistry{families: map[string]*metricFamily{}}
+	bi := buildinfo.Get()
+	m.Set("menubot_build_info", "Build of the running bot, always 1.", 1,
+		"version", bi.Version, "commit", bi.Commit, "build_time", bi.BuildTime, "go_version", bi.GoVersion)
+	return m
+}
+
+// formatLabels renders alternating name, value pairs as {name="value",...}.
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *metricsRegistry) family(name, help, kind string) *metricFamily {
+	f, ok := m.families[name]
+	if !ok {
+		f = &metricFamily{help: help, kind: kind, series: map[string]float64{}, funcs: map[string]func() float64{}, hists: map[string]*histogram{}}
+		m.families[name] = f
+	}
+	return f
+}
+
+// Add increments a counter. labels are alternating name, value pairs.
+func (m *metricsRegistry) Add(name, help string, delta float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.family(name, help, "counter").series[formatLabels(labels)] += delta
+}
+
+func (m *metricsRegistry) Inc(name, help string, labels ...string) {
+	m.Add(name, help, 1, labels...)
+}
+
+// Set sets a gauge.
+func (m *metricsRegistry) Set(name, help string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.family(name, help, "gauge").series[formatLabels(labels)] = value
+}
+
+// GaugeFunc registers a gauge whose value is read at scrape time. fn runs
+// with the registry locked, so it must not record metrics itself.
+func (m *metricsRegistry) GaugeFunc(name, help string, fn func() float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.family(name, help, "gauge").funcs[formatLabels(labels)] = fn
+}
+
+// Observe records value in a histogram with the given bucket upper bounds,
+// which must be sorted and the same for every call with name.
+func (m *metricsRegistry) Observe(name, help string, buckets []float64, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f := m.family(name, help, "histogram")
+	key := formatLabels(labels)
+	h, ok := f.hists[key]
+	if !ok {
+		h = &histogram{labels: labels, buckets: buckets, counts: make([]uint64, len(buckets))}
+		f.hists[key] = h
+	}
+	if i := sort.SearchFloat64s(h.buckets, value); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += value
+}
+
+// write renders h as Prometheus expects: cumulative buckets, then the sum
+// and count.
+func (h *histogram) write(b *strings.Builder, name string) {
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		fmt.Fprintf(b, "%s_bucket%s %d\n", name, formatLabels(append(slices.Clip(h.labels), "le", le)), cumulative)
+	}
+	fmt.Fprintf(b, "%s_bucket%s %d\n", name, formatLabels(append(slices.Clip(h.labels), "le", "+Inf")), h.count)
+	fmt.Fprintf(b, "%s_sum%s %s\n", name, formatLabels(h.labels), strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(b, "%s_count%s %d\n", name, formatLabels(h.labels), h.count)
+}
+
+func (m *metricsRegistry) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		names := make([]string, 0, len(m.families))
+		for name := range m.families {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var b strings.Builder
+		for _, name := range names {
+			f := m.families[name]
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, f.help, name, f.kind)
+			values := make(map[string]float64, len(f.series)+len(f.funcs))
+			for labels, v := range f.series {
+				values[labels] = v
+			}
+			for labels, fn := range f.funcs {
+				values[labels] = fn()
+			}
+			keys := make([]string, 0, len(values))
+			for labels := range values {
+				keys = append(keys, labels)
+			}
+			sort.Strings(keys)
+			for _, labels := range keys {
+				fmt.Fprintf(&b, "%s%s %s\n", name, labels, strconv.FormatFloat(values[labels], 'g', -1, 64))
+			}
+			keys = keys[:0]
+			for labels := range f.hists {
+				keys = append(keys, labels)
+			}
+			sort.Strings(keys)
+			for _, labels := range keys {
+				f.hists[labels].write(&b, name)
+			}
+		}
+		m.mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write([]byte(b.String()))
+	}
+}
@@ -0,0 +1,765 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Modifiers are per-item choices such as size or flavour. MenuBotLib's
+// cart only knows items and quantities, so the chosen options are kept
+// here, one row per unit of an item in order_line_options, and their price
+// deltas are added to the order on top of the library's total.
+
+// modifierCSVHeader is the column order accepted by the CSV import; one
+// row per option, grouped into modifier groups by item and group name.
+var modifierCSVHeader = []string{"item_id", "group", "required", "option", "price_delta"}
+
+type modifierOption struct {
+	Name       string  `json:"name"`
+	PriceDelta float64 `json:"price_delta"`
+}
+
+type modifierGroup struct {
+	Name     string           `json:"name"`
+	Required bool             `json:"required"`
+	Options  []modifierOption `json:"options"`
+}
+
+type itemModifiers struct {
+	ItemID int             `json:"item_id"`
+	Groups []modifierGroup `json:"groups"`
+}
+
+// chosenOption is an option as stored on an order line. The names and
+// delta are copied so later menu edits don't rewrite old orders.
+type chosenOption struct {
+	Group      string  `json:"group"`
+	Option     string  `json:"option"`
+	PriceDelta float64 `json:"price_delta"`
+}
+
+func validateModifierGroups(groups []modifierGroup) error {
+	seenGroups := map[string]bool{}
+	for _, g := range groups {
+		name := strings.ToLower(strings.TrimSpace(g.Name))
+		if name == "" {
+			return errors.New("modifier group needs a name")
+		}
+		if seenGroups[name] {
+			return fmt.Errorf("duplicate modifier group %q", g.Name)
+		}
+		seenGroups[name] = true
+		if len(g.Options) == 0 {
+			return fmt.Errorf("modifier group %q has no options", g.Name)
+		}
+		seenOptions := map[string]bool{}
+		for _, o := range g.Options {
+			option := normalizeForMatch(o.Name)
+			if option == "" {
+				return fmt.Errorf("modifier group %q: option needs a name", g.Name)
+			}
+			if seenOptions[option] {
+				return fmt.Errorf("modifier group %q: duplicate option %q", g.Name, o.Name)
+			}
+			seenOptions[option] = true
+			if math.IsNaN(o.PriceDelta) || math.IsInf(o.PriceDelta, 0) {
+				return fmt.Errorf("modifier group %q: invalid price delta for %q", g.Name, o.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func loadItemModifiers(db *sql.DB) (map[int][]modifierGroup, error) {
+	rows, err := db.Query(`SELECT item_id, name, required, options FROM item_modifiers
+		WHERE catalogue_id = $1 ORDER BY item_id, position`, catalogueID)
+	if err != nil {
+		return nil, fmt.Errorf("loading item modifiers: %w", err)
+	}
+	defer rows.Close()
+	modifiers := make(map[int][]modifierGroup)
+	for rows.Next() {
+		var id int
+		var g modifierGroup
+		var options []byte
+		if err := rows.Scan(&id, &g.Name, &g.Required, &options); err != nil {
+			return nil, fmt.Errorf("loading item modifiers: %w", err)
+		}
+		if err := json.Unmarshal(options, &g.Options); err != nil {
+			return nil, fmt.Errorf("loading modifiers of item %d: %w", id, err)
+		}
+		modifiers[id] = append(modifiers[id], g)
+	}
+	return modifiers, rows.Err()
+}
+
+// saveItemModifiers replaces an item's modifier groups; no groups removes
+// them.
+func saveItemModifiers(db dbtx, itemID int, groups []modifierGroup) error {
+	if _, err := db.Exec(`DELETE FROM item_modifiers WHERE catalogue_id = $1 AND item_id = $2`, catalogueID, itemID); err != nil {
+		return err
+	}
+	for i, g := range groups {
+		options, err := json.Marshal(g.Options)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec(`INSERT INTO item_modifiers (catalogue_id, item_id, position, name, required, options) VALUES ($1, $2, $3, $4, $5, $6)`,
+			catalogueID, itemID, i, strings.TrimSpace(g.Name), g.Required, options)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func modifierList(modifiers map[int][]modifierGroup) []itemModifiers {
+	list := make([]itemModifiers, 0, len(modifiers))
+	for id, groups := range modifiers {
+		list = append(list, itemModifiers{ItemID: id, Groups: groups})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ItemID < list[j].ItemID })
+	return list
+}
+
+// modifierHint is how the menu shows an item's modifiers, e.g.
+// "choose size: S/M/L".
+func modifierHint(groups []modifierGroup) string {
+	parts := make([]string, len(groups))
+	for i, g := range groups {
+		names := make([]string, len(g.Options))
+		for j, o := range g.Options {
+			names[j] = o.Name
+		}
+		verb := "optional"
+		if g.Required {
+			verb = "choose"
+		}
+		parts[i] = fmt.Sprintf("%s %s: %s", verb, strings.ToLower(g.Name), strings.Join(names, "/"))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// matchOption finds the option of g that msg names. With inline set the
+// option must appear as whole words in a longer message and single
+// letters don't count, since an "s" in an order message is rarely a size.
+func matchOption(g modifierGroup, msg string, inline bool) (modifierOption, bool) {
+	normalized := normalizeForMatch(msg)
+	padded := " " + normalized + " "
+	var found []modifierOption
+	for _, o := range g.Options {
+		name := normalizeForMatch(o.Name)
+		if normalized == name && !inline {
+			return o, true
+		}
+		if inline && utf8.RuneCountInString(name) < 2 {
+			continue
+		}
+		if strings.Contains(padded, " "+name+" ") {
+			found = append(found, o)
+		}
+	}
+	if len(found) == 1 {
+		return found[0], true
+	}
+	return modifierOption{}, false
+}
+
+func choose(g modifierGroup, o modifierOption) chosenOption {
+	return chosenOption{Group: g.Name, Option: o.Name, PriceDelta: o.PriceDelta}
+}
+
+func describeChoices(choices []chosenOption) string {
+	names := make([]string, len(choices))
+	for i, c := range choices {
+		names[i] = c.Option
+	}
+	return strings.Join(names, ", ")
+}
+
+func recordLineOptions(db dbtx, orderID int64, itemID, quantity int, choices []chosenOption) error {
+	encoded, err := json.Marshal(choices)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < quantity; i++ {
+		_, err := db.Exec(`INSERT INTO order_line_options (order_id, item_id, options) VALUES ($1, $2, $3)`, orderID, itemID, encoded)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orderLineOptions returns the chosen options of each unit of each item in
+// the order, oldest first.
+func orderLineOptions(db dbtx, orderID int64) (map[int][][]chosenOption, error) {
+	rows, err := db.Query(`SELECT item_id, options FROM order_line_options WHERE order_id = $1 ORDER BY id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	units := map[int][][]chosenOption{}
+	for rows.Next() {
+		var itemID int
+		var encoded []byte
+		if err := rows.Scan(&itemID, &encoded); err != nil {
+			return nil, err
+		}
+		var choices []chosenOption
+		if err := json.Unmarshal(encoded, &choices); err != nil {
+			return nil, fmt.Errorf("options of item %d on order %d: %w", itemID, orderID, err)
+		}
+		units[itemID] = append(units[itemID], choices)
+	}
+	return units, rows.Err()
+}
+
+// trimLineOptions drops the newest options of items whose quantity went
+// down, so units removed from the cart stop counting towards its total.
+func trimLineOptions(db *sql.DB, orderID int64, lines []orderLine) error {
+	quantities := map[int]int{}
+	for _, line := range lines {
+		quantities[line.ItemID] += line.Quantity
+	}
+	encoded, err := json.Marshal(quantities)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`DELETE FROM order_line_options WHERE id IN (
+			SELECT id FROM (
+				SELECT id, item_id, row_number() OVER (PARTITION BY item_id ORDER BY id) AS n
+				FROM order_line_options WHERE order_id = $1
+			) u WHERE n > COALESCE(($2::jsonb ->> u.item_id::text)::int, 0)
+		)`, orderID, string(encoded))
+	return err
+}
+
+// orderSurcharge is what the chosen options add to an order's total.
+func orderSurcharge(db dbtx, orderID int64) (float64, error) {
+	var surcharge float64
+	err := db.QueryRow(`SELECT COALESCE(SUM((o ->> 'price_delta')::numeric), 0)
+		FROM order_line_options, jsonb_array_elements(options) o WHERE order_id = $1`, orderID).Scan(&surcharge)
+	return surcharge, err
+}
+
+// lineVariant is a number of units of an item with the same options.
+type lineVariant struct {
+	ItemID   int
+	Quantity int
+	Options  string
+}
+
+// orderVariants splits the order's lines by chosen options, for the pick
+// list. Units without recorded options come first.
+func orderVariants(lines []orderLine, units map[int][][]chosenOption) []lineVariant {
+	var variants []lineVariant
+	for _, line := range lines {
+		chosen := units[line.ItemID]
+		if len(chosen) > line.Quantity {
+			chosen = chosen[:line.Quantity]
+		}
+		if plain := line.Quantity - len(chosen); plain > 0 {
+			variants = append(variants, lineVariant{ItemID: line.ItemID, Quantity: plain})
+		}
+		var order []string
+		counts := map[string]int{}
+		for _, choices := range chosen {
+			desc := describeChoices(choices)
+			if counts[desc] == 0 {
+				order = append(order, desc)
+			}
+			counts[desc]++
+		}
+		for _, desc := range order {
+			variants = append(variants, lineVariant{ItemID: line.ItemID, Quantity: counts[desc], Options: desc})
+		}
+	}
+	return variants
+}
+
+// optionsSummary lists the chosen options and their surcharge for the
+// checkout reply, "" when the order has none.
+func optionsSummary(db *sql.DB, vp versionedPricelist, orderID int64) string {
+	lines, err := orderItems(db, orderID)
+	if err != nil {
+		log.Printf("Reading items of order %d failed: %v", orderID, err)
+		return ""
+	}
+	units, err := orderLineOptions(db, orderID)
+	if err != nil {
+		log.Printf("Reading options of order %d failed: %v", orderID, err)
+		return ""
+	}
+	var b strings.Builder
+	var surcharge float64
+	for _, v := range orderVariants(lines, units) {
+		if v.Options == "" {
+			continue
+		}
+		name := itemRef(v.ItemID)
+		if item, ok := vp.Item(v.ItemID); ok {
+			name = ctlgItemName(item)
+		}
+		fmt.Fprintf(&b, "\n%d x %s (%s)", v.Quantity, name, v.Options)
+	}
+	for _, unitsOfItem := range units {
+		for _, choices := range unitsOfItem {
+			for _, c := range choices {
+				surcharge += c.PriceDelta
+			}
+		}
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	summary := "Options:" + b.String()
+	if surcharge != 0 {
+		summary += fmt.Sprintf("\nOptions add R%.2f to the total.", surcharge)
+	}
+	return summary
+}
+
+// pendingChoice is a prompt waiting for the customer to pick the options
+// of quantity units of an item.
+type pendingChoice struct {
+	OrderID  int64
+	ItemID   int
+	Quantity int
+	Chosen   []chosenOption
+}
+
+// modifierPrompts holds each customer's outstanding option prompts, the
+// first of which is being asked, as the options flow of pending_prompts.
+// Checkout asks again for anything still missing, so a prompt that goes
+// astray costs a question, never a wrong order; failures are only logged.
+type modifierPrompts struct {
+	db *sql.DB
+}
+
+func newModifierPrompts(db *sql.DB) *modifierPrompts {
+	return &modifierPrompts{db: db}
+}
+
+func (m *modifierPrompts) load(cell string) ([]savedPrompt, []pendingChoice) {
+	prompts, err := loadPrompts(m.db, cell, flowOptions)
+	if err != nil {
+		log.Printf("Reading option prompts of %s failed: %v", cell, err)
+		return nil, nil
+	}
+	choices := make([]pendingChoice, len(prompts))
+	for i, p := range prompts {
+		if err := json.Unmarshal(p.Data, &choices[i]); err != nil {
+			log.Printf("Reading option prompt %d failed: %v", p.ID, err)
+		}
+	}
+	return prompts, choices
+}
+
+func (m *modifierPrompts) push(cell string, p pendingChoice) {
+	prompts, choices := m.load(cell)
+	for i, q := range choices {
+		if q.OrderID == p.OrderID && q.ItemID == p.ItemID && len(q.Chosen) == 0 && len(p.Chosen) == 0 {
+			q.Quantity += p.Quantity
+			if err := updatePrompt(m.db, prompts[i].ID, "", q, false); err != nil {
+				log.Printf("Saving option prompt of %s failed: %v", cell, err)
+			}
+			return
+		}
+	}
+	if err := addPrompt(m.db, cell, flowOptions, p.OrderID, "", p); err != nil {
+		log.Printf("Saving option prompt of %s failed: %v", cell, err)
+	}
+}
+
+func (m *modifierPrompts) current(cell string) (pendingChoice, bool) {
+	if _, choices := m.load(cell); len(choices) > 0 {
+		return choices[0], true
+	}
+	return pendingChoice{}, false
+}
+
+// replace updates the current prompt, which asks its next group, or drops
+// it when done.
+func (m *modifierPrompts) replace(cell string, p pendingChoice, done bool) {
+	prompts, _ := m.load(cell)
+	if len(prompts) == 0 {
+		return
+	}
+	var err error
+	if done {
+		err = deletePrompt(m.db, prompts[0])
+	} else {
+		err = updatePrompt(m.db, prompts[0].ID, "", p, true)
+	}
+	if err != nil {
+		log.Printf("Saving option prompt of %s failed: %v", cell, err)
+	}
+}
+
+// clear drops the prompts of a customer's orders other than keepOrder;
+// 0 drops them all.
+func (m *modifierPrompts) clear(cell string, keepOrder int64) {
+	res, err := m.db.Exec(`DELETE FROM pending_prompts WHERE cell = $1 AND flow = $2 AND order_id <> $3`, cell, flowOptions, keepOrder)
+	if err == nil && keepOrder != 0 {
+		if n, _ := res.RowsAffected(); n > 0 {
+			err = promptNext(m.db, cell, flowOptions)
+		}
+	}
+	if err != nil {
+		log.Printf("Dropping option prompts of %s failed: %v", cell, err)
+	}
+}
+
+// nextRequiredGroup is the first required group p hasn't chosen yet.
+func nextRequiredGroup(groups []modifierGroup, p pendingChoice) (modifierGroup, bool) {
+	for _, g := range groups {
+		if !g.Required {
+			continue
+		}
+		chosen := false
+		for _, c := range p.Chosen {
+			if strings.EqualFold(c.Group, g.Name) {
+				chosen = true
+				break
+			}
+		}
+		if !chosen {
+			return g, true
+		}
+	}
+	return modifierGroup{}, false
+}
+
+func choicePrompt(vp versionedPricelist, p pendingChoice, g modifierGroup) string {
+	return fmt.Sprintf("%s Reply %s.", choiceQuestion(vp, p, g), strings.Join(optionLabels(g), ", "))
+}
+
+func choiceQuestion(vp versionedPricelist, p pendingChoice, g modifierGroup) string {
+	name := itemRef(p.ItemID)
+	if item, ok := vp.Item(p.ItemID); ok {
+		name = ctlgItemName(item)
+	}
+	units := ""
+	if p.Quantity > 1 {
+		units = fmt.Sprintf(" (%d of them)", p.Quantity)
+	}
+	return fmt.Sprintf("Which %s for %s%s?", strings.ToLower(g.Name), name, units)
+}
+
+// optionLabels are the group's options as offered, with their deltas.
+func optionLabels(g modifierGroup) []string {
+	labels := make([]string, len(g.Options))
+	for i, o := range g.Options {
+		labels[i] = o.Name
+		if o.PriceDelta != 0 {
+			labels[i] += fmt.Sprintf(" (%+.2f)", o.PriceDelta)
+		}
+	}
+	return labels
+}
+
+// nextPrompt asks about the customer's first outstanding prompt, or
+// returns "" if there is none.
+func (cc *commandContext) nextPrompt(cell string, vp versionedPricelist) string {
+	p, ok := cc.modifierPrompts.current(cell)
+	if !ok {
+		return ""
+	}
+	g, ok := nextRequiredGroup(vp.Modifiers[p.ItemID], p)
+	if !ok {
+		return ""
+	}
+	return choicePrompt(vp, p, g)
+}
+
+// recordAddedOptions handles items the last message added to the cart:
+// options named in the message are recorded, and items with required
+// groups left open are queued for a prompt. It returns the prompt to
+// append to the reply, if any.
+func recordAddedOptions(cc *commandContext, vp versionedPricelist, cell string, orderID int64, before, after []orderLine, msg string) string {
+	added := map[int]int{}
+	for _, line := range after {
+		added[line.ItemID] += line.Quantity
+	}
+	for _, line := range before {
+		added[line.ItemID] -= line.Quantity
+	}
+	ids := make([]int, 0, len(added))
+	for id := range added {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		groups := vp.Modifiers[id]
+		if added[id] <= 0 || len(groups) == 0 {
+			continue
+		}
+		p := pendingChoice{OrderID: orderID, ItemID: id, Quantity: added[id]}
+		for _, g := range groups {
+			if o, ok := matchOption(g, msg, true); ok {
+				p.Chosen = append(p.Chosen, choose(g, o))
+			}
+		}
+		if _, open := nextRequiredGroup(groups, p); open {
+			cc.modifierPrompts.push(cell, p)
+			continue
+		}
+		if err := recordLineOptions(cc.db, orderID, id, p.Quantity, p.Chosen); err != nil {
+			log.Printf("Recording options of item %d on order %d failed: %v", id, orderID, err)
+		}
+	}
+	return cc.nextPrompt(cell, vp)
+}
+
+// modifierReply answers a customer's reply to an option prompt. Messages
+// that don't name one of the options aren't handled here, so a customer
+// can carry on ordering and is asked again at checkout.
+func modifierReply(cc *commandContext, vp versionedPricelist, cell, msg string) (string, bool) {
+	p, ok := cc.modifierPrompts.current(cell)
+	if !ok {
+		return "", false
+	}
+	groups := vp.Modifiers[p.ItemID]
+	g, open := nextRequiredGroup(groups, p)
+	if !open {
+		cc.modifierPrompts.replace(cell, p, true)
+		return "", false
+	}
+	o, ok := matchOption(g, msg, false)
+	if n, err := strconv.Atoi(strings.TrimSpace(msg)); err == nil && n >= 1 && n <= len(g.Options) {
+		// Numbered, as offered when a poll goes unanswered.
+		o, ok = g.Options[n-1], true
+	}
+	if !ok {
+		return "", false
+	}
+	p.Chosen = append(p.Chosen, choose(g, o))
+	if g, open := nextRequiredGroup(groups, p); open {
+		cc.modifierPrompts.replace(cell, p, false)
+		return choicePrompt(vp, p, g), true
+	}
+	if err := recordLineOptions(cc.db, p.OrderID, p.ItemID, p.Quantity, p.Chosen); err != nil {
+		return cc.apology(incidentOptionSave, cell, p.OrderID, err, "Options: recording the options of "+itemRef(p.ItemID),
+			"Sorry, something went wrong saving your choice. Please try again."), true
+	}
+	cc.modifierPrompts.replace(cell, p, true)
+
+	name := itemRef(p.ItemID)
+	if item, ok := vp.Item(p.ItemID); ok {
+		name = ctlgItemName(item)
+	}
+	reply := fmt.Sprintf("Got it: %d x %s (%s).", p.Quantity, name, describeChoices(p.Chosen))
+	if next := cc.nextPrompt(cell, vp); next != "" {
+		reply += "\n" + next
+	}
+	return reply, true
+}
+
+// missingOptionsReply holds up a checkout while units of items with
+// required modifiers have no options recorded, and asks for them.
+func missingOptionsReply(cc *commandContext, vp versionedPricelist, cell, msg string) (string, bool) {
+	if !isCheckoutCommand(msg) {
+		return "", false
+	}
+	orderID, items, found, err := openOrder(cc.db, cell)
+	if err != nil || !found {
+		return "", false
+	}
+	lines, err := decodeOrderLines(items)
+	if err != nil {
+		return "", false
+	}
+	units, err := orderLineOptions(cc.db, orderID)
+	if err != nil {
+		log.Printf("Reading options of order %d failed: %v", orderID, err)
+		return "", false
+	}
+	// The prompts are rebuilt from what the order is missing, which also
+	// covers anything asked earlier and not yet answered.
+	cc.modifierPrompts.clear(cell, 0)
+	missing := false
+	for _, line := range lines {
+		groups := vp.Modifiers[line.ItemID]
+		if _, required := nextRequiredGroup(groups, pendingChoice{}); !required {
+			continue
+		}
+		if n := line.Quantity - len(units[line.ItemID]); n > 0 {
+			missing = true
+			cc.modifierPrompts.push(cell, pendingChoice{OrderID: orderID, ItemID: line.ItemID, Quantity: n})
+		}
+	}
+	if !missing {
+		return "", false
+	}
+	return "Before you check out we need a few choices.\n" + cc.nextPrompt(cell, vp), true
+}
+
+func ListModifiersHandler(prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, modifierList(prclist.Snapshot().Modifiers))
+	}
+}
+
+// PutModifiersHandler replaces an item's modifier groups with the posted
+// list.
+func PutModifiersHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := itemIDParam(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, ok := prclist.Snapshot().Item(itemID); !ok {
+			writeJSONError(w, http.StatusNotFound, fmt.Sprintf("no catalogue item %d", itemID))
+			return
+		}
+		var groups []modifierGroup
+		if err := json.NewDecoder(r.Body).Decode(&groups); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		if err := validateModifierGroups(groups); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := saveItemModifiers(db, itemID, groups); err != nil {
+			log.Printf("Saving modifiers for item %d failed: %v", itemID, err)
+			writeJSONError(w, http.StatusInternalServerError, "saving modifiers failed")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
+
+func DeleteModifiersHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		itemID, err := itemIDParam(r)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := saveItemModifiers(db, itemID, nil); err != nil {
+			log.Printf("Deleting modifiers for item %d failed: %v", itemID, err)
+			writeJSONError(w, http.StatusInternalServerError, "deleting modifiers failed")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
+
+// ImportModifiersHandler replaces the modifiers of every item in a CSV
+// upload. Items not in the file keep theirs. Like the availability import,
+// nothing is written unless the whole file is valid.
+func ImportModifiersHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		items, err := parseModifierCSV(r.Body)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		vp := prclist.Snapshot()
+		for _, item := range items {
+			if _, ok := vp.Item(item.ItemID); !ok {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("no catalogue item %d", item.ItemID))
+				return
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Modifier import: begin failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "import failed")
+			return
+		}
+		defer tx.Rollback()
+		for _, item := range items {
+			if err := saveItemModifiers(tx, item.ItemID, item.Groups); err != nil {
+				log.Printf("Modifier import: saving item %d failed: %v", item.ItemID, err)
+				writeJSONError(w, http.StatusInternalServerError, "import failed")
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("Modifier import: commit failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "import failed")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
+
+func parseModifierCSV(body io.Reader) ([]itemModifiers, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = len(modifierCSVHeader)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	if strings.Join(header, ",") != strings.Join(modifierCSVHeader, ",") {
+		return nil, fmt.Errorf("CSV header must be %s", strings.Join(modifierCSVHeader, ","))
+	}
+
+	byItem := map[int]*itemModifiers{}
+	var order []int
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		itemID, err := strconv.Atoi(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid item_id %q", line, record[0])
+		}
+		required, err := strconv.ParseBool(record[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: required must be true or false", line)
+		}
+		delta := 0.0
+		if record[4] != "" {
+			if delta, err = strconv.ParseFloat(record[4], 64); err != nil {
+				return nil, fmt.Errorf("line %d: invalid price_delta %q", line, record[4])
+			}
+		}
+		item, ok := byItem[itemID]
+		if !ok {
+			item = &itemModifiers{ItemID: itemID}
+			byItem[itemID] = item
+			order = append(order, itemID)
+		}
+		i := slices.IndexFunc(item.Groups, func(g modifierGroup) bool { return strings.EqualFold(g.Name, record[1]) })
+		if i < 0 {
+			item.Groups = append(item.Groups, modifierGroup{Name: record[1], Required: required})
+			i = len(item.Groups) - 1
+		} else if item.Groups[i].Required != required {
+			return nil, fmt.Errorf("line %d: group %q of item %d is both required and optional", line, record[1], itemID)
+		}
+		item.Groups[i].Options = append(item.Groups[i].Options, modifierOption{Name: record[3], PriceDelta: delta})
+	}
+
+	items := make([]itemModifiers, 0, len(order))
+	for _, id := range order {
+		if err := validateModifierGroups(byItem[id].Groups); err != nil {
+			return nil, fmt.Errorf("item %d: %w", id, err)
+		}
+		items = append(items, *byItem[id])
+	}
+	return items, nil
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/JeremyJalpha/MenuBot_WebAPI/buildinfo"
+	"github.com/go-chi/chi/v5"
+)
+
+// GET /api/openapi.json describes the API as OpenAPI 3. The paths come
+// from walking the router, so a route can't be missing from the document;
+// what each one takes and returns comes from apiOperations, whose schemas
+// are derived from the Go types the handlers decode and encode. A route
+// with no entry there is logged at startup and shows up undocumented.
+
+// apiOperation documents a route. Request and Response are zero values of
+// what the handler decodes and encodes; nil means no body.
+type apiOperation struct {
+	Summary  string
+	Role     string
+	Query    []string
+	Request  any
+	Response any
+	// Status is the success status, 200 when zero.
+	Status int
+}
+
+// apiOperations is keyed by method and pattern, relative to /api.
+var apiOperations = map[string]apiOperation{
+	"GET /openapi.json": {Summary: "This document.", Role: roleDriver, Response: map[string]any{}},
+
+	"GET /catalogue":              {Summary: "The current pricelist. Send If-None-Match with the last ETag to skip an unchanged body.", Role: roleDriver, Response: catalogueResponse{}},
+	"GET /catalogue/availability": {Summary: "Availability rules of every item that has them.", Role: roleDriver, Response: []availabilitySpec{}},
+	"GET /catalogue/modifiers":    {Summary: "Modifier groups of every item that has them.", Role: roleDriver, Response: []itemModifiers{}},
+	"GET /catalogue/combos":       {Summary: "Every combo and its components.", Role: roleDriver, Response: []comboSpec{}},
+	"GET /catalogue/categories":   {Summary: "The category of every item that has one.", Role: roleDriver, Response: []itemCategory{}},
+	"GET /catalogue/codes":        {Summary: "Every item's code; format=csv for the CSV the import takes.", Role: roleDriver, Query: []string{"format"}, Response: []itemCode{}},
+	"GET /orders":                 {Summary: "The most recent orders in a status.", Role: roleDriver, Query: []string{"status"}, Response: []orderSummary{}},
+	"GET /orders/{orderID}":       {Summary: "An order, by number or reference, with its lines and the messages sent about it.", Role: roleDriver, Response: orderResponse{}},
+	"POST /orders/{orderID}/eta":  {Summary: "Update an order's ETA, telling the customer.", Role: roleDriver, Request: orderETA{}, Response: etaResponse{}},
+
+	"POST /catalogue/availability/import":       {Summary: "Replace availability rules from a CSV upload.", Role: roleManager, Response: pricelistVersionResponse{}},
+	"PUT /catalogue/{itemID}/availability":      {Summary: "Set an item's availability rule.", Role: roleManager, Request: availabilitySpec{}, Response: pricelistVersionResponse{}},
+	"DELETE /catalogue/{itemID}/availability":   {Summary: "Remove an item's availability rule.", Role: roleManager, Response: pricelistVersionResponse{}},
+	"POST /catalogue/modifiers/import":          {Summary: "Replace modifiers from a CSV upload.", Role: roleManager, Response: pricelistVersionResponse{}},
+	"PUT /catalogue/{itemID}/modifiers":         {Summary: "Replace an item's modifier groups.", Role: roleManager, Request: []modifierGroup{}, Response: pricelistVersionResponse{}},
+	"DELETE /catalogue/{itemID}/modifiers":      {Summary: "Remove an item's modifier groups.", Role: roleManager, Response: pricelistVersionResponse{}},
+	"PUT /catalogue/{itemID}/combo":             {Summary: "Make an item a combo of the given components.", Role: roleManager, Request: comboSpec{}, Response: pricelistVersionResponse{}},
+	"DELETE /catalogue/{itemID}/combo":          {Summary: "Make a combo a plain item again.", Role: roleManager, Response: pricelistVersionResponse{}},
+	"PUT /catalogue/{itemID}/category":          {Summary: "Set an item's category.", Role: roleManager, Request: itemCategoryRequest{}, Response: pricelistVersionResponse{}},
+	"DELETE /catalogue/{itemID}/category":       {Summary: "Remove an item's category.", Role: roleManager, Response: pricelistVersionResponse{}},
+	"POST /catalogue/codes/import":              {Summary: "Set item codes from an item_id,code CSV upload.", Role: roleManager, Response: pricelistVersionResponse{}},
+	"PUT /catalogue/{itemID}/code":              {Summary: "Set an item's code; 409 if another item has it.", Role: roleManager, Request: itemCodeRequest{}, Response: pricelistVersionResponse{}},
+	"PATCH /catalogue/{itemID}":                 {Summary: "Change an item's state, e.g. sell it out.", Role: roleManager, Request: itemStatePatch{}, Response: pricelistVersionResponse{}},
+	"DELETE /catalogue/{itemID}":                {Summary: "Take an item off the menu for good.", Role: roleManager, Response: pricelistVersionResponse{}},
+	"PUT /catalogue/{itemID}/image":             {Summary: "Set an item's image.", Role: roleManager, Request: itemImageRequest{}, Response: pricelistVersionResponse{}},
+	"DELETE /catalogue/{itemID}/image":          {Summary: "Remove an item's image.", Role: roleManager, Response: pricelistVersionResponse{}},
+	"GET /price-changes":                        {Summary: "Pending price changes.", Role: roleManager, Query: []string{"all"}, Response: []priceChange{}},
+	"POST /price-changes":                       {Summary: "Schedule a price change.", Role: roleManager, Request: priceChange{}, Response: priceChange{}, Status: http.StatusCreated},
+	"DELETE /price-changes/{changeID}":          {Summary: "Withdraw a price change that hasn't taken effect.", Role: roleManager, Response: pricelistVersionResponse{}},
+	"GET /specials":                             {Summary: "Current and upcoming specials.", Role: roleManager, Query: []string{"all"}, Response: []special{}},
+	"POST /specials":                            {Summary: "Schedule a special.", Role: roleManager, Request: special{}, Response: special{}, Status: http.StatusCreated},
+	"DELETE /specials/{specialID}":              {Summary: "Withdraw a special.", Role: roleManager, Response: pricelistVersionResponse{}},
+	"GET /tiers":                                {Summary: "Every price tier.", Role: roleManager, Response: []priceTier{}},
+	"PUT /tiers/{tier}":                         {Summary: "Create or replace a price tier.", Role: roleManager, Request: priceTier{}, Response: pricelistVersionResponse{}},
+	"PUT /customers/{number}/tier":              {Summary: "Put a customer in a price tier.", Role: roleManager, Request: customerTierRequest{}, Response: customerTierResponse{}},
+	"GET /customers/{number}/points":            {Summary: "A customer's loyalty points and their history.", Role: roleManager, Response: loyaltyAccount{}},
+	"POST /customers/{number}/points":           {Summary: "Adjust a customer's loyalty points.", Role: roleManager, Request: loyaltyAdjustment{}, Response: loyaltyAccount{}},
+	"GET /users":                                {Summary: "Customers by name, paginated; q is part of a name or the end of a number.", Role: roleManager, Query: []string{"q", "limit", "offset"}, Response: customerDirectory{}},
+	"GET /users/{cell}/cart":                    {Summary: "The customer's cart as the bot prices it, with the version to write it at.", Role: roleManager, Response: cartResponse{}},
+	"POST /users/{cell}/cart/add":               {Summary: "Add an item to the cart; 409 if the version is stale or the item unavailable.", Role: roleManager, Request: cartLineRequest{}, Response: cartResponse{}},
+	"POST /users/{cell}/cart/remove":            {Summary: "Take some or all of an item out of the cart; 409 if the version is stale.", Role: roleManager, Request: cartLineRequest{}, Response: cartResponse{}},
+	"POST /orders/{orderID}/priority":           {Summary: "Move a paid order up or down today's preparation queue.", Role: roleManager, Request: orderPriorityRequest{}, Response: orderPriorityResponse{}},
+	"GET /dead-letters":                         {Summary: "Payment notifications that could not be processed.", Role: roleManager, Query: []string{"all"}, Response: []deadLetterView{}},
+	"POST /dead-letters/{deadLetterID}/redrive": {Summary: "Process a dead letter's notification again.", Role: roleManager, Response: redriveResponse{}, Status: http.StatusAccepted},
+	"GET /incidents/{incidentID}":               {Summary: "What failed behind the reference a customer or alert quoted.", Role: roleManager, Response: incident{}},
+
+	"GET /users/{cell}/export":          {Summary: "Everything stored about a customer, as a download.", Role: roleAdmin, Response: map[string]any{}},
+	"GET /users/{cell}/consent":         {Summary: "A customer's marketing consent and its history.", Role: roleAdmin, Response: customerConsent{}},
+	"GET /users/duplicates":             {Summary: "Customer profiles that look like the same person.", Role: roleAdmin, Response: []duplicateCandidate{}},
+	"GET /devices":                      {Summary: "The paired WhatsApp devices and their connection state, the primary first.", Role: roleAdmin, Response: []deviceStatus{}},
+	"GET /devices/pair":                 {Summary: "The pairing in progress or last finished, with the QR code to scan while waiting.", Role: roleAdmin, Response: devicePairing{}},
+	"POST /devices/pair":                {Summary: "Start pairing another WhatsApp device; 409 while one is already waiting.", Role: roleAdmin, Response: devicePairing{}},
+	"POST /users/merge":                 {Summary: "Merge a duplicate customer profile into another.", Role: roleAdmin, Request: mergeRequest{}, Response: customerMerge{}},
+	"POST /broadcasts":                  {Summary: "Send a marketing message to every subscriber.", Role: roleAdmin, Request: broadcastRequest{}, Response: broadcastResponse{}, Status: http.StatusAccepted},
+	"POST /messages":                    {Summary: "Send a message to a customer.", Role: roleAdmin, Request: sendMessageRequest{}, Response: sendMessageResponse{}, Status: http.StatusAccepted},
+	"POST /templates/{name}/preview":    {Summary: "Render CLOSED_MESSAGE, AD_GREETING or INVITE_ONLY_MESSAGE, or a draft of one, with sample variables.", Role: roleAdmin, Request: templatePreviewRequest{}, Response: templatePreview{}},
+	"POST /templates/{name}/test-send":  {Summary: "Render a template like the preview and send it to HOST_NUMBER only.", Role: roleAdmin, Request: templatePreviewRequest{}, Response: templateTestSend{}, Status: http.StatusAccepted},
+	"GET /reports/funnel":               {Summary: "How far conversations got towards payment.", Role: roleAdmin, Query: []string{"from", "to"}, Response: funnelReport{}},
+	"GET /reports/uptime":               {Summary: "WhatsApp connection uptime.", Role: roleAdmin, Query: []string{"from", "to"}, Response: uptimeReport{}},
+	"GET /reports/referrals":            {Summary: "Referrals and the orders they brought.", Role: roleAdmin, Query: []string{"from", "to"}, Response: referralReport{}},
+	"GET /reports/reconciliation":       {Summary: "A day's orders against PayFast's payments.", Role: roleAdmin, Query: []string{"date"}, Response: reconciliationReport{}},
+	"GET /reports/conversations":        {Summary: "What customers asked and how it was answered.", Role: roleAdmin, Query: []string{"from", "to", "limit"}, Response: conversationReport{}},
+	"GET /reports/commands":             {Summary: "How messages were dispatched today, and the top texts nothing understood.", Role: roleAdmin, Query: []string{"date"}, Response: commandReport{}},
+	"GET /reports/ratings":              {Summary: "Order ratings over time.", Role: roleAdmin, Query: []string{"from", "to", "interval"}, Response: ratingReport{}},
+	"POST /replay":                      {Summary: "Answer a period's customer messages again with the current pipeline, keeping nothing, and compare the replies with those sent.", Role: roleAdmin, Query: []string{"from", "to"}, Response: replayReport{}},
+	"POST /encryption/migrate":          {Summary: "Encrypt a batch of fields stored before encryption was on.", Role: roleAdmin, Query: []string{"batch"}, Response: encryptFieldsResponse{}},
+	"POST /retention/run":               {Summary: "Run the nightly purge now.", Role: roleAdmin, Query: []string{"dry_run"}, Response: retentionResponse{}},
+	"GET /whatsapp/store":               {Summary: "Row counts of the WhatsApp store.", Role: roleAdmin, Response: []waStoreCount{}},
+	"POST /whatsapp/store/cleanup":      {Summary: "Remove old rows from the WhatsApp store.", Role: roleAdmin, Query: []string{"months", "confirm"}, Response: waCleanupReport{}},
+	"GET /backup":                       {Summary: "The shop's configuration, as a download.", Role: roleAdmin, Response: shopBackup{}},
+	"POST /restore":                     {Summary: "Replace the configuration with a backup.", Role: roleAdmin, Query: []string{"dry_run"}, Request: shopBackup{}, Response: restoreResponse{}},
+	"GET /maintenance":                  {Summary: "Whether maintenance mode is on.", Role: roleAdmin, Response: maintenanceState{}},
+	"GET /jobs":                         {Summary: "The background jobs, their last run and when they next run.", Role: roleAdmin, Response: []jobStatus{}},
+	"POST /jobs/{jobName}/run":          {Summary: "Run a background job now; 409 while it is running or on the standby.", Role: roleAdmin, Response: map[string]string{}},
+	"PUT /maintenance":                  {Summary: "Turn maintenance mode on or off.", Role: roleAdmin, Request: maintenanceRequest{}, Response: maintenanceState{}},
+	"GET /contact-rules":                {Summary: "The allow and deny rules in force, and whether only allowed numbers are served.", Role: roleAdmin, Response: contactRulesResponse{}},
+	"POST /contact-rules":               {Summary: "Add an allow or deny rule for a number or prefix*.", Role: roleAdmin, Request: contactRuleRequest{}, Response: contactRule{}},
+	"DELETE /contact-rules/{ruleID}":    {Summary: "Remove a contact rule.", Role: roleAdmin, Status: http.StatusNoContent},
+	"PUT /contact-rules/allowlist-only": {Summary: "Turn allowlist-only mode on or off.", Role: roleAdmin, Request: allowlistOnlyRequest{}, Response: contactRulesResponse{}},
+	"GET /staff/keys":                   {Summary: "Every staff key, revoked ones included.", Role: roleAdmin, Response: []staffKey{}},
+	"POST /staff/keys":                  {Summary: "Issue a staff key. The key is only ever shown in this response.", Role: roleAdmin, Request: staffKeyRequest{}, Response: staffKey{}, Status: http.StatusCreated},
+	"DELETE /staff/keys/{keyID}":        {Summary: "Revoke a staff key.", Role: roleAdmin, Status: http.StatusNoContent},
+	"GET /staff/audit":                  {Summary: "Who changed what through the API, newest first.", Role: roleAdmin, Query: []string{"from", "to"}, Response: []staffAuditEntry{}},
+}
+
+var pathParam = regexp.MustCompile(`\{([^}:]+)(:[^}]*)?\}`)
+
+// apiRoutes lists the routes of the /api router as "METHOD pattern".
+func apiRoutes(routes chi.Routes) []string {
+	var found []string
+	err := chi.Walk(routes, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		found = append(found, method+" "+strings.TrimSuffix(route, "/"))
+		return nil
+	})
+	if err != nil {
+		log.Printf("Walking the API routes failed: %v", err)
+	}
+	sort.Strings(found)
+	return found
+}
+
+// logUndocumentedRoutes names the routes apiOperations is missing, so the
+// document and the router can't drift apart unnoticed.
+func logUndocumentedRoutes(routes chi.Routes) {
+	for _, route := range apiRoutes(routes) {
+		if _, ok := apiOperations[route]; !ok {
+			log.Printf("API route %s is missing from the OpenAPI document, add it to apiOperations", route)
+		}
+	}
+}
+
+func buildOpenAPI(routes chi.Routes) map[string]any {
+	b := &schemaBuilder{defs: map[string]any{}}
+	errorRef := b.schema(reflect.TypeOf(apiErrorResponse{}))
+	paths := map[string]map[string]any{}
+	for _, route := range apiRoutes(routes) {
+		method, pattern, _ := strings.Cut(route, " ")
+		op, documented := apiOperations[route]
+		if !documented {
+			op.Summary = "Undocumented."
+		}
+		operation := map[string]any{
+			"summary":     op.Summary,
+			"operationId": operationID(method, pattern),
+			"responses":   map[string]any{},
+		}
+		if op.Role != "" {
+			operation["description"] = fmt.Sprintf("Needs a staff key with the %s role or above.", op.Role)
+		}
+		var params []any
+		for _, m := range pathParam.FindAllStringSubmatch(pattern, -1) {
+			params = append(params, map[string]any{"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+		}
+		for _, q := range op.Query {
+			params = append(params, map[string]any{"name": q, "in": "query", "schema": map[string]any{"type": "string"}})
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if op.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": b.schema(reflect.TypeOf(op.Request))}},
+			}
+		}
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		success := map[string]any{"description": http.StatusText(status)}
+		if op.Response != nil {
+			success["content"] = map[string]any{"application/json": map[string]any{"schema": b.schema(reflect.TypeOf(op.Response))}}
+		}
+		operation["responses"] = map[string]any{
+			fmt.Sprint(status): success,
+			"default": map[string]any{
+				"description": "An error; see the apiError schema for the codes.",
+				"content":     map[string]any{"application/json": map[string]any{"schema": errorRef}},
+			},
+		}
+		path := apiBaseURL + pathParam.ReplaceAllString(pattern, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]any{}
+		}
+		paths[path][strings.ToLower(method)] = operation
+	}
+
+	codes := make([]string, len(errorCodes))
+	meanings := make([]string, len(errorCodes))
+	for i, c := range errorCodes {
+		codes[i] = c.Code
+		meanings[i] = c.Code + ": " + c.Meaning
+	}
+	if def, ok := b.defs["apiError"].(map[string]any); ok {
+		props := def["properties"].(map[string]any)
+		props["code"] = map[string]any{"type": "string", "enum": codes, "description": strings.Join(meanings, "; ")}
+	}
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "MenuBot API",
+			"version": buildinfo.Get().Version,
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas":         b.defs,
+			"securitySchemes": map[string]any{"staffKey": map[string]any{"type": "http", "scheme": "bearer"}},
+		},
+		"security": []any{map[string]any{"staffKey": []any{}}},
+	}
+}
+
+// operationID is e.g. "putCatalogueItemIDModifiers".
+func operationID(method, pattern string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(pattern, func(r rune) bool { return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9') }) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// OpenAPIHandler serves GET /api/openapi.json for the routes of the /api
+// router.
+func OpenAPIHandler(routes chi.Routes) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, buildOpenAPI(routes))
+	}
+}
+
+var (
+	timeType          = reflect.TypeOf(time.Time{})
+	durationType      = reflect.TypeOf(time.Duration(0))
+	rawMessageType    = reflect.TypeOf(json.RawMessage(nil))
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// schemaBuilder derives JSON schemas from Go types the way encoding/json
+// encodes them. Named structs go in defs and are referred to by name.
+type schemaBuilder struct {
+	defs map[string]any
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	if t.Kind() == reflect.Pointer {
+		return b.schema(t.Elem())
+	}
+	switch {
+	case t == timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case t == durationType:
+		return map[string]any{"type": "integer", "description": "nanoseconds"}
+	case t == rawMessageType:
+		return map[string]any{}
+	case t.Implements(jsonMarshalerType) || reflect.PointerTo(t).Implements(jsonMarshalerType):
+		// Encodes itself; nothing to say about its shape.
+		return map[string]any{}
+	case t.Implements(textMarshalerType) || reflect.PointerTo(t).Implements(textMarshalerType):
+		return map[string]any{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		if _, seen := b.defs[t.Name()]; !seen {
+			// Placeholder first, for types that refer to themselves.
+			b.defs[t.Name()] = map[string]any{}
+			b.defs[t.Name()] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]any{}
+}
+
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	var required []string
+	b.fields(t, props, &required)
+	s := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		sort.Strings(required)
+		s["required"] = required
+	}
+	return s
+}
+
+// fields adds t's JSON fields to props, flattening embedded structs as
+// encoding/json does.
+func (b *schemaBuilder) fields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		ft := f.Type
+		if ft.Kind() == reflect.Pointer {
+			ft = ft.Elem()
+		}
+		if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+			b.fields(ft, props, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = b.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			*required = append(*required, name)
+		}
+	}
+}
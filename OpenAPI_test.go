@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestOpenAPICoversRoutes walks the API router and checks every route is
+// documented, every documented route exists, and both are in the served
+// document.
+func TestOpenAPICoversRoutes(t *testing.T) {
+	withRuntimeConfig(t, &RuntimeConfig{})
+	d := testRouteDeps("127.0.0.1:9090")
+	d.envVars.AdminAPIKey = "admin-key"
+	_, admin := newRouters(d)
+
+	routes := map[string]bool{}
+	for _, route := range routePatterns(t, admin) {
+		method, path, _ := strings.Cut(route, " ")
+		if rel, ok := strings.CutPrefix(path, apiBaseURL+"/"); ok {
+			routes[method+" /"+strings.TrimSuffix(rel, "/")] = true
+		}
+	}
+	if len(routes) == 0 {
+		t.Fatal("no API routes found")
+	}
+	for route := range routes {
+		if _, ok := apiOperations[route]; !ok {
+			t.Errorf("%s is missing from apiOperations", route)
+		}
+	}
+	for route := range apiOperations {
+		if !routes[route] {
+			t.Errorf("apiOperations documents %s, which has no route", route)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, apiBaseURL+"/openapi.json", nil)
+	req.Header.Set("Authorization", "Bearer admin-key")
+	rec := httptest.NewRecorder()
+	admin.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/openapi.json = %d: %s", rec.Code, rec.Body)
+	}
+	var doc struct {
+		OpenAPI string                    `json:"openapi"`
+		Paths   map[string]map[string]any `json:"paths"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		t.Errorf("openapi = %q, want 3.x", doc.OpenAPI)
+	}
+	for route := range routes {
+		method, pattern, _ := strings.Cut(route, " ")
+		path := apiBaseURL + pathParam.ReplaceAllString(pattern, "{$1}")
+		op, ok := doc.Paths[path][strings.ToLower(method)].(map[string]any)
+		if !ok {
+			t.Errorf("%s %s is missing from the document", method, path)
+			continue
+		}
+		if op["summary"] == "Undocumented." {
+			t.Errorf("%s %s is undocumented", method, path)
+		}
+	}
+}
+
+func TestAPIErrorEnvelope(t *testing.T) {
+	tests := []struct {
+		status int
+		code   string
+	}{
+		{http.StatusBadRequest, codeValidationFailed},
+		{http.StatusUnprocessableEntity, codeValidationFailed},
+		{http.StatusRequestEntityTooLarge, codeValidationFailed},
+		{http.StatusUnauthorized, codeUnauthorized},
+		{http.StatusForbidden, codeForbidden},
+		{http.StatusNotFound, codeNotFound},
+		{http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{http.StatusConflict, codeConflict},
+		{http.StatusServiceUnavailable, codeUnavailable},
+		{http.StatusInternalServerError, codeInternal},
+		{http.StatusBadGateway, codeInternal},
+	}
+	documented := map[string]bool{}
+	for _, c := range errorCodes {
+		documented[c.Code] = true
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			writeAPIError(rec, tt.status, "went wrong", map[string]string{"field": "name"})
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+			var body map[string]map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			e := body["error"]
+			if e["code"] != tt.code || e["message"] != "went wrong" || e["details"] == nil {
+				t.Errorf("error = %v, want code %s", e, tt.code)
+			}
+			if !documented[tt.code] {
+				t.Errorf("%s isn't in errorCodes", tt.code)
+			}
+		})
+	}
+}
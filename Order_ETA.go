@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// etaRenotifyThreshold is how far an updated ETA must move before the
+// customer is told again, so a driver app posting every minute doesn't
+// flood them.
+const etaRenotifyThreshold = 10 * time.Minute
+
+// statusReplies describe each order status to the customer.
+var statusReplies = map[string]string{
+	statusUnpaid:    "is waiting for payment",
+	statusPaid:      "is paid and in the queue",
+	statusPreparing: "is being prepared",
+	statusReady:     "is ready",
+	statusCollected: "has been collected",
+	statusDelivered: "has been delivered",
+	statusCancelled: "was cancelled",
+	statusDisputed:  "is on hold while we sort out a problem with its payment",
+	statusExpired:   "expired because it wasn't paid, send \"repeat\" to order the same again",
+}
+
+type orderETA struct {
+	ETA  time.Time `json:"eta"`
+	Note string    `json:"note,omitempty"`
+}
+
+// finished reports whether the order is past the point where an ETA means
+// anything.
+func (o orderSummary) finished() bool {
+	return o.Status == statusCancelled || o.Status == statusDisputed || o.Status == statusExpired || o.atOrPast(statusCollected)
+}
+
+func getOrderETA(db *sql.DB, orderID int64) (orderETA, bool, error) {
+	var e orderETA
+	var eta sql.NullTime
+	err := db.QueryRow(`SELECT eta, eta_note FROM order_meta WHERE order_id = $1`, orderID).Scan(&eta, &e.Note)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !eta.Valid) {
+		return orderETA{}, false, nil
+	}
+	if err != nil {
+		return orderETA{}, false, err
+	}
+	e.ETA = eta.Time
+	return e, true, nil
+}
+
+func formatETA(t time.Time) string {
+	return t.In(cfg().BusinessHours.Location).Format("15:04")
+}
+
+// customerStatus handles "status": where the customer's latest order is,
+// or with "status PIG-2024-0042" that order, if it is theirs.
+func customerStatus(cc *commandContext, sender string, args []string) string {
+	var order orderSummary
+	var found bool
+	var err error
+	if len(args) > 0 {
+		var orderID int64
+		orderID, err = resolveOrderArg(cc.db, strings.Join(args, " "))
+		switch {
+		case errors.Is(err, errNotOrderRef):
+			return `Send "status" for your latest order, or "status" and the order reference, e.g. "status ` + formatOrderRef(cc.envVars.OrderRefPrefix, time.Now(), 42) + `".`
+		case errors.Is(err, errUnknownOrderRef):
+			return "You don't have an order with that reference."
+		case err == nil:
+			order, found, err = getOrder(cc.db, orderID)
+			if found && order.CellNumber != sender {
+				return "You don't have an order with that reference."
+			}
+		}
+	} else {
+		order, found, err = latestOrder(cc.db, sender)
+	}
+	if err != nil {
+		return cc.apology(incidentOrderLookup, sender, 0, err, "Status: reading the order",
+			"Sorry, something went wrong looking up your order. Please try again.")
+	}
+	if !found {
+		if len(args) > 0 {
+			return "You don't have an order with that reference."
+		}
+		return "You don't have any orders yet."
+	}
+	reply := fmt.Sprintf("Your order %s %s", order.reference(), statusReplies[order.Status])
+	if !order.finished() {
+		eta, ok, err := getOrderETA(cc.db, order.ID)
+		if err != nil {
+			log.Printf("Status: reading ETA of order %d failed: %v", order.ID, err)
+		} else if ok {
+			reply += ", estimated arrival " + formatETA(eta.ETA)
+		} else if order.Status == statusPaid {
+			reply += queueStatus(cc, order)
+		}
+	}
+	return reply + "."
+}
+
+// setOrderETA stores the ETA and reports whether the customer should hear
+// about it: the first time one is set, or when it moves by more than
+// etaRenotifyThreshold from the last one they were told.
+func setOrderETA(db *sql.DB, orderID int64, e orderETA) (notify bool, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var notified sql.NullTime
+	err = tx.QueryRow(`SELECT eta_notified FROM order_meta WHERE order_id = $1 FOR UPDATE`, orderID).Scan(&notified)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	notify = !notified.Valid || absDuration(e.ETA.Sub(notified.Time)) > etaRenotifyThreshold
+	_, err = tx.Exec(`INSERT INTO order_meta (order_id, pricelist_version, eta, eta_note, eta_notified)
+		VALUES ($1, 0, $2, $3, CASE WHEN $4 THEN $2 END)
+		ON CONFLICT (order_id) DO UPDATE SET eta = EXCLUDED.eta, eta_note = EXCLUDED.eta_note,
+			eta_notified = CASE WHEN $4 THEN EXCLUDED.eta ELSE order_meta.eta_notified END, updated_at = now()`,
+		orderID, e.ETA, e.Note, notify)
+	if err != nil {
+		return false, err
+	}
+	return notify, tx.Commit()
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+type etaResponse struct {
+	orderETA
+	Notified bool   `json:"notified"`
+	Ignored  string `json:"ignored,omitempty"`
+}
+
+// PostOrderETAHandler takes ETA updates from the drivers' app, e.g.
+// {"eta": "2024-06-01T18:20:00+02:00", "note": "stuck in traffic"}. Updates
+// for orders that are already delivered are acknowledged but ignored, so a
+// late retry can't message the customer.
+func PostOrderETAHandler(cc *commandContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderID, ok := orderIDParam(w, r, cc.db)
+		if !ok {
+			return
+		}
+		var e orderETA
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		if e.ETA.IsZero() {
+			writeJSONError(w, http.StatusBadRequest, "eta is required")
+			return
+		}
+		e.Note = strings.TrimSpace(e.Note)
+
+		order, found, err := getOrder(cc.db, orderID)
+		if err != nil {
+			log.Printf("Reading order %d failed: %v", orderID, err)
+			writeJSONError(w, http.StatusInternalServerError, "reading order failed")
+			return
+		}
+		if !found {
+			writeJSONError(w, http.StatusNotFound, "no such order")
+			return
+		}
+		if order.finished() {
+			writeJSON(w, http.StatusOK, etaResponse{orderETA: e, Ignored: "order is " + order.Status})
+			return
+		}
+
+		notify, err := setOrderETA(cc.db, orderID, e)
+		if err != nil {
+			log.Printf("Saving ETA for order %d failed: %v", orderID, err)
+			writeJSONError(w, http.StatusInternalServerError, "saving ETA failed")
+			return
+		}
+		if notify {
+			text := fmt.Sprintf("Your order %s is on its way, estimated arrival %s.", order.reference(), formatETA(e.ETA))
+			if e.Note != "" {
+				text += "\nDriver: " + e.Note
+			}
+			cc.sender.SendOrder(order.CellNumber, text, priorityNotify, orderID)
+		}
+		writeJSON(w, http.StatusOK, etaResponse{orderETA: e, Notified: notify})
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// "remove <item>" and "change <item> <qty>" edit the customer's cart. A
+// cart that was already checked out but not paid is reopened for the
+// edit: its payment link is dropped, so the duplicate checkout guard
+// can't hand it out again, and the next checkout issues a fresh one for
+// the edited total. An ITN for the old link no longer matches the total
+// and goes to the dead letters instead of marking the order paid.
+
+const maxEditQuantity = 999
+
+func customerRemoveItem(cc *commandContext, sender string, args []string) string {
+	if len(args) == 0 {
+		return "Send \"remove\" followed by an item in your cart, e.g. \"remove item7\"."
+	}
+	return editCart(cc, sender, strings.Join(args, " "), 0)
+}
+
+// customerEditOrder shows the cart and how to change it.
+func customerEditOrder(cc *commandContext, sender string, args []string) string {
+	orderID, reopen, found, err := editableOrder(cc.db, sender)
+	if err != nil {
+		return cc.apology(incidentCartLookup, sender, 0, err, "Editing cart: finding the order",
+			"Sorry, something went wrong looking up your cart. Please try again.")
+	}
+	if !found {
+		return "You don't have anything in your cart to change."
+	}
+	var items string
+	err = cc.db.QueryRow(`SELECT COALESCE(`+orderItemsColumn+`::text, '') FROM `+orderTable+` WHERE `+orderIDColumn+` = $1`, orderID).Scan(&items)
+	if err != nil {
+		return cc.apology(incidentCartLookup, sender, orderID, err, "Editing cart: reading the order",
+			"Sorry, something went wrong looking up your cart. Please try again.")
+	}
+	lines, err := decodeOrderLines(items)
+	if err != nil || len(lines) == 0 {
+		return "You don't have anything in your cart to change."
+	}
+	vp := cc.prclist.Snapshot().ForTier(customerTier(cc.db, sender))
+	reply := cartSummary(cc.db, vp, orderID, lines) +
+		"\n\nSend \"remove\" and an item to take it out, e.g. \"remove item7\", or \"change\" with an item and quantity, e.g. \"change item7 2\"."
+	if reopen {
+		reply += " Changing an order already checked out replaces its payment link."
+	}
+	return reply
+}
+
+func customerChangeItem(cc *commandContext, sender string, args []string) string {
+	usage := "Send \"change\" followed by an item in your cart and the quantity you want, e.g. \"change item7 2\"."
+	if len(args) < 2 {
+		return usage
+	}
+	qty, err := strconv.Atoi(args[len(args)-1])
+	if err != nil || qty < 0 || qty > maxEditQuantity {
+		return usage
+	}
+	return editCart(cc, sender, strings.Join(args[:len(args)-1], " "), qty)
+}
+
+// editableOrder returns the customer's open cart or, failing that, their
+// latest order if it was checked out and is still unpaid. reopen is set
+// for the latter.
+func editableOrder(db *sql.DB, cell string) (orderID int64, reopen, found bool, err error) {
+	if orderID, _, found, err = openOrder(db, cell); err != nil || found {
+		return orderID, false, found, err
+	}
+	order, found, err := latestOrder(db, cell)
+	if err != nil || !found || order.Status != statusUnpaid {
+		return 0, false, false, err
+	}
+	var link string
+	err = db.QueryRow(`SELECT payment_link FROM order_meta WHERE order_id = $1`, order.ID).Scan(&link)
+	if err == sql.ErrNoRows || (err == nil && link == "") {
+		return 0, false, false, nil
+	}
+	return order.ID, true, err == nil, err
+}
+
+// editCart sets the quantity of the item query names in the customer's
+// cart, removing it at zero, and answers with the updated cart.
+func editCart(cc *commandContext, sender, query string, qty int) string {
+	orderID, reopen, found, err := editableOrder(cc.db, sender)
+	if err != nil {
+		return cc.apology(incidentCartLookup, sender, 0, err, "Editing cart: finding the order",
+			"Sorry, something went wrong looking up your cart. Please try again.")
+	}
+	if !found {
+		return "You don't have anything in your cart to change."
+	}
+	vp := cc.prclist.Snapshot().ForTier(customerTier(cc.db, sender))
+	item, ok := findItem(vp, query)
+	if !ok {
+		return fmt.Sprintf("Sorry, we don't have an item called %q.", query)
+	}
+	itemID := ctlgItemID(item)
+
+	const failed = "Sorry, something went wrong changing your cart. Please try again."
+	tx, err := cc.db.Begin()
+	if err != nil {
+		return cc.apology(incidentCartChange, sender, orderID, err, "Editing cart: starting the transaction", failed)
+	}
+	defer tx.Rollback()
+	lines, changed, err := setLineQuantity(tx, orderID, itemID, qty, vp)
+	if err != nil {
+		return cc.apology(incidentCartChange, sender, orderID, err, "Editing cart: setting the quantity of "+itemRef(itemID), failed)
+	}
+	if !changed {
+		return fmt.Sprintf("%s isn't in your cart.", ctlgItemName(item))
+	}
+	if reopen {
+		// Clearing the link first keeps the order from being offered as
+		// a pending duplicate while it's being edited.
+		if _, err = tx.Exec(`UPDATE order_meta SET payment_link = '', checked_out_at = NULL, updated_at = now() WHERE order_id = $1`, orderID); err == nil {
+			_, err = tx.Exec(`UPDATE `+orderTable+` SET `+orderOpenSet+` WHERE `+orderIDColumn+` = $1`, orderID)
+		}
+		if err != nil {
+			return cc.apology(incidentCartChange, sender, orderID, err, "Editing cart: reopening the checked-out order", failed)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return cc.apology(incidentCartChange, sender, orderID, err, "Editing cart: committing", failed)
+	}
+	if err := trimLineOptions(cc.db, orderID, lines); err != nil {
+		log.Printf("Trimming options of order %d failed: %v", orderID, err)
+	}
+	cc.modifierPrompts.clear(sender, 0)
+	log.Printf("%s set %s to %d in order %d", sender, itemRef(itemID), qty, orderID)
+	metrics.Inc("menubot_cart_edits_total", "Cart lines customers changed or removed themselves.")
+
+	var b strings.Builder
+	if qty == 0 {
+		fmt.Fprintf(&b, "Removed %s.", ctlgItemName(item))
+	} else {
+		fmt.Fprintf(&b, "Changed %s to %d.", ctlgItemName(item), qty)
+	}
+	if len(lines) == 0 {
+		b.WriteString(" Your cart is now empty; send \"menu\" to start a new order.")
+		return b.String()
+	}
+	b.WriteString("\n\n" + cartSummary(cc.db, vp, orderID, lines))
+	if reopen {
+		b.WriteString("\n\nThe payment link we sent earlier is no longer valid.")
+	}
+	b.WriteString(fmt.Sprintf("\nSend \"%s\" for a payment link.", checkoutCommands[0]))
+	return b.String()
+}
+
+// setLineQuantity rewrites the order's items with itemID at qty, and
+// returns the lines left. changed is false when the item isn't in the
+// order. Fields MenuBotLib stores on a line besides the item and quantity
+// are kept as they were.
+func setLineQuantity(tx *sql.Tx, orderID int64, itemID, qty int, vp versionedPricelist) (lines []orderLine, changed bool, err error) {
+	var items string
+	err = tx.QueryRow(`SELECT COALESCE(`+orderItemsColumn+`::text, '') FROM `+orderTable+
+		` WHERE `+orderIDColumn+` = $1 FOR UPDATE`, orderID).Scan(&items)
+	if err != nil || items == "" {
+		return nil, false, err
+	}
+	kept, lines, changed, err := editOrderLines(items, itemID, qty)
+	if err != nil || !changed {
+		return nil, false, err
+	}
+	quoted, err := orderQuotedPrices(tx, orderID)
+	if err != nil {
+		return nil, false, err
+	}
+	var total float64
+	for _, line := range lines {
+		total += linePrice(vp, quoted, line.ItemID) * float64(line.Quantity)
+	}
+	return lines, true, saveOrderLines(tx, orderID, kept, total)
+}
+
+// editOrderLines sets itemID to qty in an order's encoded items, returning
+// MenuBotLib's raw entries to store and the lines they decode to.
+func editOrderLines(items string, itemID, qty int) (kept []map[string]json.RawMessage, lines []orderLine, changed bool, err error) {
+	var raw []map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(items), &raw); err != nil {
+		return nil, nil, false, fmt.Errorf("decoding items: %w", err)
+	}
+	decoded, err := decodeOrderLines(items)
+	if err != nil {
+		return nil, nil, false, fmt.Errorf("decoding items: %w", err)
+	}
+	kept = []map[string]json.RawMessage{}
+	for i, entry := range raw {
+		line := decoded[i]
+		if line.ItemID == itemID {
+			if changed {
+				// Lines of the same item after the first are merged into it.
+				continue
+			}
+			changed = true
+			if qty == 0 {
+				continue
+			}
+			line.Quantity = qty
+			entry["Quantity"] = json.RawMessage(strconv.Itoa(qty))
+		}
+		kept = append(kept, entry)
+		lines = append(lines, line)
+	}
+	return kept, lines, changed, nil
+}
+
+// saveOrderLines writes an order's items, as MenuBotLib's raw entries, and
+// its total.
+func saveOrderLines(tx *sql.Tx, orderID int64, entries []map[string]json.RawMessage, total float64) error {
+	encoded, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE `+orderTable+` SET `+orderItemsColumn+` = $2, `+orderTotalColumn+` = $3 WHERE `+orderIDColumn+` = $1`,
+		orderID, string(encoded), strconv.FormatFloat(total, 'f', 2, 64))
+	return err
+}
+
+// linePrice is what a unit of the item costs in this cart: the price it
+// was quoted at, or today's price if it never was.
+func linePrice(vp versionedPricelist, quoted quotedPrices, itemID int) float64 {
+	if price, ok := quoted[strconv.Itoa(itemID)]; ok {
+		return price
+	}
+	if item, ok := vp.Item(itemID); ok {
+		return ctlgItemPrice(item)
+	}
+	return 0
+}
+
+// cartSummary lists the cart with what it will cost, options and loyalty
+// discount included.
+func cartSummary(db *sql.DB, vp versionedPricelist, orderID int64, lines []orderLine) string {
+	quoted, err := orderQuotedPrices(db, orderID)
+	if err != nil {
+		log.Printf("Reading quoted prices of order %d failed: %v", orderID, err)
+	}
+	prices := make(quotedPrices, len(lines))
+	var total float64
+	for _, line := range lines {
+		price := linePrice(vp, quoted, line.ItemID)
+		prices[strconv.Itoa(line.ItemID)] = price
+		total += price * float64(line.Quantity)
+	}
+	surcharge, err := orderSurcharge(db, orderID)
+	if err != nil {
+		log.Printf("Reading options of order %d failed: %v", orderID, err)
+	}
+	discount, err := orderDiscount(db, orderID)
+	if err != nil {
+		log.Printf("Reading discount of order %d failed: %v", orderID, err)
+	}
+	summary := "Your cart:\n" + strings.Join(receiptLines(orderLineDetails(vp, lines, prices)), "\n")
+	if surcharge != 0 {
+		summary += fmt.Sprintf("\nOptions R%.2f", surcharge)
+	}
+	if discount > 0 {
+		summary += fmt.Sprintf("\nPoints discount -R%.2f", discount)
+	}
+	return summary + fmt.Sprintf("\nTotal R%.2f", payableAmount(total, surcharge, discount))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestEditOrderLines(t *testing.T) {
+	const items = `[{"CatalogueItemID":7,"Quantity":2,"Note":"no onion"},{"CatalogueItemID":8,"Quantity":1},{"CatalogueItemID":7,"Quantity":1}]`
+	tests := []struct {
+		name    string
+		items   string
+		itemID  int
+		qty     int
+		want    []orderLine
+		changed bool
+		stored  string
+	}{
+		{name: "change", items: items, itemID: 8, qty: 3, changed: true,
+			want:   []orderLine{{7, 2}, {8, 3}, {7, 1}},
+			stored: `[{"CatalogueItemID":7,"Note":"no onion","Quantity":2},{"CatalogueItemID":8,"Quantity":3},{"CatalogueItemID":7,"Quantity":1}]`},
+		{name: "repeated item merged, other fields kept", items: items, itemID: 7, qty: 5, changed: true,
+			want:   []orderLine{{7, 5}, {8, 1}},
+			stored: `[{"CatalogueItemID":7,"Note":"no onion","Quantity":5},{"CatalogueItemID":8,"Quantity":1}]`},
+		{name: "remove", items: items, itemID: 7, qty: 0, changed: true,
+			want:   []orderLine{{8, 1}},
+			stored: `[{"CatalogueItemID":8,"Quantity":1}]`},
+		{name: "remove the last item", items: `[{"CatalogueItemID":8,"Quantity":1}]`, itemID: 8, qty: 0, changed: true,
+			want: nil, stored: `[]`},
+		{name: "not in the cart", items: items, itemID: 9, qty: 1, changed: false,
+			want:   []orderLine{{7, 2}, {8, 1}, {7, 1}},
+			stored: `[{"CatalogueItemID":7,"Note":"no onion","Quantity":2},{"CatalogueItemID":8,"Quantity":1},{"CatalogueItemID":7,"Quantity":1}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kept, lines, changed, err := editOrderLines(tt.items, tt.itemID, tt.qty)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != tt.changed {
+				t.Errorf("changed = %v, want %v", changed, tt.changed)
+			}
+			if !reflect.DeepEqual(lines, tt.want) {
+				t.Errorf("lines = %v, want %v", lines, tt.want)
+			}
+			stored, err := json.Marshal(kept)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(stored) != tt.stored {
+				t.Errorf("stored %s, want %s", stored, tt.stored)
+			}
+		})
+	}
+	if _, _, _, err := editOrderLines(`not json`, 7, 1); err == nil {
+		t.Error("undecodable items didn't fail")
+	}
+}
+
+// TestEditedCartAndDuplicateGuard checks the cart keys the duplicate
+// checkout guard compares: an edit that changes what is in the cart stops
+// it matching the order still waiting for payment, and one that only
+// reshuffles lines doesn't.
+func TestEditedCartAndDuplicateGuard(t *testing.T) {
+	pending := []orderLine{{7, 2}, {8, 1}}
+	const cart = `[{"CatalogueItemID":7,"Quantity":1},{"CatalogueItemID":8,"Quantity":1},{"CatalogueItemID":7,"Quantity":1}]`
+	tests := []struct {
+		name      string
+		itemID    int
+		qty       int
+		duplicate bool
+	}{
+		{"lines merged to the same quantity", 7, 2, true},
+		{"quantity lowered", 7, 1, false},
+		{"quantity raised", 8, 2, false},
+		{"item removed", 8, 0, false},
+		{"item not in the cart", 9, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if cartKey(mustDecodeLines(t, cart)) != cartKey(pending) {
+				t.Fatal("the carts don't start out the same")
+			}
+			_, lines, changed, err := editOrderLines(cart, tt.itemID, tt.qty)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !changed {
+				lines = mustDecodeLines(t, cart)
+			}
+			if got := cartKey(lines) == cartKey(pending); got != tt.duplicate {
+				t.Errorf("edited cart %v matches %v: %v, want %v", lines, pending, got, tt.duplicate)
+			}
+		})
+	}
+}
+
+func mustDecodeLines(t *testing.T, items string) []orderLine {
+	t.Helper()
+	lines, err := decodeOrderLines(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestCartKey(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []orderLine
+		same bool
+	}{
+		{"same lines", []orderLine{{7, 2}, {8, 1}}, []orderLine{{7, 2}, {8, 1}}, true},
+		{"other order", []orderLine{{7, 2}, {8, 1}}, []orderLine{{8, 1}, {7, 2}}, true},
+		{"split lines", []orderLine{{7, 2}}, []orderLine{{7, 1}, {7, 1}}, true},
+		{"zero quantity ignored", []orderLine{{7, 2}, {9, 0}}, []orderLine{{7, 2}}, true},
+		{"other quantity", []orderLine{{7, 2}}, []orderLine{{7, 3}}, false},
+		{"other item", []orderLine{{7, 2}}, []orderLine{{8, 2}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cartKey(tt.a) == cartKey(tt.b); got != tt.same {
+				t.Errorf("cartKey(%v) == cartKey(%v) is %v, want %v", tt.a, tt.b, got, tt.same)
+			}
+		})
+	}
+}
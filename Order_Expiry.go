@@ -0,0 +1,165 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// An order checked out but still unpaid ORDER_EXPIRY later expires: it is
+// closed, the points redeemed against it are released and its payment
+// link is cleared, so it is no longer offered as a pending duplicate. The
+// link itself can't be withdrawn from PayFast; a payment that still comes
+// in for an expired order goes to the dead letters for someone to refund
+// or reinstate it. "repeat" copies the latest expired order into a new
+// cart, with an order number and payment link of its own.
+
+const (
+	orderExpirySweep = 10 * time.Minute
+	// orderExpiryBatch caps the orders expired per sweep, so a backlog
+	// after enabling ORDER_EXPIRY doesn't message everyone at once.
+	orderExpiryBatch = 50
+)
+
+// expiredOrdersDue lists the unpaid orders checked out before cutoff.
+func expiredOrdersDue(db *sql.DB, cutoff time.Time) ([]orderSummary, error) {
+	return listOrders(db, ` WHERE m.status = $1 AND m.checked_out_at < $2 AND NOT m.self_test
+		ORDER BY m.checked_out_at LIMIT `+fmt.Sprint(orderExpiryBatch), statusUnpaid, cutoff)
+}
+
+// expireOrder moves an unpaid order to expired and releases what it held.
+// It reports false when the order was paid or changed in the meantime.
+func expireOrder(db *sql.DB, orderID int64) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	expired, err := transitionOrder(tx, orderID, statusExpired, statusUnpaid)
+	if err != nil || !expired {
+		return false, err
+	}
+	if _, err := tx.Exec(`UPDATE order_meta SET payment_link = '', updated_at = now() WHERE order_id = $1`, orderID); err != nil {
+		return false, err
+	}
+	if err := closeOrder(tx, orderID); err != nil {
+		return false, err
+	}
+	if err := releaseLoyalty(tx, orderID); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// expireOrders expires the orders due at now and tells their customers.
+func expireOrders(cc *commandContext, now time.Time) error {
+	expiry := cfg().OrderExpiry
+	if expiry <= 0 {
+		return nil
+	}
+	due, err := expiredOrdersDue(cc.db, now.Add(-expiry))
+	if err != nil {
+		return err
+	}
+	for _, order := range due {
+		expired, err := expireOrder(cc.db, order.ID)
+		if err != nil {
+			log.Printf("Expiring order %d failed: %v", order.ID, err)
+			continue
+		}
+		if !expired {
+			continue
+		}
+		log.Printf("Order %d expired unpaid after %s", order.ID, expiry)
+		metrics.Inc("menubot_orders_expired_total", "Unpaid orders that expired.")
+		cc.events.Emit(eventOrderStatusChanged, orderStatusEvent{OrderID: order.ID, OrderRef: order.reference(), CellNumber: order.CellNumber, From: statusUnpaid, To: statusExpired})
+		cc.sendBulk(bulkMessage{
+			Recipient:   order.CellNumber,
+			Text:        fmt.Sprintf("Your order %s expired because it wasn't paid. Send \"repeat\" to order the same again.", order.reference()),
+			Kind:        bulkExpiry,
+			OrderID:     order.ID,
+			OrderStatus: statusExpired,
+		})
+	}
+	return nil
+}
+
+// repeatOrder copies an expired order's items into a new cart for cell.
+// The expired order stays as it is, so a late payment for it still lands
+// in the dead letters rather than paying for the copy. It reports false
+// when the order is no longer expired or the customer has a cart again.
+func repeatOrder(db *sql.DB, cell string, expiredID int64) (int64, bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+	// Locking the expired order makes a second "repeat" wait for the first
+	// and then find the cart it made.
+	var status string
+	err = tx.QueryRow(`SELECT COALESCE(m.status, '') FROM `+orderTable+` o
+		LEFT JOIN order_meta m ON m.order_id = o.`+orderIDColumn+`
+		WHERE o.`+orderIDColumn+` = $1 FOR UPDATE OF o`, expiredID).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && status != statusExpired) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	var carts int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM `+orderTable+` WHERE `+orderCellColumn+` = $1 AND `+orderOpenFilter, cell).Scan(&carts); err != nil {
+		return 0, false, err
+	}
+	if carts > 0 {
+		return 0, false, nil
+	}
+	var orderID int64
+	err = tx.QueryRow(`INSERT INTO `+orderTable+` (`+orderCellColumn+`, `+orderItemsColumn+`, `+orderTotalColumn+`)
+		SELECT `+orderCellColumn+`, `+orderItemsColumn+`, `+orderTotalColumn+` FROM `+orderTable+` WHERE `+orderIDColumn+` = $1
+		RETURNING `+orderIDColumn, expiredID).Scan(&orderID)
+	if err != nil {
+		return 0, false, err
+	}
+	return orderID, true, tx.Commit()
+}
+
+// customerRepeat handles "repeat", starting a new cart with the items of
+// the customer's latest order if it expired.
+func customerRepeat(cc *commandContext, sender string, _ []string) string {
+	if _, _, open, err := openOrder(cc.db, sender); err != nil {
+		return cc.apology(incidentOrderLookup, sender, 0, err, "Repeat order: reading the cart",
+			"Sorry, something went wrong looking up your order. Please try again.")
+	} else if open {
+		return "You already have a cart going. Send \"edit\" to see it."
+	}
+	order, found, err := latestOrder(cc.db, sender)
+	if err != nil {
+		return cc.apology(incidentOrderLookup, sender, 0, err, "Repeat order: reading the latest order",
+			"Sorry, something went wrong looking up your order. Please try again.")
+	}
+	if !found || order.Status != statusExpired {
+		return "You don't have an expired order to repeat."
+	}
+	lines, err := orderItems(cc.db, order.ID)
+	if err != nil || len(lines) == 0 {
+		if err != nil {
+			log.Printf("Repeat order: reading order %d failed: %v", order.ID, err)
+		}
+		return "You don't have an expired order to repeat."
+	}
+
+	orderID, repeated, err := repeatOrder(cc.db, sender, order.ID)
+	if err != nil {
+		return cc.apology(incidentRepeatOrder, sender, order.ID, err, "Repeat order: copying the order",
+			"Sorry, something went wrong repeating your order. Please try again.")
+	}
+	if !repeated {
+		return "You don't have an expired order to repeat."
+	}
+	log.Printf("Expired order %d repeated as order %d for %s", order.ID, orderID, sender)
+	vp := cc.prclist.Snapshot().ForTier(customerTier(cc.db, sender))
+	return "Your order is back in your cart:\n\n" + cartSummary(cc.db, vp, orderID, lines) +
+		"\n\nSend \"edit\" to change it, or check out as usual."
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOrderExpiryConfig(t *testing.T) {
+	tests := []struct {
+		env     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 48 * time.Hour, false},
+		{"2h", 2 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"0", 0, false},
+		{"-1h", 0, true},
+		{"two days", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.env, func(t *testing.T) {
+			t.Setenv("HOMEBASEURL", "https://shop.example.com")
+			t.Setenv("ORDER_EXPIRY", tt.env)
+			rc, err := loadRuntimeConfig()
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "ORDER_EXPIRY") {
+					t.Fatalf("err = %v, want one about ORDER_EXPIRY", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rc.OrderExpiry != tt.want {
+				t.Errorf("OrderExpiry = %s, want %s", rc.OrderExpiry, tt.want)
+			}
+		})
+	}
+}
+
+// TestOrderExpirySweep ticks the scheduler on a fake clock and checks the
+// expiry sweep runs every orderExpirySweep, and never over a run that is
+// still going.
+func TestOrderExpirySweep(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	ran := make(chan struct{}, 1)
+	release := make(chan struct{})
+	s := newScheduler(nil, []job{{Name: "order-expiry", Schedule: every(orderExpirySweep), EveryInstance: true,
+		Run: func(context.Context) error {
+			ran <- struct{}{}
+			<-release
+			return nil
+		}}})
+	s.started = start
+
+	tests := []struct {
+		name    string
+		at      time.Duration // after start
+		release bool          // let the run started before finish first
+		runs    bool
+	}{
+		{"not due yet", 5 * time.Minute, false, false},
+		{"due", orderExpirySweep, false, true},
+		{"still running", 3 * orderExpirySweep, false, false},
+		{"not due again yet", orderExpirySweep + 5*time.Minute, true, false},
+		{"due again", 2 * orderExpirySweep, false, true},
+	}
+	for _, tt := range tests {
+		if tt.release {
+			release <- struct{}{}
+			waitIdle(t, s)
+		}
+		s.tick(start.Add(tt.at))
+		select {
+		case <-ran:
+			if !tt.runs {
+				t.Errorf("%s: ran at %s", tt.name, tt.at)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if tt.runs {
+				t.Errorf("%s: didn't run at %s", tt.name, tt.at)
+			}
+		}
+	}
+	close(release)
+	waitIdle(t, s)
+}
+
+func waitIdle(t *testing.T, s *scheduler) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Status()[0].Running {
+		if time.Now().After(deadline) {
+			t.Fatal("the job didn't finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestOrderExpiryDisabled(t *testing.T) {
+	withRuntimeConfig(t, &RuntimeConfig{OrderExpiry: 0})
+	// With no database behind it, anything but returning at once panics.
+	if err := expireOrders(&commandContext{}, time.Now()); err != nil {
+		t.Errorf("expireOrders = %v, want nil", err)
+	}
+}
+
+func TestExpiredOrderAfterwards(t *testing.T) {
+	expired := orderSummary{ID: 42, Status: statusExpired}
+	if !expired.finished() {
+		t.Error("an expired order still takes an ETA")
+	}
+	if reply := statusReplies[statusExpired]; !strings.Contains(reply, `"repeat"`) {
+		t.Errorf("status reply %q doesn't offer repeat", reply)
+	}
+	// A payment for it arriving late needs someone to refund or reinstate it.
+	if action, err := notificationAction(expired, OrderData{PaymentStatus: pfComplete, AmountGross: "100.00"}); action != itnIgnore || err == nil {
+		t.Errorf("late payment = %d, %v; want it ignored and sent to a human", action, err)
+	}
+}
+
+type fakeRepeatOrder struct {
+	cell, items, total string
+	status             string // "" until order_meta has a row
+	open               bool
+}
+
+// fakeRepeatDB holds orders and payment notifications, answering the
+// statements repeatOrder and the payment pipeline make.
+type fakeRepeatDB struct {
+	orders        map[int64]*fakeRepeatOrder
+	notifications map[int64]string // id to state
+	deadLetters   []string
+}
+
+func (db *fakeRepeatDB) Open(string) (driver.Conn, error) { return fakeRepeatConn{db}, nil }
+
+type fakeRepeatConn struct{ db *fakeRepeatDB }
+
+func (c fakeRepeatConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fake repeat db: prepare not supported")
+}
+func (c fakeRepeatConn) Close() error              { return nil }
+func (c fakeRepeatConn) Begin() (driver.Tx, error) { return c, nil }
+func (c fakeRepeatConn) Commit() error             { return nil }
+func (c fakeRepeatConn) Rollback() error           { return nil }
+
+func (c fakeRepeatConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	arg := func(i int) any { return args[i].Value }
+	rows := &fakeRepeatRows{}
+	switch {
+	case strings.Contains(query, "FOR UPDATE OF o"):
+		if o, ok := c.db.orders[arg(0).(int64)]; ok {
+			rows.add(o.status)
+		}
+	case strings.Contains(query, "SELECT COUNT(*) FROM "+orderTable):
+		n := int64(0)
+		for _, o := range c.db.orders {
+			if o.cell == arg(0) && o.open {
+				n++
+			}
+		}
+		rows.add(n)
+	case strings.Contains(query, "INSERT INTO "+orderTable):
+		from := c.db.orders[arg(0).(int64)]
+		id := int64(0)
+		for existing := range c.db.orders {
+			id = max(id, existing+1)
+		}
+		c.db.orders[id] = &fakeRepeatOrder{cell: from.cell, items: from.items, total: from.total, open: true}
+		rows.add(id)
+	case strings.Contains(query, "SELECT payfast_mode FROM order_meta"):
+	case strings.HasPrefix(query, orderSummaryQuery):
+		id := arg(0).(int64)
+		if o, ok := c.db.orders[id]; ok {
+			status := o.status
+			if status == "" {
+				status = statusUnpaid
+			}
+			rows.add(id, "", o.cell, o.total, status, nil)
+		}
+	case strings.Contains(query, "FROM dead_letters WHERE state = 'open'"):
+		// One is already open, so the new one doesn't message the admin.
+		rows.add(int64(1))
+	case strings.Contains(query, "INSERT INTO dead_letters"):
+		c.db.deadLetters = append(c.db.deadLetters, arg(1).(string))
+		rows.add(int64(len(c.db.deadLetters)))
+	default:
+		return nil, errors.New("fake repeat db: unexpected query")
+	}
+	return rows, nil
+}
+
+func (c fakeRepeatConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	switch {
+	case strings.Contains(query, "SET attempts = attempts + 1"), strings.Contains(query, "INSERT INTO incidents"):
+	case strings.Contains(query, "UPDATE payment_notifications SET state = 'dead'"):
+		c.db.notifications[args[0].Value.(int64)] = "dead"
+	case strings.Contains(query, "UPDATE payment_notifications SET state = 'processed'"):
+		c.db.notifications[args[0].Value.(int64)] = "processed"
+	default:
+		return nil, errors.New("fake repeat db: unexpected statement")
+	}
+	return driver.RowsAffected(1), nil
+}
+
+type fakeRepeatRows struct{ rows [][]driver.Value }
+
+func (r *fakeRepeatRows) add(values ...driver.Value) { r.rows = append(r.rows, values) }
+func (r *fakeRepeatRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return []string{"value"}
+	}
+	return make([]string, len(r.rows[0]))
+}
+func (r *fakeRepeatRows) Close() error { return nil }
+func (r *fakeRepeatRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// TestRepeatOrder repeats an expired order and then has its old payment
+// link paid: the ITN goes to the dead letters and neither order changes.
+func TestRepeatOrder(t *testing.T) {
+	fake := &fakeRepeatDB{}
+	sql.Register("fakerepeat", fake)
+	db, err := sql.Open("fakerepeat", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	const cell = "27821234567"
+	items := `[{"CatalogueItemID":7,"Quantity":2}]`
+	reset := func() {
+		*fake = fakeRepeatDB{
+			orders: map[int64]*fakeRepeatOrder{
+				42: {cell: cell, items: items, total: "100.00", status: statusExpired},
+				43: {cell: "27829999999", items: items, total: "100.00", status: statusPaid},
+			},
+			notifications: map[int64]string{},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		prepare  func()
+		orderID  int64
+		repeated bool
+	}{
+		{name: "expired order", orderID: 42, repeated: true},
+		{name: "cart already started", orderID: 42, prepare: func() {
+			fake.orders[50] = &fakeRepeatOrder{cell: cell, items: "[]", total: "0", open: true}
+		}},
+		{name: "paid order", orderID: 43},
+		{name: "no such order", orderID: 99},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reset()
+			if tt.prepare != nil {
+				tt.prepare()
+			}
+			before := len(fake.orders)
+			newID, repeated, err := repeatOrder(db, cell, tt.orderID)
+			if err != nil || repeated != tt.repeated {
+				t.Fatalf("repeatOrder = %d, %v, %v; want repeated %v", newID, repeated, err, tt.repeated)
+			}
+			if !repeated {
+				if len(fake.orders) != before {
+					t.Errorf("made an order anyway")
+				}
+				return
+			}
+			copied := fake.orders[newID]
+			if newID == tt.orderID || copied == nil || !copied.open || copied.items != items || copied.cell != cell || copied.status != "" {
+				t.Errorf("new order %d = %+v, want an open copy of %d", newID, copied, tt.orderID)
+			}
+			if old := fake.orders[tt.orderID]; old.status != statusExpired || old.open {
+				t.Errorf("order %d became %+v, want it left expired", tt.orderID, old)
+			}
+		})
+	}
+
+	t.Run("late payment for the expired order", func(t *testing.T) {
+		reset()
+		withRuntimeConfig(t, &RuntimeConfig{})
+		newID, repeated, err := repeatOrder(db, cell, 42)
+		if err != nil || !repeated {
+			t.Fatalf("repeatOrder = %v, %v", repeated, err)
+		}
+		cc := &commandContext{db: db}
+		cc.incidents = newIncidentLog(cc)
+		fake.notifications[7] = "pending"
+		newPaymentPipeline(cc).process(7, "m_payment_id=42&pf_payment_id=pf-9&payment_status=COMPLETE&item_name=Order+42&amount_gross=100.00", true)
+		if fake.notifications[7] != "dead" || len(fake.deadLetters) != 1 || !strings.Contains(fake.deadLetters[0], "expired") {
+			t.Errorf("notification %s, dead letters %q; want one about the expired order", fake.notifications[7], fake.deadLetters)
+		}
+		if old := fake.orders[42]; old.status != statusExpired {
+			t.Errorf("order 42 became %+v, want it left expired", old)
+		}
+		if repeat := fake.orders[newID]; repeat.status != "" || !repeat.open {
+			t.Errorf("repeat order %d became %+v, want it still a cart", newID, repeat)
+		}
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// An order's reference is what the customer sees wherever the order is
+// mentioned: ORDER_REF_PREFIX, the year it was created in the business
+// timezone and the order number, e.g. PIG-2024-0042. The order number makes
+// it unique within a deployment; the year only has to read well, so it is
+// fixed in order_meta when the order is created, and a reference is only
+// ever looked up as stored. Customers retype references however they like,
+// so "pig20240042" and "PIG 2024 42" find the same order.
+
+var (
+	orderRefPrefixPattern = regexp.MustCompile(`^[A-Z]{2,6}$`)
+	orderRefPattern       = regexp.MustCompile(`^([A-Z]{2,6})(\d{4})(\d+)$`)
+)
+
+var (
+	errNotOrderRef     = errors.New("expected an order number or reference")
+	errUnknownOrderRef = errors.New("no order has that reference")
+)
+
+// validateOrderRefPrefix checks ORDER_REF_PREFIX is 2 to 6 capital letters.
+func validateOrderRefPrefix(prefix string) error {
+	if !orderRefPrefixPattern.MatchString(prefix) {
+		return fmt.Errorf("ORDER_REF_PREFIX must be 2 to 6 letters, got %q", prefix)
+	}
+	return nil
+}
+
+// formatOrderRef is the reference of an order created at t.
+func formatOrderRef(prefix string, t time.Time, orderID int64) string {
+	return fmt.Sprintf("%s-%d-%04d", prefix, t.In(cfg().BusinessHours.Location).Year(), orderID)
+}
+
+// parseOrderRef returns the canonical form of a reference and the order
+// number in it. Case, hyphens, spaces, a leading '#' and zero padding are
+// ignored.
+func parseOrderRef(s string) (string, int64, bool) {
+	s = strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' || r == '#' {
+			return -1
+		}
+		return r
+	}, strings.ToUpper(s))
+	m := orderRefPattern.FindStringSubmatch(s)
+	if m == nil {
+		return "", 0, false
+	}
+	orderID, err := strconv.ParseInt(m[3], 10, 64)
+	if err != nil || orderID == 0 {
+		return "", 0, false
+	}
+	return fmt.Sprintf("%s-%s-%04d", m[1], m[2], orderID), orderID, true
+}
+
+// assignOrderRef gives a new order its reference and returns it. An order
+// that already has one keeps it.
+func assignOrderRef(db dbtx, prefix string, orderID int64) (string, error) {
+	var ref string
+	err := db.QueryRow(`INSERT INTO order_meta (order_id, pricelist_version, order_ref) VALUES ($1, 0, $2)
+		ON CONFLICT (order_id) DO UPDATE SET order_ref = COALESCE(order_meta.order_ref, EXCLUDED.order_ref)
+		RETURNING order_ref`, orderID, formatOrderRef(prefix, time.Now(), orderID)).Scan(&ref)
+	return ref, err
+}
+
+// backfillOrderRefs gives orders from before references existed theirs,
+// dated when they were checked out or last touched.
+func backfillOrderRefs(db *sql.DB, prefix string) error {
+	rows, err := db.Query(`SELECT o.` + orderIDColumn + `, COALESCE(m.checked_out_at, m.updated_at, now())
+		FROM ` + orderTable + ` o LEFT JOIN order_meta m ON m.order_id = o.` + orderIDColumn + `
+		WHERE m.order_ref IS NULL`)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		id int64
+		at time.Time
+	}
+	var orders []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.at); err != nil {
+			rows.Close()
+			return err
+		}
+		orders = append(orders, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, p := range orders {
+		if _, err := db.Exec(`INSERT INTO order_meta (order_id, pricelist_version, order_ref) VALUES ($1, 0, $2)
+			ON CONFLICT (order_id) DO UPDATE SET order_ref = EXCLUDED.order_ref WHERE order_meta.order_ref IS NULL`,
+			p.id, formatOrderRef(prefix, p.at, p.id)); err != nil {
+			return fmt.Errorf("order %d: %w", p.id, err)
+		}
+	}
+	if len(orders) > 0 {
+		log.Printf("Gave %d existing orders a reference", len(orders))
+	}
+	return nil
+}
+
+// reference is how the order is named to customers.
+func (o orderSummary) reference() string {
+	if o.Ref != "" {
+		return o.Ref
+	}
+	return strconv.FormatInt(o.ID, 10)
+}
+
+// orderRef is the reference of an order known only by its number, given
+// one on the spot if it has none. It falls back to the number, so a
+// message can always go out.
+func (cc *commandContext) orderRef(orderID int64) string {
+	ref, err := storedOrderRef(cc.db, orderID)
+	if err == nil && ref == "" {
+		ref, err = assignOrderRef(cc.db, cc.envVars.OrderRefPrefix, orderID)
+	}
+	if err != nil {
+		log.Printf("Reading the reference of order %d failed: %v", orderID, err)
+		return strconv.FormatInt(orderID, 10)
+	}
+	return ref
+}
+
+// storedOrderRef is the order's reference, "" while it has none.
+func storedOrderRef(db dbtx, orderID int64) (string, error) {
+	var ref sql.NullString
+	err := db.QueryRow(`SELECT order_ref FROM order_meta WHERE order_id = $1`, orderID).Scan(&ref)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return ref.String, err
+}
+
+// resolveOrderArg returns the order an argument names, by number as
+// before or by reference.
+func resolveOrderArg(db *sql.DB, s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if orderID, err := strconv.ParseInt(strings.TrimPrefix(s, "#"), 10, 64); err == nil {
+		return orderID, nil
+	}
+	ref, _, ok := parseOrderRef(s)
+	if !ok {
+		return 0, errNotOrderRef
+	}
+	var orderID int64
+	err := db.QueryRow(`SELECT order_id FROM order_meta WHERE order_ref = $1`, ref).Scan(&orderID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errUnknownOrderRef
+	}
+	return orderID, err
+}
+
+// orderArgError is an admin command's reply to an order argument it
+// couldn't resolve.
+func orderArgError(err error, usage string) string {
+	switch {
+	case errors.Is(err, errNotOrderRef):
+		return usage
+	case errors.Is(err, errUnknownOrderRef):
+		return "No order has that reference."
+	}
+	return fmt.Sprintf("Looking up the order failed: %v", err)
+}
+
+// orderIDParam reads the {orderID} of an API route, which may also be a
+// reference. It has answered the request when ok is false.
+func orderIDParam(w http.ResponseWriter, r *http.Request, db *sql.DB) (orderID int64, ok bool) {
+	orderID, err := resolveOrderArg(db, chi.URLParam(r, "orderID"))
+	switch {
+	case errors.Is(err, errNotOrderRef):
+		writeJSONError(w, http.StatusBadRequest, "order ID must be a number or an order reference")
+		return 0, false
+	case errors.Is(err, errUnknownOrderRef):
+		writeJSONError(w, http.StatusNotFound, "no such order")
+		return 0, false
+	case err != nil:
+		log.Printf("Looking up order %q failed: %v", chi.URLParam(r, "orderID"), err)
+		writeJSONError(w, http.StatusInternalServerError, "reading order failed")
+		return 0, false
+	}
+	return orderID, true
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Order lifecycle as tracked in order_meta. Orders without a row there are
+// unpaid.
+const (
+	statusUnpaid    = "unpaid"
+	statusPaid      = "paid"
+	statusPreparing = "preparing"
+	statusReady     = "ready"
+	statusCollected = "collected"
+	statusDelivered = "delivered"
+	statusCancelled = "cancelled"
+	// statusDisputed marks a paid order whose payment PayFast reversed.
+	statusDisputed = "disputed"
+	// statusExpired marks an order left unpaid past ORDER_EXPIRY.
+	statusExpired = "expired"
+)
+
+// statusRank orders the forward progression of an order so "preparing or
+// later" checks don't need to list every state. Cancelled, disputed and
+// expired orders are outside it.
+var statusRank = map[string]int{
+	statusUnpaid:    0,
+	statusPaid:      1,
+	statusPreparing: 2,
+	statusReady:     3,
+	statusCollected: 4,
+	statusDelivered: 4,
+}
+
+// orderSummary converts to httpapi.Order, so the two keep the same fields.
+type orderSummary struct {
+	ID int64 `json:"id"`
+	// Ref is the reference customers know the order by, see Order_Ref.go.
+	Ref        string     `json:"ref"`
+	CellNumber string     `json:"cell_number"`
+	Total      string     `json:"total"`
+	Status     string     `json:"status"`
+	PaidAt     *time.Time `json:"paid_at,omitempty"`
+}
+
+// orderEvent is the data of order.created and order.paid events.
+type orderEvent struct {
+	OrderID    int64  `json:"order_id"`
+	OrderRef   string `json:"order_ref"`
+	CellNumber string `json:"cell_number"`
+	Amount     string `json:"amount,omitempty"`
+}
+
+// orderStatusEvent is the data of order.status_changed events. Payment is
+// reported as order.paid instead.
+type orderStatusEvent struct {
+	OrderID    int64  `json:"order_id"`
+	OrderRef   string `json:"order_ref"`
+	CellNumber string `json:"cell_number"`
+	From       string `json:"from"`
+	To         string `json:"to"`
+}
+
+// orderPaid runs once an order has been marked paid, whichever way the
+// payment came in.
+func (cc *commandContext) orderPaid(orderID int64, cellNumber, amount string) {
+	ref := cc.orderRef(orderID)
+	cc.events.Emit(eventOrderPaid, orderEvent{OrderID: orderID, OrderRef: ref, CellNumber: cellNumber, Amount: amount})
+	cc.sender.SendOrder(cellNumber, fmt.Sprintf("Payment received for order %s, thank you! Send \"status\" any time to see where it is.", ref), priorityNotify, orderID)
+	// A gift's pick list waits until the recipient has said where it goes.
+	if !cc.notifyGift(orderID) {
+		cc.sendPickList(orderID)
+	}
+}
+
+// atOrPast reports whether the order has progressed to status or beyond.
+// Cancelled and disputed orders are outside the progression and never
+// match.
+func (o orderSummary) atOrPast(status string) bool {
+	rank, ok := statusRank[o.Status]
+	return ok && rank >= statusRank[status]
+}
+
+const orderSummaryQuery = `SELECT o.` + orderIDColumn + `, COALESCE(m.order_ref, ''), o.` + orderCellColumn + `, COALESCE(o.` + orderTotalColumn + `::text, ''),
+		COALESCE(m.status, '` + statusUnpaid + `'), m.paid_at
+	FROM ` + orderTable + ` o LEFT JOIN order_meta m ON m.order_id = o.` + orderIDColumn
+
+func scanOrderSummary(row *sql.Row) (orderSummary, bool, error) {
+	o, err := readOrderSummary(row.Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return orderSummary{}, false, nil
+	}
+	if err != nil {
+		return orderSummary{}, false, err
+	}
+	return o, true, nil
+}
+
+func readOrderSummary(scan func(dest ...any) error) (orderSummary, error) {
+	var o orderSummary
+	var paidAt sql.NullTime
+	if err := scan(&o.ID, &o.Ref, &o.CellNumber, &o.Total, &o.Status, &paidAt); err != nil {
+		return orderSummary{}, err
+	}
+	if paidAt.Valid {
+		o.PaidAt = &paidAt.Time
+	}
+	return o, nil
+}
+
+// listOrders runs orderSummaryQuery with the given WHERE and ORDER BY
+// clauses.
+func listOrders(db *sql.DB, clauses string, args ...any) ([]orderSummary, error) {
+	rows, err := db.Query(orderSummaryQuery+clauses, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orders := []orderSummary{}
+	for rows.Next() {
+		o, err := readOrderSummary(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+func getOrder(db *sql.DB, orderID int64) (orderSummary, bool, error) {
+	return scanOrderSummary(db.QueryRow(orderSummaryQuery+` WHERE o.`+orderIDColumn+` = $1`, orderID))
+}
+
+// latestOrder returns the customer's most recent order in any state.
+func latestOrder(db *sql.DB, cellNumber string) (orderSummary, bool, error) {
+	return scanOrderSummary(db.QueryRow(orderSummaryQuery+` WHERE o.`+orderCellColumn+` = $1
+		ORDER BY o.`+orderIDColumn+` DESC LIMIT 1`, cellNumber))
+}
+
+// markOrderPaid moves an unpaid order to paid and reports whether it did.
+// Repeated notifications for an order that is already paid (or further
+// along) are no-ops.
+func markOrderPaid(db dbtx, orderID int64, pfPaymentID, payfastMode string) (bool, error) {
+	res, err := db.Exec(`INSERT INTO order_meta (order_id, pricelist_version, status, paid_at, pf_payment_id, payfast_mode, payment_mode)
+		VALUES ($1, 0, $2, now(), $3, $5, $5)
+		ON CONFLICT (order_id) DO UPDATE SET status = EXCLUDED.status, paid_at = EXCLUDED.paid_at,
+			pf_payment_id = EXCLUDED.pf_payment_id, payment_mode = EXCLUDED.payment_mode, updated_at = now()
+		WHERE order_meta.status = $4`,
+		orderID, statusPaid, pfPaymentID, statusUnpaid, payfastMode)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// transitionOrder sets the order's status to `to` if it is currently in one
+// of `from`. It reports whether the transition happened, so concurrent
+// updates can't both win.
+func transitionOrder(db dbtx, orderID int64, to string, from ...string) (bool, error) {
+	placeholders := make([]string, len(from))
+	args := []any{orderID, to}
+	fromUnpaid := false
+	for i, status := range from {
+		placeholders[i] = fmt.Sprintf("$%d", i+3)
+		args = append(args, status)
+		fromUnpaid = fromUnpaid || status == statusUnpaid
+	}
+
+	res, err := db.Exec(`UPDATE order_meta SET status = $2, updated_at = now()
+		WHERE order_id = $1 AND status IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+	if err != nil {
+		return false, err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return n > 0, err
+	}
+	if !fromUnpaid {
+		return false, nil
+	}
+
+	// No order_meta row yet means the order is implicitly unpaid.
+	res, err = db.Exec(`INSERT INTO order_meta (order_id, pricelist_version, status) VALUES ($1, 0, $2)
+		ON CONFLICT (order_id) DO NOTHING`, orderID, to)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// closeOrder marks the order closed in MenuBotLib's table, releasing the
+// customer's cart.
+func closeOrder(db dbtx, orderID int64) error {
+	_, err := db.Exec(`UPDATE `+orderTable+` SET `+orderClosedSet+` WHERE `+orderIDColumn+` = $1`, orderID)
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+)
+
+// MenuBotLib owns the order table; these are the only columns the web API
+// relies on, kept in one place so a library schema change is a one-file fix.
+const (
+	orderTable       = "customerorder"
+	orderIDColumn    = "orderid"
+	orderCellColumn  = "cellnumber"
+	orderItemsColumn = "orderitems"
+	orderTotalColumn = "ordertotal"
+	// orderSourceColumn is ours, added for the website, see Web_Orders.go.
+	orderSourceColumn = "source"
+	orderOpenFilter   = "isclosed = false"
+	orderOpenSet      = "isclosed = false"
+	orderClosedSet    = "isclosed = true"
+)
+
+// orderLine is one cart line as MenuBotLib serializes it into the order
+// items column.
+type orderLine struct {
+	ItemID   int `json:"CatalogueItemID"`
+	Quantity int `json:"Quantity"`
+}
+
+func decodeOrderLines(items string) ([]orderLine, error) {
+	if items == "" {
+		return nil, nil
+	}
+	var lines []orderLine
+	if err := json.Unmarshal([]byte(items), &lines); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// openOrder returns the customer's current open order (their cart), if any.
+func openOrder(db *sql.DB, cellNumber string) (orderID int64, items string, found bool, err error) {
+	err = db.QueryRow(
+		`SELECT `+orderIDColumn+`, COALESCE(`+orderItemsColumn+`::text, '') FROM `+orderTable+
+			` WHERE `+orderCellColumn+` = $1 AND `+orderOpenFilter+
+			` ORDER BY `+orderIDColumn+` DESC LIMIT 1`, cellNumber).Scan(&orderID, &items)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, "", false, nil
+	}
+	if err != nil {
+		return 0, "", false, err
+	}
+	return orderID, items, true, nil
+}
+
+// orderItems returns the cart lines of any order, open or closed.
+func orderItems(db *sql.DB, orderID int64) ([]orderLine, error) {
+	var items string
+	err := db.QueryRow(`SELECT COALESCE(`+orderItemsColumn+`::text, '') FROM `+orderTable+
+		` WHERE `+orderIDColumn+` = $1`, orderID).Scan(&items)
+	if err != nil {
+		return nil, err
+	}
+	return decodeOrderLines(items)
+}
+
+// stampPricelistVersion records which pricelist version the order's items
+// were last quoted against.
+func stampPricelistVersion(db dbtx, orderID, version int64, payfastMode string) error {
+	_, err := db.Exec(`INSERT INTO order_meta (order_id, pricelist_version, payfast_mode) VALUES ($1, $2, $3)
+		ON CONFLICT (order_id) DO UPDATE SET pricelist_version = EXCLUDED.pricelist_version,
+			payfast_mode = CASE WHEN order_meta.payfast_mode = '' THEN EXCLUDED.payfast_mode ELSE order_meta.payfast_mode END,
+			updated_at = now()`,
+		orderID, version, payfastMode)
+	return err
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const listOrdersLimit = 200
+
+// ListOrdersHandler lists the most recent orders in the status given by
+// ?status=, e.g. ?status=disputed.
+func ListOrdersHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := r.URL.Query().Get("status")
+		if _, ok := statusReplies[status]; !ok {
+			writeJSONError(w, http.StatusBadRequest, "status must be one of the order statuses, e.g. disputed")
+			return
+		}
+		orders, err := listOrders(db, ` WHERE COALESCE(m.status, '`+statusUnpaid+`') = $1
+			ORDER BY o.`+orderIDColumn+` DESC LIMIT $2`, status, listOrdersLimit)
+		if err != nil {
+			log.Printf("Listing %s orders failed: %v", status, err)
+			writeJSONError(w, http.StatusInternalServerError, "listing orders failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, orders)
+	}
+}
+
+type orderResponse struct {
+	orderSummary
+	Lines          []orderLineDetail `json:"lines"`
+	Communications []outboundRecord  `json:"communications"`
+	// DeliveryContact is who the drivers hand the order to, when it isn't
+	// the customer.
+	DeliveryContact *deliveryContact `json:"delivery_contact,omitempty"`
+}
+
+// GetOrderHandler returns an order, its lines and the timeline of messages
+// we sent about it.
+func GetOrderHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderID, ok := orderIDParam(w, r, db)
+		if !ok {
+			return
+		}
+		order, found, err := getOrder(db, orderID)
+		if err != nil {
+			log.Printf("Reading order %d failed: %v", orderID, err)
+			writeJSONError(w, http.StatusInternalServerError, "reading order failed")
+			return
+		}
+		if !found {
+			writeJSONError(w, http.StatusNotFound, "no such order")
+			return
+		}
+		lines, err := orderItems(db, orderID)
+		if err != nil {
+			log.Printf("Reading items of order %d failed: %v", orderID, err)
+			writeJSONError(w, http.StatusInternalServerError, "reading order failed")
+			return
+		}
+		quoted, err := orderQuotedPrices(db, orderID)
+		if err != nil {
+			log.Printf("Reading quoted prices of order %d failed: %v", orderID, err)
+			writeJSONError(w, http.StatusInternalServerError, "reading order failed")
+			return
+		}
+		codes, err := orderItemCodes(db, orderID)
+		if err != nil {
+			log.Printf("Reading item codes of order %d failed: %v", orderID, err)
+			writeJSONError(w, http.StatusInternalServerError, "reading order failed")
+			return
+		}
+		comms, err := orderCommunications(db, orderID)
+		if err != nil {
+			log.Printf("Reading communications for order %d failed: %v", orderID, err)
+			writeJSONError(w, http.StatusInternalServerError, "reading order failed")
+			return
+		}
+		resp := orderResponse{
+			orderSummary:   order,
+			Lines:          orderLineDetails(prclist.Snapshot(), lines, quoted),
+			Communications: comms,
+		}
+		// The codes the items had when ordered, not any they have since.
+		for i, line := range resp.Lines {
+			if code, ok := codes[strconv.Itoa(line.ItemID)]; ok {
+				resp.Lines[i].Code = code
+			}
+		}
+		if contact, found, err := getDeliveryContact(db, orderID); err != nil {
+			log.Printf("Reading delivery contact of order %d failed: %v", orderID, err)
+			writeJSONError(w, http.StatusInternalServerError, "reading order failed")
+			return
+		} else if found {
+			resp.DeliveryContact = &contact
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
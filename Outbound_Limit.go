@@ -0,0 +1,148 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// sendPriority orders waiting sends when the outbound limiter is saturated.
+// Lower values go first, so a broadcast can never starve a customer reply.
+type sendPriority int
+
+const (
+	priorityReply  sendPriority = iota // direct answers to an inbound message
+	priorityNotify                     // confirmations and status updates
+	priorityBulk                       // broadcasts and reminders
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"reply", "notify", "bulk"}
+
+// outboundLimiter gates every message we send. Wait blocks until the
+// message may go out.
+type outboundLimiter interface {
+	Wait(p sendPriority)
+}
+
+// noLimit lets everything through, for tests and setups that don't want
+// throttling.
+type noLimit struct{}
+
+func (noLimit) Wait(sendPriority) {}
+
+// tokenBucket is a global token bucket shared by all send paths. Its rate
+// and burst are read from cfg() on every refill, so a reload takes effect
+// immediately; an OUTBOUND_RATE of 0 disables throttling.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	queues [numPriorities][]chan struct{}
+	wake   chan struct{}
+}
+
+func newTokenBucket() *tokenBucket {
+	b := &tokenBucket{
+		tokens: float64(cfg().OutboundBurst),
+		last:   time.Now(),
+		wake:   make(chan struct{}, 1),
+	}
+	for p := sendPriority(0); p < numPriorities; p++ {
+		p := p
+		metrics.GaugeFunc("menubot_outbound_queue_depth", "Sends waiting for an outbound token.", func() float64 {
+			return float64(b.QueueDepth(p))
+		}, "priority", priorityNames[p])
+	}
+	metrics.GaugeFunc("menubot_outbound_tokens", "Outbound tokens currently available.", b.Tokens)
+	go b.run()
+	return b
+}
+
+// refillLocked adds the tokens earned since the last refill. It reports
+// false when throttling is disabled.
+func (b *tokenBucket) refillLocked(now time.Time) bool {
+	rc := cfg()
+	if rc.OutboundRate <= 0 {
+		return false
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rc.OutboundRate
+	if burst := float64(max(rc.OutboundBurst, 1)); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	return true
+}
+
+func (b *tokenBucket) Wait(p sendPriority) {
+	b.mu.Lock()
+	waiting := false
+	for _, q := range b.queues {
+		waiting = waiting || len(q) > 0
+	}
+	if !waiting {
+		if !b.refillLocked(time.Now()) {
+			b.mu.Unlock()
+			return
+		}
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return
+		}
+	}
+	ready := make(chan struct{})
+	b.queues[p] = append(b.queues[p], ready)
+	b.mu.Unlock()
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	<-ready
+}
+
+// run hands out tokens to queued senders, highest priority first.
+func (b *tokenBucket) run() {
+	for {
+		b.mu.Lock()
+		next := -1
+		for p, q := range b.queues {
+			if len(q) > 0 {
+				next = p
+				break
+			}
+		}
+		if next < 0 {
+			b.mu.Unlock()
+			<-b.wake
+			continue
+		}
+
+		limited := b.refillLocked(time.Now())
+		if !limited || b.tokens >= 1 {
+			if limited {
+				b.tokens--
+			}
+			close(b.queues[next][0])
+			b.queues[next] = b.queues[next][1:]
+			b.mu.Unlock()
+			continue
+		}
+		wait := time.Duration((1 - b.tokens) / cfg().OutboundRate * float64(time.Second))
+		b.mu.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+func (b *tokenBucket) QueueDepth(p sendPriority) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.queues[p])
+}
+
+func (b *tokenBucket) Tokens() float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refillLocked(time.Now())
+	return b.tokens
+}
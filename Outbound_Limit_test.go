@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucketBurst(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		burst   int
+		sends   int
+		maxTime time.Duration
+		minTime time.Duration
+	}{
+		{"disabled", 0, 1, 50, 50 * time.Millisecond, 0},
+		{"within the burst", 1, 5, 5, 50 * time.Millisecond, 0},
+		{"past the burst", 20, 2, 4, time.Second, 80 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withRuntimeConfig(t, &RuntimeConfig{OutboundRate: tt.rate, OutboundBurst: tt.burst})
+			b := newTokenBucket()
+			start := time.Now()
+			for i := 0; i < tt.sends; i++ {
+				b.Wait(priorityReply)
+			}
+			took := time.Since(start)
+			if took > tt.maxTime || took < tt.minTime {
+				t.Errorf("%d sends took %s, want between %s and %s", tt.sends, took, tt.minTime, tt.maxTime)
+			}
+		})
+	}
+}
+
+func TestTokenBucketPriority(t *testing.T) {
+	withRuntimeConfig(t, &RuntimeConfig{OutboundRate: 5, OutboundBurst: 1})
+	b := newTokenBucket()
+	b.Wait(priorityReply) // takes the only token
+
+	order := make(chan sendPriority, 3)
+	queue := func(p sendPriority) {
+		go func() {
+			b.Wait(p)
+			order <- p
+		}()
+		deadline := time.Now().Add(time.Second)
+		for b.QueueDepth(p) == 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("the %s send never queued", priorityNames[p])
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	queue(priorityBulk)
+	queue(priorityNotify)
+	queue(priorityReply)
+
+	for _, want := range []sendPriority{priorityReply, priorityNotify, priorityBulk} {
+		select {
+		case got := <-order:
+			if got != want {
+				t.Fatalf("%s went before %s", priorityNames[got], priorityNames[want])
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("the %s send never went", priorityNames[want])
+		}
+	}
+}
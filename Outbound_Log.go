@@ -0,0 +1,220 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Every message we send is in the outbound log with how far it got:
+// queued while the outbox holds it, sent once WhatsApp took it, then
+// delivered and read as the recipient's receipts come in, or failed when
+// the outbox gives up or WhatsApp's server reports it undeliverable. A
+// queued message is logged under a placeholder ID until it is sent and
+// gets WhatsApp's. States only move forward, and failed is final: a
+// receipt arriving for a failed message is logged as an anomaly and
+// changes nothing, so support never sees a failure quietly disappear.
+
+// Delivery states, in the order a message reaches them.
+const (
+	deliveryQueued    = "queued"
+	deliverySent      = "sent"
+	deliveryDelivered = "delivered"
+	deliveryRead      = "read"
+	deliveryFailed    = "failed"
+)
+
+// deliveryFollows lists the states each state may replace.
+var deliveryFollows = map[string][]string{
+	deliverySent:      {deliveryQueued},
+	deliveryDelivered: {deliveryQueued, deliverySent},
+	deliveryRead:      {deliveryQueued, deliverySent, deliveryDelivered},
+	deliveryFailed:    {deliveryQueued, deliverySent},
+}
+
+// Kinds of message a human has to follow up by phone when they fail.
+const (
+	outboundPaymentLink = "payment_link"
+	outboundOrderReady  = "order_ready"
+)
+
+// outboundRecord is a sent message as kept in outbound_messages.
+type outboundRecord struct {
+	MessageID     string    `json:"message_id"`
+	Recipient     string    `json:"recipient"`
+	Body          string    `json:"body"`
+	ServerTime    time.Time `json:"server_time"`
+	DeliveryState string    `json:"delivery_state"`
+	DeliveryError string    `json:"delivery_error,omitempty"`
+}
+
+// deliveryFailure is a message that ended up failed.
+type deliveryFailure struct {
+	MessageID string
+	Recipient string
+	Kind      string
+	OrderID   int64
+	Reason    string
+}
+
+func nullOrderID(orderID int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: orderID, Valid: orderID != 0}
+}
+
+// outboxMessageID is the placeholder ID of an outbox message in the
+// outbound log.
+func outboxMessageID(outboxID int64) string {
+	return fmt.Sprintf("outbox-%d", outboxID)
+}
+
+// recordQueued logs a message going into the outbox as part of tx. body
+// is already sealed.
+func recordQueued(tx dbtx, outboxID int64, m outboundMessage, body string) error {
+	_, err := tx.Exec(`INSERT INTO outbound_messages (message_id, recipient, body, order_id, server_time, delivery_state, kind)
+		VALUES ($1, $2, $3, $4, now(), $5, $6) ON CONFLICT (message_id) DO NOTHING`,
+		outboxMessageID(outboxID), m.To.String(), body, nullOrderID(m.OrderID), deliveryQueued, m.Kind)
+	return err
+}
+
+// recordOutbound logs a message WhatsApp accepted, keyed by the ID it
+// returned so receipts can later be matched to it. An outbox message takes
+// over its queued entry, which keeps its place in the conversation.
+func recordOutbound(db *sql.DB, m outboundMessage, resp whatsmeow.SendResponse) error {
+	if m.OutboxID != 0 {
+		res, err := db.Exec(`UPDATE outbound_messages SET message_id = $2, delivery_state = $3, delivery_updated_at = now()
+			WHERE message_id = $1 AND delivery_state = $4`, outboxMessageID(m.OutboxID), resp.ID, deliverySent, deliveryQueued)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			return nil
+		}
+	}
+	serverTime := resp.Timestamp
+	if serverTime.IsZero() {
+		serverTime = time.Now()
+	}
+	body, err := sealField(fieldMessageBody, m.Text)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO outbound_messages (message_id, recipient, body, order_id, server_time, delivery_state, kind)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (message_id) DO NOTHING`,
+		resp.ID, m.To.String(), body, nullOrderID(m.OrderID), serverTime, deliverySent, m.Kind)
+	return err
+}
+
+// setDeliveryState moves a logged message on to state, if it may follow
+// the one it is in.
+func (s *messageSender) setDeliveryState(messageID, state, reason string) {
+	var f deliveryFailure
+	var orderID sql.NullInt64
+	err := s.db.QueryRow(`UPDATE outbound_messages SET delivery_state = $2, delivery_error = $4, delivery_updated_at = now()
+		WHERE message_id = $1 AND delivery_state = ANY($3::text[])
+		RETURNING message_id, recipient, kind, order_id`,
+		messageID, state, pq.Array(deliveryFollows[state]), reason).Scan(&f.MessageID, &f.Recipient, &f.Kind, &orderID)
+	if errors.Is(err, sql.ErrNoRows) {
+		var current string
+		err = s.db.QueryRow(`SELECT delivery_state FROM outbound_messages WHERE message_id = $1`, messageID).Scan(&current)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			// Not one of ours, or purged since.
+		case err != nil:
+			log.Printf("Reading delivery state of message %s failed: %v", messageID, err)
+		case current == deliveryFailed && state != deliveryFailed:
+			log.Printf("WARNING: message %s was marked failed but is now reported %s; it stays failed", messageID, state)
+			metrics.Inc("menubot_delivery_state_anomalies_total", "Receipts for messages already marked failed.")
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Marking message %s %s failed: %v", messageID, state, err)
+		return
+	}
+	if state != deliveryFailed {
+		return
+	}
+	metrics.Inc("menubot_messages_failed_total", "Messages that ended up undelivered.", "kind", f.Kind)
+	if s.failed != nil {
+		f.OrderID, f.Reason = orderID.Int64, reason
+		go s.failed(f)
+	}
+}
+
+// receiptStates maps the receipts we act on to the state they report.
+var receiptStates = map[types.ReceiptType]string{
+	types.ReceiptTypeDelivered:   deliveryDelivered,
+	types.ReceiptTypeRead:        deliveryRead,
+	types.ReceiptTypePlayed:      deliveryRead,
+	types.ReceiptTypeServerError: deliveryFailed,
+}
+
+// applyReceipt records what a recipient's receipt says about our messages.
+func (s *messageSender) applyReceipt(r *events.Receipt) {
+	state, ok := receiptStates[r.Type]
+	if !ok || r.IsFromMe {
+		return
+	}
+	reason := ""
+	if state == deliveryFailed {
+		reason = "WhatsApp's server couldn't deliver it"
+	}
+	for _, id := range r.MessageIDs {
+		s.setDeliveryState(id, state, reason)
+	}
+}
+
+// deliveryFailed tells the admin when a payment link or an order-ready
+// message couldn't be delivered, so someone can phone the customer.
+func (cc *commandContext) deliveryFailed(f deliveryFailure) {
+	var what string
+	switch f.Kind {
+	case outboundPaymentLink:
+		what = "payment link"
+	case outboundOrderReady:
+		what = `"order ready" message`
+	default:
+		return
+	}
+	to := f.Recipient
+	if jid, err := types.ParseJID(f.Recipient); err == nil {
+		to = chatCustomerKey(cc.db, jid)
+	}
+	order := "an order"
+	if f.OrderID != 0 {
+		order = "order " + cc.orderRef(f.OrderID)
+	}
+	cc.sender.Send(cc.envVars.AdminNumber, fmt.Sprintf("The %s for %s couldn't be delivered to %s (%s). Please phone them.",
+		what, order, to, f.Reason), priorityNotify)
+}
+
+// orderCommunications lists the messages sent about an order, oldest first.
+func orderCommunications(db *sql.DB, orderID int64) ([]outboundRecord, error) {
+	rows, err := db.Query(`SELECT message_id, recipient, body, server_time, delivery_state, delivery_error FROM outbound_messages
+		WHERE order_id = $1 ORDER BY server_time, created_at`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []outboundRecord{}
+	for rows.Next() {
+		var rec outboundRecord
+		err := rows.Scan(&rec.MessageID, &rec.Recipient, &rec.Body, &rec.ServerTime, &rec.DeliveryState, &rec.DeliveryError)
+		if err == nil {
+			rec.Body, err = openField(fieldMessageBody, rec.Body)
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, rows.Err()
+}
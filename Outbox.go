@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+const (
+	outboxFlushInterval = 30 * time.Second
+	outboxBatchSize     = 50
+	// outboxMaxAttempts bounds how long a transient failure keeps being
+	// retried; with the delays below that is a little over two hours.
+	outboxMaxAttempts = 10
+)
+
+// Outbox states.
+const (
+	outboxPending = "pending"
+	outboxSent    = "sent"
+	outboxFailed  = "failed"
+)
+
+// outboxBacklog is the number of pending outbox rows as of the last flush,
+// kept for /debug/status and metrics without querying on every read.
+var outboxBacklog atomic.Int64
+
+func init() {
+	metrics.GaugeFunc("menubot_outbox_backlog", "Undelivered messages waiting in the outbox.", func() float64 {
+		return float64(outboxBacklog.Load())
+	})
+}
+
+// enqueueOutbox records a message that couldn't be sent. Transient failures
+// stay pending for the flusher; permanent ones are kept for inspection only.
+// Either way the message goes into the outbound log as queued, for the
+// caller to mark failed when it won't be retried.
+func enqueueOutbox(db *sql.DB, m outboundMessage, class sendErrorClass, sendErr error) (int64, error) {
+	state := outboxPending
+	if class == sendPermanent {
+		state = outboxFailed
+	}
+	body, err := sealField(fieldMessageBody, m.Text)
+	if err != nil {
+		return 0, fmt.Errorf("encrypting outbox row: %w", err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var id int64
+	err = tx.QueryRow(`INSERT INTO outbox (recipient, body, state, classification, last_error, attempts, next_attempt_at, priority, order_id)
+		VALUES ($1, $2, $3, $4, $5, 1, now() + $6 * interval '1 second', $7, $8) RETURNING id`,
+		m.To.String(), body, state, class, sendErr.Error(), outboxDelay(1).Seconds(), int(m.Priority), nullOrderID(m.OrderID)).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("inserting outbox row: %w", err)
+	}
+	if err := recordQueued(tx, id, m, body); err != nil {
+		return 0, fmt.Errorf("logging outbox row: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	if state == outboxPending {
+		outboxBacklog.Add(1)
+	}
+	return id, nil
+}
+
+// queueOutbox writes a message into the outbox as part of tx, for
+// messages that must go out if and only if tx commits: deliverQueued sends
+// it once it has. Should that fail, or the process die first, the flusher
+// picks it up after outboxDelay(1).
+func queueOutbox(tx dbtx, m outboundMessage) (int64, error) {
+	body, err := sealField(fieldMessageBody, m.Text)
+	if err != nil {
+		return 0, fmt.Errorf("encrypting outbox row: %w", err)
+	}
+	var id int64
+	err = tx.QueryRow(`INSERT INTO outbox (recipient, body, state, classification, last_error, attempts, next_attempt_at, priority, order_id)
+		VALUES ($1, $2, $3, '', '', 0, now() + $4 * interval '1 second', $5, $6) RETURNING id`,
+		m.To.String(), body, outboxPending, outboxDelay(1).Seconds(), int(m.Priority), nullOrderID(m.OrderID)).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("inserting outbox row: %w", err)
+	}
+	if err := recordQueued(tx, id, m, body); err != nil {
+		return 0, fmt.Errorf("logging outbox row: %w", err)
+	}
+	return id, nil
+}
+
+// deliverQueued sends a message queueOutbox wrote, once its transaction
+// has committed.
+func (s *messageSender) deliverQueued(id int64, m outboundMessage) {
+	row := outboxRow{ID: id, Recipient: m.To.String(), Body: m.Text, Priority: m.Priority, OrderID: m.OrderID}
+	if err := retryOutboxRow(s, row); err != nil {
+		log.Printf("Outbox: updating message %d failed: %v", id, err)
+	}
+}
+
+// outboxDelay is how long to wait after the given number of attempts,
+// doubling from one minute up to half an hour.
+func outboxDelay(attempts int) time.Duration {
+	delay := time.Minute << (attempts - 1)
+	if delay <= 0 || delay > 30*time.Minute {
+		delay = 30 * time.Minute
+	}
+	return delay
+}
+
+type outboxRow struct {
+	ID        int64
+	Recipient string
+	Body      string
+	Attempts  int
+	Priority  sendPriority
+	OrderID   int64
+}
+
+// flushOutbox retries pending outbox messages while WhatsApp is connected
+// and sending isn't disabled.
+func flushOutbox(s *messageSender) error {
+	if !s.client.IsConnected() || s.block.Blocked() {
+		return nil
+	}
+	if err := flushOutboxOnce(s); err != nil {
+		return fmt.Errorf("outbox flush: %w", err)
+	}
+	return nil
+}
+
+func flushOutboxOnce(s *messageSender) error {
+	rows, err := s.db.Query(`SELECT id, recipient, body, attempts, priority, COALESCE(order_id, 0) FROM outbox
+		WHERE state = $1 AND next_attempt_at <= now() ORDER BY id LIMIT $2`, outboxPending, outboxBatchSize)
+	if err != nil {
+		return err
+	}
+	var due []outboxRow
+	for rows.Next() {
+		var row outboxRow
+		if err := rows.Scan(&row.ID, &row.Recipient, &row.Body, &row.Attempts, &row.Priority, &row.OrderID); err != nil {
+			rows.Close()
+			return err
+		}
+		if row.Body, err = openField(fieldMessageBody, row.Body); err != nil {
+			rows.Close()
+			return fmt.Errorf("outbox message %d: %w", row.ID, err)
+		}
+		due = append(due, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, row := range due {
+		if err := retryOutboxRow(s, row); err != nil {
+			log.Printf("Outbox: updating message %d failed: %v", row.ID, err)
+		}
+	}
+
+	var pending int64
+	if err := s.db.QueryRow(`SELECT count(*) FROM outbox WHERE state = $1`, outboxPending).Scan(&pending); err != nil {
+		return err
+	}
+	outboxBacklog.Store(pending)
+	return nil
+}
+
+func retryOutboxRow(s *messageSender, row outboxRow) error {
+	attempts := row.Attempts + 1
+	jid, err := types.ParseJID(row.Recipient)
+	if err == nil {
+		err = s.sendOnce(outboundMessage{To: jid, Text: row.Body, Priority: row.Priority, OrderID: row.OrderID, OutboxID: row.ID})
+	}
+	if err == nil {
+		_, err = s.db.Exec(`UPDATE outbox SET state = $2, attempts = $3, sent_at = now() WHERE id = $1`, row.ID, outboxSent, attempts)
+		return err
+	}
+
+	class := classifySendError(err)
+	state := outboxPending
+	if class == sendPermanent || attempts >= outboxMaxAttempts {
+		state = outboxFailed
+		log.Printf("Outbox: giving up on message %d after %d attempts (%s): %v", row.ID, attempts, class, err)
+	}
+	_, dbErr := s.db.Exec(`UPDATE outbox SET state = $2, classification = $3, last_error = $4, attempts = $5,
+		next_attempt_at = now() + $6 * interval '1 second' WHERE id = $1`,
+		row.ID, state, class, err.Error(), attempts, outboxDelay(attempts).Seconds())
+	if dbErr == nil && state == outboxFailed {
+		s.setDeliveryState(outboxMessageID(row.ID), deliveryFailed, err.Error())
+	}
+	return dbErr
+}
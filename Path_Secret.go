@@ -0,0 +1,24 @@
+package main
+
+import "strings"
+
+// splitSecrets parses a comma-separated list of path secrets. The first is
+// the one put into new payment links; the rest stay valid so a rotation
+// doesn't break links and ITN retries already in flight.
+func splitSecrets(raw string) []string {
+	var secrets []string
+	for _, secret := range strings.Split(raw, ",") {
+		if secret = strings.TrimSpace(secret); secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// securedURL is the URL handed to PayFast for base.
+func securedURL(homebaseURL, base string, secrets []string) string {
+	if len(secrets) == 0 {
+		return homebaseURL + base
+	}
+	return homebaseURL + base + "/" + secrets[0]
+}
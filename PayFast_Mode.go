@@ -0,0 +1,59 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// PAYFAST_MODE values.
+const (
+	payfastSandbox = "sandbox"
+	payfastLive    = "live"
+
+	payfastSandboxHost = "sandbox.payfast.co.za"
+)
+
+const sandboxLinkWarning = "*TEST MODE* - this payment link uses the PayFast sandbox and no real payment will be taken.\n\n"
+
+// validatePayFastMode makes sure PFHOST agrees with PAYFAST_MODE, so sandbox
+// payments can't quietly stand in for real ones or the other way round.
+func validatePayFastMode(mode, pfHost string) error {
+	host := pfHostname(pfHost)
+	switch mode {
+	case payfastSandbox:
+		if host != payfastSandboxHost {
+			return fmt.Errorf("PAYFAST_MODE is sandbox but PFHOST %q is not %s", host, payfastSandboxHost)
+		}
+	case payfastLive:
+		if host == payfastSandboxHost {
+			return fmt.Errorf("PAYFAST_MODE is live but PFHOST points at the sandbox")
+		}
+	case "":
+		return errors.New("PAYFAST_MODE environment variable does not exist (set it to sandbox or live)")
+	default:
+		return fmt.Errorf("PAYFAST_MODE: %q is not sandbox or live", mode)
+	}
+	return nil
+}
+
+// withSandboxWarning prefixes replies carrying a payment link when running
+// against the sandbox.
+func withSandboxWarning(reply, mode, pfHost string) string {
+	if mode == payfastSandbox && strings.Contains(reply, pfHostname(pfHost)) {
+		return sandboxLinkWarning + reply
+	}
+	return reply
+}
+
+// orderPayFastMode returns the mode the order was created under, or "" for
+// orders from before modes were recorded.
+func orderPayFastMode(db *sql.DB, orderID int64) (string, error) {
+	var mode string
+	err := db.QueryRow(`SELECT payfast_mode FROM order_meta WHERE order_id = $1`, orderID).Scan(&mode)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return mode, err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+)
+
+// Payment links tell PayFast who is paying and for which order: name_first
+// from the customer's display name, email_address once they've given one
+// with "email", and custom_str1 with the order reference. PayFast fills
+// the payment page with the first two and sends all three back in the
+// ITN. A field we have nothing for is left out rather than sent empty.
+//
+// The reference that comes back must be the order's: m_payment_id and the
+// reference were signed together, so a mismatch means the ITN was meant
+// for another order or deployment and a person has to look at it. The
+// buyer can change their name and email on the page, so a different one
+// coming back is only logged.
+
+const pfMaxEmail = 100
+
+// payFastBuyer is what a payment link adds to MenuBotLib's fields.
+type payFastBuyer struct {
+	NameFirst string
+	Email     string
+	OrderRef  string
+}
+
+// payFastBuyerFor reads cell's profile for the link of the order ref. What
+// can't be read is left out, so the link still goes out.
+func payFastBuyerFor(db *sql.DB, cell, ref string) payFastBuyer {
+	b := payFastBuyer{OrderRef: ref}
+	var name string
+	err := db.QueryRow(`SELECT display_name, email FROM customer_profiles WHERE cell_number = $1`, cell).Scan(&name, &b.Email)
+	if err == nil {
+		b.Email, err = openField(fieldEmail, b.Email)
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		b.Email = ""
+		log.Printf("Reading the profile of %s for a payment link failed, sending it without: %v", cell, err)
+	}
+	if first, _, _ := strings.Cut(pfText(name, 0), " "); first != "" {
+		b.NameFirst = pfText(first, pfTextFields["name_first"])
+	}
+	return b
+}
+
+// addTo sets the buyer's fields on a payment request, in PayFast's order.
+func (b payFastBuyer) addTo(params []itnParam) []itnParam {
+	for _, f := range []itnParam{
+		{Key: "name_first", Value: b.NameFirst},
+		{Key: "email_address", Value: b.Email},
+		{Key: "custom_str1", Value: pfText(b.OrderRef, pfTextFields["custom_str1"])},
+	} {
+		if f.Value != "" {
+			params = setPayFastField(params, f.Key, f.Value)
+		}
+	}
+	return params
+}
+
+// checkITNBuyer compares what an ITN sent back with the order it names.
+// ITNs for links from before these fields were sent have none of them.
+func checkITNBuyer(db *sql.DB, order orderSummary, d OrderData) error {
+	if d.OrderRef != "" && order.Ref != "" {
+		if ref, _, ok := parseOrderRef(d.OrderRef); !ok || ref != order.Ref {
+			metrics.Inc("menubot_itn_buyer_mismatch_total", "ITNs whose buyer fields differ from the order's.", "field", "custom_str1")
+			return fmt.Errorf("%w: ITN for order %d carries reference %q but the order is %s", errNeedsHuman, order.ID, d.OrderRef, order.Ref)
+		}
+	}
+	if d.NameFirst == "" && d.Email == "" {
+		return nil
+	}
+	b := payFastBuyerFor(db, order.CellNumber, order.Ref)
+	if d.NameFirst != "" && b.NameFirst != "" && !strings.EqualFold(d.NameFirst, b.NameFirst) {
+		metrics.Inc("menubot_itn_buyer_mismatch_total", "ITNs whose buyer fields differ from the order's.", "field", "name_first")
+		log.Printf("ITN for order %d was paid by %q, the customer is %q", order.ID, d.NameFirst, b.NameFirst)
+	}
+	if d.Email != "" && b.Email != "" && !strings.EqualFold(d.Email, b.Email) {
+		metrics.Inc("menubot_itn_buyer_mismatch_total", "ITNs whose buyer fields differ from the order's.", "field", "email_address")
+		log.Printf("ITN for order %d came with a different email address from the customer's", order.ID)
+	}
+	return nil
+}
+
+// parseEmail accepts a bare address PayFast will take.
+func parseEmail(s string) (string, bool) {
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s || addr.Name != "" || len(s) > pfMaxEmail {
+		return "", false
+	}
+	_, domain, _ := strings.Cut(s, "@")
+	if !strings.Contains(domain, ".") {
+		return "", false
+	}
+	return strings.ToLower(s), true
+}
+
+// customerEmail handles "email", "email <address>" and "email remove".
+func customerEmail(cc *commandContext, sender string, args []string) string {
+	if len(args) == 0 {
+		var email string
+		err := cc.db.QueryRow(`SELECT email FROM customer_profiles WHERE cell_number = $1`, sender).Scan(&email)
+		if err == nil {
+			email, err = openField(fieldEmail, email)
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Email: reading the address of %s failed: %v", sender, err)
+		}
+		if email == "" {
+			return `Send "email" and your address, e.g. "email you@example.com", and we'll fill it in on the payment page for you.`
+		}
+		return fmt.Sprintf(`We have your email as %s. Send "email remove" to forget it.`, email)
+	}
+	var email string
+	switch arg := strings.Join(args, " "); {
+	case strings.EqualFold(arg, "remove"), strings.EqualFold(arg, "none"):
+	default:
+		var ok bool
+		if email, ok = parseEmail(arg); !ok {
+			return `That doesn't look like an email address. Send it as e.g. "email you@example.com".`
+		}
+	}
+	sealed, err := sealField(fieldEmail, email)
+	if err == nil {
+		_, err = cc.db.Exec(`INSERT INTO customer_profiles (cell_number, email) VALUES ($1, $2)
+			ON CONFLICT (cell_number) DO UPDATE SET email = EXCLUDED.email, updated_at = now()`, sender, sealed)
+	}
+	if err != nil {
+		return cc.apology(incidentEmailSave, sender, 0, err, "Email: saving the address",
+			"Sorry, something went wrong saving your email address. Please try again.")
+	}
+	if email == "" {
+		return "Done, we've forgotten your email address."
+	}
+	return fmt.Sprintf("Thanks! We'll fill in %s on the payment page from now on.", email)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/JeremyJalpha/MenuBot_WebAPI/httpapi"
+)
+
+func paramKeys(params []itnParam) string {
+	keys := make([]string, len(params))
+	for i, p := range params {
+		keys[i] = p.Key
+	}
+	return strings.Join(keys, ",")
+}
+
+func TestPayFastBuyerAddTo(t *testing.T) {
+	base := func() []itnParam {
+		return []itnParam{
+			{Key: "merchant_id", Value: "10000100"}, {Key: "merchant_key", Value: "46f0cd694581a"},
+			{Key: "return_url", Value: "https://shop.example.com/return"}, {Key: "notify_url", Value: "https://shop.example.com/notify"},
+			{Key: "m_payment_id", Value: "shop1-42"}, {Key: "amount", Value: "50.00"}, {Key: "item_name", Value: "Order 42"},
+		}
+	}
+	tests := []struct {
+		name  string
+		buyer payFastBuyer
+		keys  string
+	}{
+		{"everything", payFastBuyer{NameFirst: "Thandi", Email: "thandi@example.com", OrderRef: "SHP-2026-0042"},
+			"merchant_id,merchant_key,return_url,notify_url,name_first,email_address,m_payment_id,amount,item_name,custom_str1"},
+		{"no email", payFastBuyer{NameFirst: "Thandi", OrderRef: "SHP-2026-0042"},
+			"merchant_id,merchant_key,return_url,notify_url,name_first,m_payment_id,amount,item_name,custom_str1"},
+		{"no name", payFastBuyer{Email: "thandi@example.com", OrderRef: "SHP-2026-0042"},
+			"merchant_id,merchant_key,return_url,notify_url,email_address,m_payment_id,amount,item_name,custom_str1"},
+		{"nothing", payFastBuyer{},
+			"merchant_id,merchant_key,return_url,notify_url,m_payment_id,amount,item_name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := tt.buyer.addTo(base())
+			if got := paramKeys(params); got != tt.keys {
+				t.Errorf("fields %s, want %s", got, tt.keys)
+			}
+			for _, p := range params {
+				if p.Value == "" {
+					t.Errorf("%s is sent empty", p.Key)
+				}
+			}
+		})
+	}
+
+	t.Run("replaces fields already there", func(t *testing.T) {
+		params := append(base(), itnParam{Key: "custom_str1", Value: "old"})
+		params = payFastBuyer{OrderRef: "SHP-2026-0042"}.addTo(params)
+		if got := paramKeys(params); strings.Count(got, "custom_str1") != 1 || params[len(params)-1].Value != "SHP-2026-0042" {
+			t.Errorf("fields %v", params)
+		}
+	})
+}
+
+// TestPayFastBuyerSignature builds payment links with and without the
+// buyer's fields, checks they are signed over them, and that an ITN
+// carrying them back only verifies with them as sent.
+func TestPayFastBuyerSignature(t *testing.T) {
+	const host = "https://sandbox.payfast.co.za/eng/process"
+	const passphrase = "jt7NOE43FZPn"
+	buyers := []struct {
+		name  string
+		buyer payFastBuyer
+	}{
+		{"everything", payFastBuyer{NameFirst: "Thandi", Email: "thandi+food@example.com", OrderRef: "SHP-2026-0042"}},
+		{"reference only", payFastBuyer{OrderRef: "SHP-2026-0042"}},
+		{"awkward name", payFastBuyer{NameFirst: "D'Arcy~Jr", OrderRef: "SHP-2026-0042"}},
+	}
+	for _, tt := range buyers {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := "Pay here: " + host + "?merchant_id=10000100&merchant_key=46f0cd694581a&m_payment_id=42&amount=50.00&item_name=Order+42&signature=stale"
+			link := strings.TrimPrefix(adjustCheckoutLinks(reply, host, passphrase, "shop1-42", "Order 42", tt.buyer, 0, 0), "Pay here: ")
+			u, err := url.Parse(link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signed, signature, ok := strings.Cut(u.RawQuery, "&signature=")
+			if !ok || signature != pfSignature(signed, passphrase) {
+				t.Fatalf("link isn't signed over its fields: %s", link)
+			}
+			q := u.Query()
+			for key, want := range map[string]string{"name_first": tt.buyer.NameFirst, "email_address": tt.buyer.Email, "custom_str1": tt.buyer.OrderRef} {
+				if _, sent := q[key]; sent != (want != "") || q.Get(key) != want {
+					t.Errorf("%s = %q (sent %v), want %q", key, q.Get(key), sent, want)
+				}
+			}
+
+			// PayFast posts the fields back in the ITN, signed in the
+			// order it sends them.
+			itn := []itnParam{{Key: "m_payment_id", Value: "shop1-42"}, {Key: "pf_payment_id", Value: "1089250"},
+				{Key: "payment_status", Value: pfComplete}, {Key: "item_name", Value: "Order 42"}, {Key: "amount_gross", Value: "50.00"}}
+			itn = tt.buyer.addTo(itn)
+			raw := checkPaymentResult(itn)
+			raw += "&signature=" + pfSignature(raw, passphrase)
+			tampered := []struct {
+				name string
+				edit func(string) string
+				ok   bool
+			}{
+				{"as sent", func(s string) string { return s }, true},
+				{"other reference", func(s string) string {
+					return strings.Replace(s, "custom_str1=SHP-2026-0042", "custom_str1=SHP-2026-0043", 1)
+				}, false},
+				{"reference dropped", func(s string) string { return strings.Replace(s, "&custom_str1=SHP-2026-0042", "", 1) }, false},
+			}
+			for _, tamper := range tampered {
+				params, err := httpapi.ParseITNParams(tamper.edit(raw))
+				if err != nil {
+					t.Fatal(err)
+				}
+				d, err := httpapi.CompileOrderData(httpapi.ITNValues(params))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := (signatureVerifier{passphrase: passphrase}).Verify(d, params, ""); got != tamper.ok {
+					t.Errorf("%s: verified %v, want %v", tamper.name, got, tamper.ok)
+				}
+				if tamper.ok && (d.NameFirst != tt.buyer.NameFirst || d.Email != tt.buyer.Email || d.OrderRef != tt.buyer.OrderRef) {
+					t.Errorf("read back %q, %q, %q from the ITN", d.NameFirst, d.Email, d.OrderRef)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckITNBuyer(t *testing.T) {
+	// Profile lookups fail, so the name and email are only ever logged.
+	db, _ := openFakeStaffDB(t, nil)
+	order := orderSummary{ID: 42, Ref: "SHP-2026-0042", CellNumber: "27821234567"}
+	tests := []struct {
+		name      string
+		order     orderSummary
+		data      OrderData
+		wantHuman bool
+	}{
+		{"matching reference", order, OrderData{OrderRef: "SHP-2026-0042"}, false},
+		{"reference as typed", order, OrderData{OrderRef: "shp 2026 42"}, false},
+		{"other order's reference", order, OrderData{OrderRef: "SHP-2026-0043"}, true},
+		{"not a reference", order, OrderData{OrderRef: "hello"}, true},
+		{"link from before references", order, OrderData{}, false},
+		{"order without a reference", orderSummary{ID: 42}, OrderData{OrderRef: "SHP-2026-0042"}, false},
+		{"name and email changed on the page", order, OrderData{OrderRef: "SHP-2026-0042", NameFirst: "Sipho", Email: "sipho@example.com"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkITNBuyer(db, tt.order, tt.data)
+			if errors.Is(err, errNeedsHuman) != tt.wantHuman || (err != nil && !tt.wantHuman) {
+				t.Errorf("checkITNBuyer = %v, want needs-human %v", err, tt.wantHuman)
+			}
+		})
+	}
+}
+
+func TestParseEmail(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string // "" for rejected
+	}{
+		{"you@example.com", "you@example.com"},
+		{"You@Example.COM", "you@example.com"},
+		{"thandi+food@mail.example.co.za", "thandi+food@mail.example.co.za"},
+		{"you@localhost", ""},
+		{"you", ""},
+		{"@example.com", ""},
+		{"Thandi <you@example.com>", ""},
+		{" you@example.com", ""},
+		{"you@example.com, me@example.com", ""},
+		{strings.Repeat("a", 90) + "@example.com", ""},
+	}
+	for _, tt := range tests {
+		got, ok := parseEmail(tt.in)
+		if ok != (tt.want != "") || got != tt.want {
+			t.Errorf("parseEmail(%q) = %q, %v; want %q", tt.in, got, ok, tt.want)
+		}
+	}
+}
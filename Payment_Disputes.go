@@ -0,0 +1,147 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// PayFast ITN payment_status values. Anything not listed, e.g. PENDING, is
+// stored and otherwise ignored.
+const (
+	pfComplete  = "COMPLETE"
+	pfFailed    = "FAILED"
+	pfCancelled = "CANCELLED"
+)
+
+// pfReversals are the statuses PayFast uses when money it already paid
+// out is taken back.
+var pfReversals = map[string]bool{
+	"REVERSED":   true,
+	"REFUNDED":   true,
+	"CHARGEBACK": true,
+}
+
+const disputeSummaryHour = 9
+
+// itnAction is what a notification does to its order.
+type itnAction int
+
+const (
+	itnIgnore itnAction = iota
+	// itnSettle marks the order paid; markOrderPaid leaves one that
+	// isn't unpaid any more alone.
+	itnSettle
+	itnRetry
+	itnDispute
+)
+
+// notificationAction decides what an ITN does given the order's current
+// status, so notifications arriving out of order can't walk an order
+// backwards: a FAILED after a COMPLETE is ignored.
+func notificationAction(order orderSummary, orderData OrderData) (itnAction, error) {
+	status := strings.ToUpper(orderData.PaymentStatus)
+	switch {
+	case status == pfComplete:
+		if order.Status == statusExpired {
+			// Its link was given up on; a late payment must not revive the
+			// order behind everyone's back.
+			return itnIgnore, fmt.Errorf("%w: order %d was paid %s after it expired, refund or reinstate it", errNeedsHuman, order.ID, orderData.AmountGross)
+		}
+		return itnSettle, nil
+	case status == pfFailed || status == pfCancelled:
+		if order.Status != statusUnpaid {
+			return itnIgnore, nil
+		}
+		return itnRetry, nil
+	case pfReversals[status]:
+		if order.Status == statusDisputed {
+			return itnIgnore, nil
+		}
+		if !order.atOrPast(statusPaid) && (order.Status != statusCancelled || order.PaidAt == nil) {
+			return itnIgnore, fmt.Errorf("%w: %s ITN for order %d, which was never paid", errNeedsHuman, orderData.PaymentStatus, order.ID)
+		}
+		return itnDispute, nil
+	}
+	return itnIgnore, nil
+}
+
+// failedPayment tells the customer a payment attempt didn't go through and
+// how to try again. The order stays unpaid.
+func failedPayment(cc *commandContext, order orderSummary, orderData OrderData) error {
+	var link string
+	err := cc.db.QueryRow(`SELECT payment_link FROM order_meta WHERE order_id = $1`, order.ID).Scan(&link)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("reading payment link of order %d: %w", order.ID, err)
+	}
+	text := fmt.Sprintf("Your payment for order %s didn't go through, so the order hasn't been placed yet.", order.reference())
+	if link != "" {
+		text += " You can try again here: " + link
+	} else {
+		text += " Reply checkout to get a new payment link."
+	}
+	metrics.Inc("menubot_payments_failed_total", "PayFast payment attempts that failed or were cancelled.", "status", strings.ToLower(orderData.PaymentStatus))
+	cc.sender.SendOrder(order.CellNumber, text, priorityNotify, order.ID)
+	return nil
+}
+
+// reversedPayment marks a paid order disputed and alerts the admin at once,
+// since the goods may still be on their way out.
+func reversedPayment(cc *commandContext, order orderSummary, orderData OrderData) error {
+	tx, err := cc.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	moved, err := transitionOrder(tx, order.ID, statusDisputed, order.Status)
+	if err != nil {
+		return fmt.Errorf("marking order %d disputed: %w", order.ID, err)
+	}
+	if !moved {
+		// Its status changed under us; the retry reads it afresh.
+		return fmt.Errorf("order %d changed while marking it disputed", order.ID)
+	}
+	if _, err := tx.Exec(`UPDATE order_meta SET disputed_at = now() WHERE order_id = $1`, order.ID); err != nil {
+		return fmt.Errorf("marking order %d disputed: %w", order.ID, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("marking order %d disputed: %w", order.ID, err)
+	}
+	metrics.Inc("menubot_payments_reversed_total", "Payments PayFast reported reversed after they were made.")
+	log.Printf("Order %s (%d) payment %s was %s, order marked disputed", order.reference(), order.ID, orderData.PfPaymentID, orderData.PaymentStatus)
+	cc.events.Emit(eventOrderStatusChanged, orderStatusEvent{OrderID: order.ID, OrderRef: order.reference(), CellNumber: order.CellNumber, From: order.Status, To: statusDisputed})
+	cc.advanceQueue()
+	cc.sender.SendOrder(cc.envVars.AdminNumber, fmt.Sprintf(
+		"⚠️ PayFast reports the payment for order %s (total %s, %s) as %s. The order was %s and is now marked disputed; check it before anything else goes out.",
+		order.reference(), order.Total, order.CellNumber, strings.ToLower(orderData.PaymentStatus), order.Status), priorityNotify, order.ID)
+	return nil
+}
+
+// openDisputes lists disputed orders, oldest dispute first.
+func openDisputes(db *sql.DB) ([]orderSummary, error) {
+	return listOrders(db, ` WHERE m.status = $1 ORDER BY m.disputed_at, o.`+orderIDColumn, statusDisputed)
+}
+
+// sendDisputeSummaries reminds the admin, as a morning job, of orders
+// still marked disputed. Nothing is sent when there are none.
+func sendDisputeSummaries(cc *commandContext) error {
+	orders, err := openDisputes(cc.db)
+	if err != nil {
+		return fmt.Errorf("reading disputed orders: %w", err)
+	}
+	if len(orders) == 0 {
+		return nil
+	}
+	lines := make([]string, len(orders))
+	for i, o := range orders {
+		lines[i] = fmt.Sprintf("Order %s, %s, total %s", o.reference(), o.CellNumber, o.Total)
+	}
+	cc.sendBulk(bulkMessage{
+		Recipient: cc.envVars.AdminNumber,
+		Text:      "Orders still disputed after a reversed payment:\n" + strings.Join(lines, "\n"),
+		Kind:      bulkAdmin,
+	})
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNotificationAction(t *testing.T) {
+	paidAt := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	order := func(status string, paid bool) orderSummary {
+		o := orderSummary{ID: 42, Status: status}
+		if paid {
+			o.PaidAt = &paidAt
+		}
+		return o
+	}
+	tests := []struct {
+		name      string
+		status    string
+		order     orderSummary
+		want      itnAction
+		wantHuman bool
+	}{
+		{"complete on unpaid", pfComplete, order(statusUnpaid, false), itnSettle, false},
+		{"complete again on paid", "complete", order(statusPaid, true), itnSettle, false},
+		{"complete on expired", pfComplete, order(statusExpired, false), itnIgnore, true},
+		{"failed on unpaid", pfFailed, order(statusUnpaid, false), itnRetry, false},
+		{"cancelled on unpaid", pfCancelled, order(statusUnpaid, false), itnRetry, false},
+		{"failed after complete", pfFailed, order(statusPaid, true), itnIgnore, false},
+		{"cancelled after complete", pfCancelled, order(statusPreparing, true), itnIgnore, false},
+		{"failed on disputed", pfFailed, order(statusDisputed, true), itnIgnore, false},
+		{"failed on expired", pfFailed, order(statusExpired, false), itnIgnore, false},
+		{"chargeback on paid", "CHARGEBACK", order(statusPaid, true), itnDispute, false},
+		{"reversal on delivered", "REVERSED", order(statusDelivered, true), itnDispute, false},
+		{"refund on a paid order cancelled later", "REFUNDED", order(statusCancelled, true), itnDispute, false},
+		{"second chargeback", "CHARGEBACK", order(statusDisputed, true), itnIgnore, false},
+		{"reversal before the payment", "REVERSED", order(statusUnpaid, false), itnIgnore, true},
+		{"reversal on an unpaid cancelled order", "REVERSED", order(statusCancelled, false), itnIgnore, true},
+		{"pending", "PENDING", order(statusUnpaid, false), itnIgnore, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := notificationAction(tt.order, OrderData{PaymentStatus: tt.status, AmountGross: "100.00"})
+			if tt.wantHuman != errors.Is(err, errNeedsHuman) {
+				t.Fatalf("err = %v, want needs-human %v", err, tt.wantHuman)
+			}
+			if got != tt.want {
+				t.Errorf("action = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
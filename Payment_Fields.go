@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+)
+
+// PayFast signs the fields as PHP's urlencode encodes them, and shows the
+// free-text fields on the payment page as plain text within its length
+// limits. Catalogue names flow into those fields, so every payment link is
+// re-encoded with pfEncode and its free-text fields cleaned with pfText
+// before it is signed; otherwise an ampersand, a plus or an emoji in a name
+// gives a link whose signature PayFast rejects or a mangled description.
+
+const pfMaxItemDescription = 255
+
+// pfTextFields are the free-text fields of a payment request, with the
+// most characters PayFast takes in each.
+var pfTextFields = map[string]int{
+	"item_name":        pfMaxItemName,
+	"item_description": pfMaxItemDescription,
+	"name_first":       100,
+	"name_last":        100,
+	"custom_str1":      255,
+	"custom_str2":      255,
+	"custom_str3":      255,
+	"custom_str4":      255,
+	"custom_str5":      255,
+}
+
+// pfFieldOrder is the order PayFast documents a payment request's fields
+// in, which is the order it expects them signed in. A field we add to a
+// link goes in its place among these, wherever MenuBotLib put the rest.
+var pfFieldOrder = []string{
+	"merchant_id", "merchant_key", "return_url", "cancel_url", "notify_url",
+	"name_first", "name_last", "email_address", "cell_number",
+	"m_payment_id", "amount", "item_name", "item_description",
+	"custom_int1", "custom_int2", "custom_int3", "custom_int4", "custom_int5",
+	"custom_str1", "custom_str2", "custom_str3", "custom_str4", "custom_str5",
+	"email_confirmation", "confirmation_address", "payment_method",
+}
+
+func pfFieldRank(key string) int {
+	for i, k := range pfFieldOrder {
+		if k == key {
+			return i
+		}
+	}
+	return len(pfFieldOrder)
+}
+
+// setPayFastField sets key in params, adding it in PayFast's order when
+// it isn't there yet.
+func setPayFastField(params []itnParam, key, value string) []itnParam {
+	for i := range params {
+		if params[i].Key == key {
+			params[i].Value = value
+			return params
+		}
+	}
+	at := len(params)
+	for i, p := range params {
+		if p.Key == "signature" || pfFieldRank(p.Key) > pfFieldRank(key) {
+			at = i
+			break
+		}
+	}
+	return append(params[:at], append([]itnParam{{Key: key, Value: value}}, params[at:]...)...)
+}
+
+// pfEncode is PHP's urlencode, which PayFast's signature is computed
+// with: Go's QueryEscape leaves "~" as it is, urlencode doesn't.
+func pfEncode(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "~", "%7E")
+}
+
+// pfFold spells accented letters and typographic punctuation in ASCII.
+var pfFold = strings.NewReplacer(
+	"à", "a", "á", "a", "â", "a", "ã", "a", "ä", "a", "å", "a", "æ", "ae",
+	"À", "A", "Á", "A", "Â", "A", "Ã", "A", "Ä", "A", "Å", "A", "Æ", "AE",
+	"ç", "c", "Ç", "C", "è", "e", "é", "e", "ê", "e", "ë", "e", "È", "E", "É", "E", "Ê", "E", "Ë", "E",
+	"ì", "i", "í", "i", "î", "i", "ï", "i", "Ì", "I", "Í", "I", "Î", "I", "Ï", "I",
+	"ñ", "n", "Ñ", "N", "ò", "o", "ó", "o", "ô", "o", "õ", "o", "ö", "o", "ø", "o", "œ", "oe",
+	"Ò", "O", "Ó", "O", "Ô", "O", "Õ", "O", "Ö", "O", "Ø", "O", "Œ", "OE",
+	"ù", "u", "ú", "u", "û", "u", "ü", "u", "Ù", "U", "Ú", "U", "Û", "U", "Ü", "U",
+	"ý", "y", "ÿ", "y", "Ý", "Y", "ß", "ss",
+	"‘", "'", "’", "'", "“", `"`, "”", `"`, "–", "-", "—", "-", "…", "...",
+)
+
+// pfText is s as PayFast can show it: printable ASCII, accents spelled
+// out, anything else such as emoji dropped, runs of whitespace collapsed,
+// and cut to limit characters.
+func pfText(s string, limit int) string {
+	var b strings.Builder
+	space := false
+	for _, r := range pfFold.Replace(s) {
+		if unicode.IsSpace(r) {
+			space = true
+			continue
+		}
+		if r < ' ' || r > '~' {
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteRune(r)
+	}
+	text := b.String()
+	if limit > 0 && len(text) > limit {
+		text = strings.TrimSpace(text[:limit])
+	}
+	return text
+}
+
+// parsePayFastQuery splits a payment link's query into its fields, in
+// order. It is lenient with what an unencoded name leaves behind: a part
+// with no "=" is taken to be the rest of the previous value, after an "&"
+// that should have been encoded, and a value that isn't valid encoding is
+// taken as written.
+func parsePayFastQuery(raw string) (keys, values []string) {
+	for _, part := range strings.Split(raw, "&") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok && len(keys) > 0 {
+			values[len(values)-1] += "&" + unescapePayFast(part)
+			continue
+		}
+		keys = append(keys, key)
+		values = append(values, unescapePayFast(value))
+	}
+	return keys, values
+}
+
+func unescapePayFast(raw string) string {
+	if value, err := url.QueryUnescape(raw); err == nil {
+		return value
+	}
+	return raw
+}
+
+// payFastNameWarnings lists the catalogue names that won't appear on the
+// PayFast payment page as written.
+func payFastNameWarnings(items []mb.CatalogueItem) []string {
+	var warnings []string
+	for _, item := range items {
+		name := ctlgItemName(item)
+		switch shown := pfText(name, 0); {
+		case len(shown) > pfMaxItemDescription:
+			warnings = append(warnings, fmt.Sprintf("%s %q is longer than the %d characters PayFast shows and will be cut short",
+				itemRef(ctlgItemID(item)), name, pfMaxItemDescription))
+		case shown != name:
+			warnings = append(warnings, fmt.Sprintf("%s %q will show as %q on the PayFast page", itemRef(ctlgItemID(item)), name, shown))
+		}
+	}
+	return warnings
+}
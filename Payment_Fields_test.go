@@ -0,0 +1,160 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+)
+
+func TestPfEncode(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Fish and Chips", "Fish+and+Chips"},
+		{"Fish & Chips", "Fish+%26+Chips"},
+		{"1+1", "1%2B1"},
+		{"100% beef", "100%25+beef"},
+		{"a~b", "a%7Eb"},
+		{"café", "caf%C3%A9"},
+		{"https://x.test/a?b=c", "https%3A%2F%2Fx.test%2Fa%3Fb%3Dc"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := pfEncode(tt.in); got != tt.want {
+			t.Errorf("pfEncode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPfText(t *testing.T) {
+	long := strings.Repeat("Chocolate Brownie ", 12) // 216 characters
+	tests := []struct {
+		name  string
+		in    string
+		limit int
+		want  string
+	}{
+		{"plain", "Fish and Chips", 100, "Fish and Chips"},
+		{"ampersand kept", "Fish & Chips", 100, "Fish & Chips"},
+		{"plus and percent kept", "2+1 deal, 100% beef", 100, "2+1 deal, 100% beef"},
+		{"emoji dropped", "Fries 🍟🍟 large", 100, "Fries large"},
+		{"only emoji", "🍔🍟", 100, ""},
+		{"accents spelled out", "Crème brûlée", 100, "Creme brulee"},
+		{"smart quotes", "Mom’s “special”", 100, `Mom's "special"`},
+		{"whitespace collapsed", "  Fish\t\tand\nChips  ", 100, "Fish and Chips"},
+		{"control characters dropped", "Fish\x00and\x7fChips", 100, "FishandChips"},
+		{"cut to the limit", long, 100, strings.TrimSpace(long[:100])},
+		{"cut without a trailing space", "abcd efgh", 5, "abcd"},
+		{"200 characters within 255", strings.Repeat("x", 200), pfMaxItemDescription, strings.Repeat("x", 200)},
+		{"no limit", long, 0, strings.TrimSpace(long)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := pfText(tt.in, tt.limit)
+			if got != tt.want {
+				t.Errorf("pfText(%q, %d) = %q, want %q", tt.in, tt.limit, got, tt.want)
+			}
+			if tt.limit > 0 && len(got) > tt.limit {
+				t.Errorf("%d characters, over the limit of %d", len(got), tt.limit)
+			}
+		})
+	}
+}
+
+func TestParsePayFastQuery(t *testing.T) {
+	tests := []struct {
+		name   string
+		raw    string
+		keys   []string
+		values []string
+	}{
+		{"encoded", "item_name=Fish+%26+Chips&amount=50.00", []string{"item_name", "amount"}, []string{"Fish & Chips", "50.00"}},
+		{"unencoded ampersand", "item_name=Fish & Chips&amount=50.00", []string{"item_name", "amount"}, []string{"Fish & Chips", "50.00"}},
+		{"stray percent", "item_name=100%+beef&amount=50.00", []string{"item_name", "amount"}, []string{"100%+beef", "50.00"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, values := parsePayFastQuery(tt.raw)
+			if strings.Join(keys, ",") != strings.Join(tt.keys, ",") || strings.Join(values, "|") != strings.Join(tt.values, "|") {
+				t.Errorf("parsePayFastQuery(%q) = %q, %q; want %q, %q", tt.raw, keys, values, tt.keys, tt.values)
+			}
+		})
+	}
+}
+
+// TestAdjustCheckoutLinksNames checks that whatever a catalogue name
+// holds, the re-signed link carries it cleaned, within PayFast's limits,
+// and with a signature over the fields exactly as they are sent.
+func TestAdjustCheckoutLinksNames(t *testing.T) {
+	const host = "https://sandbox.payfast.co.za/eng/process"
+	tests := []struct {
+		name        string
+		description string // as MenuBotLib put it in the query
+		want        string
+	}{
+		{"ampersand", url.QueryEscape("Fish & Chips x1"), "Fish & Chips x1"},
+		{"unencoded ampersand", "Fish+&+Chips+x1", "Fish & Chips x1"},
+		{"plus and percent", url.QueryEscape("2+1 deal, 100% beef"), "2+1 deal, 100% beef"},
+		{"emoji", url.QueryEscape("Fries 🍟 x2"), "Fries x2"},
+		{"200 characters", url.QueryEscape(strings.Repeat("Brownie ", 25)), strings.TrimSpace(strings.Repeat("Brownie ", 25))},
+		{"over the limit", url.QueryEscape(strings.Repeat("Brownie ", 40)), strings.TrimSpace(strings.Repeat("Brownie ", 40)[:pfMaxItemDescription])},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply := "Pay here: " + host + "?merchant_id=10000100&amount=50.00&m_payment_id=7&item_name=Order+7&item_description=" + tt.description + "&signature=stale"
+			itemName := strings.Repeat("Café ☕ ", 30)
+			adjusted := adjustCheckoutLinks(reply, host, "pass phrase", "shop1-7", itemName, payFastBuyer{}, 0, 0)
+			link := strings.TrimPrefix(adjusted, "Pay here: ")
+			u, err := url.Parse(link)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q := u.Query()
+			if got := q.Get("item_description"); got != tt.want {
+				t.Errorf("item_description = %q, want %q", got, tt.want)
+			}
+			if got := q.Get("item_name"); got != pfText(itemName, pfMaxItemName) || len(got) > pfMaxItemName {
+				t.Errorf("item_name = %q", got)
+			}
+			if got := q.Get("m_payment_id"); got != "shop1-7" {
+				t.Errorf("m_payment_id = %q", got)
+			}
+			signed, signature, ok := strings.Cut(u.RawQuery, "&signature=")
+			if !ok {
+				t.Fatalf("no signature in %s", link)
+			}
+			if signature != pfSignature(signed, "pass phrase") {
+				t.Errorf("signature %s isn't over %s", signature, signed)
+			}
+			var params []itnParam
+			keys, values := parsePayFastQuery(signed)
+			for i, key := range keys {
+				params = append(params, itnParam{Key: key, Value: values[i]})
+			}
+			if checkPaymentResult(params) != signed {
+				t.Errorf("the link isn't encoded the way PayFast re-encodes it: %s", signed)
+			}
+		})
+	}
+}
+
+func TestPayFastNameWarnings(t *testing.T) {
+	items := []mb.CatalogueItem{
+		{CatalogueItemID: 1, Item: "Fish & Chips"},
+		{CatalogueItemID: 2, Item: "Crème brûlée"},
+		{CatalogueItemID: 3, Item: "Burger 🍔"},
+		{CatalogueItemID: 4, Item: strings.Repeat("x", 256)},
+		{CatalogueItemID: 5, Item: strings.Repeat("x", 255)},
+	}
+	warnings := payFastNameWarnings(items)
+	want := []string{`item2 "Crème brûlée" will show as "Creme brulee"`, `item3 "Burger 🍔" will show as "Burger"`, "item4 ", "cut short"}
+	all := strings.Join(warnings, "\n")
+	for _, w := range want {
+		if !strings.Contains(all, w) {
+			t.Errorf("warnings don't mention %q:\n%s", w, all)
+		}
+	}
+	if len(warnings) != 3 {
+		t.Errorf("%d warnings, want 3:\n%s", len(warnings), all)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/JeremyJalpha/MenuBot_WebAPI/httpapi"
+)
+
+// The payment pages and the ITN callback are served by httpapi. What they
+// are built from is here: the order store, verifier and pipeline queue
+// over the database and the payment pipeline, and the bot's templates,
+// events and incidents.
+
+func newPaymentHandlers(env EnvVars, orders httpapi.OrderStore, verifier httpapi.PaymentVerifier, sender httpapi.MessageSender, events httpapi.EventEmitter, pages httpapi.TemplateRenderer, bases httpapi.BaseURLSource, incidents incidentReporter) *httpapi.Handlers {
+	notify := newIPLimiter("notify", func(rc *RuntimeConfig) (float64, int) { return rc.NotifyRate, rc.NotifyBurst })
+	return httpapi.New(orders, verifier, sender, pages, events, bases, handlerIncidents{incidents}, httpapi.Options{
+		ReturnPath:    returnBaseURL,
+		CancelPath:    cancelBaseURL,
+		NotifyPath:    notifyBaseURL,
+		ReturnSecrets: env.ReturnPathSecrets,
+		NotifySecrets: env.NotifyPathSecrets,
+		NotifyLimit:   notify.Middleware,
+		ClientIP:      remoteIP,
+	})
+}
+
+// dbOrderStore reads orders from the database, priced from the current
+// pricelist. Payment IDs are parsed with INSTANCE_ID and ITEM_NAME_PREFIX.
+type dbOrderStore struct {
+	db      *sql.DB
+	prclist *pricelistHolder
+
+	instanceID, itemNamePrefix string
+}
+
+func (s dbOrderStore) Order(id int64) (httpapi.Order, bool, error) {
+	order, found, err := getOrder(s.db, id)
+	return httpapi.Order(order), found, err
+}
+
+func (s dbOrderStore) Receipt(order httpapi.Order) (customerOrderData, error) {
+	return orderReceipt(s.db, s.prclist.Snapshot(), orderSummary(order))
+}
+
+func (s dbOrderStore) Returned(cellNumber string, orderID int64) {
+	recordFunnel(s.db, funnelReturnHit, cellNumber, orderID)
+}
+
+func (s dbOrderStore) CallbackBase(paymentID string) (int64, string, bool, error) {
+	orderID, err := parsePaymentID(paymentID, s.instanceID, s.itemNamePrefix)
+	if err != nil {
+		return 0, "", false, nil
+	}
+	base, err := callbackBase(s.db, orderID)
+	return orderID, base, true, err
+}
+
+// payfastVerifier checks an ITN's signature against PASSPHRASE and has
+// PayFast confirm it.
+type payfastVerifier struct {
+	passphrase, host string
+	incidents        incidentReporter
+}
+
+func (v payfastVerifier) Verify(orderData OrderData, params []itnParam, sourceIP string) bool {
+	summedOrderData := checkPaymentResult(params)
+	valid := true
+	if !pfValidSignature(orderData.Signature, summedOrderData, v.passphrase) {
+		v.incidents.Report(incidentITNSignature, "", 0, nil,
+			fmt.Sprintf("Post payment check: signature validity test failed - payment gateway data: %v", orderData))
+		valid = false
+	}
+	// Advisory only: behind a tunnel the source address is often the
+	// tunnel agent, and the server confirmation below is authoritative.
+	if !pfValidIP(sourceIP) {
+		log.Printf("Post payment check: Server IP test failed - payment gateway data: %v", orderData)
+	}
+	if !pfValidServerConfirmation(summedOrderData, v.host) {
+		v.incidents.Report(incidentITNConfirmation, "", 0, nil,
+			fmt.Sprintf("Post payment check: server confirmation test failed - payment gateway data: %v", orderData))
+		valid = false
+	}
+	return valid
+}
+
+// pipelineQueue stores ITNs for the payment pipeline and wakes it.
+type pipelineQueue struct {
+	db       *sql.DB
+	payments *paymentPipeline
+}
+
+func (q pipelineQueue) QueueConfirmation(orderData OrderData, raw string) (bool, error) {
+	stored, err := storeNotification(q.db, orderData, raw)
+	if err == nil && stored {
+		q.payments.wake()
+	}
+	return stored, err
+}
+
+// templatePages renders the payment pages from the templates loaded at
+// startup.
+type templatePages struct {
+	templates map[string]*template.Template
+	branding  branding
+}
+
+func (p templatePages) Render(w http.ResponseWriter, r *http.Request, page string, order *customerOrderData) {
+	renderPage(w, r, p.templates[page], paymentPageData{Branding: p.branding, Order: order}, p.branding)
+}
+
+// handlerIncidents files the handlers' problems under the bot's incident
+// codes.
+type handlerIncidents struct {
+	incidents incidentReporter
+}
+
+var handlerIncidentCodes = map[httpapi.Problem]incidentCode{
+	httpapi.ProblemReturnPage:    incidentReturnPage,
+	httpapi.ProblemITNUnreadable: incidentITNUnreadable,
+	httpapi.ProblemITNFields:     incidentITNFields,
+	httpapi.ProblemITNStore:      incidentITNStore,
+}
+
+func (h handlerIncidents) Report(problem httpapi.Problem, cell string, orderID int64, err error, context string) {
+	h.incidents.Report(handlerIncidentCodes[problem], cell, orderID, err, context)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// With INSTANCE_ID set, an order's m_payment_id is "<instance>-<order>", so
+// two deployments charging through the same PayFast merchant account can't
+// confuse each other's payments. Orders checked out before it was set
+// carry a bare order number, or ITEM_NAME_PREFIX plus the number, and are
+// still recognised.
+
+const (
+	// PayFast's field limits for m_payment_id and item_name.
+	pfMaxPaymentID = 100
+	pfMaxItemName  = 100
+	// maxOrderDigits is the longest order number, that of math.MaxInt64.
+	maxOrderDigits = 19
+)
+
+var instanceIDPattern = regexp.MustCompile(`^[A-Za-z0-9]{1,16}$`)
+
+// validatePaymentNaming checks INSTANCE_ID and ITEM_NAME_PREFIX, and that
+// the IDs and item names built from them fit PayFast's limits for any
+// order number.
+func validatePaymentNaming(instance, prefix string) error {
+	if instance != "" && !instanceIDPattern.MatchString(instance) {
+		return fmt.Errorf("INSTANCE_ID must be 1 to 16 letters or digits, got %q", instance)
+	}
+	if prefix == "" || strings.TrimFunc(prefix, func(r rune) bool { return r >= ' ' && r <= '~' }) != "" {
+		return fmt.Errorf("ITEM_NAME_PREFIX must be printable ASCII and not empty, got %q", prefix)
+	}
+	if n := len(paymentID(instance, 0)) - 1 + maxOrderDigits; n > pfMaxPaymentID {
+		return fmt.Errorf("INSTANCE_ID %q makes payment IDs of up to %d characters, PayFast allows %d", instance, n, pfMaxPaymentID)
+	}
+	if n := len(orderItemName(prefix, longestOrderRef)); n > pfMaxItemName {
+		return fmt.Errorf("ITEM_NAME_PREFIX %q makes item names of up to %d characters, PayFast allows %d", prefix, n, pfMaxItemName)
+	}
+	return nil
+}
+
+// longestOrderRef is as long as an order reference can get.
+var longestOrderRef = "ABCDEF-2024-" + strings.Repeat("9", maxOrderDigits)
+
+// orderItemName is the item_name PayFast shows for an order, and puts on
+// the customer's emailed receipt.
+func orderItemName(prefix, ref string) string {
+	return prefix + " " + ref
+}
+
+// paymentID is the m_payment_id of an order.
+func paymentID(instance string, orderID int64) string {
+	if instance == "" {
+		return strconv.FormatInt(orderID, 10)
+	}
+	return instance + "-" + strconv.FormatInt(orderID, 10)
+}
+
+// parsePaymentID returns the order number in an ITN's m_payment_id. A
+// payment ID belonging to another instance is an error, as is an
+// instance-qualified one when this deployment has no INSTANCE_ID.
+func parsePaymentID(s, instance, prefix string) (int64, error) {
+	number := s
+	if owner, rest, qualified := strings.Cut(s, "-"); qualified {
+		if owner != instance {
+			return 0, fmt.Errorf("payment ID %q belongs to instance %q, not %q", s, owner, instance)
+		}
+		number = rest
+	} else if rest, ok := strings.CutPrefix(s, prefix); ok {
+		number = rest
+	} else if rest, ok := strings.CutPrefix(s, legacyItemNamePrefix); ok {
+		number = rest
+	}
+	if number == "" || strings.Trim(number, "0123456789") != "" {
+		return 0, fmt.Errorf("unrecognised payment ID %q", s)
+	}
+	orderID, err := strconv.ParseInt(number, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unrecognised payment ID %q", s)
+	}
+	return orderID, nil
+}
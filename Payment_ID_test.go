@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePaymentID(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       string
+		instance string
+		prefix   string
+		want     int64
+		wantErr  bool
+	}{
+		{"qualified", "shop1-42", "shop1", "Cafe", 42, false},
+		{"bare number", "42", "shop1", "Cafe", 42, false},
+		{"bare number without an instance", "42", "", "Order", 42, false},
+		{"configured prefix", "Cafe42", "shop1", "Cafe", 42, false},
+		{"legacy prefix", "Order42", "shop1", "Cafe", 42, false},
+		{"legacy prefix without an instance", "Order42", "", "Order", 42, false},
+		{"largest order", "shop1-9223372036854775807", "shop1", "Cafe", 9223372036854775807, false},
+		{"other instance", "shop2-42", "shop1", "Cafe", 0, true},
+		{"qualified without an instance", "shop1-42", "", "Order", 0, true},
+		{"other prefix", "Bistro42", "shop1", "Cafe", 0, true},
+		{"no number", "shop1-", "shop1", "Cafe", 0, true},
+		{"prefix only", "Order", "", "Order", 0, true},
+		{"signed", "shop1-+42", "shop1", "Cafe", 0, true},
+		{"overflow", "shop1-9223372036854775808", "shop1", "Cafe", 0, true},
+		{"empty", "", "shop1", "Cafe", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePaymentID(tt.id, tt.instance, tt.prefix)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsePaymentID(%q) = %d, want an error", tt.id, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePaymentID(%q): %v", tt.id, err)
+			}
+			if got != tt.want {
+				t.Errorf("parsePaymentID(%q) = %d, want %d", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPaymentIDRoundTrip(t *testing.T) {
+	for _, instance := range []string{"", "shop1", strings.Repeat("z", 16)} {
+		for _, orderID := range []int64{0, 1, 42, 9223372036854775807} {
+			id := paymentID(instance, orderID)
+			if len(id) > pfMaxPaymentID {
+				t.Errorf("paymentID(%q, %d) is %d characters", instance, orderID, len(id))
+			}
+			got, err := parsePaymentID(id, instance, "Cafe")
+			if err != nil || got != orderID {
+				t.Errorf("parsePaymentID(%q) = %d, %v; want %d", id, got, err, orderID)
+			}
+		}
+	}
+}
+
+func TestValidatePaymentNaming(t *testing.T) {
+	// The longest prefix whose item names still fit.
+	longest := strings.Repeat("P", pfMaxItemName-1-len(longestOrderRef))
+	tests := []struct {
+		name     string
+		instance string
+		prefix   string
+		wantErr  string
+	}{
+		{"defaults", "", "Order", ""},
+		{"instance", "shop1", "Cafe", ""},
+		{"longest instance", strings.Repeat("z", 16), "Cafe", ""},
+		{"instance too long", strings.Repeat("z", 17), "Cafe", "INSTANCE_ID"},
+		{"instance with a dash", "shop-1", "Cafe", "INSTANCE_ID"},
+		{"empty prefix", "shop1", "", "ITEM_NAME_PREFIX"},
+		{"non-ASCII prefix", "shop1", "Café", "ITEM_NAME_PREFIX"},
+		{"longest prefix", "shop1", longest, ""},
+		{"prefix one too long", "shop1", longest + "P", "PayFast allows 100"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePaymentNaming(tt.instance, tt.prefix)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validatePaymentNaming(%q, %q): %v", tt.instance, tt.prefix, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validatePaymentNaming(%q, %q) = %v, want an error mentioning %s", tt.instance, tt.prefix, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JeremyJalpha/MenuBot_WebAPI/httpapi"
+	"github.com/go-chi/chi/v5"
+)
+
+// Verified ITNs are stored, marked as such, before anything is done with
+// them and then processed in the background, retried a few times, and parked as dead
+// letters when they still fail. A dead letter waits for someone to fix
+// whatever was wrong and re-drive it.
+
+const (
+	itnAttempts = 3
+	itnBackoff  = 5 * time.Second
+	// itnSweep picks up notifications left pending by a restart or a
+	// re-drive that missed its wake-up.
+	itnSweep = time.Minute
+)
+
+// errNeedsHuman marks processing failures that retrying won't fix, such as
+// an amount mismatch; they go straight to the dead letters.
+var errNeedsHuman = errors.New("needs attention")
+
+type itnAttempt struct {
+	At    time.Time `json:"at"`
+	Error string    `json:"error"`
+}
+
+// storeNotification saves a verified ITN for processing. It reports false
+// for a payment ID and status it has already seen; the same payment can
+// come back later as a reversal.
+func storeNotification(db *sql.DB, orderData OrderData, raw string) (bool, error) {
+	if !orderData.Verified {
+		return false, fmt.Errorf("ITN %s for order %s was never verified", orderData.PfPaymentID, orderData.OrderID)
+	}
+	payload, err := sealField(fieldITNPayload, raw)
+	if err != nil {
+		return false, err
+	}
+	res, err := db.Exec(`INSERT INTO payment_notifications (pf_payment_id, payment_status, order_ref, payload, verified) VALUES ($1, $2, $3, $4, true)
+		ON CONFLICT (pf_payment_id, payment_status) DO NOTHING`,
+		orderData.PfPaymentID, strings.ToUpper(orderData.PaymentStatus), orderData.OrderID, payload)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// paymentPipeline processes stored notifications one at a time, in the
+// order they arrived. Only the leader runs it.
+type paymentPipeline struct {
+	cc     *commandContext
+	wakeup chan struct{}
+}
+
+func newPaymentPipeline(cc *commandContext) *paymentPipeline {
+	return &paymentPipeline{cc: cc, wakeup: make(chan struct{}, 1)}
+}
+
+func (p *paymentPipeline) wake() {
+	select {
+	case p.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (p *paymentPipeline) run() {
+	for {
+		if err := p.processPending(); err != nil {
+			log.Printf("Payment pipeline: reading pending notifications failed: %v", err)
+		}
+		select {
+		case <-p.wakeup:
+		case <-time.After(itnSweep):
+		}
+	}
+}
+
+func (p *paymentPipeline) processPending() error {
+	rows, err := p.cc.db.Query(`SELECT id, payload, verified FROM payment_notifications WHERE state = 'pending' ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		id       int64
+		raw      string
+		verified bool
+	}
+	var due []pending
+	for rows.Next() {
+		var n pending
+		if err := rows.Scan(&n.id, &n.raw, &n.verified); err != nil {
+			rows.Close()
+			return err
+		}
+		raw, err := openField(fieldITNPayload, n.raw)
+		if err != nil {
+			// Left pending, so it is processed once the key is back.
+			log.Printf("Payment notification %d can't be read, skipping it: %v", n.id, err)
+			continue
+		}
+		n.raw = raw
+		due = append(due, n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, n := range due {
+		p.process(n.id, n.raw, n.verified)
+	}
+	return nil
+}
+
+func (p *paymentPipeline) process(id int64, raw string, verified bool) {
+	var history []itnAttempt
+	var err error
+	orderRef := ""
+	for attempt := 1; attempt <= itnAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt-1) * itnBackoff)
+		}
+		var params []itnParam
+		var orderData OrderData
+		if params, err = httpapi.ParseITNParams(raw); err == nil {
+			if orderData, err = httpapi.CompileOrderData(httpapi.ITNValues(params)); err == nil {
+				orderRef = orderData.OrderID
+				orderData.Verified = verified
+				err = processNotification(p.cc, orderData)
+			} else {
+				err = fmt.Errorf("%w: %v", errNeedsHuman, err)
+			}
+		} else {
+			err = fmt.Errorf("%w: %v", errNeedsHuman, err)
+		}
+		if _, dbErr := p.cc.db.Exec(`UPDATE payment_notifications SET attempts = attempts + 1 WHERE id = $1`, id); dbErr != nil {
+			log.Printf("Payment pipeline: counting attempt on notification %d failed: %v", id, dbErr)
+		}
+		if err == nil {
+			if _, err := p.cc.db.Exec(`UPDATE payment_notifications SET state = 'processed', processed_at = now() WHERE id = $1`, id); err != nil {
+				log.Printf("Payment pipeline: marking notification %d processed failed: %v", id, err)
+			}
+			return
+		}
+		log.Printf("Payment pipeline: notification %d, attempt %d: %v", id, attempt, err)
+		history = append(history, itnAttempt{At: time.Now().UTC(), Error: err.Error()})
+		if errors.Is(err, errNeedsHuman) {
+			break
+		}
+	}
+	if err := deadLetter(p.cc, id, orderRef, err, history); err != nil {
+		// Left pending, so the next sweep tries again.
+		log.Printf("Payment pipeline: dead-lettering notification %d failed: %v", id, err)
+	}
+}
+
+// deadLetter parks a notification that failed processing and alerts the
+// admin when it's the first open one, so a backlog doesn't ping per item.
+func deadLetter(cc *commandContext, notificationID int64, orderRef string, cause error, history []itnAttempt) error {
+	attempts, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+	tx, err := cc.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var before int
+	if err := tx.QueryRow(`SELECT count(*) FROM dead_letters WHERE state = 'open'`).Scan(&before); err != nil {
+		return err
+	}
+	var id int64
+	err = tx.QueryRow(`INSERT INTO dead_letters (notification_id, error, attempts) VALUES ($1, $2, $3)
+		ON CONFLICT (notification_id) DO UPDATE SET error = EXCLUDED.error, attempts = dead_letters.attempts || EXCLUDED.attempts,
+			state = 'open', updated_at = now()
+		RETURNING id`, notificationID, cause.Error(), string(attempts)).Scan(&id)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE payment_notifications SET state = 'dead' WHERE id = $1`, notificationID); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	metrics.Inc("menubot_dead_letters_total", "Payment notifications that failed processing.")
+	i := cc.incidents.Record(incidentITNDeadLetter, "", 0, cause,
+		fmt.Sprintf("Payment pipeline: notification %d for order %s is dead letter %d", notificationID, orderRef, id))
+	if before == 0 {
+		cc.sender.Send(cc.envVars.AdminNumber, fmt.Sprintf("A PayFast payment for order %s could not be processed (%s): %v\n"+
+			"List dead letters with GET %s/dead-letters and re-drive this one with POST %s/dead-letters/%d/redrive once it's fixed.",
+			orderRef, i.Ref(), cause, apiBaseURL, apiBaseURL, id), priorityNotify)
+	}
+	return nil
+}
+
+type deadLetterView struct {
+	ID             int64           `json:"id"`
+	NotificationID int64           `json:"notification_id"`
+	OrderRef       string          `json:"order_ref"`
+	PfPaymentID    string          `json:"pf_payment_id"`
+	Payload        string          `json:"payload"`
+	Error          string          `json:"error"`
+	Attempts       json.RawMessage `json:"attempts"`
+	State          string          `json:"state"`
+	CreatedAt      time.Time       `json:"created_at"`
+	UpdatedAt      time.Time       `json:"updated_at"`
+	RedrivenAt     *time.Time      `json:"redriven_at,omitempty"`
+}
+
+// ListDeadLettersHandler lists open dead letters, or all of them with
+// ?all=true.
+func ListDeadLettersHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := `SELECT d.id, d.notification_id, n.order_ref, n.pf_payment_id, n.payload, d.error, d.attempts, d.state,
+			d.created_at, d.updated_at, d.redriven_at
+			FROM dead_letters d JOIN payment_notifications n ON n.id = d.notification_id`
+		if all, _ := strconv.ParseBool(r.URL.Query().Get("all")); !all {
+			query += ` WHERE d.state = 'open'`
+		}
+		rows, err := db.Query(query + ` ORDER BY d.id`)
+		if err != nil {
+			log.Printf("Listing dead letters failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "listing dead letters failed")
+			return
+		}
+		defer rows.Close()
+		letters := []deadLetterView{}
+		for rows.Next() {
+			var d deadLetterView
+			var attempts []byte
+			if err := rows.Scan(&d.ID, &d.NotificationID, &d.OrderRef, &d.PfPaymentID, &d.Payload, &d.Error, &attempts, &d.State,
+				&d.CreatedAt, &d.UpdatedAt, &d.RedrivenAt); err != nil {
+				log.Printf("Listing dead letters failed: %v", err)
+				writeJSONError(w, http.StatusInternalServerError, "listing dead letters failed")
+				return
+			}
+			if d.Payload, err = openField(fieldITNPayload, d.Payload); err != nil {
+				log.Printf("Listing dead letters failed: reading the payload of notification %d: %v", d.NotificationID, err)
+				writeJSONError(w, http.StatusInternalServerError, "listing dead letters failed")
+				return
+			}
+			d.Attempts = attempts
+			letters = append(letters, d)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Listing dead letters failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "listing dead letters failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, letters)
+	}
+}
+
+type redriveResponse struct {
+	ID             int64  `json:"id"`
+	NotificationID int64  `json:"notification_id"`
+	State          string `json:"state"`
+}
+
+// RedriveDeadLetterHandler puts a dead letter's notification back in the
+// pipeline. If it fails again it returns to the same dead letter, with the
+// new attempts added to its history.
+func RedriveDeadLetterHandler(cc *commandContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "deadLetterID"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid dead letter id")
+			return
+		}
+		tx, err := cc.db.Begin()
+		if err != nil {
+			log.Printf("Re-driving dead letter %d failed: %v", id, err)
+			writeJSONError(w, http.StatusInternalServerError, "re-driving dead letter failed")
+			return
+		}
+		defer tx.Rollback()
+		var notificationID int64
+		err = tx.QueryRow(`UPDATE dead_letters SET state = 'redriven', redriven_at = now(), updated_at = now()
+			WHERE id = $1 AND state = 'open' RETURNING notification_id`, id).Scan(&notificationID)
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusNotFound, "no open dead letter with that id")
+			return
+		}
+		if err == nil {
+			_, err = tx.Exec(`UPDATE payment_notifications SET state = 'pending' WHERE id = $1`, notificationID)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Re-driving dead letter %d failed: %v", id, err)
+			writeJSONError(w, http.StatusInternalServerError, "re-driving dead letter failed")
+			return
+		}
+		log.Printf("Dead letter %d re-driven", id)
+		cc.payments.wake()
+		writeJSON(w, http.StatusAccepted, redriveResponse{ID: id, NotificationID: notificationID, State: "redriven"})
+	}
+}
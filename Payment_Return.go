@@ -1,212 +1,334 @@
-package main
-
-import (
-	"crypto/md5"
-	"encoding/hex"
-	"fmt"
-	"html/template"
-	"io"
-	"log"
-	"net"
-	"net/http"
-	"net/url"
-	"strings"
-)
-
-type OrderData struct {
-	OrderID       string
-	PfPaymentID   string
-	PaymentStatus string
-	ItemName      string
-}
-
-func PaymentReturnHandler(tpl *template.Template) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		tpl.ExecuteTemplate(w, tpl.Name(), "")
-	}
-}
-
-func PaymentCancelHandler(tpl *template.Template) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		tpl.ExecuteTemplate(w, tpl.Name(), "")
-	}
-}
-
-func compileOrderData(r *http.Request) (OrderData, error) {
-	// Extract the orderID from the URL
-	orderID := r.URL.Query().Get("m_payment_id")
-	pfPaymentID := r.URL.Query().Get("pf_payment_id")
-	paymentStatus := r.URL.Query().Get("payment_status")
-	itemName := r.URL.Query().Get("item_name")
-
-	// Collect names of missing required fields
-	var missingFields []string
-	if orderID == "" {
-		missingFields = append(missingFields, "m_payment_id")
-	}
-	if pfPaymentID == "" {
-		missingFields = append(missingFields, "pf_payment_id")
-	}
-	if paymentStatus == "" {
-		missingFields = append(missingFields, "payment_status")
-	}
-	if itemName == "" {
-		missingFields = append(missingFields, "item_name")
-	}
-
-	// If any required fields are missing, return an error
-	if len(missingFields) > 0 {
-		return OrderData{}, fmt.Errorf("missing required order data: %s", strings.Join(missingFields, ", "))
-	}
-
-	orderData := OrderData{
-		OrderID:       orderID,
-		PfPaymentID:   pfPaymentID,
-		PaymentStatus: paymentStatus,
-		ItemName:      itemName,
-	}
-
-	return orderData, nil
-}
-
-func PaymentNotifyHandler(passPhrase, pfHost string) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Respond to the payment notification
-		w.WriteHeader(http.StatusOK)
-		_, err := w.Write([]byte("Success"))
-		if err != nil {
-			log.Println("error writing response: ", err)
-		}
-
-		// Read the OrderID from The URL then pass it to SetCartFromDB
-		itemID := r.URL.Query().Get("item_name")
-		log.Println(strings.TrimPrefix(itemID, ItemNamePrefix))
-
-		orderData, err := compileOrderData(r)
-		if err != nil {
-			log.Printf("Post payment check: compiling order data from payFast response failed: %v", err)
-			return
-		}
-
-		orderMap := orderDataToMap(orderData)
-		summedOrderData := checkPaymentResult(orderMap)
-
-		if !pfValidSignature(orderMap, summedOrderData, passPhrase) {
-			log.Printf("Post payment check: Signature validity test failed - payment gateway data: %v", orderData)
-		}
-		if !pfValidIP(r.Host) {
-			log.Printf("Post payment check: Server IP test failed - payment gateway data: %v", orderData)
-		}
-		if pfValidServerConfirmation(summedOrderData, pfHost) {
-			log.Printf("Post payment check: Server confirmation test failed - payment gateway data: %v", orderData)
-		}
-	}
-}
-
-func orderDataToMap(orderData OrderData) map[string]string {
-	return map[string]string{
-		"m_payment_id":   orderData.OrderID,
-		"pf_payment_id":  orderData.PfPaymentID,
-		"payment_status": orderData.PaymentStatus,
-		"item_name":      orderData.ItemName,
-	}
-}
-
-func checkPaymentResult(orderData map[string]string) string {
-	// Strip any slashes in data (not needed in Go)
-	for key, val := range orderData {
-		orderData[key] = val
-	}
-
-	// Convert posted variables to a string
-	var summedOrderData string
-	for key, val := range orderData {
-		if key != "signature" {
-			summedOrderData += key + "=" + url.QueryEscape(val) + "&"
-		} else {
-			break
-		}
-	}
-
-	return strings.TrimSuffix(summedOrderData, "&")
-}
-
-func pfValidSignature(orderData map[string]string, summedOrderData, passPhrase string) bool {
-	var tempParamString string
-	if passPhrase == "" {
-		tempParamString = summedOrderData
-	} else {
-		tempParamString = summedOrderData + "&passphrase=" + url.QueryEscape(passPhrase)
-	}
-
-	hash := md5.New()
-	hash.Write([]byte(tempParamString))
-	calculatedSignature := hex.EncodeToString(hash.Sum(nil))
-
-	return orderData["signature"] == calculatedSignature
-}
-
-func pfValidIP(referrerURL string) bool {
-	// Valid hosts
-	validHosts := []string{
-		"www.payfast.co.za",
-		"sandbox.payfast.co.za",
-		"w1w.payfast.co.za",
-		"w2w.payfast.co.za",
-	}
-
-	// Get IP addresses for valid hosts
-	var validIps []string
-	for _, pfHostname := range validHosts {
-		ips, err := net.LookupIP(pfHostname)
-		if err == nil {
-			for _, ip := range ips {
-				validIps = append(validIps, ip.String())
-			}
-		}
-	}
-
-	// Remove duplicates
-	uniqueIps := make(map[string]bool)
-	for _, ip := range validIps {
-		uniqueIps[ip] = true
-	}
-
-	// Get IP address from referrer URL
-	referrerHost := strings.TrimPrefix(referrerURL, "http://")
-	referrerHost = strings.TrimPrefix(referrerHost, "https://")
-	referrerHost = strings.Split(referrerHost, "/")[0]
-	referrerIp, err := net.LookupIP(referrerHost)
-	if err != nil {
-		return false
-	}
-
-	// Check if referrer IP is valid
-	return uniqueIps[referrerIp[0].String()]
-}
-
-func pfValidServerConfirmation(summedOrderData, pfHost string) bool {
-	url := fmt.Sprintf("https://%s/eng/query/validate", pfHost)
-
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", url, strings.NewReader(summedOrderData))
-	if err != nil {
-		log.Printf("Error creating request: %v", err)
-		return false
-	}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Printf("Error sending request: %v", err)
-		return false
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		return false
-	}
-
-	return string(body) == "VALID"
-}
+package main
+
+import (
+	"crypto/md5"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JeremyJalpha/MenuBot_WebAPI/httpapi"
+)
+
+// The ITN types and parsing live with the notify handler, see httpapi.
+type (
+	paymentNotificationEvent = httpapi.PaymentNotificationEvent
+	OrderData                = httpapi.OrderData
+	itnParam                 = httpapi.ITNParam
+)
+
+// defaultTrustedProxies covers a tunnel agent, such as ngrok's, running on
+// this host.
+const defaultTrustedProxies = "127.0.0.1/32,::1/128"
+
+// remoteIP returns the address a request came from. X-Forwarded-For is only
+// believed when the peer is one of TRUSTED_PROXIES, and then the client is
+// the right-most hop that isn't: anything left of it was written by the
+// client and proves nothing. Everything keyed on the address (the ITN
+// source check, the rate limits and their allowlist, the audit logs) relies
+// on this.
+func remoteIP(r *http.Request) string {
+	return clientIP(r, cfg().TrustedProxies)
+}
+
+func clientIP(r *http.Request, trusted []*net.IPNet) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if !inNets(peer, trusted) {
+		return peer
+	}
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !inNets(hops[i], trusted) {
+			return hops[i]
+		}
+	}
+	if len(hops) > 0 {
+		return hops[0]
+	}
+	return peer
+}
+
+// inNets reports whether ip is in one of nets.
+func inNets(ip string, nets []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// orderReceipt fills the CustomerOrder template. The page is reachable by
+// anyone who has the return URL, so the number is masked.
+func orderReceipt(db *sql.DB, vp versionedPricelist, order orderSummary) (customerOrderData, error) {
+	lines, err := orderItems(db, order.ID)
+	if err != nil {
+		return customerOrderData{}, err
+	}
+	quoted, err := orderQuotedPrices(db, order.ID)
+	if err != nil {
+		return customerOrderData{}, err
+	}
+	discount, err := orderDiscount(db, order.ID)
+	if err != nil {
+		return customerOrderData{}, err
+	}
+	surcharge, err := orderSurcharge(db, order.ID)
+	if err != nil {
+		return customerOrderData{}, err
+	}
+	total := order.Total
+	if t, err := strconv.ParseFloat(order.Total, 64); err == nil {
+		total = strconv.FormatFloat(payableAmount(t, surcharge, discount), 'f', 2, 64)
+	}
+	return customerOrderData{
+		OrderID:    strconv.FormatInt(order.ID, 10),
+		OrderRef:   order.reference(),
+		CellNumber: maskPhoneNumber(order.CellNumber),
+		OrderItems: receiptLines(orderLineDetails(vp, lines, quoted)),
+		OrderTotal: total,
+	}, nil
+}
+
+// processNotification applies a verified ITN to its order. Errors wrapping
+// errNeedsHuman won't go away by retrying.
+func processNotification(cc *commandContext, orderData OrderData) error {
+	if !orderData.Verified {
+		// Rows stored before the flag existed, or put there by hand.
+		return fmt.Errorf("%w: ITN %s for order %s was never verified", errNeedsHuman, orderData.PfPaymentID, orderData.OrderID)
+	}
+	status := strings.ToUpper(orderData.PaymentStatus)
+	if status != pfComplete && status != pfFailed && status != pfCancelled && !pfReversals[status] {
+		return nil
+	}
+	db, payfastMode := cc.db, cc.envVars.PayFastMode
+	orderID, err := parsePaymentID(orderData.OrderID, cc.envVars.InstanceID, cc.envVars.ItemNamePrefix)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errNeedsHuman, err)
+	}
+	// The ITN was confirmed against our own PFHOST, so it belongs to
+	// the running mode; an order quoted under the other mode must not
+	// be confirmed by it.
+	if orderMode, err := orderPayFastMode(db, orderID); err != nil {
+		return fmt.Errorf("reading mode of order %d: %w", orderID, err)
+	} else if orderMode != "" && orderMode != payfastMode {
+		return fmt.Errorf("%w: %s ITN for order %d created in %s mode", errNeedsHuman, payfastMode, orderID, orderMode)
+	}
+	// The order total was computed from the customer's tier prices
+	// when the cart was built, so it is what PayFast must have charged.
+	order, found, err := getOrder(db, orderID)
+	if err != nil {
+		return fmt.Errorf("reading order %d: %w", orderID, err)
+	}
+	if !found {
+		return fmt.Errorf("%w: order %d does not exist", errNeedsHuman, orderID)
+	}
+	if err := checkITNBuyer(db, order, orderData); err != nil {
+		return err
+	}
+	action, err := notificationAction(order, orderData)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case itnIgnore:
+		log.Printf("Ignoring %s ITN %s for order %d, which is already %s",
+			orderData.PaymentStatus, orderData.PfPaymentID, order.ID, order.Status)
+		return nil
+	case itnRetry:
+		return failedPayment(cc, order, orderData)
+	case itnDispute:
+		return reversedPayment(cc, order, orderData)
+	}
+	discount, err := orderDiscount(db, orderID)
+	if err != nil {
+		return fmt.Errorf("reading discount of order %d: %w", orderID, err)
+	}
+	surcharge, err := orderSurcharge(db, orderID)
+	if err != nil {
+		return fmt.Errorf("reading options of order %d: %w", orderID, err)
+	}
+	if !amountsMatch(order.Total, surcharge, discount, orderData.AmountGross) {
+		return fmt.Errorf("%w: order %d paid %s but the order total is %s plus %.2f options less %.2f",
+			errNeedsHuman, orderID, orderData.AmountGross, order.Total, surcharge, discount)
+	}
+	if selfTest, err := isSelfTestOrder(db, orderID); err != nil {
+		return fmt.Errorf("reading order %d: %w", orderID, err)
+	} else if selfTest {
+		// The self-test's order only has to reach paid: it earns no
+		// points and goes to no kitchen.
+		_, err := markOrderPaid(db, orderID, orderData.PfPaymentID, payfastMode)
+		return err
+	}
+	paid, err := markPaidAndSettle(db, orderID, order.CellNumber, orderData, payfastMode)
+	if err != nil {
+		return fmt.Errorf("marking order %d paid: %w", orderID, err)
+	}
+	if !paid {
+		return nil
+	}
+	recordFunnel(db, funnelITNConfirmed, order.CellNumber, orderID)
+	cc.orderPaid(orderID, order.CellNumber, orderData.AmountGross)
+	return nil
+}
+
+// markPaidAndSettle marks the order paid and settles its loyalty points and
+// any referral credit in one transaction, so a retried ITN can't credit or
+// charge points twice.
+func markPaidAndSettle(db *sql.DB, orderID int64, cellNumber string, orderData OrderData, payfastMode string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	paid, err := markOrderPaid(tx, orderID, orderData.PfPaymentID, payfastMode)
+	if err != nil || !paid {
+		return false, err
+	}
+	if err := settleLoyalty(tx, orderID, cellNumber, orderData.AmountGross); err != nil {
+		return false, err
+	}
+	if err := creditReferral(tx, orderID, cellNumber); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// amountsMatch compares the order's payable amount with the amount paid,
+// to the cent. An order without a stored total can't be checked, so it
+// doesn't match anything.
+func amountsMatch(orderTotal string, surcharge, discount float64, amountGross string) bool {
+	total, err1 := strconv.ParseFloat(orderTotal, 64)
+	paid, err2 := strconv.ParseFloat(amountGross, 64)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return math.Round(payableAmount(total, surcharge, discount)*100) == math.Round(paid*100)
+}
+
+func checkPaymentResult(params []itnParam) string {
+	// Convert posted variables to a string, in the order they were posted
+	var summedOrderData string
+	for _, p := range params {
+		if p.Key != "signature" {
+			summedOrderData += p.Key + "=" + pfEncode(p.Value) + "&"
+		}
+	}
+
+	return strings.TrimSuffix(summedOrderData, "&")
+}
+
+func pfValidSignature(signature, summedOrderData, passPhrase string) bool {
+	return signature == pfSignature(summedOrderData, passPhrase)
+}
+
+// pfSignature is PayFast's MD5 signature over the encoded parameter string.
+func pfSignature(summedOrderData, passPhrase string) string {
+	var tempParamString string
+	if passPhrase == "" {
+		tempParamString = summedOrderData
+	} else {
+		tempParamString = summedOrderData + "&passphrase=" + pfEncode(passPhrase)
+	}
+
+	hash := md5.New()
+	hash.Write([]byte(tempParamString))
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func pfValidIP(referrerURL string) bool {
+	// Valid hosts
+	validHosts := []string{
+		"www.payfast.co.za",
+		"sandbox.payfast.co.za",
+		"w1w.payfast.co.za",
+		"w2w.payfast.co.za",
+	}
+
+	// Get IP addresses for valid hosts
+	var validIps []string
+	for _, pfHostname := range validHosts {
+		ips, err := net.LookupIP(pfHostname)
+		if err == nil {
+			for _, ip := range ips {
+				validIps = append(validIps, ip.String())
+			}
+		}
+	}
+
+	// Remove duplicates
+	uniqueIps := make(map[string]bool)
+	for _, ip := range validIps {
+		uniqueIps[ip] = true
+	}
+
+	// Get IP address from referrer URL
+	referrerHost := strings.TrimPrefix(referrerURL, "http://")
+	referrerHost = strings.TrimPrefix(referrerHost, "https://")
+	referrerHost = strings.Split(referrerHost, "/")[0]
+	referrerIp, err := net.LookupIP(referrerHost)
+	if err != nil {
+		return false
+	}
+
+	// Check if referrer IP is valid
+	return uniqueIps[referrerIp[0].String()]
+}
+
+// pfHostname accepts PFHOST either as a bare hostname or as the full
+// process URL, e.g. https://sandbox.payfast.co.za/eng/process.
+func pfHostname(pfHost string) string {
+	if u, err := url.Parse(pfHost); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return pfHost
+}
+
+func pfValidServerConfirmation(summedOrderData, pfHost string) bool {
+	url := fmt.Sprintf("https://%s/eng/query/validate", pfHostname(pfHost))
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, err := http.NewRequest("POST", url, strings.NewReader(summedOrderData))
+	if err != nil {
+		log.Printf("Error creating request: %v", err)
+		return false
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("Error sending request: %v", err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Printf("Error reading response body: %v", err)
+		return false
+	}
+
+	return string(body) == "VALID"
+}
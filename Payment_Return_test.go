@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted, err := parseCIDRList("127.0.0.1/32,10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded []string
+		want      string
+	}{
+		{"direct", "203.0.113.7:4000", nil, "203.0.113.7"},
+		{"untrusted peer can't forward", "203.0.113.7:4000", []string{"197.97.145.145"}, "203.0.113.7"},
+		{"trusted proxy", "127.0.0.1:4000", []string{"203.0.113.7"}, "203.0.113.7"},
+		{"spoofed left-most hop ignored", "127.0.0.1:4000", []string{"197.97.145.145, 203.0.113.7"}, "203.0.113.7"},
+		{"chained trusted proxies skipped", "127.0.0.1:4000", []string{"198.51.100.1, 203.0.113.7, 10.1.2.3"}, "203.0.113.7"},
+		{"several headers", "127.0.0.1:4000", []string{"198.51.100.1", "203.0.113.7"}, "203.0.113.7"},
+		{"all hops trusted", "127.0.0.1:4000", []string{"10.0.0.1, 10.0.0.2"}, "10.0.0.1"},
+		{"trusted proxy without header", "127.0.0.1:4000", nil, "127.0.0.1"},
+		{"no port", "203.0.113.7", []string{"198.51.100.1"}, "203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/notify", nil)
+			r.RemoteAddr = tt.peer
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientIP(r, trusted); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAmountsMatch(t *testing.T) {
+	tests := []struct {
+		name                string
+		total, paid         string
+		surcharge, discount float64
+		want                bool
+	}{
+		{"exact", "100.00", "100.00", 0, 0, true},
+		{"to the cent", "99.999", "100.00", 0, 0, true},
+		{"underpaid", "100.00", "99.99", 0, 0, false},
+		{"options and discount", "100.00", "105.00", 15, 10, true},
+		{"no stored total", "", "100.00", 0, 0, false},
+		{"no amount paid", "100.00", "", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := amountsMatch(tt.total, tt.surcharge, tt.discount, tt.paid); got != tt.want {
+				t.Errorf("amountsMatch(%q, %v, %v, %q) = %v, want %v", tt.total, tt.surcharge, tt.discount, tt.paid, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnverifiedITN(t *testing.T) {
+	orderData := OrderData{OrderID: "42", PfPaymentID: "pf-1", PaymentStatus: pfComplete, AmountGross: "100.00"}
+	if stored, err := storeNotification(nil, orderData, "payment_status=COMPLETE"); stored || err == nil {
+		t.Errorf("storeNotification = %v, %v, want it refused", stored, err)
+	}
+	if err := processNotification(&commandContext{}, orderData); !errors.Is(err, errNeedsHuman) {
+		t.Errorf("processNotification = %v, want a dead letter", err)
+	}
+}
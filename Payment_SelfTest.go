@@ -0,0 +1,374 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JeremyJalpha/MenuBot_WebAPI/httpapi"
+)
+
+// The PayFast self-test pays R5 for a synthetic order once a week, at
+// PAYFAST_SELFTEST, so an expired passphrase or changed merchant settings
+// show up before a customer runs into them. It signs a payment request,
+// has the sandbox accept it, feeds our notify handler the ITN PayFast
+// would send and waits for the order to be marked paid. The customer's
+// part on the sandbox page can't be automated, so the ITN is built here
+// and checked by signature alone; the rest of the way is the real one. In
+// live mode it needs a sandbox merchant of its own in
+// PAYFAST_SELFTEST_MERCHANTID and friends.
+//
+// Its order is tagged self_test while the test runs, which keeps it off
+// the dashboard and out of reconciliation and away from the kitchen and
+// loyalty, and is deleted afterwards.
+
+// Stages of the self-test, named in its result.
+const (
+	selfTestSetup     = "setup"
+	selfTestSignature = "signature build"
+	selfTestRedirect  = "redirect params"
+	selfTestITN       = "ITN validation"
+	selfTestOrder     = "order transition"
+)
+
+const (
+	selfTestAmount = "5.00"
+	// selfTestCell stands in for the customer; it is no phone number.
+	selfTestCell = "selftest"
+	// selfTestPaymentPrefix starts the pf_payment_id of the synthetic ITN,
+	// which PayFast's own never do.
+	selfTestPaymentPrefix = "selftest-"
+	// selfTestWait is how long the order gets to reach paid once the ITN
+	// is stored.
+	selfTestWait = time.Minute
+)
+
+// selfTestSchedule is when in the week the self-test runs, in the
+// business timezone.
+type selfTestSchedule struct {
+	Day    time.Weekday
+	Minute int
+}
+
+// parseSelfTestSchedule parses "Mon 04:00"; "off" disables the self-test.
+func parseSelfTestSchedule(s string) (*selfTestSchedule, error) {
+	if s == "off" {
+		return nil, nil
+	}
+	day, clock, _ := strings.Cut(strings.TrimSpace(s), " ")
+	weekday, ok := weekdayNames[strings.ToLower(day)]
+	if !ok {
+		return nil, fmt.Errorf("%q is not a weekday and time such as Mon 04:00", s)
+	}
+	minute, err := parseClock(strings.TrimSpace(clock))
+	if err != nil {
+		return nil, err
+	}
+	return &selfTestSchedule{Day: weekday, Minute: minute}, nil
+}
+
+func (s *selfTestSchedule) String() string {
+	if s == nil {
+		return "off"
+	}
+	return s.Day.String()[:3] + " " + formatClock(s.Minute)
+}
+
+// selfTestMerchant is the sandbox merchant the self-test pays with, and
+// false when there is none.
+func selfTestMerchant(env EnvVars) (merchantID, merchantKey, passphrase string, ok bool) {
+	if env.SelfTestMerchantId != "" {
+		return env.SelfTestMerchantId, env.SelfTestMerchantKey, env.SelfTestPassphrase, true
+	}
+	if env.PayFastMode == payfastSandbox {
+		return env.MerchantId, env.MerchantKey, env.Passphrase, true
+	}
+	return "", "", "", false
+}
+
+// selfTestError is a failed self-test and the stage it failed at.
+type selfTestError struct {
+	Stage string
+	Err   error
+}
+
+func (e *selfTestError) Error() string {
+	return e.Stage + ": " + e.Err.Error()
+}
+
+func failedAt(stage string, err error) error {
+	return &selfTestError{Stage: stage, Err: err}
+}
+
+// runPayFastSelfTest runs the self-test once. A failure is a
+// *selfTestError.
+func runPayFastSelfTest(cc *commandContext) error {
+	env, base := cc.envVars, cc.homebase.URL()
+	merchantID, merchantKey, passphrase, ok := selfTestMerchant(env)
+	if !ok {
+		return failedAt(selfTestSetup, errors.New("no sandbox merchant, set PAYFAST_SELFTEST_MERCHANTID in live mode"))
+	}
+	if err := deleteSelfTestOrders(cc.db); err != nil {
+		return failedAt(selfTestSetup, fmt.Errorf("removing earlier self-test orders: %w", err))
+	}
+	orderID, err := createSelfTestOrder(cc.db, env.PayFastMode)
+	if err != nil {
+		return failedAt(selfTestSetup, fmt.Errorf("creating the synthetic order: %w", err))
+	}
+	defer func() {
+		if err := deleteSelfTestOrders(cc.db); err != nil {
+			log.Printf("PayFast self-test: removing order %d failed: %v", orderID, err)
+		}
+	}()
+	itemName := pfText(orderItemName(env.ItemNamePrefix, formatOrderRef(env.OrderRefPrefix, time.Now(), orderID)), pfMaxItemName)
+
+	// The request is signed the way checkout links are and must check out
+	// the way ITNs are, or the two have drifted apart.
+	if merchantID == "" || merchantKey == "" {
+		return failedAt(selfTestSignature, errors.New("merchant ID or key is empty"))
+	}
+	fields := []itnParam{
+		{Key: "merchant_id", Value: merchantID},
+		{Key: "merchant_key", Value: merchantKey},
+		{Key: "return_url", Value: securedURL(base, returnBaseURL, env.ReturnPathSecrets)},
+		{Key: "cancel_url", Value: securedURL(base, cancelBaseURL, env.ReturnPathSecrets)},
+		{Key: "notify_url", Value: securedURL(base, notifyBaseURL, env.NotifyPathSecrets)},
+		{Key: "m_payment_id", Value: paymentID(env.InstanceID, orderID)},
+		{Key: "amount", Value: selfTestAmount},
+		{Key: "item_name", Value: itemName},
+	}
+	query := checkPaymentResult(fields)
+	signature := pfSignature(query, passphrase)
+	signed := query + "&signature=" + signature
+	params, err := httpapi.ParseITNParams(signed)
+	if err != nil {
+		return failedAt(selfTestSignature, fmt.Errorf("reading back the signed request: %w", err))
+	}
+	if !pfValidSignature(signature, checkPaymentResult(params), passphrase) {
+		return failedAt(selfTestSignature, errors.New("the request's signature doesn't verify the way ITNs are verified"))
+	}
+
+	if err := submitSandboxPayment(signed); err != nil {
+		return failedAt(selfTestRedirect, err)
+	}
+
+	pfPaymentID := selfTestPaymentPrefix + strconv.FormatInt(orderID, 10)
+	itn := []itnParam{
+		{Key: "m_payment_id", Value: paymentID(env.InstanceID, orderID)},
+		{Key: "pf_payment_id", Value: pfPaymentID},
+		{Key: "payment_status", Value: pfComplete},
+		{Key: "item_name", Value: itemName},
+		{Key: "amount_gross", Value: selfTestAmount},
+		{Key: "amount_fee", Value: "0.00"},
+		{Key: "amount_net", Value: selfTestAmount},
+		{Key: "merchant_id", Value: merchantID},
+	}
+	body := checkPaymentResult(itn)
+	body += "&signature=" + pfSignature(body, passphrase)
+	handlers := newPaymentHandlers(env,
+		dbOrderStore{db: cc.db, prclist: cc.prclist, instanceID: env.InstanceID, itemNamePrefix: env.ItemNamePrefix},
+		signatureVerifier{passphrase: passphrase},
+		pipelineQueue{db: cc.db, payments: cc.payments},
+		eventSinks(nil), nil, cc.homebase, cc.incidents)
+	req := httptest.NewRequest(http.MethodPost, notifyBaseURL, strings.NewReader(body))
+	req.Host = baseHost(base)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	handlers.Notify(httptest.NewRecorder(), req)
+	var notificationID int64
+	err = cc.db.QueryRow(`SELECT id FROM payment_notifications WHERE pf_payment_id = $1`, pfPaymentID).Scan(&notificationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return failedAt(selfTestITN, errors.New("the notify handler didn't accept the ITN, see the log"))
+	}
+	if err != nil {
+		return failedAt(selfTestITN, err)
+	}
+
+	deadline := time.Now().Add(selfTestWait)
+	for {
+		var state, status, lastError string
+		err := cc.db.QueryRow(`SELECT n.state, COALESCE(m.status, ''), COALESCE(d.error, '')
+			FROM payment_notifications n LEFT JOIN order_meta m ON m.order_id = $2
+			LEFT JOIN dead_letters d ON d.notification_id = n.id
+			WHERE n.id = $1`, notificationID, orderID).Scan(&state, &status, &lastError)
+		switch {
+		case err != nil:
+			return failedAt(selfTestOrder, err)
+		case status == statusPaid:
+			return nil
+		case lastError != "":
+			return failedAt(selfTestOrder, errors.New(lastError))
+		case state == "processed":
+			return failedAt(selfTestOrder, fmt.Errorf("the ITN was processed but the order is %s, not %s", status, statusPaid))
+		case time.Now().After(deadline):
+			return failedAt(selfTestOrder, fmt.Errorf("the order wasn't paid within %s, the ITN is %s", selfTestWait, state))
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// submitSandboxPayment posts a signed payment request to the sandbox. It
+// redirects to its payment page when it takes the request and answers
+// with an error page when it doesn't.
+func submitSandboxPayment(signed string) error {
+	client := &http.Client{
+		Timeout:       15 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Post("https://"+payfastSandboxHost+"/eng/process", "application/x-www-form-urlencoded", strings.NewReader(signed))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		return nil
+	}
+	page, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	return fmt.Errorf("the sandbox answered %s instead of redirecting to the payment page: %s", resp.Status, pageText(string(page), 200))
+}
+
+// pageText is the first n characters of an HTML page's text.
+func pageText(page string, n int) string {
+	var b strings.Builder
+	inTag := false
+	for _, r := range page {
+		switch {
+		case r == '<':
+			inTag = true
+		case r == '>':
+			inTag = false
+			b.WriteByte(' ')
+		case !inTag:
+			b.WriteRune(r)
+		}
+	}
+	text := strings.Join(strings.Fields(b.String()), " ")
+	if len(text) > n {
+		text = text[:n] + "..."
+	}
+	return text
+}
+
+// signatureVerifier checks an ITN by its signature only; the self-test's
+// synthetic ITN neither comes from PayFast's servers nor is known to them.
+type signatureVerifier struct {
+	passphrase string
+}
+
+func (v signatureVerifier) Verify(orderData OrderData, params []itnParam, _ string) bool {
+	return pfValidSignature(orderData.Signature, checkPaymentResult(params), v.passphrase)
+}
+
+// createSelfTestOrder adds a closed R5 order for the self-test to pay.
+func createSelfTestOrder(db *sql.DB, payfastMode string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var orderID int64
+	err = tx.QueryRow(`INSERT INTO `+orderTable+` (`+orderCellColumn+`, `+orderItemsColumn+`, `+orderTotalColumn+`)
+		VALUES ($1, '[]', $2) RETURNING `+orderIDColumn, selfTestCell, selfTestAmount).Scan(&orderID)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE `+orderTable+` SET `+orderClosedSet+` WHERE `+orderIDColumn+` = $1`, orderID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`INSERT INTO order_meta (order_id, pricelist_version, payfast_mode, self_test) VALUES ($1, 0, $2, true)`,
+		orderID, payfastMode); err != nil {
+		return 0, err
+	}
+	return orderID, tx.Commit()
+}
+
+// deleteSelfTestOrders removes the self-test's orders and their
+// notifications, including any a crash left behind.
+func deleteSelfTestOrders(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	statements := []string{
+		`DELETE FROM dead_letters WHERE notification_id IN
+			(SELECT id FROM payment_notifications WHERE pf_payment_id LIKE '` + selfTestPaymentPrefix + `%')`,
+		`DELETE FROM payment_notifications WHERE pf_payment_id LIKE '` + selfTestPaymentPrefix + `%'`,
+		`DELETE FROM ` + orderTable + ` WHERE ` + orderIDColumn + ` IN (SELECT order_id FROM order_meta WHERE self_test)`,
+		`DELETE FROM order_meta WHERE self_test`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func isSelfTestOrder(db *sql.DB, orderID int64) (bool, error) {
+	var selfTest bool
+	err := db.QueryRow(`SELECT self_test FROM order_meta WHERE order_id = $1`, orderID).Scan(&selfTest)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return selfTest, err
+}
+
+const jobPayFastSelfTest = "payfast-selftest"
+
+// payFastSelfTest runs the self-test and reports it: to the log, the
+// metrics, the payfast_selftests table and the admin.
+func payFastSelfTest(cc *commandContext) error {
+	err := runPayFastSelfTest(cc)
+	passed, stage, detail := err == nil, "", ""
+	var failure *selfTestError
+	if errors.As(err, &failure) {
+		stage, detail = failure.Stage, failure.Err.Error()
+	}
+	ok := 0.0
+	text := "PayFast self-test passed: a R5 sandbox payment went from signed request to paid order."
+	if passed {
+		ok = 1
+		log.Printf("PayFast self-test passed")
+	} else {
+		log.Printf("PayFast self-test failed at %s: %s", stage, detail)
+		text = fmt.Sprintf("PayFast self-test FAILED at %s: %s\n\nCustomer payments may be failing too.", stage, detail)
+	}
+	metrics.Set("menubot_payfast_selftest_ok", "1 when the last PayFast self-test passed, 0 when it failed.", ok)
+	metrics.Set("menubot_payfast_selftest_timestamp_seconds", "When the PayFast self-test last ran.", float64(time.Now().Unix()))
+	if _, err := cc.db.Exec(`INSERT INTO payfast_selftests (passed, stage, detail) VALUES ($1, $2, $3)`, passed, stage, detail); err != nil {
+		log.Printf("Recording PayFast self-test failed: %v", err)
+	}
+	cc.sendBulk(bulkMessage{Recipient: cc.envVars.AdminNumber, Text: text, Kind: bulkAdmin})
+	return err
+}
+
+// selfTestJobSchedule is the self-test job's schedule: PAYFAST_SELFTEST each
+// week, and never while it is off or there is no sandbox merchant to test
+// with.
+func selfTestJobSchedule(cc *commandContext) jobSchedule {
+	return func(last time.Time) time.Time {
+		schedule := cfg().SelfTest
+		if _, _, _, ok := selfTestMerchant(cc.envVars); !ok || schedule == nil {
+			return time.Time{}
+		}
+		return weeklyAt(schedule.Day, schedule.Minute/60, schedule.Minute%60)(last)
+	}
+}
+
+// adminSelfTest handles "selftest", running the PayFast self-test now.
+func adminSelfTest(cc *commandContext, _ []string) string {
+	if _, _, _, ok := selfTestMerchant(cc.envVars); !ok {
+		return "No sandbox merchant to test with: in live mode set PAYFAST_SELFTEST_MERCHANTID, PAYFAST_SELFTEST_MERCHANTKEY and PAYFAST_SELFTEST_PASSPHRASE."
+	}
+	if err := cc.jobs.Trigger(jobPayFastSelfTest); err != nil {
+		return fmt.Sprintf("Can't run the PayFast self-test: %v.", err)
+	}
+	return "Running the PayFast self-test, the result follows in a minute or so."
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// orderFulfilment is what the kitchen needs to know beyond the items.
+type orderFulfilment struct {
+	Method string // collection or delivery
+	Slot   string
+	Notes  string
+	// Recipient is who a gift goes to.
+	Recipient string
+	// Contact is who takes the order, when the customer named someone.
+	Contact string
+}
+
+func getOrderFulfilment(db *sql.DB, orderID int64) (orderFulfilment, error) {
+	var f orderFulfilment
+	err := db.QueryRow(`SELECT fulfilment, slot, notes FROM order_meta WHERE order_id = $1`, orderID).
+		Scan(&f.Method, &f.Slot, &f.Notes)
+	if errors.Is(err, sql.ErrNoRows) {
+		return orderFulfilment{Method: "collection"}, nil
+	}
+	if err != nil {
+		return f, err
+	}
+	f.Notes, err = openField(fieldOrderNotes, f.Notes)
+	return f, err
+}
+
+// formatPickList lays the order out for the kitchen: one line per item and
+// set of options so it can be ticked off, combos expanded into the items
+// to pack, and nothing about prices.
+func formatPickList(order orderSummary, variants []lineVariant, f orderFulfilment, vp versionedPricelist) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*ORDER %d* %s\n", order.ID, order.reference())
+	b.WriteString(strings.ToUpper(f.Method))
+	if f.Slot != "" {
+		fmt.Fprintf(&b, " - %s", f.Slot)
+	}
+	b.WriteString("\n\n")
+	for _, v := range variants {
+		name := itemRef(v.ItemID)
+		if it, ok := vp.Item(v.ItemID); ok {
+			name = ctlgItemName(it)
+		}
+		if v.Options != "" {
+			name += " (" + v.Options + ")"
+		}
+		fmt.Fprintf(&b, "%d x %s\n", v.Quantity, name)
+		for _, c := range vp.Combos[v.ItemID] {
+			fmt.Fprintf(&b, "   - %d x %s\n", c.Quantity*v.Quantity, vp.itemName(c.ItemID))
+		}
+	}
+	if f.Notes != "" {
+		fmt.Fprintf(&b, "\nNotes: %s\n", f.Notes)
+	}
+	fmt.Fprintf(&b, "\nCustomer: %s", order.CellNumber)
+	if f.Recipient != "" {
+		fmt.Fprintf(&b, "\nGift for: %s", f.Recipient)
+	}
+	if f.Contact != "" {
+		fmt.Fprintf(&b, "\nDeliver to: %s", f.Contact)
+	}
+	return b.String()
+}
+
+func buildPickList(cc *commandContext, orderID int64) (string, error) {
+	order, found, err := getOrder(cc.db, orderID)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("order %d not found", orderID)
+	}
+	lines, err := orderItems(cc.db, orderID)
+	if err != nil {
+		return "", fmt.Errorf("reading items: %w", err)
+	}
+	units, err := orderLineOptions(cc.db, orderID)
+	if err != nil {
+		return "", fmt.Errorf("reading options: %w", err)
+	}
+	f, err := getOrderFulfilment(cc.db, orderID)
+	if err != nil {
+		return "", fmt.Errorf("reading fulfilment: %w", err)
+	}
+	if g, found, err := getGift(cc.db, orderID); err != nil {
+		return "", fmt.Errorf("reading gift: %w", err)
+	} else if found && g.State == giftAccepted {
+		f.Recipient = g.Recipient
+	}
+	if c, found, err := getDeliveryContact(cc.db, orderID); err != nil {
+		return "", fmt.Errorf("reading delivery contact: %w", err)
+	} else if found {
+		f.Contact = c.String()
+	}
+	return formatPickList(order, orderVariants(lines, units), f, cc.prclist.Snapshot()), nil
+}
+
+// sendPickList sends the order's pick list to KITCHEN_NUMBER. Undelivered
+// pick lists end up in the outbox like any other message.
+func (cc *commandContext) sendPickList(orderID int64) {
+	text, err := buildPickList(cc, orderID)
+	if err != nil {
+		log.Printf("Pick list for order %d failed: %v", orderID, err)
+		return
+	}
+	cc.sender.SendOrder(cc.envVars.KitchenNumber, text, priorityNotify, orderID)
+}
+
+// adminReprint resends an order's pick list to the kitchen, e.g. after the
+// first one was lost or the order changed by hand.
+func adminReprint(cc *commandContext, args []string) string {
+	orderID, err := parseOrderIDArg(cc.db, args)
+	if err != nil {
+		return orderArgError(err, "Usage: reprint <order number or reference>")
+	}
+	text, err := buildPickList(cc, orderID)
+	if err != nil {
+		return fmt.Sprintf("Reprinting order %d failed: %v", orderID, err)
+	}
+	cc.sender.SendOrder(cc.envVars.KitchenNumber, text, priorityNotify, orderID)
+	return fmt.Sprintf("Pick list for order %d sent to the kitchen.", orderID)
+}
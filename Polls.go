@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// Choices with a fixed set of answers, an item's required options and a
+// gift's delivery slot, are asked in text as always and, for the steps in
+// POLL_STEPS, with a single-choice WhatsApp poll as well. A vote is
+// decrypted and handled as if its option had been typed. When the poll
+// can't be sent, or gets no vote within POLL_TIMEOUT, the options are sent
+// numbered and a number answers the step. Polls are only kept in memory:
+// a vote on one sent before a restart is ignored, and the customer can
+// still answer in text.
+
+const (
+	pollStepOptions  = "options"
+	pollStepGiftSlot = "gift_slot"
+	defaultPollSteps = pollStepOptions + "," + pollStepGiftSlot
+	// maxPollOptions is the most options WhatsApp puts in a poll.
+	maxPollOptions = 12
+	// pollKeep is how long a poll's votes are still told apart from votes
+	// on polls we never sent.
+	pollKeep       = 24 * time.Hour
+	pollTooLateMsg = "Too late to change that, reply \"edit\" to modify your order."
+)
+
+func parsePollSteps(s string) ([]string, error) {
+	steps := []string{}
+	if s == "none" {
+		return steps, nil
+	}
+	for _, step := range strings.Split(s, ",") {
+		switch step = strings.TrimSpace(step); step {
+		case "":
+		case pollStepOptions, pollStepGiftSlot:
+			if !slices.Contains(steps, step) {
+				steps = append(steps, step)
+			}
+		default:
+			return nil, fmt.Errorf("%q is not a choice step, use options or gift_slot", step)
+		}
+	}
+	return steps, nil
+}
+
+// choiceStep is a question the customer is being asked with a fixed set
+// of answers. Key tells one asking from the next, so a vote can be held
+// to the question it was cast on.
+type choiceStep struct {
+	Kind     string
+	Key      string
+	Question string
+	// Labels are the options as shown, Answers what picking each one says.
+	Labels  []string
+	Answers []string
+}
+
+// currentChoiceStep returns the choice the customer is being asked, if any.
+func currentChoiceStep(cc *commandContext, vp versionedPricelist, cell string, now time.Time) (choiceStep, bool) {
+	if p, ok := cc.modifierPrompts.current(cell); ok {
+		if g, open := nextRequiredGroup(vp.Modifiers[p.ItemID], p); open {
+			step := choiceStep{
+				Kind:     pollStepOptions,
+				Key:      fmt.Sprintf("%s:%d:%d:%s:%d", pollStepOptions, p.OrderID, p.ItemID, g.Name, len(p.Chosen)),
+				Question: choiceQuestion(vp, p, g),
+				Labels:   optionLabels(g),
+			}
+			for _, o := range g.Options {
+				step.Answers = append(step.Answers, o.Name)
+			}
+			return step, true
+		}
+	}
+	if slots := cfg().GiftSlots; len(slots) > 0 {
+		if orderID, state, found := answeringGift(cc.db, cell, now); found && state == giftAddress {
+			return choiceStep{
+				Kind:     pollStepGiftSlot,
+				Key:      fmt.Sprintf("%s:%d", pollStepGiftSlot, orderID),
+				Question: "When would suit you for the delivery?",
+				Labels:   slots,
+				Answers:  slots,
+			}, true
+		}
+	}
+	return choiceStep{}, false
+}
+
+func numberedOptions(options []string) string {
+	lines := make([]string, len(options))
+	for i, o := range options {
+		lines[i] = fmt.Sprintf("%d. %s", i+1, o)
+	}
+	return strings.Join(lines, "\n")
+}
+
+type sentPoll struct {
+	cell   string
+	chat   types.JID
+	step   choiceStep
+	sentAt time.Time
+	voted  bool
+}
+
+type choicePolls struct {
+	mu   sync.Mutex
+	byID map[string]*sentPoll
+	// asked is the step last offered to each customer, so a step gets one
+	// poll however many replies it sits through.
+	asked map[string]string
+}
+
+func newChoicePolls() *choicePolls {
+	return &choicePolls{byID: map[string]*sentPoll{}, asked: map[string]string{}}
+}
+
+// offer sends a poll for the choice the customer is being asked, unless
+// it already has one. It goes after the reply asking the question.
+func (cp *choicePolls) offer(cc *commandContext, chat types.JID, cell string, vp versionedPricelist) {
+	now := time.Now()
+	step, ok := currentChoiceStep(cc, vp, cell, now)
+	if !ok || !slices.Contains(cfg().PollSteps, step.Kind) || len(step.Labels) > maxPollOptions {
+		return
+	}
+	cp.mu.Lock()
+	if cp.asked[cell] == step.Key {
+		cp.mu.Unlock()
+		return
+	}
+	cp.asked[cell] = step.Key
+	for id, poll := range cp.byID {
+		if now.Sub(poll.sentAt) > pollKeep {
+			delete(cp.byID, id)
+		}
+	}
+	cp.mu.Unlock()
+
+	id, err := cc.sender.SendPoll(chat, step.Question, step.Labels, priorityReply)
+	if err != nil || id == "" {
+		if err != nil {
+			log.Printf("Sending poll to %s failed, sending numbered options: %v", cell, err)
+		}
+		cc.sender.SendTo(chat, "Reply with a number:\n"+numberedOptions(step.Labels), priorityReply)
+		return
+	}
+	metrics.Inc("menubot_polls_total", "Choice polls sent, by step.", "step", step.Kind)
+	cp.mu.Lock()
+	cp.byID[id] = &sentPoll{cell: cell, chat: chat, step: step, sentAt: now}
+	cp.mu.Unlock()
+	time.AfterFunc(cfg().PollTimeout, func() { cp.timeout(cc, id) })
+}
+
+// timeout sends a poll's options numbered when it has had no vote and its
+// step is still being asked.
+func (cp *choicePolls) timeout(cc *commandContext, id string) {
+	cp.mu.Lock()
+	poll, ok := cp.byID[id]
+	waiting := ok && !poll.voted
+	cp.mu.Unlock()
+	if !waiting {
+		return
+	}
+	unlock := cc.senders.Lock(poll.cell)
+	defer unlock()
+	now := time.Now()
+	if cc.takeovers.Active(poll.cell, now) {
+		return
+	}
+	vp := cc.prclist.Snapshot().ForTier(customerTier(cc.db, poll.cell))
+	if step, ok := currentChoiceStep(cc, vp, poll.cell, now); !ok || step.Key != poll.step.Key {
+		return
+	}
+	metrics.Inc("menubot_poll_timeouts_total", "Choice polls that got no vote in time and were sent numbered.")
+	cc.sender.SendTo(poll.chat, "Or reply with a number:\n"+numberedOptions(poll.step.Labels), priorityReply)
+}
+
+// vote returns what a customer's vote on one of our polls answers. ok is
+// false when it answers nothing: the poll isn't ours, the vote was taken
+// back, or it came after the step moved on, which the customer is told.
+func (cp *choicePolls) vote(cc *commandContext, chat types.JID, cell string, v *events.Message) (answer string, ok bool) {
+	pollID := v.Message.GetPollUpdateMessage().GetPollCreationMessageKey().GetID()
+	cp.mu.Lock()
+	poll, known := cp.byID[pollID]
+	cp.mu.Unlock()
+	if !known || poll.cell != cell {
+		return "", false
+	}
+	decrypted, err := cc.client.DecryptPollVote(v)
+	if err != nil {
+		log.Printf("Decrypting vote of %s on poll %s failed: %v", cell, pollID, err)
+		return "", false
+	}
+	selected := decrypted.GetSelectedOptions()
+	if len(selected) == 0 {
+		return "", false
+	}
+	for i, hash := range whatsmeow.HashPollOptions(poll.step.Labels) {
+		if bytes.Equal(hash, selected[0]) {
+			answer = poll.step.Answers[i]
+		}
+	}
+	if answer == "" {
+		return "", false
+	}
+	vp := cc.prclist.Snapshot().ForTier(customerTier(cc.db, cell))
+	step, asking := currentChoiceStep(cc, vp, cell, time.Now())
+	cp.mu.Lock()
+	late := poll.voted || !asking || step.Key != poll.step.Key
+	poll.voted = true
+	cp.mu.Unlock()
+	if late {
+		cc.sender.SendTo(chat, pollTooLateMsg, priorityReply)
+		return "", false
+	}
+	metrics.Inc("menubot_poll_votes_total", "Votes on choice polls that answered their step, by step.", "step", poll.step.Kind)
+	return answer, true
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+	"go.mau.fi/whatsmeow/store/sqlstore"
+)
+
+// Exit codes from sysexits.h, so the deploy script can tell a bad app.env
+// apart from a database or tunnel that isn't up yet.
+const (
+	exitConfig      = 78 // EX_CONFIG
+	exitUnavailable = 69 // EX_UNAVAILABLE
+)
+
+// preflight collects every startup problem before exiting, rather than
+// dying on the first one.
+type preflight struct {
+	configErrs []error
+	depErrs    []error
+}
+
+func (p *preflight) config(err error) {
+	if err != nil {
+		p.configErrs = append(p.configErrs, err)
+	}
+}
+
+// dependency records err along with a hint about what to check.
+func (p *preflight) dependency(err error, hint string) {
+	if err != nil {
+		p.depErrs = append(p.depErrs, fmt.Errorf("%w (%s)", err, hint))
+	}
+}
+
+// exitOnFailure logs every problem found so far and exits if there were
+// any. Config errors take precedence for the exit code since they usually
+// explain the dependency errors too.
+func (p *preflight) exitOnFailure() {
+	if len(p.configErrs) == 0 && len(p.depErrs) == 0 {
+		return
+	}
+	for _, err := range p.configErrs {
+		log.Printf("preflight: config: %v", err)
+	}
+	for _, err := range p.depErrs {
+		log.Printf("preflight: dependency: %v", err)
+	}
+	log.Printf("preflight failed: %d config error(s), %d dependency error(s)", len(p.configErrs), len(p.depErrs))
+	if len(p.configErrs) > 0 {
+		os.Exit(exitConfig)
+	}
+	os.Exit(exitUnavailable)
+}
+
+// checkCatalogue makes sure the MenuBotLib tables exist and hold items for
+// our catalogue, since an empty pricelist makes the bot useless.
+func (p *preflight) checkCatalogue(db *sql.DB) {
+	items, err := mb.GetCatalogueItemsFromDB(db, catalogueID)
+	if err != nil {
+		p.dependency(fmt.Errorf("reading catalogue %q: %w", catalogueID, err), "has the MenuBotLib schema been loaded into DATABASE_URL?")
+		return
+	}
+	if len(items) == 0 {
+		p.dependency(fmt.Errorf("catalogue %q has no items", catalogueID), "add items for it to DATABASE_URL")
+	}
+}
+
+// checkWAStore runs whatsmeow's schema upgrade and confirms the store ends
+// up at the version this build expects. Upgrade silently leaves a store
+// written by a newer whatsmeow alone, which otherwise fails much later.
+func (p *preflight) checkWAStore(container *sqlstore.Container, waDB *sql.DB) {
+	if err := container.Upgrade(); err != nil {
+		p.dependency(fmt.Errorf("upgrading %s schema: %w", waDBName, err), "check WHATSAPP_DB_URL and WHATSAPP_DB_DRIVER")
+		return
+	}
+	var version int
+	if err := waDB.QueryRow("SELECT version FROM whatsmeow_version LIMIT 1").Scan(&version); err != nil {
+		p.dependency(fmt.Errorf("reading %s version: %w", waDBName, err), "check WHATSAPP_DB_URL")
+		return
+	}
+	if want := len(sqlstore.Upgrades); version != want {
+		p.dependency(fmt.Errorf("%s is at version %d, this build expects %d", waDBName, version, want), "was it written by a newer release?")
+	}
+}
+
+// parseTemplate parses the page at path along with the shared partials it
+// may include.
+func (p *preflight) parseTemplate(path string, partials ...string) *template.Template {
+	tpl, err := template.ParseFiles(append([]string{path}, partials...)...)
+	if err != nil {
+		p.dependency(fmt.Errorf("loading template: %w", err), "is the app started from the directory holding templates/?")
+	}
+	return tpl
+}
+
+// checkPublicHealth fetches our own /healthz through HOMEBASEURL, proving
+// the tunnel in front of us routes to this process. A 503 still counts,
+// since it means the request reached us.
+func (p *preflight) checkPublicHealth(homebaseURL string) {
+	target := strings.TrimSuffix(homebaseURL, "/") + healthBaseURL
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(target)
+	if err != nil {
+		p.dependency(fmt.Errorf("fetching %s: %w", target, err), "is the tunnel for HOMEBASEURL up?")
+		return
+	}
+	defer resp.Body.Close()
+
+	var status healthStatus
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusServiceUnavailable {
+		p.dependency(fmt.Errorf("fetching %s: got %s", target, resp.Status), "does HOMEBASEURL point at this app?")
+	} else if err := json.NewDecoder(resp.Body).Decode(&status); err != nil || status.Status == "" {
+		p.dependency(fmt.Errorf("fetching %s: response is not our health check", target), "does HOMEBASEURL point at this app?")
+	}
+}
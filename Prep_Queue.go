@@ -0,0 +1,211 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Today's preparation queue is every paid order not yet ready: the ones
+// being prepared first, then the waiting ones by priority and then by when
+// they were paid, or for a pre-order when it is due. Pre-orders due on a
+// later day aren't in it. "status" tells the customer how many orders are
+// ahead of theirs and a rough ready time, PREP_TIME_PER_ORDER for each of
+// them and for theirs; "notify me" asks to be messaged once theirs is the
+// first order still waiting. The queue is worked out afresh from
+// order_meta whenever something can change its front: the kitchen moving
+// an order on, a cancellation or dispute, or a manager reprioritizing.
+
+// prepQueue is today's queue, front first.
+type prepQueue []orderSummary
+
+func loadPrepQueue(db *sql.DB, now time.Time) (prepQueue, error) {
+	loc := cfg().BusinessHours.Location
+	local := now.In(loc)
+	tomorrow := time.Date(local.Year(), local.Month(), local.Day()+1, 0, 0, 0, 0, loc)
+	return listOrders(db, ` WHERE m.status IN ($1, $2) AND NOT m.self_test AND (m.due_at IS NULL OR m.due_at < $3)
+		ORDER BY m.status = $2 DESC, m.queue_priority DESC, COALESCE(m.due_at, m.paid_at), o.`+orderIDColumn,
+		statusPaid, statusPreparing, tomorrow)
+}
+
+// ahead is how many orders are in front of orderID, false when it isn't in
+// the queue.
+func (q prepQueue) ahead(orderID int64) (int, bool) {
+	for i, o := range q {
+		if o.ID == orderID {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// next is the order the kitchen starts on next.
+func (q prepQueue) next() (orderSummary, bool) {
+	for _, o := range q {
+		if o.Status == statusPaid {
+			return o, true
+		}
+	}
+	return orderSummary{}, false
+}
+
+// readyAround is the rough ready time of an order with ahead orders in
+// front of it, zero without PREP_TIME_PER_ORDER.
+func readyAround(ahead int, now time.Time) time.Time {
+	per := cfg().PrepTimePerOrder
+	if per == 0 {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(ahead+1) * per)
+}
+
+func ordersAhead(n int) string {
+	switch n {
+	case 0:
+		return "no orders ahead of yours"
+	case 1:
+		return "1 order ahead of yours"
+	}
+	return fmt.Sprintf("%d orders ahead of yours", n)
+}
+
+// queueStatus is what "status" adds for a paid order in today's queue.
+func queueStatus(cc *commandContext, order orderSummary) string {
+	now := time.Now()
+	q, err := loadPrepQueue(cc.db, now)
+	if err != nil {
+		log.Printf("Status: reading the queue failed: %v", err)
+		return ""
+	}
+	ahead, ok := q.ahead(order.ID)
+	if !ok {
+		return ""
+	}
+	text := ", " + ordersAhead(ahead)
+	if t := readyAround(ahead, now); !t.IsZero() {
+		text += ", ready around " + formatETA(t)
+	}
+	if next, _ := q.next(); next.ID != order.ID {
+		text += `. Send "notify me" to be told when it's next`
+	}
+	return text
+}
+
+// customerNotifyMe handles "notify me": a message once the order is next.
+func customerNotifyMe(cc *commandContext, sender string, _ []string) string {
+	order, found, err := latestOrder(cc.db, sender)
+	if err != nil {
+		return cc.apology(incidentOrderLookup, sender, 0, err, "Notify me: reading the latest order",
+			"Sorry, something went wrong looking up your order. Please try again.")
+	}
+	switch {
+	case !found || !order.atOrPast(statusPaid) || order.finished():
+		return "You don't have an order in the queue."
+	case order.Status != statusPaid:
+		return fmt.Sprintf("Your order %s %s.", order.reference(), statusReplies[order.Status])
+	}
+	q, err := loadPrepQueue(cc.db, time.Now())
+	if err != nil {
+		return cc.apology(incidentQueueLookup, sender, order.ID, err, "Notify me: reading the queue",
+			"Sorry, something went wrong looking up the queue. Please try again.")
+	}
+	if _, ok := q.ahead(order.ID); !ok {
+		return fmt.Sprintf("Your order %s is for a later day, so it isn't in today's queue yet.", order.reference())
+	}
+	if next, _ := q.next(); next.ID == order.ID {
+		return fmt.Sprintf("Your order %s is next!", order.reference())
+	}
+	if _, err := cc.db.Exec(`UPDATE order_meta SET queue_notify = true WHERE order_id = $1`, order.ID); err != nil {
+		return cc.apology(incidentQueueNotify, sender, order.ID, err, "Notify me: saving the request",
+			"Sorry, something went wrong. Please try again.")
+	}
+	return fmt.Sprintf("We'll message you when order %s is next.", order.reference())
+}
+
+// advanceQueue tells the customer of the order now next, once, if they
+// asked to be told.
+func (cc *commandContext) advanceQueue() {
+	q, err := loadPrepQueue(cc.db, time.Now())
+	if err != nil {
+		log.Printf("Reading the queue failed: %v", err)
+		return
+	}
+	next, ok := q.next()
+	if !ok {
+		return
+	}
+	// Claimed first, so two instances seeing the same change send one.
+	res, err := cc.db.Exec(`UPDATE order_meta SET next_notified_at = now()
+		WHERE order_id = $1 AND queue_notify AND next_notified_at IS NULL`, next.ID)
+	if err != nil {
+		log.Printf("Claiming the \"you're next\" message of order %d failed: %v", next.ID, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return
+	}
+	cc.sender.SendOrder(next.CellNumber, fmt.Sprintf("You're next! The kitchen starts on order %s as soon as the one before it is done.", next.reference()), priorityNotify, next.ID)
+}
+
+// orderPriorityRequest is the body of POST /orders/{orderID}/priority.
+// Waiting orders with a higher priority are prepared first; 0 is the
+// default.
+type orderPriorityRequest struct {
+	Priority int `json:"priority"`
+}
+
+type orderPriorityResponse struct {
+	OrderID  int64  `json:"order_id"`
+	OrderRef string `json:"order_ref"`
+	Priority int    `json:"priority"`
+	// Ahead is how many orders are now in front of it, -1 for a pre-order
+	// due on a later day.
+	Ahead int `json:"ahead"`
+}
+
+// PostOrderPriorityHandler moves a paid order up or down the queue.
+func PostOrderPriorityHandler(cc *commandContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		orderID, ok := orderIDParam(w, r, cc.db)
+		if !ok {
+			return
+		}
+		var req orderPriorityRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		res, err := cc.db.Exec(`UPDATE order_meta SET queue_priority = $2, updated_at = now() WHERE order_id = $1 AND status = $3`,
+			orderID, req.Priority, statusPaid)
+		if err == nil {
+			var n int64
+			if n, err = res.RowsAffected(); err == nil && n == 0 {
+				err = sql.ErrNoRows
+			}
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			writeJSONError(w, http.StatusConflict, "only paid orders waiting in the queue can be reprioritized")
+			return
+		}
+		if err != nil {
+			log.Printf("Setting priority of order %d failed: %v", orderID, err)
+			writeJSONError(w, http.StatusInternalServerError, "setting priority failed")
+			return
+		}
+		log.Printf("%s set the priority of order %d to %d", staffFromContext(r.Context()).Name, orderID, req.Priority)
+		cc.advanceQueue()
+
+		resp := orderPriorityResponse{OrderID: orderID, OrderRef: cc.orderRef(orderID), Priority: req.Priority, Ahead: -1}
+		q, err := loadPrepQueue(cc.db, time.Now())
+		if err != nil {
+			log.Printf("Reading the queue failed: %v", err)
+		} else if ahead, ok := q.ahead(orderID); ok {
+			resp.Ahead = ahead
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
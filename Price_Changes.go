@@ -0,0 +1,243 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+	"github.com/go-chi/chi/v5"
+)
+
+// priceChange is a catalogue price taking effect at a set moment, so
+// increases can be announced ahead and need no one awake at midnight.
+type priceChange struct {
+	ID            int64     `json:"id"`
+	ItemID        int       `json:"item_id"`
+	Price         float64   `json:"price"`
+	EffectiveFrom time.Time `json:"effective_from"`
+}
+
+// applyPriceChanges returns the items with the latest price change in
+// effect at now applied, and the moment of the next pending change (zero
+// if there is none).
+func applyPriceChanges(db *sql.DB, items []mb.CatalogueItem, now time.Time) ([]mb.CatalogueItem, time.Time, error) {
+	rows, err := db.Query(`SELECT DISTINCT ON (item_id) item_id, price FROM price_changes
+		WHERE catalogue_id = $1 AND effective_from <= $2 ORDER BY item_id, effective_from DESC, id DESC`, catalogueID, now)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("loading price changes: %w", err)
+	}
+	defer rows.Close()
+	prices := make(map[int]float64)
+	for rows.Next() {
+		var id int
+		var price float64
+		if err := rows.Scan(&id, &price); err != nil {
+			return nil, time.Time{}, fmt.Errorf("loading price changes: %w", err)
+		}
+		prices[id] = price
+	}
+	if err := rows.Err(); err != nil {
+		return nil, time.Time{}, fmt.Errorf("loading price changes: %w", err)
+	}
+
+	var next sql.NullTime
+	if err := db.QueryRow(`SELECT min(effective_from) FROM price_changes WHERE catalogue_id = $1 AND effective_from > $2`,
+		catalogueID, now).Scan(&next); err != nil {
+		return nil, time.Time{}, fmt.Errorf("loading price changes: %w", err)
+	}
+
+	effective := make([]mb.CatalogueItem, len(items))
+	for i, item := range items {
+		if price, ok := prices[ctlgItemID(item)]; ok {
+			item = ctlgItemWithPrice(item, price)
+		}
+		effective[i] = item
+	}
+	return effective, next.Time, nil
+}
+
+// quotedPrices is what each of the cart's items cost when it was added,
+// keyed by item ID as stored in order_meta.quoted_prices.
+type quotedPrices map[string]float64
+
+func quotePrices(vp versionedPricelist, lines []orderLine) quotedPrices {
+	q := make(quotedPrices, len(lines))
+	for _, line := range lines {
+		if item, ok := vp.Item(line.ItemID); ok {
+			q[strconv.Itoa(line.ItemID)] = ctlgItemPrice(item)
+		}
+	}
+	return q
+}
+
+// stampQuotedPrices records the prices the cart was quoted at. Items
+// already quoted keep their first price unless replace is set, which is
+// how a re-quote at checkout resets them.
+func stampQuotedPrices(db dbtx, orderID int64, q quotedPrices, replace bool) error {
+	encoded, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO order_meta (order_id, pricelist_version, quoted_prices) VALUES ($1, 0, $2)
+		ON CONFLICT (order_id) DO UPDATE SET quoted_prices = CASE WHEN $3 THEN EXCLUDED.quoted_prices
+			ELSE EXCLUDED.quoted_prices || order_meta.quoted_prices END, updated_at = now()`,
+		orderID, string(encoded), replace)
+	return err
+}
+
+func orderQuotedPrices(db dbtx, orderID int64) (quotedPrices, error) {
+	var raw string
+	err := db.QueryRow(`SELECT quoted_prices::text FROM order_meta WHERE order_id = $1`, orderID).Scan(&raw)
+	if errors.Is(err, sql.ErrNoRows) {
+		return quotedPrices{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	q := quotedPrices{}
+	return q, json.Unmarshal([]byte(raw), &q)
+}
+
+// repriceNotice compares the cart's quoted prices with the current ones and
+// describes any differences, or returns "" when nothing changed.
+func repriceNotice(vp versionedPricelist, lines []orderLine, quoted quotedPrices) string {
+	var changes []string
+	for _, line := range lines {
+		was, ok := quoted[strconv.Itoa(line.ItemID)]
+		item, found := vp.Item(line.ItemID)
+		if !ok || !found || math.Round(was*100) == math.Round(ctlgItemPrice(item)*100) {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s: was R%.2f, now R%.2f", ctlgItemName(item), was, ctlgItemPrice(item)))
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+	return "Please note, prices changed since these were added to your order:\n" + strings.Join(changes, "\n") +
+		"\nYour payment link below uses the current prices."
+}
+
+// requoteAtCheckout is called before checking out an open cart. If any of
+// its items were quoted before a price change it returns a notice for the
+// customer and re-stamps the cart at the current prices, which are the
+// ones the payment link will use.
+func requoteAtCheckout(db *sql.DB, orderID int64, items string, vp versionedPricelist) string {
+	lines, err := decodeOrderLines(items)
+	if err != nil || len(lines) == 0 {
+		return ""
+	}
+	quoted, err := orderQuotedPrices(db, orderID)
+	if err != nil {
+		log.Printf("Reading quoted prices of order %d failed: %v", orderID, err)
+		return ""
+	}
+	notice := repriceNotice(vp, lines, quoted)
+	if notice != "" {
+		if err := stampQuotedPrices(db, orderID, quotePrices(vp, lines), true); err != nil {
+			log.Printf("Re-quoting order %d failed: %v", orderID, err)
+		}
+	}
+	return notice
+}
+
+func listPriceChanges(db *sql.DB, includePast bool) ([]priceChange, error) {
+	query := `SELECT id, item_id, price, effective_from FROM price_changes WHERE catalogue_id = $1`
+	if !includePast {
+		query += ` AND effective_from > now()`
+	}
+	rows, err := db.Query(query+` ORDER BY effective_from, id`, catalogueID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []priceChange{}
+	for rows.Next() {
+		var c priceChange
+		if err := rows.Scan(&c.ID, &c.ItemID, &c.Price, &c.EffectiveFrom); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// ListPriceChangesHandler serves the pending price changes, or all of them
+// with ?all=true.
+func ListPriceChangesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		all, _ := strconv.ParseBool(r.URL.Query().Get("all"))
+		changes, err := listPriceChanges(db, all)
+		if err != nil {
+			log.Printf("Listing price changes failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "listing price changes failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, changes)
+	}
+}
+
+func CreatePriceChangeHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var c priceChange
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		if _, ok := prclist.Snapshot().Item(c.ItemID); !ok {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("no catalogue item %d", c.ItemID))
+			return
+		}
+		if c.Price <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "price must be positive")
+			return
+		}
+		if c.EffectiveFrom.IsZero() {
+			writeJSONError(w, http.StatusBadRequest, "effective_from is required")
+			return
+		}
+		err := db.QueryRow(`INSERT INTO price_changes (catalogue_id, item_id, price, effective_from) VALUES ($1, $2, $3, $4)
+			RETURNING id`, catalogueID, c.ItemID, c.Price, c.EffectiveFrom).Scan(&c.ID)
+		if err != nil {
+			log.Printf("Saving price change for item %d failed: %v", c.ItemID, err)
+			writeJSONError(w, http.StatusInternalServerError, "saving price change failed")
+			return
+		}
+		// Rebuild so the refresher knows when to wake, and so a change
+		// dated in the past applies straight away.
+		if _, err := rebuildPricelist(db, prclist); err != nil {
+			log.Printf("Rebuilding pricelist after price change failed: %v", err)
+		}
+		writeJSON(w, http.StatusCreated, c)
+	}
+}
+
+// DeletePriceChangeHandler withdraws a price change that hasn't taken
+// effect yet. Past changes are history and stay.
+func DeletePriceChangeHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "changeID"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid price change id")
+			return
+		}
+		res, err := db.Exec(`DELETE FROM price_changes WHERE id = $1 AND effective_from > now()`, id)
+		if err != nil {
+			log.Printf("Deleting price change %d failed: %v", id, err)
+			writeJSONError(w, http.StatusInternalServerError, "deleting price change failed")
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeJSONError(w, http.StatusNotFound, "no pending price change with that id")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+	"github.com/go-chi/chi/v5"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// retailTier is the implicit tier of every customer without one. It has no
+// row in price_tiers and always charges catalogue prices.
+const retailTier = "retail"
+
+// priceTier is a named set of prices. Prices overrides individual items;
+// every other item costs its retail price times Multiplier.
+type priceTier struct {
+	Name       string          `json:"name"`
+	Multiplier float64         `json:"multiplier"`
+	Prices     map[int]float64 `json:"prices,omitempty"`
+}
+
+func (t priceTier) Price(item mb.CatalogueItem) float64 {
+	if price, ok := t.Prices[ctlgItemID(item)]; ok {
+		return price
+	}
+	return math.Round(ctlgItemPrice(item)*t.Multiplier*100) / 100
+}
+
+func loadPriceTiers(db *sql.DB) (map[string]priceTier, error) {
+	tiers := make(map[string]priceTier)
+	rows, err := db.Query(`SELECT name, multiplier FROM price_tiers`)
+	if err != nil {
+		return nil, fmt.Errorf("loading price tiers: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t := priceTier{Prices: map[int]float64{}}
+		if err := rows.Scan(&t.Name, &t.Multiplier); err != nil {
+			return nil, fmt.Errorf("loading price tiers: %w", err)
+		}
+		tiers[t.Name] = t
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("loading price tiers: %w", err)
+	}
+
+	rows, err = db.Query(`SELECT tier, item_id, price FROM price_tier_items`)
+	if err != nil {
+		return nil, fmt.Errorf("loading tier prices: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		var itemID int
+		var price float64
+		if err := rows.Scan(&name, &itemID, &price); err != nil {
+			return nil, fmt.Errorf("loading tier prices: %w", err)
+		}
+		if t, ok := tiers[name]; ok {
+			t.Prices[itemID] = price
+		}
+	}
+	return tiers, rows.Err()
+}
+
+// ForTier returns the pricelist with the tier's prices substituted, or vp
+// itself for retail and unknown tiers.
+func (vp versionedPricelist) ForTier(name string) versionedPricelist {
+	tier, ok := vp.Tiers[name]
+	if !ok {
+		return vp
+	}
+	items := make([]mb.CatalogueItem, len(vp.Items))
+	for i, item := range vp.Items {
+		items[i] = ctlgItemWithPrice(item, tier.Price(item))
+	}
+	vp.Items = items
+	return vp
+}
+
+// customerTier is the customer's price tier, retail unless the admin has
+// set one.
+func customerTier(db *sql.DB, cellNumber string) string {
+	var tier string
+	err := db.QueryRow(`SELECT tier FROM customer_profiles WHERE cell_number = $1`, cellNumber).Scan(&tier)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Reading price tier of %s failed: %v", cellNumber, err)
+		}
+		return retailTier
+	}
+	return tier
+}
+
+func validateTier(vp versionedPricelist, tier string) error {
+	if _, ok := vp.Tiers[tier]; !ok && tier != retailTier {
+		return fmt.Errorf("unknown tier %q", tier)
+	}
+	return nil
+}
+
+func setCustomerTier(db *sql.DB, cellNumber, tier string) error {
+	_, err := db.Exec(`INSERT INTO customer_profiles (cell_number, tier) VALUES ($1, $2)
+		ON CONFLICT (cell_number) DO UPDATE SET tier = EXCLUDED.tier, updated_at = now()`, cellNumber, tier)
+	return err
+}
+
+// canonicalNumber turns an admin-supplied phone number into the form the
+// bot sees on inbound messages.
+func canonicalNumber(number string) (string, error) {
+	jid, err := resolveJID(number)
+	if err != nil {
+		return "", err
+	}
+	if jid.Server != types.DefaultUserServer {
+		return "", fmt.Errorf("%q is not a phone number", number)
+	}
+	return jid.User, nil
+}
+
+// adminTier handles "tier <number> <tier>"; "retail" removes a tier.
+func adminTier(cc *commandContext, args []string) string {
+	if len(args) != 2 {
+		return "Usage: tier <number> <tier>"
+	}
+	number, err := canonicalNumber(args[0])
+	if err != nil {
+		return err.Error()
+	}
+	tier := strings.ToLower(args[1])
+	if err := validateTier(cc.prclist.Snapshot(), tier); err != nil {
+		return err.Error()
+	}
+	if err := setCustomerTier(cc.db, number, tier); err != nil {
+		return fmt.Sprintf("Setting tier of %s failed: %v", number, err)
+	}
+	return fmt.Sprintf("%s now pays %s prices.", number, tier)
+}
+
+func ListPriceTiersHandler(prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tiers := make([]priceTier, 0, len(prclist.Snapshot().Tiers))
+		for _, t := range prclist.Snapshot().Tiers {
+			tiers = append(tiers, t)
+		}
+		sort.Slice(tiers, func(i, j int) bool { return tiers[i].Name < tiers[j].Name })
+		writeJSON(w, http.StatusOK, tiers)
+	}
+}
+
+// PutPriceTierHandler creates or replaces a tier, including all its item
+// overrides.
+func PutPriceTierHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.ToLower(chi.URLParam(r, "tier"))
+		if name == retailTier || name == "" {
+			writeJSONError(w, http.StatusBadRequest, "the retail tier is the catalogue itself")
+			return
+		}
+		var t priceTier
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		if t.Multiplier == 0 {
+			t.Multiplier = 1
+		}
+		if t.Multiplier < 0 {
+			writeJSONError(w, http.StatusBadRequest, "multiplier must be positive")
+			return
+		}
+		vp := prclist.Snapshot()
+		for itemID, price := range t.Prices {
+			if _, ok := vp.Item(itemID); !ok {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("no catalogue item %d", itemID))
+				return
+			}
+			if price < 0 {
+				writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("negative price for item %d", itemID))
+				return
+			}
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Saving tier %s: begin failed: %v", name, err)
+			writeJSONError(w, http.StatusInternalServerError, "saving tier failed")
+			return
+		}
+		defer tx.Rollback()
+		_, err = tx.Exec(`INSERT INTO price_tiers (name, multiplier) VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET multiplier = EXCLUDED.multiplier`, name, t.Multiplier)
+		if err == nil {
+			_, err = tx.Exec(`DELETE FROM price_tier_items WHERE tier = $1`, name)
+		}
+		for itemID, price := range t.Prices {
+			if err != nil {
+				break
+			}
+			_, err = tx.Exec(`INSERT INTO price_tier_items (tier, item_id, price) VALUES ($1, $2, $3)`, name, itemID, price)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Saving tier %s failed: %v", name, err)
+			writeJSONError(w, http.StatusInternalServerError, "saving tier failed")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
+
+type customerTierRequest struct {
+	Tier string `json:"tier"`
+}
+
+type customerTierResponse struct {
+	CellNumber string `json:"cell_number"`
+	Tier       string `json:"tier"`
+}
+
+func PutCustomerTierHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		number, err := canonicalNumber(chi.URLParam(r, "number"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var req customerTierRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		tier := strings.ToLower(req.Tier)
+		if err := validateTier(prclist.Snapshot(), tier); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := setCustomerTier(db, number, tier); err != nil {
+			log.Printf("Setting tier of %s failed: %v", number, err)
+			writeJSONError(w, http.StatusInternalServerError, "saving tier failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, customerTierResponse{CellNumber: number, Tier: tier})
+	}
+}
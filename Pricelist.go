@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+)
+
+// versionedPricelist is the catalogue as loaded from the DB, including
+// items taken off the menu so old orders can still be described. The
+// pricelist customers see is derived from it per message, since item
+// availability depends on the time of day.
+type versionedPricelist struct {
+	Items  []mb.CatalogueItem
+	Rules  map[int]availabilityRule
+	Images map[int]string // item ID to image URL
+	Tiers  map[string]priceTier
+	States map[int]itemState
+	// Modifiers are the option groups of items that have them.
+	Modifiers map[int][]modifierGroup
+	// Combos are the components of items that are combos.
+	Combos     map[int][]comboComponent
+	Categories map[int]string
+	// Codes are the item codes by item ID, see Item_Codes.go.
+	Codes map[int]string
+	// Specials are the running specials by item; Items already have
+	// their discounts applied.
+	Specials map[int]activeSpecial
+	Version  int64
+	// NextPriceChange is when a scheduled price change next takes effect
+	// or a special starts or ends, zero if none is pending.
+	NextPriceChange time.Time
+}
+
+// Full returns the pricelist with every item that hasn't been deleted,
+// regardless of availability.
+func (vp versionedPricelist) Full() mb.Pricelist {
+	items := make([]mb.CatalogueItem, 0, len(vp.Items))
+	for _, item := range vp.Items {
+		if !vp.Deleted(ctlgItemID(item)) {
+			items = append(items, item)
+		}
+	}
+	return vp.compose(items)
+}
+
+// At returns the pricelist of items that can be ordered at t.
+func (vp versionedPricelist) At(t time.Time) mb.Pricelist {
+	loc := cfg().BusinessHours.Location
+	available := make([]mb.CatalogueItem, 0, len(vp.Items))
+	for _, item := range vp.Items {
+		if !vp.Listed(ctlgItemID(item)) {
+			continue
+		}
+		if rule, ok := vp.Rules[ctlgItemID(item)]; ok && !rule.AvailableAt(t, loc) {
+			continue
+		}
+		available = append(available, item)
+	}
+	return vp.compose(available)
+}
+
+func (vp versionedPricelist) Item(id int) (mb.CatalogueItem, bool) {
+	for _, item := range vp.Items {
+		if ctlgItemID(item) == id {
+			return item, true
+		}
+	}
+	return mb.CatalogueItem{}, false
+}
+
+// compose builds MenuBotLib's pricelist from items, with each item's code,
+// running special, combo's contents and modifiers spelled out after its
+// name.
+func (vp versionedPricelist) compose(items []mb.CatalogueItem) mb.Pricelist {
+	if len(vp.Codes) > 0 || len(vp.Modifiers) > 0 || len(vp.Combos) > 0 || len(vp.Specials) > 0 {
+		now := time.Now()
+		listed := make([]mb.CatalogueItem, len(items))
+		for i, item := range items {
+			var hints []string
+			if code, ok := vp.Codes[ctlgItemID(item)]; ok {
+				hints = append(hints, code)
+			}
+			if s, ok := vp.Specials[ctlgItemID(item)]; ok {
+				hints = append(hints, s.hint(now))
+			}
+			if _, ok := vp.Combos[ctlgItemID(item)]; ok {
+				hints = append(hints, vp.comboHint(ctlgItemID(item)))
+			}
+			if groups := vp.Modifiers[ctlgItemID(item)]; len(groups) > 0 {
+				hints = append(hints, modifierHint(groups))
+			}
+			listed[i] = item
+			if len(hints) > 0 {
+				listed[i] = ctlgItemWithName(item, fmt.Sprintf("%s (%s)", ctlgItemName(item), strings.Join(hints, "; ")))
+			}
+		}
+		items = listed
+	}
+	return mb.Pricelist{
+		PrlstPreamble: prclstPreamble,
+		Catalogue:     mb.CmpsCtlgSlctnsFromCtlgItms(items),
+	}
+}
+
+// pricelistHolder shares the current pricelist between the message handler
+// and the background refresher.
+type pricelistHolder struct {
+	current atomic.Pointer[versionedPricelist]
+	// stale is set while no pricelist could be loaded, see
+	// loadStartupPricelist.
+	stale atomic.Bool
+}
+
+// Get returns the pricelist of items available right now.
+func (h *pricelistHolder) Get() mb.Pricelist {
+	return h.current.Load().At(time.Now())
+}
+
+func (h *pricelistHolder) Version() int64 {
+	return h.current.Load().Version
+}
+
+// Snapshot returns the catalogue and its version as one consistent pair.
+func (h *pricelistHolder) Snapshot() versionedPricelist {
+	return *h.current.Load()
+}
+
+func (h *pricelistHolder) Set(vp versionedPricelist) {
+	h.current.Store(&vp)
+	h.stale.Store(false)
+}
+
+// Stale reports whether the bot is running without a pricelist.
+func (h *pricelistHolder) Stale() bool {
+	return h.stale.Load()
+}
+
+// setUnavailable publishes an empty pricelist until a load succeeds.
+func (h *pricelistHolder) setUnavailable() {
+	h.current.Store(&versionedPricelist{})
+	h.stale.Store(true)
+}
+
+func loadPricelist(db *sql.DB) (versionedPricelist, error) {
+	ctlgItms, err := mb.GetCatalogueItemsFromDB(db, catalogueID)
+	if err != nil {
+		return versionedPricelist{}, err
+	}
+	ctlgItms, nextChange, err := applyPriceChanges(db, ctlgItms, time.Now())
+	if err != nil {
+		return versionedPricelist{}, err
+	}
+	rules, err := loadAvailabilityRules(db)
+	if err != nil {
+		return versionedPricelist{}, err
+	}
+	images, err := loadItemImages(db)
+	if err != nil {
+		return versionedPricelist{}, err
+	}
+	tiers, err := loadPriceTiers(db)
+	if err != nil {
+		return versionedPricelist{}, err
+	}
+	states, err := loadItemStates(db)
+	if err != nil {
+		return versionedPricelist{}, err
+	}
+	modifiers, err := loadItemModifiers(db)
+	if err != nil {
+		return versionedPricelist{}, err
+	}
+	combos, err := loadCombos(db)
+	if err != nil {
+		return versionedPricelist{}, err
+	}
+	categories, err := loadItemCategories(db)
+	if err != nil {
+		return versionedPricelist{}, err
+	}
+	codes, err := assignItemCodes(db, ctlgItms)
+	if err != nil {
+		return versionedPricelist{}, err
+	}
+	vp := versionedPricelist{
+		Items:      ctlgItms,
+		Rules:      rules,
+		Images:     images,
+		Tiers:      tiers,
+		States:     states,
+		Modifiers:  modifiers,
+		Combos:     combos,
+		Categories: categories,
+		Codes:      codes,
+	}
+	var nextSpecial time.Time
+	if vp.Items, vp.Specials, nextSpecial, err = applySpecials(db, vp, time.Now()); err != nil {
+		return versionedPricelist{}, err
+	}
+	vp.NextPriceChange = nextChange
+	if !nextSpecial.IsZero() && (nextChange.IsZero() || nextSpecial.Before(nextChange)) {
+		vp.NextPriceChange = nextSpecial
+	}
+	return vp, nil
+}
+
+// rebuildPricelist reloads the pricelist from the DB, bumps the persisted
+// version if its contents changed and publishes it to the holder.
+func rebuildPricelist(db *sql.DB, holder *pricelistHolder) (int64, error) {
+	vp, err := loadPricelist(db)
+	if err != nil {
+		return 0, err
+	}
+	if vp.Version, err = bumpPricelistVersion(db, vp); err != nil {
+		return 0, err
+	}
+	// The catalogue is written outside the bot, so loading a new version
+	// is the first chance to say a name won't survive the trip to PayFast.
+	if vp.Version != holder.Version() {
+		for _, warning := range payFastNameWarnings(vp.Items) {
+			log.Printf("Catalogue: %s", warning)
+		}
+	}
+	holder.Set(vp)
+	return vp.Version, nil
+}
+
+// pricelistHash covers everything that changes what customers can order,
+// see or pay, including availability rules, item states, images, price
+// tiers, modifiers, combos, categories, item codes and running specials.
+func pricelistHash(vp versionedPricelist) (string, error) {
+	rules := make(map[int]availabilitySpec, len(vp.Rules))
+	for id, rule := range vp.Rules {
+		rules[id] = rule.Spec
+	}
+	encoded, err := json.Marshal(struct {
+		Items  []mb.CatalogueItem
+		Rules  map[int]availabilitySpec
+		Images map[int]string           `json:",omitempty"`
+		Tiers  map[string]priceTier     `json:",omitempty"`
+		States map[int]itemState        `json:",omitempty"`
+		Mods   map[int][]modifierGroup  `json:",omitempty"`
+		Combos map[int][]comboComponent `json:",omitempty"`
+		Cats   map[int]string           `json:",omitempty"`
+		Specs  map[int]activeSpecial    `json:",omitempty"`
+		Codes  map[int]string           `json:",omitempty"`
+	}{vp.Items, rules, vp.Images, vp.Tiers, vp.States, vp.Modifiers, vp.Combos, vp.Categories, vp.Specials, vp.Codes})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// bumpPricelistVersion returns the stored version for the catalogue,
+// incrementing it only when the content hash differs from the last
+// rebuild. Periodic refreshes of an unchanged menu therefore keep the same
+// version, which is what lets clients poll cheaply with If-None-Match.
+func bumpPricelistVersion(db *sql.DB, vp versionedPricelist) (int64, error) {
+	hash, err := pricelistHash(vp)
+	if err != nil {
+		return 0, fmt.Errorf("hashing pricelist: %w", err)
+	}
+
+	var version int64
+	err = db.QueryRow(`INSERT INTO pricelist_version (catalogue_id, version, content_hash) VALUES ($1, 1, $2)
+		ON CONFLICT (catalogue_id) DO UPDATE SET
+			version = CASE WHEN pricelist_version.content_hash = EXCLUDED.content_hash
+				THEN pricelist_version.version ELSE pricelist_version.version + 1 END,
+			content_hash = EXCLUDED.content_hash,
+			updated_at = now()
+		RETURNING version`, catalogueID, hash).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("updating pricelist version: %w", err)
+	}
+	return version, nil
+}
+
+// pricelistRefreshSchedule reloads the pricelist every
+// PRICELIST_REFRESH_INTERVAL, and as soon as a scheduled price change takes
+// effect. It is read on every tick, so a config reload can enable, disable
+// or change the interval without a restart.
+func pricelistRefreshSchedule(holder *pricelistHolder) jobSchedule {
+	return func(last time.Time) time.Time {
+		var due time.Time
+		if interval := cfg().PricelistRefresh; interval > 0 {
+			due = last.Add(interval)
+		}
+		// A change the last refresh already tried to take in isn't due again.
+		if next := holder.Snapshot().NextPriceChange; next.After(last) && (due.IsZero() || next.Before(due)) {
+			due = next
+		}
+		return due
+	}
+}
+
+func refreshPricelist(db *sql.DB, holder *pricelistHolder) error {
+	previous := holder.Version()
+	version, err := rebuildPricelist(db, holder)
+	if err != nil {
+		return fmt.Errorf("pricelist refresh failed, keeping previous pricelist: %w", err)
+	}
+	if version != previous {
+		log.Printf("Pricelist refreshed from DB, now version %d", version)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	pricelistRetryBase = time.Second
+	pricelistRetryMax  = 30 * time.Second
+	// menuUnavailableMessage answers customers while the bot runs without
+	// a pricelist.
+	menuUnavailableMessage = "Sorry, our menu is temporarily unavailable. Please try again in a few minutes."
+)
+
+// loadStartupPricelist loads the pricelist, retrying with backoff for up
+// to window so a brief database outage at boot doesn't crash the process
+// and drop the WhatsApp session. If it still fails, the holder is left
+// with an empty, stale pricelist; see recoverPricelist.
+func loadStartupPricelist(db *sql.DB, holder *pricelistHolder, window time.Duration) (int64, error) {
+	deadline := time.Now().Add(window)
+	backoff := pricelistRetryBase
+	for {
+		version, err := rebuildPricelist(db, holder)
+		if err == nil {
+			return version, nil
+		}
+		if !time.Now().Add(backoff).Before(deadline) {
+			holder.setUnavailable()
+			return 0, err
+		}
+		log.Printf("Loading pricelist failed, retrying in %s: %v", backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, pricelistRetryMax)
+	}
+}
+
+// recoverPricelist keeps retrying a stale pricelist until it loads, and
+// tells the admin when the bot enters and leaves degraded mode. A reload
+// from elsewhere, e.g. the admin command, also ends it.
+func recoverPricelist(cc *commandContext) {
+	cc.sender.Send(cc.envVars.AdminNumber, "The pricelist couldn't be loaded at startup. "+
+		"Customers are being told the menu is unavailable; it will be retried in the background.", priorityNotify)
+	metrics.Inc("menubot_pricelist_degraded_total", "Times the bot started without a pricelist.")
+	backoff := pricelistRetryBase
+	for cc.prclist.Stale() {
+		time.Sleep(backoff)
+		backoff = min(backoff*2, pricelistRetryMax)
+		if !cc.prclist.Stale() {
+			break
+		}
+		if _, err := rebuildPricelist(cc.db, cc.prclist); err != nil {
+			log.Printf("Pricelist still unavailable: %v", err)
+		}
+	}
+	version := cc.prclist.Version()
+	log.Printf("Loaded pricelist version %d, leaving degraded mode", version)
+	cc.sender.Send(cc.envVars.AdminNumber, fmt.Sprintf("The pricelist is loaded (version %d) and the bot is taking orders again.", version), priorityNotify)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Multi-step flows ask the customer something and wait for the answer: an
+// item's required options, a gift's delivery address and slot, whether to
+// use a contact card as the delivery contact. What each
+// customer is being asked, for which order and since when, is kept in
+// pending_prompts so a restart picks up where it left off. Every flow has
+// a soft and a hard timeout. A reply after the soft one may well be about
+// something else by then, so rather than taking it as the answer the
+// question is asked again, once. After the hard one the flow is abandoned
+// and the customer told so, when they next write or by the sweep,
+// whichever comes first.
+
+// Flows kept in pending_prompts.
+const (
+	flowOptions = "options"
+	flowGift    = "gift"
+	flowContact = "contact"
+)
+
+const promptSweep = 10 * time.Minute
+
+// savedPrompt is a question a customer is being asked. Step and Data are
+// the flow's own, e.g. the gift state or the pendingChoice.
+type savedPrompt struct {
+	ID      int64
+	Cell    string
+	Flow    string
+	OrderID int64
+	Step    string
+	Data    json.RawMessage
+	AskedAt time.Time
+	Reasked bool
+}
+
+type promptFlow struct {
+	Soft, Hard time.Duration
+	// Ask is the question p is waiting on, "" when there is none any more.
+	Ask func(cc *commandContext, vp versionedPricelist, p savedPrompt) string
+	// Abandon gives up on p and returns what the customer is told.
+	Abandon func(cc *commandContext, p savedPrompt) string
+}
+
+// flowFor returns the flow's timeouts and callbacks; it is a function
+// rather than a map so the callbacks may use prompts themselves.
+func flowFor(flow string) (promptFlow, bool) {
+	switch flow {
+	case flowOptions:
+		return promptFlow{Soft: 30 * time.Minute, Hard: 24 * time.Hour, Ask: askOptions, Abandon: abandonOptions}, true
+	case flowGift:
+		return promptFlow{Soft: 24 * time.Hour, Hard: giftReplyWindow, Ask: askGift, Abandon: abandonGift}, true
+	case flowContact:
+		return promptFlow{Soft: 30 * time.Minute, Hard: 24 * time.Hour, Ask: askContact, Abandon: abandonContact}, true
+	}
+	return promptFlow{}, false
+}
+
+// Stages of a prompt, by how long ago it was asked.
+const (
+	promptOpen      = "open"      // a reply is taken as its answer
+	promptReask     = "reask"     // a reply gets the question again
+	promptAbandoned = "abandoned" // the flow is given up
+)
+
+// stage is where p stands at now. Asking again restarts the clock, so a
+// prompt goes open, reask, open and then abandoned, and is asked again
+// at most once.
+func (p savedPrompt) stage(f promptFlow, now time.Time) string {
+	age := now.Sub(p.AskedAt)
+	switch {
+	case age > f.Hard:
+		return promptAbandoned
+	case age > f.Soft && !p.Reasked:
+		return promptReask
+	}
+	return promptOpen
+}
+
+const promptColumns = `id, cell, flow, order_id, step, data, asked_at, reasked`
+
+func scanPrompt(scan func(dest ...any) error) (savedPrompt, error) {
+	var p savedPrompt
+	var data []byte
+	err := scan(&p.ID, &p.Cell, &p.Flow, &p.OrderID, &p.Step, &data, &p.AskedAt, &p.Reasked)
+	p.Data = data
+	return p, err
+}
+
+func queryPrompts(db dbtx, query string, args ...any) ([]savedPrompt, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var prompts []savedPrompt
+	for rows.Next() {
+		p, err := scanPrompt(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		prompts = append(prompts, p)
+	}
+	return prompts, rows.Err()
+}
+
+// loadPrompts returns the customer's prompts in a flow, the one being
+// asked first.
+func loadPrompts(db dbtx, cell, flow string) ([]savedPrompt, error) {
+	return queryPrompts(db, `SELECT `+promptColumns+` FROM pending_prompts WHERE cell = $1 AND flow = $2 ORDER BY id`, cell, flow)
+}
+
+// askedPrompts returns the prompt being asked in each of the customer's
+// flows.
+func askedPrompts(db dbtx, cell string) ([]savedPrompt, error) {
+	return queryPrompts(db, `SELECT DISTINCT ON (flow) `+promptColumns+` FROM pending_prompts WHERE cell = $1 ORDER BY flow, id`, cell)
+}
+
+func addPrompt(db dbtx, cell, flow string, orderID int64, step string, data any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO pending_prompts (cell, flow, order_id, step, data) VALUES ($1, $2, $3, $4, $5)`,
+		cell, flow, orderID, step, encoded)
+	return err
+}
+
+// updatePrompt stores a prompt's new step and data. asked is set when that
+// means a new question, which starts the clock again.
+func updatePrompt(db dbtx, id int64, step string, data any, asked bool) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`UPDATE pending_prompts SET step = $2, data = $3,
+		asked_at = CASE WHEN $4 THEN now() ELSE asked_at END, reasked = reasked AND NOT $4 WHERE id = $1`,
+		id, step, encoded, asked)
+	return err
+}
+
+// deletePrompt drops a prompt; the next one in its flow, if any, is now
+// being asked.
+func deletePrompt(db dbtx, p savedPrompt) error {
+	if _, err := db.Exec(`DELETE FROM pending_prompts WHERE id = $1`, p.ID); err != nil {
+		return err
+	}
+	return promptNext(db, p.Cell, p.Flow)
+}
+
+// promptNext starts the clock on the prompt now first in a flow.
+func promptNext(db dbtx, cell, flow string) error {
+	_, err := db.Exec(`UPDATE pending_prompts SET asked_at = now(), reasked = false
+		WHERE id = (SELECT min(id) FROM pending_prompts WHERE cell = $1 AND flow = $2)`, cell, flow)
+	return err
+}
+
+// setOrderPrompt makes step the question asked about the order in a flow
+// that asks one thing per order at a time.
+func setOrderPrompt(db dbtx, cell, flow string, orderID int64, step string) error {
+	if _, err := db.Exec(`DELETE FROM pending_prompts WHERE cell = $1 AND flow = $2 AND order_id = $3`, cell, flow, orderID); err != nil {
+		return err
+	}
+	return addPrompt(db, cell, flow, orderID, step, nil)
+}
+
+func clearOrderPrompt(db dbtx, cell, flow string, orderID int64) error {
+	_, err := db.Exec(`DELETE FROM pending_prompts WHERE cell = $1 AND flow = $2 AND order_id = $3`, cell, flow, orderID)
+	return err
+}
+
+// resumePrompts looks at what the customer is being asked before their
+// message is answered. reask is the question to ask again instead of
+// answering, notice what to tell them about flows given up on.
+func resumePrompts(cc *commandContext, vp versionedPricelist, cell string, now time.Time) (reask, notice string) {
+	prompts, err := askedPrompts(cc.db, cell)
+	if err != nil {
+		log.Printf("Reading prompts of %s failed: %v", cell, err)
+		return "", ""
+	}
+	var notices []string
+	for _, p := range prompts {
+		f, ok := flowFor(p.Flow)
+		if !ok {
+			continue
+		}
+		switch p.stage(f, now) {
+		case promptAbandoned:
+			notices = append(notices, abandonPrompt(cc, f, p))
+		case promptReask:
+			question := f.Ask(cc, vp, p)
+			if question == "" || reask != "" {
+				continue
+			}
+			if _, err := cc.db.Exec(`UPDATE pending_prompts SET asked_at = $2, reasked = true WHERE id = $1`, p.ID, now); err != nil {
+				log.Printf("Marking prompt %d asked again failed: %v", p.ID, err)
+				continue
+			}
+			metrics.Inc("menubot_prompts_reasked_total", "Questions asked again because the answer came late, by flow.", "flow", p.Flow)
+			reask = "It's been a while, so just to check: " + question
+		}
+	}
+	return reask, strings.Join(notices, "\n\n")
+}
+
+func abandonPrompt(cc *commandContext, f promptFlow, p savedPrompt) string {
+	metrics.Inc("menubot_prompts_abandoned_total", "Multi-step flows given up after their hard timeout, by flow.", "flow", p.Flow)
+	log.Printf("Abandoning %s prompt for order %d of %s, asked %s", p.Flow, p.OrderID, p.Cell, p.AskedAt.Format(time.RFC3339))
+	return f.Abandon(cc, p)
+}
+
+// abandonStalePrompts gives up on the prompts past their hard timeout that
+// nobody has written about, telling the customers.
+func abandonStalePrompts(cc *commandContext) error {
+	var failed error
+	for _, flow := range []string{flowOptions, flowGift, flowContact} {
+		f, _ := flowFor(flow)
+		prompts, err := queryPrompts(cc.db, `SELECT * FROM (SELECT DISTINCT ON (cell) `+promptColumns+`
+			FROM pending_prompts WHERE flow = $1 ORDER BY cell, id) asked WHERE asked_at < $2`, flow, time.Now().Add(-f.Hard))
+		if err != nil {
+			failed = fmt.Errorf("reading stale %s prompts: %w", flow, err)
+			continue
+		}
+		for _, p := range prompts {
+			unlock := cc.senders.Lock(p.Cell)
+			// The customer may have answered while we waited for the lock.
+			var still bool
+			err := cc.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pending_prompts WHERE id = $1 AND asked_at = $2)`, p.ID, p.AskedAt).Scan(&still)
+			if err != nil {
+				log.Printf("Reading prompt %d failed: %v", p.ID, err)
+			} else if still {
+				if text := abandonPrompt(cc, f, p); text != "" {
+					cc.sendBulk(bulkMessage{Recipient: p.Cell, Text: text, Kind: bulkPrompt})
+				}
+			}
+			unlock()
+		}
+	}
+	return failed
+}
+
+func askOptions(cc *commandContext, vp versionedPricelist, p savedPrompt) string {
+	var choice pendingChoice
+	if err := json.Unmarshal(p.Data, &choice); err != nil {
+		return ""
+	}
+	g, open := nextRequiredGroup(vp.Modifiers[choice.ItemID], choice)
+	if !open {
+		return ""
+	}
+	return choicePrompt(vp, choice, g)
+}
+
+// abandonOptions drops all of the customer's option prompts; checkout
+// asks for whatever is still missing.
+func abandonOptions(cc *commandContext, p savedPrompt) string {
+	cc.modifierPrompts.clear(p.Cell, 0)
+	return "We've stopped waiting for your choice of options. We'll ask again for anything still missing when you check out."
+}
+
+func askGift(cc *commandContext, _ versionedPricelist, p savedPrompt) string {
+	orderID, state, found := answeringGift(cc.db, p.Cell, time.Now())
+	if !found || orderID != p.OrderID {
+		return ""
+	}
+	if state == giftAddress {
+		return giftSlotPrompt()
+	}
+	return fmt.Sprintf("Where should we deliver your gift, Order %s? Reply with your address, or DECLINE if you'd rather not receive it.", cc.orderRef(orderID))
+}
+
+func abandonGift(cc *commandContext, p savedPrompt) string {
+	if err := clearOrderPrompt(cc.db, p.Cell, flowGift, p.OrderID); err != nil {
+		log.Printf("Dropping gift prompt of order %d failed: %v", p.OrderID, err)
+	}
+	return cc.lapseGift(p.OrderID, p.Cell)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPromptStage(t *testing.T) {
+	f := promptFlow{Soft: 30 * time.Minute, Hard: 24 * time.Hour}
+	asked := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		age     time.Duration
+		reasked bool
+		want    string
+	}{
+		{"just asked", time.Minute, false, promptOpen},
+		{"at the soft timeout", 30 * time.Minute, false, promptOpen},
+		{"past the soft timeout", 31 * time.Minute, false, promptReask},
+		{"past the soft timeout, asked again", 31 * time.Minute, true, promptOpen},
+		{"at the hard timeout", 24 * time.Hour, false, promptReask},
+		{"past the hard timeout", 25 * time.Hour, false, promptAbandoned},
+		{"past the hard timeout, asked again", 25 * time.Hour, true, promptAbandoned},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := savedPrompt{AskedAt: asked, Reasked: tt.reasked}
+			if got := p.stage(f, asked.Add(tt.age)); got != tt.want {
+				t.Errorf("stage after %s = %s, want %s", tt.age, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPromptLifecycle replays replies to one prompt the way resumePrompts
+// handles them: a late one gets the question again and restarts the
+// clock, and the question is never asked a third time.
+func TestPromptLifecycle(t *testing.T) {
+	for _, flow := range []string{flowOptions, flowGift, flowContact} {
+		t.Run(flow, func(t *testing.T) {
+			f, _ := flowFor(flow)
+			asked := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+			p := savedPrompt{Flow: flow, AskedAt: asked}
+			steps := []struct {
+				at   time.Time
+				want string
+			}{
+				{asked.Add(f.Soft / 2), promptOpen},
+				{asked.Add(f.Soft + time.Minute), promptReask},
+				{asked.Add(2*f.Soft + 2*time.Minute), promptOpen},
+				{asked.Add(f.Soft + time.Minute + f.Hard - time.Minute), promptOpen},
+				{asked.Add(f.Soft + time.Minute + f.Hard + time.Minute), promptAbandoned},
+			}
+			for i, s := range steps {
+				got := p.stage(f, s.at)
+				if got != s.want {
+					t.Fatalf("reply %d after %s: %s, want %s", i+1, s.at.Sub(asked), got, s.want)
+				}
+				if got == promptReask {
+					p.AskedAt, p.Reasked = s.at, true
+				}
+			}
+		})
+	}
+}
+
+func TestFlowFor(t *testing.T) {
+	for _, flow := range []string{flowOptions, flowGift, flowContact} {
+		f, ok := flowFor(flow)
+		switch {
+		case !ok:
+			t.Errorf("%s isn't a flow", flow)
+		case f.Soft <= 0 || f.Hard <= f.Soft:
+			t.Errorf("%s times out softly after %s and for good after %s", flow, f.Soft, f.Hard)
+		case f.Ask == nil || f.Abandon == nil:
+			t.Errorf("%s can't be asked again or abandoned", flow)
+		}
+	}
+	if _, ok := flowFor("survey"); ok {
+		t.Error("an unknown flow was found")
+	}
+}
+
+func TestAskOptions(t *testing.T) {
+	vp := versionedPricelist{Modifiers: map[int][]modifierGroup{
+		7: {
+			{Name: "Size", Required: true, Options: []modifierOption{{Name: "Small"}, {Name: "Large"}}},
+			{Name: "Milk", Required: true, Options: []modifierOption{{Name: "Full cream"}, {Name: "Oat"}}},
+			{Name: "Extras", Options: []modifierOption{{Name: "Syrup"}}},
+		},
+	}}
+	choice := func(chosen ...string) json.RawMessage {
+		c := pendingChoice{OrderID: 1, ItemID: 7, Quantity: 1}
+		for _, group := range chosen {
+			c.Chosen = append(c.Chosen, chosenOption{Group: group})
+		}
+		data, err := json.Marshal(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	tests := []struct {
+		name string
+		data json.RawMessage
+		want string // in the question, "" for none
+	}{
+		{"nothing chosen", choice(), "Which size"},
+		{"size chosen", choice("Size"), "Which milk"},
+		{"all required chosen", choice("Size", "Milk"), ""},
+		{"unreadable", json.RawMessage(`"nope"`), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := askOptions(nil, vp, savedPrompt{Flow: flowOptions, Data: tt.data})
+			if tt.want == "" && got != "" || !strings.Contains(got, tt.want) {
+				t.Errorf("askOptions = %q, want a question containing %q", got, tt.want)
+			}
+		})
+	}
+}
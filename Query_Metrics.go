@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every statement on the two databases goes through instrumentedConn,
+// MenuBotLib's and whatsmeow's as much as ours. It is timed into
+// menubot_db_query_seconds by database and caller, logged with its
+// arguments redacted when slower than SLOW_QUERY_THRESHOLD, and the slowest
+// are kept for "debug". The caller is the label withQueryCaller put on the
+// statement's context. Neither library passes a context that could carry
+// one, and walking the stack on every statement costs more than the label
+// is worth, so without one the WhatsApp store's statements are whatsmeow's
+// and the rest are jobs. The time is until the driver returns, which for
+// a query is before its rows are read.
+
+const (
+	// queryStatsMax caps the distinct statements kept for "debug"; ours
+	// and the libraries' are fixed strings, so it is only ever reached by
+	// something building SQL it shouldn't.
+	queryStatsMax = 500
+	// queryStatsShown is how many of the slowest "debug" lists.
+	queryStatsShown = 5
+	queryShownLen   = 120
+)
+
+// Callers, for the menubot_db_query_seconds caller label.
+const (
+	callerAPI      = "api"
+	callerWhatsApp = "whatsapp"
+	callerJobs     = "jobs" // anything unlabelled on the app database
+)
+
+var queryBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type queryCallerKey struct{}
+
+// withQueryCaller labels the statements run with ctx as being for caller.
+func withQueryCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, queryCallerKey{}, caller)
+}
+
+// labelQueries is withQueryCaller as middleware.
+func labelQueries(caller string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(w, r.WithContext(withQueryCaller(r.Context(), caller)))
+		})
+	}
+}
+
+// queryCaller names who a statement on database db, run with ctx, is for.
+func queryCaller(ctx context.Context, db string) string {
+	if caller, ok := ctx.Value(queryCallerKey{}).(string); ok {
+		return caller
+	}
+	if db == "whatsapp" {
+		return callerWhatsApp
+	}
+	return callerJobs
+}
+
+// instrumentDB reopens db, which must not have been used yet, as a pool
+// whose connections are instrumented, labelled label.
+func instrumentDB(db *sql.DB, dsn, label string) (*sql.DB, error) {
+	var base driver.Connector = dsnConnector{dsn: dsn, driver: db.Driver()}
+	if dc, ok := db.Driver().(driver.DriverContext); ok {
+		c, err := dc.OpenConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+		base = c
+	}
+	db.Close()
+	return sql.OpenDB(instrumentedConnector{base: base, db: label}), nil
+}
+
+// dsnConnector is what database/sql itself uses for drivers without a
+// connector of their own, lib/pq and the sqlite one among them.
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) { return c.driver.Open(c.dsn) }
+func (c dsnConnector) Driver() driver.Driver                        { return c.driver }
+
+type instrumentedConnector struct {
+	base driver.Connector
+	db   string
+}
+
+func (c instrumentedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.base.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedConn{Conn: conn, db: c.db}, nil
+}
+
+func (c instrumentedConnector) Driver() driver.Driver { return c.base.Driver() }
+
+// instrumentedConn passes everything on to the driver's connection, saying
+// it can't do what the driver can't so database/sql falls back as it would
+// without it.
+type instrumentedConn struct {
+	driver.Conn
+	db string
+}
+
+func (c *instrumentedConn) observe(ctx context.Context, query string, args []driver.NamedValue, start time.Time) {
+	took := time.Since(start)
+	caller := queryCaller(ctx, c.db)
+	metrics.Observe("menubot_db_query_seconds", "Time SQL statements took, by database and caller.", queryBuckets, took.Seconds(),
+		"db", c.db, "caller", caller)
+	query = strings.Join(strings.Fields(query), " ")
+	queryStats.record(query, c.db, caller, took)
+	// Preflight may query before there is a runtime config, when it failed
+	// to load.
+	if rc := cfg(); rc != nil && rc.SlowQuery > 0 && took >= rc.SlowQuery {
+		log.Printf("Slow query on %s for %s took %s: %s %s", c.db, caller, took.Round(time.Millisecond), query, redactQueryArgs(args))
+	}
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if p, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = p.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &instrumentedStmt{Stmt: stmt, conn: c, query: query}, nil
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	res, err := e.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.observe(ctx, query, args, start)
+	}
+	return res, err
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.observe(ctx, query, args, start)
+	}
+	return rows, err
+}
+
+func (c *instrumentedConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *instrumentedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+type instrumentedStmt struct {
+	driver.Stmt
+	conn  *instrumentedConn
+	query string
+}
+
+func (s *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	defer s.conn.observe(ctx, s.query, args, start)
+	if e, ok := s.Stmt.(driver.StmtExecContext); ok {
+		return e.ExecContext(ctx, args)
+	}
+	values, err := driverValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.Exec(values)
+}
+
+func (s *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	defer s.conn.observe(ctx, s.query, args, start)
+	if q, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		return q.QueryContext(ctx, args)
+	}
+	values, err := driverValues(args)
+	if err != nil {
+		return nil, err
+	}
+	return s.Stmt.Query(values)
+}
+
+func (s *instrumentedStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if n, ok := s.Stmt.(driver.NamedValueChecker); ok {
+		return n.CheckNamedValue(nv)
+	}
+	return s.conn.CheckNamedValue(nv)
+}
+
+func driverValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, a := range args {
+		if a.Name != "" {
+			return nil, fmt.Errorf("the driver doesn't support named arguments")
+		}
+		values[i] = a.Value
+	}
+	return values, nil
+}
+
+// redactQueryArgs shows a query's arguments without what customers wrote
+// or their numbers: text as its length and a hash, the rest as is.
+func redactQueryArgs(args []driver.NamedValue) string {
+	parts := make([]string, len(args))
+	for i, a := range args {
+		switch v := a.Value.(type) {
+		case string:
+			parts[i] = redactBody(v)
+		case []byte:
+			parts[i] = redactBody(string(v))
+		default:
+			parts[i] = fmt.Sprint(v)
+		}
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// queryStat is how a statement has fared since startup.
+type queryStat struct {
+	Query  string  `json:"query"`
+	DB     string  `json:"db"`
+	Caller string  `json:"caller"` // of its slowest run
+	Count  int64   `json:"count"`
+	MaxMS  float64 `json:"max_ms"`
+	MeanMS float64 `json:"mean_ms"`
+
+	total, max time.Duration
+}
+
+type queryStatsTracker struct {
+	mu    sync.Mutex
+	stats map[string]*queryStat
+}
+
+var queryStats = &queryStatsTracker{stats: map[string]*queryStat{}}
+
+func (t *queryStatsTracker) record(query, db, caller string, took time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := db + "\x00" + query
+	s, ok := t.stats[key]
+	if !ok {
+		if len(t.stats) >= queryStatsMax {
+			return
+		}
+		s = &queryStat{Query: query, DB: db}
+		t.stats[key] = s
+	}
+	s.Count++
+	s.total += took
+	if took > s.max {
+		s.max, s.Caller = took, caller
+	}
+}
+
+// slowest returns the n statements with the slowest single run.
+func (t *queryStatsTracker) slowest(n int) []queryStat {
+	t.mu.Lock()
+	stats := make([]queryStat, 0, len(t.stats))
+	for _, s := range t.stats {
+		stat := *s
+		stat.MaxMS = float64(s.max) / float64(time.Millisecond)
+		stat.MeanMS = float64(s.total) / float64(s.Count) / float64(time.Millisecond)
+		stats = append(stats, stat)
+	}
+	t.mu.Unlock()
+	sort.Slice(stats, func(i, j int) bool { return stats[i].max > stats[j].max })
+	if len(stats) > n {
+		stats = stats[:n]
+	}
+	return stats
+}
+
+func (s queryStat) String() string {
+	query := s.Query
+	if len(query) > queryShownLen {
+		query = query[:queryShownLen] + "..."
+	}
+	return fmt.Sprintf("%.0fms max, %.1fms mean over %d (%s, %s): %s", s.MaxMS, s.MeanMS, s.Count, s.DB, s.Caller, query)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"testing"
+)
+
+type plainConn struct{}
+
+func (plainConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("no statements") }
+func (plainConn) Close() error                        { return nil }
+func (plainConn) Begin() (driver.Tx, error)           { return nil, errors.New("no transactions") }
+
+// poolConn also says whether it can be reused, as lib/pq's and the sqlite
+// driver's connections do.
+type poolConn struct {
+	plainConn
+	resetErr error
+	valid    bool
+}
+
+func (c poolConn) ResetSession(context.Context) error { return c.resetErr }
+func (c poolConn) IsValid() bool                      { return c.valid }
+
+func TestInstrumentedConnPool(t *testing.T) {
+	tests := []struct {
+		name      string
+		conn      driver.Conn
+		wantReset error
+		wantValid bool
+	}{
+		{"driver without either", plainConn{}, nil, true},
+		{"reusable", poolConn{valid: true}, nil, true},
+		{"bad after a reset", poolConn{resetErr: driver.ErrBadConn, valid: true}, driver.ErrBadConn, true},
+		{"broken", poolConn{valid: false}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &instrumentedConn{Conn: tt.conn, db: "app"}
+			// database/sql only asks through these interfaces.
+			var conn driver.Conn = c
+			if err := conn.(driver.SessionResetter).ResetSession(context.Background()); err != tt.wantReset {
+				t.Errorf("ResetSession = %v, want %v", err, tt.wantReset)
+			}
+			if got := conn.(driver.Validator).IsValid(); got != tt.wantValid {
+				t.Errorf("IsValid = %v, want %v", got, tt.wantValid)
+			}
+		})
+	}
+}
+
+func TestQueryCaller(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  context.Context
+		db   string
+		want string
+	}{
+		{"unlabelled app statement", context.Background(), "app", callerJobs},
+		{"whatsmeow's", context.Background(), "whatsapp", callerWhatsApp},
+		{"labelled", withQueryCaller(context.Background(), callerAPI), "app", callerAPI},
+		{"label wins on the store too", withQueryCaller(context.Background(), callerAPI), "whatsapp", callerAPI},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := queryCaller(tt.ctx, tt.db); got != tt.want {
+				t.Errorf("queryCaller = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Quiet hours hold back messages nobody asked for, broadcasts, reminders
+// and summaries, until the window ends. Replies and order updates are
+// transactional and go out regardless. Held messages are kept in the
+// database so a restart doesn't lose them.
+
+// Kinds of bulk message, which decide what makes a held one irrelevant.
+const (
+	bulkBroadcast = "broadcast" // dropped if the customer has since unsubscribed
+	bulkAdmin     = "admin"     // reminders and summaries for the shop
+	bulkRating    = "rating"    // asks about a finished order
+	bulkExpiry    = "expiry"    // tells a customer their unpaid order expired
+	bulkPrompt    = "prompt"    // gives up on a question the customer never answered
+)
+
+const quietHoursCheck = time.Minute
+
+// bulkMessage is a non-transactional message. A held message is dropped
+// rather than sent late when ExpiresAt has passed or, for one about an
+// order, when the order is no longer in OrderStatus.
+type bulkMessage struct {
+	Recipient   string
+	Text        string
+	Kind        string
+	OrderID     int64
+	OrderStatus string
+	ExpiresAt   *time.Time
+}
+
+// quietUntil reports whether now is in quiet hours and, if so, when they
+// end.
+func quietUntil(rc *RuntimeConfig, now time.Time) (time.Time, bool) {
+	if rc.QuietHours == nil {
+		return time.Time{}, false
+	}
+	t := now.In(rc.BusinessHours.Location)
+	if !rc.QuietHours.Contains(t) {
+		return time.Time{}, false
+	}
+	end := time.Date(t.Year(), t.Month(), t.Day(), rc.QuietHours.End/60, rc.QuietHours.End%60, 0, 0, t.Location())
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end, true
+}
+
+func quietHoursString(w *TimeWindow) string {
+	if w == nil {
+		return "off"
+	}
+	return w.String()
+}
+
+// sendBulk sends m now, or holds it until quiet hours end. It reports
+// whether the message was held.
+func (cc *commandContext) sendBulk(m bulkMessage) bool {
+	if _, quiet := quietUntil(cfg(), time.Now()); !quiet {
+		cc.sender.Send(m.Recipient, m.Text, priorityBulk)
+		return false
+	}
+	_, err := cc.db.Exec(`INSERT INTO deferred_messages (recipient, body, kind, order_id, order_status, expires_at)
+		VALUES ($1, $2, $3, NULLIF($4, 0), NULLIF($5, ''), $6)`, m.Recipient, m.Text, m.Kind, m.OrderID, m.OrderStatus, m.ExpiresAt)
+	if err != nil {
+		// Better late at night than never.
+		log.Printf("Holding message for %s until quiet hours end failed, sending it now: %v", m.Recipient, err)
+		cc.sender.Send(m.Recipient, m.Text, priorityBulk)
+		return false
+	}
+	metrics.Inc("menubot_messages_deferred_total", "Bulk messages held back by quiet hours.", "kind", m.Kind)
+	return true
+}
+
+// releaseDeferredMessages sends held messages whenever it isn't quiet
+// hours, including ones held before a restart.
+func releaseDeferredMessages(cc *commandContext) error {
+	if _, quiet := quietUntil(cfg(), time.Now()); quiet {
+		return nil
+	}
+	if err := releaseDeferred(cc); err != nil {
+		return fmt.Errorf("releasing held messages: %w", err)
+	}
+	return nil
+}
+
+// releaseDeferred works through the held messages oldest first. Each is
+// removed before it is sent, so it goes out at most once; a failed send
+// still ends up in the outbox.
+func releaseDeferred(cc *commandContext) error {
+	var sent, dropped int
+	for {
+		var m bulkMessage
+		var orderID sql.NullInt64
+		var orderStatus sql.NullString
+		err := cc.db.QueryRow(`DELETE FROM deferred_messages WHERE id = (
+				SELECT id FROM deferred_messages ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED)
+			RETURNING recipient, body, kind, order_id, order_status, expires_at`).
+			Scan(&m.Recipient, &m.Text, &m.Kind, &orderID, &orderStatus, &m.ExpiresAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		m.OrderID, m.OrderStatus = orderID.Int64, orderStatus.String
+		if reason := staleReason(cc.db, m, time.Now()); reason != "" {
+			metrics.Inc("menubot_deferred_dropped_total", "Held messages that were no longer relevant when quiet hours ended.", "reason", reason)
+			dropped++
+			continue
+		}
+		cc.sender.Send(m.Recipient, m.Text, priorityBulk)
+		sent++
+	}
+	if sent+dropped > 0 {
+		log.Printf("Quiet hours over: sent %d held messages, dropped %d that no longer applied", sent, dropped)
+	}
+	return nil
+}
+
+// staleReason says why a held message shouldn't be sent any more, or ""
+// if it should.
+func staleReason(db *sql.DB, m bulkMessage, now time.Time) string {
+	if m.ExpiresAt != nil && !now.Before(*m.ExpiresAt) {
+		return "expired"
+	}
+	if m.Kind == bulkBroadcast {
+		optedIn, err := isOptedIn(db, m.Recipient)
+		if err != nil {
+			log.Printf("Reading consent of %s failed, dropping held broadcast: %v", m.Recipient, err)
+			return "error"
+		}
+		if !optedIn {
+			return "unsubscribed"
+		}
+	}
+	if m.OrderID != 0 {
+		order, found, err := getOrder(db, m.OrderID)
+		if err != nil {
+			log.Printf("Reading order %d failed, dropping held message: %v", m.OrderID, err)
+			return "error"
+		}
+		if !found || order.Status != m.OrderStatus {
+			return "order_changed"
+		}
+	}
+	return ""
+}
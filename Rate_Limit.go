@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// senderLimiter caps how many messages each sender may have handled per
+// minute. The limit is read from the runtime config on every call so a
+// reload takes effect immediately.
+type senderLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newSenderLimiter() *senderLimiter {
+	return &senderLimiter{windows: make(map[string]*rateWindow)}
+}
+
+// Allow records a message from sender and reports whether it is within the
+// configured limit.
+func (l *senderLimiter) Allow(sender string, now time.Time) bool {
+	limit := cfg().RateLimit
+	if limit == 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	w, ok := l.windows[sender]
+	if !ok || now.Sub(w.start) >= time.Minute {
+		l.pruneLocked(now)
+		l.windows[sender] = &rateWindow{start: now, count: 1}
+		return true
+	}
+	w.count++
+	return w.count <= limit
+}
+
+// pruneLocked drops expired windows so the map doesn't grow with every
+// number that has ever messaged us.
+func (l *senderLimiter) pruneLocked(now time.Time) {
+	for sender, w := range l.windows {
+		if now.Sub(w.start) >= time.Minute {
+			delete(l.windows, sender)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RATING_PROMPT_DELAY after an order is collected or delivered, the
+// customer is asked to rate it. The order_ratings row is written before the
+// prompt goes out, so an order is only ever asked about once. The next
+// message after the prompt either rates the order or, if it isn't a
+// rating, closes the prompt unanswered.
+
+const (
+	ratingPromptCheck = time.Minute
+	// ratingPromptMaxAge stops orders finished long ago, e.g. before the
+	// prompt was enabled, from all being asked about at once.
+	ratingPromptMaxAge = 24 * time.Hour
+	// ratingReplyWindow is how long after the prompt a rating is accepted.
+	ratingReplyWindow = 48 * time.Hour
+	// lowRating and below alert the admin.
+	lowRating = 2
+)
+
+const ratingPrompt = "How was your order? Reply 1-5 (5 is best), and add a comment if you like."
+
+var ratingPattern = regexp.MustCompile(`(?s)^\s*([1-5])(?:\s*/\s*5)?(?:[\s.,:;!-]+(.*))?$`)
+
+// promptRatings asks about orders that finished RATING_PROMPT_DELAY ago.
+func promptRatings(cc *commandContext) error {
+	if delay := cfg().RatingPromptDelay; delay > 0 {
+		return promptDueRatings(cc, delay, time.Now())
+	}
+	return nil
+}
+
+func promptDueRatings(cc *commandContext, delay time.Duration, now time.Time) error {
+	due, err := listOrders(cc.db, ` WHERE m.status IN ($1, $2) AND m.updated_at <= $3 AND m.updated_at > $4
+		AND NOT EXISTS (SELECT 1 FROM order_ratings r WHERE r.order_id = o.`+orderIDColumn+`)`,
+		statusCollected, statusDelivered, now.Add(-delay), now.Add(-delay-ratingPromptMaxAge))
+	if err != nil {
+		return err
+	}
+	for _, o := range due {
+		res, err := cc.db.Exec(`INSERT INTO order_ratings (order_id, cell_number) VALUES ($1, $2)
+			ON CONFLICT (order_id) DO NOTHING`, o.ID, o.CellNumber)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		metrics.Inc("menubot_rating_prompts_total", "Rating prompts sent for finished orders.")
+		cc.sendBulk(bulkMessage{Recipient: o.CellNumber, Text: ratingPrompt, Kind: bulkRating, OrderID: o.ID, OrderStatus: o.Status})
+	}
+	return nil
+}
+
+// ratingReply handles the customer's first message after a rating prompt.
+// It reports false for anything but a rating, which closes the prompt and
+// is then answered as usual.
+func ratingReply(cc *commandContext, cell, msg string, now time.Time) (string, bool) {
+	var orderID int64
+	err := cc.db.QueryRow(`SELECT order_id FROM order_ratings
+		WHERE cell_number = $1 AND rating IS NULL AND NOT dismissed AND prompted_at > $2
+		ORDER BY prompted_at DESC LIMIT 1`, cell, now.Add(-ratingReplyWindow)).Scan(&orderID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Reading rating prompt of %s failed: %v", cell, err)
+		}
+		return "", false
+	}
+	match := ratingPattern.FindStringSubmatch(msg)
+	if match == nil {
+		if _, err := cc.db.Exec(`UPDATE order_ratings SET dismissed = true WHERE cell_number = $1 AND rating IS NULL`, cell); err != nil {
+			log.Printf("Closing rating prompt of %s failed: %v", cell, err)
+		}
+		return "", false
+	}
+	rating, _ := strconv.Atoi(match[1])
+	comment := strings.TrimSpace(match[2])
+	if _, err := cc.db.Exec(`UPDATE order_ratings SET rating = $2, comment = $3, rated_at = $4 WHERE order_id = $1`,
+		orderID, rating, comment, now); err != nil {
+		return cc.apology(incidentRatingSave, cell, orderID, err, "Rating: saving the rating",
+			"Sorry, something went wrong saving your rating. Please try again."), true
+	}
+	metrics.Inc("menubot_ratings_total", "Ratings customers gave their orders.", "rating", match[1])
+	if rating > lowRating {
+		return "Thanks for rating your order!", true
+	}
+	alert := fmt.Sprintf("Order %d was rated %d/5.", orderID, rating)
+	if comment != "" {
+		alert += "\nComment: " + comment
+	}
+	if details, err := buildPickList(cc, orderID); err != nil {
+		log.Printf("Reading order %d for the rating alert failed: %v", orderID, err)
+		alert += "\nCustomer: " + cell
+	} else {
+		alert += "\n\n" + details
+	}
+	cc.sender.SendOrder(cc.envVars.AdminNumber, alert, priorityNotify, orderID)
+	return "Thanks for letting us know, and sorry it wasn't better. We've passed this on to the team.", true
+}
+
+type ratingPeriod struct {
+	Start   time.Time `json:"start"`
+	Ratings int       `json:"ratings"`
+	Average float64   `json:"average"`
+}
+
+type ratingReport struct {
+	From         time.Time      `json:"from"`
+	To           time.Time      `json:"to"`
+	Interval     string         `json:"interval"`
+	Prompted     int            `json:"prompted"`
+	Ratings      int            `json:"ratings"`
+	Average      float64        `json:"average"`
+	Distribution map[int]int    `json:"distribution"`
+	Periods      []ratingPeriod `json:"periods"`
+}
+
+var ratingIntervals = map[string]bool{"day": true, "week": true, "month": true}
+
+func buildRatingReport(db *sql.DB, from, to time.Time, interval string) (ratingReport, error) {
+	report := ratingReport{From: from, To: to, Interval: interval, Distribution: map[int]int{}, Periods: []ratingPeriod{}}
+	if err := db.QueryRow(`SELECT count(*) FROM order_ratings WHERE prompted_at >= $1 AND prompted_at < $2`, from, to).
+		Scan(&report.Prompted); err != nil {
+		return report, err
+	}
+
+	rows, err := db.Query(`SELECT rating, count(*) FROM order_ratings
+		WHERE rated_at >= $1 AND rated_at < $2 GROUP BY rating`, from, to)
+	if err != nil {
+		return report, err
+	}
+	sum := 0
+	for rows.Next() {
+		var rating, n int
+		if err := rows.Scan(&rating, &n); err != nil {
+			rows.Close()
+			return report, err
+		}
+		report.Distribution[rating] = n
+		report.Ratings += n
+		sum += rating * n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+	if report.Ratings > 0 {
+		report.Average = float64(sum) / float64(report.Ratings)
+	}
+
+	loc := cfg().BusinessHours.Location
+	rows, err = db.Query(`SELECT date_trunc($3, rated_at AT TIME ZONE $4)::text, count(*), avg(rating)::float8 FROM order_ratings
+		WHERE rated_at >= $1 AND rated_at < $2 GROUP BY 1 ORDER BY 1`, from, to, interval, loc.String())
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var start string
+		var p ratingPeriod
+		if err := rows.Scan(&start, &p.Ratings, &p.Average); err != nil {
+			return report, err
+		}
+		if p.Start, err = time.ParseInLocation("2006-01-02 15:04:05", start, loc); err != nil {
+			return report, err
+		}
+		report.Periods = append(report.Periods, p)
+	}
+	return report, rows.Err()
+}
+
+// RatingReportHandler serves GET /api/reports/ratings?from=&to=&interval=,
+// defaulting to the last 30 days by week.
+func RatingReportHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		from, err := parseReportTime(r.URL.Query().Get("from"), now.AddDate(0, 0, -30))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "from: "+err.Error())
+			return
+		}
+		to, err := parseReportTime(r.URL.Query().Get("to"), now)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "to: "+err.Error())
+			return
+		}
+		interval := r.URL.Query().Get("interval")
+		if interval == "" {
+			interval = "week"
+		}
+		if !ratingIntervals[interval] {
+			writeJSONError(w, http.StatusBadRequest, "interval must be day, week or month")
+			return
+		}
+		report, err := buildRatingReport(db, from, to, interval)
+		if err != nil {
+			log.Printf("Building rating report failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "building report failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
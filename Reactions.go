@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+)
+
+// A reaction to one of our messages about the customer's current order,
+// such as the cart summary or the payment link, stands for typing the
+// command REACTION_ACTIONS maps its emoji to, and goes through the pipeline
+// like a tap on a button does. Any other reaction is only written to the
+// transcript. Removing a reaction does nothing.
+
+const defaultReactionActions = "👍=checkout,❌=cancel order"
+
+// baseEmoji drops skin tones and variation selectors, so 👍🏽 counts as 👍.
+func baseEmoji(emoji string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 0x1F3FB && r <= 0x1F3FF) || r == 0xFE0F {
+			return -1
+		}
+		return r
+	}, strings.TrimSpace(emoji))
+}
+
+// parseReactionActions reads "emoji=command" pairs separated by commas.
+func parseReactionActions(s string) (map[string]string, error) {
+	actions := map[string]string{}
+	if s == "none" {
+		return actions, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		emoji, command, ok := strings.Cut(pair, "=")
+		emoji, command = baseEmoji(emoji), strings.TrimSpace(command)
+		if !ok || emoji == "" || command == "" {
+			return nil, fmt.Errorf("%q is not an emoji=command pair such as 👍=checkout", pair)
+		}
+		actions[emoji] = command
+	}
+	return actions, nil
+}
+
+func reactionActionsString(actions map[string]string) string {
+	pairs := make([]string, 0, len(actions))
+	for emoji, command := range actions {
+		pairs = append(pairs, emoji+"="+command)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// reactionCommand returns the command a reaction stands for. ok is false
+// when it stands for nothing and should not be answered.
+func reactionCommand(db *sql.DB, cell, messageID string, r *waProto.ReactionMessage) (command string, ok bool) {
+	emoji, target := r.GetText(), r.GetKey().GetID()
+	if emoji == "" {
+		return "", false
+	}
+	if command, mapped := cfg().ReactionActions[baseEmoji(emoji)]; mapped {
+		var orderID sql.NullInt64
+		err := db.QueryRow(`SELECT order_id FROM outbound_messages WHERE message_id = $1`, target).Scan(&orderID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("Reading the message %s reacted to failed: %v", cell, err)
+		}
+		if orderID.Valid {
+			order, found, err := latestOrder(db, cell)
+			if err != nil {
+				log.Printf("Reading latest order of %s failed: %v", cell, err)
+			} else if found && order.ID == orderID.Int64 && !order.finished() {
+				metrics.Inc("menubot_reaction_commands_total", "Reactions taken as a typed command.", "command", command)
+				return command, true
+			}
+		}
+	}
+	recordTranscript(db, cell, transcriptInbound, messageID, fmt.Sprintf("reacted %s to %s", emoji, target))
+	return "", false
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JeremyJalpha/MenuBot_WebAPI/httpapi"
+)
+
+// Each night the previous day's paid orders are checked against the stored
+// PayFast notifications, so a discrepancy with PayFast's statement shows up
+// the next morning rather than at month end. Matching is by pf_payment_id
+// whatever day either side fell on, so an order paid just before midnight
+// whose ITN is processed just after still matches.
+
+const (
+	// reconciliationHour leaves time for ITNs from just before midnight
+	// to arrive and be processed.
+	reconciliationHour = 2
+	// reconciliationIssuesListed caps the discrepancies in the admin
+	// summary; the API has them all.
+	reconciliationIssuesListed = 10
+)
+
+// Kinds of discrepancy.
+const (
+	issueOrderWithoutITN = "order_without_notification"
+	issueITNWithoutOrder = "notification_without_order"
+	issueAmountMismatch  = "amount_mismatch"
+)
+
+type reconciliationIssue struct {
+	Kind        string `json:"kind"`
+	OrderID     int64  `json:"order_id,omitempty"`
+	OrderRef    string `json:"order_ref,omitempty"`
+	PfPaymentID string `json:"pf_payment_id,omitempty"`
+	Expected    string `json:"expected,omitempty"`
+	Paid        string `json:"paid,omitempty"`
+	Detail      string `json:"detail,omitempty"`
+}
+
+type reconciliationReport struct {
+	Date          string                `json:"date"`
+	PaidOrders    int                   `json:"paid_orders"`
+	Notifications int                   `json:"notifications"`
+	Discrepancies []reconciliationIssue `json:"discrepancies"`
+	GeneratedAt   time.Time             `json:"generated_at"`
+	// Provisional reports were built before the nightly job would have
+	// run, so ITNs still arriving may change them.
+	Provisional bool `json:"provisional,omitempty"`
+}
+
+// dayBounds returns the start and end of the business day named by date.
+func dayBounds(date time.Time) (time.Time, time.Time) {
+	loc := cfg().BusinessHours.Location
+	t := date.In(loc)
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, loc)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// itnField reads one field from a stored ITN payload.
+func itnField(payload, key string) string {
+	params, err := httpapi.ParseITNParams(payload)
+	if err != nil {
+		return ""
+	}
+	return httpapi.ITNValues(params).Get(key)
+}
+
+// buildReconciliation compares the orders paid and the COMPLETE
+// notifications received on the day starting at start.
+func buildReconciliation(db *sql.DB, start, end time.Time) (reconciliationReport, error) {
+	report := reconciliationReport{
+		Date:          start.Format("2006-01-02"),
+		Discrepancies: []reconciliationIssue{},
+		GeneratedAt:   time.Now().UTC(),
+	}
+
+	// Notifications stored before payment_status was recorded have it
+	// blank, so their payload is checked instead.
+	rows, err := db.Query(`SELECT m.order_id, COALESCE(o.`+orderTotalColumn+`::text, ''), m.pf_payment_id, n.payload
+		FROM order_meta m JOIN `+orderTable+` o ON o.`+orderIDColumn+` = m.order_id
+		LEFT JOIN LATERAL (SELECT payload FROM payment_notifications
+			WHERE pf_payment_id = m.pf_payment_id AND payment_status IN ($3, '') ORDER BY id LIMIT 1) n ON true
+		WHERE m.paid_at >= $1 AND m.paid_at < $2 AND m.pf_payment_id IS NOT NULL AND NOT m.self_test
+		ORDER BY m.order_id`, start, end, pfComplete)
+	if err != nil {
+		return report, err
+	}
+	type paidOrder struct {
+		id          int64
+		total       string
+		pfPaymentID string
+		payload     sql.NullString
+	}
+	var paid []paidOrder
+	for rows.Next() {
+		var o paidOrder
+		if err := rows.Scan(&o.id, &o.total, &o.pfPaymentID, &o.payload); err != nil {
+			rows.Close()
+			return report, err
+		}
+		if o.payload.String, err = openField(fieldITNPayload, o.payload.String); err != nil {
+			rows.Close()
+			return report, fmt.Errorf("reading the notification of order %d: %w", o.id, err)
+		}
+		paid = append(paid, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return report, err
+	}
+	report.PaidOrders = len(paid)
+	for _, o := range paid {
+		if !o.payload.Valid || !strings.EqualFold(itnField(o.payload.String, "payment_status"), pfComplete) {
+			report.Discrepancies = append(report.Discrepancies, reconciliationIssue{
+				Kind: issueOrderWithoutITN, OrderID: o.id, PfPaymentID: o.pfPaymentID,
+				Detail: "order is marked paid but no COMPLETE notification was stored for its payment",
+			})
+			continue
+		}
+		surcharge, err := orderSurcharge(db, o.id)
+		if err != nil {
+			return report, fmt.Errorf("reading options of order %d: %w", o.id, err)
+		}
+		discount, err := orderDiscount(db, o.id)
+		if err != nil {
+			return report, fmt.Errorf("reading discount of order %d: %w", o.id, err)
+		}
+		if amount := itnField(o.payload.String, "amount_gross"); !amountsMatch(o.total, surcharge, discount, amount) {
+			expected := o.total
+			if t, err := strconv.ParseFloat(o.total, 64); err == nil {
+				expected = strconv.FormatFloat(payableAmount(t, surcharge, discount), 'f', 2, 64)
+			}
+			report.Discrepancies = append(report.Discrepancies, reconciliationIssue{
+				Kind: issueAmountMismatch, OrderID: o.id, PfPaymentID: o.pfPaymentID, Expected: expected, Paid: amount,
+			})
+		}
+	}
+
+	rows, err = db.Query(`SELECT n.pf_payment_id, n.order_ref, n.state, n.payload, m.order_id
+		FROM payment_notifications n LEFT JOIN order_meta m ON m.pf_payment_id = n.pf_payment_id AND m.paid_at IS NOT NULL
+		WHERE n.received_at >= $1 AND n.received_at < $2 AND n.payment_status IN ($3, '')
+			AND n.pf_payment_id NOT LIKE '`+selfTestPaymentPrefix+`%'
+		ORDER BY n.id`, start, end, pfComplete)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var pfPaymentID, orderRef, state, payload string
+		var orderID sql.NullInt64
+		if err := rows.Scan(&pfPaymentID, &orderRef, &state, &payload, &orderID); err != nil {
+			return report, err
+		}
+		if payload, err = openField(fieldITNPayload, payload); err != nil {
+			return report, fmt.Errorf("reading the notification of payment %s: %w", pfPaymentID, err)
+		}
+		if !strings.EqualFold(itnField(payload, "payment_status"), pfComplete) {
+			continue
+		}
+		report.Notifications++
+		if orderID.Valid {
+			continue
+		}
+		report.Discrepancies = append(report.Discrepancies, reconciliationIssue{
+			Kind: issueITNWithoutOrder, OrderRef: orderRef, PfPaymentID: pfPaymentID,
+			Paid:   itnField(payload, "amount_gross"),
+			Detail: fmt.Sprintf("notification is %s but no order is marked paid by it", state),
+		})
+	}
+	return report, rows.Err()
+}
+
+func storeReconciliation(db *sql.DB, report reconciliationReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO reconciliation_reports (report_date, report, discrepancies) VALUES ($1, $2, $3)
+		ON CONFLICT (report_date) DO UPDATE SET report = EXCLUDED.report, discrepancies = EXCLUDED.discrepancies, created_at = now()`,
+		report.Date, string(data), len(report.Discrepancies))
+	return err
+}
+
+func storedReconciliation(db *sql.DB, date string) (reconciliationReport, bool, error) {
+	var data []byte
+	err := db.QueryRow(`SELECT report FROM reconciliation_reports WHERE report_date = $1`, date).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return reconciliationReport{}, false, nil
+	}
+	if err != nil {
+		return reconciliationReport{}, false, err
+	}
+	var report reconciliationReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return reconciliationReport{}, false, err
+	}
+	return report, true, nil
+}
+
+func reconciliationSummary(report reconciliationReport) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Payment reconciliation for %s found %d discrepancies (%d paid orders, %d PayFast notifications):",
+		report.Date, len(report.Discrepancies), report.PaidOrders, report.Notifications)
+	for _, issue := range report.Discrepancies[:min(len(report.Discrepancies), reconciliationIssuesListed)] {
+		switch issue.Kind {
+		case issueOrderWithoutITN:
+			fmt.Fprintf(&b, "\n- Order %d is paid but has no PayFast notification (%s)", issue.OrderID, issue.PfPaymentID)
+		case issueITNWithoutOrder:
+			fmt.Fprintf(&b, "\n- PayFast payment %s of R%s for order %s paid no order", issue.PfPaymentID, issue.Paid, issue.OrderRef)
+		case issueAmountMismatch:
+			fmt.Fprintf(&b, "\n- Order %d should have paid R%s but PayFast says R%s", issue.OrderID, issue.Expected, issue.Paid)
+		}
+	}
+	if n := len(report.Discrepancies) - reconciliationIssuesListed; n > 0 {
+		fmt.Fprintf(&b, "\n...and %d more.", n)
+	}
+	fmt.Fprintf(&b, "\nFull report: GET %s/reports/reconciliation?date=%s", apiBaseURL, report.Date)
+	return b.String()
+}
+
+// reconcilePayments reconciles yesterday, as a nightly job, and messages
+// the admin only when something doesn't match. A day already reconciled
+// isn't done again.
+func reconcilePayments(cc *commandContext) error {
+	start, end := dayBounds(time.Now().AddDate(0, 0, -1))
+	if err := reconcileDay(cc, start, end); err != nil {
+		return fmt.Errorf("payment reconciliation for %s: %w", start.Format("2006-01-02"), err)
+	}
+	return nil
+}
+
+func reconcileDay(cc *commandContext, start, end time.Time) error {
+	if _, done, err := storedReconciliation(cc.db, start.Format("2006-01-02")); err != nil || done {
+		return err
+	}
+	report, err := buildReconciliation(cc.db, start, end)
+	if err != nil {
+		return err
+	}
+	if err := storeReconciliation(cc.db, report); err != nil {
+		return err
+	}
+	log.Printf("Payment reconciliation for %s: %d paid orders, %d notifications, %d discrepancies",
+		report.Date, report.PaidOrders, report.Notifications, len(report.Discrepancies))
+	if len(report.Discrepancies) > 0 {
+		metrics.Add("menubot_reconciliation_discrepancies_total", "Discrepancies found reconciling orders with PayFast notifications.", float64(len(report.Discrepancies)))
+		cc.sendBulk(bulkMessage{Recipient: cc.envVars.AdminNumber, Text: reconciliationSummary(report), Kind: bulkAdmin})
+	}
+	return nil
+}
+
+// ReconciliationReportHandler serves GET /api/reports/reconciliation?date=,
+// defaulting to yesterday. A day the nightly job hasn't covered yet is
+// reconciled on the spot but not stored, so the job still alerts on it.
+func ReconciliationReportHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		date, err := parseReportTime(r.URL.Query().Get("date"), now.AddDate(0, 0, -1))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "date: "+err.Error())
+			return
+		}
+		start, end := dayBounds(date)
+		report, found, err := storedReconciliation(db, start.Format("2006-01-02"))
+		if err == nil && !found {
+			report, err = buildReconciliation(db, start, end)
+			report.Provisional = now.Before(end.Add(reconciliationHour * time.Hour))
+		}
+		if err != nil {
+			log.Printf("Building reconciliation report for %s failed: %v", start.Format("2006-01-02"), err)
+			writeJSONError(w, http.StatusInternalServerError, "building report failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// referralAlphabet leaves out 0/O and 1/I/L so codes survive being
+	// read out or typed from memory.
+	referralAlphabet   = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+	referralCodeLength = 6
+	referralReason     = "referral"
+)
+
+func newReferralCode() (string, error) {
+	b := make([]byte, referralCodeLength)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(referralAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = referralAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// referralCode returns the customer's share code, creating one on first
+// use. If the new code collides with someone else's the insert does
+// nothing and another code is tried.
+func referralCode(db *sql.DB, cellNumber string) (string, error) {
+	for attempt := 0; attempt < 5; attempt++ {
+		var code string
+		err := db.QueryRow(`SELECT code FROM referral_codes WHERE cell_number = $1`, cellNumber).Scan(&code)
+		if err == nil {
+			return code, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return "", err
+		}
+		if code, err = newReferralCode(); err != nil {
+			return "", err
+		}
+		if _, err := db.Exec(`INSERT INTO referral_codes (cell_number, code) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+			cellNumber, code); err != nil {
+			return "", err
+		}
+	}
+	return "", errors.New("could not find an unused referral code")
+}
+
+// hasPaidOrder reports whether the customer has ever paid for an order.
+func hasPaidOrder(db dbtx, cellNumber string) (bool, error) {
+	var paid bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM `+orderTable+` o JOIN order_meta m ON m.order_id = o.`+orderIDColumn+`
+		WHERE o.`+orderCellColumn+` = $1 AND m.paid_at IS NOT NULL)`, cellNumber).Scan(&paid)
+	return paid, err
+}
+
+func customerRefer(cc *commandContext, sender string, _ []string) string {
+	code, err := referralCode(cc.db, sender)
+	if err != nil {
+		return cc.apology(incidentReferralCreate, sender, 0, err, "Refer: creating the code",
+			"Sorry, something went wrong creating your referral code. Please try again.")
+	}
+	points := cfg().ReferralPoints
+	if points == 0 {
+		return fmt.Sprintf("Your referral code is %s. Friends can send \"ref %s\" before their first order.", code, code)
+	}
+	return fmt.Sprintf("Your referral code is %s. When a friend sends \"ref %s\" before their first order, you each get %d points once it's paid.",
+		code, code, points)
+}
+
+// customerRef links a new customer to whoever referred them. It only works
+// before the customer's first paid order, once per customer.
+func customerRef(cc *commandContext, sender string, args []string) string {
+	failed := func(err error, context string) string {
+		return cc.apology(incidentReferralRecord, sender, 0, err, "Ref: "+context,
+			"Sorry, something went wrong recording your referral. Please try again.")
+	}
+	if len(args) != 1 {
+		return "Send \"ref\" followed by your friend's code, e.g. \"ref ABC234\"."
+	}
+	code := strings.ToUpper(args[0])
+
+	var referrer string
+	err := cc.db.QueryRow(`SELECT cell_number FROM referral_codes WHERE code = $1`, code).Scan(&referrer)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Sprintf("%s isn't a referral code we know. Please check it and try again.", code)
+	}
+	if err != nil {
+		return failed(err, "looking up code "+code)
+	}
+	if referrer == sender {
+		return "You can't use your own referral code."
+	}
+	paid, err := hasPaidOrder(cc.db, sender)
+	if err != nil {
+		return failed(err, "checking for a paid order")
+	}
+	if paid {
+		return "Referral codes only work before your first order."
+	}
+
+	res, err := cc.db.Exec(`INSERT INTO referrals (referred_cell, referrer_cell, code) VALUES ($1, $2, $3)
+		ON CONFLICT (referred_cell) DO NOTHING`, sender, referrer, code)
+	if err != nil {
+		return failed(err, "recording the referral")
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "You've already used a referral code."
+	}
+	return "Thanks! Your referral is linked and the credit is added once your first order is paid."
+}
+
+// creditReferral runs in the transaction that marks an order paid. The
+// first paid order of a referred customer credits both sides; the
+// credited_order_id guard makes it happen only once.
+func creditReferral(tx dbtx, orderID int64, cellNumber string) error {
+	points := cfg().ReferralPoints
+	var referrer string
+	err := tx.QueryRow(`UPDATE referrals SET credited_order_id = $2, credited_at = now(), credited_points = $3
+		WHERE referred_cell = $1 AND credited_order_id IS NULL RETURNING referrer_cell`,
+		cellNumber, orderID, points).Scan(&referrer)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("crediting referral: %w", err)
+	}
+	if points == 0 {
+		return nil
+	}
+	for _, cell := range []string{cellNumber, referrer} {
+		if err := addLoyaltyPoints(tx, cell, points, referralReason, orderID); err != nil {
+			return fmt.Errorf("crediting referral: %w", err)
+		}
+	}
+	return nil
+}
+
+type referrerReport struct {
+	CellNumber string `json:"cell_number"`
+	Referred   int64  `json:"referred"`
+	Converted  int64  `json:"converted"`
+}
+
+type referralReport struct {
+	From          time.Time        `json:"from"`
+	To            time.Time        `json:"to"`
+	Referred      int64            `json:"referred"`
+	Converted     int64            `json:"converted"`
+	ConversionPct float64          `json:"conversion_pct"`
+	TopReferrers  []referrerReport `json:"top_referrers"`
+}
+
+// buildReferralReport counts referrals linked in [from, to) and how many of
+// them have gone on to a paid order.
+func buildReferralReport(db *sql.DB, from, to time.Time) (referralReport, error) {
+	report := referralReport{From: from, To: to, TopReferrers: []referrerReport{}}
+	rows, err := db.Query(`SELECT referrer_cell, count(*), count(credited_order_id) FROM referrals
+		WHERE created_at >= $1 AND created_at < $2
+		GROUP BY referrer_cell ORDER BY count(credited_order_id) DESC, count(*) DESC, referrer_cell`, from, to)
+	if err != nil {
+		return report, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var r referrerReport
+		if err := rows.Scan(&r.CellNumber, &r.Referred, &r.Converted); err != nil {
+			return report, err
+		}
+		report.Referred += r.Referred
+		report.Converted += r.Converted
+		if len(report.TopReferrers) < 20 {
+			report.TopReferrers = append(report.TopReferrers, r)
+		}
+	}
+	if report.Referred > 0 {
+		report.ConversionPct = float64(report.Converted) * 100 / float64(report.Referred)
+	}
+	return report, rows.Err()
+}
+
+// ReferralReportHandler serves GET /api/reports/referrals?from=&to=,
+// defaulting to the last 30 days.
+func ReferralReportHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		from, err := parseReportTime(r.URL.Query().Get("from"), now.AddDate(0, 0, -30))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "from: "+err.Error())
+			return
+		}
+		to, err := parseReportTime(r.URL.Query().Get("to"), now)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "to: "+err.Error())
+			return
+		}
+		report, err := buildReferralReport(db, from, to)
+		if err != nil {
+			log.Printf("Building referral report failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "building report failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// errorPage is built in so it still works when the template directory is
+// the thing that's broken.
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>Something went wrong - {{.ShopName}}</title>
+    <link href="/static/style.css" rel="stylesheet">
+</head>
+<body>
+    <main class="page">
+        <h1>Something went wrong</h1>
+        <p>We couldn't show this page. Your payment is not affected.</p>
+        <p class="support">Please WhatsApp us on {{.SupportNumber}} if you need help.</p>
+    </main>
+</body>
+</html>
+`))
+
+// renderPage executes tpl into a buffer first, so a template error turns
+// into a clean 500 error page instead of a half-written 200.
+func renderPage(w http.ResponseWriter, r *http.Request, tpl *template.Template, data any, b branding) {
+	var buf bytes.Buffer
+	if err := tpl.ExecuteTemplate(&buf, tpl.Name(), data); err != nil {
+		log.Printf("Rendering %s failed (request %s): %v", tpl.Name(), middleware.GetReqID(r.Context()), err)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		if err := errorPage.Execute(w, b); err != nil {
+			log.Println("error writing response: ", err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Println("error writing response: ", err)
+	}
+}
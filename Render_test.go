@@ -0,0 +1,52 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenderPage(t *testing.T) {
+	b := branding{ShopName: "Corner Cafe", SupportNumber: "082 123 4567"}
+	tests := []struct {
+		name       string
+		tpl        string
+		data       any
+		wantStatus int
+		want       []string
+		notWant    []string
+	}{
+		{"renders", `<p>{{.Name}}</p>`, struct{ Name string }{"Toast"},
+			http.StatusOK, []string{"<p>Toast</p>"}, []string{"Something went wrong"}},
+		{"missing field", `<p>before</p>{{.Missing}}<p>after</p>`, struct{ Name string }{"Toast"},
+			http.StatusInternalServerError, []string{"Something went wrong", "Corner Cafe", "082 123 4567"}, []string{"before"}},
+		{"failing call", `<p>before</p>{{index .Items 5}}`, struct{ Items []string }{nil},
+			http.StatusInternalServerError, []string{"Something went wrong"}, []string{"before"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tpl := template.Must(template.New("page").Parse(tt.tpl))
+			rec := httptest.NewRecorder()
+			renderPage(rec, httptest.NewRequest(http.MethodGet, "/", nil), tpl, tt.data, b)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+				t.Errorf("Content-Type = %q", got)
+			}
+			body := rec.Body.String()
+			for _, s := range tt.want {
+				if !strings.Contains(body, s) {
+					t.Errorf("body doesn't contain %q:\n%s", s, body)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(body, s) {
+					t.Errorf("body contains %q:\n%s", s, body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// The replay runs the customer messages of a past period through the
+// current pipeline again and reports how the replies differ from the ones
+// that were sent, so a change to matching or wording can be checked
+// against real traffic before it ships. Nothing leaves the run: it works
+// on a shadow database that is rolled back (see Shadow_DB.go), sends to a
+// recorder, emits no events and starts from fresh in-memory state.
+//
+// It starts from today's data, not what each message first met, and the
+// database clock is the replay's own, so a conversation that relied on
+// yesterday's cart can differ for that reason alone. Metrics do count the
+// replayed messages, and PostgreSQL doesn't roll back sequences, so order
+// numbers skip the ones the replay used.
+
+const (
+	replayDefaultPeriod = 24 * time.Hour
+	replayMaxPeriod     = 7 * 24 * time.Hour
+	replayMaxMessages   = 2000
+	// replayReplyWindow is how long after a message what was sent to the
+	// customer still counts as its reply, unless they wrote again sooner.
+	replayReplyWindow = 2 * time.Minute
+	// replayMaxExamples caps the messages listed per kind of change.
+	replayMaxExamples = 50
+)
+
+// Kinds of change, by what differs between the recorded and replayed
+// answer.
+const (
+	replaySame     = "unchanged"
+	replayRoute    = "route"    // a different part of the pipeline answered
+	replayText     = "text"     // the same part answered differently
+	replaySilenced = "silenced" // there was a reply and now there isn't
+	replayAnswered = "answered" // there was no reply and now there is
+)
+
+// replayMessage is a logged inbound message and what was sent in reply.
+type replayMessage struct {
+	ID            int64
+	Cell          string
+	Body          string
+	Kind, Command string
+	ReceivedAt    time.Time
+	Replies       []string
+	OrderIDs      []int64
+}
+
+type replaySide struct {
+	Kind    string `json:"kind"`
+	Command string `json:"command,omitempty"`
+	Reply   string `json:"reply"`
+}
+
+type replayDiff struct {
+	Change     string     `json:"change"`
+	LogID      int64      `json:"log_id"`
+	CellNumber string     `json:"cell_number"`
+	ReceivedAt time.Time  `json:"received_at"`
+	Body       string     `json:"body"`
+	Before     replaySide `json:"before"`
+	After      replaySide `json:"after"`
+}
+
+type replayReport struct {
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Messages int       `json:"messages"`
+	// Truncated is set when the period had more than replayMaxMessages
+	// messages and only the first were replayed.
+	Truncated bool                    `json:"truncated"`
+	Changes   map[string]int          `json:"changes"`
+	Diffs     map[string][]replayDiff `json:"diffs"`
+}
+
+// loadReplayMessages reads the messages received in [from, to) with the
+// replies recorded for them, oldest first.
+func loadReplayMessages(ctx context.Context, db *sql.DB, from, to time.Time) ([]replayMessage, bool, error) {
+	rows, err := db.QueryContext(ctx, `SELECT id, cell_number, body, kind, command, received_at FROM conversation_log
+		WHERE received_at >= $1 AND received_at < $2 ORDER BY received_at, id LIMIT $3`, from, to, replayMaxMessages+1)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	var messages []replayMessage
+	for rows.Next() {
+		var m replayMessage
+		err := rows.Scan(&m.ID, &m.Cell, &m.Body, &m.Kind, &m.Command, &m.ReceivedAt)
+		if err == nil {
+			m.Body, err = openField(fieldMessageBody, m.Body)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	truncated := len(messages) > replayMaxMessages
+	if truncated {
+		messages = messages[:replayMaxMessages]
+	}
+
+	next := map[string]time.Time{}
+	for i := len(messages) - 1; i >= 0; i-- {
+		m := &messages[i]
+		until := m.ReceivedAt.Add(replayReplyWindow)
+		if t, ok := next[m.Cell]; ok && t.Before(until) {
+			until = t
+		}
+		next[m.Cell] = m.ReceivedAt
+		if err := loadReplayReplies(ctx, db, m, until); err != nil {
+			return nil, false, fmt.Errorf("reading replies to message %d: %w", m.ID, err)
+		}
+	}
+	return messages, truncated, nil
+}
+
+func loadReplayReplies(ctx context.Context, db *sql.DB, m *replayMessage, until time.Time) error {
+	jid, err := resolveJID(m.Cell)
+	if err != nil {
+		return err
+	}
+	rows, err := db.QueryContext(ctx, `SELECT body, order_id FROM outbound_messages
+		WHERE recipient = $1 AND server_time >= $2 AND server_time < $3 ORDER BY server_time, created_at`,
+		jid.String(), m.ReceivedAt, until)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var body string
+		var orderID sql.NullInt64
+		err := rows.Scan(&body, &orderID)
+		if err == nil {
+			body, err = openField(fieldMessageBody, body)
+		}
+		if err != nil {
+			return err
+		}
+		m.Replies = append(m.Replies, body)
+		if orderID.Valid {
+			m.OrderIDs = append(m.OrderIDs, orderID.Int64)
+		}
+	}
+	return rows.Err()
+}
+
+// replayRecorder collects what the replay would have sent.
+type replayRecorder struct {
+	mu   sync.Mutex
+	sent []outboundMessage
+}
+
+func (r *replayRecorder) record(m outboundMessage) {
+	r.mu.Lock()
+	r.sent = append(r.sent, m)
+	r.mu.Unlock()
+}
+
+// take returns what was sent since the last take.
+func (r *replayRecorder) take() []outboundMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sent := r.sent
+	r.sent = nil
+	return sent
+}
+
+// replayContext is cc with everything that could leave or linger swapped
+// out: the shadow database, a sender that only records, no WhatsApp client
+// or events, and fresh in-memory state.
+func replayContext(cc *commandContext, db *sql.DB, rec *replayRecorder) *commandContext {
+	maintenance := &maintenanceMode{db: db, replied: map[string]time.Time{}}
+	maintenance.state.Store(&maintenanceState{})
+	replay := &commandContext{
+		db:      db,
+		prclist: cc.prclist,
+		sender:  &messageSender{db: db, staff: map[string]bool{}, record: rec.record},
+		envVars: cc.envVars,
+
+		maintenance:     maintenance,
+		connLog:         cc.connLog,
+		images:          newItemImageCache(),
+		senders:         newSenderLocks(),
+		takeovers:       &takeovers{db: db, active: map[string]time.Time{}},
+		escalations:     newEscalations(),
+		modifierPrompts: newModifierPrompts(db),
+		suggestions:     newCommandSuggestions(),
+		recipients:      newRecipientCache(),
+		shortcuts:       newMenuShortcuts(),
+		polls:           newChoicePolls(),
+		commandStats:    newCommandStats(),
+		homebase:        cc.homebase,
+		contactRules:    cc.contactRules,
+	}
+	replay.payments = newPaymentPipeline(replay)
+	replay.incidents = newIncidentLog(replay)
+	return replay
+}
+
+// replayComparable is a reply with what differs on every run masked:
+// links, whose signatures change, and the order's number, as the shadow's
+// orders get new ones.
+func replayComparable(reply string, orderIDs []int64) string {
+	fields := strings.Fields(linkPattern.ReplaceAllString(reply, "[link]"))
+	for i, f := range fields {
+		for _, id := range orderIDs {
+			if n := strconv.FormatInt(id, 10); id != 0 && strings.Trim(f, "#.,:;!?()") == n {
+				fields[i] = strings.Replace(f, n, "{order}", 1)
+			}
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+func compareReplay(m replayMessage, out messageOutcome, replies []string) replayDiff {
+	d := replayDiff{
+		LogID:      m.ID,
+		CellNumber: m.Cell,
+		ReceivedAt: m.ReceivedAt,
+		Body:       m.Body,
+		Before:     replaySide{Kind: m.Kind, Command: m.Command, Reply: strings.Join(m.Replies, "\n\n")},
+		After:      replaySide{Kind: out.Kind, Command: out.Command, Reply: strings.Join(replies, "\n\n")},
+	}
+	before := replayComparable(d.Before.Reply, m.OrderIDs)
+	after := replayComparable(d.After.Reply, []int64{out.OrderID})
+	switch {
+	case d.Before.Kind != d.After.Kind || d.Before.Command != d.After.Command:
+		d.Change = replayRoute
+	case before == after:
+		d.Change = replaySame
+	case after == "":
+		d.Change = replaySilenced
+	case before == "":
+		d.Change = replayAnswered
+	default:
+		d.Change = replayText
+	}
+	return d
+}
+
+// replay answers the messages of [from, to) again and compares the
+// replies with the recorded ones.
+func replay(ctx context.Context, cc *commandContext, checkout mb.CheckoutInfo, from, to time.Time) (replayReport, error) {
+	report := replayReport{From: from, To: to, Changes: map[string]int{}, Diffs: map[string][]replayDiff{}}
+	messages, truncated, err := loadReplayMessages(ctx, cc.db, from, to)
+	if err != nil {
+		return report, err
+	}
+	report.Messages, report.Truncated = len(messages), truncated
+
+	shadow, err := openShadowDB(ctx, cc.db)
+	if err != nil {
+		return report, err
+	}
+	defer shadow.Close()
+	rec := &replayRecorder{}
+	rcc := replayContext(cc, shadow.DB, rec)
+	for _, m := range messages {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		chat, err := resolveJID(m.Cell)
+		if err != nil {
+			log.Printf("Replay: skipping message %d from %s: %v", m.ID, m.Cell, err)
+			continue
+		}
+		out := answerMessage(rcc, checkout, inboundMessage{
+			Sender:  m.Cell,
+			Chat:    chat,
+			ID:      fmt.Sprintf("replay-%d", m.ID),
+			Text:    m.Body,
+			Message: &waProto.Message{Conversation: proto.String(m.Body)},
+			At:      m.ReceivedAt,
+		})
+		var replies []string
+		for _, sent := range rec.take() {
+			// Escalations and the like also message staff; only what the
+			// customer got is compared.
+			if sent.To == chat {
+				replies = append(replies, sent.Text)
+			}
+		}
+		d := compareReplay(m, out, replies)
+		report.Changes[d.Change]++
+		if d.Change != replaySame && len(report.Diffs[d.Change]) < replayMaxExamples {
+			report.Diffs[d.Change] = append(report.Diffs[d.Change], d)
+		}
+	}
+	return report, nil
+}
+
+// replayRunning allows one replay at a time; each holds a connection and a
+// transaction open for as long as it runs.
+var replayRunning sync.Mutex
+
+// ReplayHandler serves POST /api/replay?from=&to=, defaulting to the last
+// day.
+func ReplayHandler(cc *commandContext, checkout mb.CheckoutInfo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		from, err := parseReportTime(r.URL.Query().Get("from"), now.Add(-replayDefaultPeriod))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "from: "+err.Error())
+			return
+		}
+		to, err := parseReportTime(r.URL.Query().Get("to"), now)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "to: "+err.Error())
+			return
+		}
+		if !to.After(from) || to.Sub(from) > replayMaxPeriod {
+			writeJSONError(w, http.StatusBadRequest, fmt.Sprintf("to must be after from, and at most %d days later", int(replayMaxPeriod.Hours()/24)))
+			return
+		}
+		if !replayRunning.TryLock() {
+			writeJSONError(w, http.StatusConflict, "a replay is already running")
+			return
+		}
+		defer replayRunning.Unlock()
+		report, err := replay(r.Context(), cc, checkout, from, to)
+		if err != nil {
+			log.Printf("Replaying messages failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "replay failed")
+			return
+		}
+		log.Printf("Replayed %d messages from %s to %s: %v", report.Messages, from.Format(time.RFC3339), to.Format(time.RFC3339), report.Changes)
+		writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Logs that grow with every message are purged once they are older than
+// RETENTION allows, a batch at a time with a pause in between so the purge
+// never competes with customers for the database. With
+// RETENTION_ARCHIVE_DIR set the rows are first written there as gzipped
+// JSON lines, as stored, so sealed fields stay sealed.
+//
+// Only the tables in retentionTables can be purged. Orders, order_meta and
+// everything else that records money changing hands are not among them,
+// nor is consent_log, which is evidence.
+
+const (
+	defaultRetention = "conversation_log=12mo,takeover_transcript=12mo,outbound_messages=12mo,funnel_events=6mo," +
+		"payment_notifications=24mo,connection_events=3mo,outbox=3mo,command_fallbacks_daily=12mo,incidents=6mo"
+	retentionHour       = 3
+	retentionBatch      = 500
+	retentionBatchPause = 250 * time.Millisecond
+)
+
+// retentionTable is a table that can be purged: rows whose column is older
+// than the cutoff and that match where, if set, go.
+type retentionTable struct {
+	name, key, keyType, column, where string
+}
+
+var retentionTables = []retentionTable{
+	{name: "conversation_log", key: "id", keyType: "bigint", column: "received_at"},
+	{name: "takeover_transcript", key: "id", keyType: "bigint", column: "received_at"},
+	{name: "outbound_messages", key: "message_id", keyType: "text", column: "created_at"},
+	{name: "funnel_events", key: "id", keyType: "bigint", column: "occurred_at"},
+	{name: "connection_events", key: "id", keyType: "bigint", column: "occurred_at"},
+	{name: "outbox", key: "id", keyType: "bigint", column: "created_at", where: "state <> 'pending'"},
+	{name: "command_fallbacks_daily", key: "id", keyType: "bigint", column: "day"},
+	{name: "incidents", key: "id", keyType: "text", column: "occurred_at"},
+	// Raw ITNs go once processed; dead letters still point at theirs.
+	{name: "payment_notifications", key: "id", keyType: "bigint", column: "received_at",
+		where: "state = 'processed' AND NOT EXISTS (SELECT 1 FROM dead_letters d WHERE d.notification_id = payment_notifications.id)"},
+}
+
+func findRetentionTable(name string) (retentionTable, bool) {
+	for _, t := range retentionTables {
+		if t.name == name {
+			return t, true
+		}
+	}
+	return retentionTable{}, false
+}
+
+// retentionPeriod is how long rows are kept, in days or calendar months.
+type retentionPeriod struct {
+	n      int
+	months bool
+}
+
+// cutoff is now less the period. Months ending on a day the earlier month
+// doesn't have end on its last day instead, so 1mo on 31 March is 28
+// February rather than AddDate's 3 March.
+func (p retentionPeriod) cutoff(now time.Time) time.Time {
+	if p.months {
+		c := now.AddDate(0, -p.n, 0)
+		if c.Day() != now.Day() {
+			c = c.AddDate(0, 0, -c.Day())
+		}
+		return c
+	}
+	return now.AddDate(0, 0, -p.n)
+}
+
+func (p retentionPeriod) String() string {
+	if p.months {
+		return strconv.Itoa(p.n) + "mo"
+	}
+	return strconv.Itoa(p.n) + "d"
+}
+
+// parseRetention reads "table=period" pairs separated by commas, with
+// periods such as 90d or 12mo. Tables left out are kept forever.
+func parseRetention(s string) (map[string]retentionPeriod, error) {
+	policies := map[string]retentionPeriod{}
+	if s == "none" {
+		return policies, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, raw, _ := strings.Cut(pair, "=")
+		name, raw = strings.TrimSpace(name), strings.TrimSpace(raw)
+		if _, ok := findRetentionTable(name); !ok {
+			known := make([]string, len(retentionTables))
+			for i, t := range retentionTables {
+				known[i] = t.name
+			}
+			return nil, fmt.Errorf("%q can't be purged, only %s", name, strings.Join(known, ", "))
+		}
+		var p retentionPeriod
+		digits, months := strings.CutSuffix(raw, "mo")
+		if !months {
+			digits, _ = strings.CutSuffix(raw, "d")
+		}
+		n, err := strconv.Atoi(digits)
+		if err != nil || n <= 0 || digits == raw {
+			return nil, fmt.Errorf("%s: %q is not a period such as 90d or 12mo", name, raw)
+		}
+		p.n, p.months = n, months
+		policies[name] = p
+	}
+	return policies, nil
+}
+
+func retentionString(policies map[string]retentionPeriod) string {
+	pairs := make([]string, 0, len(policies))
+	for name, p := range policies {
+		pairs = append(pairs, name+"="+p.String())
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// purgeOldData runs the purge, as a nightly job.
+func purgeOldData(cc *commandContext) error {
+	rc := cfg()
+	if _, err := purgeExpired(cc.db, rc.Retention, rc.RetentionArchiveDir, rc.RetentionDryRun, time.Now()); err != nil {
+		return fmt.Errorf("retention: %w", err)
+	}
+	return nil
+}
+
+// purgeExpired purges every table with a policy of rows older than it as
+// of now, and returns how many rows each lost. A dry run only counts them.
+func purgeExpired(db *sql.DB, policies map[string]retentionPeriod, archiveDir string, dryRun bool, now time.Time) (map[string]int64, error) {
+	purged := map[string]int64{}
+	for _, t := range retentionTables {
+		p, ok := policies[t.name]
+		if !ok {
+			continue
+		}
+		cutoff := p.cutoff(now)
+		var n int64
+		var err error
+		if dryRun {
+			n, err = countExpired(db, t, cutoff)
+		} else {
+			n, err = purgeTable(db, t, cutoff, archiveDir, now)
+		}
+		purged[t.name] = n
+		if err != nil {
+			return purged, fmt.Errorf("purging %s: %w", t.name, err)
+		}
+		verb := "purged"
+		if dryRun {
+			verb = "would purge"
+		}
+		log.Printf("Retention: %s %d rows of %s from before %s", verb, n, t.name, cutoff.Format(time.RFC3339))
+	}
+	return purged, nil
+}
+
+func (t retentionTable) expiredClause() string {
+	clause := t.column + ` < $1`
+	if t.where != "" {
+		clause += ` AND ` + t.where
+	}
+	return clause
+}
+
+func countExpired(db *sql.DB, t retentionTable, cutoff time.Time) (int64, error) {
+	var n int64
+	err := db.QueryRow(`SELECT count(*) FROM `+t.name+` WHERE `+t.expiredClause(), cutoff).Scan(&n)
+	return n, err
+}
+
+// purgeTable deletes t's expired rows in batches, archiving each batch
+// before it is deleted.
+func purgeTable(db *sql.DB, t retentionTable, cutoff time.Time, archiveDir string, now time.Time) (int64, error) {
+	var archive *retentionArchive
+	if archiveDir != "" {
+		var err error
+		if archive, err = createRetentionArchive(archiveDir, t.name, now); err != nil {
+			return 0, err
+		}
+	}
+	var total int64
+	for {
+		n, err := purgeBatch(db, t, cutoff, archive)
+		total += int64(n)
+		if n > 0 {
+			metrics.Add("menubot_retention_purged_rows_total", "Rows deleted by the retention job.", float64(n), "table", t.name)
+		}
+		if err != nil || n < retentionBatch {
+			if archive != nil {
+				if closeErr := archive.close(total == 0); err == nil {
+					err = closeErr
+				}
+			}
+			return total, err
+		}
+		time.Sleep(retentionBatchPause)
+	}
+}
+
+func purgeBatch(db *sql.DB, t retentionTable, cutoff time.Time, archive *retentionArchive) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`SELECT `+t.key+`::text, row_to_json(`+t.name+`)::text FROM `+t.name+`
+		WHERE `+t.expiredClause()+` ORDER BY `+t.key+` LIMIT $2 FOR UPDATE SKIP LOCKED`, cutoff, retentionBatch)
+	if err != nil {
+		return 0, err
+	}
+	var keys, records []string
+	for rows.Next() {
+		var key, record string
+		if err := rows.Scan(&key, &record); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys, records = append(keys, key), append(records, record)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	if archive != nil {
+		if err := archive.write(records); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM `+t.name+` WHERE `+t.key+` = ANY($1::`+t.keyType+`[])`, pq.Array(keys)); err != nil {
+		return 0, err
+	}
+	return len(keys), tx.Commit()
+}
+
+// retentionArchive is one table's purged rows from one run. Every batch
+// is synced to disk before the rows are deleted; if the delete then fails
+// the rows are archived again by the next run.
+type retentionArchive struct {
+	path string
+	file *os.File
+	gz   *gzip.Writer
+	buf  *bufio.Writer
+}
+
+func createRetentionArchive(dir, table string, now time.Time) (*retentionArchive, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating archive directory: %w", err)
+	}
+	path := filepath.Join(dir, table+"-"+now.UTC().Format("20060102T150405Z")+".jsonl.gz")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("creating archive: %w", err)
+	}
+	gz := gzip.NewWriter(f)
+	return &retentionArchive{path: path, file: f, gz: gz, buf: bufio.NewWriter(gz)}, nil
+}
+
+func (a *retentionArchive) write(records []string) error {
+	for _, record := range records {
+		a.buf.WriteString(record)
+		a.buf.WriteByte('\n')
+	}
+	if err := a.buf.Flush(); err != nil {
+		return fmt.Errorf("writing archive %s: %w", a.path, err)
+	}
+	if err := a.gz.Flush(); err != nil {
+		return fmt.Errorf("writing archive %s: %w", a.path, err)
+	}
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("syncing archive %s: %w", a.path, err)
+	}
+	return nil
+}
+
+// close finishes the archive, removing it when nothing was purged.
+func (a *retentionArchive) close(empty bool) error {
+	err := a.gz.Close()
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	if empty {
+		return os.Remove(a.path)
+	}
+	if err != nil {
+		return fmt.Errorf("closing archive %s: %w", a.path, err)
+	}
+	return nil
+}
+
+type retentionResponse struct {
+	DryRun bool             `json:"dry_run"`
+	Purged map[string]int64 `json:"purged"`
+}
+
+// RetentionHandler serves POST /api/retention/run?dry_run=true, running
+// the nightly purge now.
+func RetentionHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rc := cfg()
+		dryRun := rc.RetentionDryRun
+		if raw := r.URL.Query().Get("dry_run"); raw != "" {
+			v, err := strconv.ParseBool(raw)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "dry_run must be true or false")
+				return
+			}
+			dryRun = v
+		}
+		purged, err := purgeExpired(db, rc.Retention, rc.RetentionArchiveDir, dryRun, time.Now())
+		if err != nil {
+			log.Printf("Retention: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "purge failed: "+err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, retentionResponse{DryRun: dryRun, Purged: purged})
+	}
+}
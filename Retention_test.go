@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    map[string]retentionPeriod
+		wantErr string
+	}{
+		{name: "days and months", in: "funnel_events=90d, conversation_log=12mo",
+			want: map[string]retentionPeriod{"funnel_events": {n: 90}, "conversation_log": {n: 12, months: true}}},
+		{name: "none", in: "none", want: map[string]retentionPeriod{}},
+		{name: "empty pairs skipped", in: "funnel_events=6mo,, ", want: map[string]retentionPeriod{"funnel_events": {n: 6, months: true}}},
+		{name: "orders can't be purged", in: "orders=1d", wantErr: `"orders" can't be purged`},
+		{name: "order_meta can't be purged", in: "order_meta=24mo", wantErr: `"order_meta" can't be purged`},
+		{name: "consent can't be purged", in: "consent_log=24mo", wantErr: `"consent_log" can't be purged`},
+		{name: "no unit", in: "funnel_events=90", wantErr: "not a period"},
+		{name: "zero", in: "funnel_events=0d", wantErr: "not a period"},
+		{name: "negative", in: "funnel_events=-3mo", wantErr: "not a period"},
+		{name: "years", in: "funnel_events=1y", wantErr: "not a period"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRetention(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRetention(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultRetention(t *testing.T) {
+	policies, err := parseRetention(defaultRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mustParseRetention(t, retentionString(policies)); !reflect.DeepEqual(got, policies) {
+		t.Errorf("retentionString doesn't round trip: %s", retentionString(policies))
+	}
+	for _, table := range retentionTables {
+		switch table.name {
+		case "orders", "order_meta", "order_lines", "loyalty_ledger", "consent_log", "dead_letters":
+			t.Errorf("%s is purgeable", table.name)
+		}
+	}
+}
+
+func mustParseRetention(t *testing.T, s string) map[string]retentionPeriod {
+	t.Helper()
+	p, err := parseRetention(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRetentionCutoff(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	tests := []struct {
+		name   string
+		period retentionPeriod
+		now    string
+		want   string
+	}{
+		{"days", retentionPeriod{n: 90}, "2026-06-30T03:00:00Z", "2026-04-01T03:00:00Z"},
+		{"months", retentionPeriod{n: 6, months: true}, "2026-06-15T03:00:00Z", "2025-12-15T03:00:00Z"},
+		{"a year", retentionPeriod{n: 12, months: true}, "2026-06-15T03:00:00Z", "2025-06-15T03:00:00Z"},
+		{"into a shorter month", retentionPeriod{n: 1, months: true}, "2026-03-31T03:00:00Z", "2026-02-28T03:00:00Z"},
+		{"into a leap February", retentionPeriod{n: 1, months: true}, "2028-03-31T03:00:00Z", "2028-02-29T03:00:00Z"},
+		{"from a leap day", retentionPeriod{n: 12, months: true}, "2028-02-29T03:00:00Z", "2027-02-28T03:00:00Z"},
+		{"into a 30 day month", retentionPeriod{n: 3, months: true}, "2026-07-31T03:00:00Z", "2026-04-30T03:00:00Z"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.period.cutoff(at(tt.now)); !got.Equal(at(tt.want)) {
+				t.Errorf("%s before %s = %s, want %s", tt.period, tt.now, got.Format(time.RFC3339), tt.want)
+			}
+		})
+	}
+}
+
+func TestRetentionArchive(t *testing.T) {
+	now := time.Date(2026, 6, 15, 3, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		batches [][]string
+	}{
+		{"one batch", [][]string{{`{"id":1}`, `{"id":2}`}}},
+		{"two batches", [][]string{{`{"id":1}`}, {`{"id":2}`, `{"id":3}`}}},
+		{"nothing purged", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "archive")
+			a, err := createRetentionArchive(dir, "funnel_events", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want []string
+			for _, batch := range tt.batches {
+				if err := a.write(batch); err != nil {
+					t.Fatal(err)
+				}
+				want = append(want, batch...)
+			}
+			if err := a.close(len(want) == 0); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, "funnel_events-20260615T030000Z.jsonl.gz")
+			if len(want) == 0 {
+				if _, err := os.Stat(path); !os.IsNotExist(err) {
+					t.Errorf("an empty archive was kept: %v", err)
+				}
+				return
+			}
+			if got := readArchive(t, path); !reflect.DeepEqual(got, want) {
+				t.Errorf("archive holds %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func readArchive(t *testing.T, path string) []string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	s := bufio.NewScanner(gz)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
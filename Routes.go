@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+	"github.com/JeremyJalpha/MenuBot_WebAPI/buildinfo"
+	"github.com/JeremyJalpha/MenuBot_WebAPI/httpapi"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// routeDeps is what the HTTP handlers are built from.
+type routeDeps struct {
+	db, waDB  *sql.DB
+	client    waClient
+	devices   *deviceSet
+	prclist   *pricelistHolder
+	cmds      *commandContext
+	envVars   EnvVars
+	payments  *httpapi.Handlers
+	checkout  mb.CheckoutInfo
+	dashboard dashboardTemplates
+	election  *leaderElection
+}
+
+// mountPublicRoutes registers what has to be reachable through the tunnel:
+// the PayFast callbacks and the health check. Anything else belongs in
+// mountAdminRoutes.
+func mountPublicRoutes(r chi.Router, d routeDeps) {
+	env := d.envVars
+	global := newIPLimiter("global", func(rc *RuntimeConfig) (float64, int) { return rc.HTTPRate, rc.HTTPBurst })
+	r.Group(func(r chi.Router) {
+		r.Use(global.Middleware)
+		d.payments.RegisterRoutes(r)
+		r.Get(healthBaseURL, HealthHandler(d.db, d.waDB, d.client, d.devices, d.prclist, d.election, d.cmds.sender.block, env.PayFastMode))
+		r.Handle(staticBaseURL+"/*", StaticHandler(newStaticFS(env.Pwd)))
+	})
+}
+
+// mountAdminRoutes registers the internal routes, which are served on
+// ADMIN_ADDR when it is set.
+func mountAdminRoutes(r chi.Router, d routeDeps) {
+	r.Get(versionBaseURL, buildinfo.Handler())
+	r.Get(metricsBaseURL, metrics.Handler())
+	if d.envVars.AdminAPIKey == "" {
+		log.Printf("ADMIN_API_KEY is not set, %s, %s and %s are disabled", apiBaseURL, debugBaseURL, dashboardBaseURL)
+	} else {
+		r.Route(dashboardBaseURL, DashboardRoutes(d, d.dashboard))
+	}
+	auth := staffAuth{db: d.db, adminKey: d.envVars.AdminAPIKey}
+	r.Route(debugBaseURL, func(r chi.Router) {
+		r.Use(labelQueries(callerAPI), requireStaffKey(auth), requireRole(roleAdmin), auditMutations(d.db))
+		r.Group(DebugRoutes(d.cmds))
+	})
+	r.Route(apiBaseURL, func(r chi.Router) {
+		r.Use(labelQueries(callerAPI), requireStaffKey(auth), auditMutations(d.db))
+		r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+			writeJSONError(w, http.StatusNotFound, "no such route")
+		})
+		r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		})
+		api := r
+		// Anyone on the staff.
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(roleDriver))
+			r.Get("/openapi.json", OpenAPIHandler(api))
+			r.Get("/catalogue", CatalogueHandler(d.prclist))
+			r.Get("/catalogue/availability", ListAvailabilityHandler(d.prclist))
+			r.Get("/catalogue/modifiers", ListModifiersHandler(d.prclist))
+			r.Get("/catalogue/combos", ListCombosHandler(d.prclist))
+			r.Get("/catalogue/categories", ListItemCategoriesHandler(d.prclist))
+			r.Get("/catalogue/codes", ListItemCodesHandler(d.db, d.prclist))
+			r.Get("/orders", ListOrdersHandler(d.db))
+			r.Get("/orders/{orderID}", GetOrderHandler(d.db, d.prclist))
+			r.Post("/orders/{orderID}/eta", PostOrderETAHandler(d.cmds))
+		})
+		// What changes prices or takes payment.
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(roleManager))
+			r.Post("/catalogue/availability/import", ImportAvailabilityHandler(d.db, d.prclist))
+			r.Put("/catalogue/{itemID}/availability", PutAvailabilityHandler(d.db, d.prclist))
+			r.Delete("/catalogue/{itemID}/availability", DeleteAvailabilityHandler(d.db, d.prclist))
+			r.Post("/catalogue/modifiers/import", ImportModifiersHandler(d.db, d.prclist))
+			r.Put("/catalogue/{itemID}/modifiers", PutModifiersHandler(d.db, d.prclist))
+			r.Delete("/catalogue/{itemID}/modifiers", DeleteModifiersHandler(d.db, d.prclist))
+			r.Put("/catalogue/{itemID}/combo", PutComboHandler(d.db, d.prclist))
+			r.Delete("/catalogue/{itemID}/combo", DeleteComboHandler(d.db, d.prclist))
+			r.Put("/catalogue/{itemID}/category", PutItemCategoryHandler(d.db, d.prclist))
+			r.Delete("/catalogue/{itemID}/category", DeleteItemCategoryHandler(d.db, d.prclist))
+			r.Post("/catalogue/codes/import", ImportItemCodesHandler(d.db, d.prclist))
+			r.Put("/catalogue/{itemID}/code", PutItemCodeHandler(d.db, d.prclist))
+			r.Patch("/catalogue/{itemID}", PatchItemHandler(d.db, d.prclist))
+			r.Delete("/catalogue/{itemID}", DeleteItemHandler(d.db, d.prclist))
+			r.Put("/catalogue/{itemID}/image", PutItemImageHandler(d.db, d.prclist))
+			r.Delete("/catalogue/{itemID}/image", DeleteItemImageHandler(d.db, d.prclist))
+			r.Get("/price-changes", ListPriceChangesHandler(d.db))
+			r.Post("/price-changes", CreatePriceChangeHandler(d.db, d.prclist))
+			r.Delete("/price-changes/{changeID}", DeletePriceChangeHandler(d.db, d.prclist))
+			r.Get("/specials", ListSpecialsHandler(d.db))
+			r.Post("/specials", CreateSpecialHandler(d.db, d.prclist))
+			r.Delete("/specials/{specialID}", DeleteSpecialHandler(d.db, d.prclist))
+			r.Get("/tiers", ListPriceTiersHandler(d.prclist))
+			r.Put("/tiers/{tier}", PutPriceTierHandler(d.db, d.prclist))
+			r.Put("/customers/{number}/tier", PutCustomerTierHandler(d.db, d.prclist))
+			r.Get("/customers/{number}/points", GetLoyaltyHandler(d.db))
+			r.Post("/customers/{number}/points", AdjustLoyaltyHandler(d.db))
+			r.Get("/users", ListCustomersHandler(d.db))
+			r.Get("/users/{cell}/cart", GetCartHandler(d.cmds))
+			r.Post("/users/{cell}/cart/add", AddCartLineHandler(d.cmds))
+			r.Post("/users/{cell}/cart/remove", RemoveCartLineHandler(d.cmds))
+			r.Post("/orders/{orderID}/priority", PostOrderPriorityHandler(d.cmds))
+			r.Get("/dead-letters", ListDeadLettersHandler(d.db))
+			r.Post("/dead-letters/{deadLetterID}/redrive", RedriveDeadLetterHandler(d.cmds))
+			r.Get("/incidents/{incidentID}", GetIncidentHandler(d.db))
+		})
+		r.Group(func(r chi.Router) {
+			r.Use(requireRole(roleAdmin))
+			r.Get("/users/{cell}/export", CustomerExportHandler(d.db))
+			r.Get("/users/{cell}/consent", GetConsentHandler(d.db))
+			r.Get("/users/duplicates", DuplicateCustomersHandler(d.cmds))
+			r.Post("/users/merge", MergeCustomersHandler(d.db))
+			r.Get("/devices", ListDevicesHandler(d.devices))
+			r.Get("/devices/pair", GetPairingHandler(d.devices))
+			r.Post("/devices/pair", PairDeviceHandler(d.devices, d.election, d.envVars.QRAttempts))
+			r.Post("/broadcasts", PostBroadcastHandler(d.cmds))
+			r.Post("/messages", PostMessageHandler(d.cmds))
+			r.Post("/templates/{name}/preview", PreviewTemplateHandler())
+			r.Post("/templates/{name}/test-send", TestSendTemplateHandler(d.cmds))
+			r.Get("/reports/funnel", FunnelReportHandler(d.db))
+			r.Get("/reports/uptime", UptimeReportHandler(d.db))
+			r.Get("/reports/referrals", ReferralReportHandler(d.db))
+			r.Get("/reports/reconciliation", ReconciliationReportHandler(d.db))
+			r.Get("/reports/conversations", ConversationReportHandler(d.db, d.prclist))
+			r.Get("/reports/ratings", RatingReportHandler(d.db))
+			r.Get("/reports/commands", CommandReportHandler(d.db, d.cmds.commandStats))
+			r.Post("/replay", ReplayHandler(d.cmds, d.checkout))
+			r.Post("/encryption/migrate", EncryptFieldsHandler(d.db))
+			r.Post("/retention/run", RetentionHandler(d.db))
+			r.Get("/whatsapp/store", WAStoreHandler(d.waDB))
+			r.Post("/whatsapp/store/cleanup", WAStoreCleanupHandler(d.cmds))
+			r.Get("/backup", BackupHandler(d.db, d.cmds.maintenance))
+			r.Post("/restore", RestoreHandler(d.db, d.prclist, d.cmds.maintenance))
+			r.Get("/maintenance", GetMaintenanceHandler(d.cmds.maintenance))
+			r.Get("/jobs", ListJobsHandler(d.cmds.jobs))
+			r.Post("/jobs/{jobName}/run", RunJobHandler(d.cmds.jobs))
+			r.Put("/maintenance", PutMaintenanceHandler(d.cmds.maintenance))
+			r.Get("/contact-rules", ListContactRulesHandler(d.cmds.contactRules))
+			r.Post("/contact-rules", PostContactRuleHandler(d.cmds.contactRules))
+			r.Delete("/contact-rules/{ruleID}", DeleteContactRuleHandler(d.cmds.contactRules))
+			r.Put("/contact-rules/allowlist-only", PutAllowlistOnlyHandler(d.cmds.contactRules))
+			r.Get("/staff/keys", ListStaffKeysHandler(d.db))
+			r.Post("/staff/keys", CreateStaffKeyHandler(d.db))
+			r.Delete("/staff/keys/{keyID}", RevokeStaffKeyHandler(d.db))
+			r.Get("/staff/audit", StaffAuditHandler(d.db))
+		})
+		logUndocumentedRoutes(api)
+	})
+}
+
+// newRouters builds the public and admin routers. Without a separate admin
+// address everything is mounted on the public router and admin is nil.
+func newRouters(d routeDeps) (public, admin chi.Router) {
+	public = chi.NewRouter()
+	public.Use(middleware.RequestID)
+	mountPublicRoutes(public, d)
+	if d.envVars.AdminAddr == "" {
+		mountAdminRoutes(public, d)
+		return public, nil
+	}
+	admin = chi.NewRouter()
+	admin.Use(middleware.RequestID)
+	mountAdminRoutes(admin, d)
+	return public, admin
+}
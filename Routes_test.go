@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/JeremyJalpha/MenuBot_WebAPI/httpapi"
+	"github.com/go-chi/chi/v5"
+)
+
+// publicPrefixes is everything allowed through the tunnel. A route that
+// lands on the public router under any other path fails the test.
+var publicPrefixes = []string{returnBaseURL, cancelBaseURL, notifyBaseURL, healthBaseURL, staticBaseURL}
+
+func testRouteDeps(adminAddr string) routeDeps {
+	return routeDeps{
+		cmds:     &commandContext{sender: &messageSender{}},
+		payments: httpapi.New(nil, nil, nil, nil, nil, nil, nil, httpapi.Options{ReturnPath: returnBaseURL, CancelPath: cancelBaseURL, NotifyPath: notifyBaseURL}),
+		envVars:  EnvVars{AdminAddr: adminAddr, AdminAPIKey: "key"},
+	}
+}
+
+func routePatterns(t *testing.T, r chi.Router) []string {
+	t.Helper()
+	var patterns []string
+	err := chi.Walk(r, func(method, route string, _ http.Handler, _ ...func(http.Handler) http.Handler) error {
+		patterns = append(patterns, method+" "+route)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return patterns
+}
+
+func isPublicRoute(pattern string) bool {
+	_, path, _ := strings.Cut(pattern, " ")
+	for _, prefix := range publicPrefixes {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRoutePartitioning(t *testing.T) {
+	public, admin := newRouters(testRouteDeps("127.0.0.1:9090"))
+	if admin == nil {
+		t.Fatal("no admin router with ADMIN_ADDR set")
+	}
+	publicRoutes, adminRoutes := routePatterns(t, public), routePatterns(t, admin)
+	for _, p := range publicRoutes {
+		if !isPublicRoute(p) {
+			t.Errorf("%s is on the public router", p)
+		}
+	}
+	for _, p := range adminRoutes {
+		if isPublicRoute(p) {
+			t.Errorf("%s is on the admin router", p)
+		}
+	}
+
+	tests := []struct {
+		route  string
+		public bool
+	}{
+		{"GET " + healthBaseURL, true},
+		{"POST " + notifyBaseURL, true},
+		{"GET " + returnBaseURL, true},
+		{"GET " + cancelBaseURL, true},
+		{"GET " + metricsBaseURL, false},
+		{"GET " + versionBaseURL, false},
+		{"GET " + apiBaseURL + "/orders", false},
+		{"POST " + apiBaseURL + "/messages", false},
+		{"GET " + debugBaseURL + "/status", false},
+		{"GET " + dashboardBaseURL + "/login", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			want, other := adminRoutes, publicRoutes
+			if tt.public {
+				want, other = publicRoutes, adminRoutes
+			}
+			if !hasRoute(want, tt.route) {
+				t.Errorf("%s is missing", tt.route)
+			}
+			if hasRoute(other, tt.route) {
+				t.Errorf("%s is on both routers", tt.route)
+			}
+		})
+	}
+}
+
+func TestSingleListenerMountsEverything(t *testing.T) {
+	public, admin := newRouters(testRouteDeps(""))
+	if admin != nil {
+		t.Fatal("an admin router without ADMIN_ADDR")
+	}
+	routes := routePatterns(t, public)
+	split, splitAdmin := newRouters(testRouteDeps("127.0.0.1:9090"))
+	want := len(routePatterns(t, split)) + len(routePatterns(t, splitAdmin))
+	if len(routes) != want {
+		t.Errorf("%d routes on the single listener, want %d", len(routes), want)
+	}
+	for _, route := range []string{"GET " + healthBaseURL, "GET " + metricsBaseURL, "GET " + apiBaseURL + "/orders"} {
+		if !hasRoute(routes, route) {
+			t.Errorf("%s is missing", route)
+		}
+	}
+}
+
+func hasRoute(routes []string, route string) bool {
+	for _, r := range routes {
+		if strings.TrimSuffix(r, "/") == strings.TrimSuffix(route, "/") {
+			return true
+		}
+	}
+	return false
+}
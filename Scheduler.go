@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// The background jobs run on one scheduler rather than each on a ticker of
+// its own. A job has a name, a schedule saying when it is next due after a
+// run, a timeout and its handler. Most run only on the leader, and their
+// last run is kept in scheduled_jobs, so a restart neither runs a daily
+// job twice nor skips one that fell due while the bot was down: it runs
+// once on the way back up. A run never overlaps the previous one, a panic
+// fails the run instead of the process, and a run past its timeout is
+// counted failed, though it keeps the job busy until its handler returns,
+// as most of them can't be interrupted. "jobs" and GET /api/jobs list them,
+// "run job" and POST /api/jobs/{name}/run run one now.
+
+const (
+	schedulerTick     = 5 * time.Second
+	defaultJobTimeout = 10 * time.Minute
+)
+
+var (
+	errNoSuchJob  = errors.New("no such job")
+	errJobRunning = errors.New("the job is already running")
+	errNotLeading = errors.New("the job only runs on the leader")
+)
+
+// jobSchedule is when a job is next due after a run that started at last;
+// a zero time means it isn't due at all for now, e.g. while it is switched
+// off in the config. It is asked afresh on every tick.
+type jobSchedule func(last time.Time) time.Time
+
+// every is due interval after the last run.
+func every(interval time.Duration) jobSchedule {
+	return func(last time.Time) time.Time {
+		return last.Add(interval)
+	}
+}
+
+// dailyAt is due at hour:minute in the business timezone.
+func dailyAt(hour, minute int) jobSchedule {
+	return func(last time.Time) time.Time {
+		loc := cfg().BusinessHours.Location
+		t := last.In(loc)
+		due := time.Date(t.Year(), t.Month(), t.Day(), hour, minute, 0, 0, loc)
+		if !due.After(last) {
+			due = due.AddDate(0, 0, 1)
+		}
+		return due
+	}
+}
+
+// weeklyAt is due on day at hour:minute in the business timezone.
+func weeklyAt(day time.Weekday, hour, minute int) jobSchedule {
+	return func(last time.Time) time.Time {
+		loc := cfg().BusinessHours.Location
+		t := last.In(loc)
+		due := time.Date(t.Year(), t.Month(), t.Day()+int(day-t.Weekday()+7)%7, hour, minute, 0, 0, loc)
+		if !due.After(last) {
+			due = due.AddDate(0, 0, 7)
+		}
+		return due
+	}
+}
+
+type job struct {
+	Name     string
+	Schedule jobSchedule
+	// Timeout defaults to defaultJobTimeout.
+	Timeout time.Duration
+	// EveryInstance jobs run on the standby too, and their last run is only
+	// kept in memory, as what they maintain is each instance's own.
+	EveryInstance bool
+	Run           func(ctx context.Context) error
+}
+
+// jobStatus is a job as "jobs" and GET /api/jobs show it.
+type jobStatus struct {
+	Name          string     `json:"name"`
+	EveryInstance bool       `json:"every_instance,omitempty"`
+	Running       bool       `json:"running"`
+	LastRun       *time.Time `json:"last_run,omitempty"`
+	LastDuration  float64    `json:"last_duration_seconds"`
+	LastError     string     `json:"last_error,omitempty"`
+	Failures      int        `json:"consecutive_failures"`
+	NextRun       *time.Time `json:"next_run,omitempty"`
+}
+
+type scheduledJob struct {
+	job
+	running      bool
+	lastRun      time.Time
+	lastDuration time.Duration
+	lastError    string
+	failures     int
+}
+
+type scheduler struct {
+	db      *sql.DB
+	started time.Time
+
+	mu      sync.Mutex
+	jobs    []*scheduledJob
+	leading bool
+}
+
+func newScheduler(db *sql.DB, jobs []job) *scheduler {
+	s := &scheduler{db: db, started: time.Now()}
+	seen := map[string]bool{}
+	for _, j := range jobs {
+		if seen[j.Name] {
+			panic("job " + j.Name + " registered twice")
+		}
+		seen[j.Name] = true
+		if j.Timeout == 0 {
+			j.Timeout = defaultJobTimeout
+		}
+		s.jobs = append(s.jobs, &scheduledJob{job: j})
+	}
+	return s
+}
+
+// Start runs the jobs that run on every instance.
+func (s *scheduler) Start() {
+	go func() {
+		for {
+			s.tick(time.Now())
+			time.Sleep(schedulerTick)
+		}
+	}()
+}
+
+// Lead loads the leader's jobs' last runs and starts running them.
+func (s *scheduler) Lead() {
+	rows, err := s.db.Query(`SELECT name, last_run_at, last_duration_ms, last_error, failures FROM scheduled_jobs`)
+	if err != nil {
+		log.Printf("Reading the last job runs failed, every job is due now: %v", err)
+	} else {
+		defer rows.Close()
+		s.mu.Lock()
+		for rows.Next() {
+			var name, lastError string
+			var lastRun time.Time
+			var ms int64
+			var failures int
+			if err := rows.Scan(&name, &lastRun, &ms, &lastError, &failures); err != nil {
+				log.Printf("Reading the last job runs failed: %v", err)
+				break
+			}
+			if j := s.find(name); j != nil && !j.EveryInstance {
+				j.lastRun, j.lastDuration, j.lastError, j.failures = lastRun, time.Duration(ms)*time.Millisecond, lastError, failures
+			}
+		}
+		s.mu.Unlock()
+	}
+	s.mu.Lock()
+	s.leading = true
+	s.mu.Unlock()
+}
+
+func (s *scheduler) find(name string) *scheduledJob {
+	for _, j := range s.jobs {
+		if j.Name == name {
+			return j
+		}
+	}
+	return nil
+}
+
+// due is when j is next due. A job that never ran counts from startup.
+func (s *scheduler) due(j *scheduledJob) time.Time {
+	last := j.lastRun
+	if last.IsZero() {
+		last = s.started
+	}
+	return j.Schedule(last)
+}
+
+func (s *scheduler) tick(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.running || (!j.EveryInstance && !s.leading) {
+			continue
+		}
+		if due := s.due(j); !due.IsZero() && !due.After(now) {
+			s.begin(j, now)
+		}
+	}
+}
+
+// Trigger runs the named job now, off its schedule.
+func (s *scheduler) Trigger(name string) error {
+	if s == nil {
+		return errNoSuchJob
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	j := s.find(name)
+	switch {
+	case j == nil:
+		return errNoSuchJob
+	case !j.EveryInstance && !s.leading:
+		return errNotLeading
+	case j.running:
+		return errJobRunning
+	}
+	s.begin(j, time.Now())
+	return nil
+}
+
+// begin starts a run of j. s.mu is held.
+func (s *scheduler) begin(j *scheduledJob, now time.Time) {
+	j.running, j.lastRun = true, now
+	if !j.EveryInstance {
+		// Recorded up front, so a crash mid-run doesn't rerun it on restart.
+		_, err := s.db.Exec(`INSERT INTO scheduled_jobs (name, last_run_at) VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET last_run_at = EXCLUDED.last_run_at, updated_at = now()`, j.Name, now)
+		if err != nil {
+			log.Printf("Job %s: recording its start failed: %v", j.Name, err)
+		}
+	}
+	go s.run(j, now)
+}
+
+func (s *scheduler) run(j *scheduledJob, started time.Time) {
+	ctx, cancel := context.WithTimeout(context.Background(), j.Timeout)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Job %s panicked: %v\n%s", j.Name, r, debug.Stack())
+				done <- fmt.Errorf("panicked: %v", r)
+			}
+		}()
+		done <- j.Run(ctx)
+	}()
+	select {
+	case err := <-done:
+		s.finish(j, started, err)
+	case <-ctx.Done():
+		s.finish(j, started, fmt.Errorf("still running after %s", j.Timeout))
+		<-done
+	}
+	s.mu.Lock()
+	j.running = false
+	s.mu.Unlock()
+}
+
+func (s *scheduler) finish(j *scheduledJob, started time.Time, err error) {
+	took := time.Since(started)
+	s.mu.Lock()
+	j.lastDuration, j.lastError = took, ""
+	if err != nil {
+		j.lastError = err.Error()
+		j.failures++
+	} else {
+		j.failures = 0
+	}
+	failures, lastError := j.failures, j.lastError
+	s.mu.Unlock()
+
+	result := "ok"
+	if err != nil {
+		result = "failed"
+		log.Printf("Job %s failed after %s (%d in a row): %v", j.Name, took.Round(time.Millisecond), failures, err)
+	}
+	metrics.Inc("menubot_job_runs_total", "Scheduled job runs, by job and result.", "job", j.Name, "result", result)
+	metrics.Set("menubot_job_last_run_timestamp_seconds", "When each scheduled job last started.", float64(started.Unix()), "job", j.Name)
+	metrics.Set("menubot_job_last_duration_seconds", "How long each scheduled job's last run took.", took.Seconds(), "job", j.Name)
+	metrics.Set("menubot_job_consecutive_failures", "Failed runs of each scheduled job since its last good one.", float64(failures), "job", j.Name)
+	if j.EveryInstance {
+		return
+	}
+	_, dbErr := s.db.Exec(`UPDATE scheduled_jobs SET last_duration_ms = $2, last_error = $3, failures = $4, updated_at = now() WHERE name = $1`,
+		j.Name, took.Milliseconds(), lastError, failures)
+	if dbErr != nil {
+		log.Printf("Job %s: recording its result failed: %v", j.Name, dbErr)
+	}
+}
+
+// Status lists the jobs by name.
+func (s *scheduler) Status() []jobStatus {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]jobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		st := jobStatus{Name: j.Name, EveryInstance: j.EveryInstance, Running: j.running,
+			LastDuration: j.lastDuration.Seconds(), LastError: j.lastError, Failures: j.failures}
+		if !j.lastRun.IsZero() {
+			last := j.lastRun
+			st.LastRun = &last
+		}
+		if j.EveryInstance || s.leading {
+			if next := s.due(j); !next.IsZero() {
+				st.NextRun = &next
+			}
+		}
+		list = append(list, st)
+	}
+	sort.Slice(list, func(a, b int) bool { return list[a].Name < list[b].Name })
+	return list
+}
+
+// adminJobs handles "jobs".
+func adminJobs(cc *commandContext, _ []string) string {
+	jobs := cc.jobs.Status()
+	if len(jobs) == 0 {
+		return "No jobs."
+	}
+	loc := cfg().BusinessHours.Location
+	lines := make([]string, len(jobs))
+	for i, j := range jobs {
+		line := j.Name
+		switch {
+		case j.Running:
+			line += ": running"
+		case j.LastRun != nil:
+			line += fmt.Sprintf(": last %s (%.1fs)", j.LastRun.In(loc).Format("01-02 15:04"), j.LastDuration)
+		default:
+			line += ": not run yet"
+		}
+		if j.Failures > 0 {
+			line += fmt.Sprintf(", FAILED %d in a row: %s", j.Failures, j.LastError)
+		}
+		if j.NextRun != nil {
+			line += ", next " + j.NextRun.In(loc).Format("01-02 15:04")
+		}
+		lines[i] = line
+	}
+	return "Jobs:\n" + strings.Join(lines, "\n")
+}
+
+// adminRunJob handles "run job <name>".
+func adminRunJob(cc *commandContext, args []string) string {
+	if len(args) != 1 {
+		return "Usage: run job <name>, see \"jobs\" for the names"
+	}
+	if err := cc.jobs.Trigger(args[0]); err != nil {
+		return fmt.Sprintf("Can't run %s: %v.", args[0], err)
+	}
+	return fmt.Sprintf("Running %s, see \"jobs\" for how it went.", args[0])
+}
+
+func ListJobsHandler(s *scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, s.Status())
+	}
+}
+
+// RunJobHandler starts a job now and returns at once; the job's status
+// says when it is done.
+func RunJobHandler(s *scheduler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "jobName")
+		switch err := s.Trigger(name); {
+		case errors.Is(err, errNoSuchJob):
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		case err != nil:
+			writeJSONError(w, http.StatusConflict, err.Error())
+			return
+		}
+		log.Printf("%s ran job %s", staffFromContext(r.Context()).Name, name)
+		writeJSON(w, http.StatusAccepted, map[string]string{"job": name, "status": "started"})
+	}
+}
@@ -0,0 +1,510 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// schemaStatements create the tables owned by this app. MenuBotLib manages
+// its own tables; everything here is additive and safe to run on every
+// start.
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS pricelist_version (
+		catalogue_id TEXT PRIMARY KEY,
+		version      BIGINT NOT NULL,
+		content_hash TEXT NOT NULL,
+		updated_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS order_meta (
+		order_id          BIGINT PRIMARY KEY,
+		pricelist_version BIGINT NOT NULL,
+		updated_at        TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'unpaid'`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS paid_at TIMESTAMPTZ`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS pf_payment_id TEXT`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS payfast_mode TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS payment_mode TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS fulfilment TEXT NOT NULL DEFAULT 'collection'`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS slot TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS notes TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS quoted_prices JSONB NOT NULL DEFAULT '{}'`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS payment_link TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS checked_out_at TIMESTAMPTZ`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS eta TIMESTAMPTZ`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS eta_note TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS eta_notified TIMESTAMPTZ`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS disputed_at TIMESTAMPTZ`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS self_test BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS callback_base TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS delivery_contact_name TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS delivery_contact_cell TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS item_codes JSONB NOT NULL DEFAULT '{}'`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS web_link_claimed_at TIMESTAMPTZ`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS web_followup TEXT NOT NULL DEFAULT ''`,
+	// MenuBotLib creates the order table on first use, so on a new
+	// database it may not be there yet; the next start adds the column.
+	`ALTER TABLE IF EXISTS customerorder ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT 'bot'`,
+	`CREATE TABLE IF NOT EXISTS cancellation_requests (
+		id           BIGSERIAL PRIMARY KEY,
+		order_id     BIGINT NOT NULL,
+		cell_number  TEXT NOT NULL,
+		state        TEXT NOT NULL DEFAULT 'pending',
+		requested_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		decided_at   TIMESTAMPTZ
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS cancellation_requests_pending
+		ON cancellation_requests (order_id) WHERE state = 'pending'`,
+	`CREATE TABLE IF NOT EXISTS item_availability (
+		catalogue_id TEXT NOT NULL,
+		item_id      BIGINT NOT NULL,
+		days         TEXT NOT NULL DEFAULT '',
+		start_time   TEXT NOT NULL DEFAULT '',
+		end_time     TEXT NOT NULL DEFAULT '',
+		valid_from   TEXT NOT NULL DEFAULT '',
+		valid_to     TEXT NOT NULL DEFAULT '',
+		PRIMARY KEY (catalogue_id, item_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS item_state (
+		catalogue_id   TEXT NOT NULL,
+		item_id        BIGINT NOT NULL,
+		is_active      BOOLEAN NOT NULL DEFAULT true,
+		inactive_since TIMESTAMPTZ,
+		deleted_at     TIMESTAMPTZ,
+		PRIMARY KEY (catalogue_id, item_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS price_changes (
+		id             BIGSERIAL PRIMARY KEY,
+		catalogue_id   TEXT NOT NULL,
+		item_id        BIGINT NOT NULL,
+		price          NUMERIC NOT NULL,
+		effective_from TIMESTAMPTZ NOT NULL,
+		created_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS price_changes_effective ON price_changes (catalogue_id, item_id, effective_from)`,
+	`CREATE TABLE IF NOT EXISTS item_images (
+		catalogue_id TEXT NOT NULL,
+		item_id      BIGINT NOT NULL,
+		image_url    TEXT NOT NULL,
+		PRIMARY KEY (catalogue_id, item_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS price_tiers (
+		name       TEXT PRIMARY KEY,
+		multiplier NUMERIC NOT NULL DEFAULT 1
+	)`,
+	`CREATE TABLE IF NOT EXISTS price_tier_items (
+		tier    TEXT NOT NULL REFERENCES price_tiers (name) ON DELETE CASCADE,
+		item_id BIGINT NOT NULL,
+		price   NUMERIC NOT NULL,
+		PRIMARY KEY (tier, item_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS customer_profiles (
+		cell_number TEXT PRIMARY KEY,
+		tier        TEXT NOT NULL DEFAULT 'retail',
+		updated_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`ALTER TABLE customer_profiles ADD COLUMN IF NOT EXISTS lid TEXT`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS customer_profiles_lid ON customer_profiles (lid) WHERE lid IS NOT NULL`,
+	`ALTER TABLE customer_profiles ADD COLUMN IF NOT EXISTS opted_in BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE customer_profiles ADD COLUMN IF NOT EXISTS consent_requested_at TIMESTAMPTZ`,
+	`CREATE TABLE IF NOT EXISTS consent_log (
+		id          BIGSERIAL PRIMARY KEY,
+		cell_number TEXT NOT NULL,
+		event       TEXT NOT NULL,
+		message     TEXT NOT NULL,
+		prompt      TEXT NOT NULL DEFAULT '',
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS consent_log_cell ON consent_log (cell_number)`,
+	// Consent records are evidence; refuse to change or remove them.
+	`CREATE OR REPLACE FUNCTION consent_log_immutable() RETURNS trigger LANGUAGE plpgsql AS $$
+	BEGIN
+		RAISE EXCEPTION 'consent_log is append-only';
+	END $$`,
+	`DROP TRIGGER IF EXISTS consent_log_immutable ON consent_log`,
+	`CREATE TRIGGER consent_log_immutable BEFORE UPDATE OR DELETE ON consent_log
+		FOR EACH ROW EXECUTE FUNCTION consent_log_immutable()`,
+	`CREATE TABLE IF NOT EXISTS loyalty_ledger (
+		id          BIGSERIAL PRIMARY KEY,
+		cell_number TEXT NOT NULL,
+		points      INT NOT NULL,
+		reason      TEXT NOT NULL,
+		order_id    BIGINT,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS loyalty_ledger_cell ON loyalty_ledger (cell_number)`,
+	`CREATE INDEX IF NOT EXISTS loyalty_ledger_order ON loyalty_ledger (order_id) WHERE order_id IS NOT NULL`,
+	`CREATE TABLE IF NOT EXISTS loyalty_redemptions (
+		order_id    BIGINT PRIMARY KEY,
+		cell_number TEXT NOT NULL,
+		points      INT NOT NULL,
+		discount    NUMERIC NOT NULL,
+		state       TEXT NOT NULL,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS referral_codes (
+		cell_number TEXT PRIMARY KEY,
+		code        TEXT NOT NULL UNIQUE,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS referrals (
+		referred_cell     TEXT PRIMARY KEY,
+		referrer_cell     TEXT NOT NULL,
+		code              TEXT NOT NULL,
+		created_at        TIMESTAMPTZ NOT NULL DEFAULT now(),
+		credited_order_id BIGINT,
+		credited_points   INT,
+		credited_at       TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS referrals_time ON referrals (created_at)`,
+	`CREATE TABLE IF NOT EXISTS outbox (
+		id              BIGSERIAL PRIMARY KEY,
+		recipient       TEXT NOT NULL,
+		body            TEXT NOT NULL,
+		state           TEXT NOT NULL DEFAULT 'pending',
+		classification  TEXT NOT NULL,
+		last_error      TEXT NOT NULL,
+		attempts        INT NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+		sent_at         TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS outbox_pending ON outbox (next_attempt_at) WHERE state = 'pending'`,
+	`ALTER TABLE outbox ADD COLUMN IF NOT EXISTS priority INT NOT NULL DEFAULT 1`,
+	`ALTER TABLE outbox ADD COLUMN IF NOT EXISTS order_id BIGINT`,
+	`CREATE TABLE IF NOT EXISTS outbound_messages (
+		message_id  TEXT PRIMARY KEY,
+		recipient   TEXT NOT NULL,
+		body        TEXT NOT NULL,
+		order_id    BIGINT,
+		server_time TIMESTAMPTZ NOT NULL,
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS outbound_messages_order ON outbound_messages (order_id) WHERE order_id IS NOT NULL`,
+	`CREATE TABLE IF NOT EXISTS funnel_events (
+		id          BIGSERIAL PRIMARY KEY,
+		stage       TEXT NOT NULL,
+		cell_number TEXT NOT NULL,
+		order_id    BIGINT,
+		occurred_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS funnel_events_order_stage ON funnel_events (stage, order_id) WHERE order_id IS NOT NULL`,
+	`CREATE INDEX IF NOT EXISTS funnel_events_time ON funnel_events (occurred_at)`,
+	`CREATE TABLE IF NOT EXISTS maintenance (
+		id         INT PRIMARY KEY CHECK (id = 1),
+		active     BOOLEAN NOT NULL,
+		until      TIMESTAMPTZ,
+		message    TEXT NOT NULL DEFAULT '',
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS connection_events (
+		id          BIGSERIAL PRIMARY KEY,
+		kind        TEXT NOT NULL,
+		detail      TEXT NOT NULL DEFAULT '',
+		occurred_at TIMESTAMPTZ NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS connection_events_time ON connection_events (occurred_at)`,
+	`CREATE TABLE IF NOT EXISTS takeovers (
+		cell_number TEXT PRIMARY KEY,
+		until       TIMESTAMPTZ NOT NULL,
+		started_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS takeover_transcript (
+		id          BIGSERIAL PRIMARY KEY,
+		cell_number TEXT NOT NULL,
+		direction   TEXT NOT NULL,
+		message_id  TEXT NOT NULL,
+		body        TEXT NOT NULL,
+		received_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS takeover_transcript_cell ON takeover_transcript (cell_number, received_at)`,
+	`CREATE TABLE IF NOT EXISTS conversation_log (
+		id          BIGSERIAL PRIMARY KEY,
+		cell_number TEXT NOT NULL,
+		body        TEXT NOT NULL,
+		normalized  TEXT NOT NULL,
+		kind        TEXT NOT NULL,
+		command     TEXT NOT NULL DEFAULT '',
+		received_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS conversation_log_received ON conversation_log (received_at)`,
+	`CREATE TABLE IF NOT EXISTS item_additions (
+		id          BIGSERIAL PRIMARY KEY,
+		item_id     BIGINT NOT NULL,
+		quantity    INT NOT NULL,
+		cell_number TEXT NOT NULL,
+		order_id    BIGINT NOT NULL,
+		added_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS item_additions_added ON item_additions (added_at)`,
+	`CREATE TABLE IF NOT EXISTS item_modifiers (
+		catalogue_id TEXT NOT NULL,
+		item_id      BIGINT NOT NULL,
+		position     INT NOT NULL,
+		name         TEXT NOT NULL,
+		required     BOOLEAN NOT NULL DEFAULT false,
+		options      JSONB NOT NULL,
+		PRIMARY KEY (catalogue_id, item_id, position)
+	)`,
+	`CREATE TABLE IF NOT EXISTS order_line_options (
+		id         BIGSERIAL PRIMARY KEY,
+		order_id   BIGINT NOT NULL,
+		item_id    BIGINT NOT NULL,
+		options    JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS order_line_options_order ON order_line_options (order_id)`,
+	`CREATE TABLE IF NOT EXISTS item_combos (
+		catalogue_id TEXT NOT NULL,
+		combo_id     BIGINT NOT NULL,
+		position     INT NOT NULL,
+		item_id      BIGINT NOT NULL,
+		quantity     INT NOT NULL,
+		PRIMARY KEY (catalogue_id, combo_id, position)
+	)`,
+	`CREATE TABLE IF NOT EXISTS item_categories (
+		catalogue_id TEXT NOT NULL,
+		item_id      BIGINT NOT NULL,
+		category     TEXT NOT NULL,
+		PRIMARY KEY (catalogue_id, item_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS item_codes (
+		catalogue_id TEXT NOT NULL,
+		item_id      BIGINT NOT NULL,
+		code         TEXT NOT NULL,
+		manual       BOOLEAN NOT NULL DEFAULT false,
+		PRIMARY KEY (catalogue_id, item_id),
+		UNIQUE (catalogue_id, code)
+	)`,
+	`CREATE TABLE IF NOT EXISTS specials (
+		id           BIGSERIAL PRIMARY KEY,
+		catalogue_id TEXT NOT NULL,
+		item_id      BIGINT,
+		category     TEXT NOT NULL DEFAULT '',
+		discount_pct NUMERIC(5,2) NOT NULL,
+		starts_at    TIMESTAMPTZ NOT NULL,
+		ends_at      TIMESTAMPTZ NOT NULL,
+		broadcast    BOOLEAN NOT NULL DEFAULT false,
+		message      TEXT NOT NULL DEFAULT '',
+		announced_at TIMESTAMPTZ,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS specials_window ON specials (catalogue_id, ends_at)`,
+	`CREATE TABLE IF NOT EXISTS payment_notifications (
+		id            BIGSERIAL PRIMARY KEY,
+		pf_payment_id TEXT NOT NULL,
+		order_ref     TEXT NOT NULL,
+		payload       TEXT NOT NULL,
+		state         TEXT NOT NULL DEFAULT 'pending',
+		attempts      INT NOT NULL DEFAULT 0,
+		received_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		processed_at  TIMESTAMPTZ
+	)`,
+	`ALTER TABLE payment_notifications ADD COLUMN IF NOT EXISTS payment_status TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE payment_notifications DROP CONSTRAINT IF EXISTS payment_notifications_pf_payment_id_key`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS payment_notifications_payment_status ON payment_notifications (pf_payment_id, payment_status)`,
+	`CREATE INDEX IF NOT EXISTS payment_notifications_pending ON payment_notifications (id) WHERE state = 'pending'`,
+	`ALTER TABLE payment_notifications ADD COLUMN IF NOT EXISTS verified BOOLEAN NOT NULL DEFAULT false`,
+	`CREATE TABLE IF NOT EXISTS dead_letters (
+		id              BIGSERIAL PRIMARY KEY,
+		notification_id BIGINT NOT NULL UNIQUE REFERENCES payment_notifications (id),
+		error           TEXT NOT NULL,
+		attempts        JSONB NOT NULL DEFAULT '[]',
+		state           TEXT NOT NULL DEFAULT 'open',
+		created_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at      TIMESTAMPTZ NOT NULL DEFAULT now(),
+		redriven_at     TIMESTAMPTZ
+	)`,
+	`CREATE TABLE IF NOT EXISTS reconciliation_reports (
+		report_date   DATE PRIMARY KEY,
+		report        JSONB NOT NULL,
+		discrepancies INT NOT NULL,
+		created_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS deferred_messages (
+		id           BIGSERIAL PRIMARY KEY,
+		recipient    TEXT NOT NULL,
+		body         TEXT NOT NULL,
+		kind         TEXT NOT NULL,
+		order_id     BIGINT,
+		order_status TEXT,
+		expires_at   TIMESTAMPTZ,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS order_ratings (
+		order_id    BIGINT PRIMARY KEY,
+		cell_number TEXT NOT NULL,
+		prompted_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		rating      SMALLINT CHECK (rating BETWEEN 1 AND 5),
+		comment     TEXT NOT NULL DEFAULT '',
+		rated_at    TIMESTAMPTZ,
+		dismissed   BOOLEAN NOT NULL DEFAULT false
+	)`,
+	`CREATE INDEX IF NOT EXISTS order_ratings_open ON order_ratings (cell_number) WHERE rating IS NULL AND NOT dismissed`,
+	`CREATE INDEX IF NOT EXISTS order_ratings_rated ON order_ratings (rated_at) WHERE rating IS NOT NULL`,
+	`ALTER TABLE customer_profiles ADD COLUMN IF NOT EXISTS ad_source TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE customer_profiles ADD COLUMN IF NOT EXISTS ad_source_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE customer_profiles ADD COLUMN IF NOT EXISTS ad_title TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE customer_profiles ADD COLUMN IF NOT EXISTS ad_url TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE customer_profiles ADD COLUMN IF NOT EXISTS ad_click_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE customer_profiles ADD COLUMN IF NOT EXISTS ad_seen_at TIMESTAMPTZ`,
+	`ALTER TABLE customer_profiles ADD COLUMN IF NOT EXISTS ad_order_id BIGINT`,
+	`CREATE INDEX IF NOT EXISTS customer_profiles_ad_seen ON customer_profiles (ad_seen_at) WHERE ad_seen_at IS NOT NULL`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS ad_source TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS ad_source_id TEXT NOT NULL DEFAULT ''`,
+	// The preparation queue. due_at is set on pre-orders for a later slot.
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS queue_priority INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS due_at TIMESTAMPTZ`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS queue_notify BOOLEAN NOT NULL DEFAULT false`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS next_notified_at TIMESTAMPTZ`,
+	`ALTER TABLE order_meta ADD COLUMN IF NOT EXISTS order_ref TEXT`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS order_meta_order_ref ON order_meta (order_ref) WHERE order_ref IS NOT NULL`,
+	`CREATE TABLE IF NOT EXISTS gift_orders (
+		order_id       BIGINT PRIMARY KEY,
+		payer_cell     TEXT NOT NULL,
+		recipient_cell TEXT NOT NULL,
+		message        TEXT NOT NULL DEFAULT '',
+		state          TEXT NOT NULL DEFAULT 'pending',
+		created_at     TIMESTAMPTZ NOT NULL DEFAULT now(),
+		notified_at    TIMESTAMPTZ,
+		responded_at   TIMESTAMPTZ
+	)`,
+	`CREATE INDEX IF NOT EXISTS gift_orders_recipient ON gift_orders (recipient_cell) WHERE state IN ('notified', 'address')`,
+	`CREATE INDEX IF NOT EXISTS gift_orders_payer ON gift_orders (payer_cell)`,
+	`CREATE TABLE IF NOT EXISTS staff_keys (
+		id           BIGSERIAL PRIMARY KEY,
+		name         TEXT NOT NULL,
+		role         TEXT NOT NULL,
+		key_prefix   TEXT NOT NULL,
+		key_hash     TEXT NOT NULL UNIQUE,
+		created_at   TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_used_at TIMESTAMPTZ,
+		revoked_at   TIMESTAMPTZ
+	)`,
+	`CREATE TABLE IF NOT EXISTS staff_audit (
+		id         BIGSERIAL PRIMARY KEY,
+		key_id     BIGINT REFERENCES staff_keys (id),
+		staff_name TEXT NOT NULL,
+		role       TEXT NOT NULL,
+		method     TEXT NOT NULL,
+		route      TEXT NOT NULL,
+		path       TEXT NOT NULL,
+		status     INT NOT NULL,
+		remote_ip  TEXT NOT NULL DEFAULT '',
+		request_id TEXT NOT NULL DEFAULT '',
+		at         TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS staff_audit_at ON staff_audit (at)`,
+	`ALTER TABLE customer_profiles ADD COLUMN IF NOT EXISTS merged_into TEXT`,
+	`CREATE TABLE IF NOT EXISTS customer_merges (
+		id             BIGSERIAL PRIMARY KEY,
+		primary_cell   TEXT NOT NULL,
+		duplicate_cell TEXT NOT NULL,
+		merged_by      TEXT NOT NULL,
+		moved          JSONB NOT NULL,
+		merged_at      TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS customer_merges_primary ON customer_merges (primary_cell)`,
+	`CREATE TABLE IF NOT EXISTS command_stats_daily (
+		day     DATE NOT NULL,
+		outcome TEXT NOT NULL,
+		command TEXT NOT NULL DEFAULT '',
+		count   BIGINT NOT NULL,
+		PRIMARY KEY (day, outcome, command)
+	)`,
+	`CREATE TABLE IF NOT EXISTS command_fallbacks_daily (
+		id        BIGSERIAL PRIMARY KEY,
+		day       DATE NOT NULL,
+		text_hash TEXT NOT NULL,
+		text      TEXT NOT NULL,
+		count     BIGINT NOT NULL,
+		UNIQUE (day, text_hash)
+	)`,
+	`CREATE TABLE IF NOT EXISTS pending_prompts (
+		id       BIGSERIAL PRIMARY KEY,
+		cell     TEXT NOT NULL,
+		flow     TEXT NOT NULL,
+		order_id BIGINT NOT NULL,
+		step     TEXT NOT NULL DEFAULT '',
+		data     JSONB NOT NULL DEFAULT 'null',
+		asked_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		reasked  BOOLEAN NOT NULL DEFAULT false
+	)`,
+	`CREATE INDEX IF NOT EXISTS pending_prompts_cell ON pending_prompts (cell, flow, id)`,
+	`CREATE TABLE IF NOT EXISTS contact_rules (
+		id         BIGSERIAL PRIMARY KEY,
+		pattern    TEXT NOT NULL,
+		action     TEXT NOT NULL CHECK (action IN ('allow', 'deny')),
+		reason     TEXT NOT NULL DEFAULT '',
+		expires_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS contact_gate (
+		id             INT PRIMARY KEY CHECK (id = 1),
+		allowlist_only BOOLEAN NOT NULL DEFAULT false,
+		updated_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS contact_invite_notices (
+		cell_number TEXT PRIMARY KEY,
+		sent_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS sending_block (
+		id            INT PRIMARY KEY CHECK (id = 1),
+		active        BOOLEAN NOT NULL,
+		cause         TEXT NOT NULL DEFAULT '',
+		detail        TEXT NOT NULL DEFAULT '',
+		since         TIMESTAMPTZ,
+		until         TIMESTAMPTZ,
+		probes        INT NOT NULL DEFAULT 0,
+		next_probe_at TIMESTAMPTZ,
+		updated_at    TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS incidents (
+		id          TEXT PRIMARY KEY,
+		code        TEXT NOT NULL,
+		context     TEXT NOT NULL DEFAULT '',
+		error       TEXT NOT NULL DEFAULT '',
+		cell_number TEXT NOT NULL DEFAULT '',
+		order_id    BIGINT,
+		build       TEXT NOT NULL DEFAULT '',
+		occurred_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE INDEX IF NOT EXISTS incidents_occurred_at ON incidents (occurred_at)`,
+	`CREATE TABLE IF NOT EXISTS scheduled_jobs (
+		name             TEXT PRIMARY KEY,
+		last_run_at      TIMESTAMPTZ NOT NULL,
+		last_duration_ms BIGINT NOT NULL DEFAULT 0,
+		last_error       TEXT NOT NULL DEFAULT '',
+		failures         INTEGER NOT NULL DEFAULT 0,
+		updated_at       TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS payfast_selftests (
+		id     BIGSERIAL PRIMARY KEY,
+		ran_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		passed BOOLEAN NOT NULL,
+		stage  TEXT NOT NULL DEFAULT '',
+		detail TEXT NOT NULL DEFAULT ''
+	)`,
+	`ALTER TABLE customer_profiles ADD COLUMN IF NOT EXISTS display_name TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE customer_profiles ADD COLUMN IF NOT EXISTS name_source TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS customer_profiles_display_name ON customer_profiles (lower(display_name)) WHERE display_name <> ''`,
+	`ALTER TABLE customer_profiles ADD COLUMN IF NOT EXISTS email TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE outbound_messages ADD COLUMN IF NOT EXISTS delivery_state TEXT NOT NULL DEFAULT 'sent'`,
+	`ALTER TABLE outbound_messages ADD COLUMN IF NOT EXISTS delivery_error TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE outbound_messages ADD COLUMN IF NOT EXISTS delivery_updated_at TIMESTAMPTZ`,
+	`ALTER TABLE outbound_messages ADD COLUMN IF NOT EXISTS kind TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS conversation_devices (
+		chat       TEXT PRIMARY KEY,
+		device     TEXT NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+}
+
+func ensureSchema(db *sql.DB) error {
+	for _, stmt := range schemaStatements {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("creating app schema: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// maxTextLength is WhatsApp's limit on a text message, in characters.
+	maxTextLength = 65536
+
+	sendBackoffBase = 500 * time.Millisecond
+	sendBackoffMax  = 8 * time.Second
+)
+
+var errMessageTooLong = fmt.Errorf("message longer than %d characters", maxTextLength)
+
+type sendErrorClass string
+
+const (
+	sendTransient sendErrorClass = "transient"
+	sendPermanent sendErrorClass = "permanent"
+)
+
+// classifySendError decides whether a SendMessage error is worth retrying.
+// Anything unrecognised is treated as transient: a few wasted retries are
+// cheaper than dropping a reply that would have gone through.
+func classifySendError(err error) sendErrorClass {
+	var disconnected *whatsmeow.DisconnectedError
+	switch {
+	case errors.Is(err, errMessageTooLong),
+		errors.Is(err, whatsmeow.ErrUnknownServer),
+		errors.Is(err, whatsmeow.ErrRecipientADJID),
+		errors.Is(err, whatsmeow.ErrBroadcastListUnsupported),
+		errors.Is(err, whatsmeow.ErrNotLoggedIn),
+		errors.Is(err, whatsmeow.ErrIQBadRequest),
+		errors.Is(err, whatsmeow.ErrIQNotAuthorized),
+		errors.Is(err, whatsmeow.ErrIQForbidden),
+		errors.Is(err, whatsmeow.ErrIQNotFound),
+		errors.Is(err, whatsmeow.ErrIQNotAllowed),
+		errors.Is(err, whatsmeow.ErrIQNotAcceptable),
+		errors.Is(err, whatsmeow.ErrIQGone):
+		return sendPermanent
+	case errors.As(err, &disconnected),
+		errors.Is(err, whatsmeow.ErrNotConnected),
+		errors.Is(err, whatsmeow.ErrMessageTimedOut),
+		errors.Is(err, whatsmeow.ErrIQTimedOut),
+		errors.Is(err, whatsmeow.ErrIQResourceLimit),
+		errors.Is(err, whatsmeow.ErrIQInternalServerError),
+		errors.Is(err, whatsmeow.ErrIQServiceUnavailable),
+		errors.Is(err, whatsmeow.ErrIQPartialServerError),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, errSendingDisabled):
+		return sendTransient
+	case errors.Is(err, whatsmeow.ErrServerReturnedError):
+		return classifyServerErrorCode(err)
+	}
+	return sendTransient
+}
+
+// classifyServerErrorCode handles ErrServerReturnedError, which whatsmeow
+// formats as "server returned error <code>" with HTTP-like codes.
+func classifyServerErrorCode(err error) sendErrorClass {
+	code, ok := serverErrorCode(err)
+	if !ok || code == 429 || code >= 500 {
+		return sendTransient
+	}
+	return sendPermanent
+}
+
+func serverErrorCode(err error) (int, bool) {
+	if !errors.Is(err, whatsmeow.ErrServerReturnedError) {
+		return 0, false
+	}
+	fields := strings.Fields(err.Error())
+	code, convErr := strconv.Atoi(fields[len(fields)-1])
+	return code, convErr == nil
+}
+
+// sendBackoff returns a jittered exponential delay before retry attempt n,
+// counting from 1.
+func sendBackoff(attempt int) time.Duration {
+	backoff := sendBackoffBase << (attempt - 1)
+	if backoff <= 0 || backoff > sendBackoffMax {
+		backoff = sendBackoffMax
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// messageSender is the single path for outbound messages. It retries
+// transient failures and parks whatever still can't be sent in the outbox.
+type messageSender struct {
+	client  waClient
+	db      *sql.DB
+	limiter outboundLimiter
+	events  eventSinks
+	block   *sendingBlock
+	// staff are the shop's own numbers, which the test sink leaves alone.
+	staff map[string]bool
+	// record, when set, is handed every message instead of WhatsApp. The
+	// replay uses it to collect the replies.
+	record func(outboundMessage)
+	// failed is told when a message ends up failed, see setDeliveryState.
+	failed func(deliveryFailure)
+	// devices, when set, picks the client each chat is sent through.
+	devices *deviceSet
+}
+
+func newMessageSender(client waClient, db *sql.DB, limiter outboundLimiter, events eventSinks, block *sendingBlock, staff ...string) *messageSender {
+	s := &messageSender{client: client, db: db, limiter: limiter, events: events, block: block, staff: map[string]bool{}}
+	for _, number := range staff {
+		s.staff[number] = true
+	}
+	return s
+}
+
+// messageEvent is the data of message.received and message.sent events.
+type messageEvent struct {
+	CellNumber string `json:"cell_number"`
+	MessageID  string `json:"message_id"`
+	Text       string `json:"text"`
+	OrderID    int64  `json:"order_id,omitempty"`
+	// Device is our device the message came in on or went out from, set
+	// with more than one paired.
+	Device string `json:"device,omitempty"`
+}
+
+// outboundMessage is one message to send. OrderID links it to an order's
+// communication timeline and is 0 for messages about no particular order.
+// Kind marks the messages whose failure the admin is told about, and
+// OutboxID is set when the message is a retry from the outbox.
+type outboundMessage struct {
+	To       types.JID
+	Text     string
+	Priority sendPriority
+	OrderID  int64
+	Kind     string
+	OutboxID int64
+}
+
+// sendOnce makes a single delivery attempt, waiting for the outbound
+// limiter first. Successful sends are recorded in the outbound log.
+func (s *messageSender) sendOnce(m outboundMessage) error {
+	if utf8.RuneCountInString(m.Text) > maxTextLength {
+		return errMessageTooLong
+	}
+	_, err := s.sendPayload(m, &waProto.Message{Conversation: proto.String(m.Text)})
+	return err
+}
+
+// SendImage makes a single attempt at sending an uploaded image. Unlike
+// text it is not retried or parked in the outbox; callers fall back to a
+// text reply instead. The caption is what the outbound log records.
+func (s *messageSender) SendImage(to types.JID, img *waProto.ImageMessage, p sendPriority) error {
+	_, err := s.sendPayload(outboundMessage{To: to, Text: img.GetCaption(), Priority: p}, &waProto.Message{ImageMessage: img})
+	return err
+}
+
+// SendDocument is SendImage for an uploaded document.
+func (s *messageSender) SendDocument(to types.JID, doc *waProto.DocumentMessage, p sendPriority) error {
+	_, err := s.sendPayload(outboundMessage{To: to, Text: doc.GetCaption(), Priority: p}, &waProto.Message{DocumentMessage: doc})
+	return err
+}
+
+// SendPoll is SendImage for a single-choice poll, and returns the poll's
+// message ID, which votes refer to. The ID is empty when nothing was sent.
+func (s *messageSender) SendPoll(to types.JID, question string, options []string, p sendPriority) (string, error) {
+	return s.sendPayload(outboundMessage{To: to, Text: question + "\n" + strings.Join(options, "\n"), Priority: p},
+		s.client.BuildPollCreation(question, options, 1))
+}
+
+// sendPayload is where every send path ends up, so it is the one place
+// the test sink, the replay's recorder and the sending block are applied.
+func (s *messageSender) sendPayload(m outboundMessage, payload *waProto.Message) (string, error) {
+	if s.record != nil {
+		s.record(m)
+		return "", nil
+	}
+	if m, payload = s.redirectToSink(m, payload); payload == nil {
+		return "", nil
+	}
+	if s.block.Blocked() {
+		return "", errSendingDisabled
+	}
+	s.limiter.Wait(m.Priority)
+	client, device := s.client, ""
+	if s.devices != nil {
+		client = s.devices.clientFor(m.To)
+		if s.devices.multiple() {
+			device = deviceJID(client)
+		}
+	}
+	resp, err := client.SendMessage(context.Background(), m.To, payload)
+	if err != nil {
+		if isBlockSendError(err) {
+			s.block.Trip(sendForbidden, err.Error(), time.Time{})
+		}
+		return "", err
+	}
+	metrics.Inc("menubot_messages_sent_total", "Messages delivered to WhatsApp.")
+	s.events.Emit(eventMessageSent, messageEvent{CellNumber: m.To.User, MessageID: resp.ID, Text: m.Text, OrderID: m.OrderID, Device: device})
+	if err := recordOutbound(s.db, m, resp); err != nil {
+		log.Printf("Recording sent message %s failed: %v", resp.ID, err)
+	}
+	return resp.ID, nil
+}
+
+// Send sends to a phone number or JID string, see resolveJID.
+func (s *messageSender) Send(to, text string, p sendPriority) {
+	s.SendOrder(to, text, p, 0)
+}
+
+// SendOrder is Send for a message about orderID.
+func (s *messageSender) SendOrder(to, text string, p sendPriority, orderID int64) {
+	jid, err := resolveJID(to)
+	if err != nil {
+		log.Printf("ReturnToUser Failed with: %v", err)
+		return
+	}
+	s.Deliver(outboundMessage{To: jid, Text: text, Priority: p, OrderID: orderID})
+}
+
+func (s *messageSender) SendTo(jid types.JID, text string, p sendPriority) {
+	s.Deliver(outboundMessage{To: jid, Text: text, Priority: p})
+}
+
+// Deliver sends m, retrying transient failures up to SEND_RETRIES times
+// before handing the message to the outbox. While sending is disabled it
+// goes there at once.
+func (s *messageSender) Deliver(m outboundMessage) {
+	retries := cfg().SendRetries
+	var err error
+	var class sendErrorClass
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			metrics.Inc("menubot_send_retries_total", "Retries of transient send failures.")
+			time.Sleep(sendBackoff(attempt))
+		}
+		if err = s.sendOnce(m); err == nil {
+			return
+		}
+		if class = classifySendError(err); class == sendPermanent || attempt >= retries || errors.Is(err, errSendingDisabled) {
+			break
+		}
+	}
+
+	reason := string(class)
+	if errors.Is(err, errSendingDisabled) {
+		reason = "disabled"
+	} else if class == sendTransient {
+		reason = "exhausted"
+	}
+	metrics.Inc("menubot_send_failures_total", "Sends that failed permanently or ran out of retries.", "reason", reason)
+	log.Printf("ReturnToUser Failed with (%s): %v", reason, err)
+	id, dbErr := enqueueOutbox(s.db, m, class, err)
+	if dbErr != nil {
+		log.Printf("Saving undelivered message to outbox failed: %v", dbErr)
+		return
+	}
+	if class == sendPermanent {
+		s.setDeliveryState(outboxMessageID(id), deliveryFailed, err.Error())
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+)
+
+func TestClassifySendError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want sendErrorClass
+	}{
+		{"message too long", errMessageTooLong, sendPermanent},
+		{"unknown server", whatsmeow.ErrUnknownServer, sendPermanent},
+		{"device JID", whatsmeow.ErrRecipientADJID, sendPermanent},
+		{"broadcast list", whatsmeow.ErrBroadcastListUnsupported, sendPermanent},
+		{"not logged in", whatsmeow.ErrNotLoggedIn, sendPermanent},
+		{"not on WhatsApp", whatsmeow.ErrIQNotFound, sendPermanent},
+		{"forbidden", whatsmeow.ErrIQForbidden, sendPermanent},
+		{"wrapped permanent", fmt.Errorf("sending to 27821234567: %w", whatsmeow.ErrIQGone), sendPermanent},
+		{"disconnected", &whatsmeow.DisconnectedError{Action: "message send"}, sendTransient},
+		{"wrapped disconnected", fmt.Errorf("send: %w", &whatsmeow.DisconnectedError{Action: "message send"}), sendTransient},
+		{"not connected", whatsmeow.ErrNotConnected, sendTransient},
+		{"message timed out", whatsmeow.ErrMessageTimedOut, sendTransient},
+		{"IQ timed out", whatsmeow.ErrIQTimedOut, sendTransient},
+		{"rate limited", whatsmeow.ErrIQResourceLimit, sendTransient},
+		{"internal server error", whatsmeow.ErrIQInternalServerError, sendTransient},
+		{"service unavailable", whatsmeow.ErrIQServiceUnavailable, sendTransient},
+		{"deadline", context.DeadlineExceeded, sendTransient},
+		{"sending disabled", errSendingDisabled, sendTransient},
+		{"server error 500", fmt.Errorf("%w %d", whatsmeow.ErrServerReturnedError, 500), sendTransient},
+		{"server error 429", fmt.Errorf("%w %d", whatsmeow.ErrServerReturnedError, 429), sendTransient},
+		{"server error 400", fmt.Errorf("%w %d", whatsmeow.ErrServerReturnedError, 400), sendPermanent},
+		{"server error 463", fmt.Errorf("%w %d", whatsmeow.ErrServerReturnedError, 463), sendPermanent},
+		{"server error without a code", whatsmeow.ErrServerReturnedError, sendTransient},
+		{"unrecognised", errors.New("something odd"), sendTransient},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := classifySendError(tt.err); got != tt.want {
+				t.Errorf("classifySendError(%v) = %s, want %s", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendBackoff(t *testing.T) {
+	for attempt := 1; attempt <= 10; attempt++ {
+		want := sendBackoffBase << (attempt - 1)
+		if want > sendBackoffMax {
+			want = sendBackoffMax
+		}
+		for i := 0; i < 20; i++ {
+			got := sendBackoff(attempt)
+			if got < want/2 || got > want {
+				t.Fatalf("sendBackoff(%d) = %s, want between %s and %s", attempt, got, want/2, want)
+			}
+		}
+	}
+	if got := sendBackoff(100); got > sendBackoffMax || got < time.Duration(0) {
+		t.Errorf("sendBackoff(100) = %s, want at most %s", got, sendBackoffMax)
+	}
+}
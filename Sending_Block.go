@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+	"google.golang.org/protobuf/proto"
+)
+
+// WhatsApp temporarily bans numbers that behave like bots, and locks or
+// bans them outright when it keeps up. Sending anything more while that is
+// the case only makes it worse, so on the first sign of it all sending
+// stops: messages go to the outbox instead, and the outbox isn't flushed.
+// The state is persisted, so a crash-looping instance doesn't reconnect
+// the account on every start. Now and then the leader reconnects and
+// sends a probe to the host number; when that goes through sending
+// resumes and the outbox catches up. WhatsApp can't be used to say any of
+// this, so it is said in the log, on /healthz, in metrics, as a webhook
+// event and on ALERT_WEBHOOK_URL.
+
+const (
+	// sendingProbeFirst is how soon the first probe goes when WhatsApp
+	// didn't say when the ban ends; failed probes double it up to
+	// sendingProbeMax.
+	sendingProbeFirst = 5 * time.Minute
+	sendingProbeMax   = 2 * time.Hour
+	// sendingProbeConnectWait is how long a probe waits for a reconnect to
+	// log in before giving up on this round.
+	sendingProbeConnectWait = 30 * time.Second
+	alertWebhookTimeout     = 10 * time.Second
+)
+
+// sendForbidden is the cause recorded when WhatsApp refuses a send with
+// 403; the other causes are the connection event kinds.
+const sendForbidden = "send_forbidden"
+
+var errSendingDisabled = errors.New("sending is disabled while WhatsApp is blocking this number")
+
+// sendingBlockState is persisted in the single-row sending_block table.
+type sendingBlockState struct {
+	Active bool
+	Cause  string
+	Detail string
+	Since  time.Time
+	// Until is when WhatsApp said the ban ends, zero when it didn't.
+	Until     time.Time
+	Probes    int
+	NextProbe time.Time
+}
+
+// sendingBlock caches the persisted state. A nil sendingBlock never
+// blocks, for the replay's sender.
+type sendingBlock struct {
+	db         *sql.DB
+	events     eventSinks
+	instanceID string
+	state      atomic.Pointer[sendingBlockState]
+	client     *http.Client
+}
+
+func loadSendingBlock(db *sql.DB, events eventSinks, instanceID string) (*sendingBlock, error) {
+	b := &sendingBlock{db: db, events: events, instanceID: instanceID, client: &http.Client{Timeout: alertWebhookTimeout}}
+	var st sendingBlockState
+	var since, until, next sql.NullTime
+	err := db.QueryRow(`SELECT active, cause, detail, since, until, probes, next_probe_at FROM sending_block WHERE id = 1`).
+		Scan(&st.Active, &st.Cause, &st.Detail, &since, &until, &st.Probes, &next)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("reading sending block: %w", err)
+	}
+	st.Since, st.Until, st.NextProbe = since.Time, until.Time, next.Time
+	b.state.Store(&st)
+	metrics.GaugeFunc("menubot_sending_disabled", "1 while sending is disabled because WhatsApp is blocking the number.", func() float64 {
+		if b.Blocked() {
+			return 1
+		}
+		return 0
+	})
+	if st.Active {
+		log.Printf("WARNING: sending is disabled since %s (%s: %s), next probe at %s",
+			st.Since.Format(time.RFC3339), st.Cause, st.Detail, st.NextProbe.Format(time.RFC3339))
+	}
+	return b, nil
+}
+
+func (b *sendingBlock) Get() sendingBlockState {
+	if b == nil {
+		return sendingBlockState{}
+	}
+	return *b.state.Load()
+}
+
+func (b *sendingBlock) Blocked() bool {
+	return b.Get().Active
+}
+
+func (b *sendingBlock) save(st sendingBlockState) {
+	b.state.Store(&st)
+	_, err := b.db.Exec(`INSERT INTO sending_block (id, active, cause, detail, since, until, probes, next_probe_at)
+		VALUES (1, $1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (id) DO UPDATE SET active = EXCLUDED.active, cause = EXCLUDED.cause, detail = EXCLUDED.detail,
+			since = EXCLUDED.since, until = EXCLUDED.until, probes = EXCLUDED.probes,
+			next_probe_at = EXCLUDED.next_probe_at, updated_at = now()`,
+		st.Active, st.Cause, st.Detail, nullTime(st.Since), nullTime(st.Until), st.Probes, nullTime(st.NextProbe))
+	if err != nil {
+		log.Printf("Saving the sending block failed, it won't survive a restart: %v", err)
+	}
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// sendingBlockEvent is the data of the sending.disabled and
+// sending.resumed events, and the body posted to ALERT_WEBHOOK_URL.
+type sendingBlockEvent struct {
+	Alert      string     `json:"alert"`
+	Cause      string     `json:"cause"`
+	Detail     string     `json:"detail,omitempty"`
+	Since      time.Time  `json:"since"`
+	Until      *time.Time `json:"until,omitempty"`
+	InstanceID string     `json:"instance_id"`
+}
+
+func (b *sendingBlock) event(alert string, st sendingBlockState) sendingBlockEvent {
+	e := sendingBlockEvent{Alert: alert, Cause: st.Cause, Detail: st.Detail, Since: st.Since, InstanceID: b.instanceID}
+	if !st.Until.IsZero() {
+		e.Until = &st.Until
+	}
+	return e
+}
+
+// Trip disables sending. A block that is already on only takes the later
+// of the two ends and keeps its probe schedule.
+func (b *sendingBlock) Trip(cause, detail string, until time.Time) {
+	now := time.Now()
+	st := b.Get()
+	if st.Active {
+		if until.After(st.Until) {
+			st.Until = until
+			if st.NextProbe.Before(until) {
+				st.NextProbe = until
+			}
+			b.save(st)
+		}
+		return
+	}
+	st = sendingBlockState{Active: true, Cause: cause, Detail: detail, Since: now, Until: until, NextProbe: now.Add(sendingProbeFirst)}
+	if until.After(st.NextProbe) {
+		st.NextProbe = until
+	}
+	b.save(st)
+	metrics.Inc("menubot_sending_blocks_total", "Times sending was disabled because WhatsApp was blocking the number.", "cause", cause)
+	log.Printf("WARNING: WhatsApp is blocking this number (%s: %s). Sending is DISABLED, messages are kept in the outbox until a probe to the host number goes through, first at %s",
+		cause, detail, st.NextProbe.Format(time.RFC3339))
+	b.alert(eventSendingDisabled, st)
+}
+
+// probeFailed reschedules the probe after a failed one.
+func (b *sendingBlock) probeFailed(err error) {
+	st := b.Get()
+	st.Probes++
+	delay := sendingProbeFirst << st.Probes
+	if delay <= 0 || delay > sendingProbeMax {
+		delay = sendingProbeMax
+	}
+	st.NextProbe = time.Now().Add(delay)
+	b.save(st)
+	metrics.Inc("menubot_sending_probes_total", "Probe sends while sending was disabled, by result.", "result", "failed")
+	log.Printf("WARNING: sending is still disabled, probe %d failed (%v); next probe at %s", st.Probes, err, st.NextProbe.Format(time.RFC3339))
+}
+
+// clear enables sending again after a probe went through.
+func (b *sendingBlock) clear() time.Duration {
+	st := b.Get()
+	b.save(sendingBlockState{})
+	metrics.Inc("menubot_sending_probes_total", "Probe sends while sending was disabled, by result.", "result", "sent")
+	log.Printf("Sending resumed: a probe to the host number went through after %s disabled (%s)", time.Since(st.Since).Round(time.Minute), st.Cause)
+	b.alert(eventSendingResumed, st)
+	return time.Since(st.Since)
+}
+
+// alert emits the change as an event and posts it to ALERT_WEBHOOK_URL,
+// in the background.
+func (b *sendingBlock) alert(alert string, st sendingBlockState) {
+	e := b.event(alert, st)
+	b.events.Emit(alert, e)
+	url := cfg().AlertWebhookURL
+	if url == "" {
+		return
+	}
+	go func() {
+		body, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("Alert webhook: encoding %s failed: %v", alert, err)
+			return
+		}
+		resp, err := b.client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Alert webhook: posting %s failed: %v", alert, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Alert webhook: posting %s got %s", alert, resp.Status)
+		}
+	}()
+}
+
+// Watch trips the block on the connection events that mean a ban. A
+// 401 logout is the device being unlinked, which isn't one.
+func (b *sendingBlock) Watch(c waClient) {
+	c.AddEventHandler(func(evt interface{}) {
+		switch v := evt.(type) {
+		case *events.TemporaryBan:
+			var until time.Time
+			if v.Expire > 0 {
+				until = time.Now().Add(v.Expire)
+			}
+			b.Trip(connTemporaryBan, v.String(), until)
+		case *events.LoggedOut:
+			if v.Reason == events.ConnectFailureMainDeviceGone || v.Reason == events.ConnectFailureUnknownLogout {
+				b.Trip(connLoggedOut, v.Reason.String(), time.Time{})
+			}
+		}
+	})
+}
+
+// isBlockSendError reports whether a send was refused because of the
+// number rather than the message or recipient.
+func isBlockSendError(err error) bool {
+	code, ok := serverErrorCode(err)
+	return ok && code == http.StatusForbidden
+}
+
+// probeJobSchedule has the leader probe when the block says, and not at
+// all while sending isn't disabled.
+func probeJobSchedule(block *sendingBlock) jobSchedule {
+	return func(time.Time) time.Time {
+		if st := block.Get(); st.Active {
+			return st.NextProbe
+		}
+		return time.Time{}
+	}
+}
+
+func probeSending(cc *commandContext) {
+	block := cc.sender.block
+	if cc.client.ID() == nil {
+		block.probeFailed(errors.New("no WhatsApp session, pair the device again and restart"))
+		return
+	}
+	if !cc.client.IsConnected() {
+		if err := cc.client.Connect(); err != nil && !errors.Is(err, whatsmeow.ErrAlreadyConnected) {
+			block.probeFailed(fmt.Errorf("reconnecting: %w", err))
+			return
+		}
+		deadline := time.Now().Add(sendingProbeConnectWait)
+		for !cc.client.IsLoggedIn() && time.Now().Before(deadline) {
+			time.Sleep(time.Second)
+		}
+	}
+	jid, err := resolveJID(cc.envVars.HostNumber)
+	if err == nil {
+		err = cc.sender.probe(jid)
+	}
+	if err != nil {
+		block.probeFailed(err)
+		return
+	}
+	disabled := block.clear()
+	cc.sendBulk(bulkMessage{
+		Recipient: cc.envVars.AdminNumber,
+		Text:      fmt.Sprintf("WhatsApp was blocking this number, so nothing was sent for %s. Sending has resumed and held messages are going out now.", disabled.Round(time.Minute)),
+		Kind:      bulkAdmin,
+	})
+}
+
+// probe sends the probe message past the block.
+func (s *messageSender) probe(to types.JID) error {
+	if !s.client.IsLoggedIn() {
+		return whatsmeow.ErrNotLoggedIn
+	}
+	s.limiter.Wait(priorityNotify)
+	_, err := s.client.SendMessage(context.Background(), to,
+		&waProto.Message{Conversation: proto.String("Sending check: WhatsApp is accepting messages from this number again.")})
+	return err
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// A shadow database runs everything on one connection inside a transaction
+// that is rolled back at the end, so code written against *sql.DB, ours and
+// MenuBotLib's alike, runs for real without keeping anything. Transactions
+// begun on it become savepoints. Every statement also gets a savepoint of
+// its own: in PostgreSQL one failed statement aborts the transaction, and
+// with it everything after, where on a pool it only fails itself. Results
+// are read in full before they are returned, as the one connection can't
+// start a statement while another's rows are still open, and code that
+// queries while iterating rows works on a pool.
+
+type shadowDB struct {
+	// DB is what to hand the code being run.
+	DB   *sql.DB
+	conn *sql.Conn
+	// mu keeps each statement and its savepoint together.
+	mu         sync.Mutex
+	savepoints int
+}
+
+func openShadowDB(ctx context.Context, db *sql.DB) (*shadowDB, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.ExecContext(ctx, `BEGIN`); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("starting shadow transaction: %w", err)
+	}
+	s := &shadowDB{conn: conn}
+	s.DB = sql.OpenDB(shadowConnector{s})
+	return s, nil
+}
+
+// Close rolls back everything done through s. A connection that can't be
+// rolled back is dropped rather than returned to the pool mid-transaction.
+func (s *shadowDB) Close() {
+	s.DB.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.conn.ExecContext(context.Background(), `ROLLBACK`); err != nil {
+		log.Printf("Rolling back shadow transaction failed, dropping its connection: %v", err)
+		s.conn.Raw(func(any) error { return driver.ErrBadConn })
+	}
+	s.conn.Close()
+}
+
+// guard runs f under a savepoint, going back to it if f fails. The caller
+// holds mu.
+func (s *shadowDB) guard(ctx context.Context, f func() error) error {
+	if _, err := s.conn.ExecContext(ctx, `SAVEPOINT shadow_stmt`); err != nil {
+		return err
+	}
+	if err := f(); err != nil {
+		if _, rbErr := s.conn.ExecContext(ctx, `ROLLBACK TO SAVEPOINT shadow_stmt`); rbErr != nil {
+			return errors.Join(err, rbErr)
+		}
+		s.conn.ExecContext(ctx, `RELEASE SAVEPOINT shadow_stmt`)
+		return err
+	}
+	_, err := s.conn.ExecContext(ctx, `RELEASE SAVEPOINT shadow_stmt`)
+	return err
+}
+
+func (s *shadowDB) exec(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res sql.Result
+	err := s.guard(ctx, func() (err error) {
+		res, err = s.conn.ExecContext(ctx, query, shadowArgs(args)...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *shadowDB) query(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var rows *shadowRows
+	err := s.guard(ctx, func() error {
+		r, err := s.conn.QueryContext(ctx, query, shadowArgs(args)...)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		rows, err = readShadowRows(r)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// run executes a statement of the shadow's own, outside any guard.
+func (s *shadowDB) run(query string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.conn.ExecContext(context.Background(), query)
+	return err
+}
+
+func (s *shadowDB) begin() (driver.Tx, error) {
+	s.mu.Lock()
+	s.savepoints++
+	tx := shadowTx{s: s, name: fmt.Sprintf("shadow_tx_%d", s.savepoints)}
+	s.mu.Unlock()
+	if err := s.run(`SAVEPOINT ` + tx.name); err != nil {
+		return nil, err
+	}
+	return tx, nil
+}
+
+func shadowArgs(args []driver.NamedValue) []any {
+	values := make([]any, len(args))
+	for i, a := range args {
+		values[i] = a.Value
+		if a.Name != "" {
+			values[i] = sql.Named(a.Name, a.Value)
+		}
+	}
+	return values
+}
+
+type shadowConnector struct{ s *shadowDB }
+
+func (c shadowConnector) Connect(context.Context) (driver.Conn, error) { return shadowConn{c.s}, nil }
+func (c shadowConnector) Driver() driver.Driver                        { return shadowDriver{} }
+
+type shadowDriver struct{}
+
+func (shadowDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("shadow connections only come from openShadowDB")
+}
+
+// shadowConn is what database/sql sees; any number of them share the one
+// connection.
+type shadowConn struct{ s *shadowDB }
+
+func (c shadowConn) Prepare(query string) (driver.Stmt, error) {
+	return shadowStmt{s: c.s, query: query}, nil
+}
+func (c shadowConn) Close() error              { return nil }
+func (c shadowConn) Begin() (driver.Tx, error) { return c.s.begin() }
+
+func (c shadowConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return c.s.begin()
+}
+
+// CheckNamedValue passes every argument through as it is; the real
+// connection converts them.
+func (c shadowConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func (c shadowConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.s.exec(ctx, query, args)
+}
+
+func (c shadowConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.s.query(ctx, query, args)
+}
+
+type shadowTx struct {
+	s    *shadowDB
+	name string
+}
+
+func (t shadowTx) Commit() error { return t.s.run(`RELEASE SAVEPOINT ` + t.name) }
+
+func (t shadowTx) Rollback() error {
+	if err := t.s.run(`ROLLBACK TO SAVEPOINT ` + t.name); err != nil {
+		return err
+	}
+	return t.s.run(`RELEASE SAVEPOINT ` + t.name)
+}
+
+type shadowStmt struct {
+	s     *shadowDB
+	query string
+}
+
+func (st shadowStmt) Close() error  { return nil }
+func (st shadowStmt) NumInput() int { return -1 }
+
+func (st shadowStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return st.s.exec(context.Background(), st.query, namedValues(args))
+}
+
+func (st shadowStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return st.s.query(context.Background(), st.query, namedValues(args))
+}
+
+func (st shadowStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return st.s.exec(ctx, st.query, args)
+}
+
+func (st shadowStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return st.s.query(ctx, st.query, args)
+}
+
+func namedValues(args []driver.Value) []driver.NamedValue {
+	named := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		named[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return named
+}
+
+// shadowRows is a result read in full.
+type shadowRows struct {
+	columns []string
+	values  [][]any
+}
+
+func readShadowRows(r *sql.Rows) (*shadowRows, error) {
+	columns, err := r.Columns()
+	if err != nil {
+		return nil, err
+	}
+	rows := &shadowRows{columns: columns}
+	for r.Next() {
+		row := make([]any, len(columns))
+		dest := make([]any, len(columns))
+		for i := range row {
+			dest[i] = &row[i]
+		}
+		if err := r.Scan(dest...); err != nil {
+			return nil, err
+		}
+		rows.values = append(rows.values, row)
+	}
+	return rows, r.Err()
+}
+
+func (r *shadowRows) Columns() []string { return r.columns }
+func (r *shadowRows) Close() error      { return nil }
+
+func (r *shadowRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	for i, v := range r.values[0] {
+		dest[i] = v
+	}
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// maxSpecialDiscount is the largest percentage a special may take off.
+	maxSpecialDiscount = 90
+	// specialStartGrace lets a special created to start "now" through
+	// despite clock differences between the client and the server.
+	specialStartGrace    = time.Minute
+	specialAnnounceCheck = time.Minute
+)
+
+// special is a percentage off an item, or every item in a category, for a
+// set window. While it runs the discounted price is the catalogue price as
+// far as MenuBotLib is concerned, so carts, checkout and the quoted prices
+// recorded on orders all use it, much like a scheduled price change.
+type special struct {
+	ID          int64      `json:"id"`
+	ItemID      int        `json:"item_id,omitempty"`
+	Category    string     `json:"category,omitempty"`
+	DiscountPct float64    `json:"discount_pct"`
+	StartsAt    time.Time  `json:"starts_at"`
+	EndsAt      time.Time  `json:"ends_at"`
+	Broadcast   bool       `json:"broadcast"`
+	Message     string     `json:"message,omitempty"`
+	AnnouncedAt *time.Time `json:"announced_at,omitempty"`
+}
+
+// activeSpecial is a running special as applied to one item.
+type activeSpecial struct {
+	SpecialID   int64
+	DiscountPct float64
+	EndsAt      time.Time
+	WasPrice    float64
+}
+
+const specialColumns = `id, COALESCE(item_id, 0), category, discount_pct, starts_at, ends_at, broadcast, message, announced_at`
+
+func scanSpecial(rows *sql.Rows) (special, error) {
+	var s special
+	var announced sql.NullTime
+	err := rows.Scan(&s.ID, &s.ItemID, &s.Category, &s.DiscountPct, &s.StartsAt, &s.EndsAt, &s.Broadcast, &s.Message, &announced)
+	if announced.Valid {
+		s.AnnouncedAt = &announced.Time
+	}
+	return s, err
+}
+
+// targets returns the IDs of the items the special applies to.
+func (s special) targets(vp versionedPricelist) []int {
+	if s.Category != "" {
+		return vp.InCategory(s.Category)
+	}
+	return []int{s.ItemID}
+}
+
+func discounted(price, pct float64) float64 {
+	return math.Round(price*(100-pct)) / 100
+}
+
+// applySpecials discounts the items on special at now, keeping the larger
+// discount where two overlap. It also returns when a special next starts
+// or ends, zero if none will.
+func applySpecials(db *sql.DB, vp versionedPricelist, now time.Time) ([]mb.CatalogueItem, map[int]activeSpecial, time.Time, error) {
+	rows, err := db.Query(`SELECT `+specialColumns+` FROM specials WHERE catalogue_id = $1 AND ends_at > $2`, catalogueID, now)
+	if err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("loading specials: %w", err)
+	}
+	defer rows.Close()
+	var next time.Time
+	running := map[int]special{}
+	for rows.Next() {
+		s, err := scanSpecial(rows)
+		if err != nil {
+			return nil, nil, time.Time{}, fmt.Errorf("loading specials: %w", err)
+		}
+		boundary := s.EndsAt
+		if s.StartsAt.After(now) {
+			boundary = s.StartsAt
+		}
+		if next.IsZero() || boundary.Before(next) {
+			next = boundary
+		}
+		if s.StartsAt.After(now) {
+			continue
+		}
+		for _, id := range s.targets(vp) {
+			if cur, ok := running[id]; !ok || s.DiscountPct > cur.DiscountPct {
+				running[id] = s
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, time.Time{}, fmt.Errorf("loading specials: %w", err)
+	}
+
+	active := make(map[int]activeSpecial, len(running))
+	items := make([]mb.CatalogueItem, len(vp.Items))
+	for i, item := range vp.Items {
+		items[i] = item
+		if s, ok := running[ctlgItemID(item)]; ok {
+			active[ctlgItemID(item)] = activeSpecial{SpecialID: s.ID, DiscountPct: s.DiscountPct, EndsAt: s.EndsAt, WasPrice: ctlgItemPrice(item)}
+			items[i] = ctlgItemWithPrice(item, discounted(ctlgItemPrice(item), s.DiscountPct))
+		}
+	}
+	return items, active, next, nil
+}
+
+// specialEnd renders when a special ends for customers: the time if it's
+// today, otherwise the day as well.
+func specialEnd(end, now time.Time) string {
+	loc := cfg().BusinessHours.Location
+	end, now = end.In(loc), now.In(loc)
+	if end.Format(dateLayout) == now.Format(dateLayout) {
+		return end.Format("15:04")
+	}
+	return end.Format("Mon 2 Jan 15:04")
+}
+
+// hint is how the menu shows a running special, e.g.
+// "20% off, was R50.00, until 14:00".
+func (a activeSpecial) hint(now time.Time) string {
+	return fmt.Sprintf("%s%% off, was R%.2f, until %s",
+		strconv.FormatFloat(a.DiscountPct, 'f', -1, 64), a.WasPrice, specialEnd(a.EndsAt, now))
+}
+
+func (s special) announcement(vp versionedPricelist, now time.Time) string {
+	if s.Message != "" {
+		return s.Message
+	}
+	pct := strconv.FormatFloat(s.DiscountPct, 'f', -1, 64)
+	if s.Category != "" {
+		return fmt.Sprintf("Flash special: %s%% off all %s until %s!", pct, s.Category, specialEnd(s.EndsAt, now))
+	}
+	return fmt.Sprintf("Flash special: %s%% off %s until %s! Reply \"%s\" to order.",
+		pct, vp.itemName(s.ItemID), specialEnd(s.EndsAt, now), itemRef(s.ItemID))
+}
+
+// announceDueSpecials broadcasts the specials with the broadcast flag that
+// have started and not been announced yet. Marking them announced first
+// means a special is never broadcast twice, even if sending fails.
+func announceDueSpecials(cc *commandContext, now time.Time) error {
+	rows, err := cc.db.Query(`UPDATE specials SET announced_at = $2
+		WHERE catalogue_id = $1 AND broadcast AND announced_at IS NULL AND starts_at <= $2 AND ends_at > $2
+		RETURNING `+specialColumns, catalogueID, now)
+	if err != nil {
+		return err
+	}
+	var due []special
+	for rows.Next() {
+		s, err := scanSpecial(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		due = append(due, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(due) == 0 {
+		return nil
+	}
+	recipients, err := subscribers(cc.db)
+	if err != nil {
+		return err
+	}
+	vp := cc.prclist.Snapshot()
+	for _, s := range due {
+		log.Printf("Announcing special %d to %d subscribers", s.ID, len(recipients))
+		broadcast(cc, recipients, s.announcement(vp, now), &s.EndsAt)
+	}
+	return nil
+}
+
+func listSpecials(db *sql.DB, includePast bool) ([]special, error) {
+	query := `SELECT ` + specialColumns + ` FROM specials WHERE catalogue_id = $1`
+	if !includePast {
+		query += ` AND ends_at > now()`
+	}
+	rows, err := db.Query(query+` ORDER BY starts_at, id`, catalogueID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	specials := []special{}
+	for rows.Next() {
+		s, err := scanSpecial(rows)
+		if err != nil {
+			return nil, err
+		}
+		specials = append(specials, s)
+	}
+	return specials, rows.Err()
+}
+
+func validateSpecial(s special, vp versionedPricelist, now time.Time) error {
+	switch {
+	case (s.ItemID == 0) == (s.Category == ""):
+		return fmt.Errorf("set either item_id or category")
+	case s.ItemID != 0 && (vp.Deleted(s.ItemID) || !itemExists(vp, s.ItemID)):
+		return fmt.Errorf("no catalogue item %d", s.ItemID)
+	case s.Category != "" && len(vp.InCategory(s.Category)) == 0:
+		return fmt.Errorf("no items in category %q", s.Category)
+	case s.DiscountPct <= 0 || s.DiscountPct > maxSpecialDiscount:
+		return fmt.Errorf("discount_pct must be more than 0 and at most %d", maxSpecialDiscount)
+	case s.StartsAt.Before(now.Add(-specialStartGrace)):
+		return fmt.Errorf("starts_at is in the past")
+	case !s.EndsAt.After(s.StartsAt):
+		return fmt.Errorf("ends_at must be after starts_at")
+	}
+	return nil
+}
+
+func itemExists(vp versionedPricelist, id int) bool {
+	_, ok := vp.Item(id)
+	return ok
+}
+
+// ListSpecialsHandler serves the running and upcoming specials, or all of
+// them with ?all=true.
+func ListSpecialsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		all, _ := strconv.ParseBool(r.URL.Query().Get("all"))
+		specials, err := listSpecials(db, all)
+		if err != nil {
+			log.Printf("Listing specials failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "listing specials failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, specials)
+	}
+}
+
+// CreateSpecialHandler schedules a special. Without starts_at it starts
+// straight away.
+func CreateSpecialHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var s special
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		now := time.Now()
+		if s.StartsAt.IsZero() {
+			s.StartsAt = now
+		}
+		s.Category = normalizeCategory(s.Category)
+		s.Message = strings.TrimSpace(s.Message)
+		s.AnnouncedAt = nil
+		if err := validateSpecial(s, prclist.Snapshot(), now); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var itemID sql.NullInt64
+		if s.ItemID != 0 {
+			itemID = sql.NullInt64{Int64: int64(s.ItemID), Valid: true}
+		}
+		err := db.QueryRow(`INSERT INTO specials (catalogue_id, item_id, category, discount_pct, starts_at, ends_at, broadcast, message)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+			catalogueID, itemID, s.Category, s.DiscountPct, s.StartsAt, s.EndsAt, s.Broadcast, s.Message).Scan(&s.ID)
+		if err != nil {
+			log.Printf("Saving special failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "saving special failed")
+			return
+		}
+		// Rebuild so the refresher knows when to wake, and so a special
+		// starting now applies straight away.
+		if _, err := rebuildPricelist(db, prclist); err != nil {
+			log.Printf("Rebuilding pricelist after creating special %d failed: %v", s.ID, err)
+		}
+		writeJSON(w, http.StatusCreated, s)
+	}
+}
+
+// DeleteSpecialHandler withdraws a special that hasn't started and ends a
+// running one now. Finished specials are history and stay.
+func DeleteSpecialHandler(db *sql.DB, prclist *pricelistHolder) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "specialID"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid special id")
+			return
+		}
+		res, err := db.Exec(`DELETE FROM specials WHERE id = $1 AND starts_at > now()`, id)
+		if err == nil {
+			if n, _ := res.RowsAffected(); n == 0 {
+				res, err = db.Exec(`UPDATE specials SET ends_at = now() WHERE id = $1 AND ends_at > now()`, id)
+			}
+		}
+		if err != nil {
+			log.Printf("Withdrawing special %d failed: %v", id, err)
+			writeJSONError(w, http.StatusInternalServerError, "withdrawing special failed")
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeJSONError(w, http.StatusNotFound, "no upcoming or running special with that id")
+			return
+		}
+		respondPricelistChanged(w, db, prclist)
+	}
+}
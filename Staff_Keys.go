@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// staffKeyPrefixLen of a key is kept in clear so staff can tell their keys
+// apart in the list; the rest is only ever shown once, when it's created.
+const staffKeyPrefixLen = 8
+
+type staffKey struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Role       string     `json:"role"`
+	Prefix     string     `json:"prefix"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	// Key is only set in the response to creating it.
+	Key string `json:"key,omitempty"`
+}
+
+type staffKeyRequest struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+func listStaffKeys(db *sql.DB) ([]staffKey, error) {
+	rows, err := db.Query(`SELECT id, name, role, key_prefix, created_at, last_used_at, revoked_at FROM staff_keys ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []staffKey{}
+	for rows.Next() {
+		var k staffKey
+		var used, revoked sql.NullTime
+		if err := rows.Scan(&k.ID, &k.Name, &k.Role, &k.Prefix, &k.CreatedAt, &used, &revoked); err != nil {
+			return nil, err
+		}
+		if used.Valid {
+			k.LastUsedAt = &used.Time
+		}
+		if revoked.Valid {
+			k.RevokedAt = &revoked.Time
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func ListStaffKeysHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		keys, err := listStaffKeys(db)
+		if err != nil {
+			log.Printf("Listing staff keys failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "listing staff keys failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, keys)
+	}
+}
+
+// CreateStaffKeyHandler issues a key for {"name": ..., "role": ...}.
+func CreateStaffKeyHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req staffKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+			return
+		}
+		req.Name, req.Role = strings.TrimSpace(req.Name), strings.ToLower(strings.TrimSpace(req.Role))
+		if req.Name == "" || req.Name == adminKeyName {
+			writeJSONError(w, http.StatusBadRequest, "name is required")
+			return
+		}
+		if _, ok := roleRank[req.Role]; !ok {
+			writeJSONError(w, http.StatusBadRequest, "role must be admin, manager, kitchen or driver")
+			return
+		}
+		token, err := newSessionToken()
+		if err != nil {
+			log.Printf("Generating staff key failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "generating key failed")
+			return
+		}
+		k := staffKey{Name: req.Name, Role: req.Role, Prefix: token[:staffKeyPrefixLen], Key: token}
+		err = db.QueryRow(`INSERT INTO staff_keys (name, role, key_prefix, key_hash) VALUES ($1, $2, $3, $4)
+			RETURNING id, created_at`, k.Name, k.Role, k.Prefix, hashStaffKey(token)).Scan(&k.ID, &k.CreatedAt)
+		if err != nil {
+			log.Printf("Saving staff key failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "saving key failed")
+			return
+		}
+		log.Printf("%s created %s key %d for %s", staffFromContext(r.Context()).Name, k.Role, k.ID, k.Name)
+		writeJSON(w, http.StatusCreated, k)
+	}
+}
+
+// RevokeStaffKeyHandler revokes a key for good; the row stays, so the
+// audit log can still say whose it was.
+func RevokeStaffKeyHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(chi.URLParam(r, "keyID"), 10, 64)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid key id")
+			return
+		}
+		res, err := db.Exec(`UPDATE staff_keys SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL`, id)
+		if err != nil {
+			log.Printf("Revoking staff key %d failed: %v", id, err)
+			writeJSONError(w, http.StatusInternalServerError, "revoking key failed")
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			writeJSONError(w, http.StatusNotFound, "no active key with that id")
+			return
+		}
+		log.Printf("%s revoked staff key %d", staffFromContext(r.Context()).Name, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// auditMutations records who made each request that can change something,
+// and how it ended, once it has been handled. Reads aren't recorded.
+func auditMutations(db *sql.DB) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			next.ServeHTTP(ww, r)
+			status := ww.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			route := r.URL.Path
+			if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+				route = rctx.RoutePattern()
+			}
+			staff := staffFromContext(r.Context())
+			var keyID sql.NullInt64
+			if staff.KeyID != 0 {
+				keyID = sql.NullInt64{Int64: staff.KeyID, Valid: true}
+			}
+			_, err := db.Exec(`INSERT INTO staff_audit (key_id, staff_name, role, method, route, path, status, remote_ip, request_id)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+				keyID, staff.Name, staff.Role, r.Method, route, r.URL.Path, status, remoteIP(r), middleware.GetReqID(r.Context()))
+			if err != nil {
+				log.Printf("Recording audit of %s %s by %s failed: %v", r.Method, r.URL.Path, staff.Name, err)
+			}
+		})
+	}
+}
+
+type staffAuditEntry struct {
+	ID     int64     `json:"id"`
+	KeyID  *int64    `json:"key_id,omitempty"`
+	Name   string    `json:"name"`
+	Role   string    `json:"role"`
+	Method string    `json:"method"`
+	Route  string    `json:"route"`
+	Path   string    `json:"path"`
+	Status int       `json:"status"`
+	IP     string    `json:"remote_ip"`
+	At     time.Time `json:"at"`
+}
+
+// StaffAuditHandler serves GET /api/staff/audit?from=&to=, newest first.
+func StaffAuditHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		from, err := parseReportTime(r.URL.Query().Get("from"), now.AddDate(0, 0, -30))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "from: "+err.Error())
+			return
+		}
+		to, err := parseReportTime(r.URL.Query().Get("to"), now)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "to: "+err.Error())
+			return
+		}
+		rows, err := db.Query(`SELECT id, key_id, staff_name, role, method, route, path, status, remote_ip, at
+			FROM staff_audit WHERE at >= $1 AND at < $2 ORDER BY id DESC LIMIT 1000`, from, to)
+		if err != nil {
+			log.Printf("Reading staff audit failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "reading audit failed")
+			return
+		}
+		defer rows.Close()
+		entries := []staffAuditEntry{}
+		for rows.Next() {
+			var e staffAuditEntry
+			var keyID sql.NullInt64
+			if err := rows.Scan(&e.ID, &keyID, &e.Name, &e.Role, &e.Method, &e.Route, &e.Path, &e.Status, &e.IP, &e.At); err != nil {
+				log.Printf("Reading staff audit failed: %v", err)
+				writeJSONError(w, http.StatusInternalServerError, "reading audit failed")
+				return
+			}
+			if keyID.Valid {
+				e.KeyID = &keyID.Int64
+			}
+			entries = append(entries, e)
+		}
+		if err := rows.Err(); err != nil {
+			log.Printf("Reading staff audit failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "reading audit failed")
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	}
+}
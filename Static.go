@@ -0,0 +1,62 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+const staticBaseURL = "/static"
+
+//go:embed static
+var embeddedStatic embed.FS
+
+// overlayFS serves files from dir when present and from the embedded
+// assets otherwise, so a deployment can swap in its own logo or CSS next
+// to the templates without a rebuild.
+type overlayFS struct {
+	disk     fs.FS
+	embedded fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	if o.disk != nil {
+		f, err := o.disk.Open(name)
+		if err == nil {
+			return f, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return o.embedded.Open(name)
+}
+
+func newStaticFS(pwd string) fs.FS {
+	embedded, err := fs.Sub(embeddedStatic, "static")
+	if err != nil {
+		panic(err) // the embed directive guarantees the directory exists
+	}
+	o := overlayFS{embedded: embedded}
+	if dir := filepath.Join(pwd, "static"); dirExists(dir) {
+		o.disk = os.DirFS(dir)
+	}
+	return o
+}
+
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// StaticHandler serves the page assets with a day of browser caching.
+func StaticHandler(files fs.FS) http.Handler {
+	fileServer := http.StripPrefix(staticBaseURL, http.FileServer(http.FS(files)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		fileServer.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/JeremyJalpha/MenuBot_WebAPI/httpapi"
+)
+
+func TestStaticHandler(t *testing.T) {
+	pwd := t.TempDir()
+	if err := os.Mkdir(filepath.Join(pwd, "static"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pwd, "static", "logo.svg"), []byte("<svg>our own</svg>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	embedded, err := embeddedStatic.ReadFile("static/style.css")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		pwd        string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"embedded stylesheet", t.TempDir(), "/static/style.css", http.StatusOK, string(embedded)},
+		{"embedded logo", t.TempDir(), "/static/logo.svg", http.StatusOK, "<svg"},
+		{"disk overrides the logo", pwd, "/static/logo.svg", http.StatusOK, "<svg>our own</svg>"},
+		{"embedded stylesheet behind an override", pwd, "/static/style.css", http.StatusOK, string(embedded)},
+		{"missing file", pwd, "/static/nope.css", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			StaticHandler(newStaticFS(tt.pwd)).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Cache-Control"); got != "public, max-age=86400" {
+				t.Errorf("Cache-Control = %q", got)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestPaymentPagesShowBranding(t *testing.T) {
+	partial := filepath.Join("templates", "customerOrder.HTML")
+	parse := func(base string) *template.Template {
+		tpl, err := template.ParseFiles(filepath.Join("templates", base+".html"), partial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tpl
+	}
+	b := branding{ShopName: "Corner Cafe", LogoURL: "/static/logo.svg", SupportNumber: "082 123 4567"}
+	pages := templatePages{
+		templates: map[string]*template.Template{httpapi.PageReturn: parse(pymntRtrnBase), httpapi.PageCancel: parse(pymntCnclBase)},
+		branding:  b,
+	}
+	order := &customerOrderData{OrderID: "42", OrderRef: "AB12", OrderItems: []string{"1 x Toast"}, OrderTotal: "R35.00"}
+	tests := []struct {
+		name  string
+		page  string
+		order *customerOrderData
+		want  []string
+	}{
+		{"return", httpapi.PageReturn, order, []string{"AB12", "Toast"}},
+		{"return without an order", httpapi.PageReturn, nil, nil},
+		{"cancel", httpapi.PageCancel, order, []string{"AB12"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			pages.Render(rec, httptest.NewRequest(http.MethodGet, "/", nil), tt.page, tt.order)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, body %s", rec.Code, rec.Body)
+			}
+			body := rec.Body.String()
+			want := append([]string{`href="/static/style.css"`, `src="/static/logo.svg"`, "Corner Cafe", "082 123 4567"}, tt.want...)
+			for _, s := range want {
+				if !strings.Contains(body, s) {
+					t.Errorf("the page doesn't contain %q", s)
+				}
+			}
+		})
+	}
+}
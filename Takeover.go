@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTakeoverMinutes = 30
+	takeoverNotice         = "A human will assist you now."
+)
+
+// Transcript directions: what the customer sent, and what the operator
+// sent them from the shop's phone.
+const (
+	transcriptInbound  = "in"
+	transcriptOperator = "operator"
+)
+
+// takeovers silences the bot for customers an operator is chatting with.
+// They are persisted so a restart mid-handover doesn't start replying
+// again, and expire on their own.
+type takeovers struct {
+	db     *sql.DB
+	mu     sync.Mutex
+	active map[string]time.Time // cell number to end of takeover
+}
+
+type activeTakeover struct {
+	CellNumber string
+	Until      time.Time
+}
+
+func loadTakeovers(db *sql.DB) (*takeovers, error) {
+	t := &takeovers{db: db, active: map[string]time.Time{}}
+	rows, err := db.Query(`SELECT cell_number, until FROM takeovers WHERE until > now()`)
+	if err != nil {
+		return nil, fmt.Errorf("reading takeovers: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cell string
+		var until time.Time
+		if err := rows.Scan(&cell, &until); err != nil {
+			return nil, fmt.Errorf("reading takeovers: %w", err)
+		}
+		t.active[cell] = until
+	}
+	return t, rows.Err()
+}
+
+// Active reports whether the bot should stay quiet towards cell at now.
+func (t *takeovers) Active(cell string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.active[cell]
+	if ok && !now.Before(until) {
+		delete(t.active, cell)
+		return false
+	}
+	return ok
+}
+
+func (t *takeovers) Start(cell string, until time.Time) error {
+	_, err := t.db.Exec(`INSERT INTO takeovers (cell_number, until) VALUES ($1, $2)
+		ON CONFLICT (cell_number) DO UPDATE SET until = EXCLUDED.until, started_at = now()`, cell, until)
+	if err != nil {
+		return fmt.Errorf("saving takeover: %w", err)
+	}
+	t.mu.Lock()
+	t.active[cell] = until
+	t.mu.Unlock()
+	return nil
+}
+
+// Release ends a takeover early and reports whether one was active.
+func (t *takeovers) Release(cell string) (bool, error) {
+	if _, err := t.db.Exec(`DELETE FROM takeovers WHERE cell_number = $1`, cell); err != nil {
+		return false, fmt.Errorf("ending takeover: %w", err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	until, ok := t.active[cell]
+	delete(t.active, cell)
+	return ok && time.Now().Before(until), nil
+}
+
+// List returns the active takeovers, ending soonest first.
+func (t *takeovers) List(now time.Time) []activeTakeover {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var list []activeTakeover
+	for cell, until := range t.active {
+		if now.Before(until) {
+			list = append(list, activeTakeover{CellNumber: cell, Until: until})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Until.Before(list[j].Until) })
+	return list
+}
+
+// Status is the takeover line of the admin status command, "" when none
+// are active.
+func (t *takeovers) Status(now time.Time) string {
+	list := t.List(now)
+	if len(list) == 0 {
+		return ""
+	}
+	parts := make([]string, len(list))
+	for i, a := range list {
+		parts[i] = fmt.Sprintf("%s until %s", a.CellNumber, a.Until.In(cfg().BusinessHours.Location).Format("15:04"))
+	}
+	return "Takeovers: " + strings.Join(parts, ", ")
+}
+
+func recordTranscript(db *sql.DB, cell, direction, messageID, body string) {
+	sealed, err := sealField(fieldMessageBody, body)
+	if err == nil {
+		_, err = db.Exec(`INSERT INTO takeover_transcript (cell_number, direction, message_id, body) VALUES ($1, $2, $3, $4)`,
+			cell, direction, messageID, sealed)
+	}
+	if err != nil {
+		log.Printf("Recording takeover transcript for %s failed: %v", cell, err)
+	}
+}
+
+// adminTakeover handles "takeover <number> [minutes]".
+func adminTakeover(cc *commandContext, args []string) string {
+	if len(args) < 1 || len(args) > 2 {
+		return "Usage: takeover <number> [minutes]"
+	}
+	cell, err := canonicalNumber(args[0])
+	if err != nil {
+		return err.Error()
+	}
+	minutes := defaultTakeoverMinutes
+	if len(args) == 2 {
+		if minutes, err = strconv.Atoi(args[1]); err != nil || minutes <= 0 {
+			return "Minutes must be a positive number. Usage: takeover <number> [minutes]"
+		}
+	}
+	until := time.Now().Add(time.Duration(minutes) * time.Minute)
+	if err := cc.takeovers.Start(cell, until); err != nil {
+		log.Println(err)
+		return "Couldn't take over, saving the takeover failed."
+	}
+	cc.sender.Send(cell, takeoverNotice, priorityNotify)
+	return fmt.Sprintf("The bot won't reply to %s until %s. Send \"release %s\" to hand back sooner.",
+		cell, until.In(cfg().BusinessHours.Location).Format("15:04"), cell)
+}
+
+// adminRelease handles "release <number>".
+func adminRelease(cc *commandContext, args []string) string {
+	if len(args) != 1 {
+		return "Usage: release <number>"
+	}
+	cell, err := canonicalNumber(args[0])
+	if err != nil {
+		return err.Error()
+	}
+	active, err := cc.takeovers.Release(cell)
+	if err != nil {
+		log.Println(err)
+		return "Couldn't release, ending the takeover failed."
+	}
+	if !active {
+		return fmt.Sprintf("There was no takeover of %s.", cell)
+	}
+	return fmt.Sprintf("The bot is answering %s again.", cell)
+}
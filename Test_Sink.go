@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+// In test mode with TEST_SINK_NUMBER set, everything meant for a customer
+// goes to the sink instead, so a rehearsal on a copy of production data
+// can run the whole pipeline without messaging anyone real. Staff numbers
+// still get their own messages.
+
+// TestSink is where customer messages are redirected, or "" when they go
+// to the customer.
+func (rc *RuntimeConfig) TestSink() string {
+	if !rc.IsTest {
+		return ""
+	}
+	return rc.TestSinkNumber
+}
+
+func logTestSinkBanner(sink string) {
+	line := strings.Repeat("*", 72)
+	log.Printf("%s", line)
+	log.Printf("*** TEST MODE: every customer message is redirected to %s", sink)
+	log.Printf("*** No customer will receive anything until IS_TEST or TEST_SINK_NUMBER changes")
+	log.Printf("%s", line)
+}
+
+// redirectToSink rewrites m for the test sink, naming the intended
+// recipient at the top of the text or caption. The payload is copied, as
+// callers reuse some of theirs, e.g. cached item images.
+func (s *messageSender) redirectToSink(m outboundMessage, payload *waProto.Message) (outboundMessage, *waProto.Message) {
+	sink := cfg().TestSink()
+	if sink == "" || s.staff[m.To.User] {
+		return m, payload
+	}
+	to, err := resolveJID(sink)
+	if err != nil {
+		// TEST_SINK_NUMBER is validated on load, so this can't happen; if
+		// it does, not sending beats messaging the customer.
+		log.Printf("Test sink %q is invalid, dropping message for %s: %v", sink, m.To, err)
+		return outboundMessage{}, nil
+	}
+	prefix := fmt.Sprintf("[test, for %s]\n", m.To.User)
+	payload = proto.Clone(payload).(*waProto.Message)
+	switch {
+	case payload.ImageMessage != nil:
+		payload.ImageMessage.Caption = proto.String(prefix + payload.ImageMessage.GetCaption())
+	case payload.DocumentMessage != nil:
+		payload.DocumentMessage.Caption = proto.String(prefix + payload.DocumentMessage.GetCaption())
+	case payload.PollCreationMessage != nil:
+		payload.PollCreationMessage.Name = proto.String(prefix + payload.PollCreationMessage.GetName())
+	default:
+		payload.Conversation = proto.String(prefix + payload.GetConversation())
+	}
+	m.To, m.Text = to, prefix+m.Text
+	return m, payload
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	waLog "go.mau.fi/whatsmeow/util/log"
+)
+
+// slogWALogger routes whatsmeow's logging through slog, so its output gets
+// the same redaction and level handling as the rest of the app.
+type slogWALogger struct {
+	module   string
+	minLevel slog.Level
+}
+
+func newWALogger(module string, debug bool) waLog.Logger {
+	minLevel := slog.LevelInfo
+	if debug {
+		minLevel = slog.LevelDebug
+	}
+	return &slogWALogger{module: module, minLevel: minLevel}
+}
+
+func (l *slogWALogger) log(level slog.Level, msg string, args []interface{}) {
+	if level < l.minLevel {
+		return
+	}
+	slog.Default().Log(context.Background(), level, fmt.Sprintf(msg, args...), "module", l.module)
+}
+
+func (l *slogWALogger) Errorf(msg string, args ...interface{}) { l.log(slog.LevelError, msg, args) }
+func (l *slogWALogger) Warnf(msg string, args ...interface{})  { l.log(slog.LevelWarn, msg, args) }
+func (l *slogWALogger) Infof(msg string, args ...interface{})  { l.log(slog.LevelInfo, msg, args) }
+func (l *slogWALogger) Debugf(msg string, args ...interface{}) { l.log(slog.LevelDebug, msg, args) }
+
+func (l *slogWALogger) Sub(module string) waLog.Logger {
+	return &slogWALogger{module: l.module + "/" + module, minLevel: l.minLevel}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mau.fi/whatsmeow/types"
+)
+
+// whatsmeow's store only grows. The cleanup here removes contact and chat
+// settings rows of people we haven't exchanged a message with for months;
+// WhatsApp sends them again if they come back. Keys, sessions and pre-keys
+// are never touched, as the pairing needs them.
+
+var waStoreTables = []string{
+	"whatsmeow_device",
+	"whatsmeow_identity_keys",
+	"whatsmeow_pre_keys",
+	"whatsmeow_sessions",
+	"whatsmeow_sender_keys",
+	"whatsmeow_app_state_sync_keys",
+	"whatsmeow_app_state_version",
+	"whatsmeow_app_state_mutation_macs",
+	"whatsmeow_contacts",
+	"whatsmeow_chat_settings",
+	"whatsmeow_message_secrets",
+	"whatsmeow_privacy_tokens",
+}
+
+const waCleanupDefaultMonths = 6
+
+type waStoreCount struct {
+	Table string `json:"table"`
+	Rows  int64  `json:"rows"`
+	Error string `json:"error,omitempty"`
+}
+
+func waStoreCounts(waDB *sql.DB) []waStoreCount {
+	counts := make([]waStoreCount, len(waStoreTables))
+	for i, table := range waStoreTables {
+		counts[i].Table = table
+		if err := waDB.QueryRow(`SELECT count(*) FROM ` + table).Scan(&counts[i].Rows); err != nil {
+			counts[i].Error = err.Error()
+		}
+	}
+	return counts
+}
+
+type waCleanupReport struct {
+	Months       int       `json:"months"`
+	Cutoff       time.Time `json:"cutoff"`
+	Confirmed    bool      `json:"confirmed"`
+	Contacts     []string  `json:"contacts"`
+	ChatSettings []string  `json:"chat_settings"`
+}
+
+// activeCustomers returns every customer key and JID in our messages since
+// cutoff, in either direction.
+func activeCustomers(db *sql.DB, cutoff time.Time) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT cell_number FROM conversation_log WHERE received_at >= $1
+		UNION SELECT cell_number FROM takeover_transcript WHERE received_at >= $1
+		UNION SELECT recipient FROM outbound_messages WHERE server_time >= $1
+		UNION SELECT p.lid FROM customer_profiles p JOIN conversation_log c ON c.cell_number = p.cell_number
+			WHERE p.lid IS NOT NULL AND c.received_at >= $1`, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	active := map[string]bool{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		active[key] = true
+	}
+	return active, rows.Err()
+}
+
+// staleStoreJIDs lists the JIDs in column of table, for our device, that
+// belong to people rather than groups and that keep doesn't match.
+func staleStoreJIDs(waDB *sql.DB, table, column, ourJID string, keep func(types.JID) bool) ([]string, error) {
+	rows, err := waDB.Query(`SELECT `+column+` FROM `+table+` WHERE our_jid = $1 ORDER BY `+column, ourJID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stale := []string{}
+	for rows.Next() {
+		var raw string
+		if err := rows.Scan(&raw); err != nil {
+			return nil, err
+		}
+		jid, err := types.ParseJID(raw)
+		if err != nil || (jid.Server != types.DefaultUserServer && !isLID(jid)) || keep(jid) {
+			continue
+		}
+		stale = append(stale, raw)
+	}
+	return stale, rows.Err()
+}
+
+// cleanupWAStore finds the contact and chat settings rows of JIDs with no
+// messages for months, and deletes them only when confirmed.
+func cleanupWAStore(cc *commandContext, months int, confirmed bool) (waCleanupReport, error) {
+	report := waCleanupReport{Months: months, Cutoff: time.Now().AddDate(0, -months, 0).UTC(), Confirmed: confirmed}
+	if cc.client.ID() == nil {
+		return report, fmt.Errorf("WhatsApp is not paired")
+	}
+	ourJID := cc.client.ID().String()
+	active, err := activeCustomers(cc.db, report.Cutoff)
+	if err != nil {
+		return report, fmt.Errorf("reading recent activity: %w", err)
+	}
+	staff := map[string]bool{}
+	for _, number := range []string{cc.envVars.HostNumber, cc.envVars.AdminNumber, cc.envVars.KitchenNumber, cc.envVars.SupportNumber} {
+		staff[number] = true
+	}
+	keep := func(jid types.JID) bool {
+		return staff[jid.User] || active[jid.User] || active[jid.String()] || jid.User == cc.client.ID().User
+	}
+	if report.Contacts, err = staleStoreJIDs(cc.waDB, "whatsmeow_contacts", "their_jid", ourJID, keep); err != nil {
+		return report, fmt.Errorf("reading contacts: %w", err)
+	}
+	if report.ChatSettings, err = staleStoreJIDs(cc.waDB, "whatsmeow_chat_settings", "chat_jid", ourJID, keep); err != nil {
+		return report, fmt.Errorf("reading chat settings: %w", err)
+	}
+	if !confirmed {
+		log.Printf("WhatsApp store cleanup dry run: %d contacts and %d chat settings inactive for %d months",
+			len(report.Contacts), len(report.ChatSettings), months)
+		return report, nil
+	}
+
+	tx, err := cc.waDB.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback()
+	for _, jid := range report.Contacts {
+		if _, err := tx.Exec(`DELETE FROM whatsmeow_contacts WHERE our_jid = $1 AND their_jid = $2`, ourJID, jid); err != nil {
+			return report, fmt.Errorf("deleting contact %s: %w", jid, err)
+		}
+		log.Printf("WhatsApp store cleanup: removing contact %s", jid)
+	}
+	for _, jid := range report.ChatSettings {
+		if _, err := tx.Exec(`DELETE FROM whatsmeow_chat_settings WHERE our_jid = $1 AND chat_jid = $2`, ourJID, jid); err != nil {
+			return report, fmt.Errorf("deleting chat settings of %s: %w", jid, err)
+		}
+		log.Printf("WhatsApp store cleanup: removing chat settings of %s", jid)
+	}
+	if err := tx.Commit(); err != nil {
+		return report, err
+	}
+	log.Printf("WhatsApp store cleanup: removed %d contacts and %d chat settings inactive for %d months",
+		len(report.Contacts), len(report.ChatSettings), months)
+	return report, nil
+}
+
+// WAStoreHandler reports the row count of each whatsmeow table.
+func WAStoreHandler(waDB *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, waStoreCounts(waDB))
+	}
+}
+
+// WAStoreCleanupHandler serves POST /api/whatsapp/store/cleanup?months=N.
+// It only lists what it would remove unless confirm=true is given too.
+func WAStoreCleanupHandler(cc *commandContext) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		months := waCleanupDefaultMonths
+		if raw := r.URL.Query().Get("months"); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 1 {
+				writeJSONError(w, http.StatusBadRequest, "months must be a positive number")
+				return
+			}
+			months = n
+		}
+		confirmed, _ := strconv.ParseBool(r.URL.Query().Get("confirm"))
+		report, err := cleanupWAStore(cc, months, confirmed)
+		if err != nil {
+			log.Printf("WhatsApp store cleanup failed: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "cleanup failed: "+err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
+
+// adminWAStore handles "wastore" and "wastore cleanup <months> [confirm]".
+func adminWAStore(cc *commandContext, args []string) string {
+	if len(args) == 0 {
+		var b strings.Builder
+		b.WriteString("WhatsApp store rows:")
+		for _, c := range waStoreCounts(cc.waDB) {
+			if c.Error != "" {
+				fmt.Fprintf(&b, "\n%s: %s", c.Table, c.Error)
+			} else {
+				fmt.Fprintf(&b, "\n%s: %d", c.Table, c.Rows)
+			}
+		}
+		return b.String()
+	}
+	if strings.ToLower(args[0]) != "cleanup" || len(args) < 2 || len(args) > 3 {
+		return "Usage: wastore, or wastore cleanup <months> [confirm]"
+	}
+	months, err := strconv.Atoi(args[1])
+	if err != nil || months < 1 {
+		return "Months must be a positive number."
+	}
+	confirmed := len(args) == 3 && strings.ToLower(args[2]) == "confirm"
+	report, err := cleanupWAStore(cc, months, confirmed)
+	if err != nil {
+		log.Printf("WhatsApp store cleanup failed: %v", err)
+		return "Cleanup failed: " + err.Error()
+	}
+	if !confirmed {
+		return fmt.Sprintf("%d contacts and %d chat settings have had no messages for %d months. "+
+			"Send \"wastore cleanup %d confirm\" to remove them.", len(report.Contacts), len(report.ChatSettings), months, months)
+	}
+	return fmt.Sprintf("Removed %d contacts and %d chat settings with no messages for %d months.",
+		len(report.Contacts), len(report.ChatSettings), months)
+}
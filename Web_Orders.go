@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+	"github.com/lib/pq"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// The website creates orders in the order table itself, with source 'web',
+// and NOTIFYs order_created with the order ID. The leader LISTENs for it
+// and sends the customer their payment link straight away rather than
+// waiting for them to message. Every order the website may have created
+// while no one was listening is caught by a sweep whenever the listener
+// (re)connects, and every webOrderPoll while it can't. An order is claimed
+// in order_meta before its link is sent, so a second notification or a
+// sweep racing the listener sends nothing more. Numbers that aren't on
+// WhatsApp are flagged and the admin told, for someone to call. An order
+// with items that can no longer be ordered has them taken out and the
+// customer is asked to check out what is left, as a bot checkout would.
+
+const (
+	webOrderChannel   = "order_created"
+	webOrderSource    = "web"
+	webOrderPoll      = 30 * time.Second
+	webListenMinRetry = 10 * time.Second
+	webListenMaxRetry = time.Minute
+	// webFollowupNotOnWhatsApp marks an order whose customer can't be
+	// messaged.
+	webFollowupNotOnWhatsApp = "not_on_whatsapp"
+)
+
+// newCheckoutInfo is what MenuBotLib builds payment links with. The
+// callback URLs are filled in per payment link, see withHomebase.
+func newCheckoutInfo(env EnvVars) mb.CheckoutInfo {
+	return mb.CheckoutInfo{
+		MerchantId:     env.MerchantId,
+		MerchantKey:    env.MerchantKey,
+		Passphrase:     env.Passphrase,
+		HostURL:        env.PfHost,
+		ItemNamePrefix: env.ItemNamePrefix,
+	}
+}
+
+// processWebOrders runs on the leader for as long as it leads.
+func processWebOrders(cc *commandContext) {
+	var listening atomic.Bool
+	listener := pq.NewListener(cc.envVars.DBConn, webListenMinRetry, webListenMaxRetry, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventConnected, pq.ListenerEventReconnected:
+			listening.Store(true)
+		case pq.ListenerEventDisconnected:
+			listening.Store(false)
+			log.Printf("Web orders: LISTEN %s lost its connection, polling every %s until it's back: %v", webOrderChannel, webOrderPoll, err)
+		case pq.ListenerEventConnectionAttemptFailed:
+			listening.Store(false)
+		}
+	})
+	defer listener.Close()
+	if err := listener.Listen(webOrderChannel); err != nil {
+		log.Printf("Web orders: LISTEN %s failed, polling every %s: %v", webOrderChannel, webOrderPoll, err)
+	}
+	sweepWebOrders(cc)
+	poll := time.NewTicker(webOrderPoll)
+	defer poll.Stop()
+	for {
+		select {
+		case n := <-listener.Notify:
+			// nil says the connection was re-established, and notifications
+			// may have been missed meanwhile.
+			if n == nil {
+				sweepWebOrders(cc)
+				continue
+			}
+			orderID, err := strconv.ParseInt(strings.TrimSpace(n.Extra), 10, 64)
+			if err != nil {
+				sweepWebOrders(cc)
+				continue
+			}
+			if err := sendWebOrderLink(cc, orderID); err != nil {
+				log.Printf("Web orders: sending the payment link of order %d failed: %v", orderID, err)
+			}
+		case <-poll.C:
+			if !listening.Load() {
+				sweepWebOrders(cc)
+			}
+		}
+	}
+}
+
+// sweepWebOrders sends the link of every web order that hasn't had one.
+func sweepWebOrders(cc *commandContext) {
+	rows, err := cc.db.Query(`SELECT o.`+orderIDColumn+` FROM `+orderTable+` o
+		LEFT JOIN order_meta m ON m.order_id = o.`+orderIDColumn+`
+		WHERE o.`+orderSourceColumn+` = $1 AND m.web_link_claimed_at IS NULL AND COALESCE(m.payment_link, '') = ''
+		ORDER BY o.`+orderIDColumn, webOrderSource)
+	if err != nil {
+		log.Printf("Web orders: finding unsent orders failed: %v", err)
+		return
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			log.Printf("Web orders: finding unsent orders failed: %v", err)
+			break
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	for _, id := range ids {
+		if err := sendWebOrderLink(cc, id); err != nil {
+			log.Printf("Web orders: sending the payment link of order %d failed: %v", id, err)
+		}
+	}
+}
+
+type webOrder struct {
+	ID         int64
+	Ref        string
+	CellNumber string
+	Total      float64
+}
+
+// claimWebOrder marks a web order as being sent its link, as part of tx.
+// It returns the order only to the one caller that claimed it; orders that
+// aren't from the website, already have a link or were claimed before give
+// false. A second claimer waits on the first's row lock until tx ends.
+func claimWebOrder(tx dbtx, refPrefix string, orderID int64) (webOrder, bool, error) {
+	o := webOrder{ID: orderID}
+	err := tx.QueryRow(`SELECT `+orderCellColumn+`, `+orderTotalColumn+` FROM `+orderTable+`
+		WHERE `+orderIDColumn+` = $1 AND `+orderSourceColumn+` = $2`, orderID, webOrderSource).Scan(&o.CellNumber, &o.Total)
+	if errors.Is(err, sql.ErrNoRows) {
+		return webOrder{}, false, nil
+	}
+	if err != nil {
+		return webOrder{}, false, err
+	}
+	// The website doesn't know about references, so the order gets its
+	// own here.
+	err = tx.QueryRow(`INSERT INTO order_meta (order_id, pricelist_version, web_link_claimed_at, order_ref) VALUES ($1, 0, now(), $2)
+		ON CONFLICT (order_id) DO UPDATE SET web_link_claimed_at = now(), updated_at = now(),
+			order_ref = COALESCE(order_meta.order_ref, EXCLUDED.order_ref)
+		WHERE order_meta.web_link_claimed_at IS NULL AND order_meta.payment_link = ''
+		RETURNING order_ref`, orderID, formatOrderRef(refPrefix, time.Now(), orderID)).Scan(&o.Ref)
+	if errors.Is(err, sql.ErrNoRows) {
+		return webOrder{}, false, nil
+	}
+	if err != nil {
+		return webOrder{}, false, err
+	}
+	return o, true, nil
+}
+
+// webPaymentLink builds the PayFast link of an order the way MenuBotLib's
+// checkout does, with the amount adjusted and the link signed as
+// adjustCheckoutLinks would.
+func webPaymentLink(db *sql.DB, checkout mb.CheckoutInfo, instanceID string, o webOrder) (string, error) {
+	surcharge, err := orderSurcharge(db, o.ID)
+	if err != nil {
+		return "", fmt.Errorf("reading options: %w", err)
+	}
+	discount, err := orderDiscount(db, o.ID)
+	if err != nil {
+		return "", fmt.Errorf("reading discount: %w", err)
+	}
+	fields := []itnParam{
+		{Key: "merchant_id", Value: checkout.MerchantId},
+		{Key: "merchant_key", Value: checkout.MerchantKey},
+		{Key: "return_url", Value: withReturnOrder(checkout.ReturnURL, o.ID)},
+		{Key: "cancel_url", Value: withReturnOrder(checkout.CancelURL, o.ID)},
+		{Key: "notify_url", Value: checkout.NotifyURL},
+		{Key: "m_payment_id", Value: paymentID(instanceID, o.ID)},
+		{Key: "amount", Value: strconv.FormatFloat(payableAmount(o.Total, surcharge, discount), 'f', 2, 64)},
+		{Key: "item_name", Value: pfText(orderItemName(checkout.ItemNamePrefix, o.Ref), pfMaxItemName)},
+	}
+	query := checkPaymentResult(payFastBuyerFor(db, o.CellNumber, o.Ref).addTo(fields))
+	return "https://" + pfHostname(checkout.HostURL) + "/eng/process?" + query + "&signature=" + pfSignature(query, checkout.Passphrase), nil
+}
+
+// sendWebOrderLink sends a web order's customer its payment link, once.
+// The claim, the recorded link and the message holding it are written in
+// one transaction, and the message is only sent once that has committed:
+// a failure or crash part way leaves nothing behind for the next sweep to
+// trip over, and after the commit the outbox sees the link delivered.
+func sendWebOrderLink(cc *commandContext, orderID int64) error {
+	tx, err := cc.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	o, claimed, err := claimWebOrder(tx, cc.envVars.OrderRefPrefix, orderID)
+	if err != nil || !claimed {
+		return err
+	}
+	jid, err := resolveJID(o.CellNumber)
+	if err == nil {
+		jid, err = cc.checkRecipient(jid)
+	}
+	if err != nil {
+		return flagWebOrder(cc, tx, o, err)
+	}
+	vp := cc.prclist.Snapshot().ForTier(customerTier(cc.db, o.CellNumber))
+	res, lines, err := resolveOrder(tx, vp, o.ID, false, time.Now())
+	if err != nil {
+		return fmt.Errorf("checking the items: %w", err)
+	}
+	if len(res.Removed) > 0 {
+		return sendWebOrderAdjusted(cc, tx, o, jid, vp, res, lines)
+	}
+	base := cc.homebase.URL()
+	link, err := webPaymentLink(cc.db, withHomebase(newCheckoutInfo(cc.envVars), cc.envVars, base), cc.envVars.InstanceID, o)
+	if err != nil {
+		return err
+	}
+	noteCallbackBase(cc, o.ID, base)
+	if err := recordCheckout(tx, o.ID, link, base); err != nil {
+		return fmt.Errorf("recording the link: %w", err)
+	}
+	if err := stampPricelistVersion(tx, o.ID, cc.prclist.Version(), cc.envVars.PayFastMode); err != nil {
+		return fmt.Errorf("stamping the pricelist version: %w", err)
+	}
+	text := fmt.Sprintf("Thanks for your order %s! You can pay for it here:\n%s", o.Ref, link)
+	text = withSandboxWarning(text, cc.envVars.PayFastMode, cc.envVars.PfHost)
+	m := outboundMessage{To: jid, Text: text, Priority: priorityNotify, OrderID: o.ID, Kind: outboundPaymentLink}
+	queued, err := queueOutbox(tx, m)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	recordFunnel(cc.db, funnelCheckout, o.CellNumber, o.ID)
+	cc.sender.deliverQueued(queued, m)
+	metrics.Inc("menubot_web_orders_total", "Orders from the website, by what became of them.", "result", "sent")
+	log.Printf("Web orders: sent the payment link of order %d to %s", o.ID, o.CellNumber)
+	return nil
+}
+
+// sendWebOrderAdjusted commits a web order resolution took lines out of
+// and tells the customer, instead of sending a link for it. It keeps its
+// claim without a link, so their next checkout rebuilds one for what is
+// left.
+func sendWebOrderAdjusted(cc *commandContext, tx *sql.Tx, o webOrder, jid types.JID, vp versionedPricelist, res cartResolution, lines []orderLine) error {
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	text := fmt.Sprintf("Thanks for your order %s! ", o.Ref) + cc.cartAdjusted(o.CellNumber, vp, o.ID, res, lines,
+		fmt.Sprintf("Reply \"%s\" for the payment link.", checkoutCommands[0]))
+	cc.sender.Deliver(outboundMessage{To: jid, Text: text, Priority: priorityNotify, OrderID: o.ID})
+	metrics.Inc("menubot_web_orders_total", "Orders from the website, by what became of them.", "result", "adjusted")
+	log.Printf("Web orders: order %d had items that can't be ordered, asked %s to check out the rest", o.ID, o.CellNumber)
+	return nil
+}
+
+// flagWebOrder records in tx that a web order's customer can't be messaged
+// and, once committed, tells the admin. The claim stays, so the order isn't
+// tried again.
+func flagWebOrder(cc *commandContext, tx *sql.Tx, o webOrder, reason error) error {
+	if _, err := tx.Exec(`UPDATE order_meta SET web_followup = $2, updated_at = now() WHERE order_id = $1`,
+		o.ID, webFollowupNotOnWhatsApp); err != nil {
+		return fmt.Errorf("flagging for follow-up: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("flagging for follow-up: %w", err)
+	}
+	metrics.Inc("menubot_web_orders_total", "Orders from the website, by what became of them.", "result", webFollowupNotOnWhatsApp)
+	log.Printf("Web orders: order %d is for %s, which can't be messaged on WhatsApp: %v", o.ID, o.CellNumber, reason)
+	cc.sendBulk(bulkMessage{
+		Recipient: cc.envVars.AdminNumber,
+		Text:      fmt.Sprintf("Web order %s (%d) is for %s, which isn't on WhatsApp, so they haven't had a payment link. Please get in touch with them.", o.Ref, o.ID, o.CellNumber),
+		Kind:      bulkAdmin,
+	})
+	return nil
+}
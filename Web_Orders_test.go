@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	mb "github.com/JeremyJalpha/MenuBotLib"
+)
+
+// fakeCheckoutDB holds one web order and answers the statements sending
+// its payment link makes, keeping what a transaction writes apart until it
+// commits. failOn makes the first statement containing it fail; "COMMIT"
+// fails the commit itself. With crash set, that statement and every one
+// after it fail, as if the process had died there and nothing more could
+// happen until restart.
+type fakeCheckoutDB struct {
+	mu sync.Mutex
+	checkoutState
+	failOn string
+	crash  bool
+	dead   bool
+}
+
+// checkoutState is what is committed for the order.
+type checkoutState struct {
+	Claimed bool
+	Ref     string
+	Link    string
+	Stamped bool
+	Outbox  []fakeOutboxRow
+}
+
+type fakeOutboxRow struct {
+	ID    int64
+	Body  string
+	State string
+}
+
+func (db *fakeCheckoutDB) Open(string) (driver.Conn, error) { return &fakeCheckoutConn{db: db}, nil }
+
+func (db *fakeCheckoutDB) state() checkoutState {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	s := db.checkoutState
+	s.Outbox = append([]fakeOutboxRow(nil), s.Outbox...)
+	return s
+}
+
+// inject fails stmt if it is the statement to, or comes after a crash.
+func (db *fakeCheckoutDB) inject(stmt string) error {
+	if db.dead {
+		return errors.New("injected crash")
+	}
+	if db.failOn == "" || !strings.Contains(stmt, db.failOn) {
+		return nil
+	}
+	db.failOn = ""
+	db.dead = db.crash
+	return errors.New("injected failure")
+}
+
+// restart brings a crashed database back.
+func (db *fakeCheckoutDB) restart() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.dead = false
+}
+
+type fakeCheckoutConn struct {
+	db *fakeCheckoutDB
+	// pending is what the open transaction has written, nil outside one.
+	pending []func(*checkoutState)
+}
+
+func (c *fakeCheckoutConn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("fake checkout db: prepare not supported")
+}
+func (c *fakeCheckoutConn) Close() error { return nil }
+
+func (c *fakeCheckoutConn) Begin() (driver.Tx, error) {
+	c.pending = []func(*checkoutState){}
+	return fakeCheckoutTx{c}, nil
+}
+
+type fakeCheckoutTx struct{ c *fakeCheckoutConn }
+
+func (tx fakeCheckoutTx) Commit() error {
+	db := tx.c.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	defer func() { tx.c.pending = nil }()
+	if err := db.inject("COMMIT"); err != nil {
+		return err
+	}
+	for _, write := range tx.c.pending {
+		write(&db.checkoutState)
+	}
+	return nil
+}
+
+func (tx fakeCheckoutTx) Rollback() error {
+	tx.c.pending = nil
+	return nil
+}
+
+// write applies w now, or at commit inside a transaction. db.mu is held.
+func (c *fakeCheckoutConn) write(w func(*checkoutState)) {
+	if c.pending != nil {
+		c.pending = append(c.pending, w)
+		return
+	}
+	w(&c.db.checkoutState)
+}
+
+func (c *fakeCheckoutConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	db := c.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.inject(query); err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.Contains(query, "SELECT "+orderCellColumn+", "+orderTotalColumn):
+		return &fakeCheckoutRows{rows: [][]driver.Value{{"27821234567", 50.0}}}, nil
+	case strings.Contains(query, "web_link_claimed_at, order_ref"):
+		if db.Claimed || db.Link != "" {
+			return &fakeCheckoutRows{}, nil
+		}
+		ref := args[1].Value.(string)
+		c.write(func(s *checkoutState) { s.Claimed, s.Ref = true, ref })
+		return &fakeCheckoutRows{rows: [][]driver.Value{{ref}}}, nil
+	case strings.Contains(query, "FOR UPDATE"):
+		return &fakeCheckoutRows{rows: [][]driver.Value{{`[{"CatalogueItemID":7,"Quantity":2}]`}}}, nil
+	case strings.Contains(query, "price_delta"):
+		return &fakeCheckoutRows{rows: [][]driver.Value{{0.0}}}, nil
+	case strings.Contains(query, "SELECT quoted_prices"), strings.Contains(query, "FROM customer_profiles"),
+		strings.Contains(query, "FROM loyalty_redemptions"), strings.Contains(query, "SELECT callback_base"):
+		return &fakeCheckoutRows{}, nil
+	case strings.Contains(query, "INSERT INTO outbox"):
+		id := int64(len(db.Outbox) + 1)
+		body := args[1].Value.(string)
+		c.write(func(s *checkoutState) {
+			s.Outbox = append(s.Outbox, fakeOutboxRow{ID: id, Body: body, State: outboxPending})
+		})
+		return &fakeCheckoutRows{rows: [][]driver.Value{{id}}}, nil
+	}
+	return nil, fmt.Errorf("fake checkout db: unexpected query %s", query)
+}
+
+func (c *fakeCheckoutConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	db := c.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.inject(query); err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.Contains(query, "payment_link, callback_base"):
+		link := args[1].Value.(string)
+		c.write(func(s *checkoutState) { s.Link = link })
+	case strings.Contains(query, "pricelist_version, payfast_mode"):
+		c.write(func(s *checkoutState) { s.Stamped = true })
+	case strings.Contains(query, "INSERT INTO funnel_events"), strings.Contains(query, "INSERT INTO outbound_messages"):
+	case strings.Contains(query, "UPDATE outbox SET state"):
+		id, state := args[0].Value.(int64), args[1].Value.(string)
+		c.write(func(s *checkoutState) {
+			for i := range s.Outbox {
+				if s.Outbox[i].ID == id {
+					s.Outbox[i].State = state
+				}
+			}
+		})
+	default:
+		return nil, fmt.Errorf("fake checkout db: unexpected statement %s", query)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+type fakeCheckoutRows struct{ rows [][]driver.Value }
+
+func (r *fakeCheckoutRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return []string{"a", "b"}
+	}
+	return make([]string, len(r.rows[0]))
+}
+func (r *fakeCheckoutRows) Close() error { return nil }
+func (r *fakeCheckoutRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// TestSendWebOrderLinkStages fails and crashes sending a web order its
+// payment link at each stage, and checks that what is left is either
+// nothing or the whole checkout, that the customer is sent a link only
+// for a committed checkout, and that the next sweep finishes the job
+// without a second link or outbox message.
+func TestSendWebOrderLinkStages(t *testing.T) {
+	withRuntimeConfig(t, &RuntimeConfig{HomebaseURL: "https://shop.example.com", BusinessHours: BusinessHours{Location: time.UTC}})
+	tests := []struct {
+		name   string
+		failOn string
+		crash  bool
+		// committed is whether the checkout survives the failure.
+		committed bool
+		// sent is how many messages reach the customer the first time.
+		sent int
+		// outbox is the state the message is left in when committed.
+		outbox string
+	}{
+		{name: "no failure", committed: true, sent: 1, outbox: outboxSent},
+		{name: "claiming", failOn: "web_link_claimed_at, order_ref"},
+		{name: "reading the items", failOn: "FOR UPDATE"},
+		{name: "building the link", failOn: "price_delta"},
+		{name: "recording the link", failOn: "payment_link, callback_base"},
+		{name: "stamping the pricelist version", failOn: "pricelist_version, payfast_mode"},
+		{name: "queueing the message", failOn: "INSERT INTO outbox"},
+		{name: "committing", failOn: "COMMIT"},
+		{name: "crash claiming", failOn: "web_link_claimed_at, order_ref", crash: true},
+		{name: "crash reading the items", failOn: "FOR UPDATE", crash: true},
+		{name: "crash recording the link", failOn: "payment_link, callback_base", crash: true},
+		{name: "crash queueing the message", failOn: "INSERT INTO outbox", crash: true},
+		{name: "crash committing", failOn: "COMMIT", crash: true},
+		{name: "marking the message sent", failOn: "UPDATE outbox", committed: true, sent: 1, outbox: outboxPending},
+		{name: "crash marking the message sent", failOn: "UPDATE outbox", crash: true, committed: true, sent: 1, outbox: outboxPending},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeCheckoutDB{failOn: tt.failOn, crash: tt.crash}
+			name := fmt.Sprintf("fakecheckout%d", i)
+			sql.Register(name, fake)
+			db, err := sql.Open(name, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			cc, sent := testCheckoutContext(db)
+
+			err = sendWebOrderLink(cc, 42)
+			fake.restart()
+			after := fake.state()
+			switch {
+			case tt.committed && (!after.Claimed || after.Link == "" || !after.Stamped || len(after.Outbox) != 1):
+				t.Fatalf("after the failure %+v, want the whole checkout committed", after)
+			case !tt.committed && (after.Claimed || after.Link != "" || after.Stamped || len(after.Outbox) != 0):
+				t.Fatalf("after the failure %+v, want nothing committed", after)
+			case !tt.committed && err == nil:
+				t.Error("the failure wasn't reported")
+			}
+			if tt.committed && after.Outbox[0].State != tt.outbox {
+				t.Errorf("outbox message %s, want %s", after.Outbox[0].State, tt.outbox)
+			}
+			if len(*sent) != tt.sent {
+				t.Fatalf("sent %d messages, want %d", len(*sent), tt.sent)
+			}
+
+			// The next sweep.
+			if err := sendWebOrderLink(cc, 42); err != nil {
+				t.Fatalf("the retry failed: %v", err)
+			}
+			final := fake.state()
+			if !final.Claimed || final.Link == "" || !final.Stamped || len(final.Outbox) != 1 {
+				t.Fatalf("after the retry %+v, want one complete checkout", final)
+			}
+			if tt.committed && final.Link != after.Link {
+				t.Errorf("the retry replaced the link %s with %s", after.Link, final.Link)
+			}
+			if len(*sent) != 1 {
+				t.Fatalf("sent %d messages in all, want 1", len(*sent))
+			}
+			m := (*sent)[0]
+			if !strings.Contains(m.Text, final.Link) || !strings.Contains(m.Text, final.Ref) || m.OrderID != 42 || m.To.User != "27821234567" {
+				t.Errorf("sent %+v, want order 42's link %s", m, final.Link)
+			}
+			if final.Outbox[0].Body != m.Text {
+				t.Errorf("outbox holds %q, sent %q", final.Outbox[0].Body, m.Text)
+			}
+		})
+	}
+}
+
+func TestSendWebOrderLinkWhileBlocked(t *testing.T) {
+	withRuntimeConfig(t, &RuntimeConfig{HomebaseURL: "https://shop.example.com", BusinessHours: BusinessHours{Location: time.UTC}})
+	fake := &fakeCheckoutDB{}
+	sql.Register("fakecheckoutblocked", fake)
+	db, err := sql.Open("fakecheckoutblocked", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cc, sent := testCheckoutContext(db)
+	cc.sender.record = nil
+	cc.sender.block = &sendingBlock{}
+	cc.sender.block.state.Store(&sendingBlockState{Active: true})
+
+	if err := sendWebOrderLink(cc, 42); err != nil {
+		t.Fatal(err)
+	}
+	s := fake.state()
+	if len(*sent) != 0 || len(s.Outbox) != 1 || s.Outbox[0].State != outboxPending || !strings.Contains(s.Outbox[0].Body, s.Link) {
+		t.Errorf("with sending blocked: sent %d, state %+v; want the link left in the outbox", len(*sent), s)
+	}
+}
+
+func testCheckoutContext(db *sql.DB) (*commandContext, *[]outboundMessage) {
+	var sent []outboundMessage
+	prclist := &pricelistHolder{}
+	prclist.Set(versionedPricelist{Version: 3, Items: []mb.CatalogueItem{
+		ctlgItemWithPrice(mb.CatalogueItem{CatalogueItemID: 7, Item: "Brownie"}, 25),
+	}})
+	cc := &commandContext{
+		db:         db,
+		prclist:    prclist,
+		sender:     &messageSender{db: db, record: func(m outboundMessage) { sent = append(sent, m) }},
+		recipients: newRecipientCache(),
+		homebase:   newHomebaseResolver(),
+		envVars: EnvVars{
+			MerchantId:     "10000100",
+			MerchantKey:    "46f0cd694581a",
+			PfHost:         "https://sandbox.payfast.co.za/eng/process",
+			InstanceID:     "shop1",
+			OrderRefPrefix: "WEB",
+			ItemNamePrefix: legacyItemNamePrefix,
+		},
+	}
+	jid, _ := resolveJID("27821234567")
+	cc.recipients.put(jid.User, recipientEntry{JID: jid, IsIn: true, Expires: time.Now().Add(time.Hour)}, time.Now())
+	return cc, &sent
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/JeremyJalpha/MenuBot_WebAPI/httpapi"
+)
+
+const (
+	webhookQueueSize = 256
+	webhookAttempts  = 3
+)
+
+// Event types emitted to WEBHOOK_URL and EVENTS_BACKEND.
+const (
+	eventOrderCreated        = "order.created"
+	eventOrderPaid           = "order.paid"
+	eventOrderStatusChanged  = "order.status_changed"
+	eventRefundRequested     = "order.refund_requested"
+	eventMessageReceived     = "message.received"
+	eventMessageSent         = "message.sent"
+	eventPaymentNotification = httpapi.EventPaymentNotification
+	eventSendingDisabled     = "sending.disabled"
+	eventSendingResumed      = "sending.resumed"
+)
+
+// eventEnvelope is the JSON body of every webhook delivery and queued
+// event.
+type eventEnvelope struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Data       any       `json:"data"`
+}
+
+// eventSink is somewhere events are delivered, in the background.
+// Publish must never block.
+type eventSink interface {
+	Publish(env eventEnvelope)
+	// QueueDepth is the number of events waiting for delivery.
+	QueueDepth() int
+}
+
+// eventSinks is every configured sink; each event goes to all of them
+// under the same ID. With none configured events are dropped.
+type eventSinks []eventSink
+
+func newEventSinks(env EnvVars) eventSinks {
+	var sinks eventSinks
+	if env.WebhookURL != "" {
+		sinks = append(sinks, newWebhookDispatcher(env.WebhookURL, env.WebhookSecret))
+	}
+	if env.EventsBackend != eventsNone {
+		sinks = append(sinks, newQueuePublisher(env.EventsBackend, env.EventsURL, env.EventsSubject, env.EventsBuffer))
+	}
+	return sinks
+}
+
+func (s eventSinks) Emit(eventType string, data any) {
+	if len(s) == 0 {
+		return
+	}
+	env := eventEnvelope{ID: newEventID(), Type: eventType, OccurredAt: time.Now().UTC(), Data: data}
+	for _, sink := range s {
+		sink.Publish(env)
+	}
+}
+
+func (s eventSinks) QueueDepth() int {
+	depth := 0
+	for _, sink := range s {
+		depth += sink.QueueDepth()
+	}
+	return depth
+}
+
+// webhookDispatcher delivers events to WEBHOOK_URL in the background so a
+// slow receiver never holds up message handling.
+type webhookDispatcher struct {
+	url    string
+	secret string
+	client *http.Client
+	queue  chan eventEnvelope
+}
+
+func newWebhookDispatcher(url, secret string) *webhookDispatcher {
+	d := &webhookDispatcher{
+		url:    url,
+		secret: secret,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan eventEnvelope, webhookQueueSize),
+	}
+	go d.run()
+	return d
+}
+
+func newEventID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Publish queues an event for delivery. If the queue is full the event is
+// dropped and logged rather than blocking the caller.
+func (d *webhookDispatcher) Publish(env eventEnvelope) {
+	select {
+	case d.queue <- env:
+	default:
+		metrics.Inc("menubot_events_dropped_total", "Events dropped because a sink's buffer was full.", "sink", "webhook")
+		log.Printf("Webhook queue full, dropped %s event %s", env.Type, env.ID)
+	}
+}
+
+func (d *webhookDispatcher) QueueDepth() int {
+	return len(d.queue)
+}
+
+func (d *webhookDispatcher) run() {
+	for env := range d.queue {
+		body, err := json.Marshal(env)
+		if err != nil {
+			log.Printf("Webhook: encoding %s event failed: %v", env.Type, err)
+			continue
+		}
+		for attempt := 1; attempt <= webhookAttempts; attempt++ {
+			if err = d.deliver(body); err == nil {
+				break
+			}
+			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+		}
+		if err != nil {
+			log.Printf("Webhook: delivering %s event %s failed after %d attempts: %v", env.Type, env.ID, webhookAttempts, err)
+		}
+	}
+}
+
+func (d *webhookDispatcher) deliver(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.secret != "" {
+		mac := hmac.New(sha256.New, []byte(d.secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature-SHA256", hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("receiver answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Package buildinfo reports which build of the bot is running.
+//
+// Release builds set the variables with -ldflags, e.g.
+//
+//	go build -ldflags "-X github.com/JeremyJalpha/MenuBot_WebAPI/buildinfo.Version=v1.4.0 \
+//		-X github.com/JeremyJalpha/MenuBot_WebAPI/buildinfo.Commit=$(git rev-parse HEAD) \
+//		-X github.com/JeremyJalpha/MenuBot_WebAPI/buildinfo.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Anything left unset falls back to what the Go toolchain embedded.
+package buildinfo
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+var (
+	Version   = ""
+	Commit    = ""
+	BuildTime = ""
+)
+
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+var (
+	once sync.Once
+	info Info
+)
+
+// Get returns the build info, resolving the fallbacks on first use.
+func Get() Info {
+	once.Do(func() {
+		info = Info{Version: Version, Commit: Commit, BuildTime: BuildTime, GoVersion: runtime.Version()}
+		if bi, ok := debug.ReadBuildInfo(); ok {
+			if info.Version == "" && bi.Main.Version != "(devel)" {
+				info.Version = bi.Main.Version
+			}
+			for _, s := range bi.Settings {
+				switch {
+				case s.Key == "vcs.revision" && info.Commit == "":
+					info.Commit = s.Value
+				case s.Key == "vcs.time" && info.BuildTime == "":
+					info.BuildTime = s.Value
+				}
+			}
+		}
+		if info.Version == "" {
+			info.Version = "dev"
+		}
+		if info.Commit == "" {
+			info.Commit = "unknown"
+		}
+		if info.BuildTime == "" {
+			info.BuildTime = "unknown"
+		}
+	})
+	return info
+}
+
+// ShortCommit is the first 12 characters of the commit hash.
+func (i Info) ShortCommit() string {
+	if len(i.Commit) > 12 {
+		return i.Commit[:12]
+	}
+	return i.Commit
+}
+
+func (i Info) String() string {
+	return fmt.Sprintf("%s (commit %s, built %s, %s)", i.Version, i.ShortCommit(), i.BuildTime, i.GoVersion)
+}
+
+// Handler serves the build info as JSON.
+func Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Get())
+	}
+}
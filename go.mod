@@ -6,11 +6,20 @@ require (
 	github.com/JeremyJalpha/MenuBotLib v1.0.8
 	github.com/go-chi/chi/v5 v5.0.12
 	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.22
 	github.com/mdp/qrterminal v1.0.1
+	github.com/nats-io/nats.go v1.31.0
+	github.com/redis/go-redis/v9 v9.5.1
 	go.mau.fi/whatsmeow v0.0.0-20240619210240-329c2336a6f1
+	golang.org/x/sync v0.7.0
 )
 
 require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/klauspost/compress v1.17.0 // indirect
+	github.com/nats-io/nkeys v0.4.5 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
 	golang.org/x/net v0.25.0 // indirect
 	rsc.io/qr v0.2.0 // indirect
 )
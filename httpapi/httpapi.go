@@ -0,0 +1,304 @@
+// Package httpapi serves the pages PayFast sends customers back to and the
+// ITN callback.
+//
+// What the handlers need is behind the interfaces below and handed to New,
+// so a new dependency means a new field rather than another parameter on
+// every handler, and each handler can be tested with httptest and fakes.
+package httpapi
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Order is an order as the payment pages see it. Its fields are those of
+// the bot's order summary, which converts to it.
+type Order struct {
+	ID         int64
+	Ref        string
+	CellNumber string
+	Total      string
+	Status     string
+	PaidAt     *time.Time
+}
+
+// Receipt fills the CustomerOrder template.
+type Receipt struct {
+	OrderID    string
+	OrderRef   string
+	CellNumber string
+	OrderItems []string
+	OrderTotal string
+}
+
+// OrderStore is how the payment pages read orders.
+type OrderStore interface {
+	Order(id int64) (Order, bool, error)
+	Receipt(order Order) (Receipt, error)
+	// Returned notes that the customer came back from PayFast.
+	Returned(cellNumber string, orderID int64)
+	// CallbackBase is the base URL the payment link for paymentID was
+	// issued with. found is false when paymentID isn't one of ours.
+	CallbackBase(paymentID string) (orderID int64, base string, found bool, err error)
+}
+
+// PaymentVerifier decides whether an ITN really came from PayFast. One it
+// rejects is reported on the notification event and goes no further: it
+// is neither stored nor queued, so it can't mark an order paid.
+type PaymentVerifier interface {
+	Verify(orderData OrderData, params []ITNParam, sourceIP string) bool
+}
+
+// MessageSender takes a verified ITN off the handler's hands and on to the
+// customer: the payment pipeline stores it, settles the order and sends
+// their confirmation. stored is false for a repeat of one already stored.
+type MessageSender interface {
+	QueueConfirmation(orderData OrderData, raw string) (stored bool, err error)
+}
+
+// Pages TemplateRenderer renders.
+const (
+	PageReturn = "return"
+	PageCancel = "cancel"
+)
+
+type TemplateRenderer interface {
+	Render(w http.ResponseWriter, r *http.Request, page string, receipt *Receipt)
+}
+
+type EventEmitter interface {
+	Emit(eventType string, data any)
+}
+
+// BaseURLSource is where PayFast is told to call back now.
+type BaseURLSource interface {
+	URL() string
+}
+
+// Problems the handlers report. They are recorded and alerted on like any
+// other incident.
+type Problem string
+
+const (
+	ProblemReturnPage    Problem = "return_page"
+	ProblemITNUnreadable Problem = "itn_unreadable"
+	ProblemITNFields     Problem = "itn_fields"
+	ProblemITNStore      Problem = "itn_store"
+)
+
+type IncidentReporter interface {
+	Report(problem Problem, cell string, orderID int64, err error, context string)
+}
+
+// ReturnOrderParam carries the order ID on the PayFast return URL.
+const ReturnOrderParam = "order"
+
+// Options are the routes and request handling the handlers are mounted
+// with.
+type Options struct {
+	ReturnPath, CancelPath, NotifyPath string
+	// ReturnSecrets guard the return and cancel routes and NotifySecrets
+	// the notify route, see SecuredPath.
+	ReturnSecrets, NotifySecrets []string
+	// NotifyLimit rate limits the notify route, on top of whatever limits
+	// the router it is mounted on.
+	NotifyLimit func(http.Handler) http.Handler
+	// ClientIP is the address a request came from.
+	ClientIP func(r *http.Request) string
+}
+
+type Handlers struct {
+	orders    OrderStore
+	verifier  PaymentVerifier
+	sender    MessageSender
+	pages     TemplateRenderer
+	events    EventEmitter
+	bases     BaseURLSource
+	incidents IncidentReporter
+	opts      Options
+}
+
+func New(orders OrderStore, verifier PaymentVerifier, sender MessageSender, pages TemplateRenderer, events EventEmitter, bases BaseURLSource, incidents IncidentReporter, opts Options) *Handlers {
+	if opts.NotifyLimit == nil {
+		opts.NotifyLimit = func(next http.Handler) http.Handler { return next }
+	}
+	if opts.ClientIP == nil {
+		opts.ClientIP = func(r *http.Request) string { return r.RemoteAddr }
+	}
+	return &Handlers{
+		orders:    orders,
+		verifier:  verifier,
+		sender:    sender,
+		pages:     pages,
+		events:    events,
+		bases:     bases,
+		incidents: incidents,
+		opts:      opts,
+	}
+}
+
+// RegisterRoutes mounts the return, cancel and notify routes on r, which
+// is expected to be rate limited already; notify gets a tighter limit of
+// its own on top.
+func (h *Handlers) RegisterRoutes(r chi.Router) {
+	o := h.opts
+	notify := RequirePathSecret(o.NotifySecrets, h.Notify)
+	r.Get(SecuredPath(o.ReturnPath, o.ReturnSecrets), RequirePathSecret(o.ReturnSecrets, h.Return))
+	r.With(o.NotifyLimit).Post(SecuredPath(o.NotifyPath, o.NotifySecrets), notify)
+	r.With(o.NotifyLimit).Get(SecuredPath(o.NotifyPath, o.NotifySecrets), notify)
+	r.Get(SecuredPath(o.CancelPath, o.ReturnSecrets), RequirePathSecret(o.ReturnSecrets, h.Cancel))
+}
+
+// Return shows the customer's receipt once PayFast sends them back, if
+// the return URL says which order it was.
+func (h *Handlers) Return(w http.ResponseWriter, r *http.Request) {
+	h.pages.Render(w, r, PageReturn, h.pageReceipt(r, "Payment return", true))
+}
+
+// Cancel shows the order the customer didn't pay for, so its reference is
+// there if they get in touch.
+func (h *Handlers) Cancel(w http.ResponseWriter, r *http.Request) {
+	h.pages.Render(w, r, PageCancel, h.pageReceipt(r, "Payment cancel", false))
+}
+
+// pageReceipt is the receipt of the order a return or cancel URL names,
+// nil when it names none. returned records the return hit.
+func (h *Handlers) pageReceipt(r *http.Request, page string, returned bool) *Receipt {
+	orderID, err := strconv.ParseInt(r.URL.Query().Get(ReturnOrderParam), 10, 64)
+	if err != nil {
+		return nil
+	}
+	order, found, err := h.orders.Order(orderID)
+	if err != nil {
+		h.incidents.Report(ProblemReturnPage, "", orderID, err, page+": reading the order")
+		return nil
+	}
+	if !found {
+		return nil
+	}
+	if returned {
+		h.orders.Returned(order.CellNumber, orderID)
+	}
+	receipt, err := h.orders.Receipt(order)
+	if err != nil {
+		h.incidents.Report(ProblemReturnPage, order.CellNumber, orderID, err, page+": reading the receipt")
+		return nil
+	}
+	return &receipt
+}
+
+// Notify handles PayFast's ITN: it validates the notification and hands
+// it to the payment pipeline. PayFast gets a 200 whatever happens next, so
+// it stops retrying; failures end up as dead letters instead.
+func (h *Handlers) Notify(w http.ResponseWriter, r *http.Request) {
+	raw, params, err := ReadITNParams(r)
+	if err != nil {
+		h.incidents.Report(ProblemITNUnreadable, "", 0, err, "Post payment check: reading the notification from "+h.opts.ClientIP(r))
+	}
+
+	// Respond to the payment notification
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write([]byte("Success"))
+	if err != nil {
+		log.Println("error writing response: ", err)
+	}
+
+	orderData, err := CompileOrderData(ITNValues(params))
+	if err != nil {
+		h.incidents.Report(ProblemITNFields, "", 0, err, "Post payment check: compiling order data from the notification")
+		return
+	}
+
+	valid := h.verifier.Verify(orderData, params, h.opts.ClientIP(r))
+	h.events.Emit(EventPaymentNotification, PaymentNotificationEvent{
+		OrderID:       orderData.OrderID,
+		PfPaymentID:   orderData.PfPaymentID,
+		PaymentStatus: orderData.PaymentStatus,
+		AmountGross:   orderData.AmountGross,
+		Valid:         valid,
+	})
+	if !valid {
+		return
+	}
+	orderData.Verified = true
+	h.noteCallbackHost(r.Host, orderData)
+
+	if _, err := h.sender.QueueConfirmation(orderData, raw); err != nil {
+		// Nothing is lost yet: without a stored copy PayFast's own
+		// retries are all we have, so this is worth shouting about.
+		h.incidents.Report(ProblemITNStore, "", 0, err,
+			fmt.Sprintf("Post payment check: storing ITN %s for order %s", orderData.PfPaymentID, orderData.OrderID))
+	}
+}
+
+// noteCallbackHost logs an ITN that came in on another host than the
+// current base URL's. It is processed all the same: PayFast calls back on
+// the base the order's link was issued with, which may be a tunnel since
+// replaced that is still up.
+func (h *Handlers) noteCallbackHost(host string, orderData OrderData) {
+	current := h.bases.URL()
+	if host == "" || host == baseHost(current) {
+		return
+	}
+	orderID, issued, found, err := h.orders.CallbackBase(orderData.OrderID)
+	if err != nil {
+		log.Printf("Post payment check: reading callback base of order %d failed: %v", orderID, err)
+		return
+	}
+	if !found {
+		return
+	}
+	if host == baseHost(issued) {
+		log.Printf("Post payment check: ITN %s for order %d came in on %s, the base its link was issued with; the current base is %s",
+			orderData.PfPaymentID, orderID, host, current)
+		return
+	}
+	log.Printf("Post payment check: ITN %s for order %d came in on unexpected host %s; its link was issued on %q, the current base is %s",
+		orderData.PfPaymentID, orderID, host, issued, current)
+}
+
+func baseHost(base string) string {
+	if u, err := url.Parse(base); err == nil {
+		return u.Host
+	}
+	return ""
+}
+
+const pathSecretParam = "secret"
+
+// SecuredPath is the route pattern for base, with a secret segment when
+// secrets are configured.
+func SecuredPath(base string, secrets []string) string {
+	if len(secrets) == 0 {
+		return base
+	}
+	return base + "/{" + pathSecretParam + "}"
+}
+
+// RequirePathSecret answers 404 unless the {secret} segment is one of
+// secrets, so probes can't tell the route exists.
+func RequirePathSecret(secrets []string, next http.HandlerFunc) http.HandlerFunc {
+	if len(secrets) == 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		given := []byte(chi.URLParam(r, pathSecretParam))
+		for _, secret := range secrets {
+			if subtle.ConstantTimeCompare(given, []byte(secret)) == 1 {
+				next(w, r)
+				return
+			}
+		}
+		slog.Debug("Rejected request with wrong path secret", "route", r.URL.Path[:strings.LastIndex(r.URL.Path, "/")])
+		http.NotFound(w, r)
+	}
+}
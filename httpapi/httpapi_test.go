@@ -0,0 +1,294 @@
+package httpapi
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+type fakeOrders struct {
+	orders   map[int64]Order
+	returned []int64
+	bases    map[string]string
+}
+
+func (f *fakeOrders) Order(id int64) (Order, bool, error) {
+	if id < 0 {
+		return Order{}, false, errors.New("database is down")
+	}
+	o, ok := f.orders[id]
+	return o, ok, nil
+}
+
+func (f *fakeOrders) Receipt(order Order) (Receipt, error) {
+	return Receipt{OrderRef: order.Ref, OrderTotal: order.Total}, nil
+}
+
+func (f *fakeOrders) Returned(cellNumber string, orderID int64) {
+	f.returned = append(f.returned, orderID)
+}
+
+func (f *fakeOrders) CallbackBase(paymentID string) (int64, string, bool, error) {
+	base, ok := f.bases[paymentID]
+	return 1, base, ok, nil
+}
+
+// fakeVerifier accepts an ITN signed with signature that PayFast confirms,
+// i.e. whose pf_payment_id is in confirmed.
+type fakeVerifier struct {
+	signature string
+	confirmed map[string]bool
+	sourceIPs []string
+}
+
+func (v *fakeVerifier) Verify(orderData OrderData, params []ITNParam, sourceIP string) bool {
+	v.sourceIPs = append(v.sourceIPs, sourceIP)
+	return orderData.Signature == v.signature && v.confirmed[orderData.PfPaymentID]
+}
+
+type queued struct {
+	data OrderData
+	raw  string
+}
+
+type fakeSender struct {
+	queued []queued
+	err    error
+}
+
+func (s *fakeSender) QueueConfirmation(orderData OrderData, raw string) (bool, error) {
+	if s.err != nil {
+		return false, s.err
+	}
+	s.queued = append(s.queued, queued{orderData, raw})
+	return true, nil
+}
+
+type rendered struct {
+	page    string
+	receipt *Receipt
+}
+
+type fakePages struct {
+	rendered []rendered
+}
+
+func (p *fakePages) Render(w http.ResponseWriter, r *http.Request, page string, receipt *Receipt) {
+	p.rendered = append(p.rendered, rendered{page, receipt})
+}
+
+type fakeEvents struct {
+	notifications []PaymentNotificationEvent
+}
+
+func (e *fakeEvents) Emit(eventType string, data any) {
+	if eventType == EventPaymentNotification {
+		e.notifications = append(e.notifications, data.(PaymentNotificationEvent))
+	}
+}
+
+type fakeBase string
+
+func (b fakeBase) URL() string { return string(b) }
+
+type fakeIncidents struct {
+	problems []Problem
+}
+
+func (f *fakeIncidents) Report(problem Problem, cell string, orderID int64, err error, context string) {
+	f.problems = append(f.problems, problem)
+}
+
+type fixture struct {
+	orders    *fakeOrders
+	verifier  *fakeVerifier
+	sender    *fakeSender
+	pages     *fakePages
+	events    *fakeEvents
+	incidents *fakeIncidents
+	router    chi.Router
+}
+
+func newFixture() *fixture {
+	f := &fixture{
+		orders: &fakeOrders{
+			orders: map[int64]Order{7: {ID: 7, Ref: "AB12", CellNumber: "27820000000", Total: "120.00"}},
+			bases:  map[string]string{"menubot-7": "https://old.example.com"},
+		},
+		verifier:  &fakeVerifier{signature: "good", confirmed: map[string]bool{"pf-1": true, "pf-2": true}},
+		sender:    &fakeSender{},
+		pages:     &fakePages{},
+		events:    &fakeEvents{},
+		incidents: &fakeIncidents{},
+		router:    chi.NewRouter(),
+	}
+	h := New(f.orders, f.verifier, f.sender, f.pages, f.events, fakeBase("https://bot.example.com"), f.incidents, Options{
+		ReturnPath:    "/payment_return",
+		CancelPath:    "/payment_cancel",
+		NotifyPath:    "/payment_notify",
+		ReturnSecrets: []string{"r3turn"},
+		NotifySecrets: []string{"n0tify", "old"},
+		ClientIP:      func(r *http.Request) string { return "197.97.145.145" },
+	})
+	h.RegisterRoutes(f.router)
+	return f
+}
+
+func (f *fixture) serve(r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	f.router.ServeHTTP(w, r)
+	return w
+}
+
+func itnBody(pfPaymentID, signature string) string {
+	v := url.Values{}
+	v.Set("m_payment_id", "menubot-7")
+	v.Set("pf_payment_id", pfPaymentID)
+	v.Set("payment_status", "COMPLETE")
+	v.Set("item_name", "Order AB12")
+	v.Set("amount_gross", "120.00")
+	v.Set("signature", signature)
+	return v.Encode()
+}
+
+func TestNotify(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		method     string
+		body       string
+		status     int
+		queued     bool
+		valid      bool
+		notified   bool
+		problems   []Problem
+		senderFail bool
+	}{
+		{name: "valid", path: "/payment_notify/n0tify", method: "POST", body: itnBody("pf-1", "good"),
+			status: http.StatusOK, queued: true, valid: true, notified: true},
+		{name: "valid on a GET", path: "/payment_notify/n0tify?" + itnBody("pf-1", "good"), method: "GET",
+			status: http.StatusOK, queued: true, valid: true, notified: true},
+		{name: "valid under a previous secret", path: "/payment_notify/old", method: "POST", body: itnBody("pf-1", "good"),
+			status: http.StatusOK, queued: true, valid: true, notified: true},
+		{name: "bad signature", path: "/payment_notify/n0tify", method: "POST", body: itnBody("pf-1", "forged"),
+			status: http.StatusOK, notified: true},
+		{name: "unconfirmed", path: "/payment_notify/n0tify", method: "POST", body: itnBody("pf-3", "good"),
+			status: http.StatusOK, notified: true},
+		{name: "forged reversal", path: "/payment_notify/n0tify", method: "POST",
+			body:   strings.Replace(itnBody("pf-1", "forged"), "payment_status=COMPLETE", "payment_status=REVERSED", 1),
+			status: http.StatusOK, notified: true},
+		{name: "missing fields", path: "/payment_notify/n0tify", method: "POST", body: "pf_payment_id=pf-1",
+			status: http.StatusOK, problems: []Problem{ProblemITNFields}},
+		{name: "undecodable", path: "/payment_notify/n0tify", method: "POST", body: "m_payment_id=%zz",
+			status: http.StatusOK, problems: []Problem{ProblemITNUnreadable, ProblemITNFields}},
+		{name: "store failure", path: "/payment_notify/n0tify", method: "POST", body: itnBody("pf-1", "good"), senderFail: true,
+			status: http.StatusOK, valid: true, notified: true, problems: []Problem{ProblemITNStore}},
+		{name: "wrong secret", path: "/payment_notify/guess", method: "POST", body: itnBody("pf-1", "good"),
+			status: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture()
+			if tt.senderFail {
+				f.sender.err = errors.New("database is down")
+			}
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			w := f.serve(r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				if len(f.verifier.sourceIPs) != 0 {
+					t.Error("the handler ran")
+				}
+				return
+			}
+			if w.Body.String() != "Success" {
+				t.Errorf("body %q, want Success", w.Body.String())
+			}
+			if got := len(f.sender.queued) == 1; got != tt.queued {
+				t.Errorf("queued = %v, want %v", got, tt.queued)
+			}
+			if tt.queued && (f.sender.queued[0].data.PfPaymentID != "pf-1" || !f.sender.queued[0].data.Verified) {
+				t.Errorf("queued %+v", f.sender.queued[0].data)
+			}
+			if got := len(f.events.notifications) == 1; got != tt.notified {
+				t.Fatalf("notification event = %v, want %v", got, tt.notified)
+			}
+			if tt.notified && f.events.notifications[0].Valid != tt.valid {
+				t.Errorf("event valid = %v, want %v", f.events.notifications[0].Valid, tt.valid)
+			}
+			if tt.notified && f.verifier.sourceIPs[0] != "197.97.145.145" {
+				t.Errorf("verified with source IP %q", f.verifier.sourceIPs[0])
+			}
+			if strings.Join(problemNames(f.incidents.problems), ",") != strings.Join(problemNames(tt.problems), ",") {
+				t.Errorf("problems %v, want %v", f.incidents.problems, tt.problems)
+			}
+		})
+	}
+}
+
+func problemNames(problems []Problem) []string {
+	names := make([]string, len(problems))
+	for i, p := range problems {
+		names[i] = string(p)
+	}
+	return names
+}
+
+func TestReturnAndCancel(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		status   int
+		page     string
+		ref      string
+		returned bool
+		problems int
+	}{
+		{"return", "/payment_return/r3turn?order=7", http.StatusOK, PageReturn, "AB12", true, 0},
+		{"cancel", "/payment_cancel/r3turn?order=7", http.StatusOK, PageCancel, "AB12", false, 0},
+		{"return without an order", "/payment_return/r3turn", http.StatusOK, PageReturn, "", false, 0},
+		{"return for an unknown order", "/payment_return/r3turn?order=8", http.StatusOK, PageReturn, "", false, 0},
+		{"return when the order can't be read", "/payment_return/r3turn?order=-1", http.StatusOK, PageReturn, "", false, 1},
+		{"return without the secret", "/payment_return?order=7", http.StatusNotFound, "", "", false, 0},
+		{"cancel with the notify secret", "/payment_cancel/n0tify?order=7", http.StatusNotFound, "", "", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFixture()
+			w := f.serve(httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				if len(f.pages.rendered) != 0 {
+					t.Error("a page was rendered")
+				}
+				return
+			}
+			if len(f.pages.rendered) != 1 || f.pages.rendered[0].page != tt.page {
+				t.Fatalf("rendered %+v, want the %s page", f.pages.rendered, tt.page)
+			}
+			receipt := f.pages.rendered[0].receipt
+			switch {
+			case tt.ref == "" && receipt != nil:
+				t.Errorf("rendered receipt %+v, want none", receipt)
+			case tt.ref != "" && (receipt == nil || receipt.OrderRef != tt.ref):
+				t.Errorf("rendered receipt %+v, want order %s", receipt, tt.ref)
+			}
+			if got := len(f.orders.returned) == 1; got != tt.returned {
+				t.Errorf("return recorded = %v, want %v", got, tt.returned)
+			}
+			if len(f.incidents.problems) != tt.problems {
+				t.Errorf("problems %v, want %d", f.incidents.problems, tt.problems)
+			}
+		})
+	}
+}
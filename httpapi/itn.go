@@ -0,0 +1,129 @@
+package httpapi
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// EventPaymentNotification is emitted for every ITN, whether or not it
+// checked out, with a PaymentNotificationEvent.
+const EventPaymentNotification = "payment.notification_received"
+
+type PaymentNotificationEvent struct {
+	OrderID       string `json:"order_id"`
+	PfPaymentID   string `json:"pf_payment_id"`
+	PaymentStatus string `json:"payment_status"`
+	AmountGross   string `json:"amount_gross"`
+	Valid         bool   `json:"valid"`
+}
+
+type OrderData struct {
+	OrderID       string
+	PfPaymentID   string
+	PaymentStatus string
+	ItemName      string
+	AmountGross   string
+	Signature     string
+	// What the payment link told PayFast about the buyer.
+	NameFirst string
+	Email     string
+	OrderRef  string
+	// Verified is set by Notify once the PaymentVerifier has accepted the
+	// ITN; nothing PayFast posts can set it.
+	Verified bool
+}
+
+// ITNParam is one field of a PayFast ITN. PayFast signs the fields in the
+// order it sent them, so they're kept as a list rather than a map.
+type ITNParam struct {
+	Key   string
+	Value string
+}
+
+// ReadITNParams reads the notification fields from the POST body, falling
+// back to the query string for GET requests. raw is the encoded form, as
+// stored for the payment pipeline.
+func ReadITNParams(r *http.Request) (raw string, params []ITNParam, err error) {
+	raw = r.URL.RawQuery
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+		if err != nil {
+			return "", nil, fmt.Errorf("reading ITN body: %w", err)
+		}
+		raw = string(body)
+	}
+	params, err = ParseITNParams(raw)
+	return raw, params, err
+}
+
+func ParseITNParams(raw string) ([]ITNParam, error) {
+	var params []ITNParam
+	for _, pair := range strings.Split(raw, "&") {
+		if pair == "" {
+			continue
+		}
+		key, value, _ := strings.Cut(pair, "=")
+		key, err := url.QueryUnescape(key)
+		if err != nil {
+			return nil, fmt.Errorf("decoding ITN field %q: %w", key, err)
+		}
+		if value, err = url.QueryUnescape(value); err != nil {
+			return nil, fmt.Errorf("decoding ITN field %q: %w", key, err)
+		}
+		params = append(params, ITNParam{Key: key, Value: value})
+	}
+	return params, nil
+}
+
+func ITNValues(params []ITNParam) url.Values {
+	values := url.Values{}
+	for _, p := range params {
+		values.Add(p.Key, p.Value)
+	}
+	return values
+}
+
+func CompileOrderData(values url.Values) (OrderData, error) {
+	// Extract the orderID from the notification fields
+	orderID := values.Get("m_payment_id")
+	pfPaymentID := values.Get("pf_payment_id")
+	paymentStatus := values.Get("payment_status")
+	itemName := values.Get("item_name")
+
+	// Collect names of missing required fields
+	var missingFields []string
+	if orderID == "" {
+		missingFields = append(missingFields, "m_payment_id")
+	}
+	if pfPaymentID == "" {
+		missingFields = append(missingFields, "pf_payment_id")
+	}
+	if paymentStatus == "" {
+		missingFields = append(missingFields, "payment_status")
+	}
+	if itemName == "" {
+		missingFields = append(missingFields, "item_name")
+	}
+
+	// If any required fields are missing, return an error
+	if len(missingFields) > 0 {
+		return OrderData{}, fmt.Errorf("missing required order data: %s", strings.Join(missingFields, ", "))
+	}
+
+	orderData := OrderData{
+		OrderID:       orderID,
+		PfPaymentID:   pfPaymentID,
+		PaymentStatus: paymentStatus,
+		ItemName:      itemName,
+		AmountGross:   values.Get("amount_gross"),
+		Signature:     values.Get("signature"),
+		NameFirst:     values.Get("name_first"),
+		Email:         values.Get("email_address"),
+		OrderRef:      values.Get("custom_str1"),
+	}
+
+	return orderData, nil
+}